@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ALPN protocol routing
+//
+// ALPN (Application-Layer Protocol Negotiation) lets a TLS client list
+// the protocols it speaks in its ClientHello; the server picks one and
+// both sides know what comes after the handshake without another round
+// trip. It's how browsers and servers agree on HTTP/2.
+//
+// It's also a neat way to run several protocols on a single port: the
+// ALPNRouter terminates TLS, looks at the negotiated protocol and hands
+// the connection to the matching handler:
+//
+//	router := NewALPNRouter(ServerConfig(cert, nil))
+//	router.Handle("echo", echoHandler)
+//	router.Handle("tlv/1", tlvHandler)
+//	go http.Serve(router.Listener("http/1.1"), mux)
+//	router.Serve(ctx, listener)
+//
+// Protocols served by code that wants a net.Listener (net/http, for
+// one) get a virtual listener fed with the already-handshaken
+// connections. Clients that don't use ALPN at all go to Default.
+
+// ErrNoALPNHandler is logged for connections nobody handles
+var ErrNoALPNHandler = errors.New("no handler for negotiated protocol")
+
+// ALPNRouter dispatches TLS connections by negotiated protocol
+type ALPNRouter struct {
+	// Default handles connections without a negotiated protocol. When
+	// nil, they are closed.
+	Default ConnHandler
+
+	// HandshakeTimeout bounds the TLS handshake (defaults to 10s)
+	HandshakeTimeout time.Duration
+
+	// ErrorLog receives handshake and routing errors
+	ErrorLog *log.Logger
+
+	config *tls.Config
+
+	mu        sync.Mutex
+	protos    []string // Registration order, which is our preference
+	handlers  map[string]ConnHandler
+	listeners map[string]*alpnListener
+	server    *TCPServer
+}
+
+// NewALPNRouter returns a router terminating TLS with (a copy of) cfg.
+// cfg.NextProtos is managed by the router.
+func NewALPNRouter(cfg *tls.Config) *ALPNRouter {
+	r := &ALPNRouter{
+		handlers:  make(map[string]ConnHandler),
+		listeners: make(map[string]*alpnListener),
+	}
+
+	r.config = cfg.Clone()
+	r.config.NextProtos = nil
+	// Pick the protocol from the router's current table at handshake
+	// time, so protocols can be added while serving
+	r.config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := r.config.Clone()
+		c.GetConfigForClient = nil
+		c.NextProtos = r.protocols()
+		return c, nil
+	}
+
+	return r
+}
+
+// Handle registers h for connections negotiating proto
+func (r *ALPNRouter) Handle(proto string, h ConnHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.addProto(proto)
+	r.handlers[proto] = h
+}
+
+// addProto records proto in the preference list, mu must be held
+func (r *ALPNRouter) addProto(proto string) {
+	if !slices.Contains(r.protos, proto) {
+		r.protos = append(r.protos, proto)
+	}
+}
+
+// Listener returns a listener receiving the connections negotiating
+// proto. Closing it unregisters the protocol.
+func (r *ALPNRouter) Listener(proto string) net.Listener {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if l, ok := r.listeners[proto]; ok {
+		return l
+	}
+
+	l := &alpnListener{
+		router: r,
+		proto:  proto,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	r.addProto(proto)
+	r.listeners[proto] = l
+
+	return l
+}
+
+// protocols lists the registered protocols in registration order. Go
+// picks the first one of ours the client also offers, so this is the
+// server's preference.
+func (r *ALPNRouter) protocols() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.protos)
+}
+
+// Serve accepts connections on l until ctx is done or Shutdown is called
+func (r *ALPNRouter) Serve(ctx context.Context, l net.Listener) error {
+	r.mu.Lock()
+	r.server = NewTCPServer(l)
+	r.server.ErrorLog = r.ErrorLog
+	server := r.server
+	r.mu.Unlock()
+
+	return server.Serve(ctx, r.ServeConn)
+}
+
+// Shutdown stops the server started by Serve, see TCPServer.Shutdown
+func (r *ALPNRouter) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	server := r.server
+	r.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+
+	return server.Shutdown(ctx)
+}
+
+func (r *ALPNRouter) logf(format string, v ...any) {
+	if r.ErrorLog != nil {
+		r.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// ServeConn is the ConnHandler doing the routing; use it directly to
+// plug the router into another server
+func (r *ALPNRouter) ServeConn(ctx context.Context, conn net.Conn) {
+	tlsConn := tls.Server(conn, r.config)
+	info, err := TLSHandshake(ctx, tlsConn, r.HandshakeTimeout)
+	if err != nil {
+		r.logf("%v", err)
+		return
+	}
+
+	r.mu.Lock()
+	handler := r.handlers[info.ALPN]
+	listener := r.listeners[info.ALPN]
+	r.mu.Unlock()
+
+	switch {
+	case handler != nil:
+		handler(ctx, tlsConn)
+	case listener != nil:
+		listener.deliver(ctx, tlsConn)
+	case info.ALPN == "" && r.Default != nil:
+		r.Default(ctx, tlsConn)
+	default:
+		r.logf("%s: %q: %v", conn.RemoteAddr(), info.ALPN, ErrNoALPNHandler)
+	}
+}
+
+// alpnListener is the virtual listener of a single protocol
+type alpnListener struct {
+	router *ALPNRouter
+	proto  string
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// deliver hands conn to Accept and waits for the consumer to close it,
+// since the server closes the connection once the handler returns
+func (l *alpnListener) deliver(ctx context.Context, conn net.Conn) {
+	c := &closeNotifyConn{Conn: conn, closed: make(chan struct{})}
+
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		return
+	case <-ctx.Done():
+		return
+	}
+
+	select {
+	case <-c.closed:
+	case <-ctx.Done():
+	}
+}
+
+func (l *alpnListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *alpnListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+
+		r := l.router
+		r.mu.Lock()
+		if r.listeners[l.proto] == l {
+			delete(r.listeners, l.proto)
+			if r.handlers[l.proto] == nil {
+				r.protos = slices.DeleteFunc(r.protos, func(p string) bool { return p == l.proto })
+			}
+		}
+		r.mu.Unlock()
+	})
+
+	return nil
+}
+
+func (l *alpnListener) Addr() net.Addr {
+	l.router.mu.Lock()
+	defer l.router.mu.Unlock()
+
+	if l.router.server != nil {
+		return l.router.server.Addr()
+	}
+
+	return &net.TCPAddr{}
+}
+
+// closeNotifyConn signals when it's closed
+type closeNotifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.closed) })
+
+	return err
+}
+
+func TestALPNRouter(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := ca.Issue(TLSLeaf{Name: "router", Hosts: []string{"127.0.0.1"}})
+
+	router := NewALPNRouter(ServerConfig(cert, nil))
+	router.ErrorLog = log.New(io.Discard, "", 0)
+
+	// "echo": echo everything back
+	router.Handle("echo", func(_ context.Context, conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+
+	// "tlv/1": answer each TLV message with its reversed text
+	router.Handle("tlv/1", func(_ context.Context, conn net.Conn) {
+		for {
+			p, err := decode(conn)
+			if err != nil {
+				return
+			}
+			b := p.Bytes()
+			for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+				b[i], b[j] = b[j], b[i]
+			}
+			if _, err := String(b).WriteTo(conn); err != nil {
+				return
+			}
+		}
+	})
+
+	// Clients without ALPN get a greeting
+	router.Default = func(_ context.Context, conn net.Conn) {
+		_, _ = io.WriteString(conn, "hi")
+	}
+
+	// "http/1.1": a regular net/http server on a virtual listener
+	httpListener := router.Listener("http/1.1")
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello over "+r.Proto)
+	})}
+	go func() { _ = httpServer.Serve(httpListener) }()
+	defer httpServer.Close()
+
+	l := testListener(t)
+	go func() { _ = router.Serve(context.Background(), l) }()
+	defer func() { _ = router.Shutdown(context.Background()) }()
+
+	dial := func(protos ...string) *tls.Conn {
+		t.Helper()
+		cfg := ClientConfig(ca.Pool())
+		cfg.NextProtos = protos
+		conn, err := tls.Dial("tcp", l.Addr().String(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		return conn
+	}
+
+	echo := dial("echo")
+	defer echo.Close()
+	_, _ = echo.Write([]byte("ping"))
+	if b, err := ReadExactly(echo, 4); err != nil || string(b) != "ping" {
+		t.Errorf("echo: unexpected reply %q, %v", b, err)
+	}
+
+	tlv := dial("tlv/1")
+	defer tlv.Close()
+	_, _ = String("stressed").WriteTo(tlv)
+	if p, err := decode(tlv); err != nil || p.String() != "desserts" {
+		t.Errorf("tlv/1: unexpected reply %v, %v", p, err)
+	}
+
+	plain := dial()
+	defer plain.Close()
+	if b, err := ReadExactly(plain, 2); err != nil || string(b) != "hi" {
+		t.Errorf("default: unexpected reply %q, %v", b, err)
+	}
+
+	// Offered both, the client gets the one registered first
+	if proto := dial("tlv/1", "echo").ConnectionState().NegotiatedProtocol; proto != "echo" {
+		t.Errorf("expected echo; actual: %q", proto)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: ca.Pool(), NextProtos: []string{"http/1.1"}},
+	}}
+	resp, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); string(b) != "hello over HTTP/1.1" {
+		t.Errorf("http/1.1: unexpected body %q", b)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// ARP
+//
+// Before sending an IP packet to a neighbor, a host needs its Ethernet
+// address. ARP asks for it: a request broadcast to every host on the
+// link, "who has 192.0.2.1? tell 192.0.2.2", and a reply from the one
+// that does, sent back to the asker alone. The kernel does this on its
+// own and keeps the answers in its neighbor table (ip neigh); WhoHas
+// does it by hand, through a Capture (Capture.go), the way arping does,
+// and returns the address without going through the table.
+//
+// The same message, unasked, is a gratuitous ARP: a host telling the
+// link which Ethernet address an IP address is at. Every host that has
+// the IP address in its table updates it. That's how a service address
+// moves from one machine to another without the clients noticing: the
+// machine taking it over announces it, and the next packets go there
+// rather than to the failed one, instead of after the entries time out.
+// AnnounceARP sends such announcements, as requests for the address
+// itself (sender and target the same), which RFC 5227 recommends over
+// replies nobody asked for.
+//
+// ARP is IPv4 only; IPv6 has neighbor discovery, over ICMPv6, which
+// isn't done here. Both need the privileges of a capture, and an
+// Ethernet interface: loopback has no neighbors to ask.
+//
+//	golearn arp -i eth0 192.0.2.1
+//	golearn arp -i eth0 -announce 192.0.2.10
+
+const (
+	// arpAnnouncements and arpAnnounceInterval are RFC 5227's
+	// ANNOUNCE_NUM and ANNOUNCE_INTERVAL
+	arpAnnouncements    = 2
+	arpAnnounceInterval = 2 * time.Second
+
+	// arpRetry is how often WhoHas asks again, like arping
+	arpRetry = time.Second
+)
+
+// broadcastMAC is the Ethernet address of every host on the link
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// arpFilter is the BPF program keeping ARP frames only, with a VLAN tag
+// or without
+func arpFilter(snapLen int) []BPFInstruction {
+	a := &bpfAsm{jumps: make(map[int][2]string), labels: make(map[string]int)}
+	a.op(bpfLdAbsH, 12)
+	a.jump(bpfJeqK, EtherTypeARP, "accept", a.next())
+	a.jump(bpfJeqK, EtherTypeVLAN, a.next(), "reject")
+	a.op(bpfLdAbsH, 16)
+	a.jump(bpfJeqK, EtherTypeARP, "accept", "reject")
+	a.label("accept")
+	a.op(bpfRetK, uint32(snapLen))
+	a.label("reject")
+	a.op(bpfRetK, 0)
+
+	prog, _ := a.assemble() // The jumps are all short
+	return prog
+}
+
+// openARP opens a capture of the ARP frames of the interface named
+// iface, failing when the interface can't do ARP
+func openARP(iface string) (*Capture, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	if ifi.Flags&net.FlagLoopback != 0 || len(ifi.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("arp: %s isn't an Ethernet interface", iface)
+	}
+
+	return OpenCaptureBPF(iface, arpFilter(64), 64)
+}
+
+// interfaceIPv4 returns the IPv4 address of the interface in the same
+// network as ip, or its first IPv4 address, nil when it has none
+func interfaceIPv4(ifi *net.Interface, ip net.IP) net.IP {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	var first net.IP
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.To4() == nil {
+			continue
+		}
+		if n.Contains(ip) {
+			return n.IP.To4()
+		}
+		if first == nil {
+			first = n.IP.To4()
+		}
+	}
+
+	return first
+}
+
+// arpFrame returns the frame of an ARP message from the interface
+func arpFrame(ifi *net.Interface, dst net.HardwareAddr, arp *ARPHeader) ([]byte, error) {
+	p := &Packet{
+		Ethernet: EthernetHeader{Dst: dst, Src: ifi.HardwareAddr},
+		ARP:      arp,
+		Payload:  make([]byte, 60-14-arp.Len()), // The shortest frame, padded
+	}
+
+	return p.MarshalBinary()
+}
+
+// WhoHas returns the Ethernet address of ip, asking the hosts on the
+// link of the interface named iface until one replies or ctx is done.
+// The request comes from the interface's address in ip's network, or
+// from 0.0.0.0 when it has none, as an RFC 5227 probe.
+func WhoHas(ctx context.Context, iface string, ip net.IP) (net.HardwareAddr, error) {
+	target := ip.To4()
+	if target == nil {
+		return nil, fmt.Errorf("arp: %v isn't an IPv4 address", ip)
+	}
+	c, err := openARP(iface)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	sender := interfaceIPv4(c.Interface(), target)
+	if sender == nil {
+		sender = net.IPv4zero
+	}
+	request, err := arpFrame(c.Interface(), broadcastMAC, &ARPHeader{
+		Operation: ARPRequest,
+		SenderMAC: c.Interface().HardwareAddr,
+		SenderIP:  sender,
+		TargetIP:  target,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask again every arpRetry, the reads waking up to do it
+	next := time.Now()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("arp: no reply from %s: %w", target, err)
+		}
+		if now := time.Now(); !now.Before(next) {
+			if err := c.WriteFrame(request); err != nil {
+				return nil, err
+			}
+			next = now.Add(arpRetry)
+		}
+		deadline := next
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := c.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		f, err := c.ReadFrame()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		p, err := DecodePacket(f.Data)
+		if err != nil || p.ARP == nil {
+			continue
+		}
+		// A request from ip tells its address just as well
+		if p.ARP.SenderIP.Equal(target) && !bytes.Equal(p.ARP.SenderMAC, c.Interface().HardwareAddr) {
+			return append(net.HardwareAddr(nil), p.ARP.SenderMAC...), nil
+		}
+	}
+}
+
+// AnnounceARP tells the hosts on the link of the interface named iface
+// that ip is at its Ethernet address, arpAnnouncements times
+// arpAnnounceInterval apart, until ctx is done. The interface doesn't
+// need to have ip: announcing it is what moves it there for the others.
+func AnnounceARP(ctx context.Context, iface string, ip net.IP) error {
+	target := ip.To4()
+	if target == nil {
+		return fmt.Errorf("arp: %v isn't an IPv4 address", ip)
+	}
+	c, err := openARP(iface)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	announcement, err := arpFrame(c.Interface(), broadcastMAC, &ARPHeader{
+		Operation: ARPRequest,
+		SenderMAC: c.Interface().HardwareAddr,
+		SenderIP:  target,
+		TargetIP:  target,
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < arpAnnouncements; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(arpAnnounceInterval):
+			}
+		}
+		if err := c.WriteFrame(announcement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func arpMain(args []string) error {
+	fs := flag.NewFlagSet("arp", flag.ContinueOnError)
+	iface := fs.String("i", "", "`interface` to ask on")
+	timeout := fs.Duration("W", 3*time.Second, "`timeout` for a reply")
+	announce := fs.Bool("announce", false, "announce the address as this interface's rather than asking for it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *iface == "" || fs.NArg() != 1 {
+		return errors.New("usage: arp -i interface [flags] ip")
+	}
+	ip := net.ParseIP(fs.Arg(0))
+	if ip == nil {
+		return fmt.Errorf("invalid IP %q", fs.Arg(0))
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if *announce {
+		if err := AnnounceARP(ctx, *iface, ip); err != nil {
+			return err
+		}
+		fmt.Printf("announced %s on %s\n", ip, *iface)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	start := time.Now()
+	mac, err := WhoHas(ctx, *iface, ip)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is-at %s (%s)\n", ip, mac, time.Since(start).Round(time.Microsecond))
+
+	return nil
+}
+
+func TestARPFilter(t *testing.T) {
+	prog := arpFilter(64)
+
+	arp := testFrame(EtherTypeARP, make([]byte, 28))
+	tagged := testFrame(EtherTypeVLAN, []byte{0, 42, 0x08, 0x06}, make([]byte, 28))
+	udp := testFrame(EtherTypeIPv4, testIPv4(ProtocolUDP, 8), testUDP(5353, 53, 0))
+
+	for _, c := range []struct {
+		name     string
+		frame    []byte
+		expected uint32
+	}{{"arp", arp, 64}, {"tagged", tagged, 64}, {"udp", udp, 0}} {
+		if kept := runBPF(prog, c.frame); kept != c.expected {
+			t.Errorf("%s: expected %d bytes kept; actual: %d", c.name, c.expected, kept)
+		}
+	}
+}
+
+func TestARP(t *testing.T) {
+	ifi, ip, err := ethernetInterface()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// The announcements go out, and a capture on the interface sees
+	// them leave
+	c, err := openARP(ifi.Name)
+	if errors.Is(err, ErrCaptureUnsupported) || errors.Is(err, os.ErrPermission) {
+		t.Skip("can't capture here:", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// The first announcement only, the second after arpAnnounceInterval
+	go func() { _ = AnnounceARP(ctx, ifi.Name, ip) }()
+
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		f, err := c.ReadFrame()
+		if err != nil {
+			t.Fatal("expected an announcement:", err)
+		}
+		p, err := DecodePacket(f.Data)
+		if err != nil || p.ARP == nil || !p.ARP.TargetIP.Equal(ip) {
+			continue
+		}
+		if p.ARP.Operation != ARPRequest || !p.ARP.SenderIP.Equal(ip) || !bytes.Equal(p.ARP.SenderMAC, ifi.HardwareAddr) ||
+			!bytes.Equal(p.Ethernet.Dst, broadcastMAC) || len(f.Data) < 60 {
+			t.Errorf("unexpected announcement %v from %s to %s, %d bytes", p, p.Ethernet.Src, p.Ethernet.Dst, len(f.Data))
+		}
+		break
+	}
+
+	// Nobody has the first address of TEST-NET-3
+	whoCtx, whoCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer whoCancel()
+	if _, err := WhoHas(whoCtx, ifi.Name, net.IPv4(203, 0, 113, 1)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded; actual: %v", err)
+	}
+
+	if _, err := WhoHas(context.Background(), ifi.Name, net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("expected an IPv6 address to fail")
+	}
+}
+
+// ethernetInterface returns an Ethernet interface that's up, and its
+// IPv4 address
+func ethernetInterface() (*net.Interface, net.IP, error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 || len(ifi.HardwareAddr) != 6 {
+			continue
+		}
+		if ip := interfaceIPv4(&ifi, nil); ip != nil {
+			return &ifi, ip, nil
+		}
+	}
+
+	return nil, nil, errors.New("no Ethernet interface with an IPv4 address")
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Admin API
+//
+// Signals can ask a server to reload or stop, but not what it's doing.
+// The admin API is a small JSON over HTTP interface for the operator:
+//
+//	GET  /connections             open connections, by listener
+//	GET  /log                     the log level
+//	PUT  /log                     {"level": "debug"} changes it
+//	POST /listeners/{name}/drain  stop a listener, letting its
+//	                              connections finish
+//	POST /reload                  apply the configuration file again
+//	GET  /healthz, /readyz        liveness and readiness, see Health.go
+//
+// It's meant for a unix socket, whose file permissions decide who gets
+// in, and curl speaks it:
+//
+//	curl --unix-socket /run/golearn/admin.sock http://admin/connections
+//
+// It can listen on TCP too, for remote tooling, but only with a token
+// the client sends as "Authorization: Bearer <token>".
+//
+// Admin doesn't know about any server in particular: it calls the
+// functions it was given, and an endpoint without one answers 404.
+// "golearn serve" wires it to its listeners (echo, CONNECT and reverse
+// proxies); there are no TFTP transfers to list yet, TFTP.go only has
+// the packet types.
+
+// ErrUnknownListener is returned when draining a listener that isn't
+// there
+var ErrUnknownListener = errors.New("unknown listener")
+
+// Admin serves the admin API
+type Admin struct {
+	// Conns lists the open connections by listener
+	Conns func() map[string][]TrackedConnInfo
+
+	// Drain stops a listener from accepting and waits for its
+	// connections, within ctx
+	Drain func(ctx context.Context, listener string) error
+
+	// Reload applies the configuration again
+	Reload func() error
+
+	// Health reports the state of the server for /healthz and /readyz
+	Health func() HealthReport
+
+	// Level is the log level to adjust
+	Level *slog.LevelVar
+
+	// Token, when set, is required as a bearer token, except by the
+	// health endpoints
+	Token string
+
+	// ErrorLog receives the changes made through the API
+	ErrorLog *log.Logger
+}
+
+// AdminConn is a connection as listed by the admin API
+type AdminConn struct {
+	Listener   string `json:"listener"`
+	RemoteAddr string `json:"remote_addr"`
+	Age        string `json:"age"`
+	Idle       string `json:"idle"`
+}
+
+func (a *Admin) logf(format string, v ...any) {
+	if a.ErrorLog != nil {
+		a.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Handler returns the HTTP handler of the API
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", a.connections)
+	mux.HandleFunc("GET /log", a.getLevel)
+	mux.HandleFunc("PUT /log", a.setLevel)
+	mux.HandleFunc("POST /listeners/{name}/drain", a.drain)
+	mux.HandleFunc("POST /reload", a.reload)
+
+	health := http.NewServeMux()
+	if a.Health != nil {
+		health.HandleFunc("GET /healthz", healthHandler(a.Health, func(r HealthReport) bool { return r.Live }))
+		health.HandleFunc("GET /readyz", healthHandler(a.Health, func(r HealthReport) bool { return r.Ready }))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			health.ServeHTTP(w, r)
+			return
+		}
+		if a.Token != "" {
+			given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(a.Token)) != 1 {
+				writeAdminError(w, http.StatusUnauthorized, errors.New("invalid token"))
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// writeAdminJSON writes v as the response
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeAdminError writes {"error": "..."}
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+var errAdminUnsupported = errors.New("not supported by this server")
+
+func (a *Admin) connections(w http.ResponseWriter, _ *http.Request) {
+	if a.Conns == nil {
+		writeAdminError(w, http.StatusNotFound, errAdminUnsupported)
+		return
+	}
+
+	conns := []AdminConn{}
+	for listener, infos := range a.Conns() {
+		for _, info := range infos {
+			conns = append(conns, AdminConn{
+				Listener:   listener,
+				RemoteAddr: info.RemoteAddr,
+				Age:        info.Age.Round(time.Millisecond).String(),
+				Idle:       info.Idle.Round(time.Millisecond).String(),
+			})
+		}
+	}
+	slices.SortFunc(conns, func(a, b AdminConn) int {
+		if c := strings.Compare(a.Listener, b.Listener); c != 0 {
+			return c
+		}
+		return strings.Compare(a.RemoteAddr, b.RemoteAddr)
+	})
+
+	writeAdminJSON(w, http.StatusOK, conns)
+}
+
+// adminLevel is the body of /log
+type adminLevel struct {
+	Level string `json:"level"`
+}
+
+func (a *Admin) getLevel(w http.ResponseWriter, _ *http.Request) {
+	if a.Level == nil {
+		writeAdminError(w, http.StatusNotFound, errAdminUnsupported)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, adminLevel{a.Level.Level().String()})
+}
+
+func (a *Admin) setLevel(w http.ResponseWriter, r *http.Request) {
+	if a.Level == nil {
+		writeAdminError(w, http.StatusNotFound, errAdminUnsupported)
+		return
+	}
+
+	var body adminLevel
+	var level slog.Level
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.Level.Set(level)
+	a.logf("admin: log level set to %s", level)
+
+	writeAdminJSON(w, http.StatusOK, adminLevel{level.String()})
+}
+
+func (a *Admin) drain(w http.ResponseWriter, r *http.Request) {
+	if a.Drain == nil {
+		writeAdminError(w, http.StatusNotFound, errAdminUnsupported)
+		return
+	}
+
+	// The drain goes on when the client gives up waiting
+	name := r.PathValue("name")
+	a.logf("admin: draining %s", name)
+	err := a.Drain(context.WithoutCancel(r.Context()), name)
+	switch {
+	case errors.Is(err, ErrUnknownListener):
+		writeAdminError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeAdminError(w, http.StatusInternalServerError, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (a *Admin) reload(w http.ResponseWriter, _ *http.Request) {
+	if a.Reload == nil {
+		writeAdminError(w, http.StatusNotFound, errAdminUnsupported)
+		return
+	}
+
+	a.logf("admin: reloading")
+	if err := a.Reload(); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminService serves the admin API on l
+func AdminService(a *Admin, l net.Listener) Service {
+	srv := NewHTTPServer("", a.Handler())
+	srv.ErrorLog = a.ErrorLog
+
+	return HTTPService("admin "+l.Addr().String(), srv, l)
+}
+
+func TestAdmin(t *testing.T) {
+	var drained []string
+	reloads := 0
+	level := new(slog.LevelVar)
+	a := &Admin{
+		Conns: func() map[string][]TrackedConnInfo {
+			return map[string][]TrackedConnInfo{
+				"web":  {{RemoteAddr: "10.0.0.2:1000", Age: time.Second, Idle: time.Millisecond}},
+				"echo": {{RemoteAddr: "10.0.0.1:1000", Age: time.Minute}},
+			}
+		},
+		Drain: func(_ context.Context, name string) error {
+			if name != "echo" {
+				return ErrUnknownListener
+			}
+			drained = append(drained, name)
+			return nil
+		},
+		Reload: func() error {
+			if reloads++; reloads > 1 {
+				return errors.New("bad file")
+			}
+			return nil
+		},
+		Level:    level,
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+
+	// Over a unix socket, as intended
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := ListenUnix(sock, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	r := &Runner{ErrorLog: a.ErrorLog}
+	go func() { done <- r.Run(ctx, AdminService(a, l)) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", sock)
+		},
+	}}
+	call := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://admin"+path, strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(bytes.TrimSpace(b))
+	}
+
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+		response           string
+	}{
+		{"GET", "/connections", "", 200, `[{"listener":"echo","remote_addr":"10.0.0.1:1000","age":"1m0s","idle":"0s"},` +
+			`{"listener":"web","remote_addr":"10.0.0.2:1000","age":"1s","idle":"1ms"}]`},
+		{"GET", "/log", "", 200, `{"level":"INFO"}`},
+		{"PUT", "/log", `{"level": "debug"}`, 200, `{"level":"DEBUG"}`},
+		{"PUT", "/log", `{"level": "loud"}`, 400, ""},
+		{"POST", "/listeners/echo/drain", "", 204, ""},
+		{"POST", "/listeners/nope/drain", "", 404, ""},
+		{"POST", "/reload", "", 204, ""},
+		{"POST", "/reload", "", 500, `{"error":"bad file"}`},
+		{"GET", "/reload", "", 405, ""},
+	} {
+		status, body := call(c.method, c.path, c.body)
+		if status != c.status || (c.response != "" && body != c.response) {
+			t.Errorf("%s %s: unexpected %d %s", c.method, c.path, status, body)
+		}
+	}
+	if level.Level() != slog.LevelDebug || len(drained) != 1 || reloads != 2 {
+		t.Errorf("unexpected effects: level %s, drained %v, %d reloads", level.Level(), drained, reloads)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean stop; actual: %v", err)
+	}
+
+	// With a token, as over TCP
+	a.Token = "secret"
+	h := a.Handler()
+	for token, expected := range map[string]int{"": 401, "wrong": 401, "secret": 200} {
+		req, _ := http.NewRequest("GET", "/log", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Errorf("token %q: expected %d; actual: %d", token, expected, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Benchmarks
+//
+// The hot paths have Benchmark functions next to their tests, so that a
+// change making them slower shows up as a number rather than as a
+// feeling:
+//
+// - BenchmarkTLVEncode and BenchmarkTLVDecode (TLVTest.go): 4 KB
+//   payloads through WriteTo and decode
+// - BenchmarkTLVRoundTrip and BenchmarkTLVRoundTripSeparate
+//   (TLVTest.go): small frames echoed over TCP_NODELAY, written with
+//   writev and in three writes
+// - BenchmarkProxy (Proxy.go): bytes per second from a client through
+//   proxy to a server over loopback
+// - BenchmarkEchoServerUDP (UDPEcho.go): datagrams echoed per second
+// - BenchmarkData (TFTP.go): TFTP DATA blocks encoded and decoded
+// - BenchmarkCopyWithProgress (Read.go): buffer sizes for copying
+// - BenchmarkSendFile and BenchmarkSendFileUserspace (SendFile.go): a
+//   file to a socket with sendfile, and through a buffer
+// - BenchmarkMuxTCP and BenchmarkMuxSCTP (SCTP.go): small messages
+//   echoed over Mux streams, over TCP and over SCTP streams. Not in
+//   bench, where the kernel's SCTP is seldom loaded.
+//
+// Like the tests, they live in the sources rather than in _test.go
+// files, so go test doesn't see them ("no test files"). "golearn bench"
+// runs them from the binary, by the names in benchmarks below, and
+// profiles them for pprof:
+//
+//	go build && ./golearn bench -run 'proxy|tlv' -benchtime 5s > new.txt
+//	./golearn bench -run proxy -cpuprofile cpu.out -memprofile mem.out
+//	go tool pprof -top golearn cpu.out
+//
+// Comparing runs is by eye, or with diff: the output is one line per
+// benchmark, but not in the format benchstat reads.
+
+// benchmarks are the ones bench runs, by name. Those with
+// sub-benchmarks aren't here: testing.Benchmark only reports the top
+// one.
+var benchmarks = map[string]func(*testing.B){
+	"proxy":                  BenchmarkProxy,
+	"sendfile":               BenchmarkSendFile,
+	"sendfile-userspace":     BenchmarkSendFileUserspace,
+	"tftp-data":              BenchmarkData,
+	"tlv-decode":             BenchmarkTLVDecode,
+	"tlv-encode":             BenchmarkTLVEncode,
+	"tlv-roundtrip":          BenchmarkTLVRoundTrip,
+	"tlv-roundtrip-separate": BenchmarkTLVRoundTripSeparate,
+	"udp-echo":               BenchmarkEchoServerUDP,
+}
+
+func benchMain(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	run := fs.String("run", "", "only run the benchmarks matching `regexp`")
+	benchtime := fs.Duration("benchtime", time.Second, "run each benchmark for about `duration`")
+	cpuProfile := fs.String("cpuprofile", "", "write a CPU profile to `file`")
+	memProfile := fs.String("memprofile", "", "write an allocation profile to `file`")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: bench [flags]")
+	}
+	re, err := regexp.Compile(*run)
+	if err != nil {
+		return err
+	}
+
+	// testing.Benchmark reads its settings from the test flags
+	testing.Init()
+	if err := flag.Set("test.benchtime", benchtime.String()); err != nil {
+		return err
+	}
+
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	names := make([]string, 0, len(benchmarks))
+	for name := range benchmarks {
+		if re.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var failed []string
+	for _, name := range names {
+		r := testing.Benchmark(benchmarks[name])
+		if r.N == 0 {
+			fmt.Printf("%-12s FAILED\n", name)
+			failed = append(failed, name)
+			continue
+		}
+		fmt.Printf("%-12s %s\t%s\n", name, r, r.MemString())
+	}
+
+	if *memProfile != "" {
+		f, err := os.Create(*memProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		runtime.GC()
+		if err := pprof.Lookup("allocs").WriteTo(f, 0); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed: %v", failed)
+	}
+
+	return nil
+}
+
+func TestBenchMain(t *testing.T) {
+	// bench sets the benchtime of go test's own benchmarks as well
+	defer flag.Set("test.benchtime", flag.Lookup("test.benchtime").Value.String())
+
+	profile := t.TempDir() + "/cpu.out"
+	if err := benchMain([]string{"-run", "tlv-encode", "-benchtime", "10ms", "-cpuprofile", profile}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(profile); err != nil || fi.Size() == 0 {
+		t.Errorf("expected a CPU profile; actual: %v", err)
+	}
+
+	if err := benchMain([]string{"-run", "("}); err == nil {
+		t.Error("expected an invalid regexp to fail")
+	}
+}
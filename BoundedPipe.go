@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Bounded pipe with backpressure
+//
+// io.Pipe has no buffer at all: every Write blocks until a Read has
+// consumed it, which couples producer and consumer step by step. An
+// unbounded buffer (a bytes.Buffer and a goroutine) decouples them, but a
+// fast producer can then eat all the memory.
+//
+// BoundedPipe sits in between. Writes are buffered up to the high
+// watermark; once it is reached the writer blocks until the reader has
+// drained the buffer down to the low watermark. The gap between the two
+// avoids waking the writer up for every single byte the reader consumes.
+//
+// Closing works like io.Pipe: closing the writer lets the reader drain
+// what's buffered and then get io.EOF (or the CloseWithError error),
+// closing the reader makes pending and future writes fail.
+//
+// ExamplePinger talks to itself through one: with io.Pipe, a ping sent
+// after the last read blocks Pinger in Write, where it never sees its
+// context canceled.
+
+// BoundedPipeReader is the read half of a BoundedPipe
+type BoundedPipeReader struct{ p *boundedPipe }
+
+// BoundedPipeWriter is the write half of a BoundedPipe
+type BoundedPipeWriter struct{ p *boundedPipe }
+
+type boundedPipe struct {
+	mu   sync.Mutex
+	cond *sync.Cond // Signaled on every state change
+
+	buf       bytes.Buffer
+	high, low int
+	paused    bool // Writer waits for the buffer to drain to low
+
+	rerr error // Set when the reader is closed
+	werr error // Set when the writer is closed
+}
+
+// NewBoundedPipe creates a pipe buffering up to high bytes. A writer
+// blocked on a full buffer resumes once no more than low bytes are left.
+func NewBoundedPipe(high, low int) (*BoundedPipeReader, *BoundedPipeWriter) {
+	// Keep the watermarks sane: at least one byte of buffer and
+	// low strictly below high
+	high = max(high, 1)
+	low = min(max(low, 0), high-1)
+
+	p := &boundedPipe{high: high, low: low}
+	p.cond = sync.NewCond(&p.mu)
+
+	return &BoundedPipeReader{p}, &BoundedPipeWriter{p}
+}
+
+// Read reads buffered data, blocking while the pipe is empty
+func (r *BoundedPipeReader) Read(b []byte) (int, error) {
+	p := r.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.buf.Len() == 0 {
+		if p.rerr != nil {
+			return 0, io.ErrClosedPipe
+		}
+		if p.werr != nil {
+			return 0, p.werr
+		}
+		p.cond.Wait()
+	}
+
+	n, _ := p.buf.Read(b)
+
+	// Drained enough, let the writer go again
+	if p.paused && p.buf.Len() <= p.low {
+		p.paused = false
+	}
+	p.cond.Broadcast()
+
+	return n, nil
+}
+
+// Buffered returns how many bytes are waiting to be read
+func (r *BoundedPipeReader) Buffered() int {
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	return r.p.buf.Len()
+}
+
+// Close closes the reader; writes then fail with io.ErrClosedPipe
+func (r *BoundedPipeReader) Close() error {
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	r.p.rerr = io.ErrClosedPipe
+	r.p.cond.Broadcast()
+
+	return nil
+}
+
+// Write buffers b, blocking whenever the high watermark is reached
+func (w *BoundedPipeWriter) Write(b []byte) (int, error) {
+	p := w.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		// Wait for room (and for the low watermark if we hit the top)
+		for p.rerr == nil && p.werr == nil && (p.paused || p.buf.Len() >= p.high) {
+			if p.buf.Len() >= p.high {
+				p.paused = true
+			}
+			p.cond.Wait()
+		}
+		if p.rerr != nil {
+			return written, p.rerr
+		}
+		if p.werr != nil {
+			return written, io.ErrClosedPipe
+		}
+
+		// Only copy what fits below the high watermark
+		n := min(len(b)-written, p.high-p.buf.Len())
+		p.buf.Write(b[written : written+n])
+		written += n
+		p.cond.Broadcast()
+	}
+
+	return written, nil
+}
+
+// Close closes the writer; the reader gets io.EOF once drained
+func (w *BoundedPipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError closes the writer; the reader gets err (or io.EOF if
+// err is nil) once the buffered data has been read
+func (w *BoundedPipeWriter) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+
+	if w.p.werr == nil {
+		w.p.werr = err
+	}
+	w.p.cond.Broadcast()
+
+	return nil
+}
+
+func TestBoundedPipeWatermarks(t *testing.T) {
+	r, w := NewBoundedPipe(8, 2)
+
+	// The first 8 bytes fit, the 9th has to wait
+	wrote := make(chan struct{})
+	go func() {
+		defer close(wrote)
+		_, _ = w.Write([]byte("0123456789"))
+	}()
+
+	waitFor := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for r.Buffered() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d buffered bytes; actual: %d", n, r.Buffered())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(8)
+
+	// Draining to 4 is still above the low watermark, the writer
+	// stays paused
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	waitFor(4)
+
+	// Down to 2 bytes the writer resumes and adds its last 2 bytes
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+	<-wrote
+	waitFor(4)
+
+	_ = w.Close()
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "6789" {
+		t.Errorf("expected %q; actual: %q", "6789", rest)
+	}
+}
+
+func TestBoundedPipeClose(t *testing.T) {
+	r, w := NewBoundedPipe(4, 0)
+
+	// Closing the reader unblocks a writer waiting for room
+	errs := make(chan error)
+	go func() {
+		_, err := w.Write([]byte("too much data"))
+		errs <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	_ = r.Close()
+	if err := <-errs; err != io.ErrClosedPipe {
+		t.Errorf("expected io.ErrClosedPipe; actual: %v", err)
+	}
+
+	// CloseWithError is reported to the reader after the data
+	r, w = NewBoundedPipe(4, 0)
+	failed := errors.New("producer failed")
+	_, _ = w.Write([]byte("ok"))
+	_ = w.CloseWithError(failed)
+
+	b, err := io.ReadAll(r)
+	if string(b) != "ok" || err != failed {
+		t.Errorf("expected %q and producer error; actual: %q, %v", "ok", b, err)
+	}
+}
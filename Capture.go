@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Capturing frames
+//
+// Everything else in this repository sees the network through sockets,
+// after the kernel took the headers off. A capture sees the frames
+// themselves, every one going through an interface, the way tcpdump
+// does: through an AF_PACKET socket on linux, through a /dev/bpf device
+// on the BSDs and macOS. Both need privileges (root, or CAP_NET_RAW on
+// linux).
+//
+// Copying every frame to user space to throw most of them away would
+// cost more than the traffic itself, so the kernel filters them first,
+// running a classic BPF program on each: a few loads from the frame,
+// comparisons and jumps, returning how many bytes of it to keep, 0 for
+// none. CaptureFilter compiles the common cases (a protocol, a host, a
+// port) to such a program; anything fancier can be written by hand, or
+// taken from "tcpdump -dd".
+//
+// The frames come back with the time the kernel saw them; DecodePacket
+// (Headers.go) takes their headers apart and PcapWriter (Pcap.go)
+// saves them for Wireshark:
+//
+//	golearn capture -i lo -proto tcp -port 8080
+//	golearn capture -i eth0 -host 192.0.2.1 -c 100 -w out.pcap
+//
+// A capture can send frames too, crafted with Packet's MarshalBinary
+// (Headers.go), for the protocols below IP that no socket speaks: ARP.go
+// asks and announces addresses that way.
+//
+// Only Ethernet interfaces are supported (loopback on linux looks like
+// one), and the interface isn't put in promiscuous mode: the capture
+// sees the frames for this host, broadcasts and multicasts.
+
+// ErrCaptureUnsupported means frames can't be captured here
+var ErrCaptureUnsupported = errors.New("capture: not supported on this platform")
+
+// Frame is a captured frame
+type Frame struct {
+	Time   time.Time // When the kernel saw it
+	Data   []byte    // The frame, up to the snapshot length
+	Length int       // Its length on the wire
+}
+
+// BPFInstruction is a classic BPF instruction, as the kernel takes it
+// (struct sock_filter, struct bpf_insn)
+type BPFInstruction struct {
+	Op     uint16
+	Jt, Jf uint8 // Instructions skipped when the comparison is true or false
+	K      uint32
+}
+
+// Classic BPF opcodes
+const (
+	bpfLdAbsW  = 0x20 // A = frame[k:k+4]
+	bpfLdAbsH  = 0x28 // A = frame[k:k+2]
+	bpfLdAbsB  = 0x30 // A = frame[k]
+	bpfLdIndH  = 0x48 // A = frame[x+k:x+k+2]
+	bpfLdxMshB = 0xb1 // X = 4 * (frame[k] & 0xf), an IPv4 header length
+	bpfJa      = 0x05 // Jump k instructions
+	bpfJeqK    = 0x15 // Jump if A == k
+	bpfJsetK   = 0x45 // Jump if A & k != 0
+	bpfRetK    = 0x06 // Keep k bytes
+)
+
+// CaptureFilter selects the frames to capture. The zero value selects
+// all of them.
+type CaptureFilter struct {
+	Protocol string // "tcp", "udp" or "icmp", any when empty
+	Host     net.IP // Source or destination, any when nil
+	Port     int    // TCP or UDP source or destination port, any when 0
+}
+
+// String returns the filter in tcpdump's syntax
+func (f CaptureFilter) String() string {
+	var terms []string
+	if f.Protocol != "" {
+		terms = append(terms, f.Protocol)
+	}
+	if f.Host != nil {
+		terms = append(terms, "host "+f.Host.String())
+	}
+	if f.Port != 0 {
+		terms = append(terms, fmt.Sprintf("port %d", f.Port))
+	}
+
+	return strings.Join(terms, " and ")
+}
+
+// bpfAsm assembles a program whose jumps go to labels
+type bpfAsm struct {
+	ops    []BPFInstruction
+	jumps  map[int][2]string // Targets of the jumps, by index
+	labels map[string]int
+}
+
+func (a *bpfAsm) op(op uint16, k uint32) {
+	a.ops = append(a.ops, BPFInstruction{Op: op, K: k})
+}
+
+// jump compares A to k, going on to the label yes or no
+func (a *bpfAsm) jump(op uint16, k uint32, yes, no string) {
+	a.jumps[len(a.ops)] = [2]string{yes, no}
+	a.op(op, k)
+}
+
+// goTo jumps to the label
+func (a *bpfAsm) goTo(label string) {
+	a.jumps[len(a.ops)] = [2]string{label}
+	a.op(bpfJa, 0)
+}
+
+func (a *bpfAsm) label(name string) {
+	a.labels[name] = len(a.ops)
+}
+
+// next is a label for the instruction after a jump
+func (a *bpfAsm) next() string {
+	name := fmt.Sprintf(".%d", len(a.ops)+1)
+	a.labels[name] = len(a.ops) + 1
+
+	return name
+}
+
+func (a *bpfAsm) assemble() ([]BPFInstruction, error) {
+	offset := func(i int, label string) (int, error) {
+		to, ok := a.labels[label]
+		if !ok || to <= i || to-i-1 > 255 {
+			return 0, fmt.Errorf("capture: can't jump to %q", label)
+		}
+		return to - i - 1, nil
+	}
+
+	for i, targets := range a.jumps {
+		yes, err := offset(i, targets[0])
+		if err != nil {
+			return nil, err
+		}
+		if a.ops[i].Op == bpfJa {
+			a.ops[i].K = uint32(yes)
+			continue
+		}
+		no, err := offset(i, targets[1])
+		if err != nil {
+			return nil, err
+		}
+		a.ops[i].Jt, a.ops[i].Jf = uint8(yes), uint8(no)
+	}
+
+	return a.ops, nil
+}
+
+// Compile returns the BPF program of the filter for Ethernet frames,
+// keeping snapLen bytes of those it selects. IPv6 extension headers
+// aren't looked through, like tcpdump doesn't.
+func (f CaptureFilter) Compile(snapLen int) ([]BPFInstruction, error) {
+	var protocol4, protocol6 uint32
+	switch f.Protocol {
+	case "":
+	case "tcp":
+		protocol4, protocol6 = ProtocolTCP, ProtocolTCP
+	case "udp":
+		protocol4, protocol6 = ProtocolUDP, ProtocolUDP
+	case "icmp":
+		protocol4, protocol6 = ProtocolICMP, ProtocolICMPv6
+		if f.Port != 0 {
+			return nil, errors.New("capture: icmp has no ports")
+		}
+	default:
+		return nil, fmt.Errorf("capture: unknown protocol %q", f.Protocol)
+	}
+	if f.Port < 0 || f.Port > 65535 {
+		return nil, fmt.Errorf("capture: port %d", f.Port)
+	}
+	if snapLen <= 0 {
+		snapLen = defaultSnapLen
+	}
+
+	a := &bpfAsm{jumps: make(map[int][2]string), labels: make(map[string]int)}
+	if f.Protocol == "" && f.Host == nil && f.Port == 0 {
+		a.op(bpfRetK, uint32(snapLen))
+		return a.assemble()
+	}
+
+	v4, v6 := f.Host == nil || f.Host.To4() != nil, f.Host == nil || f.Host.To4() == nil
+	a.op(bpfLdAbsH, 12) // EtherType
+	switch {
+	case v4 && v6:
+		a.jump(bpfJeqK, EtherTypeIPv4, "ipv4", a.next())
+		a.jump(bpfJeqK, EtherTypeIPv6, "ipv6", "reject")
+	case v4:
+		a.jump(bpfJeqK, EtherTypeIPv4, "ipv4", "reject")
+	default:
+		a.jump(bpfJeqK, EtherTypeIPv6, "ipv6", "reject")
+	}
+
+	// The protocol, or TCP and UDP for a port, at offset
+	protocol := func(offset, protocol uint32) {
+		if protocol == 0 && f.Port == 0 {
+			return
+		}
+		a.op(bpfLdAbsB, offset)
+		if protocol != 0 {
+			a.jump(bpfJeqK, protocol, a.next(), "reject")
+			return
+		}
+		a.jump(bpfJeqK, ProtocolTCP, "ports"+fmt.Sprint(offset), a.next())
+		a.jump(bpfJeqK, ProtocolUDP, a.next(), "reject")
+		a.label("ports" + fmt.Sprint(offset))
+	}
+
+	if v4 {
+		a.label("ipv4")
+		if f.Host != nil {
+			host := binary.BigEndian.Uint32(f.Host.To4())
+			a.op(bpfLdAbsW, 14+12) // Source
+			a.jump(bpfJeqK, host, "host4", a.next())
+			a.op(bpfLdAbsW, 14+16) // Destination
+			a.jump(bpfJeqK, host, a.next(), "reject")
+			a.label("host4")
+		}
+		protocol(14+9, protocol4)
+		if f.Port != 0 {
+			// Fragments after the first have no ports
+			a.op(bpfLdAbsH, 14+6)
+			a.jump(bpfJsetK, 0x1fff, "reject", a.next())
+			a.op(bpfLdxMshB, 14)
+			a.op(bpfLdIndH, 14) // Source port, after the IPv4 header
+			a.jump(bpfJeqK, uint32(f.Port), "accept", a.next())
+			a.op(bpfLdIndH, 14+2)
+			a.jump(bpfJeqK, uint32(f.Port), "accept", "reject")
+		} else if v6 {
+			a.goTo("accept")
+		}
+	}
+
+	if v6 {
+		a.label("ipv6")
+		if f.Host != nil {
+			ip := f.Host.To16()
+			for i, offset := range []uint32{14 + 8, 14 + 24} { // Source, destination
+				mismatch := "reject"
+				if i == 0 {
+					mismatch = "dst6"
+				} else {
+					a.label("dst6")
+				}
+				for w := uint32(0); w < 4; w++ {
+					a.op(bpfLdAbsW, offset+4*w)
+					yes := a.next()
+					if w == 3 {
+						yes = "host6"
+					}
+					a.jump(bpfJeqK, binary.BigEndian.Uint32(ip[4*w:]), yes, mismatch)
+				}
+			}
+			a.label("host6")
+		}
+		protocol(14+6, protocol6)
+		if f.Port != 0 {
+			a.op(bpfLdAbsH, 14+40)
+			a.jump(bpfJeqK, uint32(f.Port), "accept", a.next())
+			a.op(bpfLdAbsH, 14+42)
+			a.jump(bpfJeqK, uint32(f.Port), "accept", "reject")
+		}
+	}
+
+	a.label("accept")
+	a.op(bpfRetK, uint32(snapLen))
+	a.label("reject")
+	a.op(bpfRetK, 0)
+
+	return a.assemble()
+}
+
+// runBPF runs a program the way the kernel does, for the opcodes
+// Compile uses: a load out of the frame rejects it
+func runBPF(prog []BPFInstruction, frame []byte) uint32 {
+	var a, x uint32
+	load := func(offset uint32, size int) bool {
+		if int(offset)+size > len(frame) {
+			return false
+		}
+		switch size {
+		case 1:
+			a = uint32(frame[offset])
+		case 2:
+			a = uint32(binary.BigEndian.Uint16(frame[offset:]))
+		default:
+			a = binary.BigEndian.Uint32(frame[offset:])
+		}
+		return true
+	}
+
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		ok := true
+		switch ins.Op {
+		case bpfLdAbsW:
+			ok = load(ins.K, 4)
+		case bpfLdAbsH:
+			ok = load(ins.K, 2)
+		case bpfLdAbsB:
+			ok = load(ins.K, 1)
+		case bpfLdIndH:
+			ok = load(x+ins.K, 2)
+		case bpfLdxMshB:
+			if int(ins.K) >= len(frame) {
+				return 0
+			}
+			x = 4 * uint32(frame[ins.K]&0xf)
+		case bpfJa:
+			pc += int(ins.K)
+		case bpfJeqK, bpfJsetK:
+			match := a == ins.K
+			if ins.Op == bpfJsetK {
+				match = a&ins.K != 0
+			}
+			if match {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case bpfRetK:
+			return ins.K
+		default:
+			return 0
+		}
+		if !ok {
+			return 0
+		}
+	}
+
+	return 0
+}
+
+// Capture captures the frames of an interface
+type Capture struct {
+	f        *os.File
+	ifi      *net.Interface
+	snapLen  int
+	buf      []byte
+	oob      []byte
+	pending  []byte // Frames read but not returned yet, from a BPF device
+	loopback bool
+}
+
+// OpenCapture starts capturing the frames of the interface named iface
+// that filter selects, keeping snapLen bytes of each, defaultSnapLen
+// when 0
+func OpenCapture(iface string, filter CaptureFilter, snapLen int) (*Capture, error) {
+	if snapLen <= 0 {
+		snapLen = defaultSnapLen
+	}
+	prog, err := filter.Compile(snapLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenCaptureBPF(iface, prog, snapLen)
+}
+
+// OpenCaptureBPF starts capturing the frames of the interface named
+// iface that the BPF program prog keeps
+func OpenCaptureBPF(iface string, prog []BPFInstruction, snapLen int) (*Capture, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	if snapLen <= 0 {
+		snapLen = defaultSnapLen
+	}
+
+	c := &Capture{ifi: ifi, snapLen: snapLen, loopback: ifi.Flags&net.FlagLoopback != 0}
+	if err := c.open(prog); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Interface returns the interface captured
+func (c *Capture) Interface() *net.Interface {
+	return c.ifi
+}
+
+// ReadFrame waits for the next frame
+func (c *Capture) ReadFrame() (Frame, error) {
+	return c.read()
+}
+
+// WriteFrame sends the Ethernet frame b out of the interface, as it is:
+// the source address isn't filled in
+func (c *Capture) WriteFrame(b []byte) error {
+	return c.write(b)
+}
+
+// SetReadDeadline sets the deadline of ReadFrame
+func (c *Capture) SetReadDeadline(t time.Time) error {
+	return c.f.SetReadDeadline(t)
+}
+
+// Close stops capturing; a pending ReadFrame returns an error
+func (c *Capture) Close() error {
+	return c.f.Close()
+}
+
+func captureMain(args []string) error {
+	fs := flag.NewFlagSet("capture", flag.ContinueOnError)
+	iface := fs.String("i", "", "`interface` to capture")
+	protocol := fs.String("proto", "", "only `protocol` frames: tcp, udp or icmp")
+	host := fs.String("host", "", "only frames from or to `ip`")
+	port := fs.Int("port", 0, "only TCP and UDP frames from or to `port`")
+	snapLen := fs.Int("snaplen", defaultSnapLen, "`bytes` kept of each frame")
+	count := fs.Int("c", 0, "stop after `n` frames, 0 for Ctrl+C")
+	out := fs.String("w", "", "write the frames to a pcap `file` rather than printing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *iface == "" || fs.NArg() != 0 {
+		return errors.New("usage: capture -i interface [flags]")
+	}
+
+	filter := CaptureFilter{Protocol: *protocol, Port: *port}
+	if *host != "" {
+		if filter.Host = net.ParseIP(*host); filter.Host == nil {
+			return fmt.Errorf("invalid IP %q", *host)
+		}
+	}
+	c, err := OpenCapture(*iface, filter, *snapLen)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var pcap *PcapWriter
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		bw := bufio.NewWriter(f)
+		defer bw.Flush()
+		if pcap, err = NewPcapWriter(bw, *snapLen, LinkTypeEthernet); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = c.Close() })
+	defer stop()
+
+	fmt.Fprintf(os.Stderr, "capturing on %s, %q\n", *iface, filter)
+	var n int
+	for *count == 0 || n < *count {
+		f, err := c.ReadFrame()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		n++
+
+		if pcap != nil {
+			if err := pcap.WriteFrame(f); err != nil {
+				return err
+			}
+			continue
+		}
+		p, err := DecodePacket(f.Data)
+		if err != nil {
+			fmt.Printf("%s %v (%v)\n", f.Time.Format("15:04:05.000000"), p, err)
+			continue
+		}
+		fmt.Printf("%s %v\n", f.Time.Format("15:04:05.000000"), p)
+	}
+	fmt.Fprintf(os.Stderr, "%d frames captured\n", n)
+
+	return nil
+}
+
+func TestCaptureFilter(t *testing.T) {
+	udp4 := testFrame(EtherTypeIPv4, testIPv4(ProtocolUDP, 8), testUDP(5353, 53, 0))
+	tcp4 := testFrame(EtherTypeIPv4, testIPv4(ProtocolTCP, 20), testTCP(40000, 80, TCPSyn))
+	tcp6 := testFrame(EtherTypeIPv6, testIPv6(ProtocolTCP, 20), testTCP(80, 40000, TCPAck))
+	icmp4 := testFrame(EtherTypeIPv4, testIPv4(ProtocolICMP, 8), make([]byte, 8))
+	arp := testFrame(EtherTypeARP, make([]byte, 28))
+
+	// A later fragment of a datagram whose ports look like 53
+	fragment := testFrame(EtherTypeIPv4, testIPv4(ProtocolUDP, 8), testUDP(53, 53, 0))
+	binary.BigEndian.PutUint16(fragment[14+6:], 185)
+
+	frames := map[string][]byte{"udp4": udp4, "tcp4": tcp4, "tcp6": tcp6, "icmp4": icmp4, "arp": arp, "fragment": fragment}
+	for _, c := range []struct {
+		filter   CaptureFilter
+		expected []string // The frames selected
+	}{
+		{CaptureFilter{}, []string{"arp", "fragment", "icmp4", "tcp4", "tcp6", "udp4"}},
+		{CaptureFilter{Protocol: "tcp"}, []string{"tcp4", "tcp6"}},
+		{CaptureFilter{Protocol: "icmp"}, []string{"icmp4"}},
+		{CaptureFilter{Port: 80}, []string{"tcp4", "tcp6"}},
+		{CaptureFilter{Port: 53}, []string{"udp4"}},
+		{CaptureFilter{Protocol: "tcp", Port: 53}, nil},
+		{CaptureFilter{Host: net.ParseIP("192.0.2.2")}, []string{"fragment", "icmp4", "tcp4", "udp4"}},
+		{CaptureFilter{Host: net.ParseIP("192.0.2.9")}, nil},
+		{CaptureFilter{Host: net.ParseIP("2001:db8::1"), Protocol: "tcp", Port: 80}, []string{"tcp6"}},
+		{CaptureFilter{Host: net.ParseIP("2001:db8::3")}, nil},
+	} {
+		prog, err := c.filter.Compile(96)
+		if err != nil {
+			t.Errorf("%q: %v", c.filter, err)
+			continue
+		}
+		for name, frame := range frames {
+			expected := uint32(0)
+			for _, e := range c.expected {
+				if e == name {
+					expected = 96
+				}
+			}
+			if kept := runBPF(prog, frame); kept != expected {
+				t.Errorf("%q: expected %d bytes of %s kept; actual: %d", c.filter, expected, name, kept)
+			}
+		}
+	}
+
+	for _, f := range []CaptureFilter{{Protocol: "sctp"}, {Protocol: "icmp", Port: 1}, {Port: 70000}} {
+		if _, err := f.Compile(0); err == nil {
+			t.Errorf("%q: expected an error", f)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	lo, err := loopbackInterface()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// A UDP socket on loopback, and a capture of its port only
+	conn := testPacketConn(t)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	c, err := OpenCapture(lo.Name, CaptureFilter{Protocol: "udp", Port: port}, 0)
+	if errors.Is(err, ErrCaptureUnsupported) || errors.Is(err, os.ErrPermission) {
+		t.Skip("can't capture here:", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Other traffic on loopback, which the filter leaves out
+	other := testPacketConn(t)
+	if _, err := other.WriteTo([]byte("not this"), other.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo([]byte("capture me"), conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	f, err := c.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DecodePacket(f.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.UDP == nil || int(p.UDP.DstPort) != port || string(p.Payload) != "capture me" || f.Length != len(f.Data) {
+		t.Errorf("unexpected frame %v, %q", p, p.Payload)
+	}
+	if f.Time.Before(start.Add(-time.Second)) || f.Time.After(time.Now()) {
+		t.Errorf("unexpected timestamp %v", f.Time)
+	}
+
+	// Once on loopback, not as sent and again as received
+	_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if f, err := c.ReadFrame(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected a timeout; actual: %d bytes, %v", len(f.Data), err)
+	}
+
+	// Close interrupts a pending read
+	_ = c.SetReadDeadline(time.Time{})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.ReadFrame()
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_ = c.Close()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("expected an error once closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("read not interrupted by Close")
+	}
+}
+
+// loopbackInterface returns the loopback interface
+func loopbackInterface() (*net.Interface, error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			return &ifi, nil
+		}
+	}
+
+	return nil, errors.New("no loopback interface")
+}
@@ -0,0 +1,140 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// open opens a BPF device on the interface, see Capture.go.
+//
+// Every /dev/bpfN serves one capture at a time, so the first free one
+// is taken, after /dev/bpf, which hands out a fresh one where the
+// system clones them. The ioctls go through package syscall's Bpf
+// functions, deprecated in favor of golang.org/x/net/bpf, which this
+// repository doesn't depend on.
+func (c *Capture) open(prog []BPFInstruction) error {
+	fd, err := openBPFDevice()
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		_ = syscall.Close(fd)
+		return os.NewSyscallError("ioctl", err)
+	}
+
+	// The buffer size can only be set before the interface
+	if _, err := syscall.SetBpfBuflen(fd, max(c.snapLen, 1<<20)); err != nil {
+		return fail(err)
+	}
+	if err := syscall.SetBpfInterface(fd, c.ifi.Name); err != nil {
+		return fail(err)
+	}
+	if dlt, err := syscall.BpfDatalink(fd); err != nil {
+		return fail(err)
+	} else if dlt != syscall.DLT_EN10MB {
+		_ = syscall.Close(fd)
+		return fmt.Errorf("%w: %s isn't an Ethernet interface", ErrCaptureUnsupported, c.ifi.Name)
+	}
+	// Deliver every frame as it comes rather than when the buffer is full
+	if err := syscall.SetBpfImmediate(fd, 1); err != nil {
+		return fail(err)
+	}
+	// Send frames with their source address, rather than the interface's
+	if err := syscall.SetBpfHeadercmpl(fd, 1); err != nil {
+		return fail(err)
+	}
+	filter := make([]syscall.BpfInsn, len(prog))
+	for i, ins := range prog {
+		filter[i] = syscall.BpfInsn{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	if err := syscall.SetBpf(fd, filter); err != nil {
+		return fail(err)
+	}
+	size, err := syscall.BpfBuflen(fd)
+	if err != nil {
+		return fail(err)
+	}
+
+	c.f = os.NewFile(uintptr(fd), "bpf")
+	c.buf = make([]byte, size) // Reads take the whole buffer or fail
+
+	return nil
+}
+
+// openBPFDevice opens the first free BPF device, non-blocking for the
+// poller
+func openBPFDevice() (int, error) {
+	const flags = syscall.O_RDWR | syscall.O_NONBLOCK | syscall.O_CLOEXEC
+
+	fd, err := syscall.Open("/dev/bpf", flags, 0)
+	if err == nil {
+		return fd, nil
+	}
+	for i := 0; i < 256; i++ {
+		fd, err = syscall.Open(fmt.Sprintf("/dev/bpf%d", i), flags, 0)
+		if err == nil {
+			return fd, nil
+		}
+		if !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+	}
+
+	return -1, os.NewSyscallError("open", err)
+}
+
+// bpfAlignment is BPF_ALIGNMENT, which the records of a read are
+// aligned on: a long on most BSDs, 4 bytes on darwin and openbsd
+var bpfAlignment = func() int {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "openbsd" {
+		return 4
+	}
+	return int(unsafe.Sizeof(uintptr(0)))
+}()
+
+// read returns the next frame of the last read, reading more once they
+// are all returned. A read returns as many frames as were waiting, each
+// behind a struct bpf_hdr.
+func (c *Capture) read() (Frame, error) {
+	for len(c.pending) == 0 {
+		n, err := c.f.Read(c.buf)
+		if err != nil {
+			return Frame{}, err
+		}
+		c.pending = c.buf[:n]
+	}
+
+	if len(c.pending) < int(unsafe.Sizeof(syscall.BpfHdr{})) {
+		c.pending = nil
+		return Frame{}, errors.New("capture: truncated BPF record")
+	}
+	h := (*syscall.BpfHdr)(unsafe.Pointer(&c.pending[0]))
+	start, end := int(h.Hdrlen), int(h.Hdrlen)+int(h.Caplen)
+	if end > len(c.pending) {
+		c.pending = nil
+		return Frame{}, errors.New("capture: truncated BPF record")
+	}
+
+	f := Frame{
+		Time:   time.Unix(int64(h.Tstamp.Sec), int64(h.Tstamp.Usec)*1000),
+		Data:   append([]byte(nil), c.pending[start:end]...),
+		Length: int(h.Datalen),
+	}
+	next := (end + bpfAlignment - 1) &^ (bpfAlignment - 1)
+	c.pending = c.pending[min(next, len(c.pending)):]
+
+	return f, nil
+}
+
+// write sends a frame through the device, in a single write
+func (c *Capture) write(b []byte) error {
+	_, err := c.f.Write(b)
+	return err
+}
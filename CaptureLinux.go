@@ -0,0 +1,108 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// open opens an AF_PACKET socket on the interface, see Capture.go.
+//
+// The socket is opened for no protocol, so nothing reaches it until
+// bind, once the filter is attached: opened for every protocol, it
+// would queue frames the filter never saw. The filter goes through
+// syscall.AttachLsf, deprecated in favor of golang.org/x/net/bpf,
+// which this repository doesn't depend on.
+func (c *Capture) open(prog []BPFInstruction) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+
+	filter := make([]syscall.SockFilter, len(prog))
+	for i, ins := range prog {
+		filter[i] = syscall.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	if err := syscall.AttachLsf(fd, filter); err != nil {
+		_ = syscall.Close(fd)
+		return os.NewSyscallError("setsockopt", err)
+	}
+	// The kernel's timestamp of each frame, as a control message
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMP, 1); err != nil {
+		_ = syscall.Close(fd)
+		return os.NewSyscallError("setsockopt", err)
+	}
+	sa := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: c.ifi.Index}
+	if err := syscall.Bind(fd, sa); err != nil {
+		_ = syscall.Close(fd)
+		return os.NewSyscallError("bind", err)
+	}
+
+	c.f = os.NewFile(uintptr(fd), "packet")
+	c.buf = make([]byte, c.snapLen)
+	c.oob = make([]byte, syscall.CmsgSpace(int(unsafe.Sizeof(syscall.Timeval{}))))
+
+	return nil
+}
+
+// read reads a frame from the socket. With MSG_TRUNC, recvmsg returns
+// the length of the frame, even when it copied less.
+func (c *Capture) read() (Frame, error) {
+	rc, err := c.f.SyscallConn()
+	if err != nil {
+		return Frame{}, err
+	}
+
+	for {
+		var n, oobn int
+		var from syscall.Sockaddr
+		var recvErr error
+		err = rc.Read(func(fd uintptr) bool {
+			n, oobn, _, from, recvErr = syscall.Recvmsg(int(fd), c.buf, c.oob, syscall.MSG_TRUNC)
+			return recvErr != syscall.EAGAIN
+		})
+		if err != nil {
+			return Frame{}, err
+		}
+		if recvErr != nil {
+			return Frame{}, os.NewSyscallError("recvmsg", recvErr)
+		}
+		// On loopback, every frame shows up as sent and again as
+		// received; tcpdump shows it once
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && c.loopback && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+
+		f := Frame{
+			Time:   time.Now(),
+			Data:   append([]byte(nil), c.buf[:min(n, len(c.buf))]...),
+			Length: n,
+		}
+		if msgs, err := syscall.ParseSocketControlMessage(c.oob[:oobn]); err == nil {
+			for _, m := range msgs {
+				if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SCM_TIMESTAMP &&
+					len(m.Data) >= int(unsafe.Sizeof(syscall.Timeval{})) {
+					tv := (*syscall.Timeval)(unsafe.Pointer(&m.Data[0]))
+					f.Time = time.Unix(tv.Unix())
+				}
+			}
+		}
+
+		return f, nil
+	}
+}
+
+// write sends a frame on the socket, bound to the interface
+func (c *Capture) write(b []byte) error {
+	_, err := c.f.Write(b)
+	return err
+}
+
+// htons puts v in network byte order, as sockaddr_ll wants its protocol
+func htons(v uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v))
+}
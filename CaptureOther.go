@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+// open fails: frames are captured on linux and the BSDs only, see
+// Capture.go
+func (c *Capture) open([]BPFInstruction) error {
+	return ErrCaptureUnsupported
+}
+
+// read fails, like open
+func (c *Capture) read() (Frame, error) {
+	return Frame{}, ErrCaptureUnsupported
+}
+
+// write fails, like open
+func (c *Capture) write([]byte) error {
+	return ErrCaptureUnsupported
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Chaos: bad networks on demand
+//
+// Loopback is fast, never drops anything and delivers every write in one
+// piece, so code tested only against it tends to assume all three. A
+// ChaosConn wraps any net.Conn and takes those assumptions away:
+//
+// - Latency and Jitter delay every write, like a long path would
+// - Bandwidth caps the bytes per second each way (a TokenBucket)
+// - MaxSegment splits writes into random pieces written one by one, so
+//   the peer's reads return arbitrary fragments of messages
+// - ResetRate resets the connection at random, possibly halfway through
+//   a write: the caller sees a partial write and ECONNRESET, the peer a
+//   RST, just like when a middlebox drops the connection
+//
+// The randomness comes from Seed, with a separate stream per direction,
+// so a failing test fails the same way every time it runs.
+
+// ErrChaosReset is returned once a ChaosConn has reset its connection.
+// It matches syscall.ECONNRESET, so retry logic treats it like the real
+// thing.
+var ErrChaosReset = fmt.Errorf("chaos: %w", syscall.ECONNRESET)
+
+// Chaos describes the trouble a ChaosConn causes; the zero value causes
+// none
+type Chaos struct {
+	Latency    time.Duration // Added to every write
+	Jitter     time.Duration // Random extra latency, up to Jitter
+	Bandwidth  int           // Bytes per second each way, 0 for unlimited
+	MaxSegment int           // Largest piece a write goes out in, 0 for whole
+	ResetRate  float64       // Chance per Read or Write of a reset
+	Seed       uint64
+}
+
+// chaosRand is a random stream safe for concurrent use
+type chaosRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (c *chaosRand) float() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.r.Float64()
+}
+
+// intN returns a number in [0, n)
+func (c *chaosRand) intN(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.r.IntN(n)
+}
+
+// ChaosConn is a net.Conn misbehaving as its Chaos says
+type ChaosConn struct {
+	net.Conn
+	chaos Chaos
+
+	readRand, writeRand *chaosRand
+	readBucket          *TokenBucket
+	writeBucket         *TokenBucket
+
+	// ctx ends bandwidth waits when the connection is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	reset  atomic.Bool
+}
+
+// NewChaosConn wraps conn
+func NewChaosConn(conn net.Conn, chaos Chaos) *ChaosConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &ChaosConn{
+		Conn:      conn,
+		chaos:     chaos,
+		readRand:  &chaosRand{r: rand.New(rand.NewPCG(chaos.Seed, 1))},
+		writeRand: &chaosRand{r: rand.New(rand.NewPCG(chaos.Seed, 2))},
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	if chaos.Bandwidth > 0 {
+		// A tenth of a second's worth may pass at once
+		burst := max(chaos.Bandwidth/10, 1)
+		c.readBucket = NewTokenBucket(float64(chaos.Bandwidth), burst)
+		c.writeBucket = NewTokenBucket(float64(chaos.Bandwidth), burst)
+	}
+
+	return c
+}
+
+// roll reports whether the connection should be reset now
+func (c *ChaosConn) roll(r *chaosRand) bool {
+	return c.chaos.ResetRate > 0 && r.float() < c.chaos.ResetRate
+}
+
+// resetConn aborts the connection so the peer gets a RST rather than a
+// FIN
+func (c *ChaosConn) resetConn() error {
+	c.reset.Store(true)
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	_ = c.Close()
+
+	return ErrChaosReset
+}
+
+// Read reads, unless it's time for a reset
+func (c *ChaosConn) Read(p []byte) (int, error) {
+	if c.reset.Load() {
+		return 0, ErrChaosReset
+	}
+	if c.roll(c.readRand) {
+		return 0, c.resetConn()
+	}
+
+	var r io.Reader = c.Conn
+	if c.readBucket != nil {
+		r = NewRateLimitedReader(c.ctx, c.Conn, c.readBucket)
+	}
+	n, err := r.Read(p)
+	if err != nil && c.reset.Load() {
+		err = ErrChaosReset
+	}
+
+	return n, err
+}
+
+// Write delays, throttles and splits p, possibly resetting the
+// connection partway through
+func (c *ChaosConn) Write(p []byte) (int, error) {
+	if c.reset.Load() {
+		return 0, ErrChaosReset
+	}
+
+	delay := c.chaos.Latency
+	if c.chaos.Jitter > 0 {
+		delay += time.Duration(c.writeRand.intN(int(c.chaos.Jitter)))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	// Where the write gets cut short, if it does
+	cut := -1
+	if c.roll(c.writeRand) {
+		cut = c.writeRand.intN(len(p) + 1)
+	}
+
+	var w io.Writer = c.Conn
+	if c.writeBucket != nil {
+		w = NewRateLimitedWriter(c.ctx, c.Conn, c.writeBucket)
+	}
+
+	var written int
+	for written < len(p) {
+		if written == cut {
+			return written, c.resetConn()
+		}
+
+		end := len(p)
+		if c.chaos.MaxSegment > 0 {
+			end = min(end, written+1+c.writeRand.intN(c.chaos.MaxSegment))
+		}
+		if cut > written {
+			end = min(end, cut)
+		}
+
+		n, err := w.Write(p[written:end])
+		written += n
+		if err != nil {
+			if c.reset.Load() {
+				err = ErrChaosReset
+			}
+			return written, err
+		}
+	}
+	if cut == len(p) {
+		return written, c.resetConn()
+	}
+
+	return written, nil
+}
+
+// Close closes the connection and ends any bandwidth wait
+func (c *ChaosConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// segmentRecorder remembers the size of every write
+type segmentRecorder struct {
+	net.Conn
+	mu     sync.Mutex
+	writes []int
+}
+
+func (s *segmentRecorder) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	s.writes = append(s.writes, len(p))
+	s.mu.Unlock()
+	return s.Conn.Write(p)
+}
+
+func TestChaosConnSegments(t *testing.T) {
+	client, server := tlvPair(t)
+	rec := &segmentRecorder{Conn: client}
+	conn := NewChaosConn(rec, Chaos{MaxSegment: 3, Seed: 1})
+
+	// A TLV message arrives intact however it's cut up
+	go func() {
+		_, _ = String("fragmented but whole").WriteTo(conn)
+	}()
+	msg, err := decode(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := msg.(*String); !ok || string(*s) != "fragmented but whole" {
+		t.Errorf("unexpected message %v", msg)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for _, n := range rec.writes {
+		if n < 1 || n > 3 {
+			t.Fatalf("unexpected segment sizes %v", rec.writes)
+		}
+	}
+}
+
+func TestChaosConnLatency(t *testing.T) {
+	client, server := tlvPair(t)
+	go func() { _, _ = io.Copy(io.Discard, server) }()
+
+	// 3 writes of 20-30ms each, then 30KB at 100KB/s: the first 10KB
+	// burst is free, the other 20KB take 200ms
+	conn := NewChaosConn(client, Chaos{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, _ = conn.Write([]byte("x"))
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("unexpected latency for 3 writes %s", elapsed)
+	}
+
+	conn = NewChaosConn(client, Chaos{Bandwidth: 100_000})
+	start = time.Now()
+	if _, err := conn.Write(make([]byte, 30_000)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("unexpected duration at 100KB/s %s", elapsed)
+	}
+}
+
+func TestChaosConnReset(t *testing.T) {
+	// The same seed resets at the same point
+	resetAfter := func() (int, int, error) {
+		client, server := tcpPair(t)
+		go func() { _, _ = io.Copy(io.Discard, server) }()
+
+		conn := NewChaosConn(client, Chaos{ResetRate: 0.1, Seed: 42})
+		for i := 0; ; i++ {
+			n, err := conn.Write(make([]byte, 100))
+			if err != nil {
+				return i, n, err
+			}
+		}
+	}
+	writes, partial, err := resetAfter()
+	if !errors.Is(err, syscall.ECONNRESET) || !IsTransient(err) {
+		t.Fatalf("expected a retryable ECONNRESET; actual: %v", err)
+	}
+	if w, p, _ := resetAfter(); w != writes || p != partial {
+		t.Errorf("expected a reset after %d writes and %d bytes; actual: %d, %d", writes, partial, w, p)
+	}
+
+	// The peer sees a reset too, not a clean EOF
+	client, server := tcpPair(t)
+	conn := NewChaosConn(client, Chaos{ResetRate: 1})
+	if _, err := conn.Write([]byte("hello")); !errors.Is(err, ErrChaosReset) {
+		t.Fatalf("expected ErrChaosReset; actual: %v", err)
+	}
+	if _, err := io.ReadAll(server); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("expected ECONNRESET at the peer; actual: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrChaosReset) {
+		t.Errorf("expected ErrChaosReset after the reset; actual: %v", err)
+	}
+}
+
+func TestChaosConnRetry(t *testing.T) {
+	// An echo server behind a connection that resets now and then
+	l := testListener(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// Each attempt sends 10 messages and needs all 10 echoes; a new
+	// seed per attempt makes the failures differ, and the first attempt
+	// always fails
+	p := RetryPolicy{Attempts: 20, Initial: time.Millisecond, Max: 5 * time.Millisecond}
+	attempts := 0
+	err := p.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		raw, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return err
+		}
+		chaos := Chaos{ResetRate: 0.1, MaxSegment: 4, Seed: uint64(attempts)}
+		if attempts == 1 {
+			chaos.ResetRate = 1
+		}
+		conn := NewChaosConn(raw, chaos)
+		defer conn.Close()
+
+		for i := 0; i < 10; i++ {
+			msg := fmt.Sprintf("message %d", i)
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				return err
+			}
+			b, err := ReadExactly(conn, len(msg))
+			if err != nil {
+				return err
+			}
+			if string(b) != msg {
+				return Permanent(fmt.Errorf("expected echo %q; actual: %q", msg, b))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected success after retries; actual: %v after %d attempts", err, attempts)
+	}
+	if attempts < 2 {
+		t.Errorf("expected at least one reset; actual: %d attempts", attempts)
+	}
+}
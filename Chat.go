@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Chat server
+//
+// A chat room is where the pieces so far meet:
+//
+// - TLV String payloads carry the messages, Control frames the heartbeats
+// - fan-out: every message goes to every client
+// - Pinger keeps quiet connections visibly alive, and IdleConn's read
+//   timeout drops clients whose heartbeats stopped (a crashed laptop
+//   sends no FIN, so nothing else would notice)
+//
+// The hard part of broadcasting is one slow client. If the server wrote
+// to every client in turn, a client that stopped reading (full TCP
+// buffers, a phone in a tunnel) would stall the room. Instead each
+// client gets a queue drained by its own writer goroutine; broadcasting
+// only enqueues, and a client whose queue is full is evicted rather than
+// waited for.
+//
+// The first String a client sends is its nickname. The server announces
+// joins and leaves as "* nick joined" and "* nick left", and relays
+// everything else as "nick: text", to the sender too, so every client
+// sees the same order.
+
+const (
+	defaultChatQueue     = 64
+	defaultChatHeartbeat = 15 * time.Second
+	chatMaxNick          = 32
+	chatMaxMessage       = 4 << 10
+)
+
+// ErrChatNick is returned for an unusable nickname
+var ErrChatNick = errors.New("chat: invalid nickname")
+
+// ChatServer is a single chat room
+type ChatServer struct {
+	// QueueSize is how many messages a client may fall behind before
+	// it's evicted (defaults to 64)
+	QueueSize int
+
+	// Heartbeat is the interval of the server's pings (defaults to 15s)
+	Heartbeat time.Duration
+
+	// IdleTimeout evicts clients silent for that long, heartbeats
+	// included (defaults to three heartbeats)
+	IdleTimeout time.Duration
+
+	// ErrorLog receives evictions and protocol errors
+	ErrorLog *log.Logger
+
+	mu      sync.Mutex
+	clients map[*chatClient]struct{}
+}
+
+// chatClient is a connected client
+type chatClient struct {
+	nick  string
+	conn  net.Conn
+	queue chan io.WriterTo
+
+	once sync.Once
+	gone chan struct{}
+}
+
+// evict disconnects the client; its ServeConn takes care of the rest
+func (c *chatClient) evict() {
+	c.once.Do(func() {
+		close(c.gone)
+		_ = c.conn.Close()
+	})
+}
+
+// chatQueueWriter lets Pinger enqueue heartbeats like any other message
+type chatQueueWriter struct{ c *chatClient }
+
+func (w chatQueueWriter) Write(p []byte) (int, error) {
+	select {
+	case w.c.queue <- Control(p):
+		return len(p), nil
+	case <-w.c.gone:
+		return 0, net.ErrClosed
+	default:
+		// A full queue is about to be evicted anyway
+		return 0, errors.New("chat: queue full")
+	}
+}
+
+func (s *ChatServer) logf(format string, v ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+func (s *ChatServer) heartbeat() time.Duration {
+	if s.Heartbeat > 0 {
+		return s.Heartbeat
+	}
+
+	return defaultChatHeartbeat
+}
+
+func (s *ChatServer) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+
+	return 3 * s.heartbeat()
+}
+
+// ServeConn runs a client's session; it's a ConnHandler
+func (s *ChatServer) ServeConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// Reads must arrive within the idle timeout, heartbeats included.
+	// Writes don't count: they succeed into the socket buffer long after
+	// the client is gone.
+	ic := &IdleConn{Conn: conn, ReadTimeout: s.idleTimeout(), WriteTimeout: s.idleTimeout()}
+
+	p, err := decode(ic)
+	if err != nil {
+		return
+	}
+	nick, ok := p.(*String)
+	if !ok || !validNick(nick.String()) {
+		s.logf("chat: %s: %v", conn.RemoteAddr(), ErrChatNick)
+		return
+	}
+
+	queueSize := s.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultChatQueue
+	}
+	c := &chatClient{
+		nick:  nick.String(),
+		conn:  conn,
+		queue: make(chan io.WriterTo, queueSize),
+		gone:  make(chan struct{}),
+	}
+	s.join(c)
+	defer s.leave(c)
+
+	stop := context.AfterFunc(ctx, c.evict)
+	defer stop()
+	go s.writeLoop(ctx, c, ic)
+
+	for {
+		p, err := decode(ic)
+		if err != nil {
+			if errors.Is(err, ErrIdle) || IsTimeout(err) {
+				s.logf("chat: %s: no heartbeat, disconnecting", c.nick)
+			}
+			return
+		}
+
+		switch p := p.(type) {
+		case *String:
+			if len(*p) > chatMaxMessage {
+				s.logf("chat: %s: message too long, dropped", c.nick)
+				continue
+			}
+			s.broadcast(String(c.nick + ": " + p.String()))
+		case *Control:
+			// A heartbeat; reading it was the point
+		}
+	}
+}
+
+// writeLoop drains the client's queue and sends its heartbeats
+func (s *ChatServer) writeLoop(ctx context.Context, c *chatClient, w io.Writer) {
+	defer c.evict()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reset := make(chan time.Duration, 1)
+	reset <- s.heartbeat()
+	go Pinger(ctx, chatQueueWriter{c}, reset)
+
+	for {
+		select {
+		case p := <-c.queue:
+			if _, err := p.WriteTo(w); err != nil {
+				return
+			}
+		case <-c.gone:
+			return
+		}
+	}
+}
+
+func (s *ChatServer) join(c *chatClient) {
+	s.mu.Lock()
+	if s.clients == nil {
+		s.clients = make(map[*chatClient]struct{})
+	}
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+
+	s.broadcast(String("* " + c.nick + " joined"))
+}
+
+func (s *ChatServer) leave(c *chatClient) {
+	c.evict()
+
+	s.mu.Lock()
+	_, ok := s.clients[c]
+	delete(s.clients, c)
+	s.mu.Unlock()
+
+	if ok {
+		s.broadcast(String("* " + c.nick + " left"))
+	}
+}
+
+// broadcast enqueues p for every client, evicting those that can't keep up
+func (s *ChatServer) broadcast(p io.WriterTo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.clients {
+		select {
+		case c.queue <- p:
+		default:
+			s.logf("chat: %s: too slow, evicting", c.nick)
+			c.evict()
+		}
+	}
+}
+
+// Clients returns the nicknames in the room
+func (s *ChatServer) Clients() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nicks := make([]string, 0, len(s.clients))
+	for c := range s.clients {
+		nicks = append(nicks, c.nick)
+	}
+
+	return nicks
+}
+
+func validNick(nick string) bool {
+	return nick != "" && len(nick) <= chatMaxNick && !strings.ContainsAny(nick, " :\r\n\t")
+}
+
+// ChatClient is a chat room member
+type ChatClient struct {
+	conn     net.Conn
+	wmu      sync.Mutex // Messages and heartbeats share the connection
+	messages chan string
+	cancel   context.CancelFunc
+}
+
+// DialChat joins the room at addr as nick
+func DialChat(ctx context.Context, addr, nick string, heartbeat time.Duration) (*ChatClient, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewChatClient(conn, nick, heartbeat)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewChatClient joins the room on conn, sending a heartbeat every
+// heartbeat (0 for the default), which must be well within the
+// server's idle timeout
+func NewChatClient(conn net.Conn, nick string, heartbeat time.Duration) (*ChatClient, error) {
+	if !validNick(nick) {
+		return nil, ErrChatNick
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &ChatClient{conn: conn, messages: make(chan string, defaultChatQueue), cancel: cancel}
+	if err := c.write(String(nick)); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if heartbeat <= 0 {
+		heartbeat = defaultChatHeartbeat
+	}
+	reset := make(chan time.Duration, 1)
+	reset <- heartbeat
+	go Pinger(ctx, chatClientPinger{c}, reset)
+	go c.readLoop()
+
+	return c, nil
+}
+
+// chatClientPinger sends Pinger's pings as Control frames
+type chatClientPinger struct{ c *ChatClient }
+
+func (p chatClientPinger) Write(b []byte) (int, error) {
+	return len(b), p.c.write(Control(b))
+}
+
+func (c *ChatClient) write(p io.WriterTo) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	_, err := p.WriteTo(c.conn)
+
+	return err
+}
+
+func (c *ChatClient) readLoop() {
+	defer close(c.messages)
+	defer c.cancel()
+
+	for {
+		p, err := decode(c.conn)
+		if err != nil {
+			return
+		}
+		if s, ok := p.(*String); ok {
+			c.messages <- s.String()
+		}
+	}
+}
+
+// Send posts text to the room
+func (c *ChatClient) Send(text string) error {
+	return c.write(String(text))
+}
+
+// Messages delivers the room's messages; it's closed when the
+// connection ends. Not reading it gets the client evicted.
+func (c *ChatClient) Messages() <-chan string {
+	return c.messages
+}
+
+// Close leaves the room
+func (c *ChatClient) Close() error {
+	c.cancel()
+
+	return c.conn.Close()
+}
+
+// expectChat reads messages until want arrives, skipping others
+func expectChat(t *testing.T, c *ChatClient, want string) {
+	t.Helper()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.Messages():
+			if !ok {
+				t.Fatalf("connection closed waiting for %q", want)
+			}
+			if msg == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+// startChatServer runs s on a TCP listener for a test
+func startChatServer(t *testing.T, s *ChatServer) string {
+	t.Helper()
+
+	s.ErrorLog = log.New(io.Discard, "", 0)
+	l := testListener(t)
+	srv := NewTCPServer(l)
+	srv.ErrorLog = s.ErrorLog
+	go func() { _ = srv.Serve(context.Background(), s.ServeConn) }()
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	return l.Addr().String()
+}
+
+func TestChatBroadcast(t *testing.T) {
+	addr := startChatServer(t, &ChatServer{})
+	ctx := context.Background()
+
+	var clients []*ChatClient
+	for _, nick := range []string{"alice", "bob", "carol"} {
+		c, err := DialChat(ctx, addr, nick, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		// Each client sees its own join once it's in the room
+		expectChat(t, c, "* "+nick+" joined")
+		clients = append(clients, c)
+	}
+
+	if err := clients[0].Send("hello, room"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients {
+		expectChat(t, c, "alice: hello, room")
+	}
+
+	_ = clients[2].Close()
+	expectChat(t, clients[0], "* carol left")
+
+	if _, err := DialChat(ctx, addr, "two words", 0); !errors.Is(err, ErrChatNick) {
+		t.Errorf("expected invalid nickname; actual: %v", err)
+	}
+}
+
+func TestChatEviction(t *testing.T) {
+	s := &ChatServer{QueueSize: 16, Heartbeat: 20 * time.Millisecond, IdleTimeout: 200 * time.Millisecond}
+	addr := startChatServer(t, s)
+
+	alice, err := DialChat(context.Background(), addr, "alice", 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	expectChat(t, alice, "* alice joined")
+
+	// A slow consumer: it joins over an unbuffered pipe and never reads,
+	// so its writer blocks right away and the queue fills up
+	slow, server := net.Pipe()
+	defer slow.Close()
+	go s.ServeConn(context.Background(), server)
+	if _, err := String("slow").WriteTo(slow); err != nil {
+		t.Fatal(err)
+	}
+	expectChat(t, alice, "* slow joined")
+
+	// Alice waits for the echo of each message, so only the stalled
+	// client's queue overflows. (Flooding faster than her own writer
+	// drains would get her evicted too.)
+	evicted := false
+	for i := 0; i < 20 && !evicted; i++ {
+		_ = alice.Send("spam")
+		for msg := range alice.Messages() {
+			evicted = evicted || msg == "* slow left"
+			if msg == "alice: spam" {
+				break
+			}
+		}
+	}
+	if !evicted {
+		t.Fatal("slow client not evicted")
+	}
+
+	// A dead client: it reads everything but its heartbeats stopped,
+	// like a machine that lost power mid-conversation
+	dead, server := net.Pipe()
+	defer dead.Close()
+	go s.ServeConn(context.Background(), server)
+	if _, err := String("dead").WriteTo(dead); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = io.Copy(io.Discard, dead) }()
+	expectChat(t, alice, "* dead joined")
+
+	start := time.Now()
+	expectChat(t, alice, "* dead left")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dead client noticed after %s", elapsed)
+	}
+
+	// Alice's heartbeats kept her in the room all along
+	if nicks := s.Clients(); len(nicks) != 1 || nicks[0] != "alice" {
+		t.Errorf("expected only alice left; actual: %v", nicks)
+	}
+}
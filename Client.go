@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Client
+//
+// Talking to a TLV server reliably takes five pieces of this repo wired
+// together: a dialer (within DefaultConnBudget), a RetryPolicy, a
+// ReconnectingConn to redial when the connection breaks, a Pinger so an
+// idle connection isn't dropped by the server or a NAT on the way, and
+// the TLV framing. Client is that wiring, behind two calls:
+//
+//	c := NewClient("backend:7000", &ClientOptions{TLS: ClientConfig(roots)})
+//	defer c.Close()
+//	reply, err := c.Request(ctx, String("status"))
+//	err = c.Send(ctx, Binary(event))
+//
+// - the connection is opened on first use, and again after it breaks:
+//   a call failing with a transient error or on a closed connection is
+//   retried under Retry, on a new connection
+// - Request sends a payload and returns the next one the server sends,
+//   one request at a time, since TLV has no request IDs; a request that
+//   failed takes its connection with it, so a late reply can't be
+//   mistaken for the next one's
+// - the heartbeats are Control "ping" frames, sent once the connection
+//   has been idle for Heartbeat, which TLVConn and the chat server skip
+//
+// A request whose reply was lost is sent again on the new connection:
+// make requests idempotent, or set Retry.Attempts to 1.
+
+// defaultClientTimeout bounds an attempt of a call
+const defaultClientTimeout = 10 * time.Second
+
+// ErrClientClosed is returned by the calls of a closed Client
+var ErrClientClosed = errors.New("client closed")
+
+// ClientOptions configure a Client; the zero value is usable
+type ClientOptions struct {
+	// Dial opens the connections, DefaultConnBudget.DialContext by
+	// default
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLS, when set, secures the connections. ServerName defaults to the
+	// host of the target.
+	TLS *tls.Config
+
+	// Retry paces the attempts of a call. Its Retryable defaults to
+	// IsTransient and IsClosed.
+	Retry RetryPolicy
+
+	// Heartbeat is how long a connection may stay idle before a ping,
+	// 30 seconds by default; negative sends none
+	Heartbeat time.Duration
+
+	// Metrics, when set, counts the heartbeats labeled with the target,
+	// see Heartbeat
+	Metrics *Metrics
+
+	// Timeout bounds each attempt of a call, 10 seconds by default
+	Timeout time.Duration
+}
+
+// Client calls a TLV server, see above
+type Client struct {
+	target string
+	opts   ClientOptions
+	conns  *ReconnectingConn
+	closed atomic.Bool
+
+	mu sync.Mutex // A request and its reply at a time
+}
+
+// NewClient returns a client of the TLV server at target. It connects
+// on first use.
+func NewClient(target string, opts *ClientOptions) *Client {
+	c := &Client{target: target}
+	if opts != nil {
+		c.opts = *opts
+	}
+
+	retry := c.opts.Retry
+	if retry.Retryable == nil {
+		retry.Retryable = isClientRetryable
+	}
+	c.conns = &ReconnectingConn{Dial: c.dial, Retry: retry}
+
+	return c
+}
+
+// isClientRetryable adds connections closed by the server, when it
+// restarts or drops idle ones, to IsTransient
+func isClientRetryable(err error) bool {
+	return IsTransient(err) || IsClosed(err)
+}
+
+// Send sends p, without waiting for anything back
+func (c *Client) Send(ctx context.Context, p io.WriterTo) error {
+	return c.conns.Do(ctx, func(ctx context.Context, conn net.Conn) error {
+		cc := conn.(*clientConn)
+		defer c.bound(ctx, cc)()
+
+		return cc.send(p)
+	})
+}
+
+// Request sends p and returns the reply, the next payload the server
+// sends
+func (c *Client) Request(ctx context.Context, p io.WriterTo) (Payload, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var reply Payload
+	err := c.conns.Do(ctx, func(ctx context.Context, conn net.Conn) error {
+		cc := conn.(*clientConn)
+		defer c.bound(ctx, cc)()
+
+		if err := cc.send(p); err != nil {
+			return err
+		}
+		for {
+			r, err := decode(cc)
+			if err != nil {
+				return err
+			}
+			// The server's own heartbeats
+			if _, ok := r.(*Control); ok {
+				continue
+			}
+			reply = r
+			return nil
+		}
+	})
+
+	return reply, err
+}
+
+// Close closes the connection; the calls after it fail with
+// ErrClientClosed
+func (c *Client) Close() error {
+	c.closed.Store(true)
+
+	return c.conns.Close()
+}
+
+// dial opens a connection to the target, secured if need be, and starts
+// its heartbeats
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	if c.closed.Load() {
+		return nil, Permanent(ErrClientClosed)
+	}
+
+	dial := c.opts.Dial
+	if dial == nil {
+		dial = DefaultConnBudget.DialContext
+	}
+	conn, err := dial(ctx, "tcp", c.target)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg := c.opts.TLS; cfg != nil {
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName, _, _ = net.SplitHostPort(c.target)
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	return newClientConn(conn, c.opts.Heartbeat, Heartbeat{Metrics: c.opts.Metrics, Name: c.target}), nil
+}
+
+// bound gives conn the deadline of an attempt, moved up to now when ctx
+// is done; the returned function lifts it
+func (c *Client) bound(ctx context.Context, conn net.Conn) func() {
+	timeout := c.opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultClientTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+
+	return func() {
+		stop()
+		_ = conn.SetDeadline(time.Time{})
+	}
+}
+
+// clientConn is a connection of a Client, with its Pinger
+type clientConn struct {
+	net.Conn
+	wmu   sync.Mutex // Payloads and heartbeats share the connection
+	reset chan time.Duration
+	stop  context.CancelFunc
+}
+
+func newClientConn(conn net.Conn, heartbeat time.Duration, h Heartbeat) *clientConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	cc := &clientConn{Conn: conn, reset: make(chan time.Duration, 1), stop: cancel}
+	if heartbeat >= 0 {
+		cc.reset <- heartbeat
+		go h.Ping(ctx, clientPinger{cc}, cc.reset)
+	}
+
+	return cc
+}
+
+// send writes p and puts off the next heartbeat
+func (cc *clientConn) send(p io.WriterTo) error {
+	if err := cc.write(p); err != nil {
+		return err
+	}
+	select {
+	case cc.reset <- 0:
+	default:
+	}
+
+	return nil
+}
+
+func (cc *clientConn) write(p io.WriterTo) error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+
+	_, err := p.WriteTo(cc.Conn)
+
+	return err
+}
+
+// Close stops the heartbeats and closes the connection
+func (cc *clientConn) Close() error {
+	cc.stop()
+
+	return cc.Conn.Close()
+}
+
+// clientPinger sends Pinger's pings as Control frames
+type clientPinger struct{ cc *clientConn }
+
+func (p clientPinger) Write(b []byte) (int, error) {
+	return len(b), p.cc.write(Control(b))
+}
+
+func TestClient(t *testing.T) {
+	// A TLV server acknowledging everything but events, over TLS
+	serverTLS, clientTLS := tlvTLSConfigs(t)
+	l := tls.NewListener(testListener(t), serverTLS)
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				_ = ServeTLV(TLVServer(conn, nil), func(_ *TLVConn, p Payload) (io.WriterTo, error) {
+					if strings.HasPrefix(p.String(), "event:") {
+						return nil, nil
+					}
+					return String("ack:" + p.String()), nil
+				})
+			}()
+		}
+	}()
+
+	clientTLS.ServerName = ""
+	metrics := new(Metrics)
+	c := NewClient(l.Addr().String(), &ClientOptions{
+		TLS:       clientTLS,
+		Retry:     RetryPolicy{Attempts: 3, Initial: time.Millisecond},
+		Heartbeat: 5 * time.Millisecond,
+		Metrics:   metrics,
+		Timeout:   time.Second,
+	})
+	defer c.Close()
+	ctx := context.Background()
+	request := func(msg string) {
+		t.Helper()
+		reply, err := c.Request(ctx, String(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.String() != "ack:"+msg {
+			t.Errorf("unexpected reply %q", reply)
+		}
+	}
+
+	// Idle long enough for a few heartbeats, which the server skips
+	request("one")
+	time.Sleep(30 * time.Millisecond)
+	request("two")
+	pings := metrics.Vars()["heartbeat_pings_total"].(map[string]any)
+	if n, _ := pings["name="+l.Addr().String()].(float64); n == 0 {
+		t.Error("expected heartbeats counted")
+	}
+	if err := c.Send(ctx, String("event:three")); err != nil {
+		t.Fatal(err)
+	}
+	request("four")
+	first := <-conns
+	if len(conns) != 0 {
+		t.Fatal("expected a single connection so far")
+	}
+
+	// The server hangs up; the next request goes through a new one
+	_ = first.Close()
+	request("five")
+	<-conns
+
+	// Not after Close
+	_ = c.Close()
+	if _, err := c.Request(ctx, String("six")); !errors.Is(err, ErrClientClosed) {
+		t.Errorf("expected the client closed; actual: %v", err)
+	}
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Configuration files
+//
+// The commands so far take a handful of flags, which is fine for
+// trying things out but not for running a proxy somewhere: the
+// listeners, where they forward to, which certificates they use and how
+// much they accept belong in a file that can be reviewed and deployed
+// next to the binary. "golearn serve -config golearn.yaml" reads one:
+//
+//	listeners:
+//	  - name: echo
+//	    kind: echo
+//	    addr: :7000
+//	    filter: office
+//	  - name: web
+//	    kind: reverse_proxy
+//	    addr: :8443
+//	    tls: site
+//	    backend: app
+//	backends:
+//	  app:
+//	    - http://10.0.0.1:8080
+//	    - http://10.0.0.2:8080
+//	tls:
+//	  site:
+//	    cert: /etc/golearn/site.pem
+//	    key: /etc/golearn/site.key
+//	filters:
+//	  office:
+//	    allow: [10.0.0.0/8]
+//	    deny: [10.66.0.0/16]
+//	limits:
+//	  max_conns_per_ip: 50
+//	  max_outbound_per_host: 100
+//	  shutdown_grace: 30s
+//	log:
+//	  output: syslog+tcp://logs.example.com:601
+//	  level: warn
+//	admin:
+//	  socket: /run/golearn/admin.sock
+//
+// JSON works as well (by file extension), and so does the YAML subset
+// described in ConfigYAML.go. Environment variables override single
+// values, named after the path to them: GOLEARN_LIMITS_MAX_CONNS_PER_IP,
+// GOLEARN_LOG_OUTPUT. That's how a container sets what differs between
+// deployments without a file per deployment, or keeps a secret like
+// GOLEARN_ADMIN_TOKEN out of the file.
+//
+// Loading fills in the defaults and validates everything at once, so a
+// broken file lists all its problems instead of the first one. Unknown
+// keys are errors: a typo in a limit should not silently disable it.
+// The same goes for a reload on SIGHUP (see Serve.go): a file that
+// doesn't load leaves the running configuration alone.
+
+// configEnvPrefix starts the environment variables read by LoadConfig
+const configEnvPrefix = "GOLEARN"
+
+// Listener kinds
+const (
+	kindEcho         = "echo"
+	kindConnectProxy = "connect_proxy"
+	kindForwardProxy = "forward_proxy"
+	kindReverseProxy = "reverse_proxy"
+	kindSNIRouter    = "sni_router"
+
+	// The inetd services (see Inetd.go)
+	kindDiscard = "discard"
+	kindDaytime = "daytime"
+	kindChargen = "chargen"
+	kindExec    = "exec"
+)
+
+// Config describes the services of "golearn serve"
+type Config struct {
+	Listeners []ListenerConfig        `json:"listeners"`
+	Backends  map[string][]string     `json:"backends"` // Upstream URLs by name
+	TLS       map[string]TLSConfig    `json:"tls"`      // Certificates by name
+	Filters   map[string]FilterConfig `json:"filters"`  // Peer filters by name
+	Limits    LimitsConfig            `json:"limits"`
+	Log       LogConfig               `json:"log"`
+	Admin     AdminConfig             `json:"admin"`
+}
+
+// ListenerConfig is a service on an address
+type ListenerConfig struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`    // echo, connect_proxy, forward_proxy, reverse_proxy, sni_router, or an inetd service
+	Network string `json:"network"` // tcp (default), udp (echo, discard and daytime only) or unix
+	Addr    string `json:"addr"`
+	TLS     string `json:"tls"`    // Name in Config.TLS
+	Filter  string `json:"filter"` // Name in Config.Filters
+
+	// Backend names the upstreams of a reverse_proxy in Config.Backends
+	Backend string `json:"backend"`
+
+	// Warm is the number of connections a reverse_proxy opens to each
+	// upstream as it starts; it's not ready until they are
+	Warm int `json:"warm"`
+
+	// Allow lists the targets ("host:port") a connect_proxy or a
+	// forward_proxy may reach, Credentials its "user:password"
+	Allow       []string `json:"allow"`
+	Credentials string   `json:"credentials"`
+
+	// Routes map the server names of an sni_router ("host", "*.domain"
+	// or "*" for the rest) to backend addresses ("host:port")
+	Routes map[string]string `json:"routes"`
+
+	// Command is the program of an exec listener and its arguments
+	Command []string `json:"command"`
+
+	// DenyJA3 lists the JA3 hashes of TLS clients to refuse, see
+	// Fingerprint.go
+	DenyJA3 []string `json:"deny_ja3"`
+
+	// Socket tunes the accepted TCP connections: Nagle, buffer sizes,
+	// quick ACKs (see SocketOptions.go)
+	Socket SocketOptions `json:"socket"`
+
+	// UPnP forwards the port on the LAN's router, to reach the listener
+	// from behind a home NAT (see UPnP.go)
+	UPnP bool `json:"upnp"`
+}
+
+// TLSConfig is a PEM certificate and key, and optionally the CA that
+// signs client certificates, which are then required
+type TLSConfig struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"client_ca"`
+}
+
+// FilterConfig are the networks ("10.0.0.0/8", or an address) whose
+// peers are allowed or denied, as a RuleSet (see NetFilter.go) reads
+// them
+type FilterConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// LimitsConfig are the TCPServer limits of the echo listeners, the
+// timeouts and the outbound connection budget
+type LimitsConfig struct {
+	MaxConnsPerIP  int      `json:"max_conns_per_ip"`
+	AcceptRate     float64  `json:"accept_rate"`
+	AcceptBurst    int      `json:"accept_burst"`
+	RequestTimeout Duration `json:"request_timeout"` // HTTP handlers, 30s by default
+	ShutdownGrace  Duration `json:"shutdown_grace"`  // 10s by default
+
+	// Outbound connections open at once, to a host and altogether, of
+	// the proxies and the upstream pool; 0 means no limit
+	MaxOutboundPerHost int `json:"max_outbound_per_host"`
+	MaxOutbound        int `json:"max_outbound"`
+}
+
+// LogConfig says where the logs go
+type LogConfig struct {
+	// Output is stderr (default), stdout, a file, a syslog server
+	// (syslog://host:port over UDP, syslog+tcp://host:port) or journald
+	Output string `json:"output"`
+
+	Level string   `json:"level"` // debug, info (default), warn or error
+	Stats Duration `json:"stats"` // Log the metrics this often, 0 never
+
+	// Peers is a CSV file of networks labeling clients with their
+	// country and ASN in logs and metrics, see Enrich.go
+	Peers string `json:"peers"`
+}
+
+// AdminConfig is where the admin API (see Admin.go) listens, if anywhere
+type AdminConfig struct {
+	Socket string `json:"socket"` // Unix socket, only for its owner
+	Addr   string `json:"addr"`   // TCP address, requires the token
+	Token  string `json:"token"`
+	Filter string `json:"filter"` // Name in Config.Filters, for addr
+
+	// Console is the TCP address of the control console (see
+	// Console.go), behind Filter as well, which requires ConsolePassword;
+	// ConsoleTLS names its certificate in Config.TLS
+	Console         string `json:"console"`
+	ConsolePassword string `json:"console_password"`
+	ConsoleTLS      string `json:"console_tls"`
+}
+
+// level parses Level
+func (l LogConfig) level() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(l.Level))
+
+	return level, err
+}
+
+// ruleSet returns the rules of the filter called name, nil (allowing
+// anyone) for none
+func (c *Config) ruleSet(name string) *RuleSet {
+	f, ok := c.Filters[name]
+	if !ok {
+		return nil
+	}
+	// Validate checked the networks
+	rules, _ := NewRuleSet(f.Allow, f.Deny)
+
+	return rules
+}
+
+// Duration is a time.Duration written as "1m30s" in configuration files
+type Duration time.Duration
+
+// UnmarshalJSON accepts a duration string or a number of nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("invalid duration %s", b)
+		}
+		*d = Duration(n)
+		return nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads the configuration file at path, applies the
+// environment overrides and the defaults, and validates the result
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := parseConfig(data, filepath.Ext(path), os.LookupEnv)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// parseConfig does the work of LoadConfig. ext is ".json", ".yaml" or
+// ".yml"; env looks up environment variables.
+func parseConfig(data []byte, ext string, env func(string) (string, bool)) (*Config, error) {
+	switch strings.ToLower(ext) {
+	case ".json":
+	case ".yaml", ".yml":
+		tree, err := parseYAML(data)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(tree); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown configuration format %q", ext)
+	}
+
+	cfg := new(Config)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+
+	if err := applyConfigEnv(reflect.ValueOf(cfg).Elem(), configEnvPrefix, env); err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// applyConfigEnv sets the scalar fields of the struct v from the
+// variables named prefix_FIELD, recursing into nested structs
+func applyConfigEnv(v reflect.Value, prefix string, env func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := applyConfigEnv(field, name, env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, ok := env(name)
+		if !ok {
+			continue
+		}
+		if err := setConfigField(field, s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setConfigField parses s into a scalar field. Lists of strings are
+// comma separated; other lists and maps only come from the file.
+func setConfigField(field reflect.Value, s string) error {
+	if field.Type() == reflect.TypeOf(Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return errors.New("can't be set from the environment")
+		}
+		field.Set(reflect.ValueOf(strings.Split(s, ",")))
+	default:
+		return errors.New("can't be set from the environment")
+	}
+
+	return nil
+}
+
+// setDefaults fills in what the file left out
+func (c *Config) setDefaults() {
+	for i := range c.Listeners {
+		if c.Listeners[i].Network == "" {
+			c.Listeners[i].Network = "tcp"
+		}
+	}
+	if c.Limits.RequestTimeout == 0 {
+		c.Limits.RequestTimeout = Duration(30 * time.Second)
+	}
+	if c.Limits.ShutdownGrace == 0 {
+		c.Limits.ShutdownGrace = Duration(defaultRunGrace)
+	}
+	if c.Log.Output == "" {
+		c.Log.Output = "stderr"
+	}
+	if c.Log.Level == "" {
+		c.Log.Level = "info"
+	}
+}
+
+// Validate reports every problem of the configuration
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, v ...any) {
+		errs = append(errs, fmt.Errorf(format, v...))
+	}
+
+	if len(c.Listeners) == 0 {
+		fail("no listeners")
+	}
+	names := make(map[string]bool)
+	for i, l := range c.Listeners {
+		where := fmt.Sprintf("listener %d", i)
+		if l.Name != "" {
+			where = fmt.Sprintf("listener %q", l.Name)
+		}
+
+		switch {
+		case l.Name == "":
+			fail("%s: missing name", where)
+		case names[l.Name]:
+			fail("%s: duplicate name", where)
+		}
+		names[l.Name] = true
+
+		if l.Addr == "" {
+			fail("%s: missing addr", where)
+		}
+		switch l.Network {
+		case "tcp", "unix":
+		case "udp":
+			if l.Kind != kindEcho && l.Kind != kindDiscard && l.Kind != kindDaytime {
+				fail("%s: only echo, discard and daytime listeners can use udp", where)
+			}
+			if l.TLS != "" {
+				fail("%s: tls needs a stream network", where)
+			}
+		default:
+			fail("%s: unknown network %q", where, l.Network)
+		}
+		if l.Socket != (SocketOptions{}) && l.Network != "tcp" {
+			fail("%s: socket options need tcp", where)
+		}
+		if l.Socket.SendBuffer < 0 || l.Socket.ReceiveBuffer < 0 {
+			fail("%s: socket buffers must not be negative", where)
+		}
+		if l.UPnP && l.Network == "unix" {
+			fail("%s: upnp needs tcp or udp", where)
+		}
+
+		switch l.Kind {
+		case kindEcho, kindDiscard, kindDaytime, kindChargen:
+		case kindExec:
+			if len(l.Command) == 0 || l.Command[0] == "" {
+				fail("%s: an exec listener needs a command", where)
+			}
+		case kindConnectProxy, kindForwardProxy:
+			if len(l.Allow) == 0 {
+				fail("%s: a %s needs an allow list", where, l.Kind)
+			}
+		case kindReverseProxy:
+			if _, ok := c.Backends[l.Backend]; !ok {
+				fail("%s: unknown backend %q", where, l.Backend)
+			}
+			if l.Warm < 0 {
+				fail("%s: warm must not be negative", where)
+			}
+		case kindSNIRouter:
+			if len(l.Routes) == 0 {
+				fail("%s: an sni_router needs routes", where)
+			}
+			if l.TLS != "" {
+				fail("%s: an sni_router passes tls through", where)
+			}
+			for name, backend := range l.Routes {
+				if _, _, err := net.SplitHostPort(backend); err != nil {
+					fail("%s: route %q: invalid backend %q", where, name, backend)
+				}
+			}
+		default:
+			fail("%s: unknown kind %q", where, l.Kind)
+		}
+		if l.Warm != 0 && l.Kind != kindReverseProxy {
+			fail("%s: warm is for a reverse_proxy", where)
+		}
+
+		if _, ok := c.TLS[l.TLS]; l.TLS != "" && !ok {
+			fail("%s: unknown tls %q", where, l.TLS)
+		}
+		if _, ok := c.Filters[l.Filter]; l.Filter != "" && !ok {
+			fail("%s: unknown filter %q", where, l.Filter)
+		}
+		if len(l.DenyJA3) > 0 && l.TLS == "" {
+			fail("%s: deny_ja3 needs tls", where)
+		}
+		for _, hash := range l.DenyJA3 {
+			if b, err := hex.DecodeString(hash); err != nil || len(b) != md5.Size {
+				fail("%s: invalid JA3 hash %q", where, hash)
+			}
+		}
+	}
+
+	for name, urls := range c.Backends {
+		if len(urls) == 0 {
+			fail("backend %q: no upstreams", name)
+		}
+		for _, raw := range urls {
+			if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				fail("backend %q: invalid upstream %q", name, raw)
+			}
+		}
+	}
+	for name, t := range c.TLS {
+		if t.Cert == "" || t.Key == "" {
+			fail("tls %q: cert and key are required", name)
+		}
+	}
+	for name, f := range c.Filters {
+		if _, err := NewRuleSet(f.Allow, f.Deny); err != nil {
+			fail("filter %q: %v", name, strings.ReplaceAll(err.Error(), "\n", ", "))
+		}
+	}
+
+	if c.Limits.MaxConnsPerIP < 0 || c.Limits.AcceptRate < 0 || c.Limits.AcceptBurst < 0 ||
+		c.Limits.MaxOutboundPerHost < 0 || c.Limits.MaxOutbound < 0 {
+		fail("limits: must not be negative")
+	}
+	if c.Limits.RequestTimeout < 0 || c.Limits.ShutdownGrace < 0 || c.Log.Stats < 0 {
+		fail("durations must not be negative")
+	}
+	if _, err := c.Log.level(); err != nil {
+		fail("log: %v", err)
+	}
+	if _, _, ok := syslogOutput(c.Log.Output); !ok && strings.HasPrefix(c.Log.Output, "syslog") && strings.Contains(c.Log.Output, "://") {
+		fail("log: invalid syslog output %q", c.Log.Output)
+	}
+	if c.Admin.Addr != "" && c.Admin.Token == "" {
+		fail("admin: addr needs a token")
+	}
+	if _, ok := c.Filters[c.Admin.Filter]; c.Admin.Filter != "" && !ok {
+		fail("admin: unknown filter %q", c.Admin.Filter)
+	}
+	if c.Admin.Console != "" && c.Admin.ConsolePassword == "" {
+		fail("admin: console needs a password")
+	}
+	if _, ok := c.TLS[c.Admin.ConsoleTLS]; c.Admin.ConsoleTLS != "" && !ok {
+		fail("admin: unknown console tls %q", c.Admin.ConsoleTLS)
+	}
+
+	return errors.Join(errs...)
+}
+
+func TestConfig(t *testing.T) {
+	yaml := `
+# Two listeners in front of one backend
+listeners:
+  - name: echo
+    kind: echo
+    addr: 127.0.0.1:7000
+    filter: office
+    socket:
+      nagle: true
+      send_buffer: 65536
+  - name: web
+    kind: reverse_proxy
+    addr: ":8443"
+    tls: site
+    backend: app
+backends:
+  app: [http://10.0.0.1:8080, http://10.0.0.2:8080]
+tls:
+  site:
+    cert: site.pem
+    key: site.key
+filters:
+  office:
+    allow: [10.0.0.0/8]
+    deny:
+      - 10.66.0.0/16
+limits:
+  max_conns_per_ip: 50
+  shutdown_grace: 30s
+`
+	jsonConfig := `{
+		"listeners": [
+			{"name": "echo", "kind": "echo", "addr": "127.0.0.1:7000", "filter": "office", "socket": {"nagle": true, "send_buffer": 65536}},
+			{"name": "web", "kind": "reverse_proxy", "addr": ":8443", "tls": "site", "backend": "app"}
+		],
+		"backends": {"app": ["http://10.0.0.1:8080", "http://10.0.0.2:8080"]},
+		"tls": {"site": {"cert": "site.pem", "key": "site.key"}},
+		"filters": {"office": {"allow": ["10.0.0.0/8"], "deny": ["10.66.0.0/16"]}},
+		"limits": {"max_conns_per_ip": 50, "shutdown_grace": "30s"}
+	}`
+	env := map[string]string{
+		"GOLEARN_LIMITS_ACCEPT_RATE": "100",
+		"GOLEARN_LOG_STATS":          "1m",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	fromYAML, err := parseConfig([]byte(yaml), ".yaml", lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := parseConfig([]byte(jsonConfig), ".json", lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("YAML and JSON differ:\n%+v\n%+v", fromYAML, fromJSON)
+	}
+
+	// Defaults and environment overrides
+	if fromYAML.Listeners[0].Network != "tcp" || fromYAML.Limits.RequestTimeout != Duration(30*time.Second) || fromYAML.Log.Output != "stderr" {
+		t.Errorf("defaults not applied: %+v", fromYAML)
+	}
+	if s := fromYAML.Listeners[0].Socket; !s.Nagle || s.SendBuffer != 64<<10 {
+		t.Errorf("unexpected socket options: %+v", s)
+	}
+	if fromYAML.Limits.AcceptRate != 100 || fromYAML.Log.Stats != Duration(time.Minute) || fromYAML.Limits.ShutdownGrace != Duration(30*time.Second) {
+		t.Errorf("unexpected limits and logging: %+v %+v", fromYAML.Limits, fromYAML.Log)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+
+	_, err := parseConfig([]byte(`{
+		"listeners": [
+			{"name": "a", "kind": "echo", "network": "udp", "addr": ":1", "tls": "missing", "socket": {"receive_buffer": -1}},
+			{"name": "a", "kind": "connect_proxy"},
+			{"name": "b", "kind": "reverse_proxy", "addr": ":2", "backend": "app", "filter": "home", "deny_ja3": ["abc"], "warm": -1},
+			{"name": "c", "kind": "sni_router", "addr": ":3"},
+			{"name": "d", "kind": "sni_router", "addr": ":4", "tls": "site", "routes": {"*": "backend"}},
+			{"name": "e", "kind": "echo", "network": "unix", "addr": "/run/echo.sock", "upnp": true},
+			{"name": "f", "kind": "chargen", "network": "udp", "addr": ":19"},
+			{"name": "g", "kind": "exec", "addr": ":79", "warm": 2},
+			{"name": "h", "kind": "forward_proxy", "addr": ":3128"}
+		],
+		"tls": {"site": {"cert": "cert.pem", "key": "key.pem"}},
+		"backends": {"other": ["ftp://x"]},
+		"limits": {"max_conns_per_ip": -1},
+		"filters": {"lab": {"allow": ["10.0.0.0/8"], "deny": ["10.66.0.0/33", "lab"]}},
+		"log": {"level": "loud", "output": "syslog+sctp://collector"},
+		"admin": {"addr": ":9000", "filter": "office", "console": ":7070", "console_tls": "none"}
+	}`), ".json", noEnv)
+	for _, expected := range []string{
+		`listener "a": tls needs a stream network`,
+		`listener "a": unknown tls "missing"`,
+		`listener "a": socket options need tcp`,
+		`listener "a": socket buffers must not be negative`,
+		`listener "a": duplicate name`,
+		`listener "a": missing addr`,
+		`listener "a": a connect_proxy needs an allow list`,
+		`listener "b": unknown backend "app"`,
+		`listener "b": unknown filter "home"`,
+		`listener "b": deny_ja3 needs tls`,
+		`listener "b": invalid JA3 hash "abc"`,
+		`listener "b": warm must not be negative`,
+		`listener "c": an sni_router needs routes`,
+		`listener "d": an sni_router passes tls through`,
+		`listener "d": route "*": invalid backend "backend"`,
+		`listener "e": upnp needs tcp or udp`,
+		`listener "f": only echo, discard and daytime listeners can use udp`,
+		`listener "g": an exec listener needs a command`,
+		`listener "g": warm is for a reverse_proxy`,
+		`listener "h": a forward_proxy needs an allow list`,
+		`backend "other": invalid upstream "ftp://x"`,
+		`limits: must not be negative`,
+		`log: slog: level string "loud": unknown name`,
+		`log: invalid syslog output "syslog+sctp://collector"`,
+		`filter "lab": invalid network "10.66.0.0/33", invalid network "lab"`,
+		`admin: addr needs a token`,
+		`admin: unknown filter "office"`,
+		`admin: console needs a password`,
+		`admin: unknown console tls "none"`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %v", expected, err)
+		}
+	}
+
+	// A typo is an error rather than a silently missing limit
+	_, err = parseConfig([]byte(`{"listeners": [{"name": "e", "kind": "echo", "addr": ":1"}], "limits": {"max_conn_per_ip": 5}}`), ".json", noEnv)
+	if err == nil || !strings.Contains(err.Error(), "max_conn_per_ip") {
+		t.Errorf("expected an unknown field error; actual: %v", err)
+	}
+}
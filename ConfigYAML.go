@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A YAML subset
+//
+// The standard library has no YAML, and configuration files are where
+// people expect it. Full YAML is a big language (anchors, tags, multi
+// document streams, a dozen ways to write a string), but configuration
+// files use a small part of it, which parseYAML understands:
+//
+//	# comments, also at the end of a line
+//	key: value                  # mappings, nested by indentation
+//	list:
+//	  - item                    # block sequences
+//	  - name: x                 # of mappings too
+//	    addr: ":1"
+//	flow: [a, b, "c d"]         # flow sequences of scalars
+//	quoted: "with \"escapes\""  # double quoted (Go escapes), 'single'
+//
+// Scalars become bools (true, false), null, integers, floats or
+// strings, in that order of preference, so the result marshals to the
+// JSON the same document would have been written as. Anything beyond
+// the subset (tabs for indentation, flow mappings, multi-line strings)
+// is an error rather than a guess.
+
+// yamlLine is a line without its indentation and comment
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// yamlParser walks the lines of a document
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML parses a document into maps, slices and scalars
+func parseYAML(data []byte) (any, error) {
+	p := new(yamlParser)
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, " \r")
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("yaml line %d: tabs can't indent", i+1)
+		}
+		text = strings.TrimRight(stripYAMLComment(text), " ")
+		if text == "" || text == "---" {
+			continue
+		}
+		p.lines = append(p.lines, yamlLine{number: i + 1, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+	if len(p.lines) == 0 {
+		return map[string]any{}, nil
+	}
+
+	v, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+
+	return v, nil
+}
+
+// stripYAMLComment removes a comment, minding quotes
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return s[:i]
+		}
+	}
+
+	return s
+}
+
+func (p *yamlParser) errorf(format string, v ...any) error {
+	line := p.lines[min(p.pos, len(p.lines)-1)].number
+	return fmt.Errorf("yaml line %d: %s", line, fmt.Sprintf(format, v...))
+}
+
+// isYAMLItem reports whether text starts a sequence item
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// block parses the mapping or sequence at indent
+func (p *yamlParser) block(indent int) (any, error) {
+	if isYAMLItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+
+	return p.mapping(indent)
+}
+
+// mapping parses "key: value" lines at indent
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := make(map[string]any)
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+		if isYAMLItem(line.text) {
+			return nil, p.errorf("sequence item in a mapping")
+		}
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, p.errorf("expected key: value")
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		p.pos++
+
+		if rest != "" {
+			v, err := parseYAMLValue(rest)
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			m[key] = v
+			continue
+		}
+
+		// The value is the block below, which may be a sequence at the
+		// key's own indentation
+		switch {
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			v, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLItem(p.lines[p.pos].text):
+			v, err := p.sequence(indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		default:
+			m[key] = nil
+		}
+	}
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+
+	return m, nil
+}
+
+// sequence parses "- item" lines at indent
+func (p *yamlParser) sequence(indent int) (any, error) {
+	s := []any{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isYAMLItem(p.lines[p.pos].text) {
+		line := p.lines[p.pos]
+		content := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+
+		switch {
+		case content == "":
+			// The item is the block below
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				s = append(s, nil)
+				continue
+			}
+			v, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+		case isYAMLItem(content):
+			// "- - a": a sequence in a sequence, on one line
+			return nil, p.errorf("nested sequence item")
+		case isYAMLMappingStart(content):
+			// "- key: value": a mapping whose keys line up with the
+			// first one, so parse the line again as if it started there
+			p.lines[p.pos] = yamlLine{number: line.number, indent: line.indent + len(line.text) - len(content), text: content}
+			v, err := p.mapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+		default:
+			v, err := parseYAMLValue(content)
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			s = append(s, v)
+			p.pos++
+		}
+	}
+
+	return s, nil
+}
+
+// isYAMLMappingStart reports whether an item's content is "key: ..."
+func isYAMLMappingStart(content string) bool {
+	if strings.HasPrefix(content, `"`) || strings.HasPrefix(content, "'") || strings.HasPrefix(content, "[") {
+		return false
+	}
+	_, _, ok := splitYAMLKey(content)
+
+	return ok
+}
+
+// splitYAMLKey splits "key: value" and "key:"
+func splitYAMLKey(text string) (key, rest string, ok bool) {
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			key = strings.TrimSpace(text[:i])
+			if uq, err := strconv.Unquote(key); err == nil {
+				key = uq
+			}
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+
+	return "", "", false
+}
+
+// parseYAMLValue parses an inline value: a flow sequence or a scalar
+func parseYAMLValue(s string) (any, error) {
+	if !strings.HasPrefix(s, "[") {
+		return parseYAMLScalar(s)
+	}
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated flow sequence %s", s)
+	}
+
+	items := []any{}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	if inner == "" {
+		return items, nil
+	}
+	for _, item := range splitYAMLFlow(inner) {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.ContainsAny(item[:1], "[]{}") {
+			return nil, fmt.Errorf("unsupported flow sequence %s", s)
+		}
+		v, err := parseYAMLScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+
+	return items, nil
+}
+
+// splitYAMLFlow splits the inside of a flow sequence at the commas
+// outside quotes
+func splitYAMLFlow(s string) []string {
+	var items []string
+	var quote byte
+	begin := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[begin:i])
+			begin = i + 1
+		}
+	}
+
+	return append(items, s[begin:])
+}
+
+// parseYAMLScalar parses a quoted or plain scalar
+func parseYAMLScalar(s string) (any, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "{") || strings.HasPrefix(s, "&") || strings.HasPrefix(s, "*") ||
+		strings.HasPrefix(s, "!") || s == "|" || s == ">":
+		return nil, fmt.Errorf("unsupported YAML: %s", s)
+	}
+
+	switch s {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+
+	return s, nil
+}
+
+func TestParseYAML(t *testing.T) {
+	doc := `
+# A comment
+name: "quoted \" # not a comment"
+port: 8080
+ratio: 0.5
+on: true
+nothing:
+plain: hello world # trailing comment
+list:
+- a
+- 2
+nested:
+  flow: [x, "y, z", 'it''s']
+  items:
+    - name: first
+      addr: ":1"
+    -
+      name: second
+    - [1, 2]
+`
+	v, err := parseYAML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]any{
+		"name":    "quoted \" # not a comment",
+		"port":    int64(8080),
+		"ratio":   0.5,
+		"on":      true,
+		"nothing": nil,
+		"plain":   "hello world",
+		"list":    []any{"a", int64(2)},
+		"nested": map[string]any{
+			"flow": []any{"x", "y, z", "it's"},
+			"items": []any{
+				map[string]any{"name": "first", "addr": ":1"},
+				map[string]any{"name": "second"},
+				[]any{int64(1), int64(2)},
+			},
+		},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Errorf("expected %#v; actual: %#v", expected, v)
+	}
+
+	for _, bad := range []string{
+		"a: 1\n  b: 2",         // Indented for no reason
+		"a: 1\na: 2",           // Duplicate key
+		"a:\n\t- x",            // Tab
+		"a: {b: 1}",            // Flow mapping
+		"a: [1, [2]]",          // Nested flow
+		"a: |\n  text",         // Block scalar
+		"- x\nb: 1",            // Sequence then mapping
+		"- - a",                // Nested sequence on one line
+		"a: \"unterminated",    // Bad string
+		"a: [\"x\\\", y]",      // Bad string in a flow sequence
+		"just a scalar line\n", // Neither
+	} {
+		if _, err := parseYAML([]byte(bad)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
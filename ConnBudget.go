@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Outbound connection budget
+//
+// The proxies, the upstream pool and the retrying clients each dial as
+// much as their own work asks for. Each of them is reasonable on its
+// own; together, against one slow backend, they can hold thousands of
+// connections to it: the backend drowns, and the local side runs out of
+// ephemeral ports to that address, failing every other dial with
+// EADDRNOTAVAIL.
+//
+// A ConnBudget caps the connections open at once, per destination host
+// and in total, across everything dialing through it:
+//
+// - a dial over budget waits for a connection to close, until its
+//   context is done; it then fails with a *BudgetError, which matches
+//   ErrConnBudget and the context error (so IsTimeout holds for a
+//   deadline)
+// - a connection counts from the dial until its Close
+// - hosts compare case-insensitively, without the port: the ports of a
+//   host share its limit
+//
+// DefaultConnBudget is the one shared by the upstream pool, the CONNECT
+// proxy and SNI router upstreams, HTTPClient and the file transfer
+// client. It's unlimited until SetLimits, which the serve command calls
+// with limits.max_outbound_per_host and limits.max_outbound.
+
+// ErrConnBudget is matched by errors of dials refused by a ConnBudget
+var ErrConnBudget = errors.New("outbound connection budget exhausted")
+
+// BudgetError is returned by a dial that waited for a budget in vain
+type BudgetError struct {
+	Host string
+	Err  error // Why it stopped waiting, the context's error
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("dial %s: %v: %v", e.Host, ErrConnBudget, e.Err)
+}
+
+// Is makes errors.Is(err, ErrConnBudget) true for a BudgetError
+func (e *BudgetError) Is(target error) bool { return target == ErrConnBudget }
+
+func (e *BudgetError) Unwrap() error { return e.Err }
+
+// DefaultConnBudget is the budget of the dialers in the repo
+var DefaultConnBudget = new(ConnBudget)
+
+// ConnBudget limits open outbound connections. The zero value has no
+// limits.
+type ConnBudget struct {
+	// Metrics, when set, counts the dials that had to wait, and those
+	// refused in the end, by host
+	Metrics *Metrics
+
+	mu      sync.Mutex
+	perHost int
+	total   int
+	hosts   map[string]int
+	open    int
+	changed chan struct{} // Closed and replaced when a slot frees up
+}
+
+// NewConnBudget returns a budget of perHost connections per host and
+// total altogether; zero means no limit
+func NewConnBudget(perHost, total int) *ConnBudget {
+	b := new(ConnBudget)
+	b.SetLimits(perHost, total)
+
+	return b
+}
+
+// SetLimits changes the limits. Connections already open stay; new
+// dials wait until they fit.
+func (b *ConnBudget) SetLimits(perHost, total int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.perHost, b.total = perHost, total
+	b.signal()
+}
+
+// signal wakes up the dials waiting; b.mu is held
+func (b *ConnBudget) signal() {
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+}
+
+// budgetHost returns the host of addr, lowercased
+func budgetHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return strings.ToLower(host)
+}
+
+// acquire takes a slot for host, waiting until there is one
+func (b *ConnBudget) acquire(ctx context.Context, host string) error {
+	waited := false
+	for {
+		b.mu.Lock()
+		if (b.perHost <= 0 || b.hosts[host] < b.perHost) && (b.total <= 0 || b.open < b.total) {
+			if b.hosts == nil {
+				b.hosts = make(map[string]int)
+			}
+			b.hosts[host]++
+			b.open++
+			b.mu.Unlock()
+			return nil
+		}
+		if b.changed == nil {
+			b.changed = make(chan struct{})
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		if !waited {
+			waited = true
+			b.count("outbound_budget_waits_total", "Outbound dials that waited for the connection budget.", host)
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			b.count("outbound_budget_refused_total", "Outbound dials refused by the connection budget.", host)
+			return &BudgetError{Host: host, Err: ctx.Err()}
+		}
+	}
+}
+
+// release gives the slot of a closed connection back
+func (b *ConnBudget) release(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.hosts[host]--; b.hosts[host] <= 0 {
+		delete(b.hosts, host)
+	}
+	b.open--
+	b.signal()
+}
+
+func (b *ConnBudget) count(name, help, host string) {
+	if b.Metrics != nil {
+		b.Metrics.Counter(name, help, "host").With(host).Inc()
+	}
+}
+
+// Open returns the connections open to host, and altogether
+func (b *ConnBudget) Open(host string) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.hosts[strings.ToLower(host)], b.open
+}
+
+// Dialer wraps dial so its connections count against the budget
+func (b *ConnBudget) Dialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host := budgetHost(addr)
+		if err := b.acquire(ctx, host); err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			b.release(host)
+			return nil, explainExhaustion(err, addr)
+		}
+
+		return &budgetConn{Conn: conn, budget: b, host: host}, nil
+	}
+}
+
+// DialContext dials with a net.Dialer within the budget
+func (b *ConnBudget) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return b.Dialer(new(net.Dialer).DialContext)(ctx, network, addr)
+}
+
+// budgetConn gives its slot back when closed
+type budgetConn struct {
+	net.Conn
+	budget *ConnBudget
+	host   string
+	once   sync.Once
+}
+
+func (c *budgetConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.budget.release(c.host) })
+
+	return err
+}
+
+// CloseWrite half-closes like *net.TCPConn; without one underneath it
+// closes the connection, which is all the peer can be told then
+func (c *budgetConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+// SyscallConn exposes the socket underneath, for probeSocket and the
+// socket options
+func (c *budgetConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+
+	return nil, errors.ErrUnsupported
+}
+
+// NetConn returns the connection underneath, like tls.Conn does
+func (c *budgetConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func TestConnBudget(t *testing.T) {
+	b := NewConnBudget(2, 3)
+	b.Metrics = new(Metrics)
+	dial := b.Dialer(func(context.Context, string, string) (net.Conn, error) {
+		c, _ := MemPipe()
+		return c, nil
+	})
+	ctx := context.Background()
+
+	// Two for the first host, the second host gets the last slot
+	var conns []net.Conn
+	for _, addr := range []string{"a.test:80", "A.test:443", "b.test:80"} {
+		c, err := dial(ctx, "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	if host, total := b.Open("a.test"); host != 2 || total != 3 {
+		t.Errorf("expected 2 of 3 open to a.test; actual: %d of %d", host, total)
+	}
+
+	// Over budget: waits, then fails as a timeout
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err := dial(short, "tcp", "c.test:80")
+	if !errors.Is(err, ErrConnBudget) || !IsTimeout(err) {
+		t.Errorf("expected a budget timeout; actual: %v", err)
+	}
+
+	// A close lets a waiting dial through
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	dialed := make(chan result, 1)
+	dialAsync := func(addr string) {
+		go func() {
+			c, err := dial(ctx, "tcp", addr)
+			dialed <- result{c, err}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	dialAsync("a.test:80")
+	_ = conns[0].Close()
+	_ = conns[0].Close() // Only the first Close gives the slot back
+	select {
+	case r := <-dialed:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		defer r.conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("a closed connection didn't free its slot")
+	}
+	if _, total := b.Open(""); total != 3 {
+		t.Errorf("expected 3 open; actual: %d", total)
+	}
+
+	// Raising the limits frees the waiters too
+	dialAsync("d.test:80")
+	b.SetLimits(2, 0)
+	if r := <-dialed; r.err != nil {
+		t.Fatal(r.err)
+	} else {
+		defer r.conn.Close()
+	}
+
+	// A failed dial doesn't keep its slot
+	failing := b.Dialer(func(context.Context, string, string) (net.Conn, error) {
+		return nil, syscall.ECONNREFUSED
+	})
+	if _, err := failing(ctx, "tcp", "e.test:80"); !IsRefused(err) {
+		t.Fatalf("expected the dial error; actual: %v", err)
+	}
+	if host, _ := b.Open("e.test"); host != 0 {
+		t.Errorf("expected no slot held by a failed dial; actual: %d", host)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// net.Conn conformance suite
+//
+// The repo keeps growing net.Conn wrappers: MonitoredConn, IdleConn,
+// RecordingConn, ChaosConn, PSKConn, WSConn, the tracked conns of
+// ConnTracker. Each of them forwards deadlines and Close to the conn
+// underneath, or in the case of PSKConn and WSConn, frames the stream
+// on top of it, and RUDPConn implements the whole of net.Conn over
+// UDP. Each is an easy place to get that subtly wrong: a wrapper that
+// re-arms its own deadlines and drops the caller's, one whose Close
+// doesn't unblock a Read, one whose timeout error is no longer a
+// net.Error.
+//
+// testConnConformance runs the same checks against any pair of
+// connected conns, in the spirit of golang.org/x/net/nettest.TestConn:
+//
+// - BasicIO: a large transfer arrives intact, Close shows up as EOF
+// - PingPong: small alternating messages
+// - PastDeadline: reads and writes fail at once with a timeout that
+//   matches os.ErrDeadlineExceeded and is a net.Error
+// - FutureDeadline: a Read blocks until its deadline, and the conn works
+//   again once the deadline is cleared
+// - DeadlineInterrupt: moving the deadline unblocks a pending Read
+// - WriteDeadline: a Write to a peer that doesn't read times out
+// - ConcurrentReadWrite: both ends read and write at once while the
+//   deadlines keep changing
+// - CloseUnblocks: Close ends a blocked Read, later calls fail, a second
+//   Close doesn't panic
+//
+// TestConnConformance runs it over every wrapper in the repo.
+
+// makeConnPair returns the two ends of a connection, and a function
+// releasing whatever else the pair needed
+type makeConnPair func(t *testing.T) (c1, c2 net.Conn, stop func())
+
+// timeoutBound is how long a deadline may overshoot before the test
+// calls it broken, generous for slow CI machines
+const timeoutBound = 2 * time.Second
+
+// testConnConformance runs the whole suite, each check on a fresh pair
+func testConnConformance(t *testing.T, mp makeConnPair) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, c1, c2 net.Conn)
+	}{
+		{"BasicIO", testConnBasicIO},
+		{"PingPong", testConnPingPong},
+		{"PastDeadline", testConnPastDeadline},
+		{"FutureDeadline", testConnFutureDeadline},
+		{"DeadlineInterrupt", testConnDeadlineInterrupt},
+		{"WriteDeadline", testConnWriteDeadline},
+		{"ConcurrentReadWrite", testConnConcurrentReadWrite},
+		{"CloseUnblocks", testConnCloseUnblocks},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2, stop := mp(t)
+			defer stop()
+			defer c1.Close()
+			defer c2.Close()
+
+			tt.fn(t, c1, c2)
+		})
+	}
+}
+
+// checkTimeout fails the test unless err is a deadline error that both
+// net.Error and errors.Is recognize
+func checkTimeout(t *testing.T, op string, err error) {
+	t.Helper()
+
+	if !IsTimeout(err) {
+		t.Errorf("%s: expected a net.Error timeout; actual: %v", op, err)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("%s: expected os.ErrDeadlineExceeded; actual: %v", op, err)
+	}
+}
+
+// readResult is the outcome of a Read running in another goroutine
+type readResult struct {
+	n   int
+	err error
+}
+
+// readAsync starts a Read of a single byte and returns its result
+func readAsync(c net.Conn) <-chan readResult {
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := c.Read(make([]byte, 1))
+		done <- readResult{n, err}
+	}()
+
+	return done
+}
+
+func testConnBasicIO(t *testing.T, c1, c2 net.Conn) {
+	want := make([]byte, 256<<10)
+	r := rand.New(rand.NewPCG(1, 2))
+	for i := range want {
+		want[i] = byte(r.Uint32())
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		// Uneven chunks so no wrapper gets away with assuming sizes
+		p := want
+		for len(p) > 0 {
+			n := min(len(p), 1+r.IntN(8<<10))
+			if _, err := c1.Write(p[:n]); err != nil {
+				errs <- err
+				return
+			}
+			p = p[n:]
+		}
+		errs <- c1.Close()
+	}()
+
+	got, err := io.ReadAll(c2)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("received %d bytes, not the %d sent", len(got), len(want))
+	}
+}
+
+func testConnPingPong(t *testing.T, c1, c2 net.Conn) {
+	errs := make(chan error, 1)
+	go func() {
+		var buf [8]byte
+		for {
+			if _, err := io.ReadFull(c2, buf[:]); err != nil {
+				errs <- err
+				return
+			}
+			n := binary.BigEndian.Uint64(buf[:])
+			if _, err := c2.Write(binary.BigEndian.AppendUint64(nil, n+1)); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	var buf [8]byte
+	for i := uint64(0); i < 100; i += 2 {
+		if _, err := c1.Write(binary.BigEndian.AppendUint64(nil, i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c1, buf[:]); err != nil {
+			t.Fatal(err)
+		}
+		if n := binary.BigEndian.Uint64(buf[:]); n != i+1 {
+			t.Fatalf("expected %d; actual %d", i+1, n)
+		}
+	}
+
+	_ = c1.Close()
+	<-errs
+}
+
+func testConnPastDeadline(t *testing.T, c1, _ net.Conn) {
+	if err := c1.SetDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		n, err := c1.Read(make([]byte, 1))
+		if n != 0 {
+			t.Errorf("read %d bytes past the deadline", n)
+		}
+		checkTimeout(t, "read", err)
+
+		n, err = c1.Write([]byte("x"))
+		if n != 0 {
+			t.Errorf("wrote %d bytes past the deadline", n)
+		}
+		checkTimeout(t, "write", err)
+	}
+}
+
+func testConnFutureDeadline(t *testing.T, c1, c2 net.Conn) {
+	const wait = 50 * time.Millisecond
+
+	begin := time.Now()
+	if err := c1.SetReadDeadline(begin.Add(wait)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-readAsync(c1):
+		if elapsed := time.Since(begin); elapsed < wait {
+			t.Errorf("read returned after %s, before its deadline", elapsed)
+		}
+		checkTimeout(t, "read", res.err)
+	case <-time.After(timeoutBound):
+		t.Fatal("read didn't honor its deadline")
+	}
+
+	// A timeout isn't fatal: clear the deadline and the conn reads on
+	if err := c1.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	done := readAsync(c1)
+	if _, err := c2.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-done:
+		if res.n != 1 || res.err != nil {
+			t.Fatalf("read after timeout: %d, %v", res.n, res.err)
+		}
+	case <-time.After(timeoutBound):
+		t.Fatal("conn unusable after a timeout")
+	}
+}
+
+func testConnDeadlineInterrupt(t *testing.T, c1, _ net.Conn) {
+	done := readAsync(c1)
+
+	// Let the Read block first
+	time.Sleep(20 * time.Millisecond)
+	if err := c1.SetReadDeadline(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-done:
+		checkTimeout(t, "read", res.err)
+	case <-time.After(timeoutBound):
+		t.Fatal("moving the deadline didn't interrupt the read")
+	}
+}
+
+func testConnWriteDeadline(t *testing.T, c1, _ net.Conn) {
+	if err := c1.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads, so buffers fill up and a write has to time out
+	done := make(chan error, 1)
+	go func() {
+		chunk := make([]byte, 32<<10)
+		for {
+			if _, err := c1.Write(chunk); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-done:
+		checkTimeout(t, "write", err)
+	case <-time.After(timeoutBound):
+		_ = c1.Close()
+		t.Fatal("write didn't honor its deadline")
+	}
+}
+
+func testConnConcurrentReadWrite(t *testing.T, c1, c2 net.Conn) {
+	const (
+		writers = 4
+		perConn = 64 << 10
+		chunk   = 1 << 10
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*writers)
+
+	// Every side both reads and writes; the deadlines keep moving,
+	// always far enough out that they never fire
+	for _, pair := range [][2]net.Conn{{c1, c2}, {c2, c1}} {
+		w, r := pair[0], pair[1]
+
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p := make([]byte, chunk)
+				for sent := 0; sent < perConn; sent += chunk {
+					_ = w.SetDeadline(time.Now().Add(time.Minute))
+					if _, err := w.Write(p); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = r.SetReadDeadline(time.Now().Add(time.Minute))
+			if _, err := io.CopyN(io.Discard, r, writers*perConn); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testConnCloseUnblocks(t *testing.T, c1, c2 net.Conn) {
+	done := readAsync(c1)
+	time.Sleep(20 * time.Millisecond)
+
+	if err := c1.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	select {
+	case res := <-done:
+		if res.err == nil {
+			t.Error("blocked read succeeded after close")
+		}
+	case <-time.After(timeoutBound):
+		t.Fatal("close didn't unblock a pending read")
+	}
+
+	if _, err := c1.Read(make([]byte, 1)); err == nil {
+		t.Error("read after close succeeded")
+	}
+	if _, err := c1.Write([]byte("x")); err == nil {
+		t.Error("write after close succeeded")
+	}
+
+	// Reporting an error is fine, panicking isn't
+	_ = c1.Close()
+
+	// The peer sees the end of the stream
+	_ = c2.SetReadDeadline(time.Now().Add(timeoutBound))
+	if _, err := io.Copy(io.Discard, c2); err != nil && IsTimeout(err) {
+		t.Errorf("peer never saw the close: %v", err)
+	}
+}
+
+// wrapPair builds a makeConnPair putting wrap around both ends of a
+// MemPipe
+func wrapPair(wrap func(c net.Conn, client bool) net.Conn) makeConnPair {
+	return func(t *testing.T) (net.Conn, net.Conn, func()) {
+		a, b := MemPipe()
+		return wrap(a, true), wrap(b, false), func() {}
+	}
+}
+
+func TestConnConformance(t *testing.T) {
+	psk := bytes.Repeat([]byte{0x42}, 32)
+
+	tests := map[string]makeConnPair{
+		"MemConn": wrapPair(func(c net.Conn, _ bool) net.Conn { return c }),
+		"TCPConn": func(t *testing.T) (net.Conn, net.Conn, func()) {
+			c1, c2 := tcpPair(t)
+			return c1, c2, func() {}
+		},
+		"MonitoredConn": wrapPair(func(c net.Conn, _ bool) net.Conn {
+			return NewMonitoredConn(c, new(Monitor))
+		}),
+		"IdleConn": wrapPair(func(c net.Conn, _ bool) net.Conn {
+			return NewIdleConn(c, time.Minute)
+		}),
+		"RecordingConn": wrapPair(func(c net.Conn, _ bool) net.Conn {
+			return NewRecordingConn(c, io.Discard)
+		}),
+		"ChaosConn": wrapPair(func(c net.Conn, _ bool) net.Conn {
+			// Rate limited, but fast enough for the transfers above
+			return NewChaosConn(c, Chaos{Bandwidth: 64 << 20})
+		}),
+		"TrackedConn": func(t *testing.T) (net.Conn, net.Conn, func()) {
+			var tracker ConnTracker
+			c1, c2 := tcpPair(t)
+			return tracker.Track(c1), tracker.Track(c2), func() {}
+		},
+		"WSConn": wrapPair(func(c net.Conn, client bool) net.Conn {
+			return &WSConn{Conn: c, r: bufio.NewReader(c), client: client}
+		}),
+		"PSKConn": func(t *testing.T) (net.Conn, net.Conn, func()) {
+			// The handshake runs on the first Read or Write, under the
+			// deadlines the checks set
+			a, b := MemPipe()
+			return PSKClient(a, psk), PSKServer(b, psk), func() {}
+		},
+		"RUDPConn": func(t *testing.T) (net.Conn, net.Conn, func()) {
+			l := NewRUDPListener(testPacketConn(t))
+			c1, err := DialRUDP(context.Background(), l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			c2, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c1, c2, func() {
+				_ = c1.Close()
+				_ = c2.Close()
+				_ = l.Close()
+			}
+		},
+	}
+
+	for name, mp := range tests {
+		t.Run(name, func(t *testing.T) {
+			testConnConformance(t, mp)
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Connection context
+//
+// Several things know something about a connection: the accept loop its
+// addresses, the Enricher where the peer is, the TLS layer who it is,
+// the fingerprinting listener what client it runs, a proxy in front the
+// address of the real client. Each of them used to hand it on its own
+// way (FingerprintConnContext, the Monitor's connection IDs, peerLabel
+// on the RemoteAddr of a request), so no two log lines about the same
+// connection agreed on what to call it.
+//
+// A ConnInfo gathers it, attached to the context at accept time:
+//
+// - TCPServer puts one in the context of every handler
+// - HTTP servers get one per request, with ConnInfoConnContext as
+//   their ConnContext (the serve command sets it)
+// - ConnInfoFrom gets it back; NewMonitoredConnContext gives the
+//   Monitor's records the same connection ID, and LogValue the same
+//   slog group in log records
+//
+// What can only be known later is looked up when asked for: TLS is the
+// state of the handshake, once done, and JA3 the fingerprint, once the
+// ClientHello was read. Client is the peer, unless SetClient said
+// otherwise (a PROXY protocol header, a trusted X-Forwarded-For).
+
+// ConnInfo is what is known about an accepted connection
+type ConnInfo struct {
+	ID       uint64 // Shared with the Monitor's records
+	Local    net.Addr
+	Remote   net.Addr
+	Accepted time.Time
+	Peer     PeerInfo // From the Enricher, if any
+
+	conn net.Conn
+
+	mu     sync.Mutex
+	client net.Addr
+}
+
+type connInfoKey struct{}
+
+// NewConnInfo returns the ConnInfo of conn, with a new connection ID
+func NewConnInfo(conn net.Conn, e Enricher) *ConnInfo {
+	return &ConnInfo{
+		ID:       monitoredConnIDs.Add(1),
+		Local:    conn.LocalAddr(),
+		Remote:   conn.RemoteAddr(),
+		Accepted: time.Now(),
+		Peer:     enrichAddr(e, conn.RemoteAddr()),
+		conn:     conn,
+	}
+}
+
+// WithConnInfo returns ctx carrying info
+func WithConnInfo(ctx context.Context, info *ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// ConnInfoFrom returns the ConnInfo ctx carries
+func ConnInfoFrom(ctx context.Context) (*ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoKey{}).(*ConnInfo)
+
+	return info, ok
+}
+
+// ConnInfoConnContext is an http.Server ConnContext attaching a
+// ConnInfo to the requests of each connection. The fingerprint is there
+// too, for FingerprintFromContext.
+func ConnInfoConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return WithConnInfo(FingerprintConnContext(ctx, conn), NewConnInfo(conn, nil))
+}
+
+// SetClient records the address of the real client, when the peer is a
+// proxy that said who it was
+func (c *ConnInfo) SetClient(addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.client = addr
+}
+
+// Client returns the address of the client: the one set by SetClient,
+// or the peer's
+func (c *ConnInfo) Client() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client != nil {
+		return c.client
+	}
+
+	return c.Remote
+}
+
+// TLS returns the state of the connection's TLS handshake, looking
+// through the wrappers that have a NetConn method, once it's complete
+func (c *ConnInfo) TLS() (TLSInfo, bool) {
+	for conn := c.conn; conn != nil; {
+		if tc, ok := conn.(*tls.Conn); ok {
+			state := tc.ConnectionState()
+			if !state.HandshakeComplete {
+				break
+			}
+			return InspectTLS(state), true
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = u.NetConn()
+	}
+
+	return TLSInfo{}, false
+}
+
+// Identity returns the subject of the client certificate, "" without
+// one
+func (c *ConnInfo) Identity() string {
+	if info, ok := c.TLS(); ok && len(info.PeerChain) > 0 {
+		return info.PeerChain[0].Subject
+	}
+
+	return ""
+}
+
+// JA3 returns the JA3 hash of the client, "" when it isn't known (yet)
+func (c *ConnInfo) JA3() string {
+	fp, err := FingerprintOf(c.conn)
+	if err != nil {
+		return ""
+	}
+
+	return fp.JA3Hash()
+}
+
+// String returns "conn <id> <client>", with the peer's labels
+func (c *ConnInfo) String() string {
+	label := "conn " + strconv.FormatUint(c.ID, 10)
+	if client := c.Client(); client != nil {
+		label += " " + client.String()
+	}
+	if peer := c.Peer.String(); peer != "" {
+		label += " (" + peer + ")"
+	}
+
+	return label
+}
+
+// LogValue groups what is known, for slog
+func (c *ConnInfo) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.Uint64("id", c.ID)}
+	if client := c.Client(); client != nil {
+		attrs = append(attrs, slog.String("client", client.String()))
+	}
+	if client, remote := c.Client(), c.Remote; client != nil && remote != nil && client.String() != remote.String() {
+		attrs = append(attrs, slog.String("via", remote.String()))
+	}
+	if c.Peer != (PeerInfo{}) {
+		attrs = append(attrs, slog.Any("peer", c.Peer))
+	}
+	if id := c.Identity(); id != "" {
+		attrs = append(attrs, slog.String("identity", id))
+	}
+	if ja3 := c.JA3(); ja3 != "" {
+		attrs = append(attrs, slog.String("ja3", ja3))
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+// NewMonitoredConnContext wraps conn like NewMonitoredConn, with the
+// connection ID of the ConnInfo of ctx when there is one
+func NewMonitoredConnContext(ctx context.Context, conn net.Conn, m *Monitor) *MonitoredConn {
+	info, ok := ConnInfoFrom(ctx)
+	if !ok {
+		return NewMonitoredConn(conn, m)
+	}
+
+	c := &MonitoredConn{Conn: conn, monitor: m, id: info.ID, peer: info.Peer}
+	if m.Enricher != nil && c.peer == (PeerInfo{}) {
+		c.peer = enrichAddr(m.Enricher, conn.RemoteAddr())
+	}
+	c.ring = m.Recorder.open(c.id, conn)
+
+	return c
+}
+
+// requestPeer labels the client of r for the logs: its connection, or
+// its address when the server attaches no ConnInfo
+func requestPeer(e Enricher, r *http.Request) string {
+	info, ok := ConnInfoFrom(r.Context())
+	if !ok {
+		return peerLabel(e, r.RemoteAddr)
+	}
+
+	return "conn " + strconv.FormatUint(info.ID, 10) + " " + peerLabel(e, info.Client().String())
+}
+
+func TestConnInfo(t *testing.T) {
+	// TCPServer handlers get one, and the Monitor uses its ID
+	srv := NewTCPServer(testListener(t))
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	monitor := &Monitor{}
+	infos := make(chan *ConnInfo, 1)
+	ids := make(chan uint64, 1)
+	go func() {
+		_ = srv.Serve(context.Background(), func(ctx context.Context, conn net.Conn) {
+			info, _ := ConnInfoFrom(ctx)
+			infos <- info
+			ids <- NewMonitoredConnContext(ctx, conn, monitor).ID()
+		})
+	}()
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	info := <-infos
+	if info == nil || info.Remote.String() != conn.LocalAddr().String() {
+		t.Fatalf("unexpected info: %v", info)
+	}
+	if id := <-ids; id != info.ID {
+		t.Errorf("expected the monitor to use conn %d; actual: %d", info.ID, id)
+	}
+
+	// A proxy in front names the real client
+	info.SetClient(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 4000})
+	if s := info.String(); s != "conn "+strconv.FormatUint(info.ID, 10)+" 192.0.2.7:4000" {
+		t.Errorf("unexpected label %q", s)
+	}
+	var buf strings.Builder
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("x", "conn", info)
+	if out := buf.String(); !strings.Contains(out, "conn.client=192.0.2.7:4000") || !strings.Contains(out, "conn.via="+conn.LocalAddr().String()) {
+		t.Errorf("unexpected record %q", out)
+	}
+
+	// HTTP servers get it per request, with the client certificate
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := ca.Issue(TLSLeaf{Name: "server", Hosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := ca.Issue(TLSLeaf{Name: "alice", Client: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := tls.NewListener(testListener(t), ServerConfig(serverCert, ca.Pool()))
+	labels := make(chan string, 1)
+	hs := &http.Server{
+		ConnContext: ConnInfoConnContext,
+		ErrorLog:    log.New(io.Discard, "", 0),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info, _ := ConnInfoFrom(r.Context())
+			labels <- info.Identity() + " " + requestPeer(nil, r)
+		}),
+	}
+	go func() { _ = hs.Serve(l) }()
+	t.Cleanup(func() { _ = hs.Close() })
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: ClientConfig(ca.Pool(), clientCert)}}
+	resp, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard(resp)
+	if label := <-labels; !strings.HasPrefix(label, "CN=alice conn ") {
+		t.Errorf("unexpected label %q", label)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Connection tracking with phased shutdown
+//
+// Shutting a server down nicely means different things for different
+// connections:
+//
+// 1. Idle connections (nothing sent or received for a while) are simply
+//    closed, nobody is waiting for them
+// 2. Active connections get a short read/write deadline, so whatever
+//    they are doing has a little time to finish but can't block forever
+// 3. Whatever is still open when the grace period ends is force closed
+//
+// ConnTracker implements these phases for any set of connections. Wrap
+// every accepted (or dialed, in the case of the proxy) connection with
+// Track (or the listener with Listener) and call Shutdown when it's
+// time to go. Closing a tracked connection removes it from the tracker.
+
+// Default thresholds for a zero ConnTracker
+const (
+	defaultIdleAfter     = time.Second
+	defaultDrainDeadline = time.Second
+)
+
+// TrackedConnInfo describes a tracked connection
+type TrackedConnInfo struct {
+	RemoteAddr string
+	Age        time.Duration // Time since the connection was tracked
+	Idle       time.Duration // Time since the last successful Read/Write
+}
+
+// ConnTracker keeps track of open connections
+type ConnTracker struct {
+	// IdleAfter is how long a connection must be quiet to count as
+	// idle during Shutdown (defaults to 1s)
+	IdleAfter time.Duration
+
+	// DrainDeadline is the deadline given to active connections when
+	// Shutdown starts (defaults to 1s)
+	DrainDeadline time.Duration
+
+	mu      sync.Mutex
+	conns   map[*trackedConn]struct{}
+	changed chan struct{} // Closed and replaced whenever a conn leaves
+}
+
+// trackedConn records its activity and leaves the tracker on Close
+type trackedConn struct {
+	net.Conn
+	tracker      *ConnTracker
+	since        time.Time
+	lastActivity atomic.Int64 // Unix nanoseconds
+	closeOnce    sync.Once
+	closeErr     error
+}
+
+// Track registers conn and returns the wrapper to use in its place
+func (t *ConnTracker) Track(conn net.Conn) net.Conn {
+	c := &trackedConn{Conn: conn, tracker: t, since: time.Now()}
+	c.lastActivity.Store(c.since.UnixNano())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns == nil {
+		t.conns = make(map[*trackedConn]struct{})
+		t.changed = make(chan struct{})
+	}
+	t.conns[c] = struct{}{}
+
+	return c
+}
+
+// trackingListener tracks the connections it accepts
+type trackingListener struct {
+	net.Listener
+	tracker *ConnTracker
+}
+
+// Listener returns a listener whose accepted connections are tracked,
+// for servers that do their own accepting like http.Server
+func (t *ConnTracker) Listener(l net.Listener) net.Listener {
+	return &trackingListener{Listener: l, tracker: t}
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.tracker.Track(conn), nil
+}
+
+// NetConn returns the connection underneath, like tls.Conn does
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// ReadFrom lets io.Copy reach the connection's own ReadFrom, which is
+// sendfile for a TCP connection and a file (see SendFile.go)
+func (c *trackedConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(c.Conn, r)
+	if n > 0 {
+		c.lastActivity.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// Close closes the connection and removes it from the tracker
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+		c.tracker.untrack(c)
+	})
+
+	return c.closeErr
+}
+
+// idleFor returns the time since the last successful Read/Write
+func (c *trackedConn) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastActivity.Load()))
+}
+
+func (t *ConnTracker) untrack(c *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns, c)
+
+	// Wake up anyone waiting in Shutdown
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// Len returns the number of tracked connections
+func (t *ConnTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.conns)
+}
+
+// Conns describes every tracked connection
+func (t *ConnTracker) Conns() []TrackedConnInfo {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	infos := make([]TrackedConnInfo, 0, len(t.conns))
+	for c := range t.conns {
+		infos = append(infos, TrackedConnInfo{
+			RemoteAddr: c.RemoteAddr().String(),
+			Age:        now.Sub(c.since),
+			Idle:       c.idleFor(now),
+		})
+	}
+
+	return infos
+}
+
+// snapshot copies the tracked set so conns can be closed without
+// holding the lock (Close calls back into untrack)
+func (t *ConnTracker) snapshot() []*trackedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+// CloseIdle closes the connections that have been quiet for IdleAfter
+// and returns how many were closed
+func (t *ConnTracker) CloseIdle() int {
+	idleAfter := t.IdleAfter
+	if idleAfter <= 0 {
+		idleAfter = defaultIdleAfter
+	}
+
+	now := time.Now()
+	closed := 0
+	for _, c := range t.snapshot() {
+		if c.idleFor(now) >= idleAfter {
+			_ = c.Close()
+			closed++
+		}
+	}
+
+	return closed
+}
+
+// SetDeadline sets the same deadline on every tracked connection
+func (t *ConnTracker) SetDeadline(deadline time.Time) {
+	for _, c := range t.snapshot() {
+		_ = c.SetDeadline(deadline)
+	}
+}
+
+// CloseAll force closes every tracked connection
+func (t *ConnTracker) CloseAll() {
+	for _, c := range t.snapshot() {
+		_ = c.Close()
+	}
+}
+
+// Wait blocks until no connections are tracked or ctx is done
+func (t *ConnTracker) Wait(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		if len(t.conns) == 0 {
+			t.mu.Unlock()
+			return nil
+		}
+		changed := t.changed
+		t.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Drain runs the first two shutdown phases: close the idle connections
+// and give the active ones DrainDeadline to finish
+func (t *ConnTracker) Drain() {
+	t.CloseIdle()
+
+	drain := t.DrainDeadline
+	if drain <= 0 {
+		drain = defaultDrainDeadline
+	}
+	t.SetDeadline(time.Now().Add(drain))
+}
+
+// Shutdown drains the connections and waits for them to be closed.
+// When ctx (the grace period) expires first, the rest is force closed
+// and ctx.Err() is returned.
+func (t *ConnTracker) Shutdown(ctx context.Context) error {
+	t.Drain()
+
+	if err := t.Wait(ctx); err != nil {
+		t.CloseAll()
+		return err
+	}
+
+	return nil
+}
+
+func TestConnTrackerShutdown(t *testing.T) {
+	tracker := &ConnTracker{
+		IdleAfter:     50 * time.Millisecond,
+		DrainDeadline: 100 * time.Millisecond,
+	}
+
+	// idle never sees any traffic, active is busy talking
+	idleClient, idleServer := net.Pipe()
+	activeClient, activeServer := net.Pipe()
+	defer idleClient.Close()
+	defer activeClient.Close()
+
+	idle := tracker.Track(idleServer)
+	active := tracker.Track(activeServer)
+
+	// The active side's handler: read until an error, then close
+	handlerErr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			if _, err := active.Read(buf); err != nil {
+				handlerErr <- err
+				_ = active.Close()
+				return
+			}
+		}
+	}()
+	go func() { _, _ = io.Copy(io.Discard, idleClient) }()
+
+	time.Sleep(60 * time.Millisecond)
+	// Keep the active connection busy right before the shutdown
+	if _, err := activeClient.Write([]byte("busy")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := tracker.Len(); n != 2 {
+		t.Fatalf("expected 2 tracked conns; actual: %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	begin := time.Now()
+	if err := tracker.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The idle conn was closed right away, the active one ran into
+	// its drain deadline and its handler closed it
+	if _, err := idle.Write([]byte("x")); err == nil {
+		t.Error("expected idle connection to be closed")
+	}
+	if err := <-handlerErr; !IsTimeout(err) {
+		t.Errorf("expected active connection to hit its deadline; actual: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 100*time.Millisecond {
+		t.Errorf("shutdown did not wait for the drain deadline: %s", elapsed)
+	}
+}
+
+func TestConnTrackerForceClose(t *testing.T) {
+	tracker := &ConnTracker{DrainDeadline: time.Hour}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// A fresh (so not idle) conn whose handler never closes it
+	tracker.Track(server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := tracker.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded; actual: %v", err)
+	}
+	if n := tracker.Len(); n != 0 {
+		t.Errorf("expected all conns force closed; actual: %d left", n)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Control console
+//
+// The admin API (Admin.go) is for tools: JSON over HTTP, curl. The
+// console is for a person at a terminal, telnet or nc to a port, the
+// way routers and old daemons are looked after:
+//
+//	$ nc localhost 7070
+//	golearn console, "help" lists the commands
+//	login s3cret
+//	ok
+//	conns echo
+//	echo 10.0.0.7:51234 age 3m2s idle 1.2s
+//	ok 1 connection
+//	drain echo
+//	ok echo drained
+//
+// Each command is a line (see LineServer.go) and so is each reply,
+// several for the longer ones, the last one starting with "ok" or
+// "error:", which is what a script waits for.
+//
+// The commands look at the connections, drain listeners, set the log
+// level and the sampling of a Monitor (see MonitorSampling.go), check
+// the health and reload the configuration, through the functions the
+// Console was given, like Admin; a command without one says so. With a
+// Password, nothing but login works until it's given, and the third
+// wrong one hangs up. With TLS, clients connect with openssl s_client
+// (or nc --ssl) rather than telnet, and the password doesn't cross the
+// network in the clear.
+
+const (
+	defaultConsoleIdleTimeout = 10 * time.Minute
+	consoleDrainTimeout       = time.Minute
+	consoleMaxLogins          = 3
+)
+
+// consoleHelp is the reply of help
+var consoleHelp = []string{
+	"login <password>         before anything else, when there's a password",
+	"conns [listener]         open connections",
+	"drain <listener>         stop a listener, letting its connections finish",
+	"health                   the state of the listeners",
+	"level [level]            show or set the log level",
+	"sample [every [per-sec]] show or set the sampling of the monitor",
+	"sample off               log every message",
+	"reload                   apply the configuration again",
+	"quit                     hang up",
+}
+
+// Console serves the control console
+type Console struct {
+	// The functions behind the commands, as for Admin
+	Conns  func() map[string][]TrackedConnInfo
+	Drain  func(ctx context.Context, listener string) error
+	Reload func() error
+	Health func() HealthReport
+	Level  *slog.LevelVar
+
+	// Monitor has its sampling set by the sample command
+	Monitor *Monitor
+
+	// Password, when set, is required by login before anything else
+	Password string
+
+	// TLS, when set, is what clients connect with
+	TLS *tls.Config
+
+	IdleTimeout time.Duration // Per command, 10 minutes by default
+
+	// ErrorLog receives the changes made through the console
+	ErrorLog *log.Logger
+}
+
+func (c *Console) logf(format string, v ...any) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// consoleReply joins the lines of a reply and its final status line
+func consoleReply(lines []string, status string) string {
+	return strings.Join(append(lines, status), "\r\n")
+}
+
+// consoleError is the reply to a command that failed
+func consoleError(err error) string {
+	return "error: " + err.Error()
+}
+
+// LineServer returns the line server of the console's commands
+func (c *Console) LineServer() *LineServer {
+	s := NewLineServer()
+	s.Greeting = `golearn console, "help" lists the commands`
+	s.IdleTimeout = c.IdleTimeout
+	if s.IdleTimeout <= 0 {
+		s.IdleTimeout = defaultConsoleIdleTimeout
+	}
+	s.NotFound = func(_ *LineSession, line string) (string, error) {
+		if strings.TrimSpace(line) == "" {
+			return "", nil
+		}
+		return `error: unknown command, "help" lists them`, nil
+	}
+
+	// Everything but login, help and quit is behind the password
+	handle := func(command string, h LineHandler) {
+		s.Handle(command, func(session *LineSession, args string) (string, error) {
+			if c.Password != "" && session.Values["user"] == nil {
+				return "error: login first", nil
+			}
+			return h(session, args)
+		})
+	}
+
+	s.Handle("login", c.login)
+	s.Handle("quit", func(*LineSession, string) (string, error) {
+		return "ok bye", ErrQuit
+	})
+	s.Handle("help", func(*LineSession, string) (string, error) {
+		return consoleReply(slices.Clone(consoleHelp), "ok"), nil
+	})
+	handle("conns", c.conns)
+	handle("drain", c.drain)
+	handle("health", c.health)
+	handle("level", c.level)
+	handle("sample", c.sample)
+	handle("reload", func(session *LineSession, _ string) (string, error) {
+		if c.Reload == nil {
+			return consoleError(errAdminUnsupported), nil
+		}
+		c.logf("console %s: reloading", session.Conn.RemoteAddr())
+		if err := c.Reload(); err != nil {
+			return consoleError(err), nil
+		}
+		return "ok reloaded", nil
+	})
+
+	return s
+}
+
+func (c *Console) login(session *LineSession, password string) (string, error) {
+	if c.Password == "" || session.Values["user"] != nil {
+		return "ok", nil
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(c.Password)) == 1 {
+		session.Values["user"] = true
+		c.logf("console %s: logged in", session.Conn.RemoteAddr())
+		return "ok", nil
+	}
+
+	failed, _ := session.Values["failed"].(int)
+	session.Values["failed"] = failed + 1
+	c.logf("console %s: wrong password", session.Conn.RemoteAddr())
+	if failed+1 >= consoleMaxLogins {
+		return "error: wrong password, bye", ErrQuit
+	}
+	return "error: wrong password", nil
+}
+
+func (c *Console) conns(_ *LineSession, listener string) (string, error) {
+	if c.Conns == nil {
+		return consoleError(errAdminUnsupported), nil
+	}
+
+	var lines []string
+	for name, infos := range c.Conns() {
+		if listener != "" && name != listener {
+			continue
+		}
+		for _, info := range infos {
+			lines = append(lines, fmt.Sprintf("%s %s age %s idle %s", name, info.RemoteAddr,
+				info.Age.Round(time.Second), info.Idle.Round(100*time.Millisecond)))
+		}
+	}
+	slices.Sort(lines)
+
+	status := fmt.Sprintf("ok %d connections", len(lines))
+	if len(lines) == 1 {
+		status = "ok 1 connection"
+	}
+	return consoleReply(lines, status), nil
+}
+
+func (c *Console) drain(session *LineSession, listener string) (string, error) {
+	if c.Drain == nil {
+		return consoleError(errAdminUnsupported), nil
+	}
+	if listener == "" {
+		return "error: drain which listener?", nil
+	}
+
+	c.logf("console %s: draining %s", session.Conn.RemoteAddr(), listener)
+	ctx, cancel := context.WithTimeout(context.Background(), consoleDrainTimeout)
+	defer cancel()
+	if err := c.Drain(ctx, listener); err != nil {
+		return consoleError(err), nil
+	}
+
+	return fmt.Sprintf("ok %s drained", listener), nil
+}
+
+func (c *Console) health(*LineSession, string) (string, error) {
+	if c.Health == nil {
+		return consoleError(errAdminUnsupported), nil
+	}
+
+	report := c.Health()
+	var lines []string
+	for name, l := range report.Listeners {
+		line := name + " " + l.State
+		backends := make([]string, 0, len(l.Backends))
+		for url, healthy := range l.Backends {
+			state := "down"
+			if healthy {
+				state = "up"
+			}
+			backends = append(backends, url+" "+state)
+		}
+		slices.Sort(backends)
+		if len(backends) > 0 {
+			line += ", " + strings.Join(backends, ", ")
+		}
+		lines = append(lines, line)
+	}
+	slices.Sort(lines)
+
+	return consoleReply(lines, fmt.Sprintf("ok live %t ready %t", report.Live, report.Ready)), nil
+}
+
+func (c *Console) level(session *LineSession, args string) (string, error) {
+	if c.Level == nil {
+		return consoleError(errAdminUnsupported), nil
+	}
+	if args != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(args)); err != nil {
+			return consoleError(err), nil
+		}
+		c.Level.Set(level)
+		c.logf("console %s: log level set to %s", session.Conn.RemoteAddr(), level)
+	}
+
+	return "ok " + c.Level.Level().String(), nil
+}
+
+func (c *Console) sample(session *LineSession, args string) (string, error) {
+	if c.Monitor == nil {
+		return consoleError(errAdminUnsupported), nil
+	}
+
+	fields := strings.Fields(args)
+	switch {
+	case len(fields) == 1 && strings.EqualFold(fields[0], "off"):
+		c.Monitor.SetSampling(0, 0)
+		c.logf("console %s: sampling off", session.Conn.RemoteAddr())
+	case len(fields) == 1 || len(fields) == 2:
+		every, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return "error: invalid sampling " + strconv.Quote(fields[0]), nil
+		}
+		perSecond := 0
+		if len(fields) == 2 {
+			if perSecond, err = strconv.Atoi(fields[1]); err != nil || perSecond < 0 {
+				return "error: invalid rate " + strconv.Quote(fields[1]), nil
+			}
+		}
+		c.Monitor.SetSampling(every, perSecond)
+		c.logf("console %s: sampling 1 in %d, %d per second", session.Conn.RemoteAddr(), every, perSecond)
+	case len(fields) > 2:
+		return "error: usage: sample [every [per-second]] | sample off", nil
+	}
+
+	every, perSecond := c.Monitor.Sampling()
+	if every <= 1 && perSecond <= 0 {
+		return "ok sampling off", nil
+	}
+	return fmt.Sprintf("ok 1 in %d, at most %d per second", max(every, 1), perSecond), nil
+}
+
+// ConsoleService serves c on l, over TLS when c.TLS is set, timing its
+// commands in DefaultMetrics
+func ConsoleService(c *Console, l net.Listener) Service {
+	if c.TLS != nil {
+		l = tls.NewListener(l, c.TLS)
+	}
+	srv := NewTCPServer(l)
+	srv.ErrorLog = c.ErrorLog
+	lines := c.LineServer()
+	lines.Middleware = NewLatencyRecorder(DefaultMetrics, l.Addr().String()).LineHandler
+
+	return TCPService("console "+l.Addr().String(), srv, func(ctx context.Context, conn net.Conn) {
+		stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+		defer stop()
+		lines.ServeConn(conn)
+	})
+}
+
+func TestConsole(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := ca.Issue(TLSLeaf{Name: "console", Hosts: []string{"127.0.0.1"}})
+
+	var drained []string
+	level := new(slog.LevelVar)
+	monitor := &Monitor{Logger: log.New(io.Discard, "", 0), SampleEvery: 10}
+	c := &Console{
+		Conns: func() map[string][]TrackedConnInfo {
+			return map[string][]TrackedConnInfo{
+				"echo": {{RemoteAddr: "10.0.0.7:51234", Age: 3 * time.Minute, Idle: 1200 * time.Millisecond}},
+				"web":  {{RemoteAddr: "10.0.0.8:40000", Age: time.Second}},
+			}
+		},
+		Drain: func(_ context.Context, listener string) error {
+			if listener != "echo" {
+				return ErrUnknownListener
+			}
+			drained = append(drained, listener)
+			return nil
+		},
+		Health: func() HealthReport {
+			return HealthReport{Live: true, Listeners: map[string]ListenerHealth{
+				"web": {State: "running", Backends: map[string]bool{"http://b": false, "http://a": true}},
+			}}
+		},
+		Level:    level,
+		Monitor:  monitor,
+		Password: "s3cret",
+		TLS:      ServerConfig(cert, nil),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := testListener(t)
+	go func() { _ = ConsoleService(c, l).Serve(ctx) }()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), ClientConfig(ca.Pool()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// send returns the lines of the reply to command
+	send := func(command string) []string {
+		t.Helper()
+		if command != "" {
+			_, _ = io.WriteString(conn, command+"\r\n")
+		}
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: %v", command, err)
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			if command == "" || strings.HasPrefix(line, "ok") || strings.HasPrefix(line, "error:") {
+				return lines
+			}
+		}
+	}
+
+	for _, step := range []struct {
+		command  string
+		expected []string
+	}{
+		{"", []string{`golearn console, "help" lists the commands`}},
+		{"conns", []string{"error: login first"}},
+		{"help", append(slices.Clone(consoleHelp), "ok")},
+		{"login guess", []string{"error: wrong password"}},
+		{"LOGIN s3cret", []string{"ok"}},
+		{"conns", []string{"echo 10.0.0.7:51234 age 3m0s idle 1.2s", "web 10.0.0.8:40000 age 1s idle 0s", "ok 2 connections"}},
+		{"conns echo", []string{"echo 10.0.0.7:51234 age 3m0s idle 1.2s", "ok 1 connection"}},
+		{"drain nope", []string{"error: unknown listener"}},
+		{"drain echo", []string{"ok echo drained"}},
+		{"health", []string{"web running, http://a up, http://b down", "ok live true ready false"}},
+		{"level", []string{"ok INFO"}},
+		{"level debug", []string{"ok DEBUG"}},
+		{"level loud", []string{`error: slog: level string "loud": unknown name`}},
+		{"sample", []string{"ok 1 in 10, at most 0 per second"}},
+		{"sample 100 5", []string{"ok 1 in 100, at most 5 per second"}},
+		{"sample off", []string{"ok sampling off"}},
+		{"sample x", []string{`error: invalid sampling "x"`}},
+		{"reload", []string{"error: not supported by this server"}},
+		{"frobnicate", []string{`error: unknown command, "help" lists them`}},
+		{"quit", []string{"ok bye"}},
+	} {
+		if lines := send(step.command); !slices.Equal(lines, step.expected) {
+			t.Errorf("%q: expected %q; actual: %q", step.command, step.expected, lines)
+		}
+	}
+	if level.Level() != slog.LevelDebug || !slices.Equal(drained, []string{"echo"}) {
+		t.Errorf("unexpected level %s and drained %q", level.Level(), drained)
+	}
+	if every, perSecond := monitor.Sampling(); every != 0 || perSecond != 0 {
+		t.Errorf("expected sampling off; actual: %d, %d", every, perSecond)
+	}
+
+	// Three wrong passwords and out
+	conn2, err := tls.Dial("tcp", l.Addr().String(), ClientConfig(ca.Pool()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	_ = conn2.SetDeadline(time.Now().Add(2 * time.Second))
+	_, _ = io.WriteString(conn2, "login a\r\nlogin b\r\nlogin c\r\nlogin s3cret\r\n")
+	b, _ := io.ReadAll(conn2)
+	if !strings.HasSuffix(string(b), "error: wrong password\r\nerror: wrong password, bye\r\n") {
+		t.Errorf("expected to be hung up on; actual: %q", b)
+	}
+}
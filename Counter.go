@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Byte and packet accounting
+//
+// The proxy, the MonitoredConn and the UDP echo server all move bytes
+// around, and an application usually wants to know how many. Instead of
+// each of them growing its own counters, they all report to a Counter.
+// Plug in an expvar map, a Prometheus collector or a test fake once and
+// the numbers are consistent everywhere.
+//
+// Count is called once per read, write or packet, so "messages" means
+// reads/writes for streams and datagrams for UDP.
+
+// Counter receives traffic accounting from the networking components
+type Counter interface {
+	// Count records n bytes moving in direction d
+	Count(d Direction, n int)
+}
+
+// CounterFunc adapts an ordinary function to the Counter interface
+type CounterFunc func(d Direction, n int)
+
+// Count calls f(d, n)
+func (f CounterFunc) Count(d Direction, n int) {
+	f(d, n)
+}
+
+// count reports to c if there is one. Components take a nil Counter
+// to mean "no accounting", so every call site goes through here.
+func count(c Counter, d Direction, n int) {
+	if c != nil {
+		c.Count(d, n)
+	}
+}
+
+// ExpvarCounter publishes counts in an expvar.Map with the keys
+// bytes_in, bytes_out, messages_in and messages_out
+type ExpvarCounter struct {
+	*expvar.Map
+}
+
+// NewExpvarCounter creates the map and publishes it under name.
+// Like expvar.NewMap, it panics if name is already in use.
+func NewExpvarCounter(name string) ExpvarCounter {
+	return ExpvarCounter{Map: expvar.NewMap(name)}
+}
+
+// Count implements Counter
+func (e ExpvarCounter) Count(d Direction, n int) {
+	e.Add("bytes_"+d.String(), int64(n))
+	e.Add("messages_"+d.String(), 1)
+}
+
+// countingReader reports every successful read to a Counter
+type countingReader struct {
+	r         io.Reader
+	counter   Counter
+	direction Direction
+}
+
+// Read reads from the underlying reader and counts what was read
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		count(c.counter, c.direction, n)
+	}
+
+	return n, err
+}
+
+// fakeCounter keeps the counts in memory for tests
+type fakeCounter struct {
+	mu       sync.Mutex
+	bytes    map[Direction]int
+	messages map[Direction]int
+}
+
+func newFakeCounter() *fakeCounter {
+	return &fakeCounter{bytes: map[Direction]int{}, messages: map[Direction]int{}}
+}
+
+func (f *fakeCounter) Count(d Direction, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.bytes[d] += n
+	f.messages[d]++
+}
+
+func (f *fakeCounter) get(d Direction) (bytes, messages int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.bytes[d], f.messages[d]
+}
+
+func TestCounterUDP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	counter := newFakeCounter()
+	serverAddr, err := echoServerUDPWithCounter(ctx, "127.0.0.1:", counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("udp", serverAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	buf := make([]byte, 1024)
+	for _, msg := range []string{"ping", "hello"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two datagrams of 4 + 5 bytes each way
+	if b, m := counter.get(Inbound); b != 9 || m != 2 {
+		t.Errorf("inbound: expected 9 bytes in 2 packets; actual: %d in %d", b, m)
+	}
+	if b, m := counter.get(Outbound); b != 9 || m != 2 {
+		t.Errorf("outbound: expected 9 bytes in 2 packets; actual: %d in %d", b, m)
+	}
+}
+
+func TestCounterProxy(t *testing.T) {
+	counter := newFakeCounter()
+
+	// The client talks to one end of a pipe, the proxy sits between
+	// the other end and the "server" pipe
+	client, proxyFrom := net.Pipe()
+	proxyTo, server := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = proxyWithCounter(proxyFrom, proxyTo, counter)
+		_ = proxyTo.Close()
+	}()
+
+	// Server echoes once, then hangs up
+	go func() {
+		defer server.Close()
+		b := make([]byte, 1024)
+		n, err := server.Read(b)
+		if err != nil {
+			return
+		}
+		_, _ = server.Write(b[:n])
+	}()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1024)
+	if _, err := client.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	<-done
+
+	if b, _ := counter.get(Outbound); b != 4 {
+		t.Errorf("expected 4 bytes proxied to the server; actual: %d", b)
+	}
+	if b, _ := counter.get(Inbound); b != 4 {
+		t.Errorf("expected 4 bytes proxied back; actual: %d", b)
+	}
+}
@@ -0,0 +1,1028 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DHCP client (RFC 2131)
+//
+// A host joining a network has no address yet, and doesn't know who to
+// ask for one, so it asks everyone: a DISCOVER broadcast from 0.0.0.0
+// to 255.255.255.255, port 68 to port 67. Every DHCP server on the link
+// answers with an OFFER of an address; the client takes one, REQUESTs
+// it, broadcast again so the servers whose offers it turned down know,
+// and the chosen server ACKs it (or NAKs it, when someone was faster):
+//
+//	client                                  server
+//	  | DISCOVER (broadcast)                  |
+//	  |-------------------------------------->|
+//	  |                      OFFER 192.0.2.10 |
+//	  |<--------------------------------------|
+//	  | REQUEST 192.0.2.10, server id         |
+//	  |-------------------------------------->|
+//	  |                ACK, lease of 1 hour   |
+//	  |<--------------------------------------|
+//
+// The address is leased, not given: at T1, half the lease, the client
+// asks the server that gave it for more time (RENEWING, unicast, from
+// the address now); if the server doesn't answer by T2, seven eighths
+// of the lease, it asks any server (REBINDING, broadcast); when the
+// lease runs out, it's back to DISCOVER. Run is that state machine:
+//
+//	INIT -> SELECTING -> REQUESTING -> BOUND -> RENEWING -> REBINDING
+//	  ^                                 ^  |        |            |
+//	  |                                 +--+--------+ ACK        |
+//	  +------------------------------------ NAK, lease expired --+
+//
+// The messages are BOOTP's, from before DHCP: a fixed 236 byte header
+// (op, transaction id, the addresses, the client's Ethernet address),
+// then a magic cookie and the options, type-length-value, which is
+// where DHCP lives: the message type, the lease time, the server id,
+// the subnet mask, the routers, the DNS servers.
+//
+// The client sends and receives over a UDP socket on port 68, bound to
+// the interface (SO_BINDTODEVICE, linux only) with SO_BROADCAST set,
+// rather than a raw socket: with no address, the kernel would drop
+// replies unicast to the address offered, so the client sets the
+// broadcast flag, asking the servers to broadcast their replies. The
+// exchanges before BOUND are retried with a RetryPolicy (Retry.go),
+// with RFC 2131's doubling waits.
+//
+// The leases are only reported, to OnState: configuring the interface
+// with them takes netlink, or ip(8), which is the caller's business.
+//
+//	golearn dhclient -i eth0
+
+// DHCP message types, option 53
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpDecline  = 4
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+)
+
+// DHCP options the client uses
+const (
+	dhcpOptPad         = 0
+	dhcpOptSubnetMask  = 1
+	dhcpOptRouter      = 3
+	dhcpOptDNS         = 6
+	dhcpOptHostname    = 12
+	dhcpOptRequestedIP = 50
+	dhcpOptLeaseTime   = 51
+	dhcpOptMessageType = 53
+	dhcpOptServerID    = 54
+	dhcpOptParameters  = 55
+	dhcpOptMaxSize     = 57
+	dhcpOptRenewalTime = 58
+	dhcpOptRebindTime  = 59
+	dhcpOptClientID    = 61
+	dhcpOptEnd         = 255
+)
+
+const (
+	dhcpBootRequest    = 1
+	dhcpBootReply      = 2
+	dhcpFlagBroadcast  = 0x8000
+	dhcpMagicCookie    = 0x63825363
+	dhcpHeaderSize     = 240 // With the magic cookie
+	dhcpMinMessageSize = 300 // BOOTP's, which some relays still want
+	dhcpMaxMessageSize = 1500
+	dhcpInfiniteLease  = 0xffffffff
+
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpDefaultTimeout = 4 * time.Second
+	dhcpMinRetryWait   = time.Minute // RFC 2131's minimum between renewals
+
+	// The default Retry: RFC 2131 waits 4 seconds, then 8, up to 64,
+	// give or take one
+	dhcpRetryAttempts = 5
+	dhcpRetryInitial  = 4 * time.Second
+	dhcpRetryMax      = 64 * time.Second
+	dhcpRetryJitter   = 0.25
+)
+
+// ErrDHCPNak is returned when a server refuses the address asked for
+var ErrDHCPNak = errors.New("dhcp: server refused the address (NAK)")
+
+// dhcpMessage is a DHCP message. Options holds the options by code,
+// those repeated concatenated, as RFC 3396 says.
+type dhcpMessage struct {
+	Op        uint8
+	XID       uint32
+	Secs      uint16
+	Broadcast bool
+	CIAddr    net.IP // The client's address, when it has one
+	YIAddr    net.IP // The address offered
+	SIAddr    net.IP
+	GIAddr    net.IP // The relay's
+	CHAddr    net.HardwareAddr
+	Options   map[uint8][]byte
+}
+
+// Type returns the DHCP message type, 0 for a BOOTP message
+func (m *dhcpMessage) Type() uint8 {
+	if t := m.Options[dhcpOptMessageType]; len(t) == 1 {
+		return t[0]
+	}
+	return 0
+}
+
+// MarshalBinary encodes the message, the message type first, padded to
+// dhcpMinMessageSize
+func (m *dhcpMessage) MarshalBinary() ([]byte, error) {
+	if len(m.CHAddr) > 16 {
+		return nil, fmt.Errorf("dhcp: hardware address %s too long", m.CHAddr)
+	}
+
+	b := make([]byte, dhcpHeaderSize, dhcpMinMessageSize)
+	b[0] = m.Op
+	b[1], b[2] = 1, uint8(len(m.CHAddr)) // Ethernet
+	binary.BigEndian.PutUint32(b[4:], m.XID)
+	binary.BigEndian.PutUint16(b[8:], m.Secs)
+	if m.Broadcast {
+		binary.BigEndian.PutUint16(b[10:], dhcpFlagBroadcast)
+	}
+	for i, ip := range []net.IP{m.CIAddr, m.YIAddr, m.SIAddr, m.GIAddr} {
+		if ip != nil && ip.To4() == nil {
+			return nil, fmt.Errorf("dhcp: %v isn't an IPv4 address", ip)
+		}
+		copy(b[12+4*i:], ip.To4())
+	}
+	copy(b[28:], m.CHAddr)
+	binary.BigEndian.PutUint32(b[236:], dhcpMagicCookie)
+
+	codes := make([]int, 0, len(m.Options))
+	for code := range m.Options {
+		codes = append(codes, int(code))
+	}
+	// Servers look for the message type first
+	order := func(code int) int {
+		if code == dhcpOptMessageType {
+			return -1
+		}
+		return code
+	}
+	slices.SortFunc(codes, func(a, b int) int { return order(a) - order(b) })
+	for _, code := range codes {
+		value := m.Options[uint8(code)]
+		if code == dhcpOptPad || code == dhcpOptEnd {
+			continue
+		}
+		// Longer values go in several options, concatenated on the way in
+		for first := true; first || len(value) > 0; first = false {
+			n := min(len(value), 255)
+			b = append(b, uint8(code), uint8(n))
+			b = append(b, value[:n]...)
+			value = value[n:]
+		}
+	}
+	b = append(b, dhcpOptEnd)
+	if len(b) < dhcpMinMessageSize {
+		b = b[:dhcpMinMessageSize]
+	}
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes a message. The sname and file fields aren't
+// looked at, nor options overloaded into them.
+func (m *dhcpMessage) UnmarshalBinary(b []byte) error {
+	if len(b) < dhcpHeaderSize {
+		return errors.New("dhcp: message too short")
+	}
+	if binary.BigEndian.Uint32(b[236:]) != dhcpMagicCookie {
+		return errors.New("dhcp: not a DHCP message")
+	}
+	if b[2] > 16 {
+		return fmt.Errorf("dhcp: hardware address of %d bytes", b[2])
+	}
+
+	m.Op = b[0]
+	m.XID = binary.BigEndian.Uint32(b[4:])
+	m.Secs = binary.BigEndian.Uint16(b[8:])
+	m.Broadcast = binary.BigEndian.Uint16(b[10:])&dhcpFlagBroadcast != 0
+	m.CIAddr = net.IP(slices.Clone(b[12:16]))
+	m.YIAddr = net.IP(slices.Clone(b[16:20]))
+	m.SIAddr = net.IP(slices.Clone(b[20:24]))
+	m.GIAddr = net.IP(slices.Clone(b[24:28]))
+	m.CHAddr = net.HardwareAddr(slices.Clone(b[28 : 28+int(b[2])]))
+
+	m.Options = make(map[uint8][]byte)
+	for b = b[dhcpHeaderSize:]; len(b) > 0; {
+		code := b[0]
+		if code == dhcpOptPad {
+			b = b[1:]
+			continue
+		}
+		if code == dhcpOptEnd {
+			return nil
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return errors.New("dhcp: truncated option")
+		}
+		m.Options[code] = append(m.Options[code], b[2:2+int(b[1])]...)
+		b = b[2+int(b[1]):]
+	}
+
+	return errors.New("dhcp: options without an end")
+}
+
+// DHCPState is a state of the client, see the diagram above
+type DHCPState int
+
+// The states of RFC 2131, but for those of a reboot with an old lease
+const (
+	DHCPInit DHCPState = iota
+	DHCPSelecting
+	DHCPRequesting
+	DHCPBound
+	DHCPRenewing
+	DHCPRebinding
+)
+
+func (s DHCPState) String() string {
+	switch s {
+	case DHCPInit:
+		return "INIT"
+	case DHCPSelecting:
+		return "SELECTING"
+	case DHCPRequesting:
+		return "REQUESTING"
+	case DHCPBound:
+		return "BOUND"
+	case DHCPRenewing:
+		return "RENEWING"
+	case DHCPRebinding:
+		return "REBINDING"
+	}
+	return fmt.Sprintf("DHCPState(%d)", int(s))
+}
+
+// DHCPLease is an address leased by a server
+type DHCPLease struct {
+	IP       net.IP
+	Mask     net.IPMask
+	Routers  []net.IP
+	DNS      []net.IP
+	Server   net.IP        // The server id, where renewals go
+	Duration time.Duration // 0 for a lease that never expires
+	Renew    time.Duration // T1, after Acquired
+	Rebind   time.Duration // T2, after Acquired
+	Acquired time.Time     // When the request was sent, which the times count from
+}
+
+func (l *DHCPLease) String() string {
+	ones, _ := l.Mask.Size()
+	duration := "infinite"
+	if l.Duration > 0 {
+		duration = l.Duration.String()
+	}
+	return fmt.Sprintf("%s/%d from %s, lease %s, routers %v, dns %v", l.IP, ones, l.Server, duration, l.Routers, l.DNS)
+}
+
+// Expires returns when the lease runs out, the zero time for one that
+// never does
+func (l *DHCPLease) Expires() time.Time {
+	if l.Duration == 0 {
+		return time.Time{}
+	}
+	return l.Acquired.Add(l.Duration)
+}
+
+// newDHCPLease reads the lease of an ACK from the server at from
+func newDHCPLease(m *dhcpMessage, from net.IP, acquired time.Time) *DHCPLease {
+	l := &DHCPLease{IP: m.YIAddr, Server: from, Acquired: acquired}
+	if mask := m.Options[dhcpOptSubnetMask]; len(mask) == 4 {
+		l.Mask = net.IPMask(mask)
+	} else {
+		l.Mask = l.IP.DefaultMask()
+	}
+	l.Routers = dhcpIPs(m.Options[dhcpOptRouter])
+	l.DNS = dhcpIPs(m.Options[dhcpOptDNS])
+	if id := m.Options[dhcpOptServerID]; len(id) == 4 {
+		l.Server = net.IP(id)
+	}
+
+	seconds := func(code uint8) (time.Duration, bool) {
+		v := m.Options[code]
+		if len(v) != 4 || binary.BigEndian.Uint32(v) == dhcpInfiniteLease {
+			return 0, false
+		}
+		return time.Duration(binary.BigEndian.Uint32(v)) * time.Second, true
+	}
+	if d, ok := seconds(dhcpOptLeaseTime); ok {
+		l.Duration = d
+		l.Renew, l.Rebind = d/2, d*7/8
+		if t1, ok := seconds(dhcpOptRenewalTime); ok && t1 < d {
+			l.Renew = t1
+		}
+		if t2, ok := seconds(dhcpOptRebindTime); ok && t2 < d && t2 >= l.Renew {
+			l.Rebind = t2
+		}
+		l.Rebind = max(l.Rebind, l.Renew)
+	}
+
+	return l
+}
+
+// dhcpIPs splits an option's value into IPv4 addresses
+func dhcpIPs(b []byte) []net.IP {
+	var ips []net.IP
+	for ; len(b) >= 4; b = b[4:] {
+		ips = append(ips, net.IP(b[:4:4]))
+	}
+	return ips
+}
+
+// DHCPClient gets and keeps an address lease for an interface. Its
+// fields are only read, so a client can be shared once set up.
+type DHCPClient struct {
+	// Interface is the interface the leases are for, which the socket
+	// is bound to
+	Interface string
+
+	// HardwareAddr identifies the client, the interface's when nil
+	HardwareAddr net.HardwareAddr
+
+	// Hostname, when set, is sent for the server to register in DNS
+	Hostname string
+
+	// Conn, when set, is used rather than a socket on port 68, and
+	// Server rather than the broadcast address: tests use both to run
+	// a server on loopback
+	Conn   net.PacketConn
+	Server *net.UDPAddr
+
+	// Timeout is how long to wait for a reply, dhcpDefaultTimeout when 0
+	Timeout time.Duration
+
+	// Retry retries DISCOVER and REQUEST until a lease, with RFC 2131's
+	// waits when its Attempts is 0
+	Retry RetryPolicy
+
+	// OnState, when set, is called with each state Run enters, and the
+	// lease of BOUND, RENEWING and REBINDING
+	OnState func(state DHCPState, lease *DHCPLease)
+
+	mu    sync.Mutex
+	state DHCPState
+	lease *DHCPLease
+}
+
+// State returns the state of Run, and its lease
+func (c *DHCPClient) State() (DHCPState, *DHCPLease) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state, c.lease
+}
+
+func (c *DHCPClient) setState(state DHCPState, lease *DHCPLease) {
+	c.mu.Lock()
+	c.state, c.lease = state, lease
+	c.mu.Unlock()
+
+	if c.OnState != nil {
+		c.OnState(state, lease)
+	}
+}
+
+func (c *DHCPClient) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return dhcpDefaultTimeout
+}
+
+// server returns where broadcasts go, and the port of the servers
+func (c *DHCPClient) server() *net.UDPAddr {
+	if c.Server != nil {
+		return c.Server
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpServerPort}
+}
+
+func (c *DHCPClient) retry() RetryPolicy {
+	p := c.Retry
+	if p.Attempts == 0 {
+		p.Attempts, p.Initial, p.Max, p.Jitter = dhcpRetryAttempts, dhcpRetryInitial, dhcpRetryMax, dhcpRetryJitter
+	}
+	if p.Retryable == nil {
+		p.Retryable = func(err error) bool {
+			return IsTransient(err) || errors.Is(err, ErrDHCPNak)
+		}
+	}
+	if p.Name == "" {
+		p.Name = "dhcp"
+	}
+
+	return p
+}
+
+func (c *DHCPClient) hardwareAddr() (net.HardwareAddr, error) {
+	if c.HardwareAddr != nil {
+		return c.HardwareAddr, nil
+	}
+	ifi, err := net.InterfaceByName(c.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if len(ifi.HardwareAddr) == 0 {
+		return nil, fmt.Errorf("dhcp: %s has no hardware address", c.Interface)
+	}
+
+	return ifi.HardwareAddr, nil
+}
+
+// listen returns Conn, or a socket on port 68 to close when done
+func (c *DHCPClient) listen(ctx context.Context) (net.PacketConn, func(), error) {
+	if c.Conn != nil {
+		return c.Conn, func() {}, nil
+	}
+	if c.Interface == "" {
+		return nil, nil, errors.New("dhcp: no interface")
+	}
+	pc, err := dhcpListenConfig(c.Interface).ListenPacket(ctx, "udp4", fmt.Sprintf(":%d", dhcpClientPort))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pc, func() { _ = pc.Close() }, nil
+}
+
+// message returns a request of the given type, with a new transaction
+// id and the options every request has
+func (c *DHCPClient) message(typ uint8, chaddr net.HardwareAddr) *dhcpMessage {
+	var xid [4]byte
+	_, _ = rand.Read(xid[:])
+
+	m := &dhcpMessage{
+		Op:     dhcpBootRequest,
+		XID:    binary.BigEndian.Uint32(xid[:]),
+		CHAddr: chaddr,
+		Options: map[uint8][]byte{
+			dhcpOptMessageType: {typ},
+			dhcpOptClientID:    append([]byte{1}, chaddr...), // Ethernet
+		},
+	}
+	if typ != dhcpRelease {
+		m.Options[dhcpOptParameters] = []byte{dhcpOptSubnetMask, dhcpOptRouter, dhcpOptDNS,
+			dhcpOptLeaseTime, dhcpOptRenewalTime, dhcpOptRebindTime}
+		m.Options[dhcpOptMaxSize] = binary.BigEndian.AppendUint16(nil, dhcpMaxMessageSize)
+		if c.Hostname != "" {
+			m.Options[dhcpOptHostname] = []byte(c.Hostname)
+		}
+	}
+
+	return m
+}
+
+// exchange sends m to addr and returns the first reply to it of one of
+// the types, and who it came from, or an error after the timeout
+func (c *DHCPClient) exchange(ctx context.Context, pc net.PacketConn, m *dhcpMessage, addr net.Addr, types ...uint8) (*dhcpMessage, net.IP, error) {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := pc.WriteTo(b, addr); err != nil {
+		return nil, nil, err
+	}
+
+	deadline := time.Now().Add(c.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := pc.SetReadDeadline(deadline); err != nil {
+		return nil, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = pc.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, dhcpMaxMessageSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			return nil, nil, err
+		}
+
+		reply := new(dhcpMessage)
+		if reply.UnmarshalBinary(buf[:n]) != nil || reply.Op != dhcpBootReply || reply.XID != m.XID ||
+			!bytes.Equal(reply.CHAddr, m.CHAddr) || !slices.Contains(types, reply.Type()) {
+			continue // Someone else's, or garbage
+		}
+		var ip net.IP
+		if u, ok := from.(*net.UDPAddr); ok {
+			ip = u.IP
+		}
+
+		return reply, ip, nil
+	}
+}
+
+// Acquire gets a lease: DISCOVER, OFFER, REQUEST and ACK, retried with
+// Retry on a timeout or a NAK
+func (c *DHCPClient) Acquire(ctx context.Context) (*DHCPLease, error) {
+	chaddr, err := c.hardwareAddr()
+	if err != nil {
+		return nil, err
+	}
+	pc, done, err := c.listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var lease *DHCPLease
+	err = c.retry().Do(ctx, func(ctx context.Context) error {
+		lease, err = c.acquire(ctx, pc, chaddr)
+		return err
+	})
+
+	return lease, err
+}
+
+func (c *DHCPClient) acquire(ctx context.Context, pc net.PacketConn, chaddr net.HardwareAddr) (*DHCPLease, error) {
+	c.setState(DHCPSelecting, nil)
+	discover := c.message(dhcpDiscover, chaddr)
+	discover.Broadcast = true
+	offer, _, err := c.exchange(ctx, pc, discover, c.server(), dhcpOffer)
+	if err != nil {
+		return nil, fmt.Errorf("dhcp: no offer: %w", err)
+	}
+	server := offer.Options[dhcpOptServerID]
+	if len(server) != 4 || offer.YIAddr.To4().Equal(net.IPv4zero) {
+		return nil, errors.New("dhcp: offer without an address or server id")
+	}
+
+	// The same transaction, for the servers to tie the request to their
+	// offers
+	c.setState(DHCPRequesting, nil)
+	request := c.message(dhcpRequest, chaddr)
+	request.XID, request.Broadcast = discover.XID, true
+	request.Options[dhcpOptRequestedIP] = offer.YIAddr.To4()
+	request.Options[dhcpOptServerID] = server
+	sent := time.Now()
+	ack, from, err := c.exchange(ctx, pc, request, c.server(), dhcpAck, dhcpNak)
+	if err != nil {
+		return nil, fmt.Errorf("dhcp: no acknowledgment: %w", err)
+	}
+	if ack.Type() == dhcpNak {
+		return nil, ErrDHCPNak
+	}
+
+	return newDHCPLease(ack, from, sent), nil
+}
+
+// Renew asks the server of the lease to extend it, unicast from the
+// lease's address: what RENEWING does, once
+func (c *DHCPClient) Renew(ctx context.Context, lease *DHCPLease) (*DHCPLease, error) {
+	return c.extend(ctx, lease, &net.UDPAddr{IP: lease.Server, Port: c.server().Port})
+}
+
+// Rebind asks any server to extend the lease, broadcast: what REBINDING
+// does, once
+func (c *DHCPClient) Rebind(ctx context.Context, lease *DHCPLease) (*DHCPLease, error) {
+	return c.extend(ctx, lease, c.server())
+}
+
+func (c *DHCPClient) extend(ctx context.Context, lease *DHCPLease, addr net.Addr) (*DHCPLease, error) {
+	chaddr, err := c.hardwareAddr()
+	if err != nil {
+		return nil, err
+	}
+	pc, done, err := c.listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	request := c.message(dhcpRequest, chaddr)
+	request.CIAddr = lease.IP
+	sent := time.Now()
+	ack, from, err := c.exchange(ctx, pc, request, addr, dhcpAck, dhcpNak)
+	if err != nil {
+		return nil, fmt.Errorf("dhcp: no acknowledgment: %w", err)
+	}
+	if ack.Type() == dhcpNak {
+		return nil, ErrDHCPNak
+	}
+
+	return newDHCPLease(ack, from, sent), nil
+}
+
+// Release gives the lease back to its server, which doesn't answer
+func (c *DHCPClient) Release(ctx context.Context, lease *DHCPLease) error {
+	chaddr, err := c.hardwareAddr()
+	if err != nil {
+		return err
+	}
+	pc, done, err := c.listen(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	release := c.message(dhcpRelease, chaddr)
+	release.CIAddr = lease.IP
+	release.Options[dhcpOptServerID] = lease.Server.To4()
+	b, err := release.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = pc.WriteTo(b, &net.UDPAddr{IP: lease.Server, Port: c.server().Port})
+
+	return err
+}
+
+// Run gets a lease and keeps it, renewing and rebinding it, until ctx
+// is done, starting over from INIT when it's lost. The lease isn't
+// released, like dhclient doesn't: the same address comes back next
+// time.
+func (c *DHCPClient) Run(ctx context.Context) error {
+	for {
+		c.setState(DHCPInit, nil)
+		lease, err := c.Acquire(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// The attempts are used up: wait as long as the longest
+			// backoff, and start over
+			if err := sleepUntil(ctx, time.Now().Add(c.retry().Backoff(c.retry().Attempts))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for lease != nil {
+			c.setState(DHCPBound, lease)
+			if lease.Duration == 0 {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			if err := sleepUntil(ctx, lease.Acquired.Add(lease.Renew)); err != nil {
+				return err
+			}
+
+			next, err := c.keep(ctx, DHCPRenewing, lease, lease.Acquired.Add(lease.Rebind), c.Renew)
+			if next == nil && err == nil {
+				next, err = c.keep(ctx, DHCPRebinding, lease, lease.Expires(), c.Rebind)
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			lease = next // nil on a NAK or when the lease ran out
+		}
+	}
+}
+
+// keep tries extend until it gets a new lease, a NAK or until, waiting
+// half the time left between tries, down to dhcpMinRetryWait. It
+// returns nil and no error when until came first.
+func (c *DHCPClient) keep(ctx context.Context, state DHCPState, lease *DHCPLease, until time.Time,
+	extend func(context.Context, *DHCPLease) (*DHCPLease, error)) (*DHCPLease, error) {
+	c.setState(state, lease)
+	for time.Now().Before(until) {
+		attemptCtx, cancel := context.WithDeadline(ctx, until)
+		next, err := extend(attemptCtx, lease)
+		cancel()
+		if err == nil || errors.Is(err, ErrDHCPNak) || ctx.Err() != nil {
+			return next, err
+		}
+
+		left := time.Until(until)
+		if err := sleepUntil(ctx, time.Now().Add(min(max(left/2, dhcpMinRetryWait), left))); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// sleepUntil waits until t or until ctx is done
+func sleepUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func dhclientMain(args []string) error {
+	fs := flag.NewFlagSet("dhclient", flag.ContinueOnError)
+	iface := fs.String("i", "", "`interface` to get an address for")
+	hostname := fs.String("hostname", "", "`name` to register with the server")
+	timeout := fs.Duration("W", dhcpDefaultTimeout, "`timeout` for each reply")
+	once := fs.Bool("1", false, "exit once a lease is acquired")
+	release := fs.Bool("release", false, "release the lease on exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *iface == "" || fs.NArg() != 0 {
+		return errors.New("usage: dhclient -i interface [flags]")
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	c := &DHCPClient{
+		Interface: *iface,
+		Hostname:  *hostname,
+		Timeout:   *timeout,
+		OnState: func(state DHCPState, lease *DHCPLease) {
+			if lease != nil && state == DHCPBound {
+				fmt.Printf("%s: %v\n", state, lease)
+				return
+			}
+			fmt.Println(state)
+		},
+	}
+	if *once {
+		lease, err := c.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(lease)
+		if *release {
+			return c.Release(context.Background(), lease)
+		}
+		return nil
+	}
+
+	err := c.Run(ctx)
+	if _, lease := c.State(); lease != nil && *release {
+		if err := c.Release(context.Background(), lease); err != nil {
+			return err
+		}
+		fmt.Printf("released %s\n", lease.IP)
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+
+	return err
+}
+
+// dhcpTestServer is a DHCP server for the tests, leasing 192.0.2.100 and
+// up, and answering where the requests came from rather than broadcast
+type dhcpTestServer struct {
+	pc       net.PacketConn
+	id       net.IP // Its server id
+	lease    uint32 // Lease, T1 and T2 in seconds
+	t1, t2   uint32
+	mu       sync.Mutex
+	received map[uint8]int // Messages by type
+	drop     map[uint8]int // Messages to ignore, by type
+	nak      int           // Requests to refuse
+	leases   map[string]net.IP
+}
+
+func newDHCPTestServer(t *testing.T) *dhcpTestServer {
+	t.Helper()
+
+	pc := testPacketConn(t)
+	s := &dhcpTestServer{
+		pc: pc, id: net.IPv4(127, 0, 0, 1), lease: 3600,
+		received: make(map[uint8]int), drop: make(map[uint8]int), leases: make(map[string]net.IP),
+	}
+
+	return s
+}
+
+// client starts the server, set up by then, and returns a client of it,
+// over a socket of its own
+func (s *dhcpTestServer) client(t *testing.T) *DHCPClient {
+	t.Helper()
+	go s.serve()
+
+	pc := testPacketConn(t)
+
+	return &DHCPClient{
+		HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x42},
+		Hostname:     "gopher",
+		Conn:         pc,
+		Server:       s.pc.LocalAddr().(*net.UDPAddr),
+		Timeout:      200 * time.Millisecond,
+		Retry:        RetryPolicy{Attempts: 4, Initial: 10 * time.Millisecond},
+	}
+}
+
+func (s *dhcpTestServer) count(typ uint8) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received[typ]
+}
+
+func (s *dhcpTestServer) serve() {
+	buf := make([]byte, dhcpMaxMessageSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var m dhcpMessage
+		if m.UnmarshalBinary(buf[:n]) != nil || m.Op != dhcpBootRequest {
+			continue
+		}
+		if reply := s.handle(&m); reply != nil {
+			b, _ := reply.MarshalBinary()
+			_, _ = s.pc.WriteTo(b, addr)
+		}
+	}
+}
+
+func (s *dhcpTestServer) handle(m *dhcpMessage) *dhcpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	typ := m.Type()
+	s.received[typ]++
+	if s.drop[typ] > 0 {
+		s.drop[typ]--
+		return nil
+	}
+
+	ip, ok := s.leases[m.CHAddr.String()]
+	if !ok {
+		ip = net.IPv4(192, 0, 2, byte(100+len(s.leases))).To4()
+		s.leases[m.CHAddr.String()] = ip
+	}
+
+	reply := &dhcpMessage{Op: dhcpBootReply, XID: m.XID, CHAddr: m.CHAddr, Broadcast: m.Broadcast,
+		YIAddr: ip, Options: map[uint8][]byte{dhcpOptServerID: s.id.To4()}}
+	switch typ {
+	case dhcpDiscover:
+		reply.Options[dhcpOptMessageType] = []byte{dhcpOffer}
+	case dhcpRequest:
+		if s.nak > 0 {
+			s.nak--
+			reply.YIAddr = nil
+			reply.Options[dhcpOptMessageType] = []byte{dhcpNak}
+			return reply
+		}
+		reply.Options[dhcpOptMessageType] = []byte{dhcpAck}
+	default:
+		return nil
+	}
+	reply.Options[dhcpOptSubnetMask] = net.CIDRMask(24, 32)
+	reply.Options[dhcpOptRouter] = net.IPv4(192, 0, 2, 1).To4()
+	reply.Options[dhcpOptDNS] = append(net.IPv4(192, 0, 2, 53).To4(), net.IPv4(192, 0, 2, 54).To4()...)
+	reply.Options[dhcpOptLeaseTime] = binary.BigEndian.AppendUint32(nil, s.lease)
+	if s.t1 > 0 {
+		reply.Options[dhcpOptRenewalTime] = binary.BigEndian.AppendUint32(nil, s.t1)
+		reply.Options[dhcpOptRebindTime] = binary.BigEndian.AppendUint32(nil, s.t2)
+	}
+
+	return reply
+}
+
+func TestDHCPMessage(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 300) // Split over two options
+	in := &dhcpMessage{
+		Op: dhcpBootRequest, XID: 0xdeadbeef, Secs: 3, Broadcast: true,
+		CIAddr: net.IPv4(192, 0, 2, 7), CHAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		Options: map[uint8][]byte{dhcpOptHostname: long, dhcpOptMessageType: {dhcpRequest}, dhcpOptClientID: {1, 2}},
+	}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < dhcpMinMessageSize || b[dhcpHeaderSize] != dhcpOptMessageType {
+		t.Errorf("expected at least %d bytes, the message type first; actual: %d, option %d", dhcpMinMessageSize,
+			len(b), b[dhcpHeaderSize])
+	}
+
+	var out dhcpMessage
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if out.XID != in.XID || out.Secs != 3 || !out.Broadcast || !out.CIAddr.Equal(in.CIAddr) ||
+		!bytes.Equal(out.CHAddr, in.CHAddr) || out.Type() != dhcpRequest || !bytes.Equal(out.Options[dhcpOptHostname], long) {
+		t.Errorf("expected %+v; actual: %+v", in, out)
+	}
+
+	for name, bad := range map[string][]byte{
+		"short":     b[:100],
+		"cookie":    append(make([]byte, dhcpHeaderSize), dhcpOptEnd),
+		"truncated": append(slices.Clone(b[:dhcpHeaderSize]), dhcpOptHostname, 10, 'x'),
+		"no end":    slices.Clone(b[:dhcpHeaderSize]),
+	} {
+		if err := out.UnmarshalBinary(bad); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDHCPClient(t *testing.T) {
+	s := newDHCPTestServer(t)
+	s.drop[dhcpDiscover] = 1 // Lost on the way, sent again
+	s.nak = 1                // Someone was faster, start over
+	c := s.client(t)
+
+	var states []DHCPState
+	c.OnState = func(state DHCPState, _ *DHCPLease) { states = append(states, state) }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lease, err := c.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lease.IP.Equal(net.IPv4(192, 0, 2, 100)) || lease.Mask.String() != "ffffff00" || len(lease.Routers) != 1 ||
+		len(lease.DNS) != 2 || !lease.Server.Equal(s.id) || lease.Duration != time.Hour ||
+		lease.Renew != 30*time.Minute || lease.Rebind != 52*time.Minute+30*time.Second {
+		t.Errorf("unexpected lease %v, T1 %s, T2 %s", lease, lease.Renew, lease.Rebind)
+	}
+	if s.count(dhcpDiscover) != 3 || s.count(dhcpRequest) != 2 {
+		t.Errorf("expected 3 discovers, 2 requests; actual: %d, %d", s.count(dhcpDiscover), s.count(dhcpRequest))
+	}
+	expected := []DHCPState{DHCPSelecting, DHCPSelecting, DHCPRequesting, DHCPSelecting, DHCPRequesting}
+	if !slices.Equal(states, expected) {
+		t.Errorf("expected states %v; actual: %v", expected, states)
+	}
+
+	renewed, err := c.Renew(ctx, lease)
+	if err != nil || !renewed.IP.Equal(lease.IP) {
+		t.Errorf("expected %s renewed; actual: %v, %v", lease.IP, renewed, err)
+	}
+	s.mu.Lock()
+	s.nak = 1
+	s.mu.Unlock()
+	if _, err := c.Rebind(ctx, lease); !errors.Is(err, ErrDHCPNak) {
+		t.Errorf("expected ErrDHCPNak; actual: %v", err)
+	}
+
+	if err := c.Release(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; s.count(dhcpRelease) == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.count(dhcpRelease) != 1 {
+		t.Error("expected a release")
+	}
+
+	// No server at all: the attempts are used up
+	s.mu.Lock()
+	s.drop[dhcpDiscover] = 10
+	s.mu.Unlock()
+	c.Retry.Attempts = 2
+	if _, err := c.Acquire(ctx); !IsTimeout(err) {
+		t.Errorf("expected a timeout; actual: %v", err)
+	}
+}
+
+func TestDHCPClientRun(t *testing.T) {
+	// A lease of 4 seconds, renewed after 1, rebound after 2. The
+	// server gives an id nobody listens on, so the renewal, unicast
+	// there, gets no answer, and the rebinding, broadcast, gets one.
+	s := newDHCPTestServer(t)
+	s.id = net.IPv4(127, 0, 0, 2)
+	s.lease, s.t1, s.t2 = 4, 1, 2
+	c := s.client(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var states []DHCPState
+	c.OnState = func(state DHCPState, _ *DHCPLease) {
+		states = append(states, state)
+		if state == DHCPBound && slices.Contains(states, DHCPRebinding) {
+			cancel()
+		}
+	}
+	if err := c.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled; actual: %v (states %v)", err, states)
+	}
+
+	expected := []DHCPState{DHCPInit, DHCPSelecting, DHCPRequesting, DHCPBound, DHCPRenewing, DHCPRebinding, DHCPBound}
+	if !slices.Equal(states, expected) {
+		t.Errorf("expected states %v; actual: %v", expected, states)
+	}
+	if _, lease := c.State(); lease == nil || !lease.IP.Equal(net.IPv4(192, 0, 2, 100)) {
+		t.Errorf("expected a lease of 192.0.2.100; actual: %v", lease)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// dhcpListenConfig sets SO_BROADCAST on the socket, to send to
+// 255.255.255.255, binds it to the interface, for the broadcasts to
+// leave from there with no route to follow, and sets SO_REUSEADDR, for
+// one client per interface on port 68
+func dhcpListenConfig(iface string) *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+				if sockErr == nil {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				}
+				if sockErr == nil {
+					sockErr = syscall.BindToDevice(int(fd), iface)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// dhcpListenConfig fails every listen, see DHCPLinux.go: without
+// SO_BINDTODEVICE, the broadcasts would leave by whichever interface
+// routes 255.255.255.255. A DHCPClient with a Conn works anywhere.
+func dhcpListenConfig(string) *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(_, _ string, _ syscall.RawConn) error {
+			return errors.New("dhcp: broadcast sockets bound to an interface are only supported on linux")
+		},
+	}
+}
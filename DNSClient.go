@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// DNS client
+//
+// net.Resolver asks whatever resolver the system is configured with.
+// DNSClient talks to a server of our choice instead, which is what
+// diagnostics tools (dig) and anything that must bypass /etc/resolv.conf
+// need.
+//
+// Queries go over UDP first, one datagram each way. A response that
+// doesn't fit (512 bytes without EDNS) comes back with the TC
+// (truncated) flag set, and the query is repeated over TCP, where every
+// message is prefixed with its 2 byte length. Transport can also send
+// every query over TCP, or over TLS (see DNSTransport.go).
+//
+// UDP loses packets, so every attempt has its own timeout and lost
+// queries are retried according to a RetryPolicy. Responses whose ID
+// doesn't match the query are ignored: they are either late answers to
+// an earlier attempt or someone trying to spoof an answer.
+
+// Default DNSClient values
+const (
+	defaultDNSTimeout = 2 * time.Second
+	dnsUDPSize        = 4096 // Generous, responses are 512 bytes without EDNS
+)
+
+// DNSError is returned when the server answers with an error code
+type DNSError struct {
+	Name  string
+	RCode DNSRCode
+}
+
+func (e *DNSError) Error() string {
+	return fmt.Sprintf("dns: %s: %s", e.Name, e.RCode)
+}
+
+// DNSClient sends queries to a specific DNS server
+type DNSClient struct {
+	Server  string        // host:port of the server
+	Timeout time.Duration // Per attempt (defaults to 2s)
+	Retry   RetryPolicy   // Applied to timeouts and network errors
+
+	// Dialer is used for the UDP and TCP connections (defaults to a
+	// zero net.Dialer)
+	Dialer *net.Dialer
+
+	// Transport is DNSOverUDP (the default), DNSOverTCP or DNSOverTLS
+	Transport DNSTransport
+
+	// TLS configures DNS over TLS, ServerName defaulting to the host
+	// of Server
+	TLS *tls.Config
+
+	// IdleTimeout closes the TCP or TLS connection once no query used
+	// it for that long (defaults to 10s)
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	stream *dnsStream // The connection queries share over TCP or TLS
+}
+
+// dnsIDs seeds query IDs randomly, predictable IDs make spoofing easy
+var dnsIDs atomic.Uint32
+
+func init() {
+	dnsIDs.Store(rand.Uint32())
+}
+
+// NewDNSQuery returns a recursive query for name and type
+func NewDNSQuery(name string, t DNSType) *DNSMessage {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	return &DNSMessage{
+		ID:               uint16(dnsIDs.Add(1)),
+		RecursionDesired: true,
+		Questions:        []DNSQuestion{{Name: name, Type: t, Class: DNSClassINET}},
+	}
+}
+
+// Lookup queries the records of type t for name. Answers of other types
+// (e.g. the CNAME records leading to the requested ones) are included.
+// A response code other than NOERROR is returned as a *DNSError.
+func (c *DNSClient) Lookup(ctx context.Context, name string, t DNSType) ([]DNSRecord, error) {
+	resp, err := c.Exchange(ctx, NewDNSQuery(name, t))
+	if err != nil {
+		return nil, err
+	}
+	if resp.RCode != DNSRCodeSuccess {
+		return nil, &DNSError{Name: name, RCode: resp.RCode}
+	}
+
+	return resp.Answers, nil
+}
+
+// Exchange sends query and returns the response, retrying lost queries
+// and falling back to TCP for truncated responses
+func (c *DNSClient) Exchange(ctx context.Context, query *DNSMessage) (*DNSMessage, error) {
+	b, err := query.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *DNSMessage
+	err = c.Retry.Do(ctx, func(ctx context.Context) error {
+		if c.Transport == DNSOverTCP || c.Transport == DNSOverTLS {
+			resp, err = c.exchangeStream(ctx, query.ID, b)
+			return err
+		}
+		resp, err = c.exchangeUDP(ctx, query.ID, b)
+		if err == nil && resp.Truncated {
+			resp, err = c.exchangeStream(ctx, query.ID, b)
+		}
+		return err
+	})
+
+	return resp, err
+}
+
+func (c *DNSClient) dialer() *net.Dialer {
+	if c.Dialer != nil {
+		return c.Dialer
+	}
+
+	return new(net.Dialer)
+}
+
+// attemptContext bounds a single attempt by Timeout
+func (c *DNSClient) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// exchangeUDP sends one query datagram and waits for the matching reply
+func (c *DNSClient) exchangeUDP(ctx context.Context, id uint16, query []byte) (*DNSMessage, error) {
+	ctx, cancel := c.attemptContext(ctx)
+	defer cancel()
+
+	conn, err := c.dialer().DialContext(ctx, "udp", c.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := new(DNSMessage)
+		if err := resp.UnmarshalBinary(buf[:n]); err != nil || !resp.Response || resp.ID != id {
+			// Not ours: keep waiting for the real answer
+			continue
+		}
+
+		return resp, nil
+	}
+}
+
+// writeDNSTCP writes a length-prefixed message, in one writev(2) like
+// writeTLV
+func writeDNSTCP(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return fmt.Errorf("dns: message %w for TCP", ErrTooLarge)
+	}
+
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(msg)))
+	buffers := net.Buffers{size[:], msg}
+
+	_, err := buffers.WriteTo(w)
+	return err
+}
+
+// readDNSTCP reads a length-prefixed message
+func readDNSTCP(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	return ReadExactly(r, int(size))
+}
+
+// fakeDNSServer answers every UDP query with the message built by
+// respond, and TCP queries with respondTCP
+func fakeDNSServer(t *testing.T, respond, respondTCP func(q *DNSMessage) *DNSMessage) string {
+	t.Helper()
+
+	l, pc := testListenerPair(t)
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q DNSMessage
+			if q.UnmarshalBinary(buf[:n]) != nil {
+				continue
+			}
+			if resp := respond(&q); resp != nil {
+				b, _ := resp.MarshalBinary()
+				_, _ = pc.WriteTo(b, addr)
+			}
+		}
+	}()
+
+	if respondTCP == nil {
+		// Nobody answers over TCP
+		_ = l.Close()
+		return pc.LocalAddr().String()
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b, err := readDNSTCP(conn)
+			var q DNSMessage
+			if err == nil && q.UnmarshalBinary(b) == nil {
+				out, _ := respondTCP(&q).MarshalBinary()
+				_ = writeDNSTCP(conn, out)
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+// dnsAnswer builds a response to q with the given answers
+func dnsAnswer(q *DNSMessage, answers ...DNSRecord) *DNSMessage {
+	return &DNSMessage{ID: q.ID, Response: true, Questions: q.Questions, Answers: answers}
+}
+
+func TestDNSClientLookup(t *testing.T) {
+	addr := fakeDNSServer(t, func(q *DNSMessage) *DNSMessage {
+		if q.Questions[0].Name != "example.com." {
+			resp := dnsAnswer(q)
+			resp.RCode = DNSRCodeNXDomain
+			return resp
+		}
+		return dnsAnswer(q, DNSRecord{
+			Name: "example.com.", Type: DNSTypeA, Class: DNSClassINET, TTL: 60, IP: net.IPv4(192, 0, 2, 1),
+		})
+	}, nil)
+
+	c := &DNSClient{Server: addr, Timeout: time.Second}
+	records, err := c.Lookup(context.Background(), "example.com", DNSTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !records[0].IP.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("unexpected answers: %+v", records)
+	}
+
+	_, err = c.Lookup(context.Background(), "missing.example.com", DNSTypeA)
+	var dnsErr *DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.RCode != DNSRCodeNXDomain {
+		t.Errorf("expected NXDOMAIN; actual: %v", err)
+	}
+}
+
+func TestDNSClientTCPFallback(t *testing.T) {
+	// Too many TXT strings for a UDP response
+	var text []string
+	for i := 0; i < 20; i++ {
+		text = append(text, strings.Repeat("x", 100))
+	}
+
+	addr := fakeDNSServer(t,
+		func(q *DNSMessage) *DNSMessage {
+			resp := dnsAnswer(q)
+			resp.Truncated = true
+			return resp
+		},
+		func(q *DNSMessage) *DNSMessage {
+			return dnsAnswer(q, DNSRecord{
+				Name: "big.example.com.", Type: DNSTypeTXT, Class: DNSClassINET, Text: text,
+			})
+		},
+	)
+
+	c := &DNSClient{Server: addr, Timeout: time.Second}
+	records, err := c.Lookup(context.Background(), "big.example.com", DNSTypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0].Text) != 20 {
+		t.Errorf("expected the full TXT record over TCP; actual: %+v", records)
+	}
+}
+
+func TestDNSClientRetry(t *testing.T) {
+	// The first query is "lost", the second only gets a bogus response
+	// with the wrong ID, the third one is answered
+	var queries atomic.Int32
+	addr := fakeDNSServer(t, func(q *DNSMessage) *DNSMessage {
+		switch queries.Add(1) {
+		case 1:
+			return nil
+		case 2:
+			fake := dnsAnswer(q)
+			fake.ID++
+			return fake
+		}
+		return dnsAnswer(q, DNSRecord{
+			Name: "example.com.", Type: DNSTypeA, Class: DNSClassINET, IP: net.IPv4(192, 0, 2, 1),
+		})
+	}, nil)
+
+	c := &DNSClient{
+		Server:  addr,
+		Timeout: 50 * time.Millisecond,
+		Retry:   RetryPolicy{Attempts: 3, Initial: time.Millisecond},
+	}
+	records, err := c.Lookup(context.Background(), "example.com", DNSTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Errorf("unexpected answers: %+v", records)
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("expected 3 queries; actual: %d", n)
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// DNS messages (RFC 1035)
+//
+// Queries and responses share a single format: a 12 byte header
+// followed by four sections, each a list of entries.
+//
+//	+---------------------+
+//	|        Header       | ID, flags, entry count of each section
+//	+---------------------+
+//	|       Question      | What is being asked: name, type, class
+//	+---------------------+
+//	|        Answer       | Resource records answering the question
+//	+---------------------+
+//	|      Authority      | Records pointing to authoritative servers
+//	+---------------------+
+//	|      Additional     | Records that might help, e.g. glue
+//	+---------------------+
+//
+// Names are sequences of length-prefixed labels ending with a zero byte:
+// "www.example.com" is 3www7example3com0. To save space, a name may end
+// with a 2 byte pointer (top two bits set) to an earlier occurrence of
+// the rest of the name in the same message. We follow pointers when
+// decoding but never write them; that's allowed, just less compact.
+
+// DNSType is the type of a resource record or question
+type DNSType uint16
+
+// Record types we know how to decode
+const (
+	DNSTypeA     DNSType = 1
+	DNSTypeCNAME DNSType = 5
+	DNSTypeTXT   DNSType = 16
+	DNSTypeAAAA  DNSType = 28
+	DNSTypeSRV   DNSType = 33
+)
+
+func (t DNSType) String() string {
+	switch t {
+	case DNSTypeA:
+		return "A"
+	case DNSTypeCNAME:
+		return "CNAME"
+	case DNSTypeTXT:
+		return "TXT"
+	case DNSTypeAAAA:
+		return "AAAA"
+	case DNSTypeSRV:
+		return "SRV"
+	}
+
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+// DNSClassINET is the only class anyone uses
+const DNSClassINET = 1
+
+// DNSRCode is the response code in the header
+type DNSRCode uint8
+
+const (
+	DNSRCodeSuccess  DNSRCode = 0
+	DNSRCodeFormErr  DNSRCode = 1 // The server couldn't parse the query
+	DNSRCodeServFail DNSRCode = 2 // The server failed to answer
+	DNSRCodeNXDomain DNSRCode = 3 // The name doesn't exist
+	DNSRCodeNotImp   DNSRCode = 4 // Query type not implemented
+	DNSRCodeRefused  DNSRCode = 5 // The server won't answer us
+)
+
+func (c DNSRCode) String() string {
+	switch c {
+	case DNSRCodeSuccess:
+		return "NOERROR"
+	case DNSRCodeFormErr:
+		return "FORMERR"
+	case DNSRCodeServFail:
+		return "SERVFAIL"
+	case DNSRCodeNXDomain:
+		return "NXDOMAIN"
+	case DNSRCodeNotImp:
+		return "NOTIMP"
+	case DNSRCodeRefused:
+		return "REFUSED"
+	}
+
+	return fmt.Sprintf("RCODE%d", uint8(c))
+}
+
+const (
+	dnsHeaderSize = 12
+
+	// Header flag bits
+	dnsFlagResponse           = 1 << 15
+	dnsFlagAuthoritative      = 1 << 10
+	dnsFlagTruncated          = 1 << 9
+	dnsFlagRecursionDesired   = 1 << 8
+	dnsFlagRecursionAvailable = 1 << 7
+
+	dnsMaxNameLength  = 255
+	dnsMaxLabelLength = 63
+	dnsMaxPointers    = 16 // Guards against pointer loops
+)
+
+var (
+	ErrDNSShortMessage = errors.New("dns: message too short")
+	ErrDNSBadName      = errors.New("dns: malformed name")
+)
+
+// DNSQuestion is an entry of the question section
+type DNSQuestion struct {
+	Name  string // Fully qualified, e.g. "example.com."
+	Type  DNSType
+	Class uint16
+}
+
+// DNSRecord is a resource record. Depending on Type, the record data is
+// decoded into IP (A, AAAA), Target (CNAME, SRV), Text (TXT) or the SRV
+// fields; anything else is kept in RData as is.
+type DNSRecord struct {
+	Name  string
+	Type  DNSType
+	Class uint16
+	TTL   uint32
+
+	IP       net.IP
+	Target   string
+	Text     []string
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+
+	RData []byte
+}
+
+// DNSMessage is a DNS query or response
+type DNSMessage struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	RCode              DNSRCode
+
+	Questions  []DNSQuestion
+	Answers    []DNSRecord
+	Authority  []DNSRecord
+	Additional []DNSRecord
+}
+
+// MarshalBinary encodes the message without name compression
+func (m *DNSMessage) MarshalBinary() ([]byte, error) {
+	b := new(bytes.Buffer)
+
+	var flags uint16
+	if m.Response {
+		flags |= dnsFlagResponse
+	}
+	flags |= uint16(m.Opcode&0xf) << 11
+	if m.Authoritative {
+		flags |= dnsFlagAuthoritative
+	}
+	if m.Truncated {
+		flags |= dnsFlagTruncated
+	}
+	if m.RecursionDesired {
+		flags |= dnsFlagRecursionDesired
+	}
+	if m.RecursionAvailable {
+		flags |= dnsFlagRecursionAvailable
+	}
+	flags |= uint16(m.RCode & 0xf)
+
+	for _, v := range []uint16{
+		m.ID, flags,
+		uint16(len(m.Questions)), uint16(len(m.Answers)),
+		uint16(len(m.Authority)), uint16(len(m.Additional)),
+	} {
+		_ = binary.Write(b, binary.BigEndian, v)
+	}
+
+	for _, q := range m.Questions {
+		if err := writeDNSName(b, q.Name); err != nil {
+			return nil, err
+		}
+		_ = binary.Write(b, binary.BigEndian, q.Type)
+		_ = binary.Write(b, binary.BigEndian, q.Class)
+	}
+
+	for _, section := range [][]DNSRecord{m.Answers, m.Authority, m.Additional} {
+		for _, r := range section {
+			if err := r.write(b); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// write appends the record to b
+func (r DNSRecord) write(b *bytes.Buffer) error {
+	if err := writeDNSName(b, r.Name); err != nil {
+		return err
+	}
+
+	rdata := new(bytes.Buffer)
+	switch r.Type {
+	case DNSTypeA:
+		ip := r.IP.To4()
+		if ip == nil {
+			return fmt.Errorf("dns: A record %s without IPv4 address", r.Name)
+		}
+		rdata.Write(ip)
+	case DNSTypeAAAA:
+		ip := r.IP.To16()
+		if ip == nil || r.IP.To4() != nil {
+			return fmt.Errorf("dns: AAAA record %s without IPv6 address", r.Name)
+		}
+		rdata.Write(ip)
+	case DNSTypeCNAME:
+		if err := writeDNSName(rdata, r.Target); err != nil {
+			return err
+		}
+	case DNSTypeTXT:
+		// One or more strings, each with a single byte length
+		for _, s := range r.Text {
+			if len(s) > 255 {
+				return fmt.Errorf("dns: TXT string longer than 255 bytes")
+			}
+			rdata.WriteByte(byte(len(s)))
+			rdata.WriteString(s)
+		}
+	case DNSTypeSRV:
+		_ = binary.Write(rdata, binary.BigEndian, r.Priority)
+		_ = binary.Write(rdata, binary.BigEndian, r.Weight)
+		_ = binary.Write(rdata, binary.BigEndian, r.Port)
+		if err := writeDNSName(rdata, r.Target); err != nil {
+			return err
+		}
+	default:
+		rdata.Write(r.RData)
+	}
+
+	_ = binary.Write(b, binary.BigEndian, r.Type)
+	_ = binary.Write(b, binary.BigEndian, r.Class)
+	_ = binary.Write(b, binary.BigEndian, r.TTL)
+	_ = binary.Write(b, binary.BigEndian, uint16(rdata.Len()))
+	b.Write(rdata.Bytes())
+
+	return nil
+}
+
+// writeDNSName writes name as a sequence of labels
+func writeDNSName(b *bytes.Buffer, name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > dnsMaxNameLength-2 {
+		return fmt.Errorf("%w: %q too long", ErrDNSBadName, name)
+	}
+
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > dnsMaxLabelLength {
+				return fmt.Errorf("%w: %q", ErrDNSBadName, name)
+			}
+			b.WriteByte(byte(len(label)))
+			b.WriteString(label)
+		}
+	}
+
+	return b.WriteByte(0)
+}
+
+// UnmarshalBinary decodes a message
+func (m *DNSMessage) UnmarshalBinary(p []byte) error {
+	if len(p) < dnsHeaderSize {
+		return ErrDNSShortMessage
+	}
+
+	flags := binary.BigEndian.Uint16(p[2:])
+	*m = DNSMessage{
+		ID:                 binary.BigEndian.Uint16(p),
+		Response:           flags&dnsFlagResponse != 0,
+		Opcode:             uint8(flags>>11) & 0xf,
+		Authoritative:      flags&dnsFlagAuthoritative != 0,
+		Truncated:          flags&dnsFlagTruncated != 0,
+		RecursionDesired:   flags&dnsFlagRecursionDesired != 0,
+		RecursionAvailable: flags&dnsFlagRecursionAvailable != 0,
+		RCode:              DNSRCode(flags & 0xf),
+	}
+
+	d := dnsDecoder{msg: p, off: dnsHeaderSize}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(p[4+2*i:]))
+	}
+
+	for i := 0; i < counts[0]; i++ {
+		name, err := d.name()
+		if err != nil {
+			return err
+		}
+		fixed, err := d.bytes(4)
+		if err != nil {
+			return err
+		}
+		m.Questions = append(m.Questions, DNSQuestion{
+			Name:  name,
+			Type:  DNSType(binary.BigEndian.Uint16(fixed)),
+			Class: binary.BigEndian.Uint16(fixed[2:]),
+		})
+	}
+
+	for i, section := range []*[]DNSRecord{&m.Answers, &m.Authority, &m.Additional} {
+		for j := 0; j < counts[i+1]; j++ {
+			r, err := d.record()
+			if err != nil {
+				return err
+			}
+			*section = append(*section, r)
+		}
+	}
+
+	return nil
+}
+
+// dnsDecoder reads from a message; names need the whole message to
+// follow compression pointers
+type dnsDecoder struct {
+	msg []byte
+	off int
+}
+
+func (d *dnsDecoder) bytes(n int) ([]byte, error) {
+	if d.off+n > len(d.msg) {
+		return nil, ErrDNSShortMessage
+	}
+	b := d.msg[d.off : d.off+n]
+	d.off += n
+
+	return b, nil
+}
+
+// name decodes a possibly compressed name at the current offset
+func (d *dnsDecoder) name() (string, error) {
+	name, next, err := readDNSName(d.msg, d.off)
+	if err != nil {
+		return "", err
+	}
+	d.off = next
+
+	return name, nil
+}
+
+// readDNSName decodes the name at off and returns it together with the
+// offset right after it (after the first pointer, if any)
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	pointers := 0
+	length := 0
+
+	for {
+		if off >= len(msg) {
+			return "", 0, ErrDNSShortMessage
+		}
+		c := int(msg[off])
+
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return strings.Join(labels, ".") + ".", next, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, ErrDNSShortMessage
+			}
+			if length += c + 1; length > dnsMaxNameLength {
+				return "", 0, fmt.Errorf("%w: too long", ErrDNSBadName)
+			}
+			labels = append(labels, string(msg[off+1:off+1+c]))
+			off += 1 + c
+		case 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, ErrDNSShortMessage
+			}
+			if pointers++; pointers > dnsMaxPointers {
+				return "", 0, fmt.Errorf("%w: too many compression pointers", ErrDNSBadName)
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			return "", 0, fmt.Errorf("%w: unknown label type %#x", ErrDNSBadName, c&0xc0)
+		}
+	}
+}
+
+// record decodes a resource record at the current offset
+func (d *dnsDecoder) record() (DNSRecord, error) {
+	var r DNSRecord
+	var err error
+
+	if r.Name, err = d.name(); err != nil {
+		return r, err
+	}
+	fixed, err := d.bytes(10)
+	if err != nil {
+		return r, err
+	}
+	r.Type = DNSType(binary.BigEndian.Uint16(fixed))
+	r.Class = binary.BigEndian.Uint16(fixed[2:])
+	r.TTL = binary.BigEndian.Uint32(fixed[4:])
+	rdLen := int(binary.BigEndian.Uint16(fixed[8:]))
+
+	start := d.off
+	rdata, err := d.bytes(rdLen)
+	if err != nil {
+		return r, err
+	}
+	r.RData = append([]byte(nil), rdata...)
+
+	switch r.Type {
+	case DNSTypeA, DNSTypeAAAA:
+		if (r.Type == DNSTypeA && rdLen != net.IPv4len) || (r.Type == DNSTypeAAAA && rdLen != net.IPv6len) {
+			return r, fmt.Errorf("dns: bad %s record length %d", r.Type, rdLen)
+		}
+		r.IP = net.IP(r.RData)
+	case DNSTypeCNAME:
+		// May be compressed, so decode against the whole message
+		if r.Target, _, err = readDNSName(d.msg, start); err != nil {
+			return r, err
+		}
+	case DNSTypeTXT:
+		for i := 0; i < len(rdata); {
+			n := int(rdata[i])
+			if i+1+n > len(rdata) {
+				return r, ErrDNSShortMessage
+			}
+			r.Text = append(r.Text, string(rdata[i+1:i+1+n]))
+			i += 1 + n
+		}
+	case DNSTypeSRV:
+		if rdLen < 7 {
+			return r, ErrDNSShortMessage
+		}
+		r.Priority = binary.BigEndian.Uint16(rdata)
+		r.Weight = binary.BigEndian.Uint16(rdata[2:])
+		r.Port = binary.BigEndian.Uint16(rdata[4:])
+		if r.Target, _, err = readDNSName(d.msg, start+6); err != nil {
+			return r, err
+		}
+	}
+
+	return r, nil
+}
+
+func TestDNSMessageRoundTrip(t *testing.T) {
+	in := &DNSMessage{
+		ID:               0xbeef,
+		Response:         true,
+		Authoritative:    true,
+		RecursionDesired: true,
+		RCode:            DNSRCodeSuccess,
+		Questions:        []DNSQuestion{{Name: "example.com.", Type: DNSTypeA, Class: DNSClassINET}},
+		Answers: []DNSRecord{
+			{Name: "example.com.", Type: DNSTypeA, Class: DNSClassINET, TTL: 60, IP: net.IPv4(192, 0, 2, 1)},
+			{Name: "example.com.", Type: DNSTypeAAAA, Class: DNSClassINET, TTL: 60, IP: net.ParseIP("2001:db8::1")},
+			{Name: "www.example.com.", Type: DNSTypeCNAME, Class: DNSClassINET, TTL: 60, Target: "example.com."},
+			{Name: "example.com.", Type: DNSTypeTXT, Class: DNSClassINET, TTL: 60, Text: []string{"hello", "world"}},
+			{Name: "_sip._tcp.example.com.", Type: DNSTypeSRV, Class: DNSClassINET, TTL: 60,
+				Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com."},
+		},
+	}
+
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out DNSMessage
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.ID != in.ID || !out.Response || !out.Authoritative || !out.RecursionDesired {
+		t.Errorf("header mismatch: %+v", out)
+	}
+	if len(out.Questions) != 1 || out.Questions[0] != in.Questions[0] {
+		t.Errorf("question mismatch: %+v", out.Questions)
+	}
+	if len(out.Answers) != len(in.Answers) {
+		t.Fatalf("expected %d answers; actual: %d", len(in.Answers), len(out.Answers))
+	}
+
+	a := out.Answers
+	if !a[0].IP.Equal(in.Answers[0].IP) || !a[1].IP.Equal(in.Answers[1].IP) {
+		t.Errorf("address mismatch: %s, %s", a[0].IP, a[1].IP)
+	}
+	if a[2].Target != "example.com." {
+		t.Errorf("CNAME mismatch: %q", a[2].Target)
+	}
+	if strings.Join(a[3].Text, " ") != "hello world" {
+		t.Errorf("TXT mismatch: %q", a[3].Text)
+	}
+	if a[4].Priority != 10 || a[4].Weight != 5 || a[4].Port != 5060 || a[4].Target != "sip.example.com." {
+		t.Errorf("SRV mismatch: %+v", a[4])
+	}
+}
+
+func TestDNSMessageCompression(t *testing.T) {
+	// A response as a real server would send it: the answer's name and
+	// the CNAME target point back into the question
+	msg := []byte{
+		0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0,
+		// Question at offset 12: www.example.com A IN
+		3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0, 1, 0, 1,
+		// Answer: name = pointer to 12, CNAME, IN, TTL 300
+		0xc0, 12, 0, 5, 0, 1, 0, 0, 1, 0x2c,
+		// RDATA: "web" + pointer to "example.com" at 16
+		0, 6, 3, 'w', 'e', 'b', 0xc0, 16,
+	}
+
+	var m DNSMessage
+	if err := m.UnmarshalBinary(msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answers) != 1 {
+		t.Fatalf("expected 1 answer; actual: %d", len(m.Answers))
+	}
+	if r := m.Answers[0]; r.Name != "www.example.com." || r.Target != "web.example.com." || r.TTL != 300 {
+		t.Errorf("unexpected record: %+v", r)
+	}
+
+	// A pointer to itself must not loop forever
+	loop := append([]byte(nil), msg[:12]...)
+	loop[5] = 1
+	loop = append(loop, 0xc0, 12, 0, 1, 0, 1)
+	if err := m.UnmarshalBinary(loop); !errors.Is(err, ErrDNSBadName) {
+		t.Errorf("expected ErrDNSBadName; actual: %v", err)
+	}
+}
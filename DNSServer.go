@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Authoritative toy DNS server
+//
+// DNSServer answers queries from an in-memory zone: a map from names to
+// their records. It is authoritative for every name in the map and
+// answers NXDOMAIN ("no such domain") for anything else. Names that
+// exist but have no records of the requested type get an empty, but
+// successful, answer (a "NODATA" response), which tells resolvers not to
+// try other types of the name as missing.
+//
+// UDP responses are limited to 512 bytes. When the answer doesn't fit,
+// the server sends just the header and question with the TC flag set
+// and the client retries over TCP (see DNSClient), so the server listens
+// on both.
+
+// dnsMaxUDPSize is the UDP response limit without EDNS (RFC 1035)
+const dnsMaxUDPSize = 512
+
+// DNSZone maps fully qualified names ("example.com.") to their records
+type DNSZone map[string][]DNSRecord
+
+// DNSServer serves the records of a zone
+type DNSServer struct {
+	Zone DNSZone
+
+	// ErrorLog receives errors on TCP connections (defaults to
+	// log.Default())
+	ErrorLog *log.Logger
+}
+
+// NewDNSServer returns a server for zone. Names are matched
+// case-insensitively.
+func NewDNSServer(zone DNSZone) *DNSServer {
+	s := &DNSServer{Zone: make(DNSZone, len(zone))}
+	for name, records := range zone {
+		s.Zone[canonicalDNSName(name)] = records
+	}
+
+	return s
+}
+
+// canonicalDNSName lowercases name and makes it fully qualified
+func canonicalDNSName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	return name
+}
+
+// Answer builds the response to a query
+func (s *DNSServer) Answer(q *DNSMessage) *DNSMessage {
+	resp := &DNSMessage{
+		ID:               q.ID,
+		Response:         true,
+		Opcode:           q.Opcode,
+		Authoritative:    true,
+		RecursionDesired: q.RecursionDesired,
+		Questions:        q.Questions,
+	}
+
+	switch {
+	case q.Opcode != 0:
+		// Only standard queries, no NOTIFY/UPDATE
+		resp.RCode = DNSRCodeNotImp
+		return resp
+	case q.Response || len(q.Questions) != 1:
+		// Nobody sends more than one question in practice
+		resp.RCode = DNSRCodeFormErr
+		return resp
+	}
+
+	question := q.Questions[0]
+	if question.Class != DNSClassINET {
+		resp.RCode = DNSRCodeRefused
+		return resp
+	}
+
+	records, ok := s.Zone[canonicalDNSName(question.Name)]
+	if !ok {
+		resp.RCode = DNSRCodeNXDomain
+		return resp
+	}
+
+	for _, r := range records {
+		if r.Type == question.Type {
+			// Answer with the name as it was asked
+			r.Name = question.Name
+			if r.Class == 0 {
+				r.Class = DNSClassINET
+			}
+			resp.Answers = append(resp.Answers, r)
+		}
+	}
+
+	return resp
+}
+
+// respond parses a query and encodes the answer. Garbage gets no reply,
+// answering it could turn us into a reflector for spoofed traffic.
+func (s *DNSServer) respond(packet []byte) ([]byte, *DNSMessage, bool) {
+	var q DNSMessage
+	if err := q.UnmarshalBinary(packet); err != nil || q.Response {
+		return nil, nil, false
+	}
+
+	resp := s.Answer(&q)
+	b, err := resp.MarshalBinary()
+	if err != nil {
+		resp = &DNSMessage{ID: q.ID, Response: true, Questions: q.Questions, RCode: DNSRCodeServFail}
+		b, _ = resp.MarshalBinary()
+	}
+
+	return b, resp, true
+}
+
+// handlePacket is the PacketHandler answering UDP queries
+func (s *DNSServer) handlePacket(_ context.Context, pc net.PacketConn, addr net.Addr, packet []byte) {
+	b, resp, ok := s.respond(packet)
+	if !ok {
+		return
+	}
+
+	if len(b) > dnsMaxUDPSize {
+		// Too big: send what fits, the client asks again over TCP
+		truncated := *resp
+		truncated.Truncated = true
+		truncated.Answers, truncated.Authority, truncated.Additional = nil, nil, nil
+		b, _ = truncated.MarshalBinary()
+	}
+
+	_, _ = pc.WriteTo(b, addr)
+}
+
+// handleConn answers length-prefixed queries on a TCP connection until
+// the client hangs up
+func (s *DNSServer) handleConn(_ context.Context, conn net.Conn) {
+	for {
+		packet, err := readDNSTCP(conn)
+		if err != nil {
+			if !IsClosed(err) {
+				s.logf("dns: %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		b, _, ok := s.respond(packet)
+		if !ok {
+			return
+		}
+		if err := writeDNSTCP(conn, b); err != nil {
+			return
+		}
+	}
+}
+
+func (s *DNSServer) logf(format string, v ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// ServePacket answers UDP queries on pc until ctx is done
+func (s *DNSServer) ServePacket(ctx context.Context, pc net.PacketConn) error {
+	return ServePacket(ctx, pc, s.handlePacket)
+}
+
+// Serve answers TCP queries on l until ctx is done. Idle connections are
+// closed after 10 seconds.
+func (s *DNSServer) Serve(ctx context.Context, l net.Listener) error {
+	srv := NewTCPServer(l)
+	srv.ErrorLog = s.ErrorLog
+
+	return srv.Serve(ctx, func(ctx context.Context, conn net.Conn) {
+		s.handleConn(ctx, NewIdleConn(conn, 10*time.Second))
+	})
+}
+
+// ListenAndServe serves UDP and TCP on the same address until ctx is
+// done or one of them fails
+func (s *DNSServer) ListenAndServe(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	// Same port for TCP, even when addr asked for any port
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	go func() { errs <- s.ServePacket(ctx, pc) }()
+	go func() { errs <- s.Serve(ctx, l) }()
+
+	// The first one to stop takes the other one down
+	err = <-errs
+	cancel()
+	<-errs
+
+	return err
+}
+
+// startDNSServer runs a DNSServer on UDP and TCP for a test
+func startDNSServer(t *testing.T, s *DNSServer) string {
+	t.Helper()
+
+	l, pc := testListenerPair(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = s.ServePacket(ctx, pc) }()
+	go func() { _ = s.Serve(ctx, l) }()
+
+	return pc.LocalAddr().String()
+}
+
+func TestDNSServer(t *testing.T) {
+	// Enough TXT data to blow the 512 byte UDP limit
+	var big []string
+	for i := 0; i < 10; i++ {
+		big = append(big, strings.Repeat("z", 100))
+	}
+
+	s := NewDNSServer(DNSZone{
+		"example.com": {
+			{Type: DNSTypeA, TTL: 60, IP: net.IPv4(192, 0, 2, 1)},
+			{Type: DNSTypeAAAA, TTL: 60, IP: net.ParseIP("2001:db8::1")},
+			{Type: DNSTypeTXT, TTL: 60, Text: []string{"v=spf1 -all"}},
+		},
+		"big.example.com.": {
+			{Type: DNSTypeTXT, TTL: 60, Text: big},
+		},
+	})
+	s.ErrorLog = log.New(io.Discard, "", 0)
+
+	c := &DNSClient{Server: startDNSServer(t, s), Timeout: time.Second}
+	ctx := context.Background()
+
+	// Lookups are case-insensitive
+	a, err := c.Lookup(ctx, "EXAMPLE.com", DNSTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 1 || !a[0].IP.Equal(net.IPv4(192, 0, 2, 1)) || a[0].Name != "EXAMPLE.com." {
+		t.Errorf("unexpected A answers: %+v", a)
+	}
+
+	aaaa, err := c.Lookup(ctx, "example.com", DNSTypeAAAA)
+	if err != nil || len(aaaa) != 1 || !aaaa[0].IP.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("unexpected AAAA answers: %+v, %v", aaaa, err)
+	}
+
+	// The name exists, but has no SRV records
+	srv, err := c.Lookup(ctx, "example.com", DNSTypeSRV)
+	if err != nil || len(srv) != 0 {
+		t.Errorf("expected empty NOERROR answer; actual: %+v, %v", srv, err)
+	}
+
+	_, err = c.Lookup(ctx, "nope.example.com", DNSTypeA)
+	var dnsErr *DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.RCode != DNSRCodeNXDomain {
+		t.Errorf("expected NXDOMAIN; actual: %v", err)
+	}
+
+	// Truncated over UDP, complete over TCP
+	txt, err := c.Lookup(ctx, "big.example.com", DNSTypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txt) != 1 || len(txt[0].Text) != len(big) {
+		t.Errorf("expected the full TXT record; actual: %+v", txt)
+	}
+}
+
+func TestDNSServerFormErr(t *testing.T) {
+	s := NewDNSServer(nil)
+
+	resp := s.Answer(&DNSMessage{ID: 1})
+	if resp.RCode != DNSRCodeFormErr {
+		t.Errorf("expected FORMERR for a query without questions; actual: %s", resp.RCode)
+	}
+
+	resp = s.Answer(&DNSMessage{ID: 1, Opcode: 5, Questions: []DNSQuestion{{Name: "a.", Class: DNSClassINET}}})
+	if resp.RCode != DNSRCodeNotImp {
+		t.Errorf("expected NOTIMP for an UPDATE; actual: %s", resp.RCode)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// DNS over TCP and TLS
+//
+// UDP is the fast path, but some networks drop it, some answers don't
+// fit, and anyone on the path reads and can forge it. DNSClient can send
+// every query over a stream instead:
+//
+// - DNSOverTCP: the 2 byte length prefixed messages of the TCP fallback
+//   (RFC 7766), on port 53
+// - DNSOverTLS: the same inside TLS (DoT, RFC 7858), usually on port
+//   853. The server's certificate is checked against the host of Server
+//   unless TLS.ServerName says otherwise.
+//
+// A handshake (or two, with TLS) per query would cost more than the
+// query, so the client keeps one connection and pipelines on it: queries
+// are written as they come, without waiting for the answers before
+// them, and answers are matched to queries by ID in whatever order they
+// arrive. Timeout is per query: a slow answer fails its own query, not
+// the connection. A connection nobody used for IdleTimeout is closed,
+// and so is one the server closed (servers drop idle clients too); a
+// query that finds its reused connection gone is sent once more on a
+// new one before it counts as a failure.
+
+// DNSTransport is how DNSClient sends its queries
+type DNSTransport string
+
+const (
+	DNSOverUDP DNSTransport = "" // UDP, TCP for truncated responses
+	DNSOverTCP DNSTransport = "tcp"
+	DNSOverTLS DNSTransport = "tls"
+)
+
+const defaultDNSIdleTimeout = 10 * time.Second
+
+// errDNSStreamIdle closes a connection nobody used for a while
+var errDNSStreamIdle = errors.New("dns: connection idle")
+
+// dnsStream is a TCP or TLS connection pipelining queries
+type dnsStream struct {
+	conn net.Conn
+	idle time.Duration
+	done chan struct{} // Closed once the connection failed
+	used atomic.Bool   // Some query got its answer on it
+
+	writing sync.Mutex // Messages are written whole
+
+	mu      sync.Mutex
+	pending map[uint16]chan *DNSMessage
+	timer   *time.Timer // Closes the idle connection
+	err     error
+}
+
+func newDNSStream(conn net.Conn, idle time.Duration) *dnsStream {
+	s := &dnsStream{
+		conn:    conn,
+		idle:    idle,
+		done:    make(chan struct{}),
+		pending: make(map[uint16]chan *DNSMessage),
+	}
+	s.timer = time.AfterFunc(idle, s.closeIdle)
+	go s.readLoop()
+
+	return s
+}
+
+// readLoop hands the answers to the queries waiting for them
+func (s *dnsStream) readLoop() {
+	for {
+		b, err := readDNSTCP(s.conn)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		resp := new(DNSMessage)
+		if resp.UnmarshalBinary(b) != nil || !resp.Response {
+			continue
+		}
+		s.mu.Lock()
+		answer, ok := s.pending[resp.ID]
+		delete(s.pending, resp.ID)
+		s.mu.Unlock()
+		if ok {
+			answer <- resp // Buffered
+		}
+	}
+}
+
+// fail closes the connection, failing the queries waiting on it
+func (s *dnsStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+		close(s.done)
+		s.timer.Stop()
+		_ = s.conn.Close()
+	}
+}
+
+// closeIdle closes the connection unless a query is in flight
+func (s *dnsStream) closeIdle() {
+	s.mu.Lock()
+	busy := len(s.pending) > 0
+	s.mu.Unlock()
+	if !busy {
+		s.fail(errDNSStreamIdle)
+	}
+}
+
+// alive reports whether the connection takes queries
+func (s *dnsStream) alive() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// query sends query and waits for the answer with its ID, until ctx is
+// done or the connection fails
+func (s *dnsStream) query(ctx context.Context, id uint16, query []byte) (*DNSMessage, error) {
+	answer := make(chan *DNSMessage, 1)
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	if _, ok := s.pending[id]; ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("dns: query ID %d already in flight", id)
+	}
+	s.pending[id] = answer
+	s.timer.Stop()
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, id)
+		if len(s.pending) == 0 && s.err == nil {
+			s.timer.Reset(s.idle)
+		}
+		s.mu.Unlock()
+	}()
+
+	s.writing.Lock()
+	deadline, _ := ctx.Deadline()
+	_ = s.conn.SetWriteDeadline(deadline)
+	err := writeDNSTCP(s.conn, query)
+	s.writing.Unlock()
+	if err != nil {
+		// Maybe half a message went out: the stream is out of sync
+		s.fail(err)
+		return nil, err
+	}
+
+	select {
+	case resp := <-answer:
+		s.used.Store(true)
+		return resp, nil
+	case <-s.done:
+		return nil, s.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// exchangeStream sends the query over the shared TCP or TLS connection
+func (c *DNSClient) exchangeStream(ctx context.Context, id uint16, query []byte) (*DNSMessage, error) {
+	ctx, cancel := c.attemptContext(ctx)
+	defer cancel()
+
+	for retried := false; ; retried = true {
+		s, err := c.streamConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.query(ctx, id, query)
+		if err != nil && !retried && ctx.Err() == nil && !s.alive() && s.used.Load() {
+			// The server closed a connection that had served queries
+			// before: not a failure of this query, try a new one
+			continue
+		}
+		return resp, err
+	}
+}
+
+// streamConn returns the shared connection, connecting when there's
+// none or it failed
+func (c *DNSClient) streamConn(ctx context.Context) (*dnsStream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stream != nil && c.stream.alive() {
+		return c.stream, nil
+	}
+
+	conn, err := c.dialStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	idle := c.IdleTimeout
+	if idle <= 0 {
+		idle = defaultDNSIdleTimeout
+	}
+	c.stream = newDNSStream(conn, idle)
+
+	return c.stream, nil
+}
+
+// dialStream connects over TCP, with TLS on top for DNSOverTLS
+func (c *DNSClient) dialStream(ctx context.Context) (net.Conn, error) {
+	if c.Transport != DNSOverTLS {
+		return c.dialer().DialContext(ctx, "tcp", c.Server)
+	}
+
+	config := c.TLS.Clone()
+	if config == nil {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.Server)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	d := &tls.Dialer{NetDialer: c.dialer(), Config: config}
+
+	return d.DialContext(ctx, "tcp", c.Server)
+}
+
+// Close closes the shared TCP or TLS connection
+func (c *DNSClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stream != nil {
+		c.stream.fail(net.ErrClosed)
+		c.stream = nil
+	}
+	return nil
+}
+
+// ServeTLS answers DNS over TLS queries on l until ctx is done
+func (s *DNSServer) ServeTLS(ctx context.Context, l net.Listener, config *tls.Config) error {
+	return s.Serve(ctx, tls.NewListener(l, config))
+}
+
+func TestDNSClientPipelining(t *testing.T) {
+	// The server reads three queries before it answers any, and then
+	// answers them last first, which only a pipelining client that
+	// matches answers by ID gets through
+	l := testListener(t)
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					var queries []DNSMessage
+					for range 3 {
+						b, err := readDNSTCP(conn)
+						var q DNSMessage
+						if err != nil || q.UnmarshalBinary(b) != nil {
+							return
+						}
+						queries = append(queries, q)
+					}
+					for i := len(queries) - 1; i >= 0; i-- {
+						q := &queries[i]
+						out, _ := dnsAnswer(q, DNSRecord{
+							Name: q.Questions[0].Name, Type: DNSTypeTXT, Class: DNSClassINET, Text: []string{q.Questions[0].Name},
+						}).MarshalBinary()
+						_ = writeDNSTCP(conn, out)
+					}
+				}
+			}()
+		}
+	}()
+
+	c := &DNSClient{Server: l.Addr().String(), Transport: DNSOverTCP, Timeout: 2 * time.Second}
+	defer c.Close()
+	for round := range 2 {
+		var wg sync.WaitGroup
+		for i := range 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				name := fmt.Sprintf("q%d-%d.example.com.", round, i)
+				records, err := c.Lookup(context.Background(), name, DNSTypeTXT)
+				if err != nil || len(records) != 1 || records[0].Text[0] != name {
+					t.Errorf("%s: unexpected answer %+v, %v", name, records, err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expected all queries on 1 connection; actual: %d", n)
+	}
+}
+
+func TestDNSClientStreamTimeout(t *testing.T) {
+	// slow.example.com never gets an answer, which fails that query
+	// alone: the connection goes on serving the others
+	var slow atomic.Int32
+	s := NewDNSServer(DNSZone{"fast.example.com": {{Name: "fast.example.com.", Type: DNSTypeA, Class: DNSClassINET, IP: net.IPv4(192, 0, 2, 1)}}})
+	l := testListener(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					b, err := readDNSTCP(conn)
+					if err != nil {
+						return
+					}
+					var q DNSMessage
+					if q.UnmarshalBinary(b) == nil && q.Questions[0].Name == "slow.example.com." {
+						slow.Add(1)
+						continue
+					}
+					out, _, _ := s.respond(b)
+					_ = writeDNSTCP(conn, out)
+				}
+			}()
+		}
+	}()
+
+	c := &DNSClient{
+		Server:    l.Addr().String(),
+		Transport: DNSOverTCP,
+		Timeout:   50 * time.Millisecond,
+		Retry:     RetryPolicy{Attempts: 2, Initial: time.Millisecond},
+	}
+	defer c.Close()
+	if _, err := c.Lookup(context.Background(), "slow.example.com", DNSTypeA); !IsTimeout(err) {
+		t.Errorf("expected a timeout; actual: %v", err)
+	}
+	if n := slow.Load(); n != 2 {
+		t.Errorf("expected 2 attempts; actual: %d", n)
+	}
+	stream := c.stream
+	if records, err := c.Lookup(context.Background(), "fast.example.com", DNSTypeA); err != nil || len(records) != 1 {
+		t.Errorf("unexpected answer %+v, %v", records, err)
+	}
+	if c.stream != stream {
+		t.Error("expected the connection to survive the timeout")
+	}
+
+	// Idle, the connection is closed; the next query connects again
+	c.IdleTimeout = 20 * time.Millisecond
+	_ = c.Close()
+	if _, err := c.Lookup(context.Background(), "fast.example.com", DNSTypeA); err != nil {
+		t.Fatal(err)
+	}
+	stream = c.stream
+	time.Sleep(100 * time.Millisecond)
+	if stream.alive() {
+		t.Error("expected the idle connection closed")
+	}
+	if _, err := c.Lookup(context.Background(), "fast.example.com", DNSTypeA); err != nil || c.stream == stream {
+		t.Errorf("expected a new connection; actual: %v", err)
+	}
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Issue(TLSLeaf{Name: "dns", Hosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewDNSServer(DNSZone{"example.com": {{Name: "example.com.", Type: DNSTypeA, Class: DNSClassINET, IP: net.IPv4(192, 0, 2, 1)}}})
+	l := testListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.ServeTLS(ctx, l, ServerConfig(cert, nil)) }()
+
+	// The certificate is checked against the server's address
+	c := &DNSClient{Server: l.Addr().String(), Transport: DNSOverTLS, TLS: ClientConfig(ca.Pool()), Timeout: 2 * time.Second}
+	defer c.Close()
+	for range 2 {
+		records, err := c.Lookup(ctx, "example.com", DNSTypeA)
+		if err != nil || len(records) != 1 || !records[0].IP.Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Errorf("unexpected answer %+v, %v", records, err)
+		}
+	}
+	if _, ok := c.stream.conn.(*tls.Conn); !ok {
+		t.Errorf("expected a TLS connection; actual: %T", c.stream.conn)
+	}
+
+	// And one issued for another name is refused
+	other := &DNSClient{
+		Server:    l.Addr().String(),
+		Transport: DNSOverTLS,
+		TLS:       &tls.Config{RootCAs: ca.Pool(), ServerName: "dns.example.net"},
+		Retry:     RetryPolicy{Attempts: 1},
+	}
+	defer other.Close()
+	var certErr *tls.CertificateVerificationError
+	if _, err := other.Lookup(ctx, "example.com", DNSTypeA); !errors.As(err, &certErr) {
+		t.Errorf("expected a certificate error; actual: %v", err)
+	}
+}
@@ -16,14 +16,12 @@ import (
 // and so on. If you don’t hear from the remote node in the allotted time, you
 // can assume that either the remote node is gone and you never received its
 // FIN or that it is idle.
+// IdleConn (IdleConn.go) packages this pattern as a reusable conn wrapper.
 func TestDeadline(t *testing.T) {
 	sync := make(chan struct{}) // Channel used to synchronize between goroutines
 
 	// Start listening on a random TCP port on loopback address
-	listener, err := net.Listen("tcp", "127.0.0.1:")
-	if err != nil {
-		t.Fatal(err)
-	}
+	listener := testListener(t)
 
 	// Start server logic in a goroutine
 	go func() {
@@ -2,18 +2,22 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"net"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 const payload = "The bigger the interface, the weaker the abstraction."
 
 func TestScanner(t *testing.T) {
-	listener, err := net.Listen("tcp", "127.0.0.1:")
-	if err != nil {
-		t.Fatal(err)
-	}
+	listener := testListener(t)
 
 	// Start a goroutine to act as a server
 	go func() {
@@ -77,3 +81,283 @@ func TestScanner(t *testing.T) {
 	// Log the successful result for debugging/verification purposes
 	t.Logf("Scanned words: %#v", words)
 }
+
+// Reusable split functions
+//
+// bufio.Scanner splits a stream into tokens with a SplitFunc. The
+// standard library ships ScanWords, ScanLines, ScanRunes and ScanBytes;
+// the protocols in this repo need a few more:
+//
+// - ScanLengthPrefixed: 4-byte big-endian length followed by the payload
+// - ScanTLV: a complete TLV frame as written by Binary/String.WriteTo
+// - ScanNullTerminated: NUL terminated strings, as used in TFTP requests
+// - ScanCRLFLines: CRLF terminated lines with a maximum line length
+// - ScanSyslogFrames: syslog messages over TCP, octet counted or LF
+//   terminated (RFC 6587)
+//
+// A SplitFunc is called with whatever is buffered so far. Returning
+// (0, nil, nil) asks the scanner to read more data, so a frame arriving
+// in many small pieces is handled the same as one arriving all at once.
+
+// ErrLineTooLong is returned by ScanCRLFLines when no line ending shows
+// up within the maximum line length
+var ErrLineTooLong = errLimit("line too long")
+
+// ScanLengthPrefixed returns the payload of frames laid out as
+// [4 bytes big-endian length][payload]. Payloads larger than
+// MaxPayloadSize fail with ErrMaxPayloadSize.
+func ScanLengthPrefixed(data []byte, atEOF bool) (int, []byte, error) {
+	// Wait until the length prefix is complete
+	if len(data) < 4 {
+		return 0, nil, partialFrame(data, atEOF)
+	}
+
+	size := binary.BigEndian.Uint32(data[:4])
+	if size > MaxPayloadSize {
+		return 0, nil, ErrMaxPayloadSize
+	}
+
+	// Wait until the whole payload is buffered
+	end := 4 + int(size)
+	if len(data) < end {
+		return 0, nil, partialFrame(data, atEOF)
+	}
+
+	return end, data[4:end], nil
+}
+
+// ScanTLV returns complete TLV frames ([1 byte type][4 bytes length]
+// [payload]), header included, so each token can be handed to decode
+// through a bytes.Reader
+func ScanTLV(data []byte, atEOF bool) (int, []byte, error) {
+	// The type byte is followed by the same 4-byte length prefix
+	if len(data) < 1 {
+		return 0, nil, partialFrame(data, atEOF)
+	}
+
+	advance, _, err := ScanLengthPrefixed(data[1:], atEOF)
+	if advance == 0 || err != nil {
+		return 0, nil, err
+	}
+
+	return 1 + advance, data[:1+advance], nil
+}
+
+// ScanNullTerminated returns NUL terminated strings without the NUL
+func ScanNullTerminated(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	return 0, nil, partialFrame(data, atEOF)
+}
+
+// ScanCRLFLines returns a SplitFunc for CRLF terminated lines (without
+// the CRLF). Lines longer than maxLen bytes fail with ErrLineTooLong, so a
+// peer can't make us buffer an endless line. A final line without CRLF
+// is returned as is, like bufio.ScanLines does.
+func ScanCRLFLines(maxLen int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, []byte("\r\n")); i >= 0 {
+			if i > maxLen {
+				return 0, nil, ErrLineTooLong
+			}
+			return i + 2, data[:i], nil
+		}
+
+		// No line ending yet. Anything beyond maxLen bytes (plus room
+		// for a CR whose LF hasn't arrived) can't become a valid line.
+		if len(data) > maxLen+1 {
+			return 0, nil, ErrLineTooLong
+		}
+
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+
+		return 0, nil, nil
+	}
+}
+
+// ScanSyslogFrames returns a SplitFunc for syslog messages over TCP,
+// framed either way RFC 6587 allows, chosen per message: octet counting
+// ("11 <13>1 - hi", the length in ASCII and a space), which syslog
+// senders that know RFC 5425 use, or a message per line, which the
+// older ones do. A message starts with "<" and never with a digit, so
+// the first byte tells. Messages longer than maxLen bytes fail with
+// ErrMaxPayloadSize or ErrLineTooLong.
+func ScanSyslogFrames(maxLen int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) == 0 || data[0] < '0' || data[0] > '9' {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				if i > maxLen+1 {
+					return 0, nil, ErrLineTooLong
+				}
+				return i + 1, bytes.TrimSuffix(data[:i], []byte("\r")), nil
+			}
+			if len(data) > maxLen+1 {
+				return 0, nil, ErrLineTooLong
+			}
+			if atEOF && len(data) > 0 {
+				return len(data), data, nil
+			}
+			return 0, nil, nil
+		}
+
+		// The length: digits up to a space, no more than maxLen has
+		i := bytes.IndexByte(data, ' ')
+		if i < 0 {
+			if len(data) > len(strconv.Itoa(maxLen)) {
+				return 0, nil, ErrMaxPayloadSize
+			}
+			return 0, nil, partialFrame(data, atEOF)
+		}
+		size, err := strconv.Atoi(string(data[:i]))
+		if err != nil || size < 0 {
+			return 0, nil, fmt.Errorf("invalid syslog frame length %q", data[:i])
+		}
+		if size > maxLen {
+			return 0, nil, ErrMaxPayloadSize
+		}
+		end := i + 1 + size
+		if len(data) < end {
+			return 0, nil, partialFrame(data, atEOF)
+		}
+
+		return end, data[i+1 : end], nil
+	}
+}
+
+// partialFrame decides what to do with an incomplete frame: ask for more
+// data, or report the truncated frame if the stream has ended
+func partialFrame(data []byte, atEOF bool) error {
+	if atEOF && len(data) > 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	return nil
+}
+
+// scanAll runs a scanner over r and collects the tokens as strings
+func scanAll(r io.Reader, split bufio.SplitFunc) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(split)
+
+	var tokens []string
+	for scanner.Scan() {
+		tokens = append(tokens, scanner.Text())
+	}
+
+	return tokens, scanner.Err()
+}
+
+func TestScanLengthPrefixed(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for _, msg := range []string{"Errors", "are", "", "values."} {
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(msg)))
+		buf.WriteString(msg)
+	}
+
+	// OneByteReader hands the scanner one byte per Read call,
+	// which fragments every frame as badly as possible
+	tokens, err := scanAll(iotest.OneByteReader(buf), ScanLengthPrefixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"Errors", "are", "", "values."}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("expected %q; actual: %q", expected, tokens)
+	}
+
+	// A frame cut short by the end of the stream is an error
+	_, err = scanAll(bytes.NewReader([]byte{0, 0, 0, 9, 'a'}), ScanLengthPrefixed)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF; actual: %v", err)
+	}
+}
+
+func TestScanTLV(t *testing.T) {
+	b := Binary("Clear is better than clever.")
+	s := String("Don't panic.")
+
+	buf := new(bytes.Buffer)
+	_, _ = b.WriteTo(buf)
+	_, _ = s.WriteTo(buf)
+
+	scanner := bufio.NewScanner(iotest.OneByteReader(buf))
+	scanner.Split(ScanTLV)
+
+	var decoded []Payload
+	for scanner.Scan() {
+		// Every token is a complete frame ready for decode
+		p, err := decode(bytes.NewReader(scanner.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, p)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []Payload{&b, &s}; !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("expected %v; actual: %v", expected, decoded)
+	}
+}
+
+func TestScanNullTerminated(t *testing.T) {
+	// Filename and mode of a TFTP read request
+	r := iotest.OneByteReader(strings.NewReader("test.txt\x00octet\x00"))
+
+	tokens, err := scanAll(r, ScanNullTerminated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"test.txt", "octet"}; !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("expected %q; actual: %q", expected, tokens)
+	}
+}
+
+func TestScanCRLFLines(t *testing.T) {
+	r := iotest.OneByteReader(strings.NewReader("HELO example\r\nQUIT\r\n"))
+
+	tokens, err := scanAll(r, ScanCRLFLines(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"HELO example", "QUIT"}; !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("expected %q; actual: %q", expected, tokens)
+	}
+
+	// A line that never ends is cut off at the limit
+	r = iotest.OneByteReader(strings.NewReader(strings.Repeat("a", 100)))
+	_, err = scanAll(r, ScanCRLFLines(16))
+	if err != ErrLineTooLong {
+		t.Errorf("expected ErrLineTooLong; actual: %v", err)
+	}
+}
+
+func TestScanSyslogFrames(t *testing.T) {
+	// Both framings in one stream, as a relay may send them
+	r := iotest.OneByteReader(strings.NewReader("11 <13>1 - hi\n<13>line one\r\n<13>line two\n3 abc"))
+
+	tokens, err := scanAll(r, ScanSyslogFrames(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"<13>1 - hi\n", "<13>line one", "<13>line two", "abc"}; !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("expected %q; actual: %q", expected, tokens)
+	}
+
+	for in, expected := range map[string]error{
+		"99 <13>too long":                 ErrMaxPayloadSize,
+		"123456789":                       ErrMaxPayloadSize,
+		"<13>" + strings.Repeat("a", 100): ErrLineTooLong,
+		"10 <13>cut":                      io.ErrUnexpectedEOF,
+	} {
+		if _, err := scanAll(strings.NewReader(in), ScanSyslogFrames(16)); err != expected {
+			t.Errorf("%q: expected %v; actual: %v", in, expected, err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Delimited reader with limits
+//
+// A bare bufio.Scanner on a net.Conn trusts the peer a lot: it will wait
+// forever for the rest of a token, and it will grow its buffer up to
+// 64 KB (or whatever Buffer allows) for a single token. DelimitedReader
+// puts both under control:
+//
+// - maxTokenSize caps the buffer, longer tokens fail with bufio.ErrTooLong
+// - tokenTimeout is a fresh read deadline for every token
+//
+// When the deadline hits while part of a token is already buffered the
+// peer stalled mid-frame, which is reported as a *StallError. A timeout
+// with nothing buffered is just an idle peer and the plain net.Error
+// timeout is returned.
+//
+// SetQuota adds a MessageQuota over all the tokens, delimiters counted
+// in their bytes.
+//
+// Like bufio.Scanner, a DelimitedReader stops at the first error.
+
+// ErrStalled is matched by errors returned when a peer stops mid-frame
+var ErrStalled = errors.New("peer stalled mid-frame")
+
+// StallError reports a peer that sent part of a token and then stopped
+type StallError struct {
+	Buffered int           // Bytes of the incomplete token received so far
+	Timeout  time.Duration // The per-token timeout that expired
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("peer stalled mid-frame: %d bytes buffered after %s", e.Buffered, e.Timeout)
+}
+
+// Is makes errors.Is(err, ErrStalled) true for a StallError
+func (e *StallError) Is(target error) bool { return target == ErrStalled }
+
+// DelimitedReader reads tokens from a connection with a SplitFunc
+type DelimitedReader struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	timeout time.Duration
+
+	read     int   // Bytes read from the connection so far
+	consumed int   // Bytes handed out as tokens (including delimiters)
+	readErr  error // Last error returned by the connection
+
+	usage     *quotaUsage
+	accounted int // Bytes of consumed counted in usage
+}
+
+// NewDelimitedReader returns a reader splitting conn with split.
+// maxTokenSize limits the size of a single token and tokenTimeout the
+// time allowed to receive it; zero disables the timeout.
+func NewDelimitedReader(conn net.Conn, split bufio.SplitFunc, maxTokenSize int, tokenTimeout time.Duration) *DelimitedReader {
+	d := &DelimitedReader{conn: conn, timeout: tokenTimeout}
+
+	d.scanner = bufio.NewScanner(readCounter{d})
+	d.scanner.Buffer(make([]byte, 0, min(maxTokenSize, 4096)), maxTokenSize)
+
+	// Wrap split to keep track of how much of the buffered data
+	// has been turned into tokens
+	d.scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		// The scanner treats any read error like EOF and offers the
+		// leftovers as a final token. After a timeout they are half a
+		// frame, not a token, so keep the read error instead.
+		if atEOF && d.readErr != nil && d.readErr != io.EOF {
+			return 0, nil, d.readErr
+		}
+
+		advance, token, err := split(data, atEOF)
+		d.consumed += advance
+		return advance, token, err
+	})
+
+	return d
+}
+
+// SetQuota bounds the tokens read from now on, see MessageQuota
+func (d *DelimitedReader) SetQuota(q MessageQuota) {
+	d.usage = q.start()
+}
+
+// readCounter counts the bytes the scanner reads from the connection
+type readCounter struct {
+	d *DelimitedReader
+}
+
+func (r readCounter) Read(p []byte) (int, error) {
+	n, err := r.d.conn.Read(p)
+	r.d.read += n
+	r.d.readErr = err
+
+	return n, err
+}
+
+// Next returns the next token. The returned slice is only valid until
+// the next call, like bufio.Scanner.Bytes.
+func (d *DelimitedReader) Next() ([]byte, error) {
+	return d.NextContext(context.Background())
+}
+
+// NextContext is Next returning ctx.Err() as soon as ctx is done. It
+// moves the read deadline to interrupt the read, so, like any other
+// error, that ends the reader.
+func (d *DelimitedReader) NextContext(ctx context.Context) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := d.usage.exceeded(); err != nil {
+		return nil, err
+	}
+
+	// Every token gets the full timeout
+	if d.timeout > 0 {
+		if err := d.conn.SetReadDeadline(time.Now().Add(d.timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Set after the timeout, which would otherwise undo it
+	stop := context.AfterFunc(ctx, func() { _ = d.conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	if d.scanner.Scan() {
+		n := d.consumed - d.accounted
+		d.accounted = d.consumed
+		if err := d.usage.add(n); err != nil {
+			return nil, err
+		}
+		return d.scanner.Bytes(), nil
+	}
+
+	err := d.scanner.Err()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err == nil {
+		// Clean EOF between tokens
+		return nil, io.EOF
+	}
+
+	// Data read but not turned into a token means the peer stopped
+	// in the middle of one
+	var nErr net.Error
+	if errors.As(err, &nErr) && nErr.Timeout() && d.read > d.consumed {
+		return nil, &StallError{Buffered: d.read - d.consumed, Timeout: d.timeout}
+	}
+
+	return nil, err
+}
+
+func TestDelimitedReaderStall(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	r := NewDelimitedReader(server, ScanCRLFLines(64), 64, 100*time.Millisecond)
+
+	// One complete line, then half a line and silence
+	go func() {
+		_, _ = client.Write([]byte("HELO example\r\nQU"))
+	}()
+
+	token, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(token) != "HELO example" {
+		t.Errorf("expected %q; actual: %q", "HELO example", token)
+	}
+
+	_, err = r.Next()
+	var stall *StallError
+	if !errors.As(err, &stall) {
+		t.Fatalf("expected stall error; actual: %v", err)
+	}
+	if stall.Buffered != 2 {
+		t.Errorf("expected 2 bytes buffered; actual: %d", stall.Buffered)
+	}
+}
+
+func TestDelimitedReaderIdle(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	r := NewDelimitedReader(server, ScanNullTerminated, 64, 100*time.Millisecond)
+
+	// Nothing at all is sent: a plain timeout, not a stall
+	_, err := r.Next()
+	var nErr net.Error
+	if !errors.As(err, &nErr) || !nErr.Timeout() || errors.Is(err, ErrStalled) {
+		t.Errorf("expected plain timeout; actual: %v", err)
+	}
+}
+
+func TestDelimitedReaderTooLong(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	r := NewDelimitedReader(server, ScanNullTerminated, 16, time.Second)
+
+	// A token bigger than the limit, the reader gives up on it
+	// instead of growing its buffer
+	go func() {
+		_, _ = client.Write(bytes.Repeat([]byte("a"), 64))
+	}()
+
+	_, err := r.Next()
+	if err != bufio.ErrTooLong {
+		t.Errorf("expected bufio.ErrTooLong; actual: %v", err)
+	}
+}
+
+func TestDelimitedReaderContext(t *testing.T) {
+	client, server := MemPipe()
+	defer client.Close()
+	defer server.Close()
+
+	// No per-token timeout: only ctx ends the wait
+	r := NewDelimitedReader(server, ScanCRLFLines(64), 64, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := r.NextContext(ctx)
+		errs <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled; actual: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancel didn't interrupt the read")
+	}
+}
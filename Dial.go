@@ -11,10 +11,7 @@ import (
 
 func TestDial(t *testing.T) {
 	// Create a listener on random port
-	listener, err := net.Listen("tcp", "127.0.0.1:")
-	if err != nil {
-		t.Fatal(err)
-	}
+	listener := testListener(t)
 
 	// Channel to signal when goroutines are done
 	// Ensuring clean exit and test completion
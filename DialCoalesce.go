@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Dial coalescing
+//
+// When a backend is slow or down, every goroutine that needs it dials it
+// at once: a hundred requests arriving together mean a hundred SYNs to
+// a host that is already struggling, and a hundred timeouts to wait for.
+// A DialGroup lets a single dial per key be in flight, and the callers
+// arriving meanwhile wait for it instead of starting their own:
+//
+// - a failure is shared: every caller waiting gets the same error, and
+//   the backend saw a single attempt
+// - a connection isn't, since a net.Conn is one stream: it goes to one
+//   of the callers, and the others learn the backend is up. They then
+//   check their pool, as UpstreamTransport does, or dial on their own,
+//   as CoalescingDialer does, now that dialing is known to work.
+//
+// The shared dial isn't canceled by the caller who started it going
+// away, only once every caller waiting for it did. A connection that
+// arrives after all of them left goes to Orphan, so a pool can park it
+// rather than waste the handshake, or is closed.
+
+// errDialTaken is returned by DialGroup.Dial when the dial waited for
+// succeeded, and someone else got the connection
+var errDialTaken = errors.New("dial: connection went to another caller")
+
+// DialGroup coalesces concurrent dials to the same key. The zero value
+// is ready to use.
+type DialGroup struct {
+	// Orphan, when set, receives connections dialed for callers that
+	// have all given up; otherwise they're closed
+	Orphan func(key string, conn net.Conn)
+
+	mu    sync.Mutex
+	calls map[string]*dialCall
+
+	coalesced atomic.Uint64
+}
+
+// dialCall is a dial in flight, and the callers waiting for it
+type dialCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+
+	// Set once done is closed
+	conn  net.Conn
+	err   error
+	taken bool
+}
+
+// Dial runs dial for key, unless one is already in flight, in which case
+// it waits for that one. It returns the connection, the dial error, or
+// errDialTaken when the connection went to another caller.
+func (g *DialGroup) Dial(ctx context.Context, key string, dial func(ctx context.Context) (net.Conn, error)) (net.Conn, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*dialCall)
+	}
+	call, ok := g.calls[key]
+	if ok {
+		g.coalesced.Add(1)
+	} else {
+		// The dial keeps the values of ctx, not its cancellation: it
+		// belongs to everyone waiting
+		dialCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &dialCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+		go g.run(dialCtx, key, call, dial)
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		g.leave(key, call)
+		return nil, ctx.Err()
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	call.waiters--
+	switch {
+	case call.err != nil:
+		return nil, call.err
+	case call.taken:
+		return nil, errDialTaken
+	}
+	call.taken = true
+
+	return call.conn, nil
+}
+
+// run dials and hands the result to the waiters
+func (g *DialGroup) run(ctx context.Context, key string, call *dialCall, dial func(ctx context.Context) (net.Conn, error)) {
+	conn, err := dial(ctx)
+	call.cancel()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	call.conn, call.err = conn, err
+	close(call.done)
+	orphan := err == nil && call.waiters == 0
+	call.taken = call.taken || orphan
+	g.mu.Unlock()
+
+	if orphan {
+		g.orphan(key, conn)
+	}
+}
+
+// leave takes a caller who gave up off call. The last one to leave
+// cancels the dial, or takes care of the connection it produced.
+func (g *DialGroup) leave(key string, call *dialCall) {
+	g.mu.Lock()
+	call.waiters--
+	last := call.waiters == 0
+
+	var orphan net.Conn
+	select {
+	case <-call.done:
+		if last && call.err == nil && !call.taken {
+			call.taken = true
+			orphan = call.conn
+		}
+	default:
+		if last {
+			call.cancel()
+		}
+	}
+	g.mu.Unlock()
+
+	if orphan != nil {
+		g.orphan(key, orphan)
+	}
+}
+
+func (g *DialGroup) orphan(key string, conn net.Conn) {
+	if g.Orphan != nil {
+		g.Orphan(key, conn)
+		return
+	}
+	_ = conn.Close()
+}
+
+// Coalesced returns how many calls waited for a dial already in flight
+// instead of starting their own
+func (g *DialGroup) Coalesced() uint64 {
+	return g.coalesced.Load()
+}
+
+// CoalescingDialer is a dialer whose concurrent dials to the same
+// address share a single attempt, see above
+type CoalescingDialer struct {
+	// Dial connects, a net.Dialer by default
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	group DialGroup
+}
+
+func (d *CoalescingDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.Dial != nil {
+		return d.Dial(ctx, network, addr)
+	}
+	return new(net.Dialer).DialContext(ctx, network, addr)
+}
+
+// DialContext connects to addr, joining a dial to it already in flight
+func (d *CoalescingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.group.Dial(ctx, network+"!"+addr, func(ctx context.Context) (net.Conn, error) {
+		return d.dial(ctx, network, addr)
+	})
+	if errors.Is(err, errDialTaken) {
+		// The address is known to work: no more waiting in line
+		return d.dial(ctx, network, addr)
+	}
+
+	return conn, err
+}
+
+// Coalesced returns how many dials joined one in flight
+func (d *CoalescingDialer) Coalesced() uint64 {
+	return d.group.Coalesced()
+}
+
+// gatedDialer is a test dialer that counts its calls and blocks each
+// until gate is closed
+type gatedDialer struct {
+	calls atomic.Int32
+	gate  chan struct{}
+	err   error
+}
+
+func (d *gatedDialer) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	d.calls.Add(1)
+	select {
+	case <-d.gate:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	c, _ := MemPipe()
+
+	return c, nil
+}
+
+// dialMany dials addr from n goroutines once they're all waiting
+func dialMany(d *CoalescingDialer, gd *gatedDialer, n int) ([]net.Conn, []error) {
+	conns, errs := make([]net.Conn, n), make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conns[i], errs[i] = d.DialContext(context.Background(), "tcp", "backend:80")
+		}()
+	}
+
+	// Everyone but the first joins the dial in flight
+	for d.Coalesced() < uint64(n-1) {
+		time.Sleep(time.Millisecond)
+	}
+	close(gd.gate)
+	wg.Wait()
+
+	return conns, errs
+}
+
+func TestCoalescingDialer(t *testing.T) {
+	// A failing backend is dialed once for everybody
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	gd := &gatedDialer{gate: make(chan struct{}), err: refused}
+	d := &CoalescingDialer{Dial: gd.dial}
+
+	_, errs := dialMany(d, gd, 10)
+	if n := gd.calls.Load(); n != 1 {
+		t.Errorf("expected a single dial; actual: %d", n)
+	}
+	for _, err := range errs {
+		if err != refused {
+			t.Errorf("expected the shared error; actual: %v", err)
+		}
+	}
+
+	// A working one: one caller gets the shared connection, the others
+	// dial their own after it
+	gd = &gatedDialer{gate: make(chan struct{})}
+	d = &CoalescingDialer{Dial: gd.dial}
+
+	conns, errs := dialMany(d, gd, 5)
+	seen := make(map[net.Conn]bool)
+	for i, err := range errs {
+		if err != nil || conns[i] == nil || seen[conns[i]] {
+			t.Fatalf("expected a connection of its own; actual: %v, %v", conns[i], err)
+		}
+		seen[conns[i]] = true
+	}
+	if n := gd.calls.Load(); n != 5 {
+		t.Errorf("expected 1 shared and 4 own dials; actual: %d", n)
+	}
+}
+
+func TestDialGroupOrphan(t *testing.T) {
+	orphans := make(chan net.Conn, 1)
+	g := &DialGroup{Orphan: func(_ string, conn net.Conn) { orphans <- conn }}
+
+	// The dial outlives its only caller
+	gate := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := g.Dial(ctx, "k", func(context.Context) (net.Conn, error) {
+			<-gate
+			c, _ := MemPipe()
+			return c, nil
+		})
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected context.Canceled; actual: %v", err)
+	}
+
+	close(gate)
+	select {
+	case conn := <-orphans:
+		_ = conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("connection nobody waited for was lost")
+	}
+
+	// Leaving before the dial is done cancels it
+	canceled := make(chan struct{})
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, _ = g.Dial(ctx, "k", func(ctx context.Context) (net.Conn, error) {
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("dial not canceled after its last caller left")
+	}
+}
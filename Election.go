@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Leader election (bully algorithm)
+//
+// Some work must be done by exactly one node of a group: running the
+// cron jobs, assigning shards, writing to the primary. Election picks
+// that node among a fixed set of peers, each with a unique ID, by the
+// bully algorithm (Garcia-Molina, 1982): the live node with the highest
+// ID leads.
+//
+// - A node that doesn't hear from a leader starts an election: it asks
+//   every peer with a higher ID (Elect). Any answer means a higher node
+//   is alive and takes over; it waits for its announcement. No answer
+//   within ElectionTimeout, and it's the highest alive: it leads.
+// - The leader announces itself to every peer (Coordinator), and keeps
+//   announcing every HeartbeatInterval. A follower that goes
+//   LeaderTimeout without an announcement starts an election.
+// - A node asked by a lower one answers and starts an election of its
+//   own, and so does one hearing from a lower leader: a higher node
+//   coming back bullies its way to the lead.
+//
+// The calls run over the RPC layer (RPC.go) on TCP, one multiplexed
+// connection per peer, redialed after a failure. OnElected and OnDemoted
+// report gaining and losing the lead, one call at a time and in order.
+//
+// Bully trusts the network: across a partition each side elects its own
+// leader, and a leader that's cut off keeps leading. Where two leaders
+// at once are a disaster, leases granted by a majority (Raft, etcd) are
+// the answer.
+
+// ElectionArgs identifies the calling node
+type ElectionArgs struct {
+	ID int
+}
+
+// ElectionReply is the answer to Elect (the callee is higher and takes
+// over) and to Coordinator (the callee follows the caller)
+type ElectionReply struct {
+	OK bool
+}
+
+// Election runs a node of a bully election
+type Election struct {
+	ID    int
+	Peers map[int]string // The other nodes, by ID: their RPC addresses
+
+	HeartbeatInterval time.Duration // 1s by default
+	LeaderTimeout     time.Duration // 3 heartbeats by default
+	ElectionTimeout   time.Duration // 500ms by default, for every call
+
+	// OnElected and OnDemoted, if set, are called when this node gains
+	// and loses the lead
+	OnElected func()
+	OnDemoted func()
+
+	ErrorLog *log.Logger
+
+	kick      chan struct{} // Start an election now
+	callbacks sync.Mutex    // Keeps the callbacks in order
+
+	mu        sync.Mutex
+	leader    int // -1 when unknown
+	lastHeard time.Time
+	peers     map[int]*rpcPeer
+}
+
+func (e *Election) heartbeatInterval() time.Duration {
+	if e.HeartbeatInterval > 0 {
+		return e.HeartbeatInterval
+	}
+	return time.Second
+}
+
+func (e *Election) leaderTimeout() time.Duration {
+	if e.LeaderTimeout > 0 {
+		return e.LeaderTimeout
+	}
+	return 3 * e.heartbeatInterval()
+}
+
+func (e *Election) electionTimeout() time.Duration {
+	if e.ElectionTimeout > 0 {
+		return e.ElectionTimeout
+	}
+	return 500 * time.Millisecond
+}
+
+func (e *Election) logf(format string, v ...any) {
+	if e.ErrorLog != nil {
+		e.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Serve answers the peers on l and takes part in the elections until
+// ctx is canceled, when a leader is demoted. It returns ctx.Err().
+func (e *Election) Serve(ctx context.Context, l net.Listener) error {
+	rpc := NewRPCServer()
+	rpc.ErrorLog = e.ErrorLog
+	if err := e.Register(rpc); err != nil {
+		return err
+	}
+	srv := NewTCPServer(l)
+	srv.ErrorLog = e.ErrorLog
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, rpc.ServeConn) }()
+
+	err := e.Run(ctx)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = srv.Shutdown(shutdownCtx)
+	<-served
+
+	return err
+}
+
+// Register adds the election's service to s, for a node serving more
+// than the election on its RPC server; Run then takes part
+func (e *Election) Register(s *RPCServer) error {
+	e.mu.Lock()
+	if e.peers != nil {
+		e.mu.Unlock()
+		return errors.New("election: already registered")
+	}
+	e.leader = -1
+	e.kick = make(chan struct{}, 1)
+	e.peers = make(map[int]*rpcPeer, len(e.Peers))
+	for id, addr := range e.Peers {
+		e.peers[id] = &rpcPeer{addr: addr}
+	}
+	e.mu.Unlock()
+
+	return s.Register("Election", &electionService{e: e})
+}
+
+// Run takes part in the elections until ctx is canceled, when a leader
+// is demoted. It returns ctx.Err().
+func (e *Election) Run(ctx context.Context) error {
+	e.mu.Lock()
+	registered := e.peers != nil
+	e.mu.Unlock()
+	if !registered {
+		return errors.New("election: not registered")
+	}
+
+	e.run(ctx)
+	for _, p := range e.peers {
+		p.close()
+	}
+	e.setLeader(-1)
+
+	return ctx.Err()
+}
+
+// run elects and heartbeats until ctx is canceled
+func (e *Election) run(ctx context.Context) {
+	ticker := time.NewTicker(e.heartbeatInterval())
+	defer ticker.Stop()
+
+	// A node starting up holds an election: it may be the highest
+	e.startElection()
+	for {
+		elect := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.kick:
+			elect = true
+		case <-ticker.C:
+		}
+
+		e.mu.Lock()
+		leading := e.leader == e.ID
+		if !leading && time.Since(e.lastHeard) > e.leaderTimeout() {
+			elect = true
+		}
+		e.mu.Unlock()
+
+		switch {
+		case elect:
+			e.elect(ctx)
+		case leading:
+			e.announce(ctx)
+		}
+	}
+}
+
+// startElection has run hold an election
+func (e *Election) startElection() {
+	select {
+	case e.kick <- struct{}{}:
+	default:
+	}
+}
+
+// elect asks the higher peers, and leads when none answers
+func (e *Election) elect(ctx context.Context) {
+	var higher []*rpcPeer
+	for id, p := range e.peers {
+		if id > e.ID {
+			higher = append(higher, p)
+		}
+	}
+
+	answered := make(chan struct{}, len(higher))
+	var wg sync.WaitGroup
+	for _, p := range higher {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply ElectionReply
+			if e.call(ctx, p, "Election.Elect", &reply) == nil && reply.OK {
+				answered <- struct{}{}
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	if len(answered) > 0 {
+		// A higher node takes over; give it until the leader timeout
+		// to announce itself before trying again
+		e.mu.Lock()
+		leading := e.leader == e.ID
+		e.lastHeard = time.Now()
+		e.mu.Unlock()
+		if leading {
+			e.setLeader(-1)
+		}
+		return
+	}
+
+	e.setLeader(e.ID)
+	e.announce(ctx)
+}
+
+// announce tells every peer this node leads, which is the heartbeat too
+func (e *Election) announce(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range e.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply ElectionReply
+			// A higher peer that refuses starts an election of its own
+			_ = e.call(ctx, p, "Election.Coordinator", &reply)
+		}()
+	}
+	wg.Wait()
+}
+
+// call calls method on p with the ID of this node
+func (e *Election) call(ctx context.Context, p *rpcPeer, method string, reply *ElectionReply) error {
+	ctx, cancel := context.WithTimeout(ctx, e.electionTimeout())
+	defer cancel()
+
+	return p.call(ctx, method, &ElectionArgs{ID: e.ID}, reply)
+}
+
+// setLeader records the leader, reporting gaining or losing the lead
+func (e *Election) setLeader(id int) {
+	e.callbacks.Lock()
+	defer e.callbacks.Unlock()
+
+	e.mu.Lock()
+	was := e.leader
+	e.leader = id
+	if id != e.ID {
+		e.lastHeard = time.Now()
+	}
+	e.mu.Unlock()
+
+	switch {
+	case was != e.ID && id == e.ID:
+		e.logf("election: %d leads", e.ID)
+		if e.OnElected != nil {
+			e.OnElected()
+		}
+	case was == e.ID && id != e.ID:
+		e.logf("election: %d no longer leads", e.ID)
+		if e.OnDemoted != nil {
+			e.OnDemoted()
+		}
+	}
+}
+
+// Leader returns the ID of the leader, false when there's none known
+func (e *Election) Leader() (int, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leader, e.leader >= 0 && e.peers != nil
+}
+
+// IsLeader reports whether this node leads
+func (e *Election) IsLeader() bool {
+	id, ok := e.Leader()
+	return ok && id == e.ID
+}
+
+// electionService is the RPC service of an Election
+type electionService struct {
+	e *Election
+}
+
+// Elect answers a lower node, and holds an election of our own
+func (s *electionService) Elect(_ context.Context, args *ElectionArgs) (*ElectionReply, error) {
+	if args.ID >= s.e.ID {
+		return &ElectionReply{}, nil
+	}
+	s.e.startElection()
+
+	return &ElectionReply{OK: true}, nil
+}
+
+// Coordinator follows a higher leader; a lower one gets bullied
+func (s *electionService) Coordinator(_ context.Context, args *ElectionArgs) (*ElectionReply, error) {
+	if args.ID < s.e.ID {
+		s.e.startElection()
+		return &ElectionReply{}, nil
+	}
+	s.e.setLeader(args.ID)
+
+	return &ElectionReply{OK: true}, nil
+}
+
+// rpcPeer is the RPC client of a peer, connected on demand
+type rpcPeer struct {
+	addr string
+
+	mu     sync.Mutex
+	client *RPCClient
+}
+
+func (p *rpcPeer) call(ctx context.Context, method string, args, reply any) error {
+	client, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = client.Call(ctx, method, args, reply)
+	var status *RPCError
+	if err != nil && !errors.As(err, &status) {
+		p.drop(client)
+	}
+
+	return err
+}
+
+// stream starts a streaming call of method
+func (p *rpcPeer) stream(ctx context.Context, method string) (*RPCStream, error) {
+	client, err := p.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := client.Stream(ctx, method)
+	if err != nil {
+		p.drop(client)
+	}
+
+	return st, err
+}
+
+// connect returns the client, dialing the peer when there's none
+func (p *rpcPeer) connect(ctx context.Context) (*RPCClient, error) {
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	client = NewRPCClient(conn)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client != nil {
+		// Another call connected first
+		_ = client.Close()
+		return p.client, nil
+	}
+	p.client = client
+
+	return client, nil
+}
+
+// drop closes a client whose connection is gone or stuck: the next
+// call redials
+func (p *rpcPeer) drop(client *RPCClient) {
+	p.mu.Lock()
+	if p.client == client {
+		p.client = nil
+	}
+	p.mu.Unlock()
+	_ = client.Close()
+}
+
+func (p *rpcPeer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.client != nil {
+		_ = p.client.Close()
+		p.client = nil
+	}
+}
+
+func TestElection(t *testing.T) {
+	type node struct {
+		e      *Election
+		addr   string
+		cancel context.CancelFunc
+		done   chan error
+
+		mu     sync.Mutex
+		events []string
+	}
+	nodes := make(map[int]*node)
+	listeners := make(map[int]net.Listener) // For each node's first start
+	for id := 1; id <= 3; id++ {
+		listeners[id] = testListener(t)
+		nodes[id] = &node{addr: listeners[id].Addr().String()}
+	}
+	start := func(id int) {
+		t.Helper()
+		l, ok := listeners[id]
+		if ok {
+			delete(listeners, id)
+		} else {
+			l = testRelisten(t, nodes[id].addr)
+		}
+		n := nodes[id]
+		n.e = &Election{
+			ID:                id,
+			Peers:             make(map[int]string),
+			HeartbeatInterval: 20 * time.Millisecond,
+			LeaderTimeout:     100 * time.Millisecond,
+			ElectionTimeout:   50 * time.Millisecond,
+			ErrorLog:          log.New(io.Discard, "", 0),
+		}
+		n.e.OnElected = func() {
+			n.mu.Lock()
+			n.events = append(n.events, "elected")
+			n.mu.Unlock()
+		}
+		n.e.OnDemoted = func() {
+			n.mu.Lock()
+			n.events = append(n.events, "demoted")
+			n.mu.Unlock()
+		}
+		for other, o := range nodes {
+			if other != id {
+				n.e.Peers[other] = o.addr
+			}
+		}
+		var ctx context.Context
+		ctx, n.cancel = context.WithCancel(context.Background())
+		n.done = make(chan error, 1)
+		go func() { n.done <- n.e.Serve(ctx, l) }()
+		t.Cleanup(n.cancel)
+	}
+	stop := func(id int) {
+		nodes[id].cancel()
+		<-nodes[id].done
+	}
+	leaders := func(ids ...int) string {
+		var s []string
+		for _, id := range ids {
+			leader, ok := nodes[id].e.Leader()
+			s = append(s, fmt.Sprintf("%d:%d/%t", id, leader, ok))
+		}
+		return fmt.Sprint(s)
+	}
+	eventually := func(leader int, ids ...int) {
+		t.Helper()
+		var expected []string
+		for _, id := range ids {
+			expected = append(expected, fmt.Sprintf("%d:%d/true", id, leader))
+		}
+		for deadline := time.Now().Add(5 * time.Second); leaders(ids...) != fmt.Sprint(expected); {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected leaders %v; actual: %s", expected, leaders(ids...))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	events := func(id int) string {
+		n := nodes[id]
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return fmt.Sprint(n.events)
+	}
+
+	// The highest leads. Started first, it's also the first to hold
+	// an election; a lower one started alone would lead for a while.
+	for id := 3; id >= 1; id-- {
+		start(id)
+	}
+	eventually(3, 1, 2, 3)
+	if !nodes[3].e.IsLeader() || nodes[2].e.IsLeader() {
+		t.Error("expected only 3 to lead")
+	}
+
+	// It fails: the next highest takes over
+	stop(3)
+	if actual := events(3); actual != "[elected demoted]" {
+		t.Errorf("expected 3 to be elected then demoted; actual: %s", actual)
+	}
+	eventually(2, 1, 2)
+
+	// It comes back and bullies its way to the lead
+	start(3)
+	eventually(3, 1, 2, 3)
+	if actual := events(2); actual != "[elected demoted]" {
+		t.Errorf("expected 2 to be elected then demoted; actual: %s", actual)
+	}
+	if actual := events(1); actual != "[]" {
+		t.Errorf("expected 1 never to lead; actual: %s", actual)
+	}
+}
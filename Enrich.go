@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Peer enrichment
+//
+// "10.1.2.3 failed" says little to someone reading the logs; "10.1.2.3
+// (DE AS3320) failed" says where the peer is, and a graph of
+// connections by country shows when a scan starts. Where an address is
+// comes from a GeoIP or ASN database, of which there are many, in
+// formats of their own and under licenses of their own, so the core
+// only knows an interface:
+//
+//	type Enricher interface {
+//		Enrich(ip netip.Addr) PeerInfo
+//	}
+//
+// Whatever reads the database of choice implements it (EnricherFunc
+// turns a function into one), and the components that take an Enricher
+// label their output with what it returns:
+//
+// - Monitor: "country", "asn" and "as_org" attributes on the structured
+//   records of a MonitoredConn
+// - ConnectProxy and ReverseProxy: the client in their log lines
+// - TCPServer and ConnectProxy: connections counted by country and ASN
+//   (tcp_server_peers_total, connect_proxy_peers_total), which stays a
+//   bounded number of series, unlike counting by address
+//
+// PrefixEnricher is the one implementation here: a CSV file of
+// networks, in a CIDRTrie (see NetFilter.go), which is what most
+// databases can be exported to or are published as:
+//
+//	# network,country,asn,organization
+//	192.0.2.0/24,DE,AS64500,Example Networks
+//	2001:db8::/32,FR,64501,
+//
+// Lookups happen for every connection, so an Enricher should answer
+// from memory; one that queries a service should cache.
+
+// PeerInfo is what an Enricher knows about an address. The zero value
+// means nothing.
+type PeerInfo struct {
+	Country string // ISO 3166-1 alpha-2 code
+	ASN     uint32 // Autonomous system number
+	Org     string // Owner of the AS
+}
+
+// Enricher labels peer addresses
+type Enricher interface {
+	Enrich(ip netip.Addr) PeerInfo
+}
+
+// EnricherFunc is a function used as an Enricher
+type EnricherFunc func(ip netip.Addr) PeerInfo
+
+// Enrich calls f
+func (f EnricherFunc) Enrich(ip netip.Addr) PeerInfo {
+	return f(ip)
+}
+
+// String returns "DE AS3320", or "" when nothing is known
+func (i PeerInfo) String() string {
+	var parts []string
+	if i.Country != "" {
+		parts = append(parts, i.Country)
+	}
+	if i.ASN != 0 {
+		parts = append(parts, "AS"+strconv.FormatUint(uint64(i.ASN), 10))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Attrs returns what is known as slog attributes
+func (i PeerInfo) Attrs() []slog.Attr {
+	var attrs []slog.Attr
+	if i.Country != "" {
+		attrs = append(attrs, slog.String("country", i.Country))
+	}
+	if i.ASN != 0 {
+		attrs = append(attrs, slog.Uint64("asn", uint64(i.ASN)))
+	}
+	if i.Org != "" {
+		attrs = append(attrs, slog.String("as_org", i.Org))
+	}
+
+	return attrs
+}
+
+// labels returns the country and ASN metric label values, "unknown"
+// when not known
+func (i PeerInfo) labels() (country, asn string) {
+	country, asn = i.Country, "unknown"
+	if country == "" {
+		country = "unknown"
+	}
+	if i.ASN != 0 {
+		asn = "AS" + strconv.FormatUint(uint64(i.ASN), 10)
+	}
+
+	return country, asn
+}
+
+// enrichAddr looks up the IP address of a TCP or UDP peer, nothing
+// being known without an Enricher or an IP address
+func enrichAddr(e Enricher, addr net.Addr) PeerInfo {
+	if e == nil || addr == nil {
+		return PeerInfo{}
+	}
+	ip, ok := peerIP(addr)
+	if !ok {
+		return PeerInfo{}
+	}
+
+	return e.Enrich(ip.Unmap())
+}
+
+// enrichRemote looks up a "host:port" as found in http.Request.RemoteAddr
+func enrichRemote(e Enricher, remote string) PeerInfo {
+	if e == nil {
+		return PeerInfo{}
+	}
+	ap, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return PeerInfo{}
+	}
+
+	return e.Enrich(ap.Addr().Unmap())
+}
+
+// peerLabel returns remote followed by what e knows about it, for log
+// lines: "192.0.2.1:5000 (DE AS64500)"
+func peerLabel(e Enricher, remote string) string {
+	if info := enrichRemote(e, remote).String(); info != "" {
+		return remote + " (" + info + ")"
+	}
+
+	return remote
+}
+
+// PrefixEnricher answers from a table of networks, see above
+type PrefixEnricher struct {
+	trie CIDRTrie[PeerInfo]
+}
+
+// Enrich returns the information of the most specific network
+// containing ip
+func (p *PrefixEnricher) Enrich(ip netip.Addr) PeerInfo {
+	info, _, _ := p.trie.Lookup(ip)
+	return info
+}
+
+// Len returns the number of networks
+func (p *PrefixEnricher) Len() int {
+	return p.trie.Len()
+}
+
+// ReadPrefixEnricher reads the CSV format above: a network (or an
+// address), then optionally a country, an ASN ("AS64500" or "64500")
+// and an organization
+func ReadPrefixEnricher(r io.Reader) (*PrefixEnricher, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	p := new(PrefixEnricher)
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+
+		prefix, err := ParsePrefix(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid network %q", line, record[0])
+		}
+		var info PeerInfo
+		if len(record) > 1 {
+			info.Country = strings.ToUpper(record[1])
+		}
+		if len(record) > 2 && record[2] != "" {
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(record[2]), "AS"), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid ASN %q", line, record[2])
+			}
+			info.ASN = uint32(asn)
+		}
+		if len(record) > 3 {
+			info.Org = record[3]
+		}
+		p.trie.Insert(prefix, info)
+	}
+}
+
+// LoadPrefixEnricher reads the CSV file at path
+func LoadPrefixEnricher(path string) (*PrefixEnricher, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := ReadPrefixEnricher(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return p, nil
+}
+
+// testEnricher knows loopback as the documentation AS
+var testEnricher = EnricherFunc(func(ip netip.Addr) PeerInfo {
+	if ip.IsLoopback() {
+		return PeerInfo{Country: "ZZ", ASN: 64500, Org: "Loopback"}
+	}
+	return PeerInfo{}
+})
+
+func TestPrefixEnricher(t *testing.T) {
+	p, err := ReadPrefixEnricher(strings.NewReader(`# network,country,asn,organization
+192.0.2.0/24,de,AS64500,"Example Networks, Inc."
+192.0.2.128/25,FR,64501
+2001:db8::/32
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Len() != 3 {
+		t.Errorf("expected 3 networks; actual: %d", p.Len())
+	}
+
+	for addr, expected := range map[string]PeerInfo{
+		"192.0.2.1":          {"DE", 64500, "Example Networks, Inc."},
+		"::ffff:192.0.2.200": {"FR", 64501, ""},
+		"2001:db8::1":        {},
+		"198.51.100.1":       {},
+	} {
+		if info := p.Enrich(netip.MustParseAddr(addr)); info != expected {
+			t.Errorf("%s: expected %+v; actual: %+v", addr, expected, info)
+		}
+	}
+
+	if label := peerLabel(p, "192.0.2.1:5000"); label != "192.0.2.1:5000 (DE AS64500)" {
+		t.Errorf("unexpected label %q", label)
+	}
+	if label := peerLabel(p, "198.51.100.1:5000"); label != "198.51.100.1:5000" {
+		t.Errorf("unexpected label %q", label)
+	}
+	if country, asn := (PeerInfo{}).labels(); country != "unknown" || asn != "unknown" {
+		t.Errorf("unexpected labels %q %q", country, asn)
+	}
+
+	for _, bad := range []string{"192.0.2.0/33,DE", "192.0.2.0/24,DE,ASX"} {
+		if _, err := ReadPrefixEnricher(strings.NewReader(bad)); err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Errorf("%q: expected an error on line 1; actual: %v", bad, err)
+		}
+	}
+}
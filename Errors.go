@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Error taxonomy
+//
+// Every layer in the repo ends up asking the same few questions about an
+// error: did it time out, is the connection gone, would another attempt
+// work, was a message over its size limit? Over time each of them grew
+// its own answer, an isTimeout here, a list of syscall.Errno there, an
+// err != io.EOF elsewhere, and they didn't quite agree. This file is the
+// one place those answers live:
+//
+// - IsTimeout: a deadline fired, of a conn or a context
+// - IsClosed: the connection is over, closed by us (net.ErrClosed) or
+//   by the peer (EOF, reset, broken pipe)
+// - IsTransient: another attempt, usually on a fresh connection, may
+//   well succeed: timeouts, resets, refused connections. It's the
+//   default RetryPolicy.Retryable.
+// - IsRefused: nothing listened, so nothing was sent; safe to retry
+//   even requests that aren't idempotent
+// - IsExhausted: local ports or file descriptors ran out, see
+//   PortExhaustion.go; transient as well
+// - IsTooLarge: a message was over a size limit. ErrMaxPayloadSize,
+//   ErrLineTooLong and the other limit errors all match ErrTooLarge.
+//
+// Classify folds all of it into one ErrorClass, short enough to use as
+// a metric label. Timeouts win over everything else; an error that's
+// none of the above is fatal.
+
+// ErrTooLarge is matched by every error about a size limit
+var ErrTooLarge = errors.New("too large")
+
+// limitError is a sentinel error about a size limit. Being a distinct
+// value, it still works with ==, and errors.Is matches it to ErrTooLarge.
+type limitError struct {
+	msg string
+}
+
+// errLimit returns a new size limit sentinel
+func errLimit(msg string) error {
+	return &limitError{msg: msg}
+}
+
+func (e *limitError) Error() string { return e.msg }
+
+// Is makes errors.Is(err, ErrTooLarge) true for a limitError
+func (e *limitError) Is(target error) bool { return target == ErrTooLarge }
+
+// IsTimeout reports whether err is, or wraps, a timeout: a net.Error
+// saying so, os.ErrDeadlineExceeded or context.DeadlineExceeded
+func IsTimeout(err error) bool {
+	var nErr net.Error
+	return errors.As(err, &nErr) && nErr.Timeout()
+}
+
+// IsClosed reports whether err means the connection is gone
+func IsClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		isPeerGone(err)
+}
+
+// IsTransient reports whether another attempt may succeed where this
+// one failed
+func IsTransient(err error) bool {
+	return IsTimeout(err) || isPeerGone(err) || IsRefused(err) || IsExhausted(err)
+}
+
+// IsRefused reports whether the peer refused the connection, or a
+// datagram sent earlier came back as ICMP port unreachable
+func IsRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// IsTooLarge reports whether err is about a size limit
+func IsTooLarge(err error) bool {
+	return errors.Is(err, ErrTooLarge)
+}
+
+// isPeerGone reports whether the peer reset or abandoned the connection
+func isPeerGone(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// isUnreachableEcho reports whether a read from a UDP socket failed
+// only because an earlier write drew an ICMP error, which some
+// platforms (Windows) report on the next read as a reset or refusal
+func isUnreachableEcho(err error) bool {
+	return IsRefused(err) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// ErrorClass is the coarse category of an error
+type ErrorClass int
+
+const (
+	ClassNone      ErrorClass = iota // No error
+	ClassTimeout                     // IsTimeout
+	ClassTooLarge                    // IsTooLarge
+	ClassTransient                   // IsTransient, other than timeouts
+	ClassClosed                      // IsClosed, other than transient
+	ClassFatal                       // Anything else
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassNone:
+		return "none"
+	case ClassTimeout:
+		return "timeout"
+	case ClassTooLarge:
+		return "too_large"
+	case ClassTransient:
+		return "transient"
+	case ClassClosed:
+		return "closed"
+	case ClassFatal:
+		return "fatal"
+	}
+
+	return fmt.Sprintf("ErrorClass(%d)", int(c))
+}
+
+// Classify returns the class of err
+func Classify(err error) ErrorClass {
+	switch {
+	case err == nil:
+		return ClassNone
+	case IsTimeout(err):
+		return ClassTimeout
+	case IsTooLarge(err):
+		return ClassTooLarge
+	case IsTransient(err):
+		return ClassTransient
+	case IsClosed(err):
+		return ClassClosed
+	}
+
+	return ClassFatal
+}
+
+func TestErrorTaxonomy(t *testing.T) {
+	// Real errors, the way the network hands them out
+	client, server := MemPipe()
+	_ = client.SetReadDeadline(time.Now())
+	_, deadlineErr := client.Read(make([]byte, 1))
+	_ = server.Close()
+	_, pipeErr := client.Write([]byte("x"))
+	_ = client.Close()
+	_, closedErr := client.Read(make([]byte, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+
+	tests := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{nil, ClassNone},
+		{deadlineErr, ClassTimeout},
+		{ctx.Err(), ClassTimeout},
+		{&IdleError{Op: "read"}, ClassTimeout},
+		{ErrMaxPayloadSize, ClassTooLarge},
+		{fmt.Errorf("frame: %w", ErrLineTooLong), ClassTooLarge},
+		{pipeErr, ClassTransient},
+		{ErrChaosReset, ClassTransient},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, ClassTransient},
+		{closedErr, ClassClosed},
+		{io.ErrUnexpectedEOF, ClassClosed},
+		{ErrPSKAuth, ClassFatal},
+		{context.Canceled, ClassFatal},
+	}
+	for _, tt := range tests {
+		if class := Classify(tt.err); class != tt.class {
+			t.Errorf("%v: expected %s; actual %s", tt.err, tt.class, class)
+		}
+	}
+
+	// Sentinels stay comparable, and keep their own message
+	if err := ErrMaxPayloadSize; err != ErrMaxPayloadSize || errors.Is(err, ErrLineTooLong) {
+		t.Error("limit sentinels must be distinct values")
+	}
+	if !IsRefused(fmt.Errorf("dial: %w", syscall.ECONNREFUSED)) || IsRefused(pipeErr) {
+		t.Error("IsRefused must match connection refused only")
+	}
+	if !IsClosed(pipeErr) || IsTransient(io.EOF) {
+		t.Error("a broken pipe is closed and transient, EOF only closed")
+	}
+	if _, err := os.Open("/nonexistent"); Classify(err) != ClassFatal {
+		t.Errorf("expected a missing file to be fatal; actual %s", Classify(err))
+	}
+}
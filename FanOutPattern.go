@@ -31,11 +31,7 @@ func TestDialContextCancelFanOut(t *testing.T) {
 	)
 
 	// Start a tcp listener on a random available port on localhost
-	listener, err := net.Listen("tcp", "127.0.0.1:")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer listener.Close()
+	listener := testListener(t)
 
 	// Simulation of a server side
 	// Accept one connection then end it immediately
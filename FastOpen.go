@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TCP Fast Open
+//
+// A TCP connection costs a round trip before the first byte of the
+// request leaves: SYN, SYN-ACK, and only then the data. Fast Open (RFC
+// 7413) puts the data in the SYN itself. The first connection to a
+// server gets a cookie along with its SYN-ACK; the next ones show the
+// cookie in a SYN carrying the request, which the server hands to the
+// application before the handshake is even complete. Over a 100ms
+// path, a short request-response saves a third of its time.
+//
+// Both ends opt in, on linux:
+//
+// - the listening socket with the TCP_FASTOPEN option, whose value is
+//   how many Fast Open handshakes may be pending at once, which bounds
+//   what a SYN flood with valid cookies can make us do
+// - the dialing socket with TCP_FASTOPEN_CONNECT. The classic client
+//   API is sendto() with MSG_FASTOPEN instead of connect(), which Go's
+//   dialer doesn't do; with this option connect() returns right away
+//   and the kernel turns the first write into that sendto, SYN and
+//   data together.
+//
+// and the net.ipv4.tcp_fastopen sysctl allows each side: 1 for clients
+// (the default), 2 for servers, 3 for both.
+//
+// FastOpenListenConfig and FastOpenDialer set the options in the
+// Control hook, before the socket binds or connects. Everything else
+// falls back on its own: without a cookie, or without support in the
+// kernel, the sysctl, the other end or a middlebox, the connection
+// makes the usual handshake. Where the options don't exist at all,
+// they do nothing.
+//
+// Two things change for the client. Dial returns before anything was
+// sent, so a refused connection shows up on the first Write or Read
+// instead. And the handshake only starts with that first write: a
+// protocol where the server speaks first (SMTP, SSH banners) waits
+// forever for it. Fast Open is for protocols where the client speaks
+// first, HTTP, TLS, the TLV RPC. And data in a SYN may be replayed by
+// the network, so a request that must not be repeated shouldn't go
+// there; TLS 0-RTT has the same caveat.
+
+// defaultFastOpenQueue is the pending Fast Open handshakes a listener
+// allows, when not told otherwise
+const defaultFastOpenQueue = 256
+
+// FastOpenListenConfig returns a ListenConfig whose TCP listeners accept
+// data in SYNs, with at most queue Fast Open handshakes pending (or
+// defaultFastOpenQueue when queue is 0)
+func FastOpenListenConfig(queue int) *net.ListenConfig {
+	if queue <= 0 {
+		queue = defaultFastOpenQueue
+	}
+
+	return &net.ListenConfig{
+		Control: func(network, _ string, c syscall.RawConn) error {
+			if network != "tcp" && network != "tcp4" && network != "tcp6" {
+				return nil
+			}
+			// An error means no Fast Open, not no listener
+			_ = setFastOpen(c, queue)
+			return nil
+		},
+	}
+}
+
+// FastOpenDialer returns a copy of d whose TCP connections send their
+// first write with the SYN, once they have a cookie. d's own Control
+// or ControlContext hook runs first.
+func FastOpenDialer(d *net.Dialer) *net.Dialer {
+	fd := *d
+	fastOpen := func(network string, c syscall.RawConn) {
+		if network == "tcp" || network == "tcp4" || network == "tcp6" {
+			// An error means the usual handshake
+			_ = setFastOpenConnect(c)
+		}
+	}
+
+	if control := d.ControlContext; control != nil {
+		fd.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if err := control(ctx, network, address, c); err != nil {
+				return err
+			}
+			fastOpen(network, c)
+			return nil
+		}
+		return &fd
+	}
+
+	control := d.Control
+	fd.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		fastOpen(network, c)
+		return nil
+	}
+
+	return &fd
+}
+
+func TestFastOpen(t *testing.T) {
+	l, err := FastOpenListenConfig(0).Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// The first connection gets the cookie, the next ones use it
+	var called bool
+	d := FastOpenDialer(&net.Dialer{Timeout: time.Second, Control: func(string, string, syscall.RawConn) error {
+		called = true
+		return nil
+	}})
+	var last *TCPOptions
+	for i := 0; i < 3; i++ {
+		conn, err := d.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := []byte("fast open")
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if reply, err := ReadExactly(conn, len(msg)); err != nil || !bytes.Equal(reply, msg) {
+			t.Fatalf("unexpected reply %q, %v", reply, err)
+		}
+		last = peerTCPOptions(conn)
+		_ = conn.Close()
+	}
+	if !called {
+		t.Error("expected the dialer's own Control to run")
+	}
+
+	// Whether data actually went in the SYN is up to the kernel
+	if !fastOpenEnabled() || last == nil {
+		t.Skip("TCP Fast Open isn't enabled for both ends here")
+	}
+	if !last.FastOpen {
+		t.Errorf("expected data in the SYN; actual: %s", last)
+	}
+
+	// A refused connection fails on the first write or read rather
+	// than at dial
+	addr := l.Addr().String()
+	_ = l.Close()
+	conn, err := d.Dial("tcp", addr)
+	if err == nil {
+		_, err = conn.Write([]byte("hello"))
+		if err == nil {
+			_, err = conn.Read(make([]byte, 1))
+		}
+		_ = conn.Close()
+	}
+	if err == nil {
+		t.Error("expected a closed listener to fail the connection")
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// TCP_FASTOPEN and TCP_FASTOPEN_CONNECT, which package syscall is
+// missing
+const (
+	tcpFastOpen        = 0x17
+	tcpFastOpenConnect = 0x1e
+)
+
+// setFastOpen allows queue pending Fast Open handshakes on a listening
+// socket, see FastOpen.go
+func setFastOpen(c syscall.RawConn, queue int) error {
+	return setsockoptTCP(c, tcpFastOpen, queue)
+}
+
+// setFastOpenConnect defers connect to the first write, which carries
+// the SYN, on linux 4.11 and later
+func setFastOpenConnect(c syscall.RawConn) error {
+	return setsockoptTCP(c, tcpFastOpenConnect, 1)
+}
+
+func setsockoptTCP(c syscall.RawConn, opt, value int) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// fastOpenEnabled reports whether the net.ipv4.tcp_fastopen sysctl
+// allows both clients and servers
+func fastOpenEnabled() bool {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return false
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(b)))
+
+	return err == nil && v&3 == 3
+}
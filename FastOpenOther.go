@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// setFastOpen does nothing: TCP Fast Open is only set up on linux, see
+// FastOpen.go
+func setFastOpen(syscall.RawConn, int) error {
+	return nil
+}
+
+// setFastOpenConnect does nothing, like setFastOpen
+func setFastOpenConnect(syscall.RawConn) error {
+	return nil
+}
+
+// fastOpenEnabled is false: Fast Open connections aren't set up here
+func fastOpenEnabled() bool {
+	return false
+}
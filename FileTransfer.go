@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// File transfer over TCP with resume
+//
+// TFTP moves files over UDP in 512-byte blocks, one acknowledgment per
+// block: fine for boot images on a LAN, slow for anything big or far.
+// Over TCP the kernel handles ordering and retransmission, so the server
+// can stream the file in large chunks and all that's left to us is
+// what TCP can't do: survive the connection dropping, and prove the
+// file arrived intact.
+//
+// The client asks for a file starting at an offset:
+//
+//	offset (8) | name length (2) | name
+//
+// The server answers with a status, the total size and the SHA-256 of
+// the whole file, then streams it from the offset in length-prefixed
+// chunks, ending with an empty one:
+//
+//	status (1) | size (8) | sha256 (32)
+//	length (4) | data ... | length (4) | data ... | 0 (4)
+//
+// The chunks go out with SendFile, so the file's bytes go from the page
+// cache to the socket without passing through the server.
+//
+// Fetch downloads into name.part. When the connection breaks it
+// reconnects and asks for the rest, starting at the size of the partial
+// file; that works across program restarts too. Once complete, the
+// partial file is hashed and only renamed into place if it matches.
+
+const (
+	fileChunkSize   = 32 << 10
+	fileMaxName     = 1 << 10
+	fileHeaderSize  = 1 + 8 + sha256.Size
+	fileReadTimeout = 30 * time.Second // For the request, and each chunk
+	filePartSuffix  = ".part"
+)
+
+// File transfer statuses
+const (
+	fileOK = iota
+	fileNotFound
+	fileBadOffset
+)
+
+var (
+	// ErrFileNotFound means the server has no such file
+	ErrFileNotFound = errors.New("filetransfer: file not found")
+	// ErrChecksum means the downloaded file doesn't match the server's hash
+	ErrChecksum = errors.New("filetransfer: checksum mismatch")
+	// errFileChanged means the file changed on the server mid-download
+	errFileChanged = errors.New("filetransfer: file changed on server")
+)
+
+// ReconnectingConn runs an operation on a connection, dialing a new one
+// under Retry whenever the operation fails with a retryable error. The
+// operation must pick up where the last one stopped; the connection
+// can't do that for it, since the bytes in flight when it broke are lost.
+type ReconnectingConn struct {
+	// Dial opens a connection
+	Dial func(ctx context.Context) (net.Conn, error)
+
+	// Retry paces the reconnects. Its Retryable sees both dial errors
+	// and operation errors.
+	Retry RetryPolicy
+
+	// OnReconnect, when set, is called before each attempt after the first
+	OnReconnect func(attempt int, err error)
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Do calls op with a connection until it succeeds or the retry policy
+// gives up. A connection op fails on is closed and not used again.
+func (rc *ReconnectingConn) Do(ctx context.Context, op func(ctx context.Context, conn net.Conn) error) error {
+	var attempt int
+	var last error
+
+	return rc.Retry.Do(ctx, func(ctx context.Context) error {
+		if attempt > 0 && rc.OnReconnect != nil {
+			rc.OnReconnect(attempt, last)
+		}
+		attempt++
+
+		conn, err := rc.get(ctx)
+		if err != nil {
+			last = err
+			return err
+		}
+		if err := op(ctx, conn); err != nil {
+			rc.drop(conn)
+			last = err
+			return err
+		}
+
+		return nil
+	})
+}
+
+// Close closes the current connection, if any
+func (rc *ReconnectingConn) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.conn == nil {
+		return nil
+	}
+	err := rc.conn.Close()
+	rc.conn = nil
+
+	return err
+}
+
+func (rc *ReconnectingConn) get(ctx context.Context) (net.Conn, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.conn != nil {
+		return rc.conn, nil
+	}
+	conn, err := rc.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rc.conn = conn
+
+	return conn, nil
+}
+
+func (rc *ReconnectingConn) drop(conn net.Conn) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	_ = conn.Close()
+	if rc.conn == conn {
+		rc.conn = nil
+	}
+}
+
+// FileServer serves the files under a directory
+type FileServer struct {
+	// ErrorLog receives transfer errors
+	ErrorLog *log.Logger
+
+	root *os.Root
+}
+
+// NewFileServer serves dir. Requests can't reach outside of it, not
+// even through symlinks.
+func NewFileServer(dir string) (*FileServer, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileServer{root: root}, nil
+}
+
+// Close releases the directory
+func (s *FileServer) Close() error {
+	return s.root.Close()
+}
+
+func (s *FileServer) logf(format string, v ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// ServeConn serves one request; it's a ConnHandler
+func (s *FileServer) ServeConn(_ context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(fileReadTimeout))
+	offset, name, err := readFileRequest(conn)
+	if err != nil {
+		s.logf("filetransfer: %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if err := s.send(conn, name, offset); err != nil {
+		s.logf("filetransfer: %s: %s: %v", conn.RemoteAddr(), name, err)
+	}
+}
+
+func (s *FileServer) send(conn net.Conn, name string, offset int64) error {
+	header := make([]byte, fileHeaderSize)
+
+	f, err := s.root.Open(name)
+	if err != nil {
+		header[0] = fileNotFound
+		_, _ = conn.Write(header)
+		return err
+	}
+	defer f.Close()
+
+	// Hashing reads the whole file on every request, resumed or not. A
+	// server with big, rarely changing files would cache it by size and
+	// modification time.
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset > size {
+		header[0] = fileBadOffset
+		_, _ = conn.Write(header)
+		return fmt.Errorf("offset %d beyond size %d", offset, size)
+	}
+
+	header[0] = fileOK
+	binary.BigEndian.PutUint64(header[1:], uint64(size))
+	copy(header[9:], h.Sum(nil))
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+
+	var length [4]byte
+	for offset < size {
+		n := min(size-offset, fileChunkSize)
+		// A client that stops reading doesn't hold the file open forever
+		_ = conn.SetWriteDeadline(time.Now().Add(fileReadTimeout))
+		binary.BigEndian.PutUint32(length[:], uint32(n))
+		if _, err := conn.Write(length[:]); err != nil {
+			return err
+		}
+		// A file shrinking under us cuts the chunk short: the client
+		// reconnects and sees it changed
+		if _, err := SendFile(conn, f, offset, n); err != nil {
+			return err
+		}
+		offset += n
+	}
+
+	// The empty chunk tells the client nothing was cut off
+	_, err = conn.Write(make([]byte, 4))
+
+	return err
+}
+
+func readFileRequest(r io.Reader) (int64, string, error) {
+	var header [10]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, "", err
+	}
+	offset := int64(binary.BigEndian.Uint64(header[:]))
+	size := binary.BigEndian.Uint16(header[8:])
+	if size == 0 || size > fileMaxName {
+		return 0, "", errors.New("invalid name length")
+	}
+
+	name := make([]byte, size)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return 0, "", err
+	}
+
+	return offset, string(name), nil
+}
+
+// FileClient downloads files from a FileServer
+type FileClient struct {
+	// Conn dials the server and paces reconnects
+	Conn *ReconnectingConn
+
+	// Progress, when set, is called as data arrives with the bytes
+	// downloaded so far (counting a resumed partial file) and the total
+	Progress func(done, total int64)
+}
+
+// NewFileClient returns a client for the server at addr that retries
+// with policy
+func NewFileClient(addr string, policy RetryPolicy) *FileClient {
+	if policy.Retryable == nil {
+		policy.Retryable = isFileRetryable
+	}
+
+	return &FileClient{
+		Conn: &ReconnectingConn{
+			Dial: func(ctx context.Context) (net.Conn, error) {
+				return DefaultConnBudget.DialContext(ctx, "tcp", addr)
+			},
+			Retry: policy,
+		},
+	}
+}
+
+// isFileRetryable adds connections cut mid-transfer to IsTransient
+func isFileRetryable(err error) bool {
+	return IsTransient(err) ||
+		IsClosed(err) ||
+		errors.Is(err, errFileChanged)
+}
+
+// Fetch downloads name into dst, resuming from dst.part if a previous
+// download left one
+func (c *FileClient) Fetch(ctx context.Context, name, dst string) error {
+	if len(name) == 0 || len(name) > fileMaxName {
+		return fmt.Errorf("filetransfer: invalid name %q", name)
+	}
+
+	part, err := os.OpenFile(dst+filePartSuffix, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+
+	// The hash the server announced first; if it changes between
+	// attempts, what we have belongs to an older version of the file
+	var want []byte
+
+	err = c.Conn.Do(ctx, func(ctx context.Context, conn net.Conn) error {
+		offset, err := part.Seek(0, io.SeekEnd)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		// Cancelling ctx interrupts whatever read or write is blocked
+		stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+		defer stop()
+
+		size, sum, err := c.request(conn, name, offset)
+		if err != nil {
+			return err
+		}
+		if want != nil && !bytes.Equal(want, sum) {
+			want = nil
+			if err := part.Truncate(0); err != nil {
+				return Permanent(err)
+			}
+			return errFileChanged
+		}
+		want = sum
+
+		return c.receive(ctx, conn, part, offset, size)
+	})
+	_ = c.Conn.Close()
+	if err != nil {
+		return err
+	}
+
+	// Hash what's on disk, not what went by: it's the file we keep
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, part); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), want) {
+		// Starting over is the only way out
+		_ = part.Close()
+		_ = os.Remove(part.Name())
+		return ErrChecksum
+	}
+
+	if err := part.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(part.Name(), dst)
+}
+
+// request asks for name from offset and reads the response header
+func (c *FileClient) request(conn net.Conn, name string, offset int64) (int64, []byte, error) {
+	_ = conn.SetDeadline(time.Now().Add(fileReadTimeout))
+	req := make([]byte, 10, 10+len(name))
+	binary.BigEndian.PutUint64(req, uint64(offset))
+	binary.BigEndian.PutUint16(req[8:], uint16(len(name)))
+	req = append(req, name...)
+	if _, err := conn.Write(req); err != nil {
+		return 0, nil, err
+	}
+
+	header, err := ReadExactly(conn, fileHeaderSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch header[0] {
+	case fileOK:
+	case fileNotFound:
+		return 0, nil, Permanent(fmt.Errorf("%w: %s", ErrFileNotFound, name))
+	case fileBadOffset:
+		// The partial file is longer than the file: not ours to resume
+		return 0, nil, Permanent(fmt.Errorf("filetransfer: %s: partial file larger than the original", name))
+	default:
+		return 0, nil, Permanent(fmt.Errorf("filetransfer: unknown status %d", header[0]))
+	}
+
+	return int64(binary.BigEndian.Uint64(header[1:])), header[9:], nil
+}
+
+// receive appends chunks to part until the empty chunk
+func (c *FileClient) receive(ctx context.Context, conn net.Conn, part *os.File, done, total int64) error {
+	if c.Progress != nil {
+		c.Progress(done, total)
+	}
+
+	var length [4]byte
+	buf := make([]byte, fileChunkSize)
+	for {
+		// Checked after moving the deadline, which could have undone
+		// the cancellation's
+		_ = conn.SetReadDeadline(time.Now().Add(fileReadTimeout))
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(length[:])
+		if n == 0 {
+			if done != total {
+				return Permanent(fmt.Errorf("filetransfer: got %d of %d bytes", done, total))
+			}
+			return nil
+		}
+		if n > fileChunkSize || done+int64(n) > total {
+			return Permanent(errors.New("filetransfer: invalid chunk"))
+		}
+
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return err
+		}
+		if _, err := part.Write(buf[:n]); err != nil {
+			return Permanent(err)
+		}
+		done += int64(n)
+
+		if c.Progress != nil {
+			c.Progress(done, total)
+		}
+	}
+}
+
+// cutConn fails after passing limit bytes through Write, like a link
+// going down mid-transfer
+type cutConn struct {
+	net.Conn
+	limit int
+}
+
+func (c *cutConn) Write(p []byte) (int, error) {
+	if c.limit <= 0 {
+		_ = c.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	if len(p) > c.limit {
+		n, _ := c.Conn.Write(p[:c.limit])
+		c.limit = 0
+		_ = c.Conn.Close()
+		return n, net.ErrClosed
+	}
+	c.limit -= len(p)
+
+	return c.Conn.Write(p)
+}
+
+// startFileServer serves dir, wrapping each connection with wrap
+func startFileServer(t *testing.T, dir string, wrap func(net.Conn) net.Conn) string {
+	t.Helper()
+
+	fs, err := NewFileServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.ErrorLog = log.New(io.Discard, "", 0)
+
+	l := testListener(t)
+	srv := NewTCPServer(l)
+	srv.ErrorLog = fs.ErrorLog
+	go func() {
+		_ = srv.Serve(context.Background(), func(ctx context.Context, conn net.Conn) {
+			fs.ServeConn(ctx, wrap(conn))
+		})
+	}()
+	t.Cleanup(func() {
+		_ = srv.Shutdown(context.Background())
+		_ = fs.Close()
+	})
+
+	return l.Addr().String()
+}
+
+func TestFileTransferResume(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 40_000) // 640 KB
+	if err := os.WriteFile(filepath.Join(src, "big.bin"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first two connections break after 100 KB
+	var conns atomic.Int32
+	addr := startFileServer(t, src, func(conn net.Conn) net.Conn {
+		if conns.Add(1) <= 2 {
+			return &cutConn{Conn: conn, limit: 100 << 10}
+		}
+		return conn
+	})
+
+	client := NewFileClient(addr, RetryPolicy{Attempts: 5, Initial: time.Millisecond})
+	var reconnects int
+	client.Conn.OnReconnect = func(int, error) { reconnects++ }
+	var last, total int64
+	client.Progress = func(done, size int64) {
+		if done < last {
+			t.Errorf("progress went back from %d to %d", last, done)
+		}
+		last, total = done, size
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	out := filepath.Join(dst, "big.bin")
+	if err := client.Fetch(ctx, "big.bin", out); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded file differs")
+	}
+	if reconnects != 2 {
+		t.Errorf("expected 2 reconnects; actual: %d", reconnects)
+	}
+	if last != int64(len(data)) || total != int64(len(data)) {
+		t.Errorf("expected progress to end at %d/%d; actual: %d/%d", len(data), len(data), last, total)
+	}
+	if _, err := os.Stat(out + filePartSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+
+	// Only what was missing crosses the wire when resuming a partial
+	// file from an earlier run
+	if err := os.WriteFile(out+".2"+filePartSuffix, data[:500_000], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client.Progress = func(done, _ int64) {
+		if done < 500_000 {
+			t.Errorf("resume restarted at %d", done)
+		}
+	}
+	if err := client.Fetch(ctx, "big.bin", out+".2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing files and paths outside the root fail right away
+	if err := client.Fetch(ctx, "missing", filepath.Join(dst, "missing")); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("expected not found; actual: %v", err)
+	}
+	if err := client.Fetch(ctx, "../"+filepath.Base(dst)+"/big.bin", filepath.Join(dst, "escape")); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("expected escaping the root to fail; actual: %v", err)
+	}
+}
+
+func TestFileTransferChecksum(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+
+	data := bytes.Repeat([]byte{0xaa}, 100_000)
+	if err := os.WriteFile(filepath.Join(src, "file"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupted partial file from "an earlier run" can't be detected
+	// until the end, and then costs a full download
+	out := filepath.Join(dst, "file")
+	corrupt := bytes.Clone(data[:50_000])
+	corrupt[123] ^= 0xff
+	if err := os.WriteFile(out+filePartSuffix, corrupt, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startFileServer(t, src, func(conn net.Conn) net.Conn { return conn })
+	client := NewFileClient(addr, RetryPolicy{Attempts: 2, Initial: time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Fetch(ctx, "file", out); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("expected checksum mismatch; actual: %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("corrupted file renamed into place")
+	}
+
+	// The bad partial file is gone, so the next try succeeds
+	if err := client.Fetch(ctx, "file", out); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+		t.Error("downloaded file differs")
+	}
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Connection fingerprinting
+//
+// Before any encryption starts, a TLS client describes itself in its
+// ClientHello: which versions, cipher suites, extensions and curves it
+// supports, in its own order. That list differs between TLS libraries
+// (and versions of them) far more than between users of one, so it
+// tells a browser from curl from a Go program from a scanner pretending
+// to be a browser. JA3 makes it a string, the fields as decimal numbers:
+//
+//	771,4865-4866-4867-49195,0-23-65281-10-11-35-16-5-13-18-51-45-43,29-23-24,0
+//
+// version,ciphers,extensions,curves,point formats, with each list in the
+// order the client sent it, minus the GREASE values (RFC 8701) clients
+// throw in at random to keep servers honest. Its MD5 is what gets
+// compared and logged.
+//
+// FingerprintListener reads the ClientHello of its connections (and
+// hands the bytes back to whoever reads next, the TLS server usually),
+// so a fingerprint is available before anything is served:
+//
+// - the Check hook sees it first and can refuse the connection (a
+//   known bad JA3, a missing SNI)
+// - handlers get it from the connection, through the TLS and tracking
+//   wrappers, with FingerprintOf
+// - HTTP handlers get it from the request context, with
+//   FingerprintConnContext as the server's ConnContext
+//
+// The ClientHello is read on the first Read, or by Fingerprint, not in
+// Accept: a client that connects and says nothing must not hold up the
+// others. A client that doesn't start with a TLS handshake simply has no
+// TLS fingerprint, as long as it speaks first: one waiting for the
+// server to greet it (SMTP) waits for the Timeout instead, so the
+// listener is for TLS ports.
+//
+// On linux the fingerprint also has the TCP options the peer's SYN
+// negotiated (timestamps, SACK, window scaling, ECN, its MSS), read from
+// TCP_INFO; operating systems differ there as well.
+
+// ErrNotTLS is returned when a connection doesn't start with a
+// ClientHello
+var ErrNotTLS = errors.New("not a TLS ClientHello")
+
+// ErrNoFingerprint is returned by FingerprintOf for connections that
+// didn't come from a FingerprintListener
+var ErrNoFingerprint = errors.New("connection not fingerprinted")
+
+// maxClientHelloSize bounds how much is read looking for the end of a
+// ClientHello. Large ones (post-quantum key shares) take a few KB.
+const maxClientHelloSize = 64 << 10
+
+// defaultFingerprintTimeout bounds reading the ClientHello
+const defaultFingerprintTimeout = 10 * time.Second
+
+// ClientHello is what a fingerprint is made of
+type ClientHello struct {
+	Version           uint16 // legacy_version, 0x0303 for TLS 1.2 and 1.3
+	Ciphers           []uint16
+	Extensions        []uint16
+	Curves            []uint16 // supported_groups
+	PointFormats      []uint8
+	ServerName        string   // SNI
+	ALPN              []string // Protocols offered
+	SupportedVersions []uint16 // From the supported_versions extension
+}
+
+// TLS extensions read from the ClientHello
+const (
+	extServerName        = 0
+	extSupportedGroups   = 10
+	extPointFormats      = 11
+	extALPN              = 16
+	extSupportedVersions = 43
+)
+
+// isGREASE reports whether v is one of the reserved 0x?a?a values
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// JA3 returns the JA3 string of the ClientHello
+func (h *ClientHello) JA3() string {
+	list := func(values []uint16) string {
+		var parts []string
+		for _, v := range values {
+			if !isGREASE(v) {
+				parts = append(parts, strconv.Itoa(int(v)))
+			}
+		}
+		return strings.Join(parts, "-")
+	}
+	formats := make([]uint16, len(h.PointFormats))
+	for i, f := range h.PointFormats {
+		formats[i] = uint16(f)
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		list(h.Ciphers),
+		list(h.Extensions),
+		list(h.Curves),
+		list(formats),
+	}, ",")
+}
+
+// JA3Hash returns the MD5 of the JA3 string, in hex
+func (h *ClientHello) JA3Hash() string {
+	sum := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+// ReadClientHello reads TLS records from r up to the end of the
+// ClientHello, and returns it parsed along with every byte read, which
+// belong to whoever handles the connection next. ErrNotTLS means the
+// bytes read are not the start of one.
+func ReadClientHello(r io.Reader) (*ClientHello, []byte, error) {
+	var raw, msg []byte
+	header := make([]byte, 5)
+	for {
+		n, err := io.ReadFull(r, header)
+		raw = append(raw, header[:n]...)
+		if err != nil {
+			return nil, raw, err
+		}
+		// A handshake record of a TLS 1.x client
+		if header[0] != 22 || header[1] != 3 {
+			return nil, raw, ErrNotTLS
+		}
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		if length == 0 || len(raw)+length > maxClientHelloSize {
+			return nil, raw, ErrNotTLS
+		}
+
+		body := make([]byte, length)
+		n, err = io.ReadFull(r, body)
+		raw = append(raw, body[:n]...)
+		if err != nil {
+			return nil, raw, err
+		}
+		msg = append(msg, body...)
+
+		// The handshake message may span several records
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != 1 { // client_hello
+			return nil, raw, ErrNotTLS
+		}
+		size := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if len(msg)-4 < size {
+			continue
+		}
+		h, err := parseClientHello(msg[4 : 4+size])
+		return h, raw, err
+	}
+}
+
+// helloReader reads the fields of a ClientHello, remembering the first
+// error: a short message leaves ok false
+type helloReader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if !r.ok || len(r.b) < n {
+		r.ok = false
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+
+	return b
+}
+
+func (r *helloReader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *helloReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// vector returns the bytes of a vector with a length prefix of size
+// bytes, as a reader of its own
+func (r *helloReader) vector(size int) *helloReader {
+	var n int
+	for _, b := range r.bytes(size) {
+		n = n<<8 | int(b)
+	}
+
+	return &helloReader{b: r.bytes(n), ok: r.ok}
+}
+
+// uint16s reads the rest of r as 16 bit values
+func (r *helloReader) uint16s() []uint16 {
+	var values []uint16
+	for r.ok && len(r.b) >= 2 {
+		values = append(values, r.uint16())
+	}
+
+	return values
+}
+
+// parseClientHello parses the body of a ClientHello handshake message
+func parseClientHello(msg []byte) (*ClientHello, error) {
+	r := &helloReader{b: msg, ok: true}
+	h := &ClientHello{Version: r.uint16()}
+	r.bytes(32) // random
+	r.vector(1) // legacy_session_id
+	h.Ciphers = r.vector(2).uint16s()
+	r.vector(1) // legacy_compression_methods
+	if !r.ok {
+		return nil, ErrNotTLS
+	}
+	if len(r.b) == 0 {
+		// Old clients may send no extensions at all
+		return h, nil
+	}
+	exts := r.vector(2)
+
+	for exts.ok && len(exts.b) > 0 {
+		typ := exts.uint16()
+		data := exts.vector(2)
+		h.Extensions = append(h.Extensions, typ)
+
+		switch typ {
+		case extServerName:
+			names := data.vector(2)
+			for names.ok && len(names.b) > 0 {
+				nameType, name := names.uint8(), names.vector(2)
+				if nameType == 0 && name.ok { // host_name
+					h.ServerName = string(name.b)
+				}
+			}
+		case extSupportedGroups:
+			h.Curves = data.vector(2).uint16s()
+		case extPointFormats:
+			h.PointFormats = append([]uint8(nil), data.vector(1).b...)
+		case extALPN:
+			protos := data.vector(2)
+			for protos.ok && len(protos.b) > 0 {
+				if p := protos.vector(1); p.ok {
+					h.ALPN = append(h.ALPN, string(p.b))
+				}
+			}
+		case extSupportedVersions:
+			h.SupportedVersions = data.vector(1).uint16s()
+		}
+	}
+	if !exts.ok {
+		return nil, ErrNotTLS
+	}
+
+	return h, nil
+}
+
+// TCPOptions are the TCP options the peer negotiated
+type TCPOptions struct {
+	Timestamps  bool
+	SACK        bool
+	ECN         bool
+	WindowScale int    // The peer's window scale shift, -1 without
+	MSS         uint32 // The peer's maximum segment size
+	FastOpen    bool   // Data went with the SYN, see FastOpen.go
+}
+
+// String returns "mss=1460,sack,ts,wscale=7"
+func (o TCPOptions) String() string {
+	parts := []string{fmt.Sprintf("mss=%d", o.MSS)}
+	if o.SACK {
+		parts = append(parts, "sack")
+	}
+	if o.Timestamps {
+		parts = append(parts, "ts")
+	}
+	if o.ECN {
+		parts = append(parts, "ecn")
+	}
+	if o.WindowScale >= 0 {
+		parts = append(parts, fmt.Sprintf("wscale=%d", o.WindowScale))
+	}
+	if o.FastOpen {
+		parts = append(parts, "tfo")
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// Fingerprint describes how a client connected
+type Fingerprint struct {
+	TLS *ClientHello // nil when the client didn't start with TLS
+	TCP *TCPOptions  // nil when not known (not TCP, not linux)
+}
+
+// JA3Hash returns the JA3 hash of the ClientHello, "" without one
+func (f *Fingerprint) JA3Hash() string {
+	if f == nil || f.TLS == nil {
+		return ""
+	}
+
+	return f.TLS.JA3Hash()
+}
+
+// LogValue groups what is known, for slog
+func (f *Fingerprint) LogValue() slog.Value {
+	var attrs []slog.Attr
+	if f.TLS != nil {
+		attrs = append(attrs, slog.String("ja3", f.TLS.JA3Hash()), slog.String("sni", f.TLS.ServerName))
+	}
+	if f.TCP != nil {
+		attrs = append(attrs, slog.String("tcp", f.TCP.String()))
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+// String returns "ja3=... sni=... tcp=..."
+func (f *Fingerprint) String() string {
+	var parts []string
+	for _, a := range f.LogValue().Group() {
+		parts = append(parts, a.Key+"="+a.Value.String())
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// FingerprintListener fingerprints the connections of a listener
+type FingerprintListener struct {
+	net.Listener
+
+	// Timeout bounds reading the ClientHello, 10 seconds by default
+	Timeout time.Duration
+
+	// Check, when set, is called with every fingerprint; an error
+	// closes the connection, the error going to whoever was reading
+	Check func(conn net.Conn, fp *Fingerprint) error
+}
+
+// Accept returns the next connection as a *FingerprintConn
+func (l *FingerprintListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &FingerprintConn{Conn: conn, listener: l}, nil
+}
+
+// FingerprintConn is a connection fingerprinted on first use
+type FingerprintConn struct {
+	net.Conn
+	listener *FingerprintListener
+
+	once        sync.Once
+	fingerprint *Fingerprint
+	err         error
+	peeked      *PeekConn // Holds what the fingerprinting read
+}
+
+// Fingerprint reads the ClientHello if that wasn't done yet, and
+// returns the fingerprint. The error is that of the read, or of Check.
+func (c *FingerprintConn) Fingerprint() (*Fingerprint, error) {
+	c.once.Do(c.peek)
+	return c.fingerprint, c.err
+}
+
+// peek reads the ClientHello and runs the Check
+func (c *FingerprintConn) peek() {
+	timeout := c.listener.Timeout
+	if timeout <= 0 {
+		timeout = defaultFingerprintTimeout
+	}
+	c.peeked = NewPeekConn(c.Conn, maxClientHelloSize)
+	_ = c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	hello, _, err := ReadClientHello(c.peeked.Lookahead())
+	_ = c.Conn.SetReadDeadline(time.Time{})
+
+	c.fingerprint = &Fingerprint{TLS: hello, TCP: peerTCPOptions(c.Conn)}
+	switch {
+	case err == nil, errors.Is(err, ErrNotTLS):
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// Whoever reads next gets what there was, then EOF
+		return
+	default:
+		c.err = err
+		return
+	}
+	if c.listener.Check != nil {
+		if c.err = c.listener.Check(c, c.fingerprint); c.err != nil {
+			_ = c.Conn.Close()
+		}
+	}
+}
+
+// Read returns what the fingerprinting read first, then reads on
+func (c *FingerprintConn) Read(p []byte) (int, error) {
+	c.once.Do(c.peek)
+
+	// Too slow to say hello, or refused by Check
+	if c.err != nil && c.peeked.Buffered() == 0 {
+		return 0, c.err
+	}
+
+	return c.peeked.Read(p)
+}
+
+// NetConn returns the connection underneath
+func (c *FingerprintConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// FingerprintOf returns the fingerprint of conn, looking through
+// wrappers that have a NetConn method (tls.Conn, the tracked
+// connections) for a *FingerprintConn
+func FingerprintOf(conn net.Conn) (*Fingerprint, error) {
+	for conn != nil {
+		if fc, ok := conn.(*FingerprintConn); ok {
+			return fc.Fingerprint()
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = u.NetConn()
+	}
+
+	return nil, ErrNoFingerprint
+}
+
+type fingerprintConnKey struct{}
+
+// FingerprintConnContext is an http.Server ConnContext making the
+// fingerprint available to handlers through FingerprintFromContext
+func FingerprintConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, fingerprintConnKey{}, conn)
+}
+
+// FingerprintFromContext returns the fingerprint of the connection of a
+// request, see FingerprintConnContext
+func FingerprintFromContext(ctx context.Context) (*Fingerprint, bool) {
+	conn, _ := ctx.Value(fingerprintConnKey{}).(net.Conn)
+	fp, err := FingerprintOf(conn)
+
+	return fp, err == nil
+}
+
+func TestClientHelloJA3(t *testing.T) {
+	h := &ClientHello{
+		Version:      0x0303,
+		Ciphers:      []uint16{0x0a0a, 4865, 4866}, // GREASE first, like Chrome
+		Extensions:   []uint16{0, 0x1a1a, 10, 11},
+		Curves:       []uint16{0x2a2a, 29, 23},
+		PointFormats: []uint8{0},
+	}
+	if ja3 := h.JA3(); ja3 != "771,4865-4866,0-10-11,29-23,0" {
+		t.Errorf("unexpected JA3 %q", ja3)
+	}
+	sum := md5.Sum([]byte("771,4865-4866,0-10-11,29-23,0"))
+	if h.JA3Hash() != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected hash %s", h.JA3Hash())
+	}
+
+	// Garbage and truncated hellos are not TLS
+	for _, b := range [][]byte{[]byte("GET / HTTP/1.1\r\n\r\n"), {22, 3, 1, 0, 4, 1, 0, 0, 9, 3, 3}} {
+		if _, _, err := ReadClientHello(bytes.NewReader(b)); !errors.Is(err, ErrNotTLS) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%q: expected not TLS; actual: %v", b, err)
+		}
+	}
+}
+
+func TestFingerprintListener(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Issue(TLSLeaf{Name: "server", Hosts: []string{"example.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients asking for "refused.test" are turned away
+	fl := &FingerprintListener{
+		Listener: testListener(t),
+		Check: func(_ net.Conn, fp *Fingerprint) error {
+			if fp.TLS != nil && fp.TLS.ServerName == "refused.test" {
+				return errors.New("refused")
+			}
+			return nil
+		},
+	}
+	fingerprints := make(chan *Fingerprint, 3)
+	serverConfig := ServerConfig(cert, nil)
+	serverConfig.NextProtos = []string{"echo"}
+	go func() {
+		for {
+			conn, err := fl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Plain text clients are echoed as they are
+				if fp, _ := conn.(*FingerprintConn).Fingerprint(); fp.TLS == nil {
+					_, _ = io.Copy(conn, conn)
+					fingerprints <- fp
+					return
+				}
+				tlsConn := tls.Server(conn, serverConfig)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				fp, err := FingerprintOf(tlsConn)
+				if err != nil {
+					t.Errorf("expected a fingerprint; actual: %v", err)
+				}
+				fingerprints <- fp
+				_, _ = io.Copy(tlsConn, tlsConn)
+			}()
+		}
+	}()
+
+	clientConfig := ClientConfig(ca.Pool())
+	clientConfig.ServerName = "example.test"
+	clientConfig.NextProtos = []string{"echo"}
+	conn, err := tls.Dial("tcp", fl.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("hi"))
+	if b, err := ReadExactly(conn, 2); err != nil || string(b) != "hi" {
+		t.Errorf("unexpected echo %q, %v", b, err)
+	}
+	_ = conn.Close()
+
+	fp := <-fingerprints
+	if fp.TLS == nil || fp.TLS.ServerName != "example.test" || len(fp.TLS.ALPN) != 1 || fp.TLS.ALPN[0] != "echo" {
+		t.Fatalf("unexpected fingerprint %+v", fp.TLS)
+	}
+	if fields := strings.Split(fp.TLS.JA3(), ","); len(fields) != 5 || fields[0] != "771" || fields[1] == "" {
+		t.Errorf("unexpected JA3 %q", fp.TLS.JA3())
+	}
+	if len(fp.JA3Hash()) != 32 || !strings.Contains(fp.String(), "sni=example.test") {
+		t.Errorf("unexpected fingerprint %s", fp)
+	}
+
+	// Plain text goes through untouched, without a TLS fingerprint
+	plain, err := net.Dial("tcp", fl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = plain.Write([]byte("plain text"))
+	if b, err := ReadExactly(plain, 10); err != nil || string(b) != "plain text" {
+		t.Errorf("unexpected echo %q, %v", b, err)
+	}
+	_ = plain.Close()
+	if fp := <-fingerprints; fp.TLS != nil {
+		t.Errorf("expected no TLS fingerprint; actual: %+v", fp.TLS)
+	}
+
+	// Check refuses
+	clientConfig.ServerName = "refused.test"
+	if conn, err := tls.Dial("tcp", fl.Addr().String(), clientConfig); err == nil {
+		_ = conn.Close()
+		t.Error("expected the handshake to fail")
+	}
+}
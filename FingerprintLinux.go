@@ -0,0 +1,113 @@
+//go:build linux && !386
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// TCP_INFO options bits (tcpi_options)
+const (
+	tcpiOptTimestamps = 1
+	tcpiOptSACK       = 2
+	tcpiOptWScale     = 4
+	tcpiOptECN        = 8
+	tcpiOptSYNData    = 32
+)
+
+// peerTCPOptions reads the options negotiated with the peer from
+// TCP_INFO. struct tcp_info starts with bytes, then 32 bit values, the
+// same on every architecture:
+//
+//	0 state, ca_state, retransmits, probes, backoff, options,
+//	6 snd_wscale:4 rcv_wscale:4, ...
+//	8 rto, 12 ato, 16 snd_mss, 20 rcv_mss, ...
+//
+// It's read into bytes rather than syscall.TCPInfo, whose padding hides
+// the window scales. 386 has no getsockopt syscall (it goes through
+// socketcall), hence the build tag.
+func peerTCPOptions(conn net.Conn) *TCPOptions {
+	for conn != nil {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			return tcpConnOptions(tc)
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = u.NetConn()
+	}
+
+	return nil
+}
+
+func tcpConnOptions(conn *net.TCPConn) *TCPOptions {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var info [104]byte
+	size := uint32(len(info))
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil || errno != 0 || size < 24 {
+		return nil
+	}
+
+	options := info[5]
+	o := &TCPOptions{
+		Timestamps:  options&tcpiOptTimestamps != 0,
+		SACK:        options&tcpiOptSACK != 0,
+		ECN:         options&tcpiOptECN != 0,
+		FastOpen:    options&tcpiOptSYNData != 0,
+		WindowScale: -1,
+		MSS:         binary.NativeEndian.Uint32(info[16:]), // snd_mss: what the peer accepts
+	}
+	if options&tcpiOptWScale != 0 {
+		// Bit fields are laid out from the low bits on little endian
+		// machines, from the high bits on big endian ones
+		scales := info[6]
+		if binary.NativeEndian.Uint16([]byte{0, 1}) == 1 {
+			o.WindowScale = int(scales >> 4)
+		} else {
+			o.WindowScale = int(scales & 0xf)
+		}
+	}
+
+	return o
+}
+
+func TestPeerTCPOptions(t *testing.T) {
+	l := testListener(t)
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// Through a wrapper, like the fingerprinting sees it
+	o := peerTCPOptions(new(ConnTracker).Track(server))
+	if o == nil || o.MSS == 0 || o.WindowScale > 14 {
+		t.Fatalf("unexpected options %+v", o)
+	}
+	if !o.SACK || !o.Timestamps {
+		// Linux enables both unless told otherwise
+		t.Logf("options without SACK or timestamps: %s", o)
+	}
+	if a, _ := MemPipe(); peerTCPOptions(a) != nil {
+		t.Error("expected no options for a connection that isn't TCP")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux || 386
+
+package main
+
+import "net"
+
+// peerTCPOptions knows nothing: TCP_INFO is read on linux only (see
+// FingerprintLinux.go)
+func peerTCPOptions(net.Conn) *TCPOptions {
+	return nil
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Flight recorder
+//
+// When a connection fails in production, the bytes that led up to it
+// are what explains the failure, and they're gone: logging every
+// payload (Monitor with a Logger) costs too much to leave on, and a
+// capture started after the fact misses it. A FlightRecorder keeps the
+// last Size bytes of every MonitoredConn, both directions interleaved,
+// in a ring buffer of its own, and writes them out only when something
+// went wrong:
+//
+// - a read or write of the connection fails with an error DumpOn
+//   accepts, by default one that isn't a plain close or a timeout
+//   (Classify: fatal, too large or transient, such as a reset)
+// - the application calls Dump, say on a protocol error it found in
+//   data that read fine
+//
+// A dump is a pcap file in Dir, flight-<conn id>-<time>.pcap, holding
+// the recorded chunks as TCP segments between the connection's
+// addresses (made up ones for connections that aren't TCP), with
+// sequence numbers running on, so Wireshark's "Follow TCP stream" shows
+// the conversation. The start of the stream is missing, of course: the
+// ring only has its end.
+//
+// Recording is a copy into the ring under a per-connection lock; the
+// ring is allocated with the first byte and freed when the connection
+// closes. MaxDumps caps the files written, so an outage failing every
+// connection doesn't fill the disk.
+
+const (
+	defaultFlightSize     = 16 << 10
+	defaultFlightMaxDumps = 100
+
+	// flightSegment is the largest payload of a dumped TCP segment
+	flightSegment = 16 << 10
+)
+
+// FlightRecorder keeps the end of every MonitoredConn's traffic, see
+// above. Set it as the Recorder of a Monitor.
+type FlightRecorder struct {
+	Size     int    // Bytes kept per connection, 16KB by default
+	Dir      string // Where dumps go, os.TempDir() by default
+	MaxDumps int    // Files written at most, 100 by default
+
+	// DumpOn reports whether a connection failing with err is dumped;
+	// see defaultDumpOn for the default
+	DumpOn func(err error) bool
+
+	// ErrorLog receives the dumps written, and those that failed
+	ErrorLog *log.Logger
+
+	mu    sync.Mutex
+	rings map[uint64]*flightRing
+
+	dumps atomic.Int64
+}
+
+// flightRing is the recording of one connection
+type flightRing struct {
+	local, remote net.Addr
+
+	mu      sync.Mutex
+	buf     []byte // Circular, allocated by the first add
+	written int64  // Bytes ever added; buf holds the last len(buf)
+	segs    []flightSeg
+	dumped  bool
+}
+
+// flightSeg is a chunk of traffic, at its offset in the stream of both
+// directions
+type flightSeg struct {
+	at    time.Time
+	dir   Direction
+	start int64
+	n     int
+}
+
+func (f *FlightRecorder) logf(format string, v ...any) {
+	if f.ErrorLog != nil {
+		f.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// defaultDumpOn dumps on errors that aren't the connection ending the
+// normal way, or a deadline firing
+func defaultDumpOn(err error) bool {
+	switch Classify(err) {
+	case ClassFatal, ClassTooLarge, ClassTransient:
+		return true
+	}
+
+	return false
+}
+
+// open starts recording connection id; a nil FlightRecorder records
+// nothing
+func (f *FlightRecorder) open(id uint64, conn net.Conn) *flightRing {
+	if f == nil {
+		return nil
+	}
+	r := &flightRing{local: conn.LocalAddr(), remote: conn.RemoteAddr()}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rings == nil {
+		f.rings = make(map[uint64]*flightRing)
+	}
+	f.rings[id] = r
+
+	return r
+}
+
+// close forgets connection id
+func (f *FlightRecorder) close(id uint64) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.rings, id)
+}
+
+// failed dumps connection id if err is worth it, once per connection
+func (f *FlightRecorder) failed(id uint64, err error) {
+	dumpOn := f.DumpOn
+	if dumpOn == nil {
+		dumpOn = defaultDumpOn
+	}
+	if !dumpOn(err) {
+		return
+	}
+	if _, dumpErr := f.dump(id, err, true); dumpErr != nil {
+		f.logf("flight recorder: conn %d: %v", id, dumpErr)
+	}
+}
+
+// Dump writes the recording of connection id to a pcap file in Dir,
+// and returns its path. reason goes to the log.
+func (f *FlightRecorder) Dump(id uint64, reason error) (string, error) {
+	return f.dump(id, reason, false)
+}
+
+func (f *FlightRecorder) dump(id uint64, reason error, once bool) (string, error) {
+	f.mu.Lock()
+	r := f.rings[id]
+	f.mu.Unlock()
+	if r == nil {
+		return "", fmt.Errorf("flight recorder: no connection %d", id)
+	}
+
+	r.mu.Lock()
+	skip := once && r.dumped
+	r.dumped = true
+	r.mu.Unlock()
+	if skip {
+		return "", nil
+	}
+
+	maxDumps := f.MaxDumps
+	if maxDumps <= 0 {
+		maxDumps = defaultFlightMaxDumps
+	}
+	if n := f.dumps.Add(1); n > int64(maxDumps) {
+		if n == int64(maxDumps)+1 {
+			f.logf("flight recorder: %d dumps written, no more", maxDumps)
+		}
+		return "", nil
+	}
+
+	dir := f.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := filepath.Join(dir, fmt.Sprintf("flight-%d-%s.pcap", id, time.Now().Format("20060102T150405.000")))
+	file, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	bw := bufio.NewWriter(file)
+	err = r.writePcap(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("flight recorder: %w", err)
+	}
+	f.logf("flight recorder: conn %d (%s): %v; last %d bytes in %s", id, r.remote, reason, r.len(), name)
+
+	return name, nil
+}
+
+// Snapshot returns what is recorded of connection id, with offsets
+// from its first event kept
+func (f *FlightRecorder) Snapshot(id uint64) []SessionEvent {
+	f.mu.Lock()
+	r := f.rings[id]
+	f.mu.Unlock()
+	if r == nil {
+		return nil
+	}
+
+	events := r.events()
+	out := make([]SessionEvent, len(events))
+	for i, e := range events {
+		out[i] = SessionEvent{Offset: e.at.Sub(events[0].at), Direction: e.dir, Payload: e.data}
+	}
+
+	return out
+}
+
+// add records p, a chunk going in direction dir
+func (r *flightRing) add(size int, dir Direction, p []byte) {
+	if r == nil || len(p) == 0 {
+		return
+	}
+	if size <= 0 {
+		size = defaultFlightSize
+	}
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.buf == nil {
+		r.buf = make([]byte, size)
+	}
+	size = len(r.buf)
+	if len(p) > size {
+		// Only its end fits
+		r.written += int64(len(p) - size)
+		p = p[len(p)-size:]
+	}
+
+	// Chunks following each other in the same direction within a
+	// millisecond share a segment, so a stream of tiny writes doesn't
+	// grow the segment list without bound
+	if last := len(r.segs) - 1; last >= 0 && r.segs[last].dir == dir &&
+		r.segs[last].start+int64(r.segs[last].n) == r.written && now.Sub(r.segs[last].at) < time.Millisecond {
+		r.segs[last].n += len(p)
+	} else {
+		r.segs = append(r.segs, flightSeg{at: now, dir: dir, start: r.written, n: len(p)})
+	}
+
+	off := int(r.written % int64(size))
+	n := copy(r.buf[off:], p)
+	copy(r.buf, p[n:])
+	r.written += int64(len(p))
+
+	// Forget the segments overwritten entirely
+	floor := r.written - int64(size)
+	i := 0
+	for i < len(r.segs) && r.segs[i].start+int64(r.segs[i].n) <= floor {
+		i++
+	}
+	r.segs = r.segs[i:]
+}
+
+// flightEvent is a recorded chunk, copied out of the ring
+type flightEvent struct {
+	at   time.Time
+	dir  Direction
+	data []byte
+}
+
+// events copies out the chunks still in the ring, the first one cut
+// where the ring wrapped over it
+func (r *flightRing) events() []flightEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	size := int64(len(r.buf))
+	floor := r.written - size
+	events := make([]flightEvent, 0, len(r.segs))
+	for _, s := range r.segs {
+		start, end := max(s.start, floor), s.start+int64(s.n)
+		data := make([]byte, 0, end-start)
+		for start < end {
+			off := start % size
+			chunk := min(end-start, size-off)
+			data = append(data, r.buf[off:off+chunk]...)
+			start += chunk
+		}
+		events = append(events, flightEvent{at: s.at, dir: s.dir, data: data})
+	}
+
+	return events
+}
+
+// len returns how many bytes the ring holds
+func (r *flightRing) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return int(min(r.written, int64(len(r.buf))))
+}
+
+// flightEndpoint returns the IP and port of addr for the dump, or
+// made up ones for an address that isn't TCP
+func flightEndpoint(addr net.Addr, fallback net.IP, port uint16) (net.IP, uint16) {
+	if a, ok := addr.(*net.TCPAddr); ok && a.IP != nil {
+		return a.IP, uint16(a.Port)
+	}
+
+	return fallback, port
+}
+
+// writePcap writes the recording as TCP segments from and to the
+// connection's addresses
+func (r *flightRing) writePcap(w io.Writer) error {
+	pw, err := NewPcapWriter(w, 0, LinkTypeEthernet)
+	if err != nil {
+		return err
+	}
+
+	localIP, localPort := flightEndpoint(r.local, net.IPv4(127, 0, 0, 1), 1)
+	remoteIP, remotePort := flightEndpoint(r.remote, net.IPv4(127, 0, 0, 2), 2)
+	v4 := localIP.To4() != nil && remoteIP.To4() != nil
+
+	// Next sequence number sent by each side, relative to the start of
+	// what's recorded
+	var localSeq, remoteSeq uint32 = 1, 1
+	for _, e := range r.events() {
+		for data := e.data; len(data) > 0; {
+			payload := data[:min(len(data), flightSegment)]
+			data = data[len(payload):]
+
+			p := &Packet{
+				TCP:     &TCPHeader{Flags: TCPPsh | TCPAck, Window: 65535},
+				Payload: payload,
+			}
+			src, dst := localIP, remoteIP
+			if e.dir == Inbound {
+				src, dst = remoteIP, localIP
+				p.TCP.SrcPort, p.TCP.DstPort = remotePort, localPort
+				p.TCP.Seq, p.TCP.Ack = remoteSeq, localSeq
+				remoteSeq += uint32(len(payload))
+			} else {
+				p.TCP.SrcPort, p.TCP.DstPort = localPort, remotePort
+				p.TCP.Seq, p.TCP.Ack = localSeq, remoteSeq
+				localSeq += uint32(len(payload))
+			}
+			if v4 {
+				p.IPv4 = &IPv4Header{TTL: 64, Src: src, Dst: dst}
+			} else {
+				p.IPv6 = &IPv6Header{HopLimit: 64, Src: src.To16(), Dst: dst.To16()}
+			}
+
+			frame, err := p.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := pw.WriteFrame(Frame{Time: e.at, Data: frame, Length: len(frame)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// failingConn fails its reads with err once it's set, for the tests
+type failingConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failingConn) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+func TestFlightRecorder(t *testing.T) {
+	client, server := tcpPair(t)
+	fr := &FlightRecorder{Size: 16, Dir: t.TempDir(), ErrorLog: log.New(io.Discard, "", 0)}
+	m := &Monitor{Recorder: fr}
+	fc := &failingConn{Conn: client}
+	c := NewMonitoredConn(fc, m)
+
+	go func() {
+		_, _ = server.Write([]byte("HELLO SERVER"))
+		_, _ = io.Copy(io.Discard, server)
+	}()
+	if _, err := c.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// 22 bytes went through, the last 16 are kept
+	events := fr.Snapshot(c.ID())
+	var got []string
+	for _, e := range events {
+		got = append(got, fmt.Sprintf("%s %s", e.Direction, e.Payload))
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]string{Outbound.String() + " 6789", Inbound.String() + " HELLO SERVER"}) {
+		t.Errorf("unexpected recording: %q", got)
+	}
+
+	// A failing read dumps it, once
+	fc.err = errors.New("bad frame")
+	_, _ = c.Read(buf)
+	_, _ = c.Read(buf)
+	dumps, _ := filepath.Glob(filepath.Join(fr.Dir, "flight-*.pcap"))
+	if len(dumps) != 1 {
+		t.Fatalf("expected 1 dump; actual: %v", dumps)
+	}
+
+	// The dump is the two chunks, as segments between the addresses
+	file, err := os.Open(dumps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	pr, err := NewPcapReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outbound, inbound []byte
+	for {
+		frame, err := pr.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := DecodePacket(frame.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.VerifyChecksums(); err != nil {
+			t.Error(err)
+		}
+		if int(p.TCP.SrcPort) == client.LocalAddr().(*net.TCPAddr).Port {
+			outbound = append(outbound, p.Payload...)
+		} else {
+			inbound = append(inbound, p.Payload...)
+		}
+	}
+	if string(outbound) != "6789" || string(inbound) != "HELLO SERVER" {
+		t.Errorf("unexpected dump: %q, %q", outbound, inbound)
+	}
+
+	// Timeouts and closes aren't dumped; closing forgets the connection
+	if defaultDumpOn(os.ErrDeadlineExceeded) || defaultDumpOn(io.EOF) || !defaultDumpOn(ErrMaxPayloadSize) {
+		t.Error("unexpected DumpOn defaults")
+	}
+	_ = c.Close()
+	if _, err := fr.Dump(c.ID(), nil); err == nil {
+		t.Error("expected a closed connection to be forgotten")
+	}
+}
@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Forward HTTP proxy with a cache
+//
+// Before CONNECT, a proxy was asked for documents, not tunnels. The
+// client puts the whole URL in the request line instead of just the
+// path, and the proxy fetches it on the client's behalf:
+//
+//	GET http://example.com/index.html HTTP/1.0
+//	Host: example.com
+//
+// Since the proxy sees every request and response, it can keep copies
+// of the popular ones and answer from its cache, which is why whole
+// offices used to sit behind one. ConnectProxy (ConnectTunnel.go) can
+// only copy encrypted bytes; ForwardProxy reads plain HTTP.
+//
+// ForwardProxy fetches with HTTPClient, so idempotent requests are
+// retried, and strips the hop-by-hop headers (Connection and the
+// headers it names, Proxy-Authorization, ...) both ways: they are meant
+// for the proxy, not for the origin or the client.
+//
+// HTTPCache keeps GET responses the origin marked as cacheable:
+//
+//   - Cache-Control s-maxage or max-age, or else Expires, give the
+//     freshness lifetime; without one nothing is stored, there is no
+//     guessing
+//   - no-store and private responses aren't stored, nor are responses
+//     to requests with an Authorization header, unless marked public
+//   - a request's no-store bypasses the cache, no-cache or max-age=0
+//     fetch anew and store the result
+//   - Vary names the request headers that must match; "Vary: *" is
+//     never stored
+//
+// Hits carry an Age header and X-Cache: HIT. Expired entries aren't
+// revalidated, just fetched again.
+
+const (
+	defaultCacheEntries   = 1024
+	defaultCacheEntrySize = 1 << 20
+)
+
+// hopHeaders are meaningful for a single connection only (RFC 9110
+// section 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// cacheableStatuses may be stored given a freshness lifetime
+var cacheableStatuses = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusNoContent,
+	http.StatusMultipleChoices,
+	http.StatusMovedPermanently,
+	http.StatusNotFound,
+	http.StatusMethodNotAllowed,
+	http.StatusGone,
+	http.StatusRequestURITooLong,
+	http.StatusNotImplemented,
+}
+
+// ForwardProxy is an http.Handler fetching absolute-URI requests
+type ForwardProxy struct {
+	// Allow decides which origins ("host:port") may be reached; nil
+	// allows none
+	Allow func(target string) bool
+
+	// Credentials, when set, are required as "user:password"
+	Credentials string
+
+	// Client fetches from the origins; defaults to NewForwardClient
+	Client *HTTPClient
+
+	// Cache, when set, answers GET requests it has a fresh copy for
+	Cache *HTTPCache
+
+	// ErrorLog receives fetch errors
+	ErrorLog *log.Logger
+
+	// Metrics, when set, counts requests by cache result
+	Metrics *Metrics
+
+	// Enricher, when set, labels clients in the logs (see Enrich.go)
+	Enricher Enricher
+
+	once   sync.Once
+	client *HTTPClient
+}
+
+// NewForwardClient returns the HTTPClient of a ForwardProxy: it hands
+// redirects back to the client and ignores the proxy environment
+func NewForwardClient() *HTTPClient {
+	transport := NewHTTPTransport()
+	transport.Proxy = nil
+	// The client negotiates compression with the origin, not us
+	transport.DisableCompression = true
+
+	return &HTTPClient{
+		Client: &http.Client{
+			Transport: transport,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		Retry: RetryPolicy{Attempts: 3, Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: 0.2},
+	}
+}
+
+func (p *ForwardProxy) logf(format string, v ...any) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+func (p *ForwardProxy) httpClient() *HTTPClient {
+	p.once.Do(func() {
+		p.client = p.Client
+		if p.client == nil {
+			p.client = NewForwardClient()
+		}
+	})
+
+	return p.client
+}
+
+// served records the outcome of a request
+func (p *ForwardProxy) served(result string) {
+	if p.Metrics != nil {
+		p.Metrics.Counter("forward_proxy_requests_total", "Forward proxy requests, by result.", "result").With(result).Inc()
+	}
+}
+
+func (p *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		http.Error(w, "CONNECT is not supported", http.StatusMethodNotAllowed)
+		p.served("rejected")
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Host == "" || (r.URL.Scheme != "http" && r.URL.Scheme != "https") {
+		http.Error(w, "absolute http URI required", http.StatusBadRequest)
+		p.served("rejected")
+		return
+	}
+
+	if p.Credentials != "" {
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.Credentials))
+		if r.Header.Get("Proxy-Authorization") != want {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="golearn"`)
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			p.served("unauthorized")
+			return
+		}
+	}
+
+	target := originAddr(r.URL)
+	if p.Allow == nil || !p.Allow(target) {
+		http.Error(w, "target not allowed", http.StatusForbidden)
+		p.served("denied")
+		return
+	}
+
+	cacheable := p.Cache != nil && r.Method == http.MethodGet
+	reqCC := parseCacheControl(r.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		cacheable = false
+	}
+	if cacheable && !reqCC.revalidate() {
+		if entry := p.Cache.Get(r); entry != nil {
+			entry.write(w)
+			p.served("hit")
+			return
+		}
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	out.Header.Add("Via", fmt.Sprintf("%d.%d golearn", r.ProtoMajor, r.ProtoMinor))
+	if r.ContentLength == 0 {
+		// Lets HTTPClient retry it
+		out.Body = http.NoBody
+	}
+
+	resp, err := p.httpClient().Do(out)
+	if err != nil {
+		p.logf("forward %s %s for %s: %v", r.Method, r.URL, requestPeer(p.Enricher, r), err)
+		http.Error(w, "cannot reach origin", http.StatusBadGateway)
+		p.served("unreachable")
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	resp.Header.Add("Via", fmt.Sprintf("%d.%d golearn", resp.ProtoMajor, resp.ProtoMinor))
+
+	var store *cacheWriter
+	if cacheable {
+		store = p.Cache.storable(r, resp)
+	}
+	result := "bypass"
+	if store != nil {
+		result = "miss"
+		resp.Header.Set("X-Cache", "MISS")
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var body io.Writer = w
+	if store != nil {
+		body = io.MultiWriter(w, store)
+	}
+	if _, err := io.Copy(body, resp.Body); err != nil {
+		p.logf("forward %s %s for %s: %v", r.Method, r.URL, requestPeer(p.Enricher, r), err)
+		p.served(result)
+		return
+	}
+	if store != nil {
+		store.commit()
+	}
+	p.served(result)
+}
+
+// originAddr is the "host:port" of u, with the scheme's default port
+func originAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// removeHopHeaders deletes the headers meant for one connection from h
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// cacheControl holds the directives of Cache-Control headers, by
+// lower-case name, with their values unquoted
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+
+	return cc
+}
+
+// seconds returns the value of a delta-seconds directive
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// revalidate reports whether a request refuses cached answers
+func (cc cacheControl) revalidate() bool {
+	if _, ok := cc["no-cache"]; ok {
+		return true
+	}
+	maxAge, ok := cc.seconds("max-age")
+
+	return ok && maxAge == 0
+}
+
+// HTTPCache is an in-memory LRU cache of responses
+type HTTPCache struct {
+	// MaxEntries bounds the number of responses kept (defaults to
+	// 1024), MaxEntrySize the body of each (1 MiB)
+	MaxEntries   int
+	MaxEntrySize int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // Of *cacheEntry, most recently used first
+
+	hits, misses atomic.Uint64
+}
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	key     string
+	vary    http.Header // The request headers named by Vary
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	age     time.Duration // Age of the response when stored
+	expires time.Time
+}
+
+// cacheKey identifies the responses for r
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.URL.String()
+}
+
+// Get returns a fresh response for r, or nil
+func (c *HTTPCache) Get(r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[cacheKey(r)]
+	if !ok {
+		c.misses.Add(1)
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, entry.key)
+		c.misses.Add(1)
+		return nil
+	}
+	for name, values := range entry.vary {
+		if !slices.Equal(r.Header.Values(name), values) {
+			c.misses.Add(1)
+			return nil
+		}
+	}
+	c.lru.MoveToFront(e)
+	c.hits.Add(1)
+
+	return entry
+}
+
+// Stats returns the number of hits and misses so far
+func (c *HTTPCache) Stats() (hits, misses uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// Len returns the number of stored responses
+func (c *HTTPCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// storable returns a writer collecting the body of resp to r for the
+// cache, or nil when the response must not be stored
+func (c *HTTPCache) storable(r *http.Request, resp *http.Response) *cacheWriter {
+	if !slices.Contains(cacheableStatuses, resp.StatusCode) {
+		return nil
+	}
+
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return nil
+	}
+	if _, ok := cc["private"]; ok {
+		return nil
+	}
+	if _, ok := cc["no-cache"]; ok {
+		// Stored, it would have to be revalidated on every use
+		return nil
+	}
+	_, public := cc["public"]
+	sMaxAge, shared := cc.seconds("s-maxage")
+	if r.Header.Get("Authorization") != "" && !public && !shared {
+		return nil
+	}
+
+	limit := c.MaxEntrySize
+	if limit <= 0 {
+		limit = defaultCacheEntrySize
+	}
+	if resp.ContentLength > int64(limit) {
+		return nil
+	}
+
+	var lifetime time.Duration
+	if shared {
+		lifetime = sMaxAge
+	} else if maxAge, ok := cc.seconds("max-age"); ok {
+		lifetime = maxAge
+	} else if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		lifetime = expires.Sub(date)
+	}
+	var age time.Duration
+	if secs, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		age = time.Duration(secs) * time.Second
+	}
+	if lifetime <= age {
+		return nil
+	}
+
+	vary := make(http.Header)
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary[http.CanonicalHeaderKey(name)] = r.Header.Values(name)
+			}
+		}
+	}
+
+	now := time.Now()
+	header := resp.Header.Clone()
+	header.Del("X-Cache")
+
+	return &cacheWriter{cache: c, limit: limit, entry: &cacheEntry{
+		key:     cacheKey(r),
+		vary:    vary,
+		status:  resp.StatusCode,
+		header:  header,
+		stored:  now,
+		age:     age,
+		expires: now.Add(lifetime - age),
+	}}
+}
+
+// put stores entry, evicting the least recently used ones over the
+// limit
+func (c *HTTPCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if e, ok := c.entries[entry.key]; ok {
+		c.lru.Remove(e)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	limit := c.MaxEntries
+	if limit <= 0 {
+		limit = defaultCacheEntries
+	}
+	for c.lru.Len() > limit {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// write sends the stored response to w
+func (e *cacheEntry) write(w http.ResponseWriter) {
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	age := e.age + time.Since(e.stored)
+	w.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(e.status)
+	_, _ = w.Write(e.body)
+}
+
+// cacheWriter collects a response body on its way to the client and
+// stores it once complete, unless it grew past the limit
+type cacheWriter struct {
+	cache *HTTPCache
+	limit int
+	entry *cacheEntry
+	buf   bytes.Buffer
+	over  bool
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if !w.over && w.buf.Len()+len(p) <= w.limit {
+		w.buf.Write(p)
+	} else {
+		w.over = true
+		w.buf.Reset()
+	}
+
+	// Never fail the copy to the client
+	return len(p), nil
+}
+
+// commit stores the response once its body was read in full
+func (w *cacheWriter) commit() {
+	if w.over {
+		return
+	}
+	w.entry.body = bytes.Clone(w.buf.Bytes())
+	w.cache.put(w.entry)
+}
+
+// forwardProxyClient returns an http.Client going through the proxy at
+// addr
+func forwardProxyClient(addr string) *http.Client {
+	proxyURL := &url.URL{Scheme: "http", Host: addr}
+
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+}
+
+func TestForwardProxy(t *testing.T) {
+	var calls atomic.Int32
+	origin := testListener(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/static", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprintf(w, "static via=%s conn=%s", r.Header.Get("Via"), r.Header.Get("X-Hop"))
+	})
+	mux.HandleFunc("/private", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		_, _ = io.WriteString(w, "private")
+	})
+	mux.HandleFunc("/lang", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = io.WriteString(w, "lang "+r.Header.Get("Accept-Language"))
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/static", http.StatusFound)
+	})
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(origin) }()
+	defer srv.Close()
+
+	cache := new(HTTPCache)
+	p := &ForwardProxy{
+		Allow:    func(target string) bool { return target == origin.Addr().String() },
+		Cache:    cache,
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	l := testListener(t)
+	proxySrv := NewHTTPServer("", p)
+	go func() { _ = proxySrv.Serve(l) }()
+	defer proxySrv.Close()
+
+	client := forwardProxyClient(l.Addr().String())
+	base := "http://" + origin.Addr().String()
+	get := func(path string, header http.Header) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	// Fetched once, then served from the cache; the hop-by-hop header
+	// named by Connection never reaches the origin
+	hop := http.Header{"Connection": {"X-Hop"}, "X-Hop": {"secret"}}
+	resp, body := get("/static", hop)
+	if body != "static via=1.1 golearn conn=" || resp.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("unexpected first response %q, X-Cache %q", body, resp.Header.Get("X-Cache"))
+	}
+	resp, body = get("/static", hop)
+	if body != "static via=1.1 golearn conn=" || resp.Header.Get("X-Cache") != "HIT" || resp.Header.Get("Age") == "" {
+		t.Errorf("unexpected cached response %q, headers %v", body, resp.Header)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 origin call; actual: %d", calls.Load())
+	}
+
+	// The client can insist on a fresh copy
+	get("/static", http.Header{"Cache-Control": {"no-cache"}})
+	if calls.Load() != 2 {
+		t.Errorf("expected no-cache to reach the origin; actual: %d calls", calls.Load())
+	}
+
+	// Private responses aren't kept
+	get("/private", nil)
+	get("/private", nil)
+	if calls.Load() != 4 {
+		t.Errorf("expected private responses to be fetched each time; actual: %d calls", calls.Load())
+	}
+
+	// Vary: one language cached, another one fetched
+	get("/lang", http.Header{"Accept-Language": {"fi"}})
+	_, body = get("/lang", http.Header{"Accept-Language": {"fi"}})
+	if body != "lang fi" || calls.Load() != 5 {
+		t.Errorf("expected a cached finnish response; actual: %q after %d calls", body, calls.Load())
+	}
+	if _, body = get("/lang", http.Header{"Accept-Language": {"en"}}); body != "lang en" || calls.Load() != 6 {
+		t.Errorf("expected an english response from the origin; actual: %q after %d calls", body, calls.Load())
+	}
+
+	// Redirects go back to the client, which follows them itself
+	if resp, _ = get("/moved", nil); resp.Request.URL.Path != "/static" {
+		t.Errorf("expected the client to follow the redirect; ended at %s", resp.Request.URL)
+	}
+
+	if hits, _ := cache.Stats(); hits != 3 {
+		t.Errorf("expected 3 cache hits; actual: %d", hits)
+	}
+}
+
+func TestForwardProxyRejects(t *testing.T) {
+	p := &ForwardProxy{
+		Allow:       func(target string) bool { return target == "allowed.example.com:80" },
+		Credentials: "user:pass",
+		ErrorLog:    log.New(io.Discard, "", 0),
+	}
+	l := testListener(t)
+	srv := NewHTTPServer("", p)
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	send := func(raw string) int {
+		t.Helper()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, raw)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")) + "\r\n"
+	for _, c := range []struct {
+		raw    string
+		status int
+	}{
+		{"GET /index.html HTTP/1.0\r\nHost: allowed.example.com\r\n" + auth + "\r\n", http.StatusBadRequest},
+		{"CONNECT allowed.example.com:443 HTTP/1.1\r\nHost: allowed.example.com:443\r\n" + auth + "\r\n", http.StatusMethodNotAllowed},
+		{"GET http://allowed.example.com/ HTTP/1.0\r\n\r\n", http.StatusProxyAuthRequired},
+		{"GET http://denied.example.com/ HTTP/1.0\r\n" + auth + "\r\n", http.StatusForbidden},
+	} {
+		if status := send(c.raw); status != c.status {
+			t.Errorf("%q: expected %d; actual: %d", strings.SplitN(c.raw, "\r\n", 2)[0], c.status, status)
+		}
+	}
+}
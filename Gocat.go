@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gocat, a netcat for this package
+//
+// netcat connects stdin and stdout to a socket, which makes it the
+// universal client and server for poking at a protocol by hand. gocat
+// does the same with the pieces built here:
+//
+//	golearn gocat host port               dial TCP
+//	golearn gocat -l [host] port          accept one TCP connection
+//	golearn gocat -u ...                  UDP instead
+//	golearn gocat -U path                 a Unix socket (ListenUnix/DialUnix)
+//	golearn gocat -tls ...                wrap the connection in TLS
+//	golearn gocat -proxy socks5://h:1080  dial through a SOCKS5 or HTTP proxy
+//	golearn gocat -hex ...                hex dump the traffic to stderr
+//	golearn gocat -watch :9090 ...        stream the traffic to "golearn
+//	                                      watch" (see MonitorStream.go)
+//
+// Both directions are copied at once. When stdin ends, the write half is
+// closed (CloseWrite), so the peer sees EOF while its answer can still
+// arrive; gocat exits when the peer closes its side. UDP has no EOF:
+// gocat runs until interrupted.
+//
+// A TLS listener uses a throwaway certificate from its own CA, so
+// dialers need -k to skip verification, like curl -k. The hex dump comes
+// from the Monitor, applied above TLS: it shows the plaintext.
+//
+// UDP listening learns the peer from the first datagram and only talks
+// to it from then on.
+
+// gocatOptions is what the command line asks for
+type gocatOptions struct {
+	Network  string // "tcp", "udp" or "unix"
+	Addr     string // host:port, or a path for unix
+	Listen   bool
+	TLS      bool
+	Insecure bool   // Skip certificate verification when dialing TLS
+	Proxy    string // socks5://, socks5h:// or http:// proxy URL
+	HexLog   io.Writer
+
+	// Monitor, when set, records the traffic, e.g. for its subscribers
+	Monitor *Monitor
+
+	// Ready, when set, is called with the listening address
+	Ready func(net.Addr)
+}
+
+func gocatMain(args []string) error {
+	fs := flag.NewFlagSet("gocat", flag.ContinueOnError)
+	listen := fs.Bool("l", false, "listen for a connection instead of dialing")
+	udp := fs.Bool("u", false, "use UDP instead of TCP")
+	unix := fs.Bool("U", false, "use a Unix socket at the given path")
+	useTLS := fs.Bool("tls", false, "wrap the connection in TLS")
+	insecure := fs.Bool("k", false, "skip TLS certificate verification")
+	proxy := fs.String("proxy", "", "dial through a socks5:// or http:// proxy `URL`")
+	hexDump := fs.Bool("hex", false, "hex dump the traffic to stderr")
+	watch := fs.String("watch", "", "stream the traffic over a WebSocket on `address`")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts := gocatOptions{
+		Network:  "tcp",
+		Listen:   *listen,
+		TLS:      *useTLS,
+		Insecure: *insecure,
+		Proxy:    *proxy,
+	}
+	if *hexDump {
+		opts.HexLog = os.Stderr
+	}
+
+	switch {
+	case *unix && fs.NArg() == 1:
+		opts.Network, opts.Addr = "unix", fs.Arg(0)
+	case *listen && fs.NArg() == 1:
+		opts.Addr = net.JoinHostPort("", fs.Arg(0))
+	case fs.NArg() == 2:
+		opts.Addr = net.JoinHostPort(fs.Arg(0), fs.Arg(1))
+	default:
+		return errors.New("usage: gocat [flags] host port | gocat -l [host] port | gocat -U path")
+	}
+	if *udp {
+		if *unix {
+			return errors.New("gocat: -u and -U are exclusive")
+		}
+		opts.Network = "udp"
+	}
+	if opts.Listen {
+		opts.Ready = func(addr net.Addr) {
+			fmt.Fprintf(os.Stderr, "listening on %s %s\n", addr.Network(), addr)
+		}
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if *watch != "" {
+		opts.Monitor = new(Monitor)
+		l, err := net.Listen("tcp", *watch)
+		if err != nil {
+			return err
+		}
+		srv := NewHTTPServer(*watch, opts.Monitor.StreamHandler())
+		go func() { _ = srv.Serve(l) }()
+		defer srv.Close()
+		fmt.Fprintf(os.Stderr, "traffic at ws://%s/\n", l.Addr())
+	}
+
+	err := gocat(ctx, opts, os.Stdin, os.Stdout)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+
+	return err
+}
+
+// gocat connects as opts say and pipes stdin and stdout through
+func gocat(ctx context.Context, opts gocatOptions, stdin io.Reader, stdout io.Writer) error {
+	if opts.Proxy != "" && (opts.Listen || opts.Network != "tcp") {
+		return errors.New("gocat: a proxy only dials TCP")
+	}
+	if opts.TLS && opts.Network == "udp" {
+		return errors.New("gocat: TLS needs a stream, not UDP")
+	}
+
+	var conn net.Conn
+	var err error
+	if opts.Listen {
+		conn, err = gocatAccept(ctx, opts)
+	} else {
+		conn, err = gocatDial(ctx, opts)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	// CloseWrite belongs to the connection itself, not the wrappers
+	raw := conn
+	monitor := opts.Monitor
+	if opts.HexLog != nil {
+		if monitor == nil {
+			monitor = new(Monitor)
+		}
+		monitor.Logger, monitor.Hex = log.New(opts.HexLog, "", 0), true
+	}
+	if monitor != nil {
+		conn = NewMonitoredConn(conn, monitor)
+	}
+
+	return gocatPipe(ctx, conn, raw, stdin, stdout)
+}
+
+// gocatDial connects to opts.Addr, through the proxy if there is one
+func gocatDial(ctx context.Context, opts gocatOptions) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case opts.Proxy != "":
+		conn, err = DialProxy(ctx, opts.Proxy, opts.Addr)
+	case opts.Network == "unix":
+		conn, err = DialUnix(ctx, opts.Addr)
+	default:
+		conn, err = new(net.Dialer).DialContext(ctx, opts.Network, opts.Addr)
+	}
+	if err != nil || !opts.TLS {
+		return conn, err
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: opts.Insecure}
+	if host, _, err := net.SplitHostPort(opts.Addr); err == nil {
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if _, err := TLSHandshake(ctx, tlsConn, 0); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// gocatAccept waits for a single peer on opts.Addr
+func gocatAccept(ctx context.Context, opts gocatOptions) (net.Conn, error) {
+	if opts.Network == "udp" {
+		return gocatAcceptPacket(ctx, opts)
+	}
+
+	var l net.Listener
+	var err error
+	if opts.Network == "unix" {
+		l, err = ListenUnix(opts.Addr, 0o600)
+	} else {
+		l, err = new(net.ListenConfig).Listen(ctx, "tcp", opts.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Like nc, stop listening after the first connection
+	defer func() { _ = l.Close() }()
+
+	if opts.TLS {
+		host, _, _ := net.SplitHostPort(l.Addr().String())
+		ca, err := NewTLSCA("gocat")
+		if err != nil {
+			return nil, err
+		}
+		cert, err := ca.Issue(TLSLeaf{Name: "gocat", Hosts: []string{"localhost", host}})
+		if err != nil {
+			return nil, err
+		}
+		l = tls.NewListener(l, ServerConfig(cert, nil))
+	}
+
+	if opts.Ready != nil {
+		opts.Ready(l.Addr())
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = l.Close() })
+	defer stop()
+
+	conn, err := l.Accept()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if _, err := TLSHandshake(ctx, tlsConn, 0); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// gocatAcceptPacket waits for the first datagram and returns a
+// connection to its sender
+func gocatAcceptPacket(ctx context.Context, opts gocatOptions) (net.Conn, error) {
+	pc, err := new(net.ListenConfig).ListenPacket(ctx, "udp", opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Ready != nil {
+		opts.Ready(pc.LocalAddr())
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = pc.Close() })
+	defer stop()
+
+	buf := make([]byte, maxDatagramSize)
+	n, peer, err := pc.ReadFrom(buf)
+	if err != nil {
+		_ = pc.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	return &gocatPacketConn{PacketConn: pc, peer: peer, pending: buf[:n]}, nil
+}
+
+// gocatPacketConn is a listening UDP socket talking to a single peer
+type gocatPacketConn struct {
+	net.PacketConn
+	peer    net.Addr
+	pending []byte // The first datagram, not yet read
+}
+
+func (c *gocatPacketConn) Read(p []byte) (int, error) {
+	if c.pending != nil {
+		n := copy(p, c.pending)
+		c.pending = nil
+		return n, nil
+	}
+
+	for {
+		n, addr, err := c.ReadFrom(p)
+		if err != nil || addr.String() == c.peer.String() {
+			return n, err
+		}
+	}
+}
+
+func (c *gocatPacketConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.peer)
+}
+
+func (c *gocatPacketConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+// gocatPipe copies conn to stdout and stdin to conn until the peer is
+// done or ctx is canceled. raw is conn without wrappers, for CloseWrite.
+func gocatPipe(ctx context.Context, conn, raw net.Conn, stdin io.Reader, stdout io.Writer) error {
+	received := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdout, conn)
+		received <- err
+	}()
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, stdin)
+		if err == nil {
+			if cw, ok := raw.(interface{ CloseWrite() error }); ok {
+				err = cw.CloseWrite()
+			}
+		}
+		sent <- err
+	}()
+
+	done := ctx.Done()
+	for {
+		select {
+		case err := <-received:
+			if errors.Is(err, net.ErrClosed) && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		case err := <-sent:
+			if err != nil {
+				_ = conn.Close()
+				return err
+			}
+			// Keep reading the peer's answer
+			sent = nil
+		case <-done:
+			_ = conn.Close()
+			sent, done = nil, nil
+		}
+	}
+}
+
+// gocatExchange runs a gocat listener and a gocat dialer against each
+// other: the dialer sends "ping", the listener answers "pong" and
+// closes, and the dialer's output is returned
+func gocatExchange(t *testing.T, listen gocatOptions, dial func(addr net.Addr) gocatOptions) string {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ready := make(chan net.Addr, 1)
+	listen.Listen = true
+	listen.Ready = func(addr net.Addr) { ready <- addr }
+
+	listenIn, listenInW := io.Pipe()
+	listenOut, listenOutW := io.Pipe()
+	listened := make(chan error, 1)
+	go func() {
+		err := gocat(ctx, listen, listenIn, listenOutW)
+		_ = listenOutW.Close()
+		listened <- err
+	}()
+
+	var addr net.Addr
+	select {
+	case addr = <-ready:
+	case err := <-listened:
+		t.Fatalf("listen: %v", err)
+	}
+
+	// The dialer's stdin stays open, as a terminal's would
+	dialIn, dialInW := io.Pipe()
+	defer dialInW.Close()
+	out := new(bytes.Buffer)
+	dialed := make(chan error, 1)
+	go func() {
+		dialed <- gocat(ctx, dial(addr), io.MultiReader(strings.NewReader("ping"), dialIn), out)
+	}()
+
+	if b, err := ReadExactly(listenOut, 4); err != nil || string(b) != "ping" {
+		t.Fatalf("listener received %q, %v", b, err)
+	}
+	go func() { _, _ = io.Copy(io.Discard, listenOut) }()
+	_, _ = listenInW.Write([]byte("pong"))
+	_ = listenInW.Close()
+
+	if err := <-dialed; err != nil {
+		t.Errorf("dial: %v", err)
+	}
+	if err := <-listened; err != nil {
+		t.Errorf("listen: %v", err)
+	}
+
+	return out.String()
+}
+
+func TestGocat(t *testing.T) {
+	tcp := gocatOptions{Network: "tcp", Addr: "127.0.0.1:"}
+	dialer := func(opts gocatOptions) func(net.Addr) gocatOptions {
+		return func(addr net.Addr) gocatOptions {
+			opts.Addr = addr.String()
+			return opts
+		}
+	}
+
+	socks := startSOCKS5Proxy(t, "", "")
+	connect := startConnectProxy(t, &ConnectProxy{Allow: func(string) bool { return true }})
+	path := filepath.Join(t.TempDir(), "gocat.sock")
+
+	for name, tc := range map[string]struct {
+		listen gocatOptions
+		dial   gocatOptions
+	}{
+		"tcp":    {tcp, gocatOptions{Network: "tcp"}},
+		"unix":   {gocatOptions{Network: "unix", Addr: path}, gocatOptions{Network: "unix"}},
+		"tls":    {gocatOptions{Network: "tcp", Addr: "127.0.0.1:", TLS: true}, gocatOptions{Network: "tcp", TLS: true, Insecure: true}},
+		"socks5": {tcp, gocatOptions{Network: "tcp", Proxy: "socks5://" + socks}},
+		"http":   {tcp, gocatOptions{Network: "tcp", Proxy: "http://" + connect}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if out := gocatExchange(t, tc.listen, dialer(tc.dial)); out != "pong" {
+				t.Errorf("expected pong; actual: %q", out)
+			}
+		})
+	}
+
+	// The hex dump shows the plaintext, even over TLS
+	hexLog := new(bytes.Buffer)
+	out := gocatExchange(t, gocatOptions{Network: "tcp", Addr: "127.0.0.1:", TLS: true}, dialer(gocatOptions{
+		Network: "tcp", TLS: true, Insecure: true, HexLog: hexLog,
+	}))
+	if out != "pong" {
+		t.Errorf("expected pong; actual: %q", out)
+	}
+	for _, expected := range []string{
+		"out 4 bytes\n00000000  70 69 6e 67",
+		"in 4 bytes\n00000000  70 6f 6e 67",
+	} {
+		if !strings.Contains(hexLog.String(), expected) {
+			t.Errorf("expected %q in hex log:\n%s", expected, hexLog)
+		}
+	}
+
+	// Verification fails against the throwaway certificate without -k
+	if err := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ready := make(chan net.Addr, 1)
+		go func() {
+			_ = gocat(ctx, gocatOptions{Network: "tcp", Addr: "127.0.0.1:", TLS: true, Listen: true,
+				Ready: func(addr net.Addr) { ready <- addr }}, strings.NewReader(""), io.Discard)
+		}()
+		return gocat(ctx, gocatOptions{Network: "tcp", Addr: (<-ready).String(), TLS: true},
+			strings.NewReader(""), io.Discard)
+	}(); err == nil {
+		t.Error("expected a certificate verification error")
+	}
+}
+
+func TestGocatUDP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ready := make(chan net.Addr, 1)
+	listenOut, listenOutW := io.Pipe()
+	go func() {
+		_ = gocat(ctx, gocatOptions{Network: "udp", Addr: "127.0.0.1:", Listen: true,
+			Ready: func(addr net.Addr) { ready <- addr }}, strings.NewReader("pong"), listenOutW)
+		_ = listenOutW.Close()
+	}()
+
+	// The dialer runs until canceled, since UDP has no EOF
+	dialCtx, dialCancel := context.WithCancel(ctx)
+	dialOut, dialOutW := io.Pipe()
+	dialed := make(chan error, 1)
+	go func() {
+		dialed <- gocat(dialCtx, gocatOptions{Network: "udp", Addr: (<-ready).String()},
+			strings.NewReader("ping"), dialOutW)
+	}()
+
+	if b, err := ReadExactly(listenOut, 4); err != nil || string(b) != "ping" {
+		t.Fatalf("listener received %q, %v", b, err)
+	}
+	if b, err := ReadExactly(dialOut, 4); err != nil || string(b) != "pong" {
+		t.Fatalf("dialer received %q, %v", b, err)
+	}
+
+	dialCancel()
+	if err := <-dialed; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled; actual: %v", err)
+	}
+}
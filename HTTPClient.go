@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Resilient HTTP client
+//
+// http.Client sends a request once. Over a flaky network that's not
+// enough, but blindly retrying is worse: resending a POST may charge a
+// credit card twice. HTTPClient layers RetryPolicy over http.Client and
+// only retries what is safe:
+//
+//   - idempotent methods (GET, HEAD, OPTIONS, TRACE, PUT, DELETE) and
+//     requests carrying an Idempotency-Key header, on transient network
+//     errors, timeouts and 429/502/503/504 responses
+//   - any method when the connection was refused, since nothing was
+//     sent at all
+//   - only requests whose body can be replayed (http.NewRequest sets
+//     GetBody for bytes, strings and bytes.Buffer readers)
+//
+// A Retry-After header (seconds or an HTTP date) stretches the backoff,
+// up to MaxRetryAfter. When the attempts run out on a bad status, the
+// last response is returned as is, so callers see the 503 and its body.
+//
+// AttemptTimeout bounds every attempt, reading the response body
+// included, while the request's context bounds the whole exchange.
+//
+// Trace receives an HTTPAttempt after every attempt, with the timings
+// httptrace reports (DNS, connect, TLS, time to first byte) and whether
+// a kept-alive connection was reused. NewHTTPTransport tunes the pool so
+// reuse actually happens: the default keeps only 2 idle connections per
+// host.
+
+const (
+	defaultMaxRetryAfter = 30 * time.Second
+	httpDrainLimit       = 4 << 10 // Bytes read from a discarded body to reuse its connection
+)
+
+// httpRetryStatuses are responses meaning "try again later"
+var httpRetryStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// HTTPStatusError is the error of an attempt failing with a retryable
+// status
+type HTTPStatusError struct {
+	Status int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("http status %d %s", e.Status, http.StatusText(e.Status))
+}
+
+// HTTPAttempt describes one try of a request
+type HTTPAttempt struct {
+	Attempt  int // 1 based
+	Method   string
+	URL      string
+	Status   int // 0 when no response arrived
+	Err      error
+	Reused   bool // Went over a kept-alive connection
+	DNS      time.Duration
+	Connect  time.Duration
+	TLS      time.Duration
+	TTFB     time.Duration // Until the first response byte
+	Duration time.Duration
+}
+
+// HTTPClient sends requests with retries
+type HTTPClient struct {
+	// Client does the actual work; defaults to one using
+	// NewHTTPTransport
+	Client *http.Client
+
+	// Retry is the retry policy; its Retryable is replaced by the
+	// request-aware rules above
+	Retry RetryPolicy
+
+	// AttemptTimeout bounds each attempt, zero means no limit
+	AttemptTimeout time.Duration
+
+	// MaxRetryAfter caps how long a Retry-After header can make us
+	// wait (defaults to 30s)
+	MaxRetryAfter time.Duration
+
+	// Trace, when set, is called after every attempt
+	Trace func(HTTPAttempt)
+
+	once   sync.Once
+	client *http.Client
+}
+
+// NewHTTPTransport returns a transport with connection pooling tuned for
+// a client talking to a handful of hosts
+func NewHTTPTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           DefaultConnBudget.Dialer(dialer.DialContext),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+func (c *HTTPClient) httpClient() *http.Client {
+	c.once.Do(func() {
+		c.client = c.Client
+		if c.client == nil {
+			c.client = &http.Client{Transport: NewHTTPTransport()}
+		}
+	})
+
+	return c.client
+}
+
+// Get fetches url
+func (c *HTTPClient) Get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Do(req)
+}
+
+// Do sends req, retrying as described above. Like http.Client.Do, the
+// caller must close the response body.
+func (c *HTTPClient) Do(req *http.Request) (*http.Response, error) {
+	policy := c.Retry
+	policy.Retryable = c.retryable(req)
+
+	var last *http.Response
+	attempt := 0
+
+	err := policy.Do(req.Context(), func(ctx context.Context) error {
+		attempt++
+		if last != nil {
+			discard(last)
+			last = nil
+		}
+
+		resp, err := c.attempt(ctx, req, attempt)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(httpRetryStatuses, resp.StatusCode) {
+			last = resp
+			return nil
+		}
+
+		// Keep it, in case this was the last attempt
+		last = resp
+		var statusErr error = &HTTPStatusError{Status: resp.StatusCode}
+		if after, ok := c.retryAfter(resp); ok {
+			statusErr = RetryAfter(statusErr, after)
+		}
+		return statusErr
+	})
+
+	var statusErr *HTTPStatusError
+	if err == nil || (errors.As(err, &statusErr) && last != nil) {
+		return last, nil
+	}
+	if last != nil {
+		discard(last)
+	}
+
+	return nil, err
+}
+
+// attempt sends one copy of req
+func (c *HTTPClient) attempt(ctx context.Context, req *http.Request, n int) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if c.AttemptTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.AttemptTimeout)
+	}
+
+	info := HTTPAttempt{Attempt: n, Method: req.Method, URL: req.URL.String()}
+	var dnsStart, connectStart, tlsStart time.Time
+	begin := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotConn:              func(ci httptrace.GotConnInfo) { info.Reused = ci.Reused },
+		DNSStart:             func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { info.DNS = time.Since(dnsStart) },
+		ConnectStart:         func(_, _ string) { connectStart = time.Now() },
+		ConnectDone:          func(_, _ string, _ error) { info.Connect = time.Since(connectStart) },
+		TLSHandshakeStart:    func() { tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { info.TLS = time.Since(tlsStart) },
+		GotFirstResponseByte: func() { info.TTFB = time.Since(begin) },
+	}
+
+	r := req.Clone(httptrace.WithClientTrace(ctx, trace))
+	if n > 1 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, Permanent(err)
+		}
+		r.Body = body
+	}
+
+	resp, err := c.httpClient().Do(r)
+	info.Duration = time.Since(begin)
+	info.Err = err
+	if resp != nil {
+		info.Status = resp.StatusCode
+	}
+	if c.Trace != nil {
+		c.Trace(info)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The attempt's deadline covers the body too; release it on Close
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// retryable returns the RetryPolicy.Retryable for req
+func (c *HTTPClient) retryable(req *http.Request) func(error) bool {
+	idempotent := req.Header.Get("Idempotency-Key") != "" ||
+		slices.Contains([]string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}, req.Method)
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	return func(err error) bool {
+		if !replayable {
+			return false
+		}
+		if IsRefused(err) {
+			// Never reached the server
+			return true
+		}
+		if !idempotent {
+			return false
+		}
+
+		var statusErr *HTTPStatusError
+		return errors.As(err, &statusErr) ||
+			IsTransient(err) ||
+			errors.Is(err, io.ErrUnexpectedEOF)
+	}
+}
+
+// retryAfter parses the Retry-After header of resp
+func (c *HTTPClient) retryAfter(resp *http.Response) (time.Duration, bool) {
+	limit := c.MaxRetryAfter
+	if limit <= 0 {
+		limit = defaultMaxRetryAfter
+	}
+
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+
+	var d time.Duration
+	if secs, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		d = time.Until(at)
+	} else {
+		return 0, false
+	}
+
+	return min(max(d, 0), limit), true
+}
+
+// discard drains a little of an unwanted body, so the connection can
+// go back to the pool, and closes it
+func discard(resp *http.Response) {
+	_, _ = io.CopyN(io.Discard, resp.Body, httpDrainLimit)
+	_ = resp.Body.Close()
+}
+
+// cancelBody releases the attempt's context when the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+// flakyHTTPServer fails the first `failures` requests with status and
+// then answers "ok", recording the request bodies it saw
+func flakyHTTPServer(t *testing.T, failures int32, status int, header http.Header) (string, *atomic.Int32, *[]string) {
+	t.Helper()
+
+	var calls atomic.Int32
+	var mu sync.Mutex
+	var bodies []string
+
+	l := testListener(t)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+
+		if calls.Add(1) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			_, _ = io.WriteString(w, "try later")
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	})}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return "http://" + l.Addr().String(), &calls, &bodies
+}
+
+func TestHTTPClientRetry(t *testing.T) {
+	url, calls, _ := flakyHTTPServer(t, 2, http.StatusServiceUnavailable, http.Header{"Retry-After": {"1"}})
+
+	var attempts []HTTPAttempt
+	c := &HTTPClient{
+		Retry:         RetryPolicy{Attempts: 3, Initial: time.Millisecond},
+		MaxRetryAfter: 30 * time.Millisecond, // Don't really wait a second
+		Trace:         func(a HTTPAttempt) { attempts = append(attempts, a) },
+	}
+
+	begin := time.Now()
+	resp, err := c.Get(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(b) != "ok" || calls.Load() != 3 {
+		t.Errorf("unexpected result: %d %q after %d calls", resp.StatusCode, b, calls.Load())
+	}
+	if elapsed := time.Since(begin); elapsed < 60*time.Millisecond {
+		t.Errorf("expected Retry-After to be honored (capped); took %s", elapsed)
+	}
+
+	// The failed responses were drained, so the connection was reused
+	if len(attempts) != 3 || attempts[0].Status != 503 || !attempts[2].Reused {
+		t.Errorf("unexpected attempts: %+v", attempts)
+	}
+}
+
+func TestHTTPClientGivesUp(t *testing.T) {
+	url, calls, _ := flakyHTTPServer(t, 100, http.StatusBadGateway, nil)
+
+	c := &HTTPClient{Retry: RetryPolicy{Attempts: 2, Initial: time.Millisecond}}
+	resp, err := c.Get(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The last response is handed back, body intact
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadGateway || string(b) != "try later" || calls.Load() != 2 {
+		t.Errorf("unexpected result: %d %q after %d calls", resp.StatusCode, b, calls.Load())
+	}
+}
+
+func TestHTTPClientIdempotency(t *testing.T) {
+	c := &HTTPClient{Retry: RetryPolicy{Attempts: 3, Initial: time.Millisecond}}
+
+	// POST isn't retried...
+	url, calls, _ := flakyHTTPServer(t, 1, http.StatusServiceUnavailable, nil)
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("charge $10"))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("POST: expected a single 503; actual: %d after %d calls", resp.StatusCode, calls.Load())
+	}
+
+	// ...unless it carries an idempotency key; PUT is retried anyway.
+	// Either way the body is sent again in full.
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		url, calls, bodies := flakyHTTPServer(t, 1, http.StatusServiceUnavailable, nil)
+		req, _ := http.NewRequest(method, url, strings.NewReader("charge $10"))
+		if method == http.MethodPost {
+			req.Header.Set("Idempotency-Key", "order-42")
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || calls.Load() != 2 {
+			t.Errorf("%s: expected success on retry; actual: %d after %d calls", method, resp.StatusCode, calls.Load())
+		}
+		if !slices.Equal(*bodies, []string{"charge $10", "charge $10"}) {
+			t.Errorf("%s: unexpected bodies %q", method, *bodies)
+		}
+	}
+}
+
+func TestHTTPClientAttemptTimeout(t *testing.T) {
+	var calls atomic.Int32
+	l := testListener(t)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// The first attempt hangs until the client gives up
+			<-r.Context().Done()
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	})}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	var attempts []HTTPAttempt
+	c := &HTTPClient{
+		Retry:          RetryPolicy{Attempts: 2, Initial: time.Millisecond},
+		AttemptTimeout: 50 * time.Millisecond,
+		Trace:          func(a HTTPAttempt) { attempts = append(attempts, a) },
+	}
+
+	resp, err := c.Get(context.Background(), "http://"+l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if b, _ := io.ReadAll(resp.Body); string(b) != "ok" {
+		t.Errorf("unexpected body %q", b)
+	}
+	if len(attempts) != 2 || !IsTimeout(attempts[0].Err) {
+		t.Errorf("expected a timed out first attempt; actual: %+v", attempts)
+	}
+}
+
+func TestHTTPClientRefused(t *testing.T) {
+	// Grab a port nobody listens on
+	addr := testUnusedAddr(t)
+
+	// Even a POST is retried when the connection was refused
+	calls := 0
+	c := &HTTPClient{
+		Retry: RetryPolicy{Attempts: 3, Initial: time.Millisecond},
+		Trace: func(HTTPAttempt) { calls++ },
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr, strings.NewReader("x"))
+	if _, err := c.Do(req); !errors.Is(err, syscall.ECONNREFUSED) || calls != 3 {
+		t.Errorf("expected 3 refused attempts; actual: %d, %v", calls, err)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+// HTTP/1.1 servers done right
+//
+// HTTP is "just" text over the TCP connections of the previous chapters,
+// and net/http takes care of the parsing. What it doesn't take care of
+// are the defaults: a bare http.ListenAndServe has no timeouts at all,
+// so a client that sends half a request header (or reads the response
+// one byte per minute) holds a connection and a goroutine forever.
+//
+// NewHTTPServer sets each of them:
+//
+//   - ReadHeaderTimeout: the request line and headers must arrive
+//     quickly, the classic slowloris defense
+//   - ReadTimeout: the whole request, body included
+//   - WriteTimeout: from the end of the headers to the end of the
+//     response, so it must be longer than the slowest handler
+//   - IdleTimeout: how long a keep-alive connection waits for the next
+//     request
+//
+// Handlers should watch r.Context(): it's canceled when the client goes
+// away, or when a Timeout middleware's deadline passes, so abandoned
+// work stops instead of running to completion for nobody.
+//
+// Middleware is a func(http.Handler) http.Handler, stacked with Chain:
+//
+//	handler := Chain(mux, LogRequests(monitor), guard.HTTP, Timeout(5*time.Second))
+//
+// ServeHTTP runs a server until its context is canceled and then shuts
+// down gracefully: the listener closes right away, requests in flight
+// get up to httpShutdownGrace to finish. Wired to signalContext, that's
+// Ctrl+C without dropping anybody's request:
+//
+//	golearn http -addr :8080
+
+const (
+	httpReadHeaderTimeout = 5 * time.Second
+	httpReadTimeout       = 10 * time.Second
+	httpWriteTimeout      = 30 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
+	httpMaxHeaderBytes    = 64 << 10
+	httpShutdownGrace     = 10 * time.Second
+)
+
+// NewHTTPServer returns a server for h with sane timeouts
+func NewHTTPServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+		MaxHeaderBytes:    httpMaxHeaderBytes,
+	}
+}
+
+// ServeHTTP serves on l until ctx is done, then shuts srv down, giving
+// requests in flight httpShutdownGrace to complete
+func ServeHTTP(ctx context.Context, srv *http.Server, l net.Listener) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(l) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	// ctx is done already, Shutdown needs a fresh deadline
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownGrace)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Whoever is still there gets cut off
+		_ = srv.Close()
+	}
+	if serveErr := <-errc; !errors.Is(serveErr, http.ErrServerClosed) {
+		return serveErr
+	}
+
+	return err
+}
+
+// Middleware decorates an http.Handler
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h with mws, the first one outermost
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+
+	return h
+}
+
+// Timeout cancels the request context after d. Handlers must watch
+// r.Context() for it to have any effect.
+func Timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// statusRecorder remembers the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += n
+
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush, deadlines and
+// Hijack of the real ResponseWriter
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// LogRequests logs one line per request to m and accounts the response
+// bytes as outbound traffic:
+//
+//	monitor: 127.0.0.1:5555 GET /hello 200 12B 153µs
+func LogRequests(m *Monitor) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &statusRecorder{ResponseWriter: w}
+			begin := time.Now()
+
+			next.ServeHTTP(rec, r)
+
+			elapsed := time.Since(begin)
+			if rec.status == 0 {
+				// Handler wrote nothing, net/http sends a 200
+				rec.status = http.StatusOK
+			}
+
+			m.stats.add(Outbound, rec.bytes, time.Now())
+			count(m.Counter, Outbound, rec.bytes)
+
+			if m.Structured != nil {
+				m.Structured.LogAttrs(r.Context(), slog.LevelInfo, "http",
+					slog.String("remote", r.RemoteAddr),
+					slog.String("method", r.Method),
+					slog.String("path", r.URL.Path),
+					slog.Int("status", rec.status),
+					slog.Int("size", rec.bytes),
+					slog.Duration("duration", elapsed),
+				)
+				return
+			}
+
+			if m.Logger != nil {
+				m.Printf("%s %s %s %d %dB %s", r.RemoteAddr, r.Method, r.URL.Path,
+					rec.status, rec.bytes, elapsed.Round(time.Microsecond))
+			}
+		})
+	}
+}
+
+// HTTP is middleware recovering panics in handlers. net/http recovers
+// them too, but only by dropping the connection; this answers with a
+// 500 when nothing was written yet, and counts the panic.
+func (g *PanicGuard) HTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate abort, let net/http handle it silently
+				panic(v)
+			}
+
+			g.panics.Add(1)
+			logger := g.Logger
+			if logger == nil {
+				logger = log.Default()
+			}
+			logger.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+
+			if rec.status == 0 {
+				http.Error(rec, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// slowHandler simulates work taking ?d= (default 1s), giving up when
+// the request context is done
+func slowHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := time.ParseDuration(r.URL.Query().Get("d"))
+	if err != nil {
+		d = time.Second
+	}
+
+	select {
+	case <-time.After(d):
+		fmt.Fprintf(w, "done after %s\n", d)
+	case <-r.Context().Done():
+		// The client is gone or the deadline passed; if anyone is still
+		// listening, tell them
+		http.Error(w, r.Context().Err().Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// httpMux is the demo application
+func httpMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello over %s\n", r.Proto)
+	})
+	mux.HandleFunc("GET /slow", slowHandler)
+	mux.Handle("GET /metrics", DefaultMetrics)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+
+	return mux
+}
+
+func httpMain(args []string) error {
+	fs := flag.NewFlagSet("http", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "`address` to listen on")
+	timeout := fs.Duration("timeout", 5*time.Second, "per-request handler deadline")
+	stats := fs.Duration("stats", 0, "log the expvar statistics every `interval` (0 disables)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	monitor := &Monitor{Logger: log.New(log.Writer(), "http: ", log.LstdFlags)}
+	guard := &PanicGuard{Logger: monitor.Logger}
+	srv := NewHTTPServer(*addr, Chain(httpMux(), LogRequests(monitor), guard.HTTP, Timeout(*timeout)))
+	srv.ErrorLog = monitor.Logger
+
+	DefaultMetrics.Publish("golearn")
+	if *stats > 0 {
+		go func() { _ = monitor.LogVars(ctx, *stats, "golearn") }()
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	monitor.Printf("listening on http://%s", l.Addr())
+
+	r := &Runner{Grace: httpShutdownGrace, ErrorLog: monitor.Logger}
+	return r.Run(ctx, HTTPService("http", srv, l))
+}
+
+func TestHTTPServer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	monitor := &Monitor{Logger: log.New(buf, "", 0)}
+	guard := &PanicGuard{Logger: log.New(io.Discard, "", 0)}
+
+	mux := httpMux()
+	mux.HandleFunc("GET /panic", func(http.ResponseWriter, *http.Request) { panic("boom") })
+
+	srv := NewHTTPServer("", Chain(mux, LogRequests(monitor), guard.HTTP, Timeout(100*time.Millisecond)))
+	l := testListener(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = ServeHTTP(ctx, srv, l) }()
+
+	base := "http://" + l.Addr().String()
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if status, body := get("/"); status != http.StatusOK || body != "hello over HTTP/1.1\n" {
+		t.Errorf("unexpected response %d %q", status, body)
+	}
+	if status, _ := get("/missing"); status != http.StatusNotFound {
+		t.Errorf("expected 404; actual: %d", status)
+	}
+
+	// The handler gives up at the Timeout middleware's deadline
+	if status, _ := get("/slow?d=10s"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected 503; actual: %d", status)
+	}
+
+	// A panic turns into a 500 and the server keeps going
+	if status, _ := get("/panic"); status != http.StatusInternalServerError {
+		t.Errorf("expected 500; actual: %d", status)
+	}
+	if guard.Panics() != 1 {
+		t.Errorf("expected 1 panic; actual: %d", guard.Panics())
+	}
+
+	out := buf.String()
+	for _, want := range []string{"GET / 200 20B", "GET /missing 404", "GET /slow 503", "GET /panic 500"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in log:\n%s", want, out)
+		}
+	}
+	if stats := monitor.Stats(); stats.MessagesOut != 4 {
+		t.Errorf("expected 4 responses counted; actual: %d", stats.MessagesOut)
+	}
+}
+
+func TestHTTPServerGracefulShutdown(t *testing.T) {
+	srv := NewHTTPServer("", httpMux())
+	l := testListener(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- ServeHTTP(ctx, srv, l) }()
+
+	// A request is in flight when the shutdown starts...
+	type result struct {
+		status int
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/slow?d=200ms")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		resp.Body.Close()
+		results <- result{status: resp.StatusCode}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	// ...and still completes
+	if r := <-results; r.err != nil || r.status != http.StatusOK {
+		t.Errorf("expected in-flight request to complete; actual: %d, %v", r.status, r.err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected clean shutdown; actual: %v", err)
+	}
+
+	// New connections are refused
+	if _, err := net.DialTimeout("tcp", l.Addr().String(), 100*time.Millisecond); err == nil {
+		t.Error("expected listener to be closed")
+	}
+}
+
+func TestHTTPServerSlowloris(t *testing.T) {
+	srv := NewHTTPServer("", httpMux())
+	srv.ReadHeaderTimeout = 100 * time.Millisecond
+	l := testListener(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = ServeHTTP(ctx, srv, l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Start a request and never finish the headers
+	_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	begin := time.Now()
+	// net/http may answer 408 before closing; either way the connection ends
+	_, err = bufio.NewReader(conn).ReadString(0)
+	if IsTimeout(err) {
+		t.Fatal("expected the server to drop the connection")
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("connection dropped after %s", elapsed)
+	}
+}
@@ -0,0 +1,821 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Strict HTTP/1.1 parsing
+//
+// An HTTP/1.1 message says where it ends in its header: a
+// Content-Length, or "Transfer-Encoding: chunked" and then chunks. When
+// a message says both, or says it twice differently, two parsers can
+// disagree on where it ends, and that's request smuggling: the proxy
+// forwards one request, the backend sees two, and the second one, which
+// the proxy never checked, gets the answer meant for the next client.
+//
+//	POST / HTTP/1.1
+//	Host: example.com
+//	Content-Length: 6
+//	Transfer-Encoding: chunked
+//
+//	0
+//
+//	G
+//
+// The fix is to refuse anything ambiguous rather than guess:
+//
+// - Content-Length together with Transfer-Encoding, Transfer-Encoding in
+//   HTTP/1.0, or a Transfer-Encoding other than just "chunked"
+// - Content-Lengths that differ, or aren't plain digits
+// - lines ending in a bare LF or holding a bare CR, folded lines,
+//   whitespace before the colon, control characters in values
+// - a missing or repeated Host in HTTP/1.1, versions other than 1.0 and
+//   1.1, chunk sizes with signs, spaces or more than 15 digits
+// - heads over HTTPLimits (16KB, 100 fields by default)
+//
+// ReadStrictRequest and ReadStrictResponse read one message from a
+// bufio.Reader like http.ReadRequest and http.ReadResponse do, and never
+// read past its end, so the next message can be read from the same
+// reader. StrictHTTPListener puts them in front of an http.Server: its
+// connections only pass on what was checked, and the server answers 400
+// to the rest, which is how serve runs plain HTTP reverse proxies.
+
+var (
+	// ErrHTTPMalformed is wrapped by the errors for invalid syntax
+	ErrHTTPMalformed = errors.New("malformed HTTP message")
+
+	// ErrHTTPHeaderTooLarge is wrapped by the errors for heads over the
+	// limits
+	ErrHTTPHeaderTooLarge = errLimit("HTTP header too large")
+
+	// ErrHTTPAmbiguousLength is wrapped by the errors for messages whose
+	// end can't be told for sure
+	ErrHTTPAmbiguousLength = errors.New("ambiguous HTTP message length")
+)
+
+const (
+	defaultHTTPMaxHeaderBytes = 16 << 10
+	defaultHTTPMaxHeaders     = 100
+)
+
+// HTTPLimits bounds the heads of messages, and the trailers of chunked
+// ones. The zero value is the defaults.
+type HTTPLimits struct {
+	MaxHeaderBytes int // Start line and fields, line ends included
+	MaxHeaders     int // Number of fields
+}
+
+func (l HTTPLimits) maxHeaderBytes() int {
+	if l.MaxHeaderBytes > 0 {
+		return l.MaxHeaderBytes
+	}
+	return defaultHTTPMaxHeaderBytes
+}
+
+func (l HTTPLimits) maxHeaders() int {
+	if l.MaxHeaders > 0 {
+		return l.MaxHeaders
+	}
+	return defaultHTTPMaxHeaders
+}
+
+// ReadStrictRequest reads a request from r, see above. io.EOF means r
+// ended cleanly before it.
+func ReadStrictRequest(r *bufio.Reader, limits HTTPLimits) (*http.Request, error) {
+	budget := limits.maxHeaderBytes()
+	line, err := readHTTPLine(r, &budget)
+	if err != nil {
+		return nil, err
+	}
+
+	req := new(http.Request)
+	method, rest, ok1 := strings.Cut(line, " ")
+	target, proto, ok2 := strings.Cut(rest, " ")
+	if !ok1 || !ok2 || !isHTTPToken(method) || target == "" || strings.ContainsFunc(target, isHTTPCtlOrSpace) {
+		return nil, fmt.Errorf("%w: invalid request line %q", ErrHTTPMalformed, line)
+	}
+	if proto != "HTTP/1.1" && proto != "HTTP/1.0" {
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrHTTPMalformed, proto)
+	}
+	req.Method, req.RequestURI, req.Proto = method, target, proto
+	req.ProtoMajor, req.ProtoMinor, _ = http.ParseHTTPVersion(proto)
+
+	if req.Header, err = readHTTPFields(r, &budget, limits); err != nil {
+		return nil, err
+	}
+	hosts := req.Header.Values("Host")
+	if len(hosts) > 1 || (len(hosts) == 0 && req.ProtoAtLeast(1, 1)) {
+		return nil, fmt.Errorf("%w: %d Host fields", ErrHTTPMalformed, len(hosts))
+	}
+	if method == http.MethodConnect && !strings.HasPrefix(target, "/") {
+		req.URL = &url.URL{Host: target}
+	} else if req.URL, err = url.ParseRequestURI(target); err != nil {
+		return nil, fmt.Errorf("%w: invalid target %q", ErrHTTPMalformed, target)
+	}
+	req.Host = req.URL.Host
+	if req.Host == "" && len(hosts) == 1 {
+		req.Host = hosts[0]
+	}
+	req.Header.Del("Host")
+
+	// Without a length, a request has no body
+	length, chunked, err := httpMessageLength(req.Header, req.ProtoMinor == 0)
+	switch {
+	case err != nil:
+		return nil, err
+	case chunked:
+		req.Header.Del("Transfer-Encoding")
+		req.TransferEncoding = []string{"chunked"}
+		req.ContentLength = -1
+		req.Body = &chunkedBody{r: r, limits: limits}
+	case length > 0:
+		req.ContentLength = length
+		req.Body = &lengthBody{r: r, n: length}
+	default:
+		req.Body = http.NoBody
+	}
+	req.Close = httpShouldClose(req.ProtoMinor, req.Header)
+
+	return req, nil
+}
+
+// ReadStrictResponse reads the response to req from r, see above. req
+// may be nil, taken as a GET.
+func ReadStrictResponse(r *bufio.Reader, req *http.Request, limits HTTPLimits) (*http.Response, error) {
+	budget := limits.maxHeaderBytes()
+	line, err := readHTTPLine(r, &budget)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &http.Response{Request: req}
+	proto, status, ok := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(status, " ")
+	if !ok || len(code) != 3 || strings.ContainsFunc(code, func(r rune) bool { return r < '0' || r > '9' }) || !validHTTPValue(reason) {
+		return nil, fmt.Errorf("%w: invalid status line %q", ErrHTTPMalformed, line)
+	}
+	if proto != "HTTP/1.1" && proto != "HTTP/1.0" {
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrHTTPMalformed, proto)
+	}
+	resp.Proto, resp.Status = proto, strings.TrimSuffix(code+" "+reason, " ")
+	resp.ProtoMajor, resp.ProtoMinor, _ = http.ParseHTTPVersion(proto)
+	resp.StatusCode, _ = strconv.Atoi(code)
+
+	if resp.Header, err = readHTTPFields(r, &budget, limits); err != nil {
+		return nil, err
+	}
+
+	// Without a length, a response lasts until the connection closes
+	length, chunked, err := httpMessageLength(resp.Header, resp.ProtoMinor == 0)
+	noBody := resp.StatusCode/100 == 1 || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		(req != nil && (req.Method == http.MethodHead || (req.Method == http.MethodConnect && resp.StatusCode/100 == 2)))
+	switch {
+	case err != nil:
+		return nil, err
+	case noBody:
+		resp.ContentLength = max(length, 0)
+		resp.Body = http.NoBody
+	case chunked:
+		resp.Header.Del("Transfer-Encoding")
+		resp.TransferEncoding = []string{"chunked"}
+		resp.ContentLength = -1
+		resp.Body = &chunkedBody{r: r, limits: limits}
+	case length >= 0:
+		resp.ContentLength = length
+		resp.Body = &lengthBody{r: r, n: length}
+	default:
+		resp.ContentLength = -1
+		resp.Body = io.NopCloser(r)
+		resp.Close = true
+	}
+	resp.Close = resp.Close || httpShouldClose(resp.ProtoMinor, resp.Header)
+
+	return resp, nil
+}
+
+// readHTTPLine reads a line ending in CRLF, without it, taking its
+// length from budget. io.EOF means r ended before the line started.
+func readHTTPLine(r *bufio.Reader, budget *int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if *budget -= len(chunk); *budget < 0 {
+			return "", fmt.Errorf("%w: over the size limit", ErrHTTPHeaderTooLarge)
+		}
+		line = append(line, chunk...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	switch {
+	case !ok:
+		return "", fmt.Errorf("%w: bare LF", ErrHTTPMalformed)
+	case strings.IndexByte(s, '\r') >= 0:
+		return "", fmt.Errorf("%w: bare CR", ErrHTTPMalformed)
+	}
+
+	return s, nil
+}
+
+// readHTTPFields reads header (or trailer) fields up to the empty line
+func readHTTPFields(r *bufio.Reader, budget *int, limits HTTPLimits) (http.Header, error) {
+	h := make(http.Header)
+	for n := 0; ; n++ {
+		line, err := readHTTPLine(r, budget)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return h, nil
+		}
+		if n == limits.maxHeaders() {
+			return nil, fmt.Errorf("%w: over %d fields", ErrHTTPHeaderTooLarge, n)
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("%w: folded line", ErrHTTPMalformed)
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !isHTTPToken(name) {
+			return nil, fmt.Errorf("%w: invalid field name %q", ErrHTTPMalformed, name)
+		}
+		value = strings.Trim(value, " \t")
+		if !validHTTPValue(value) {
+			return nil, fmt.Errorf("%w: invalid %s value", ErrHTTPMalformed, name)
+		}
+		h.Add(textproto.CanonicalMIMEHeaderKey(name), value)
+	}
+}
+
+// httpMessageLength returns the length a header gives its body, -1 for
+// none, or whether it is chunked
+func httpMessageLength(h http.Header, http10 bool) (int64, bool, error) {
+	te, cl := h.Values("Transfer-Encoding"), h.Values("Content-Length")
+	if len(te) > 0 {
+		switch {
+		case len(cl) > 0:
+			return 0, false, fmt.Errorf("%w: Content-Length and Transfer-Encoding", ErrHTTPAmbiguousLength)
+		case http10:
+			return 0, false, fmt.Errorf("%w: Transfer-Encoding in HTTP/1.0", ErrHTTPAmbiguousLength)
+		case len(te) > 1 || !strings.EqualFold(te[0], "chunked"):
+			return 0, false, fmt.Errorf("%w: Transfer-Encoding %q", ErrHTTPAmbiguousLength, strings.Join(te, ", "))
+		}
+		return -1, true, nil
+	}
+
+	// The same length repeated is fine, like a proxy merging fields
+	length := int64(-1)
+	for _, v := range cl {
+		for _, s := range strings.Split(v, ",") {
+			n, err := strconv.ParseUint(strings.Trim(s, " \t"), 10, 63)
+			if err != nil {
+				return 0, false, fmt.Errorf("%w: Content-Length %q", ErrHTTPAmbiguousLength, v)
+			}
+			if length >= 0 && int64(n) != length {
+				return 0, false, fmt.Errorf("%w: Content-Lengths %q", ErrHTTPAmbiguousLength, strings.Join(cl, ", "))
+			}
+			length = int64(n)
+		}
+	}
+
+	return length, false, nil
+}
+
+// httpShouldClose reports whether a message ends its connection
+func httpShouldClose(minor int, h http.Header) bool {
+	if httpHasToken(h, "Connection", "close") {
+		return true
+	}
+
+	return minor == 0 && !httpHasToken(h, "Connection", "keep-alive")
+}
+
+// httpHasToken reports whether a comma separated field holds token
+func httpHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.Trim(t, " \t"), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isHTTPToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func isHTTPCtlOrSpace(r rune) bool {
+	return r <= ' ' || r == 0x7f
+}
+
+// validHTTPValue reports whether s holds no control characters but tabs
+func validHTTPValue(s string) bool {
+	for _, c := range []byte(s) {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lengthBody reads a body of n bytes
+type lengthBody struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (b *lengthBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.r.Read(p)
+	b.n -= int64(n)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (b *lengthBody) Close() error { return nil }
+
+// chunkedBody reads a chunked body, and its trailer
+type chunkedBody struct {
+	r      *bufio.Reader
+	limits HTTPLimits
+	n      int64 // Left in the current chunk; 0 before a chunk size
+	err    error
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.n == 0 {
+		if b.err = b.nextChunk(); b.err != nil {
+			return 0, b.err
+		}
+	}
+
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.r.Read(p)
+	if b.n -= int64(n); b.n == 0 && err == nil {
+		// Every chunk ends in CRLF
+		crlf, err2 := b.r.Peek(2)
+		if err2 == nil && string(crlf) != "\r\n" {
+			err2 = fmt.Errorf("%w: chunk longer than its size", ErrHTTPMalformed)
+		}
+		_, _ = b.r.Discard(len(crlf))
+		err = err2
+	}
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	b.err = err
+
+	return n, err
+}
+
+// nextChunk reads a chunk size, or the last chunk and the trailer, for
+// which it returns io.EOF
+func (b *chunkedBody) nextChunk() error {
+	budget := b.limits.maxHeaderBytes()
+	line, err := readHTTPLine(b.r, &budget)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	size, ext, _ := strings.Cut(line, ";")
+	if size == "" || len(size) > 15 || strings.ContainsFunc(size, func(r rune) bool {
+		return !('0' <= r && r <= '9' || 'a' <= r && r <= 'f' || 'A' <= r && r <= 'F')
+	}) || !validHTTPValue(ext) {
+		return fmt.Errorf("%w: invalid chunk size line %q", ErrHTTPMalformed, line)
+	}
+	if b.n, _ = strconv.ParseInt(size, 16, 64); b.n > 0 {
+		return nil
+	}
+
+	trailer, err := readHTTPFields(b.r, &budget, b.limits)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"Content-Length", "Transfer-Encoding"} {
+		if _, ok := trailer[name]; ok {
+			return fmt.Errorf("%w: %s in the trailer", ErrHTTPAmbiguousLength, name)
+		}
+	}
+
+	return io.EOF
+}
+
+func (b *chunkedBody) Close() error { return nil }
+
+// StrictHTTPListener checks the requests on the connections it accepts,
+// see above
+type StrictHTTPListener struct {
+	net.Listener
+
+	Limits HTTPLimits
+
+	// Rejected, when set, is called with the connection and the error
+	// of each request refused
+	Rejected func(conn net.Conn, err error)
+}
+
+// Accept returns a *StrictHTTPConn
+func (l *StrictHTTPListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &StrictHTTPConn{Conn: conn, limits: l.Limits, rejected: l.Rejected}
+	c.r = bufio.NewReaderSize(strictRecorder{c}, max(l.Limits.maxHeaderBytes()+1, 4096))
+
+	return c, nil
+}
+
+// StrictHTTPConn reads requests, passing on only the bytes it checked.
+// After a CONNECT or an Upgrade request, it passes on everything.
+type StrictHTTPConn struct {
+	net.Conn
+
+	limits   HTTPLimits
+	rejected func(net.Conn, error)
+
+	r           *bufio.Reader // Parses what is read from Conn
+	raw         []byte        // Read from Conn and not passed on yet, the last r.Buffered() unchecked
+	body        io.Reader     // Of the current request, nil between requests
+	scratch     []byte
+	upgrade     bool // Whether the current request switches protocols
+	passthrough bool
+	refusal     []byte // Passed on once err is set
+	err         error
+}
+
+// strictRecorder keeps what r reads in raw
+type strictRecorder struct {
+	c *StrictHTTPConn
+}
+
+func (s strictRecorder) Read(p []byte) (int, error) {
+	n, err := s.c.Conn.Read(p)
+	s.c.raw = append(s.c.raw, p[:n]...)
+
+	return n, err
+}
+
+// NetConn returns the underlying connection
+func (c *StrictHTTPConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *StrictHTTPConn) Read(p []byte) (int, error) {
+	for {
+		checked := len(c.raw) - c.r.Buffered()
+		if c.passthrough {
+			checked = len(c.raw)
+		}
+		if checked > 0 {
+			n := copy(p, c.raw[:checked])
+			c.raw = c.raw[:copy(c.raw, c.raw[n:])]
+			return n, nil
+		}
+		if c.passthrough {
+			return c.Conn.Read(p)
+		}
+		if len(c.refusal) > 0 {
+			n := copy(p, c.refusal)
+			c.refusal = c.refusal[n:]
+			return n, nil
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		err := c.next()
+		var ne net.Error
+		switch {
+		case err == nil:
+		case errors.As(err, &ne) && ne.Timeout():
+			// net/http interrupts reads with deadlines and reads on
+			return 0, err
+		default:
+			if c.rejected != nil && isStrictHTTPError(err) {
+				c.rejected(c, err)
+			}
+			// Whatever the refused message got through parsing
+			// stays here. For a refused head, the server gets a line
+			// it can't parse instead, so that it answers 400 in its
+			// turn: it closes quietly on read errors between requests.
+			c.raw, c.err = nil, err
+			if c.body == nil && isStrictHTTPError(err) {
+				c.refusal = []byte("REFUSED\r\n\r\n")
+			}
+		}
+	}
+}
+
+// isStrictHTTPError reports whether err refuses a message, rather than
+// being a read error
+func isStrictHTTPError(err error) bool {
+	return errors.Is(err, ErrHTTPMalformed) || errors.Is(err, ErrHTTPHeaderTooLarge) || errors.Is(err, ErrHTTPAmbiguousLength)
+}
+
+// next checks some more of the stream
+func (c *StrictHTTPConn) next() error {
+	if c.body != nil {
+		if c.scratch == nil {
+			c.scratch = make([]byte, 4096)
+		}
+		_, err := c.body.Read(c.scratch)
+		if errors.Is(err, io.EOF) {
+			c.body, c.passthrough = nil, c.upgrade
+			return nil
+		}
+		return err
+	}
+
+	if err := c.bufferHead(); err != nil {
+		return err
+	}
+	req, err := ReadStrictRequest(c.r, c.limits)
+	if err != nil {
+		return err
+	}
+	c.body = req.Body
+	c.upgrade = req.Method == http.MethodConnect || httpHasToken(req.Header, "Connection", "upgrade")
+
+	return nil
+}
+
+// bufferHead waits until c.r holds a whole head, or as much of one as
+// it can, so that parsing it never stops halfway through on a deadline
+func (c *StrictHTTPConn) bufferHead() error {
+	for {
+		buf, _ := c.r.Peek(c.r.Buffered())
+		if bytes.HasPrefix(buf, []byte("\n")) || bytes.HasPrefix(buf, []byte("\r\n")) ||
+			bytes.Contains(buf, []byte("\n\n")) || bytes.Contains(buf, []byte("\n\r\n")) ||
+			len(buf) == c.r.Size() {
+			return nil
+		}
+		if _, err := c.r.Peek(len(buf) + 1); err != nil {
+			if errors.Is(err, io.EOF) && len(buf) > 0 {
+				return nil // Parsing tells what's wrong
+			}
+			return err
+		}
+	}
+}
+
+func TestStrictHTTP(t *testing.T) {
+	const limitsHead = "GET / HTTP/1.1\r\nHost: a\r\n"
+
+	// Malformed messages, and what they are refused for
+	for _, c := range []struct {
+		name, request string
+		expected      error
+	}{
+		{"CL.TE", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG", ErrHTTPAmbiguousLength},
+		{"TE.CL", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n", ErrHTTPAmbiguousLength},
+		{"CL.CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd", ErrHTTPAmbiguousLength},
+		{"CL list", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3, 4\r\n\r\nabcd", ErrHTTPAmbiguousLength},
+		{"CL sign", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +3\r\n\r\nabc", ErrHTTPAmbiguousLength},
+		{"CL hex", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x3\r\n\r\nabc", ErrHTTPAmbiguousLength},
+		{"CL empty", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length:\r\n\r\n", ErrHTTPAmbiguousLength},
+		{"CL overflow", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999999999999\r\n\r\n", ErrHTTPAmbiguousLength},
+		{"TE obfuscated", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n", ErrHTTPAmbiguousLength},
+		{"TE twice", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n", ErrHTTPAmbiguousLength},
+		{"TE list", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", ErrHTTPAmbiguousLength},
+		{"TE in 1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrHTTPAmbiguousLength},
+		{"TE space", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n", ErrHTTPMalformed},
+		{"TE folded", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n", ErrHTTPMalformed},
+		{"TE vertical tab", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\vchunked\r\n\r\n0\r\n\r\n", ErrHTTPMalformed},
+		{"bare LF", "GET / HTTP/1.1\nHost: a\n\n", ErrHTTPMalformed},
+		{"bare CR", "GET / HTTP/1.1\r\nHost: a\rX: b\r\n\r\n", ErrHTTPMalformed},
+		{"NUL in value", "GET / HTTP/1.1\r\nHost: a\r\nX: a\x00b\r\n\r\n", ErrHTTPMalformed},
+		{"no colon", "GET / HTTP/1.1\r\nHost: a\r\nX\r\n\r\n", ErrHTTPMalformed},
+		{"empty name", "GET / HTTP/1.1\r\nHost: a\r\n: b\r\n\r\n", ErrHTTPMalformed},
+		{"no host", "GET / HTTP/1.1\r\n\r\n", ErrHTTPMalformed},
+		{"two hosts", "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", ErrHTTPMalformed},
+		{"leading empty line", "\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n", ErrHTTPMalformed},
+		{"double space", "GET  / HTTP/1.1\r\nHost: a\r\n\r\n", ErrHTTPMalformed},
+		{"space in target", "GET /a b HTTP/1.1\r\nHost: a\r\n\r\n", ErrHTTPMalformed},
+		{"HTTP/0.9", "GET /\r\n\r\n", ErrHTTPMalformed},
+		{"HTTP/2.0", "GET / HTTP/2.0\r\nHost: a\r\n\r\n", ErrHTTPMalformed},
+		{"HTTP/1.10", "GET / HTTP/1.10\r\nHost: a\r\n\r\n", ErrHTTPMalformed},
+		{"method", "G(T / HTTP/1.1\r\nHost: a\r\n\r\n", ErrHTTPMalformed},
+		{"too large", limitsHead + "X: " + strings.Repeat("a", defaultHTTPMaxHeaderBytes) + "\r\n\r\n", ErrHTTPHeaderTooLarge},
+		{"too many", limitsHead + strings.Repeat("X: a\r\n", defaultHTTPMaxHeaders) + "\r\n", ErrHTTPHeaderTooLarge},
+		{"chunk sign", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n+3\r\nabc\r\n0\r\n\r\n", ErrHTTPMalformed},
+		{"chunk space", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3 \r\nabc\r\n0\r\n\r\n", ErrHTTPMalformed},
+		{"chunk overflow", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n10000000000000003\r\nabc\r\n0\r\n\r\n", ErrHTTPMalformed},
+		{"chunk too long", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabcd\r\n0\r\n\r\n", ErrHTTPMalformed},
+		{"chunk bare LF", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\nabc\r\n0\r\n\r\n", ErrHTTPMalformed},
+		{"chunk trailer CL", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nContent-Length: 5\r\n\r\n", ErrHTTPAmbiguousLength},
+		{"short body", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nabc", io.ErrUnexpectedEOF},
+		{"short chunks", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n", io.ErrUnexpectedEOF},
+		{"short head", "GET / HTTP/1.1\r\nHost: a\r\n", io.ErrUnexpectedEOF},
+	} {
+		req, err := ReadStrictRequest(bufio.NewReader(strings.NewReader(c.request)), HTTPLimits{})
+		if err == nil {
+			_, err = io.ReadAll(req.Body)
+		}
+		if !errors.Is(err, c.expected) {
+			t.Errorf("%s: expected %v; actual: %v", c.name, c.expected, err)
+		}
+	}
+
+	// Valid requests, pipelined on one reader
+	r := bufio.NewReader(strings.NewReader("" +
+		"POST /a HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc" +
+		"POST /b?x=1 HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: Chunked\r\n\r\n3;ext=1\r\nabc\r\n1\r\nd\r\n0\r\nChecksum: x\r\n\r\n" +
+		"CONNECT b:443 HTTP/1.1\r\nHost: b:443\r\n\r\n" +
+		"GET http://c/ HTTP/1.0\r\nX-Empty:\r\nX-Tab:\ta\tb \r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: d\r\nConnection: keep-alive, Close\r\n\r\n"))
+	for _, expected := range []struct {
+		method, host, uri, body string
+		length                  int64
+		close                   bool
+	}{
+		{"POST", "a", "/a", "abc", 3, false},
+		{"POST", "a", "/b?x=1", "abcd", -1, false},
+		{"CONNECT", "b:443", "b:443", "", 0, false},
+		{"GET", "c", "http://c/", "", 0, true},
+		{"GET", "d", "/", "", 0, true},
+	} {
+		req, err := ReadStrictRequest(r, HTTPLimits{})
+		if err != nil {
+			t.Fatalf("%s %s: %v", expected.method, expected.uri, err)
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil || string(body) != expected.body || req.Method != expected.method || req.Host != expected.host ||
+			req.RequestURI != expected.uri || req.ContentLength != expected.length || req.Close != expected.close {
+			t.Errorf("%s %s: unexpected %s %s %q %q %d %t, %v", expected.method, expected.uri,
+				req.Method, req.Host, req.RequestURI, body, req.ContentLength, req.Close, err)
+		}
+		if req.Header.Get("Host") != "" || req.Header.Get("Transfer-Encoding") != "" {
+			t.Errorf("%s %s: expected Host and Transfer-Encoding out of the header", expected.method, expected.uri)
+		}
+	}
+	if _, err := ReadStrictRequest(r, HTTPLimits{}); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF after the last request; actual: %v", err)
+	}
+	if _, err := ReadStrictRequest(bufio.NewReader(strings.NewReader(limitsHead+"X: a\r\nY: b\r\n\r\n")), HTTPLimits{MaxHeaders: 2}); !errors.Is(err, ErrHTTPHeaderTooLarge) {
+		t.Errorf("expected 3 fields over a limit of 2; actual: %v", err)
+	}
+
+	// Responses
+	for _, c := range []struct {
+		name, response, method string
+		expected               error
+		body                   string
+	}{
+		{"length", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi", "GET", nil, "hi"},
+		{"chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\n\r\n", "GET", nil, "hi"},
+		{"until close", "HTTP/1.0 200\r\n\r\nhi", "GET", nil, "hi"},
+		{"HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n", "HEAD", nil, ""},
+		{"CONNECT", "HTTP/1.1 200 Connection established\r\n\r\n", "CONNECT", nil, ""},
+		{"no content", "HTTP/1.1 204 No Content\r\n\r\n", "GET", nil, ""},
+		{"CL.TE", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", "GET", ErrHTTPAmbiguousLength, ""},
+		{"status", "HTTP/1.1 20 OK\r\n\r\n", "GET", ErrHTTPMalformed, ""},
+		{"version", "HTTP/1.2 200 OK\r\n\r\n", "GET", ErrHTTPMalformed, ""},
+		{"bare LF", "HTTP/1.1 200 OK\nContent-Length: 0\n\n", "GET", ErrHTTPMalformed, ""},
+	} {
+		resp, err := ReadStrictResponse(bufio.NewReader(strings.NewReader(c.response)), &http.Request{Method: c.method}, HTTPLimits{})
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+		}
+		if !errors.Is(err, c.expected) || string(body) != c.body {
+			t.Errorf("%s: expected %q, %v; actual: %q, %v", c.name, c.body, c.expected, body, err)
+		}
+	}
+}
+
+func TestStrictHTTPListener(t *testing.T) {
+	requests := make(chan string, 10)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			requests <- r.Method + " " + r.URL.Path + " " + string(body)
+		}),
+		ReadHeaderTimeout: time.Second,
+	}
+	rejected := make(chan error, 10)
+	l := &StrictHTTPListener{
+		Listener: testListener(t),
+		Rejected: func(_ net.Conn, err error) { rejected <- err },
+	}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	// exchange sends raw requests and returns the status lines answered
+	exchange := func(raw string) []string {
+		t.Helper()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.WriteString(conn, raw); err != nil {
+			t.Fatal(err)
+		}
+		var statuses []string
+		r := bufio.NewReader(conn)
+		for {
+			resp, err := http.ReadResponse(r, nil)
+			if err != nil {
+				return statuses
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			statuses = append(statuses, resp.Status)
+		}
+	}
+
+	// Pipelined requests, with bodies both ways, go through
+	statuses := exchange("" +
+		"POST /a HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\n\r\nabc" +
+		"POST /b HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nde\r\n0\r\n\r\n" +
+		"GET /c HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+	if strings.Join(statuses, "|") != "200 OK|200 OK|200 OK" {
+		t.Errorf("unexpected statuses %q", statuses)
+	}
+	for _, expected := range []string{"POST /a abc", "POST /b de", "GET /c "} {
+		if actual := <-requests; actual != expected {
+			t.Errorf("expected %q; actual: %q", expected, actual)
+		}
+	}
+
+	// The smuggled request never reaches the server, nor does anything
+	// after it
+	statuses = exchange("" +
+		"GET /ok HTTP/1.1\r\nHost: a\r\n\r\n" +
+		"POST /cover HTTP/1.1\r\nHost: a\r\nContent-Length: 35\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"0\r\n\r\nGET /admin HTTP/1.1\r\nHost: a\r\n\r\n")
+	if strings.Join(statuses, "|") != "200 OK|400 Bad Request" {
+		t.Errorf("unexpected statuses %q", statuses)
+	}
+	if actual := <-requests; actual != "GET /ok " {
+		t.Errorf("unexpected request %q", actual)
+	}
+	select {
+	case actual := <-requests:
+		t.Errorf("unexpected request %q", actual)
+	case err := <-rejected:
+		if !errors.Is(err, ErrHTTPAmbiguousLength) {
+			t.Errorf("unexpected rejection %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected a rejection")
+	}
+}
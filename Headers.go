@@ -0,0 +1,1076 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Packet headers
+//
+// What a capture reads is the frame as it was on the wire, headers and
+// all. DecodePacket takes one apart the way tcpdump does: the Ethernet
+// header, ARP, IPv4 or IPv6 behind it, TCP, UDP or ICMP behind that,
+// and what's left is the payload. The other way around, a Packet's
+// MarshalBinary crafts a frame from its layers, for tests that need
+// packets no socket would send (a forged source, a bad checksum) and
+// for the tools writing to raw sockets.
+//
+// Each header has an UnmarshalBinary reading its fields, in network
+// byte order, from the start of a buffer, a MarshalBinary writing them,
+// and a Len telling where the next one starts. Packet's MarshalBinary
+// fills in what follows from the layers: the lengths, the EtherType,
+// the IP protocol and the checksums.
+//
+// The checksums are all the internet checksum (internetChecksum in
+// Ping.go), over different bytes. IPv4 covers its header only, ICMP its
+// message. TCP, UDP and ICMPv6 cover the segment and a pseudo header of
+// the IP addresses, the protocol and the length, so that a packet
+// delivered to the wrong address fails the check too. VerifyChecksums
+// checks those of a decoded packet. Frames captured on their way out
+// often fail it: the network card computes the checksums, after the
+// capture saw the frame (checksum offload).
+//
+// Decoding stops at the first layer it doesn't know (IPv6 extension
+// headers, IPv4 fragments after the first), leaving the rest as the
+// payload. A header cut short is an error, with the layers before it
+// decoded: a snapshot length too small for the headers shows as such
+// rather than as garbage.
+
+// EtherType values of the layers DecodePacket knows
+const (
+	EtherTypeIPv4 = 0x0800
+	EtherTypeARP  = 0x0806
+	EtherTypeVLAN = 0x8100
+	EtherTypeIPv6 = 0x86dd
+)
+
+// IP protocol numbers
+const (
+	ProtocolICMP   = 1
+	ProtocolTCP    = 6
+	ProtocolUDP    = 17
+	ProtocolICMPv6 = 58
+)
+
+// TCP flags
+const (
+	TCPFin = 1 << iota
+	TCPSyn
+	TCPRst
+	TCPPsh
+	TCPAck
+	TCPUrg
+	TCPEce
+	TCPCwr
+)
+
+// ARP operations
+const (
+	ARPRequest = 1
+	ARPReply   = 2
+)
+
+// ICMP and ICMPv6 message types DecodePacket names
+const (
+	icmpDestinationUnreachable   = 3
+	icmpTimeExceeded             = 11
+	icmpv6DestinationUnreachable = 1
+	icmpv6TimeExceeded           = 3
+)
+
+// errTruncated is returned for a header cut short
+var errTruncated = errors.New("packet: truncated header")
+
+// EthernetHeader is the link header of an Ethernet frame
+type EthernetHeader struct {
+	Dst, Src  net.HardwareAddr
+	VLAN      uint16 // VLAN id of an 802.1Q tag, 0 without
+	EtherType uint16 // What follows: EtherTypeIPv4 and the like
+}
+
+// Len returns the size of the header, with its VLAN tag
+func (h *EthernetHeader) Len() int {
+	if h.VLAN != 0 {
+		return 18
+	}
+
+	return 14
+}
+
+// UnmarshalBinary decodes the header at the start of b
+func (h *EthernetHeader) UnmarshalBinary(b []byte) error {
+	if len(b) < 14 {
+		return errTruncated
+	}
+	h.Dst = net.HardwareAddr(b[0:6:6])
+	h.Src = net.HardwareAddr(b[6:12:12])
+	h.EtherType = binary.BigEndian.Uint16(b[12:])
+	h.VLAN = 0
+
+	if h.EtherType == EtherTypeVLAN {
+		if len(b) < 18 {
+			return errTruncated
+		}
+		h.VLAN = binary.BigEndian.Uint16(b[14:]) & 0xfff
+		h.EtherType = binary.BigEndian.Uint16(b[16:])
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes the header, with a VLAN tag when VLAN is set
+func (h *EthernetHeader) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, h.Len())
+	b, err := appendMAC(b, h.Dst)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = appendMAC(b, h.Src); err != nil {
+		return nil, err
+	}
+	if h.VLAN != 0 {
+		b = binary.BigEndian.AppendUint16(b, EtherTypeVLAN)
+		b = binary.BigEndian.AppendUint16(b, h.VLAN&0xfff)
+	}
+
+	return binary.BigEndian.AppendUint16(b, h.EtherType), nil
+}
+
+// appendMAC appends an Ethernet address, zeros when nil
+func appendMAC(b []byte, mac net.HardwareAddr) ([]byte, error) {
+	switch len(mac) {
+	case 0:
+		return append(b, make([]byte, 6)...), nil
+	case 6:
+		return append(b, mac...), nil
+	}
+
+	return nil, fmt.Errorf("packet: %s isn't an Ethernet address", mac)
+}
+
+// ARPHeader is an ARP message, for IPv4 over Ethernet, the only kind
+// there is in practice
+type ARPHeader struct {
+	Operation uint16 // ARPRequest or ARPReply
+	SenderMAC net.HardwareAddr
+	SenderIP  net.IP
+	TargetMAC net.HardwareAddr // Zeros in a request: what's asked for
+	TargetIP  net.IP
+}
+
+// Len returns the size of the message, always 28 bytes
+func (h *ARPHeader) Len() int {
+	return 28
+}
+
+// UnmarshalBinary decodes the message at the start of b
+func (h *ARPHeader) UnmarshalBinary(b []byte) error {
+	if len(b) < 28 {
+		return errTruncated
+	}
+	// Hardware type 1 (Ethernet) with 6 byte addresses, protocol IPv4
+	// with 4 byte addresses
+	if binary.BigEndian.Uint16(b[0:]) != 1 || binary.BigEndian.Uint16(b[2:]) != EtherTypeIPv4 || b[4] != 6 || b[5] != 4 {
+		return errors.New("packet: ARP for other than IPv4 over Ethernet")
+	}
+
+	h.Operation = binary.BigEndian.Uint16(b[6:])
+	h.SenderMAC = net.HardwareAddr(b[8:14:14])
+	h.SenderIP = net.IP(b[14:18:18])
+	h.TargetMAC = net.HardwareAddr(b[18:24:24])
+	h.TargetIP = net.IP(b[24:28:28])
+
+	return nil
+}
+
+// MarshalBinary encodes the message
+func (h *ARPHeader) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8, h.Len())
+	binary.BigEndian.PutUint16(b[0:], 1)
+	binary.BigEndian.PutUint16(b[2:], EtherTypeIPv4)
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:], h.Operation)
+
+	var err error
+	for _, a := range []struct {
+		mac net.HardwareAddr
+		ip  net.IP
+	}{{h.SenderMAC, h.SenderIP}, {h.TargetMAC, h.TargetIP}} {
+		if b, err = appendMAC(b, a.mac); err != nil {
+			return nil, err
+		}
+		ip := a.ip.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("packet: %v isn't an IPv4 address", a.ip)
+		}
+		b = append(b, ip...)
+	}
+
+	return b, nil
+}
+
+// IPv4Header is an IPv4 header
+type IPv4Header struct {
+	TOS            uint8
+	TotalLength    uint16 // Header and payload
+	ID             uint16
+	Flags          uint8  // 3 bits: reserved, don't fragment, more fragments
+	FragmentOffset uint16 // In units of 8 bytes
+	TTL            uint8
+	Protocol       uint8 // ProtocolTCP and the like
+	Checksum       uint16
+	Src, Dst       net.IP
+	Options        []byte
+}
+
+// Len returns the size of the header, with its options
+func (h *IPv4Header) Len() int {
+	return 20 + len(h.Options)
+}
+
+// UnmarshalBinary decodes the header at the start of b
+func (h *IPv4Header) UnmarshalBinary(b []byte) error {
+	if len(b) < 20 {
+		return errTruncated
+	}
+	if version := b[0] >> 4; version != 4 {
+		return fmt.Errorf("packet: IP version %d in an IPv4 header", version)
+	}
+	size := int(b[0]&0x0f) * 4
+	if size < 20 {
+		return fmt.Errorf("packet: IPv4 header of %d bytes", size)
+	}
+	if len(b) < size {
+		return errTruncated
+	}
+
+	h.TOS = b[1]
+	h.TotalLength = binary.BigEndian.Uint16(b[2:])
+	h.ID = binary.BigEndian.Uint16(b[4:])
+	h.Flags = b[6] >> 5
+	h.FragmentOffset = binary.BigEndian.Uint16(b[6:]) & 0x1fff
+	h.TTL = b[8]
+	h.Protocol = b[9]
+	h.Checksum = binary.BigEndian.Uint16(b[10:])
+	h.Src = net.IP(b[12:16:16])
+	h.Dst = net.IP(b[16:20:20])
+	h.Options = nil
+	if size > 20 {
+		h.Options = b[20:size:size]
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes the header, computing its checksum rather than
+// taking Checksum. The options must be padded to 4 bytes.
+func (h *IPv4Header) MarshalBinary() ([]byte, error) {
+	src, dst := h.Src.To4(), h.Dst.To4()
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("packet: %v > %v aren't IPv4 addresses", h.Src, h.Dst)
+	}
+	if len(h.Options)%4 != 0 || len(h.Options) > 40 {
+		return nil, fmt.Errorf("packet: IPv4 options of %d bytes", len(h.Options))
+	}
+
+	b := make([]byte, 20, h.Len())
+	b[0] = 4<<4 | uint8(h.Len()/4)
+	b[1] = h.TOS
+	binary.BigEndian.PutUint16(b[2:], h.TotalLength)
+	binary.BigEndian.PutUint16(b[4:], h.ID)
+	binary.BigEndian.PutUint16(b[6:], uint16(h.Flags)<<13|h.FragmentOffset&0x1fff)
+	b[8] = h.TTL
+	b[9] = h.Protocol
+	copy(b[12:], src)
+	copy(b[16:], dst)
+	b = append(b, h.Options...)
+	binary.BigEndian.PutUint16(b[10:], internetChecksum(b))
+
+	return b, nil
+}
+
+// IPv6Header is the fixed IPv6 header
+type IPv6Header struct {
+	TrafficClass  uint8
+	FlowLabel     uint32 // 20 bits
+	PayloadLength uint16 // Extension headers and payload
+	NextHeader    uint8  // ProtocolTCP and the like, or an extension header
+	HopLimit      uint8
+	Src, Dst      net.IP
+}
+
+// Len returns the size of the header, always 40 bytes
+func (h *IPv6Header) Len() int {
+	return 40
+}
+
+// UnmarshalBinary decodes the header at the start of b
+func (h *IPv6Header) UnmarshalBinary(b []byte) error {
+	if len(b) < 40 {
+		return errTruncated
+	}
+	if version := b[0] >> 4; version != 6 {
+		return fmt.Errorf("packet: IP version %d in an IPv6 header", version)
+	}
+
+	first := binary.BigEndian.Uint32(b)
+	h.TrafficClass = uint8(first >> 20)
+	h.FlowLabel = first & 0xfffff
+	h.PayloadLength = binary.BigEndian.Uint16(b[4:])
+	h.NextHeader = b[6]
+	h.HopLimit = b[7]
+	h.Src = net.IP(b[8:24:24])
+	h.Dst = net.IP(b[24:40:40])
+
+	return nil
+}
+
+// MarshalBinary encodes the header
+func (h *IPv6Header) MarshalBinary() ([]byte, error) {
+	src, dst := h.Src.To16(), h.Dst.To16()
+	if src == nil || dst == nil || h.Src.To4() != nil || h.Dst.To4() != nil {
+		return nil, fmt.Errorf("packet: %v > %v aren't IPv6 addresses", h.Src, h.Dst)
+	}
+
+	b := make([]byte, 8, h.Len())
+	binary.BigEndian.PutUint32(b, 6<<28|uint32(h.TrafficClass)<<20|h.FlowLabel&0xfffff)
+	binary.BigEndian.PutUint16(b[4:], h.PayloadLength)
+	b[6], b[7] = h.NextHeader, h.HopLimit
+	b = append(b, src...)
+
+	return append(b, dst...), nil
+}
+
+// TCPHeader is a TCP header
+type TCPHeader struct {
+	SrcPort, DstPort uint16
+	Seq, Ack         uint32
+	Flags            uint8 // TCPSyn and the like
+	Window           uint16
+	Checksum         uint16
+	Urgent           uint16
+	Options          []byte
+}
+
+// Len returns the size of the header, with its options
+func (h *TCPHeader) Len() int {
+	return 20 + len(h.Options)
+}
+
+// UnmarshalBinary decodes the header at the start of b
+func (h *TCPHeader) UnmarshalBinary(b []byte) error {
+	if len(b) < 20 {
+		return errTruncated
+	}
+	size := int(b[12]>>4) * 4
+	if size < 20 {
+		return fmt.Errorf("packet: TCP header of %d bytes", size)
+	}
+	if len(b) < size {
+		return errTruncated
+	}
+
+	h.SrcPort = binary.BigEndian.Uint16(b[0:])
+	h.DstPort = binary.BigEndian.Uint16(b[2:])
+	h.Seq = binary.BigEndian.Uint32(b[4:])
+	h.Ack = binary.BigEndian.Uint32(b[8:])
+	h.Flags = b[13]
+	h.Window = binary.BigEndian.Uint16(b[14:])
+	h.Checksum = binary.BigEndian.Uint16(b[16:])
+	h.Urgent = binary.BigEndian.Uint16(b[18:])
+	h.Options = nil
+	if size > 20 {
+		h.Options = b[20:size:size]
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes the header, Checksum included. The options
+// must be padded to 4 bytes.
+func (h *TCPHeader) MarshalBinary() ([]byte, error) {
+	if len(h.Options)%4 != 0 || len(h.Options) > 40 {
+		return nil, fmt.Errorf("packet: TCP options of %d bytes", len(h.Options))
+	}
+
+	b := make([]byte, 20, h.Len())
+	binary.BigEndian.PutUint16(b[0:], h.SrcPort)
+	binary.BigEndian.PutUint16(b[2:], h.DstPort)
+	binary.BigEndian.PutUint32(b[4:], h.Seq)
+	binary.BigEndian.PutUint32(b[8:], h.Ack)
+	b[12] = uint8(h.Len()/4) << 4
+	b[13] = h.Flags
+	binary.BigEndian.PutUint16(b[14:], h.Window)
+	binary.BigEndian.PutUint16(b[16:], h.Checksum)
+	binary.BigEndian.PutUint16(b[18:], h.Urgent)
+
+	return append(b, h.Options...), nil
+}
+
+// FlagString returns the flags the way tcpdump prints them: [S.] for
+// SYN and ACK
+func (h *TCPHeader) FlagString() string {
+	var s strings.Builder
+	s.WriteByte('[')
+	for _, f := range []struct {
+		flag uint8
+		name byte
+	}{{TCPSyn, 'S'}, {TCPFin, 'F'}, {TCPRst, 'R'}, {TCPPsh, 'P'}, {TCPUrg, 'U'}, {TCPEce, 'E'}, {TCPCwr, 'W'}, {TCPAck, '.'}} {
+		if h.Flags&f.flag != 0 {
+			s.WriteByte(f.name)
+		}
+	}
+	s.WriteByte(']')
+
+	return s.String()
+}
+
+// UDPHeader is a UDP header
+type UDPHeader struct {
+	SrcPort, DstPort uint16
+	Length           uint16 // Header and payload
+	Checksum         uint16
+}
+
+// Len returns the size of the header, always 8 bytes
+func (h *UDPHeader) Len() int {
+	return 8
+}
+
+// UnmarshalBinary decodes the header at the start of b
+func (h *UDPHeader) UnmarshalBinary(b []byte) error {
+	if len(b) < 8 {
+		return errTruncated
+	}
+	h.SrcPort = binary.BigEndian.Uint16(b[0:])
+	h.DstPort = binary.BigEndian.Uint16(b[2:])
+	h.Length = binary.BigEndian.Uint16(b[4:])
+	h.Checksum = binary.BigEndian.Uint16(b[6:])
+
+	return nil
+}
+
+// MarshalBinary encodes the header, Checksum included
+func (h *UDPHeader) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b[0:], h.SrcPort)
+	binary.BigEndian.PutUint16(b[2:], h.DstPort)
+	binary.BigEndian.PutUint16(b[4:], h.Length)
+	binary.BigEndian.PutUint16(b[6:], h.Checksum)
+
+	return b, nil
+}
+
+// ICMPHeader is the header of an ICMP or ICMPv6 message. ICMPEcho
+// (Ping.go) has the fields of the echoes.
+type ICMPHeader struct {
+	Type, Code uint8
+	Checksum   uint16
+	Rest       uint32 // Identifier and sequence number of an echo, depends on the type
+}
+
+// Len returns the size of the header, always 8 bytes
+func (h *ICMPHeader) Len() int {
+	return 8
+}
+
+// UnmarshalBinary decodes the header at the start of b
+func (h *ICMPHeader) UnmarshalBinary(b []byte) error {
+	if len(b) < 8 {
+		return errTruncated
+	}
+	h.Type, h.Code = b[0], b[1]
+	h.Checksum = binary.BigEndian.Uint16(b[2:])
+	h.Rest = binary.BigEndian.Uint32(b[4:])
+
+	return nil
+}
+
+// MarshalBinary encodes the header, Checksum included
+func (h *ICMPHeader) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 8)
+	b[0], b[1] = h.Type, h.Code
+	binary.BigEndian.PutUint16(b[2:], h.Checksum)
+	binary.BigEndian.PutUint32(b[4:], h.Rest)
+
+	return b, nil
+}
+
+// Packet is a decoded frame. The layers DecodePacket didn't get to are
+// nil. The headers and the payload point into the frame.
+type Packet struct {
+	Ethernet EthernetHeader
+	ARP      *ARPHeader
+	IPv4     *IPv4Header
+	IPv6     *IPv6Header
+	TCP      *TCPHeader
+	UDP      *UDPHeader
+	ICMP     *ICMPHeader // ICMP after IPv4, ICMPv6 after IPv6
+	Payload  []byte      // What follows the last header
+}
+
+// DecodePacket decodes the headers of an Ethernet frame. On error, the
+// layers before the one that failed are decoded.
+func DecodePacket(frame []byte) (*Packet, error) {
+	p := new(Packet)
+	if err := p.Ethernet.UnmarshalBinary(frame); err != nil {
+		return p, err
+	}
+	b := frame[p.Ethernet.Len():]
+	p.Payload = b
+
+	var protocol uint8
+	switch p.Ethernet.EtherType {
+	case EtherTypeARP:
+		h := new(ARPHeader)
+		if err := h.UnmarshalBinary(b); err != nil {
+			return p, err
+		}
+		p.ARP = h
+		p.Payload = b[h.Len():] // Padding
+		return p, nil
+	case EtherTypeIPv4:
+		h := new(IPv4Header)
+		if err := h.UnmarshalBinary(b); err != nil {
+			return p, err
+		}
+		p.IPv4 = h
+		// Short frames are padded up to 60 bytes
+		if end := int(h.TotalLength); end >= h.Len() && end < len(b) {
+			b = b[:end]
+		}
+		b = b[h.Len():]
+		p.Payload = b
+		if h.FragmentOffset != 0 {
+			return p, nil // The transport header is in the first fragment
+		}
+		protocol = h.Protocol
+	case EtherTypeIPv6:
+		h := new(IPv6Header)
+		if err := h.UnmarshalBinary(b); err != nil {
+			return p, err
+		}
+		p.IPv6 = h
+		b = b[h.Len():]
+		if end := int(h.PayloadLength); end < len(b) {
+			b = b[:end]
+		}
+		p.Payload = b
+		protocol = h.NextHeader
+	default:
+		return p, nil
+	}
+
+	switch protocol {
+	case ProtocolTCP:
+		h := new(TCPHeader)
+		if err := h.UnmarshalBinary(b); err != nil {
+			return p, err
+		}
+		p.TCP = h
+		p.Payload = b[h.Len():]
+	case ProtocolUDP:
+		h := new(UDPHeader)
+		if err := h.UnmarshalBinary(b); err != nil {
+			return p, err
+		}
+		p.UDP = h
+		p.Payload = b[h.Len():]
+	case ProtocolICMP, ProtocolICMPv6:
+		if (protocol == ProtocolICMP) != (p.IPv4 != nil) {
+			break // Each IP has its own ICMP
+		}
+		h := new(ICMPHeader)
+		if err := h.UnmarshalBinary(b); err != nil {
+			return p, err
+		}
+		p.ICMP = h
+		p.Payload = b[h.Len():]
+	}
+
+	return p, nil
+}
+
+// MarshalBinary encodes the packet, filling in the lengths, the
+// EtherType, the IP protocol and the checksums from the layers set. The
+// Packet itself is left as it is.
+func (p *Packet) MarshalBinary() ([]byte, error) {
+	eth := p.Ethernet
+	var body []byte
+	var err error
+
+	switch {
+	case p.ARP != nil:
+		eth.EtherType = EtherTypeARP
+		if body, err = p.ARP.MarshalBinary(); err != nil {
+			return nil, err
+		}
+		body = append(body, p.Payload...)
+	case p.IPv4 != nil || p.IPv6 != nil:
+		if body, err = p.marshalIP(&eth); err != nil {
+			return nil, err
+		}
+	default:
+		body = p.Payload
+	}
+
+	b, err := eth.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, body...), nil
+}
+
+// marshalIP encodes the IP header and what follows it
+func (p *Packet) marshalIP(eth *EthernetHeader) ([]byte, error) {
+	var segment []byte
+	var protocol uint8
+	checksum := -1 // Offset of the checksum in the segment
+	var err error
+
+	switch {
+	case p.TCP != nil:
+		h := *p.TCP
+		h.Checksum = 0
+		segment, err = h.MarshalBinary()
+		protocol, checksum = ProtocolTCP, 16
+	case p.UDP != nil:
+		h := *p.UDP
+		h.Length, h.Checksum = uint16(h.Len()+len(p.Payload)), 0
+		segment, err = h.MarshalBinary()
+		protocol, checksum = ProtocolUDP, 6
+	case p.ICMP != nil:
+		h := *p.ICMP
+		h.Checksum = 0
+		segment, err = h.MarshalBinary()
+		protocol, checksum = ProtocolICMP, 2
+		if p.IPv4 == nil {
+			protocol = ProtocolICMPv6
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	segment = append(segment, p.Payload...)
+	if len(segment) > 65535-60 {
+		return nil, fmt.Errorf("packet: %d bytes after the IP header", len(segment))
+	}
+
+	var header []byte
+	if p.IPv4 != nil {
+		h := *p.IPv4
+		h.TotalLength = uint16(h.Len() + len(segment))
+		if protocol != 0 {
+			h.Protocol = protocol
+		}
+		if header, err = h.MarshalBinary(); err != nil {
+			return nil, err
+		}
+		eth.EtherType = EtherTypeIPv4
+		if checksum >= 0 {
+			sum := internetChecksum(segment) // ICMP covers its message only
+			if protocol != ProtocolICMP {
+				sum = TransportChecksum(h.Src, h.Dst, protocol, segment)
+			}
+			binary.BigEndian.PutUint16(segment[checksum:], sum)
+		}
+	} else {
+		h := *p.IPv6
+		h.PayloadLength = uint16(len(segment))
+		if protocol != 0 {
+			h.NextHeader = protocol
+		}
+		if header, err = h.MarshalBinary(); err != nil {
+			return nil, err
+		}
+		eth.EtherType = EtherTypeIPv6
+		if checksum >= 0 {
+			binary.BigEndian.PutUint16(segment[checksum:], TransportChecksum(h.Src, h.Dst, protocol, segment))
+		}
+	}
+	// A UDP checksum of 0 means there is none; 0xffff is the same sum
+	if protocol == ProtocolUDP && binary.BigEndian.Uint16(segment[6:]) == 0 {
+		binary.BigEndian.PutUint16(segment[6:], 0xffff)
+	}
+
+	return append(header, segment...), nil
+}
+
+// TransportChecksum returns the checksum of a TCP, UDP or ICMPv6
+// segment (header and payload) sent from src to dst: the internet
+// checksum of a pseudo header and the segment. Computed with the
+// checksum field zeroed, it's what goes there; over a segment with its
+// checksum, it's 0.
+func TransportChecksum(src, dst net.IP, protocol uint8, segment []byte) uint16 {
+	b := make([]byte, 0, 40+len(segment))
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		b = append(b, src4...)
+		b = append(b, dst4...)
+		b = append(b, 0, protocol)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(segment)))
+	} else {
+		b = append(b, src.To16()...)
+		b = append(b, dst.To16()...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(segment)))
+		b = append(b, 0, 0, 0, protocol)
+	}
+
+	return internetChecksum(append(b, segment...))
+}
+
+// VerifyChecksums checks the checksums of a decoded packet: the IPv4
+// header's, and the TCP, UDP or ICMP segment's. A UDP checksum of 0,
+// none, passes.
+func (p *Packet) VerifyChecksums() error {
+	var src, dst net.IP
+	switch {
+	case p.IPv4 != nil:
+		h := *p.IPv4
+		h.Checksum = 0
+		b, err := h.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if sum := binary.BigEndian.Uint16(b[10:]); sum != p.IPv4.Checksum {
+			return fmt.Errorf("packet: IPv4 checksum %#04x, expected %#04x", p.IPv4.Checksum, sum)
+		}
+		src, dst = h.Src, h.Dst
+	case p.IPv6 != nil:
+		src, dst = p.IPv6.Src, p.IPv6.Dst
+	default:
+		return nil
+	}
+
+	var header interface{ MarshalBinary() ([]byte, error) }
+	var protocol uint8
+	switch {
+	case p.TCP != nil:
+		header, protocol = p.TCP, ProtocolTCP
+	case p.UDP != nil:
+		if p.UDP.Checksum == 0 && p.IPv4 != nil {
+			return nil
+		}
+		header, protocol = p.UDP, ProtocolUDP
+	case p.ICMP != nil:
+		header, protocol = p.ICMP, ProtocolICMPv6
+		if p.IPv4 != nil {
+			protocol = ProtocolICMP
+		}
+	default:
+		return nil
+	}
+	segment, err := header.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	segment = append(segment, p.Payload...)
+
+	sum := internetChecksum(segment)
+	if protocol != ProtocolICMP {
+		sum = TransportChecksum(src, dst, protocol, segment)
+	}
+	if sum != 0 {
+		return fmt.Errorf("packet: bad checksum of protocol %d", protocol)
+	}
+
+	return nil
+}
+
+// String summarizes the packet on a line, like tcpdump
+func (p *Packet) String() string {
+	var src, dst net.IP
+	var protocol uint8
+	switch {
+	case p.IPv4 != nil:
+		src, dst, protocol = p.IPv4.Src, p.IPv4.Dst, p.IPv4.Protocol
+	case p.IPv6 != nil:
+		src, dst, protocol = p.IPv6.Src, p.IPv6.Dst, p.IPv6.NextHeader
+	case p.ARP != nil:
+		switch p.ARP.Operation {
+		case ARPRequest:
+			return fmt.Sprintf("ARP, who-has %s tell %s", p.ARP.TargetIP, p.ARP.SenderIP)
+		case ARPReply:
+			return fmt.Sprintf("ARP, %s is-at %s", p.ARP.SenderIP, p.ARP.SenderMAC)
+		}
+		return fmt.Sprintf("ARP, operation %d", p.ARP.Operation)
+	default:
+		return fmt.Sprintf("%s > %s ethertype %#04x, length %d", p.Ethernet.Src, p.Ethernet.Dst,
+			p.Ethernet.EtherType, len(p.Payload))
+	}
+
+	switch {
+	case p.TCP != nil:
+		s := fmt.Sprintf("%s > %s: TCP %s seq %d", hostPort(src, p.TCP.SrcPort), hostPort(dst, p.TCP.DstPort),
+			p.TCP.FlagString(), p.TCP.Seq)
+		if p.TCP.Flags&TCPAck != 0 {
+			s += fmt.Sprintf(" ack %d", p.TCP.Ack)
+		}
+		return s + fmt.Sprintf(" win %d, length %d", p.TCP.Window, len(p.Payload))
+	case p.UDP != nil:
+		return fmt.Sprintf("%s > %s: UDP, length %d", hostPort(src, p.UDP.SrcPort), hostPort(dst, p.UDP.DstPort),
+			len(p.Payload))
+	case p.ICMP != nil:
+		return fmt.Sprintf("%s > %s: %s, length %d", src, dst, p.icmpType(), len(p.Payload))
+	}
+
+	return fmt.Sprintf("%s > %s: protocol %d, length %d", src, dst, protocol, len(p.Payload))
+}
+
+// icmpType names the ICMP message, like tcpdump
+func (p *Packet) icmpType() string {
+	h := p.ICMP
+	name := "ICMP"
+	if p.IPv6 != nil {
+		name = "ICMP6"
+	}
+
+	switch {
+	case p.IPv4 != nil && h.Type == icmpEchoRequest, p.IPv6 != nil && h.Type == icmpv6EchoRequest:
+		return fmt.Sprintf("%s echo request, id %d, seq %d", name, h.Rest>>16, h.Rest&0xffff)
+	case p.IPv4 != nil && h.Type == icmpEchoReply, p.IPv6 != nil && h.Type == icmpv6EchoReply:
+		return fmt.Sprintf("%s echo reply, id %d, seq %d", name, h.Rest>>16, h.Rest&0xffff)
+	case p.IPv4 != nil && h.Type == icmpDestinationUnreachable, p.IPv6 != nil && h.Type == icmpv6DestinationUnreachable:
+		return fmt.Sprintf("%s unreachable, code %d", name, h.Code)
+	case p.IPv4 != nil && h.Type == icmpTimeExceeded, p.IPv6 != nil && h.Type == icmpv6TimeExceeded:
+		return fmt.Sprintf("%s time exceeded, code %d", name, h.Code)
+	}
+
+	return fmt.Sprintf("%s type %d, code %d", name, h.Type, h.Code)
+}
+
+func hostPort(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), fmt.Sprint(port))
+}
+
+// testFrame builds an Ethernet frame by hand: a header of etherType,
+// then the bytes given
+func testFrame(etherType uint16, layers ...[]byte) []byte {
+	frame := []byte{
+		0x02, 0, 0, 0, 0, 0x02, // Destination
+		0x02, 0, 0, 0, 0, 0x01, // Source
+	}
+	frame = binary.BigEndian.AppendUint16(frame, etherType)
+	for _, l := range layers {
+		frame = append(frame, l...)
+	}
+
+	return frame
+}
+
+// testIPv4 is an IPv4 header from 192.0.2.1 to 192.0.2.2 for a payload
+// of size bytes
+func testIPv4(protocol uint8, size int) []byte {
+	h := []byte{0x45, 0, 0, 0, 0, 1, 0x40, 0, 64, protocol, 0, 0, 192, 0, 2, 1, 192, 0, 2, 2}
+	binary.BigEndian.PutUint16(h[2:], uint16(20+size))
+
+	return h
+}
+
+// testIPv6 is an IPv6 header from 2001:db8::1 to 2001:db8::2 for a
+// payload of size bytes
+func testIPv6(next uint8, size int) []byte {
+	h := make([]byte, 40)
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:], uint16(size))
+	h[6], h[7] = next, 64
+	copy(h[8:], net.ParseIP("2001:db8::1"))
+	copy(h[24:], net.ParseIP("2001:db8::2"))
+
+	return h
+}
+
+// testUDP is a UDP header for a payload of size bytes
+func testUDP(src, dst uint16, size int) []byte {
+	h := make([]byte, 8)
+	binary.BigEndian.PutUint16(h[0:], src)
+	binary.BigEndian.PutUint16(h[2:], dst)
+	binary.BigEndian.PutUint16(h[4:], uint16(8+size))
+
+	return h
+}
+
+// testTCP is a TCP header with flags
+func testTCP(src, dst uint16, flags uint8) []byte {
+	h := make([]byte, 20)
+	binary.BigEndian.PutUint16(h[0:], src)
+	binary.BigEndian.PutUint16(h[2:], dst)
+	binary.BigEndian.PutUint32(h[4:], 1000)
+	binary.BigEndian.PutUint32(h[8:], 2000)
+	h[12], h[13] = 5<<4, flags
+	binary.BigEndian.PutUint16(h[14:], 65535)
+
+	return h
+}
+
+func TestDecodePacket(t *testing.T) {
+	payload := []byte("hello")
+	for _, c := range []struct {
+		name     string
+		frame    []byte
+		expected string
+		err      bool
+	}{
+		{
+			"udp",
+			testFrame(EtherTypeIPv4, testIPv4(ProtocolUDP, 8+5), testUDP(5353, 53, 5), payload),
+			"192.0.2.1:5353 > 192.0.2.2:53: UDP, length 5",
+			false,
+		},
+		{
+			"tcp",
+			testFrame(EtherTypeIPv4, testIPv4(ProtocolTCP, 20+5), testTCP(80, 40000, TCPSyn|TCPAck), payload),
+			"192.0.2.1:80 > 192.0.2.2:40000: TCP [S.] seq 1000 ack 2000 win 65535, length 5",
+			false,
+		},
+		{
+			"tcp6",
+			testFrame(EtherTypeIPv6, testIPv6(ProtocolTCP, 20), testTCP(443, 50000, TCPFin|TCPPsh)),
+			"[2001:db8::1]:443 > [2001:db8::2]:50000: TCP [FP] seq 1000 win 65535, length 0",
+			false,
+		},
+		{
+			"padded",
+			testFrame(EtherTypeIPv4, testIPv4(ProtocolUDP, 8+1), testUDP(1, 2, 1), []byte{'x'}, make([]byte, 17)),
+			"192.0.2.1:1 > 192.0.2.2:2: UDP, length 1",
+			false,
+		},
+		{
+			"icmp",
+			testFrame(EtherTypeIPv4, testIPv4(ProtocolICMP, 8+4), []byte{8, 0, 0, 0, 0, 7, 0, 1}, payload[:4]),
+			"192.0.2.1 > 192.0.2.2: ICMP echo request, id 7, seq 1, length 4",
+			false,
+		},
+		{
+			"icmp6 over ipv4",
+			testFrame(EtherTypeIPv4, testIPv4(ProtocolICMPv6, 8), make([]byte, 8)),
+			"192.0.2.1 > 192.0.2.2: protocol 58, length 8",
+			false,
+		},
+		{
+			"arp",
+			testFrame(EtherTypeARP, []byte{0, 1, 8, 0, 6, 4, 0, 1}, make([]byte, 6), []byte{192, 0, 2, 1},
+				make([]byte, 6), []byte{192, 0, 2, 2}),
+			"ARP, who-has 192.0.2.2 tell 192.0.2.1",
+			false,
+		},
+		{
+			"other",
+			testFrame(0x88cc, make([]byte, 30)),
+			"02:00:00:00:00:01 > 02:00:00:00:00:02 ethertype 0x88cc, length 30",
+			false,
+		},
+		{
+			"truncated",
+			testFrame(EtherTypeIPv4, testIPv4(ProtocolTCP, 20), testTCP(80, 40000, TCPAck)[:10]),
+			"192.0.2.1 > 192.0.2.2: protocol 6, length 10",
+			true,
+		},
+	} {
+		p, err := DecodePacket(c.frame)
+		if (err != nil) != c.err {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if s := p.String(); s != c.expected {
+			t.Errorf("%s: expected %q; actual: %q", c.name, c.expected, s)
+		}
+	}
+
+	// The VLAN tag is looked through
+	tagged := testFrame(EtherTypeVLAN, []byte{0, 42, 0x08, 0}, testIPv4(ProtocolUDP, 8), testUDP(1, 2, 0))
+	if p, err := DecodePacket(tagged); err != nil || p.Ethernet.VLAN != 42 || p.UDP == nil {
+		t.Errorf("unexpected decoding of a tagged frame: %+v, %v", p, err)
+	}
+}
+
+func TestPacketMarshal(t *testing.T) {
+	// The header of the checksum example everyone uses, from Wikipedia
+	ip := IPv4Header{TotalLength: 0x73, Flags: 2, TTL: 64, Protocol: ProtocolUDP,
+		Src: net.IPv4(192, 168, 0, 1), Dst: net.IPv4(192, 168, 0, 199)}
+	if b, err := ip.MarshalBinary(); err != nil || binary.BigEndian.Uint16(b[10:]) != 0xb861 {
+		t.Errorf("expected checksum 0xb861; actual: % x, %v", b, err)
+	}
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	payload := []byte("Clear is better than clever.")
+	for _, p := range []*Packet{
+		{
+			Ethernet: EthernetHeader{Src: mac, Dst: mac},
+			IPv4:     &IPv4Header{TTL: 64, ID: 1, Src: net.IPv4(192, 0, 2, 1), Dst: net.IPv4(192, 0, 2, 2)},
+			TCP:      &TCPHeader{SrcPort: 40000, DstPort: 80, Seq: 1, Flags: TCPSyn, Window: 1024, Options: []byte{2, 4, 5, 0xb4}},
+		},
+		{
+			Ethernet: EthernetHeader{Src: mac, Dst: mac, VLAN: 42},
+			IPv4:     &IPv4Header{TTL: 64, Src: net.IPv4(192, 0, 2, 1), Dst: net.IPv4(192, 0, 2, 2)},
+			UDP:      &UDPHeader{SrcPort: 5353, DstPort: 53},
+			Payload:  payload,
+		},
+		{
+			Ethernet: EthernetHeader{Src: mac, Dst: mac},
+			IPv4:     &IPv4Header{TTL: 64, Src: net.IPv4(192, 0, 2, 1), Dst: net.IPv4(192, 0, 2, 2)},
+			ICMP:     &ICMPHeader{Type: icmpEchoRequest, Rest: 7<<16 | 1},
+			Payload:  payload,
+		},
+		{
+			Ethernet: EthernetHeader{Src: mac, Dst: mac},
+			IPv6:     &IPv6Header{HopLimit: 64, FlowLabel: 12345, Src: net.ParseIP("2001:db8::1"), Dst: net.ParseIP("2001:db8::2")},
+			UDP:      &UDPHeader{SrcPort: 5353, DstPort: 53},
+			Payload:  payload,
+		},
+		{
+			Ethernet: EthernetHeader{Src: mac, Dst: mac},
+			IPv6:     &IPv6Header{HopLimit: 255, Src: net.ParseIP("fe80::1"), Dst: net.ParseIP("ff02::1")},
+			ICMP:     &ICMPHeader{Type: icmpv6EchoRequest, Rest: 1},
+		},
+		{
+			Ethernet: EthernetHeader{Src: mac, Dst: net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+			ARP:      &ARPHeader{Operation: ARPRequest, SenderMAC: mac, SenderIP: net.IPv4(192, 0, 2, 1), TargetIP: net.IPv4(192, 0, 2, 2)},
+		},
+	} {
+		b, err := p.MarshalBinary()
+		if err != nil {
+			t.Errorf("%v: %v", p, err)
+			continue
+		}
+		decoded, err := DecodePacket(b)
+		if err != nil {
+			t.Errorf("%v: %v", p, err)
+			continue
+		}
+		if err := decoded.VerifyChecksums(); err != nil {
+			t.Errorf("%v: %v", p, err)
+		}
+		// What was set comes back, and what was filled in is there
+		if decoded.String() != p.String() || !bytes.Equal(decoded.Payload, p.Payload) || decoded.Ethernet.VLAN != p.Ethernet.VLAN {
+			t.Errorf("expected %v back; actual: %v", p, decoded)
+		}
+		if again, err := decoded.MarshalBinary(); err != nil || !bytes.Equal(again, b) {
+			t.Errorf("%v: expected the same bytes encoded again; actual: %v", p, err)
+		}
+
+		// A flipped bit in the payload fails the checksum
+		if len(p.Payload) > 0 {
+			b[len(b)-1] ^= 1
+			if decoded, _ := DecodePacket(b); decoded.VerifyChecksums() == nil {
+				t.Errorf("%v: expected a bad checksum", p)
+			}
+		}
+	}
+
+	for _, p := range []*Packet{
+		{IPv4: &IPv4Header{Src: net.ParseIP("2001:db8::1"), Dst: net.IPv4(192, 0, 2, 1)}},
+		{IPv6: &IPv6Header{Src: net.IPv4(192, 0, 2, 1), Dst: net.ParseIP("2001:db8::1")}},
+		{IPv4: &IPv4Header{Src: net.IPv4(192, 0, 2, 1), Dst: net.IPv4(192, 0, 2, 1)}, TCP: &TCPHeader{Options: []byte{1}}},
+		{Ethernet: EthernetHeader{Src: net.HardwareAddr{1, 2, 3}}},
+		{ARP: &ARPHeader{SenderIP: net.ParseIP("2001:db8::1"), TargetIP: net.IPv4(192, 0, 2, 1)}},
+	} {
+		if _, err := p.MarshalBinary(); err == nil {
+			t.Errorf("%+v: expected an error", p)
+		}
+	}
+}
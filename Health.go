@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Health and readiness
+//
+// Orchestrators ask a server two different questions, and it matters
+// which one fails:
+//
+// - /healthz, is the process alive? No means it's stuck or broken
+//   beyond repair, and the answer is to restart it. A listener whose
+//   service died (its socket gone) is that.
+// - /readyz, should it get traffic? No means leave it alone but route
+//   around it: it's still starting, shutting down, has a listener
+//   drained through the admin API, a reverse proxy still opening its
+//   warm connections, or one with no healthy backend left (as seen by
+//   its health checks). It comes back on its own once that's over.
+//
+// Restarting a server that's only unready would turn a backend outage
+// into a restart loop, so the two stay apart. Both answer 200 or 503
+// with the same report, for whoever wants to know why:
+//
+//	{"live": true, "ready": false, "listeners": {
+//	  "echo": {"state": "serving"},
+//	  "web":  {"state": "serving", "backends": {"http://10.0.0.1:8080": false}}}}
+//
+// They're served by the admin API (see Admin.go) without asking for its
+// token: probes rarely have one, and the report holds nothing secret.
+
+// Listener states
+const (
+	listenerStarting = "starting" // Not served yet
+	listenerWarming  = "warming"  // Opening connections to its upstreams
+	listenerServing  = "serving"
+	listenerDraining = "draining" // Finishing its connections
+	listenerDrained  = "drained"  // Stopped until the next reload
+	listenerFailed   = "failed"   // Its service returned an error
+)
+
+// HealthReport is the state of a server
+type HealthReport struct {
+	Live      bool                      `json:"live"`
+	Ready     bool                      `json:"ready"`
+	Listeners map[string]ListenerHealth `json:"listeners"`
+}
+
+// ListenerHealth is the state of a listener, and of its backends for
+// reverse proxies (by URL, true when healthy)
+type ListenerHealth struct {
+	State    string          `json:"state"`
+	Backends map[string]bool `json:"backends,omitempty"`
+}
+
+// healthHandler answers 200 when ok(report) holds, 503 otherwise
+func healthHandler(report func() HealthReport, ok func(HealthReport) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		r := report()
+		status := http.StatusOK
+		if !ok(r) {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeAdminJSON(w, status, r)
+	}
+}
+
+func TestServeHealth(t *testing.T) {
+	backend, backendServer := startBackend(t, "app")
+	cfg, err := parseConfig([]byte(`
+listeners:
+  - name: echo
+    kind: echo
+    addr: 127.0.0.1:0
+  - name: web
+    kind: reverse_proxy
+    addr: 127.0.0.1:0
+    backend: app
+    warm: 2
+backends:
+  app: [`+backend.URL.String()+`]
+`), ".yaml", func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newConfigServer(cfg, NewLevelLog(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.healthInterval = 10 * time.Millisecond
+	h := (&Admin{Health: s.Health, Token: "secret"}).Handler()
+	probe := func(path string) (int, HealthReport) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var r HealthReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, r
+	}
+	waitReady := func(expected bool) HealthReport {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+			_, r := probe("/readyz")
+			if r.Ready == expected {
+				return r
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected ready %t; actual: %+v", expected, r)
+			}
+		}
+	}
+
+	// Alive but not ready before serving, no token needed
+	if code, r := probe("/healthz"); code != 200 || r.Listeners["echo"].State != listenerStarting {
+		t.Errorf("unexpected health before serving %d %+v", code, r)
+	}
+	if code, _ := probe("/readyz"); code != 503 {
+		t.Errorf("expected not ready before serving; actual: %d", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	r := waitReady(true)
+	if r.Listeners["web"].Backends[backend.URL.String()] != true {
+		t.Errorf("expected a healthy backend; actual: %+v", r)
+	}
+
+	// Ready means warm: the connections wait in the pool
+	key, _ := upstreamKey(backend.URL)
+	DefaultUpstreamTransport.mu.Lock()
+	idle := len(DefaultUpstreamTransport.idle[key])
+	DefaultUpstreamTransport.mu.Unlock()
+	if idle < 2 {
+		t.Errorf("expected 2 warm connections; actual: %d", idle)
+	}
+
+	// The only backend going down takes readiness, not liveness
+	_ = backendServer.Close()
+	r = waitReady(false)
+	if !r.Live || r.Listeners["web"].Backends[backend.URL.String()] {
+		t.Errorf("unexpected report with the backend down %+v", r)
+	}
+
+	// A drained listener is reported until the next reload
+	if err := s.Drain(ctx, "echo"); err != nil {
+		t.Fatal(err)
+	}
+	if code, r := probe("/readyz"); code != 503 || r.Listeners["echo"].State != listenerDrained {
+		t.Errorf("unexpected report after draining %d %+v", code, r)
+	}
+
+	cancel()
+	<-done
+	if _, r := probe("/readyz"); r.Ready || r.Listeners["web"].State != listenerDraining {
+		t.Errorf("unexpected report after shutdown %+v", r)
+	}
+}
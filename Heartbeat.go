@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"testing"
 	"time"
 )
@@ -22,6 +24,26 @@ const defaultPingInterval = 30 * time.Second
 // - w: io.Writer to send "ping" messages to
 // - reset: Channel to receive new ping intervals
 func Pinger(ctx context.Context, w io.Writer, reset <-chan time.Duration) {
+	Heartbeat{}.Ping(ctx, w, reset)
+}
+
+// Heartbeat is a Pinger that counts its pings
+type Heartbeat struct {
+	// Metrics, when set, counts the pings sent and the ones that missed
+	// their write deadline in heartbeat_pings_total and
+	// heartbeat_missed_total, labelled with Name
+	Metrics *Metrics
+	Name    string
+}
+
+// Ping is Pinger, counting into h.Metrics
+func (h Heartbeat) Ping(ctx context.Context, w io.Writer, reset <-chan time.Duration) {
+	var sent, missed *Metric // nil when there are no metrics, doing nothing
+	if h.Metrics != nil {
+		sent = h.Metrics.Counter("heartbeat_pings_total", "Heartbeat pings sent.", "name").With(h.Name)
+		missed = h.Metrics.Counter("heartbeat_missed_total", "Heartbeat pings that missed their write deadline.", "name").With(h.Name)
+	}
+
 	var interval time.Duration // Stores the current ping interval
 
 	// Initial interval setup: check if a new interval is
@@ -41,12 +63,10 @@ func Pinger(ctx context.Context, w io.Writer, reset <-chan time.Duration) {
 
 	// Create a timer that fires after the specified interval
 	timer := time.NewTimer(interval)
-	// Ensure that the timer is stopped and drained on exit
-	defer func() {
-		if !timer.Stop() {
-			<-timer.C
-		}
-	}()
+	// Ensure that the timer is stopped on exit. (No draining: after a
+	// failed ping it has fired and been received already, and since Go
+	// 1.23 a stopped timer never delivers a stale value.)
+	defer timer.Stop()
 
 	// Main loop
 	for {
@@ -70,8 +90,12 @@ func Pinger(ctx context.Context, w io.Writer, reset <-chan time.Duration) {
 				// track and act on consecutive timeouts here
 				// If writing fails, exit
 				// (could track consecutive errors in a real app)
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					missed.Inc()
+				}
 				return
 			}
+			sent.Inc()
 		}
 
 		// Reset the timer to fire again after the current interval
@@ -84,8 +108,10 @@ func ExamplePinger() {
 	// Create a cancellable context to control the Pinger’s lifecycle
 	ctx, cancel := context.WithCancel(context.Background())
 
-	// Create a pipe for simulating network communication (reader and writer ends)
-	r, w := io.Pipe()
+	// Create a pipe for simulating network communication (reader and writer ends).
+	// It buffers a few pings, like a socket would: a ping sent after the
+	// last read doesn't block Pinger, which then sees cancel below.
+	r, w := NewBoundedPipe(16, 4)
 
 	// Channel to signal when Pinger is done
 	done := make(chan struct{})
@@ -138,6 +164,43 @@ func ExamplePinger() {
 	<-done
 }
 
+func TestHeartbeatMetrics(t *testing.T) {
+	m := new(Metrics)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	reset := make(chan time.Duration, 1)
+	reset <- 10 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		Heartbeat{Metrics: m, Name: "test"}.Ping(context.Background(), client, reset)
+		close(done)
+	}()
+
+	// Two pings read, then nobody reads: the third misses its deadline
+	// and stops the heartbeat
+	for i := 0; i < 2; i++ {
+		if b, err := ReadExactly(server, 4); err != nil || string(b) != "ping" {
+			t.Fatalf("unexpected ping %q: %v", b, err)
+		}
+	}
+	_ = client.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the heartbeat didn't stop")
+	}
+
+	vars := m.Vars()
+	if n := vars["heartbeat_pings_total"].(map[string]any)["name=test"]; n != 2.0 {
+		t.Errorf("expected 2 pings; actual: %v", n)
+	}
+	if n := vars["heartbeat_missed_total"].(map[string]any)["name=test"]; n != 1.0 {
+		t.Errorf("expected 1 missed ping; actual: %v", n)
+	}
+}
+
 // Each side of a network connection could use a
 // Pinger to advance its deadline if the other
 // side becomes idle, whereas the previous examples
@@ -158,11 +221,7 @@ func TestPingerAdvanceDeadline(t *testing.T) {
 	done := make(chan struct{})
 
 	// Start a TCP listener on localhost with an OS-assigned port.
-	listener, err := net.Listen("tcp", "127.0.0.1:")
-	if err != nil {
-		// Fail the test if the listener cannot be created.
-		t.Fatal(err)
-	}
+	listener := testListener(t)
 
 	// Record the start time for logging and calculating
 	// test duration.
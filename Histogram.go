@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Rolling latency histograms
+//
+// An average hides what users notice: a service answering 99 requests
+// in 1ms and one in 2s averages 21ms. Percentiles (p50, p99) show both,
+// and a histogram gives them for a fixed amount of memory: count each
+// observation in the bucket it falls into, then walk the buckets.
+//
+// The buckets grow exponentially, 50µs, 100µs, 200µs, ... up to about
+// 50s, so the relative error stays the same from loopback to
+// intercontinental latencies. Percentiles are interpolated within a
+// bucket, which is as precise as a histogram gets.
+//
+// Like rateWindow in the Monitor, the histogram only covers the recent
+// past: it's a ring of sub-histograms, each covering a slice of the
+// window and recycled once it falls out of it.
+
+const (
+	histogramBuckets  = 21 // Plus one for everything beyond the last bound
+	histogramSmallest = 50 * time.Microsecond
+	histogramSlots    = 10 // Sub-histograms per window
+)
+
+// histogramBounds are the bucket upper bounds
+var histogramBounds = func() []time.Duration {
+	bounds := make([]time.Duration, histogramBuckets)
+	for i := range bounds {
+		bounds[i] = histogramSmallest << i
+	}
+	return bounds
+}()
+
+// HistogramSnapshot is a histogram at a point in time
+type HistogramSnapshot struct {
+	Count  uint64
+	Sum    time.Duration
+	Max    time.Duration
+	Counts [histogramBuckets + 1]uint64 // Per bucket of histogramBounds
+}
+
+// Mean returns the average observation
+func (h HistogramSnapshot) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile estimates the q-quantile (0.5 for the median, 0.99 for p99)
+func (h HistogramSnapshot) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := q * float64(h.Count)
+
+	var seen float64
+	for i, n := range h.Counts {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+
+		// Interpolate linearly within the bucket
+		var lower, upper time.Duration
+		if i > 0 {
+			lower = histogramBounds[i-1]
+		}
+		if i < len(histogramBounds) {
+			upper = histogramBounds[i]
+		} else {
+			upper = max(h.Max, lower)
+		}
+		d := lower + time.Duration(float64(upper-lower)*(rank-seen)/float64(n))
+
+		return min(d, h.Max)
+	}
+
+	return h.Max
+}
+
+func (h *HistogramSnapshot) merge(o *HistogramSnapshot) {
+	h.Count += o.Count
+	h.Sum += o.Sum
+	h.Max = max(h.Max, o.Max)
+	for i := range h.Counts {
+		h.Counts[i] += o.Counts[i]
+	}
+}
+
+// MarshalJSON shows the figures people look at, in milliseconds
+func (h HistogramSnapshot) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 {
+		return math.Round(float64(d)/1e3) / 1e3
+	}
+
+	return json.Marshal(map[string]any{
+		"count":   h.Count,
+		"mean_ms": ms(h.Mean()),
+		"p50_ms":  ms(h.Quantile(0.5)),
+		"p90_ms":  ms(h.Quantile(0.9)),
+		"p99_ms":  ms(h.Quantile(0.99)),
+		"max_ms":  ms(h.Max),
+	})
+}
+
+// histogramSlot is one slice of the window
+type histogramSlot struct {
+	index int64 // Which slice of time it holds
+	HistogramSnapshot
+}
+
+// RollingHistogram is a latency histogram over a sliding window. The
+// zero value isn't usable; use NewRollingHistogram.
+type RollingHistogram struct {
+	mu    sync.Mutex
+	width time.Duration
+	slots [histogramSlots]histogramSlot
+}
+
+// NewRollingHistogram returns a histogram of the last window
+func NewRollingHistogram(window time.Duration) *RollingHistogram {
+	return &RollingHistogram{width: max(window/histogramSlots, time.Millisecond)}
+}
+
+// Observe records d as seen at now
+func (r *RollingHistogram) Observe(d time.Duration, now time.Time) {
+	index := now.UnixNano() / int64(r.width)
+
+	bucket := len(histogramBounds)
+	for i, bound := range histogramBounds {
+		if d <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	slot := &r.slots[index%histogramSlots]
+	if slot.index != index {
+		*slot = histogramSlot{index: index}
+	}
+	slot.Count++
+	slot.Sum += d
+	slot.Max = max(slot.Max, d)
+	slot.Counts[bucket]++
+}
+
+// Snapshot merges the slots still within the window ending at now
+func (r *RollingHistogram) Snapshot(now time.Time) HistogramSnapshot {
+	index := now.UnixNano() / int64(r.width)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var h HistogramSnapshot
+	for i := range r.slots {
+		if slot := &r.slots[i]; slot.index > index-histogramSlots && slot.index <= index {
+			h.merge(&slot.HistogramSnapshot)
+		}
+	}
+
+	return h
+}
+
+func TestRollingHistogram(t *testing.T) {
+	h := NewRollingHistogram(10 * time.Second)
+	now := time.Unix(1_000, 0)
+
+	// 99 fast observations and one slow one
+	for i := 0; i < 99; i++ {
+		h.Observe(time.Millisecond, now)
+	}
+	h.Observe(2*time.Second, now)
+
+	s := h.Snapshot(now)
+	if s.Count != 100 || s.Max != 2*time.Second {
+		t.Fatalf("unexpected snapshot %+v", s)
+	}
+	// 1ms falls into the (800µs, 1.6ms] bucket
+	if p50 := s.Quantile(0.5); p50 < 800*time.Microsecond || p50 > 1600*time.Microsecond {
+		t.Errorf("unexpected p50 %s", p50)
+	}
+	if p99 := s.Quantile(0.99); p99 > 1600*time.Microsecond {
+		t.Errorf("p99 should still be fast; actual: %s", p99)
+	}
+	if p999 := s.Quantile(0.999); p999 < time.Second {
+		t.Errorf("p99.9 should be slow; actual: %s", p999)
+	}
+	if mean := s.Mean(); mean < 20*time.Millisecond || mean > 22*time.Millisecond {
+		t.Errorf("unexpected mean %s", mean)
+	}
+
+	// Half a window later the old observations still count...
+	h.Observe(10*time.Millisecond, now.Add(5*time.Second))
+	if s := h.Snapshot(now.Add(5 * time.Second)); s.Count != 101 {
+		t.Errorf("expected 101 observations; actual: %d", s.Count)
+	}
+	// ...a full window later only the newer one does
+	if s := h.Snapshot(now.Add(10 * time.Second)); s.Count != 1 || s.Max != 10*time.Millisecond {
+		t.Errorf("expected 1 observation; actual: %+v", s)
+	}
+}
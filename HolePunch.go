@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// UDP hole punching
+//
+// Two peers behind NATs can't simply send each other packets: each NAT
+// drops incoming packets that don't belong to a "connection" one of its
+// hosts started. The trick is to make both NATs believe the other peer
+// is answering:
+//
+// 1. Both peers send a packet to a rendezvous server on the public
+//    internet. The server sees each peer's public address (the NAT
+//    mapping) and tells each one the other's address.
+// 2. Both peers start sending packets to each other's public address
+//    from the same socket they used to talk to the server. The first
+//    packets may be dropped by the other NAT, but they create a mapping
+//    in the sender's own NAT. As soon as both sides have sent one, the
+//    packets from the other side look like replies and get through.
+//
+// This works with most home NATs (which keep the same mapping for every
+// destination), not with "symmetric" NATs that pick a new public port
+// per destination.
+//
+// Peers behind the same NAT often can't reach each other through its
+// public address (hairpinning), so each peer also registers its private
+// address and punching targets both; whichever answers first wins.
+//
+// The rendezvous server also answers STUN binding requests on the same
+// port, which the client uses to learn its own public address first.
+//
+// Messages are text over UDP:
+//
+//	client -> server: REGISTER <session> <private addr>
+//	server -> client: PEER <public addr> <private addr>
+//	peer   -> peer:   PUNCH <session>
+
+const (
+	rendezvousTTL    = 30 * time.Second      // Registrations expire unless refreshed
+	punchInterval    = 50 * time.Millisecond // Between REGISTER/PUNCH retries
+	punchControlPref = "\x00PUNCH "          // Leading NUL keeps it apart from payloads
+)
+
+// RendezvousServer pairs up peers registering with the same session
+type RendezvousServer struct {
+	mu       sync.Mutex
+	sessions map[string]map[string]rendezvousPeer // session -> public addr -> peer
+}
+
+type rendezvousPeer struct {
+	public  *net.UDPAddr
+	private string
+	seen    time.Time
+}
+
+// Handle is the server's PacketHandler
+func (s *RendezvousServer) Handle(ctx context.Context, pc net.PacketConn, addr net.Addr, packet []byte) {
+	if !bytes.HasPrefix(packet, []byte("REGISTER ")) {
+		STUNHandler(ctx, pc, addr, packet)
+		return
+	}
+
+	fields := strings.Fields(string(packet))
+	public, ok := addr.(*net.UDPAddr)
+	if len(fields) != 3 || !ok {
+		return
+	}
+	session, private := fields[1], fields[2]
+
+	other, found := s.register(session, rendezvousPeer{public: public, private: private, seen: time.Now()})
+	if !found {
+		// Nobody to pair with yet; the client keeps registering
+		return
+	}
+
+	// Introduce them to each other
+	_, _ = pc.WriteTo([]byte(fmt.Sprintf("PEER %s %s", other.public, other.private)), public)
+	_, _ = pc.WriteTo([]byte(fmt.Sprintf("PEER %s %s", public, private)), other.public)
+}
+
+// register records p and returns another live peer of the session
+func (s *RendezvousServer) register(session string, p rendezvousPeer) (rendezvousPeer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]map[string]rendezvousPeer)
+	}
+	peers := s.sessions[session]
+	if peers == nil {
+		peers = make(map[string]rendezvousPeer)
+		s.sessions[session] = peers
+	}
+	peers[p.public.String()] = p
+
+	var other rendezvousPeer
+	found := false
+	for key, peer := range peers {
+		if p.seen.Sub(peer.seen) > rendezvousTTL {
+			delete(peers, key)
+			continue
+		}
+		if key != p.public.String() {
+			other, found = peer, true
+		}
+	}
+
+	return other, found
+}
+
+// PunchResult is the outcome of a successful Punch
+type PunchResult struct {
+	Conn   net.Conn     // Talks to the peer over the punched socket
+	Public *net.UDPAddr // Our public address according to the server
+}
+
+// Punch registers with the rendezvous server under session, waits for
+// the other peer and punches a hole to it. pc must not be used for
+// anything else while Punch runs; afterwards, use the returned Conn.
+func Punch(ctx context.Context, pc net.PacketConn, rendezvous, session string) (*PunchResult, error) {
+	server, err := net.ResolveUDPAddr("udp", rendezvous)
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := STUNBinding(ctx, pc, rendezvous)
+	if err != nil {
+		return nil, fmt.Errorf("learning public address: %w", err)
+	}
+
+	private, err := privateAddr(pc, server)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deadlines make the reads below come back regularly to resend
+	defer func() { _ = pc.SetReadDeadline(time.Time{}) }()
+
+	// Phase 1: register until the server introduces the peer
+	register := []byte(fmt.Sprintf("REGISTER %s %s", session, private))
+	var candidates []*net.UDPAddr
+	for candidates == nil {
+		if _, err := pc.WriteTo(register, server); err != nil {
+			return nil, err
+		}
+
+		_ = pc.SetReadDeadline(time.Now().Add(punchInterval))
+		candidates, err = readPeer(pc, server)
+		if err != nil {
+			return nil, err
+		}
+		if candidates == nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	// Phase 2: send PUNCH to every candidate until one gets through
+	punch := []byte(punchControlPref + session)
+	buf := make([]byte, 1500)
+	for {
+		for _, c := range candidates {
+			_, _ = pc.WriteTo(punch, c)
+		}
+
+		_ = pc.SetReadDeadline(time.Now().Add(punchInterval))
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if IsTimeout(err) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(buf[:n], punch) {
+				// E.g. a duplicate PEER from the server
+				continue
+			}
+
+			peer := from.(*net.UDPAddr)
+			// Make sure the peer hears from us at least once more at
+			// the address that works
+			_, _ = pc.WriteTo(punch, peer)
+
+			return &PunchResult{Conn: &peerConn{PacketConn: pc, peer: peer}, Public: public}, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// privateAddr returns the address the peer can use to reach pc on the
+// local network: pc's port on the interface that routes to server
+func privateAddr(pc net.PacketConn, server *net.UDPAddr) (string, error) {
+	local, ok := pc.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return "", errors.New("punch: not a UDP socket")
+	}
+	if !local.IP.IsUnspecified() {
+		return local.String(), nil
+	}
+
+	// Dialing UDP sends nothing, it only picks the route
+	probe, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		return "", err
+	}
+	defer probe.Close()
+
+	ip := probe.LocalAddr().(*net.UDPAddr).IP
+	return (&net.UDPAddr{IP: ip, Port: local.Port}).String(), nil
+}
+
+// readPeer reads until a PEER message from server or the read deadline.
+// It returns nil candidates on timeout.
+func readPeer(pc net.PacketConn, server *net.UDPAddr) ([]*net.UDPAddr, error) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if IsTimeout(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		fields := strings.Fields(string(buf[:n]))
+		if from.String() != server.String() || len(fields) != 3 || fields[0] != "PEER" {
+			continue
+		}
+
+		var candidates []*net.UDPAddr
+		for _, a := range fields[1:] {
+			if addr, err := net.ResolveUDPAddr("udp", a); err == nil {
+				candidates = append(candidates, addr)
+			}
+		}
+		if len(candidates) > 0 {
+			return candidates, nil
+		}
+	}
+}
+
+// peerConn is a net.Conn over a PacketConn, talking to a single peer.
+// Packets from anyone else and leftover PUNCH messages are dropped.
+type peerConn struct {
+	net.PacketConn
+	peer *net.UDPAddr
+}
+
+func (c *peerConn) Read(p []byte) (int, error) {
+	for {
+		n, from, err := c.ReadFrom(p)
+		if err != nil {
+			return n, err
+		}
+		if from.String() != c.peer.String() || bytes.HasPrefix(p[:n], []byte(punchControlPref)) {
+			continue
+		}
+
+		return n, nil
+	}
+}
+
+func (c *peerConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.peer)
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+func TestPunch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	server := testPacketConn(t)
+	rendezvous := new(RendezvousServer)
+	go func() { _ = ServePacket(ctx, server, rendezvous.Handle) }()
+
+	type result struct {
+		res *PunchResult
+		err error
+	}
+	results := make(chan result, 2)
+	var sockets []net.PacketConn
+	for i := 0; i < 2; i++ {
+		pc := testPacketConn(t)
+		sockets = append(sockets, pc)
+
+		go func() {
+			res, err := Punch(ctx, pc, server.LocalAddr().String(), "game-42")
+			results <- result{res, err}
+		}()
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		conns = append(conns, r.res.Conn)
+	}
+
+	// Each peer is connected to the other's socket
+	for i, c := range conns {
+		local := c.(*peerConn).LocalAddr().String()
+		if remote := conns[1-i].RemoteAddr().String(); remote != local {
+			t.Errorf("peer %d: expected other side to talk to %s; actual: %s", i, local, remote)
+		}
+	}
+
+	// And data flows, without leftover PUNCH messages in between
+	if _, err := conns[0].Write([]byte("hello peer")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conns[1].SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 32)
+	n, err := conns[1].Read(buf)
+	if err != nil || string(buf[:n]) != "hello peer" {
+		t.Errorf("expected payload; actual: %q, %v", buf[:n], err)
+	}
+}
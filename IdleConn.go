@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Idle timeout connection wrapper
+//
+// TestDeadline shows the pattern by hand: set a deadline, read, and push
+// the deadline forward every time data arrives. IdleConn does the same
+// for any net.Conn so the proxy, the TLV code and the echo servers don't
+// have to repeat it.
+//
+// - ReadTimeout bounds a single Read call
+// - WriteTimeout bounds a single Write call
+// - IdleTimeout bounds the time since the last successful Read or Write
+//   in either direction
+//
+// Deadlines are re-armed before every operation. A Read or Write
+// blocked until the idle deadline while the other direction moved data,
+// a proxy pushing to a client that says nothing, is re-armed and keeps
+// waiting: the connection wasn't idle. When the idle deadline is what
+// stopped an operation, the error is an *IdleError, which matches
+// ErrIdle with errors.Is, instead of a generic i/o timeout.
+//
+// Deadlines set by the caller still count: re-arming picks the earliest
+// of the caller's deadline and the timeouts, so wrapping a conn in an
+// IdleConn never extends a deadline someone else relies on.
+
+// ErrIdle is matched by errors returned when a connection went idle
+var ErrIdle = errors.New("connection idle")
+
+// IdleError is returned by IdleConn when IdleTimeout expired
+type IdleError struct {
+	Op   string        // "read" or "write"
+	Idle time.Duration // How long the connection had been idle
+}
+
+func (e *IdleError) Error() string {
+	return fmt.Sprintf("%s: connection idle for %s", e.Op, e.Idle.Round(time.Millisecond))
+}
+
+// Is makes errors.Is(err, ErrIdle) true for an IdleError
+func (e *IdleError) Is(target error) bool { return target == ErrIdle }
+
+// Timeout and Temporary let an IdleError be used as a net.Error
+func (e *IdleError) Timeout() bool   { return true }
+func (e *IdleError) Temporary() bool { return false }
+
+// IdleConn wraps a net.Conn with per-operation and idle timeouts.
+// A zero timeout disables that particular limit.
+type IdleConn struct {
+	net.Conn
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// lastActivity is the time of the last successful operation
+	// in Unix nanoseconds
+	lastActivity atomic.Int64
+
+	// Deadlines set with SetDeadline and friends in Unix nanoseconds,
+	// 0 for none
+	readDeadline, writeDeadline atomic.Int64
+}
+
+// NewIdleConn wraps conn so it fails with an IdleError once no data
+// moved in either direction for idle
+func NewIdleConn(conn net.Conn, idle time.Duration) *IdleConn {
+	c := &IdleConn{Conn: conn, IdleTimeout: idle}
+	c.touch(time.Now())
+
+	return c
+}
+
+// touch records a successful operation
+func (c *IdleConn) touch(now time.Time) {
+	c.lastActivity.Store(now.UnixNano())
+}
+
+// storeDeadline remembers a deadline set by the caller
+func storeDeadline(d *atomic.Int64, t time.Time) {
+	if t.IsZero() {
+		d.Store(0)
+		return
+	}
+	d.Store(t.UnixNano())
+}
+
+// SetDeadline sets the caller's read and write deadlines
+func (c *IdleConn) SetDeadline(t time.Time) error {
+	storeDeadline(&c.readDeadline, t)
+	storeDeadline(&c.writeDeadline, t)
+
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the caller's read deadline. It applies right
+// away, so it interrupts a blocked Read.
+func (c *IdleConn) SetReadDeadline(t time.Time) error {
+	storeDeadline(&c.readDeadline, t)
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the caller's write deadline
+func (c *IdleConn) SetWriteDeadline(t time.Time) error {
+	storeDeadline(&c.writeDeadline, t)
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// arm computes the deadline for an operation started at start from the
+// timeout and the caller's deadline. It returns the deadline and whether
+// the idle timeout is the one that will fire.
+func (c *IdleConn) arm(start time.Time, timeout time.Duration, user *atomic.Int64) (time.Time, bool) {
+	// A connection used without the constructor starts its idle
+	// clock with the first operation
+	if c.lastActivity.Load() == 0 {
+		c.touch(start)
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = start.Add(timeout)
+	}
+	if u := user.Load(); u != 0 {
+		if userDeadline := time.Unix(0, u); deadline.IsZero() || userDeadline.Before(deadline) {
+			deadline = userDeadline
+		}
+	}
+
+	idle := false
+	if c.IdleTimeout > 0 {
+		last := time.Unix(0, c.lastActivity.Load())
+		if idleDeadline := last.Add(c.IdleTimeout); deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+			idle = true
+		}
+	}
+
+	return deadline, idle
+}
+
+// translate turns a timeout caused by the idle deadline into an
+// IdleError. The caller may have moved its own deadline in the meantime,
+// so the idle period must really be over.
+func (c *IdleConn) translate(op string, err error, idle bool) error {
+	var nErr net.Error
+	if idle && errors.As(err, &nErr) && nErr.Timeout() {
+		last := time.Unix(0, c.lastActivity.Load())
+		if idle := time.Since(last); idle >= c.IdleTimeout {
+			return &IdleError{Op: op, Idle: idle}
+		}
+	}
+
+	return err
+}
+
+// busy reports whether err, returned by translate for an operation
+// armed with the idle deadline, is that deadline firing on a connection
+// the other direction kept busy, so the operation may go on
+func (c *IdleConn) busy(err error, idle bool, user *atomic.Int64) bool {
+	var nErr net.Error
+	if !idle || errors.Is(err, ErrIdle) || !errors.As(err, &nErr) || !nErr.Timeout() {
+		return false
+	}
+	// Unless the caller's own deadline is the one that passed
+	u := user.Load()
+
+	return u == 0 || time.Now().Before(time.Unix(0, u))
+}
+
+// Read re-arms the read deadline and reads from the connection
+func (c *IdleConn) Read(p []byte) (int, error) {
+	start := time.Now()
+	for {
+		deadline, idle := c.arm(start, c.ReadTimeout, &c.readDeadline)
+		if err := c.Conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.touch(time.Now())
+		}
+		err = c.translate("read", err, idle)
+		if n == 0 && c.busy(err, idle, &c.readDeadline) {
+			continue
+		}
+
+		return n, err
+	}
+}
+
+// Write re-arms the write deadline and writes to the connection
+func (c *IdleConn) Write(p []byte) (int, error) {
+	start := time.Now()
+	var written int
+	for {
+		deadline, idle := c.arm(start, c.WriteTimeout, &c.writeDeadline)
+		if err := c.Conn.SetWriteDeadline(deadline); err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(p[written:])
+		if n > 0 {
+			c.touch(time.Now())
+		}
+		written += n
+		err = c.translate("write", err, idle)
+		if written < len(p) && c.busy(err, idle, &c.writeDeadline) {
+			continue
+		}
+
+		return written, err
+	}
+}
+
+func TestIdleConn(t *testing.T) {
+	listener := testListener(t)
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+
+		c := NewIdleConn(conn, 200*time.Millisecond)
+		buf := make([]byte, 1)
+
+		// Keep reading; each byte the client sends re-arms the
+		// idle timeout, the silence afterwards trips it
+		for {
+			if _, err := c.Read(buf); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Stay active for longer than the idle timeout in total
+	begin := time.Now()
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := conn.Write([]byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = <-errs
+	if !errors.Is(err, ErrIdle) {
+		t.Fatalf("expected idle error; actual: %v", err)
+	}
+
+	// It still looks like a timeout to code that only knows net.Error
+	var nErr net.Error
+	if !errors.As(err, &nErr) || !nErr.Timeout() {
+		t.Errorf("expected a net.Error timeout; actual: %v", err)
+	}
+
+	// 3 writes 100ms apart plus the 200ms idle period
+	if elapsed := time.Since(begin); elapsed < 500*time.Millisecond {
+		t.Errorf("connection went idle too early: %s", elapsed)
+	}
+}
+
+func TestIdleConnOneWay(t *testing.T) {
+	client, server := tcpPair(t)
+	c := NewIdleConn(server, 100*time.Millisecond)
+
+	// The server blocks in Read while it writes, to a client that reads
+	// nothing and says nothing
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		errs <- err
+	}()
+
+	begin := time.Now()
+	for time.Since(begin) < 400*time.Millisecond {
+		if _, err := c.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-errs:
+			t.Fatalf("read failed while the server was writing: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// Once the writes stop, the connection goes idle
+	stopped := time.Now()
+	if err := <-errs; !errors.Is(err, ErrIdle) {
+		t.Errorf("expected idle error; actual: %v", err)
+	}
+	if elapsed := time.Since(stopped); elapsed > time.Second {
+		t.Errorf("idle read took %s", elapsed)
+	}
+
+	// The caller's deadline still ends the read with a plain timeout
+	_, _ = client.Write([]byte("y"))
+	_ = c.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := c.Read(make([]byte, 1)); errors.Is(err, ErrIdle) || !IsTimeout(err) {
+		t.Errorf("expected a plain timeout; actual: %v", err)
+	}
+}
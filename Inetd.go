@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// inetd services
+//
+// Before every daemon listened on its own ports, inetd listened on all
+// of them, from a table in /etc/inetd.conf, and started the program of
+// a port for each connection with the socket as its standard input and
+// output. It also answered a few trivial services itself, handy for
+// testing a network by hand with telnet or nc:
+//
+// - echo (port 7, RFC 862): sends back what it receives
+// - discard (port 9, RFC 863): throws away what it receives
+// - daytime (port 13, RFC 867): the date and time, human readable
+// - chargen (port 19, RFC 864): characters, as fast as they're read
+//
+// The listeners of "golearn serve" (Serve.go) are such a table: each of
+// these services is a listener kind, over TCP or UDP (chargen TCP only:
+// a reply far larger than a spoofed datagram is an amplifier), and so
+// is exec, which runs a command per connection the way inetd does. The
+// command reads the client from its standard input and answers on its
+// standard output; its standard error goes to the logs. The client's
+// and the listener's addresses are in the environment, named as UCSPI
+// (tcpserver) names them: TCPREMOTEIP, TCPREMOTEPORT, TCPLOCALIP and
+// TCPLOCALPORT.
+//
+//	listeners:
+//	  - name: daytime
+//	    kind: daytime
+//	    network: udp
+//	    addr: :13
+//	  - name: finger
+//	    kind: exec
+//	    addr: :79
+//	    command: [/usr/sbin/in.fingerd]
+
+const (
+	chargenLineLen = 72
+	chargenChars   = 95 // The printable ASCII, ' ' to '~'
+
+	// execWaitDelay is how long a command that exited gets to hand
+	// over its last output, the processes it started holding its
+	// standard output open, before the connection is closed
+	execWaitDelay = time.Second
+)
+
+// discardConn reads until the client hangs up or the server stops
+func discardConn(ctx context.Context, conn net.Conn) {
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// discardPacket ignores a datagram
+func discardPacket(context.Context, net.PacketConn, net.Addr, []byte) {}
+
+// daytime is the answer of the daytime service
+func daytime() []byte {
+	return []byte(time.Now().Format("Monday, January 2, 2006 15:04:05-MST") + "\r\n")
+}
+
+// daytimeConn sends the date and time, and hangs up
+func daytimeConn(_ context.Context, conn net.Conn) {
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write(daytime())
+}
+
+// daytimePacket answers any datagram with the date and time
+func daytimePacket(_ context.Context, pc net.PacketConn, addr net.Addr, _ []byte) {
+	_, _ = pc.WriteTo(daytime(), addr)
+}
+
+// chargenLine returns the line n of chargen's output: 72 of the
+// printable characters, each line starting one further than the last
+func chargenLine(n int) []byte {
+	line := make([]byte, chargenLineLen+2)
+	for i := range chargenLineLen {
+		line[i] = ' ' + byte((n+i)%chargenChars)
+	}
+	copy(line[chargenLineLen:], "\r\n")
+
+	return line
+}
+
+// chargenConn sends lines until the client hangs up or the server
+// stops; what the client sends is thrown away
+func chargenConn(ctx context.Context, conn net.Conn) {
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	go func() { _, _ = io.Copy(io.Discard, conn) }()
+
+	w := bufio.NewWriter(conn)
+	for n := 0; ; n++ {
+		if _, err := w.Write(chargenLine(n)); err != nil {
+			return
+		}
+	}
+}
+
+// execConn returns a handler running the command in argv, which
+// returns it, for every connection, with the connection as its
+// standard input and output
+func execConn(argv func() []string, errorLog *log.Logger) ConnHandler {
+	return func(ctx context.Context, conn net.Conn) {
+		args := argv()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdout = conn
+		cmd.Stderr = &logWriter{log: errorLog, prefix: fmt.Sprintf("%s: %s: ", args[0], conn.RemoteAddr())}
+		cmd.Env = append(os.Environ(), ucspiEnv(conn)...)
+		cmd.WaitDelay = execWaitDelay
+
+		// Not cmd.Stdin: Wait would wait for the client to stop
+		// sending. The copy ends when the connection is closed.
+		stdin, err := cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			logTo(errorLog, "%s: %s: %v", args[0], conn.RemoteAddr(), err)
+			return
+		}
+		go func() {
+			_, _ = io.Copy(stdin, conn)
+			_ = stdin.Close()
+		}()
+
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			logTo(errorLog, "%s: %s: %v", args[0], conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// ucspiEnv returns the addresses of conn as the environment of an UCSPI
+// tcpserver program
+func ucspiEnv(conn net.Conn) []string {
+	var env []string
+	for _, a := range []struct {
+		name string
+		addr net.Addr
+	}{{"REMOTE", conn.RemoteAddr()}, {"LOCAL", conn.LocalAddr()}} {
+		host, port, err := net.SplitHostPort(a.addr.String())
+		if err != nil {
+			continue // A unix socket
+		}
+		env = append(env, "TCP"+a.name+"IP="+host, "TCP"+a.name+"PORT="+port)
+	}
+	env = append(env, "PROTO=TCP")
+
+	return env
+}
+
+// logWriter logs what's written to it, a line at a time
+type logWriter struct {
+	log    *log.Logger
+	prefix string
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		logTo(w.log, "%s%s", w.prefix, line)
+	}
+
+	return len(p), nil
+}
+
+// logTo logs to l, or to the standard logger when l is nil
+func logTo(l *log.Logger, format string, v ...any) {
+	if l != nil {
+		l.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+func TestChargenLine(t *testing.T) {
+	first := string(chargenLine(0))
+	if !strings.HasPrefix(first, ` !"#$%&'()*+,-./0123`) || !strings.HasSuffix(first, "efg\r\n") || len(first) != 74 {
+		t.Errorf("unexpected first line %q", first)
+	}
+	// The line after the last character wraps around to the first
+	if line := string(chargenLine(94)); !strings.HasPrefix(line, "~ !\"") {
+		t.Errorf("unexpected line 94 %q", line)
+	}
+	if string(chargenLine(95)) != first {
+		t.Error("expected line 95 to be the first again")
+	}
+}
+
+func TestInetd(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell:", err)
+	}
+
+	config := func(greeting string) *Config {
+		t.Helper()
+		cfg, err := parseConfig([]byte(fmt.Sprintf(`
+listeners:
+  - name: discard
+    kind: discard
+    addr: 127.0.0.1:0
+  - name: daytime
+    kind: daytime
+    addr: 127.0.0.1:0
+  - name: daytime-udp
+    kind: daytime
+    network: udp
+    addr: 127.0.0.1:0
+  - name: chargen
+    kind: chargen
+    addr: 127.0.0.1:0
+  - name: hello
+    kind: exec
+    addr: 127.0.0.1:0
+    command: [%s, -c, 'read name; echo %s $name from $TCPREMOTEIP; echo oops >&2']
+`, sh, greeting)), ".yaml", func(string) (string, bool) { return "", false })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	var logs strings.Builder
+	s, err := newConfigServer(config("hello"), NewLevelLog(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	dial := func(name string) net.Conn {
+		t.Helper()
+		conn, err := net.Dial(s.Addr(name).Network(), s.Addr(name).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		return conn
+	}
+	year := strconv.Itoa(time.Now().Year())
+
+	// daytime over TCP hangs up after the date, over UDP answers any
+	// datagram
+	conn := dial("daytime")
+	if b, err := io.ReadAll(conn); err != nil || !strings.Contains(string(b), year) || !strings.HasSuffix(string(b), "\r\n") {
+		t.Errorf("unexpected daytime %q, %v", b, err)
+	}
+	_ = conn.Close()
+	conn = dial("daytime-udp")
+	_, _ = conn.Write([]byte("?"))
+	b := make([]byte, 128)
+	if n, err := conn.Read(b); err != nil || !strings.Contains(string(b[:n]), year) {
+		t.Errorf("unexpected daytime %q, %v", b[:n], err)
+	}
+	_ = conn.Close()
+
+	// chargen streams lines
+	conn = dial("chargen")
+	r := bufio.NewReader(conn)
+	for n := range 3 {
+		if line, err := r.ReadString('\n'); err != nil || line != string(chargenLine(n)) {
+			t.Errorf("unexpected chargen line %d %q, %v", n, line, err)
+		}
+	}
+	_ = conn.Close()
+
+	// discard takes anything and says nothing
+	conn = dial("discard")
+	_, _ = conn.Write([]byte("into the void"))
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Read(b); n != 0 || !os.IsTimeout(err) {
+		t.Errorf("expected silence; actual: %q, %v", b[:n], err)
+	}
+	_ = conn.Close()
+
+	// exec runs the command per connection, the one of the current
+	// configuration
+	for _, greeting := range []string{"hello", "bonjour"} {
+		if greeting != "hello" {
+			if err := s.Reload(config(greeting)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		conn = dial("hello")
+		_, _ = conn.Write([]byte("gopher\n"))
+		expected := greeting + " gopher from 127.0.0.1\n"
+		if b, err := io.ReadAll(conn); err != nil || string(b) != expected {
+			t.Errorf("expected %q; actual: %q, %v", expected, b, err)
+		}
+		_ = conn.Close()
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(logs.String(), ": oops") {
+		t.Errorf("expected the standard error in the logs; actual: %q", logs.String())
+	}
+}
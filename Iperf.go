@@ -0,0 +1,640 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Bandwidth measurement, iperf style
+//
+// How fast is the path between two machines? Push as much data as TCP
+// will take for a few seconds and count what arrives. A single stream is
+// often limited by its window (bandwidth-delay product), so several
+// streams in parallel show what the link itself can do.
+//
+// TCP: the client sends a header, mode (1) | duration (8), then either
+//
+// - sends for the duration and half-closes; the server counts what it
+//   received and answers with the total (8), so the result is what
+//   actually arrived, not what left the client's socket buffer
+// - or, with Reverse, reads what the server sends for the duration
+//
+// We can't see TCP retransmissions from user space (ss -ti or
+// TCP_INFO can), but their effect shows: when segments are lost the
+// congestion window shrinks, the socket buffer fills up and Write
+// blocks. Writes that block longer than StallThreshold are counted as
+// stalls.
+//
+// UDP has no congestion control, so the client sends at a fixed
+// Bitrate instead, each datagram carrying:
+//
+//	session (4) | sequence (8) | send time (8) | padding
+//
+// The server counts what arrives and tracks jitter, the variation in
+// transit time, as RTP does (RFC 3550): J += (|D| - J) / 16, where D is
+// the difference between consecutive transit times. The clocks of the
+// two machines needn't agree; the offset cancels out in D. A final
+// datagram with sequence iperfFin asks for the report:
+//
+//	session (4) | received (8) | jitter in ns (8)
+
+const (
+	iperfSink   = 'S' // Server receives
+	iperfSource = 'R' // Server sends
+
+	iperfDefaultPort     = "5201"
+	iperfBufferSize      = 128 << 10
+	iperfHeaderTimeout   = 5 * time.Second
+	iperfGrace           = 5 * time.Second // Past the test's duration
+	iperfMaxDuration     = time.Hour
+	iperfUDPHeaderSize   = 4 + 8 + 8
+	iperfReportSize      = 4 + 8 + 8
+	iperfFin             = ^uint64(0)
+	iperfFinAttempts     = 5
+	iperfFinTimeout      = 200 * time.Millisecond
+	iperfSettle          = 50 * time.Millisecond // For the last datagrams to land
+	iperfSessionLifetime = time.Minute
+
+	defaultIperfDuration   = 10 * time.Second
+	defaultIperfBitrate    = 1_000_000 // bits/s
+	defaultIperfPacketSize = 1400      // Fits an Ethernet MTU
+	defaultIperfStall      = 50 * time.Millisecond
+)
+
+// IperfResult is the outcome of a test
+type IperfResult struct {
+	Protocol string
+	Streams  int
+	Bytes    int64         // Payload bytes that arrived
+	Elapsed  time.Duration // Longest stream
+
+	// TCP
+	Stalls int // Writes blocked longer than the stall threshold
+
+	// UDP
+	Sent     int64 // Datagrams
+	Received int64
+	Jitter   time.Duration
+}
+
+// Mbps is the throughput in megabits per second
+func (r IperfResult) Mbps() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(r.Bytes) * 8 / r.Elapsed.Seconds() / 1e6
+}
+
+// Loss is the fraction of UDP datagrams lost
+func (r IperfResult) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+
+	return float64(r.Sent-min(r.Received, r.Sent)) / float64(r.Sent)
+}
+
+func (r IperfResult) String() string {
+	s := fmt.Sprintf("%s, %d stream(s): %d bytes in %s, %.2f Mbps",
+		r.Protocol, r.Streams, r.Bytes, r.Elapsed.Round(time.Millisecond), r.Mbps())
+	if r.Protocol == "udp" {
+		return s + fmt.Sprintf(", %d/%d datagrams lost (%.1f%%), jitter %s",
+			r.Sent-min(r.Received, r.Sent), r.Sent, r.Loss()*100, r.Jitter)
+	}
+
+	return s + fmt.Sprintf(", %d write stalls", r.Stalls)
+}
+
+// IperfServer sinks and sources test traffic
+type IperfServer struct {
+	// ErrorLog receives errors of the tests
+	ErrorLog *log.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*iperfSession
+}
+
+// iperfSession is the state of a UDP test
+type iperfSession struct {
+	received int64
+	transit  int64   // Of the last datagram, ns
+	jitter   float64 // ns
+	last     time.Time
+}
+
+func (s *IperfServer) logf(format string, v ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// ServeConn runs a TCP test; it's a ConnHandler
+func (s *IperfServer) ServeConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	_ = conn.SetReadDeadline(time.Now().Add(iperfHeaderTimeout))
+	header, err := ReadExactly(conn, 9)
+	if err != nil {
+		return
+	}
+	d := time.Duration(binary.BigEndian.Uint64(header[1:]))
+	if d <= 0 || d > iperfMaxDuration {
+		s.logf("iperf: %s: invalid duration %s", conn.RemoteAddr(), d)
+		return
+	}
+
+	switch header[0] {
+	case iperfSink:
+		_ = conn.SetReadDeadline(time.Now().Add(d + iperfGrace))
+		n, err := sink(conn)
+		if err != nil {
+			s.logf("iperf: %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(iperfHeaderTimeout))
+		_, _ = conn.Write(binary.BigEndian.AppendUint64(nil, uint64(n)))
+	case iperfSource:
+		end := time.Now().Add(d)
+		_ = conn.SetWriteDeadline(end.Add(iperfGrace))
+		buf := make([]byte, iperfBufferSize)
+		for time.Now().Before(end) {
+			if _, err := conn.Write(buf); err != nil {
+				s.logf("iperf: %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	default:
+		s.logf("iperf: %s: unknown mode %q", conn.RemoteAddr(), header[0])
+	}
+}
+
+// sink reads r to the end and returns how much it read
+func sink(r io.Reader) (int64, error) {
+	// Bigger reads than io.Discard's 8 KB mean fewer system calls
+	buf := make([]byte, iperfBufferSize)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// HandlePacket counts a UDP test datagram or answers a report request;
+// it's a PacketHandler. ServePacket runs handlers concurrently, so
+// datagrams may be counted out of order: the report has no reordering
+// figure.
+func (s *IperfServer) HandlePacket(_ context.Context, pc net.PacketConn, addr net.Addr, p []byte) {
+	arrival := time.Now()
+	if len(p) < iperfUDPHeaderSize {
+		return
+	}
+	id := binary.BigEndian.Uint32(p)
+	seq := binary.BigEndian.Uint64(p[4:])
+	sent := int64(binary.BigEndian.Uint64(p[12:]))
+	key := addr.String() + "/" + strconv.FormatUint(uint64(id), 16)
+
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*iperfSession)
+	}
+	sess := s.sessions[key]
+	if sess == nil {
+		// Forget sessions that ended long ago; their clients may have
+		// needed a few report requests but are gone now
+		for k, old := range s.sessions {
+			if arrival.Sub(old.last) > iperfSessionLifetime {
+				delete(s.sessions, k)
+			}
+		}
+		sess = &iperfSession{}
+		s.sessions[key] = sess
+	}
+	sess.last = arrival
+
+	if seq == iperfFin {
+		report := make([]byte, iperfReportSize)
+		binary.BigEndian.PutUint32(report, id)
+		binary.BigEndian.PutUint64(report[4:], uint64(sess.received))
+		binary.BigEndian.PutUint64(report[12:], uint64(sess.jitter))
+		s.mu.Unlock()
+		_, _ = pc.WriteTo(report, addr)
+		return
+	}
+
+	transit := arrival.UnixNano() - sent
+	if sess.received > 0 {
+		d := float64(transit - sess.transit)
+		if d < 0 {
+			d = -d
+		}
+		sess.jitter += (d - sess.jitter) / 16
+	}
+	sess.transit = transit
+	sess.received++
+	s.mu.Unlock()
+}
+
+// IperfClient runs tests against an IperfServer
+type IperfClient struct {
+	Addr     string        // host:port of the server
+	Duration time.Duration // Defaults to 10s
+	Streams  int           // Parallel TCP streams, defaults to 1
+
+	// Reverse has the server send (TCP only)
+	Reverse bool
+
+	// StallThreshold is how long a Write may block before it counts as
+	// a stall (defaults to 50ms)
+	StallThreshold time.Duration
+
+	// UDP sending rate in bits/s (defaults to 1 Mbps) and datagram size
+	// (defaults to 1400 bytes)
+	Bitrate    int64
+	PacketSize int
+}
+
+func (c *IperfClient) duration() time.Duration {
+	if c.Duration > 0 {
+		return c.Duration
+	}
+
+	return defaultIperfDuration
+}
+
+// TCP measures TCP throughput
+func (c *IperfClient) TCP(ctx context.Context) (*IperfResult, error) {
+	streams := max(c.Streams, 1)
+	results := make([]IperfResult, streams)
+	errs := make([]error, streams)
+
+	var wg sync.WaitGroup
+	for i := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = c.tcpStream(ctx)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	total := &IperfResult{Protocol: "tcp", Streams: streams}
+	for _, r := range results {
+		total.Bytes += r.Bytes
+		total.Stalls += r.Stalls
+		total.Elapsed = max(total.Elapsed, r.Elapsed)
+	}
+
+	return total, nil
+}
+
+func (c *IperfClient) tcpStream(ctx context.Context) (IperfResult, error) {
+	var r IperfResult
+
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return r, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	d := c.duration()
+	mode := byte(iperfSink)
+	if c.Reverse {
+		mode = iperfSource
+	}
+	header := binary.BigEndian.AppendUint64([]byte{mode}, uint64(d))
+	if _, err := conn.Write(header); err != nil {
+		return r, err
+	}
+
+	start := time.Now()
+	if c.Reverse {
+		_ = conn.SetReadDeadline(start.Add(d + iperfGrace))
+		r.Bytes, err = sink(conn)
+		r.Elapsed = time.Since(start)
+		return r, err
+	}
+
+	threshold := c.StallThreshold
+	if threshold <= 0 {
+		threshold = defaultIperfStall
+	}
+	buf := make([]byte, iperfBufferSize)
+	end := start.Add(d)
+	for time.Now().Before(end) && ctx.Err() == nil {
+		before := time.Now()
+		if _, err := conn.Write(buf); err != nil {
+			return r, err
+		}
+		if time.Since(before) > threshold {
+			r.Stalls++
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return r, err
+	}
+
+	// The server's count stops the clock: everything sent has arrived
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(iperfGrace))
+	total, err := ReadExactly(conn, 8)
+	if err != nil {
+		return r, err
+	}
+	r.Bytes = int64(binary.BigEndian.Uint64(total))
+	r.Elapsed = time.Since(start)
+
+	return r, nil
+}
+
+// UDP measures UDP throughput, loss and jitter at Bitrate
+func (c *IperfClient) UDP(ctx context.Context) (*IperfResult, error) {
+	size := c.PacketSize
+	if size <= 0 {
+		size = defaultIperfPacketSize
+	}
+	if size < iperfUDPHeaderSize || size > maxDatagramSize {
+		return nil, fmt.Errorf("iperf: invalid packet size %d", size)
+	}
+	bitrate := c.Bitrate
+	if bitrate <= 0 {
+		bitrate = defaultIperfBitrate
+	}
+
+	conn, err := new(net.Dialer).DialContext(ctx, "udp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	id := rand.Uint32()
+	p := make([]byte, size)
+	binary.BigEndian.PutUint32(p, id)
+
+	r := &IperfResult{Protocol: "udp", Streams: 1}
+	start := time.Now()
+	end := start.Add(c.duration())
+
+	// Send in bursts of whatever is due, so the rate holds even where
+	// sleeps are far coarser than the gap between datagrams
+	for now := start; now.Before(end); now = time.Now() {
+		due := int64(now.Sub(start).Seconds() * float64(bitrate) / float64(size*8))
+		for ; r.Sent < due; r.Sent++ {
+			binary.BigEndian.PutUint64(p[4:], uint64(r.Sent))
+			binary.BigEndian.PutUint64(p[12:], uint64(time.Now().UnixNano()))
+			if _, err := conn.Write(p); err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+				return nil, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+	r.Elapsed = time.Since(start)
+
+	// Ask for the report until it arrives; either datagram may be lost
+	time.Sleep(iperfSettle)
+	fin := make([]byte, iperfUDPHeaderSize)
+	binary.BigEndian.PutUint32(fin, id)
+	binary.BigEndian.PutUint64(fin[4:], iperfFin)
+	report := make([]byte, maxDatagramSize)
+	for attempt := 0; ; attempt++ {
+		if attempt == iperfFinAttempts {
+			return nil, errors.New("iperf: no report from server")
+		}
+		if _, err := conn.Write(fin); err != nil {
+			return nil, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(iperfFinTimeout))
+		n, err := conn.Read(report)
+		if err != nil {
+			if IsTimeout(err) || IsRefused(err) {
+				continue
+			}
+			return nil, err
+		}
+		if n == iperfReportSize && binary.BigEndian.Uint32(report) == id {
+			break
+		}
+	}
+
+	r.Received = int64(binary.BigEndian.Uint64(report[4:]))
+	r.Jitter = time.Duration(binary.BigEndian.Uint64(report[12:]))
+	r.Bytes = r.Received * int64(size)
+
+	return r, nil
+}
+
+// parseBitrate parses "100", "64K", "10M" or "1G" bits per second
+func parseBitrate(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"), strings.HasSuffix(s, "k"):
+		multiplier = 1_000
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		multiplier = 1_000_000
+	case strings.HasSuffix(s, "G"), strings.HasSuffix(s, "g"):
+		multiplier = 1_000_000_000
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", s)
+	}
+
+	return int64(v * float64(multiplier)), nil
+}
+
+// iperfMain runs "golearn iperf -s" (server) or "golearn iperf host"
+func iperfMain(args []string) error {
+	fs := flag.NewFlagSet("iperf", flag.ContinueOnError)
+	server := fs.Bool("s", false, "run the server")
+	port := fs.String("p", iperfDefaultPort, "server `port`")
+	duration := fs.Duration("t", defaultIperfDuration, "test `duration`")
+	streams := fs.Int("P", 1, "parallel TCP `streams`")
+	reverse := fs.Bool("R", false, "reverse: the server sends")
+	udp := fs.Bool("u", false, "test UDP instead of TCP")
+	bitrate := fs.String("b", "1M", "UDP `bitrate` in bits/s (K, M and G suffixes)")
+	size := fs.Int("l", defaultIperfPacketSize, "UDP datagram `size`")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *server {
+		return iperfServe(context.Background(), net.JoinHostPort("", *port))
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: iperf [flags] host | iperf -s")
+	}
+	rate, err := parseBitrate(*bitrate)
+	if err != nil {
+		return err
+	}
+	client := &IperfClient{
+		Addr:       net.JoinHostPort(fs.Arg(0), *port),
+		Duration:   *duration,
+		Streams:    *streams,
+		Reverse:    *reverse,
+		Bitrate:    rate,
+		PacketSize: *size,
+	}
+
+	var r *IperfResult
+	if *udp {
+		r, err = client.UDP(ctx)
+	} else {
+		r, err = client.TCP(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(r)
+
+	return nil
+}
+
+// iperfServe serves TCP and UDP tests on addr until ctx is done or the
+// process is interrupted
+func iperfServe(ctx context.Context, addr string) error {
+	s := &IperfServer{}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		_ = l.Close()
+		return err
+	}
+	fmt.Printf("iperf server on %s (tcp and udp)\n", l.Addr())
+
+	return Run(ctx,
+		TCPService("iperf tcp", NewTCPServer(l), s.ServeConn),
+		PacketService("iperf udp", pc, s.HandlePacket),
+	)
+}
+
+// startIperfServer runs an IperfServer on TCP and UDP for a test,
+// passing each datagram through filter first
+func startIperfServer(t *testing.T, filter func(p []byte) bool) string {
+	t.Helper()
+
+	s := &IperfServer{ErrorLog: log.New(io.Discard, "", 0)}
+	l, pc := testListenerPair(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := NewTCPServer(l)
+	srv.ErrorLog = s.ErrorLog
+	go func() { _ = srv.Serve(ctx, s.ServeConn) }()
+	go func() {
+		_ = ServePacket(ctx, pc, func(ctx context.Context, pc net.PacketConn, addr net.Addr, p []byte) {
+			if filter(p) {
+				s.HandlePacket(ctx, pc, addr, p)
+			}
+		})
+	}()
+	t.Cleanup(cancel)
+
+	return l.Addr().String()
+}
+
+func TestIperfTCP(t *testing.T) {
+	addr := startIperfServer(t, func([]byte) bool { return true })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, reverse := range []bool{false, true} {
+		client := &IperfClient{Addr: addr, Duration: 200 * time.Millisecond, Streams: 3, Reverse: reverse}
+		r, err := client.TCP(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Streams != 3 || r.Bytes == 0 || r.Mbps() <= 0 {
+			t.Errorf("reverse %v: unexpected result %s", reverse, r)
+		}
+		if r.Elapsed < client.Duration {
+			t.Errorf("reverse %v: test ended after %s", reverse, r.Elapsed)
+		}
+	}
+}
+
+func TestIperfUDP(t *testing.T) {
+	// Drop every fourth datagram on arrival, the report requests aside
+	addr := startIperfServer(t, func(p []byte) bool {
+		seq := binary.BigEndian.Uint64(p[4:])
+		return seq == iperfFin || seq%4 != 3
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := &IperfClient{Addr: addr, Duration: 300 * time.Millisecond, Bitrate: 8_000_000, PacketSize: 1000}
+	r, err := client.UDP(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 8 Mbps of 1000-byte datagrams is 1000 per second
+	if r.Sent < 250 || r.Sent > 310 {
+		t.Errorf("expected about 300 datagrams sent; actual: %d", r.Sent)
+	}
+	// Localhost itself may drop a few under load
+	if loss := r.Loss(); loss < 0.24 || loss > 0.35 {
+		t.Errorf("expected about 25%% loss; actual: %s", r)
+	}
+	if r.Jitter <= 0 || r.Jitter > 100*time.Millisecond {
+		t.Errorf("implausible jitter %s", r.Jitter)
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	for in, want := range map[string]int64{"100": 100, "64K": 64_000, "1.5M": 1_500_000, "1g": 1_000_000_000} {
+		if got, err := parseBitrate(in); err != nil || got != want {
+			t.Errorf("%s: expected %d; actual: %d, %v", in, want, got, err)
+		}
+	}
+	if _, err := parseBitrate("fast"); err == nil {
+		t.Error("expected an error")
+	}
+}
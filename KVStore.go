@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Replicated key-value store
+//
+// KVNode puts the pieces together: a map of strings, copied to every
+// node of a group, with clients talking RPC (RPC.go) straight to the
+// nodes, no proxy or load balancer in between.
+//
+// - Writes go to the leader, picked by a bully election (Election.go)
+//   among the nodes. A node that doesn't lead answers a write with the
+//   leader's address, and KVClient writes there.
+// - The leader numbers the write, applies it and sends it to every
+//   follower (Replicate), acknowledging it to the client once Quorum
+//   nodes, itself included, hold it: a majority by default, so a write
+//   survives the loss of any minority.
+// - A follower applies writes in order. One that missed some (it was
+//   down, or a write overtook another) answers with how far it got, and
+//   the leader sends what's missing; a follower that comes back empty
+//   catches up with the next write.
+// - Reads are served locally by any node: fast and available, possibly
+//   a little stale on a follower.
+//
+// A demo, not a database: the log is in memory and grows forever, and
+// bully elections aren't Raft's, so a write a new leader never saw can
+// be lost, and a leader applies a write before the quorum has it.
+
+// KVEntry is a write, numbered by the leader
+type KVEntry struct {
+	Index  uint64
+	Key    string
+	Value  string
+	Delete bool
+}
+
+type KVGetArgs struct {
+	Key string
+}
+
+type KVGetReply struct {
+	Value string
+	Found bool
+	Index uint64 // Writes applied by the node that answered
+}
+
+type KVPutArgs struct {
+	Key    string
+	Value  string
+	Delete bool
+}
+
+type KVPutReply struct {
+	Index    uint64
+	Redirect string // When not the leader: the leader's address
+}
+
+type KVReplicateArgs struct {
+	Leader  int
+	Entries []KVEntry
+}
+
+type KVReplicateReply struct {
+	OK   bool   // The caller leads, as far as the follower knows
+	Last uint64 // Writes the follower applied
+}
+
+// KVNode is a node of the store
+type KVNode struct {
+	// Election has the node's ID and its peers, whose addresses serve
+	// the store too
+	Election *Election
+
+	Quorum int // Nodes holding a write before it's acknowledged; a majority by default
+
+	ErrorLog *log.Logger
+
+	mu   sync.Mutex
+	data map[string]string
+	log  []KVEntry // Entry i has Index i+1
+}
+
+func (n *KVNode) quorum() int {
+	if n.Quorum > 0 {
+		return n.Quorum
+	}
+	return (len(n.Election.Peers)+1)/2 + 1
+}
+
+func (n *KVNode) logf(format string, v ...any) {
+	if n.ErrorLog != nil {
+		n.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Serve answers clients and peers on l and takes part in the elections
+// until ctx is canceled. It returns ctx.Err().
+func (n *KVNode) Serve(ctx context.Context, l net.Listener) error {
+	rpc := NewRPCServer()
+	rpc.ErrorLog = n.ErrorLog
+	if err := n.Election.Register(rpc); err != nil {
+		return err
+	}
+	if err := rpc.Register("KV", &kvService{n: n}); err != nil {
+		return err
+	}
+	srv := NewTCPServer(l)
+	srv.ErrorLog = n.ErrorLog
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, rpc.ServeConn) }()
+
+	err := n.Election.Run(ctx)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = srv.Shutdown(shutdownCtx)
+	<-served
+
+	return err
+}
+
+// Get returns the local value of key
+func (n *KVNode) Get(key string) (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	value, ok := n.data[key]
+	return value, ok
+}
+
+// put applies a write on the leader and replicates it
+func (n *KVNode) put(ctx context.Context, args *KVPutArgs) (*KVPutReply, error) {
+	e := n.Election
+	leader, ok := e.Leader()
+	switch {
+	case !ok:
+		return nil, rpcErrorf(RPCUnavailable, "no leader")
+	case leader != e.ID:
+		return &KVPutReply{Redirect: e.Peers[leader]}, nil
+	}
+
+	n.mu.Lock()
+	entry := KVEntry{Index: uint64(len(n.log)) + 1, Key: args.Key, Value: args.Value, Delete: args.Delete}
+	n.apply(entry)
+	n.mu.Unlock()
+
+	// The leader holds it already; wait for the rest of the quorum
+	acks := make(chan bool, len(e.peers))
+	for id, p := range e.peers {
+		go func() { acks <- n.replicate(ctx, id, p, entry) }()
+	}
+	held := 1
+	for range e.peers {
+		if held >= n.quorum() {
+			break
+		}
+		if <-acks {
+			held++
+		}
+	}
+	if held < n.quorum() {
+		return nil, rpcErrorf(RPCUnavailable, "write %d held by %d nodes, quorum is %d", entry.Index, held, n.quorum())
+	}
+
+	return &KVPutReply{Index: entry.Index}, nil
+}
+
+// replicate sends entry to peer id, and what it misses before it
+func (n *KVNode) replicate(ctx context.Context, id int, p *rpcPeer, entry KVEntry) bool {
+	// Going on after the quorum answered and the call returned
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), n.Election.electionTimeout())
+	defer cancel()
+
+	entries := []KVEntry{entry}
+	for range 3 {
+		var reply KVReplicateReply
+		err := p.call(ctx, "KV.Replicate", &KVReplicateArgs{Leader: n.Election.ID, Entries: entries}, &reply)
+		if err != nil && ctx.Err() == nil {
+			continue // The peer restarted, the call redials
+		}
+		if err != nil || !reply.OK {
+			return false
+		}
+		if reply.Last >= entry.Index {
+			return true
+		}
+
+		// Behind: send it everything from where it stopped
+		n.mu.Lock()
+		entries = append([]KVEntry(nil), n.log[reply.Last:entry.Index]...)
+		n.mu.Unlock()
+		n.logf("kv: %d catching up %d from %d to %d", n.Election.ID, id, reply.Last, entry.Index)
+	}
+
+	return false
+}
+
+// apply appends entry to the log and the map; n.mu is held
+func (n *KVNode) apply(entry KVEntry) {
+	if n.data == nil {
+		n.data = make(map[string]string)
+	}
+	n.log = append(n.log, entry)
+	if entry.Delete {
+		delete(n.data, entry.Key)
+		return
+	}
+	n.data[entry.Key] = entry.Value
+}
+
+// follow applies the leader's entries, in order. Entries the follower
+// already has are the leader's to overwrite.
+func (n *KVNode) follow(entries []KVEntry) uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, entry := range entries {
+		last := uint64(len(n.log))
+		if entry.Index > last+1 {
+			break // A gap: the leader will fill it
+		}
+		if entry.Index <= last {
+			n.truncate(entry.Index - 1)
+		}
+		n.apply(entry)
+	}
+
+	return uint64(len(n.log))
+}
+
+// truncate drops the entries after index and rebuilds the map; n.mu is
+// held
+func (n *KVNode) truncate(index uint64) {
+	log := n.log[:index]
+	n.log, n.data = nil, nil
+	for _, entry := range log {
+		n.apply(entry)
+	}
+}
+
+// kvService is the RPC service of a KVNode
+type kvService struct {
+	n *KVNode
+}
+
+func (s *kvService) Get(_ context.Context, args *KVGetArgs) (*KVGetReply, error) {
+	s.n.mu.Lock()
+	defer s.n.mu.Unlock()
+
+	value, ok := s.n.data[args.Key]
+	return &KVGetReply{Value: value, Found: ok, Index: uint64(len(s.n.log))}, nil
+}
+
+func (s *kvService) Put(ctx context.Context, args *KVPutArgs) (*KVPutReply, error) {
+	return s.n.put(ctx, args)
+}
+
+func (s *kvService) Replicate(_ context.Context, args *KVReplicateArgs) (*KVReplicateReply, error) {
+	// Only from the leader we follow: a deposed one may not know yet
+	if leader, ok := s.n.Election.Leader(); !ok || leader != args.Leader {
+		return &KVReplicateReply{}, nil
+	}
+
+	return &KVReplicateReply{OK: true, Last: s.n.follow(args.Entries)}, nil
+}
+
+// KVClient talks to the nodes of a store
+type KVClient struct {
+	mu    sync.Mutex
+	addrs []string
+	peers map[string]*rpcPeer
+}
+
+// NewKVClient returns a client of the nodes at addrs
+func NewKVClient(addrs ...string) *KVClient {
+	return &KVClient{addrs: addrs, peers: make(map[string]*rpcPeer)}
+}
+
+func (c *KVClient) peer(addr string) *rpcPeer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := c.peers[addr]
+	if p == nil {
+		p = &rpcPeer{addr: addr}
+		c.peers[addr] = p
+	}
+	return p
+}
+
+// Close closes the connections to the nodes
+func (c *KVClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.peers {
+		p.close()
+	}
+	return nil
+}
+
+// Get reads key from the first node that answers
+func (c *KVClient) Get(ctx context.Context, key string) (string, bool, error) {
+	var errs []error
+	for _, addr := range c.addrs {
+		var reply KVGetReply
+		if err := c.peer(addr).call(ctx, "KV.Get", &KVGetArgs{Key: key}, &reply); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+			continue
+		}
+		return reply.Value, reply.Found, nil
+	}
+
+	return "", false, errors.Join(errs...)
+}
+
+// Put writes key, at the leader
+func (c *KVClient) Put(ctx context.Context, key, value string) error {
+	return c.write(ctx, &KVPutArgs{Key: key, Value: value})
+}
+
+// Delete deletes key, at the leader
+func (c *KVClient) Delete(ctx context.Context, key string) error {
+	return c.write(ctx, &KVPutArgs{Key: key, Delete: true})
+}
+
+// write tries the nodes in turn, going where they redirect to
+func (c *KVClient) write(ctx context.Context, args *KVPutArgs) error {
+	var errs []error
+	for _, addr := range c.addrs {
+		for range 2 {
+			var reply KVPutReply
+			err := c.peer(addr).call(ctx, "KV.Put", args, &reply)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+				break
+			}
+			if reply.Redirect == "" {
+				return nil
+			}
+			addr = reply.Redirect
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func TestKVStore(t *testing.T) {
+	addrs := make(map[int]string)
+	listeners := make(map[int]net.Listener) // For each node's first start
+	for id := 1; id <= 3; id++ {
+		listeners[id] = testListener(t)
+		addrs[id] = listeners[id].Addr().String()
+	}
+	nodes := make(map[int]*KVNode)
+	cancels := make(map[int]func())
+	start := func(id int) {
+		t.Helper()
+		l, ok := listeners[id]
+		if ok {
+			delete(listeners, id)
+		} else {
+			l = testRelisten(t, addrs[id])
+		}
+		e := &Election{
+			ID:                id,
+			Peers:             make(map[int]string),
+			HeartbeatInterval: 20 * time.Millisecond,
+			LeaderTimeout:     100 * time.Millisecond,
+			ElectionTimeout:   200 * time.Millisecond,
+			ErrorLog:          log.New(io.Discard, "", 0),
+		}
+		for other, addr := range addrs {
+			if other != id {
+				e.Peers[other] = addr
+			}
+		}
+		n := &KVNode{Election: e, ErrorLog: e.ErrorLog}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			_ = n.Serve(ctx, l)
+			close(done)
+		}()
+		nodes[id] = n
+		cancels[id] = func() {
+			cancel()
+			<-done
+		}
+		t.Cleanup(cancels[id])
+	}
+	leads := func(leader int, ids ...int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			agreed := true
+			for _, id := range ids {
+				if l, ok := nodes[id].Election.Leader(); !ok || l != leader {
+					agreed = false
+				}
+			}
+			if agreed {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %v to follow %d", ids, leader)
+			}
+		}
+	}
+	holds := func(id int, key, expected string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			value, ok := nodes[id].Get(key)
+			if ok && value == expected || !ok && expected == "" {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d: expected %s=%q; actual: %q, %t", id, key, expected, value, ok)
+			}
+		}
+	}
+
+	for id := 3; id >= 1; id-- {
+		start(id)
+	}
+	leads(3, 1, 2, 3)
+
+	// The client knows a follower first: it's redirected to the leader
+	client := NewKVClient(addrs[1], addrs[2], addrs[3])
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Put(ctx, "color", "blue"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Put(ctx, "shape", "circle"); err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id <= 3; id++ {
+		holds(id, "color", "blue")
+	}
+	if value, ok, err := client.Get(ctx, "shape"); err != nil || !ok || value != "circle" {
+		t.Errorf("expected circle; actual: %q, %t, %v", value, ok, err)
+	}
+
+	// A follower down misses writes, and catches up once back
+	cancels[1]()
+	if err := client.Put(ctx, "size", "large"); err != nil {
+		t.Fatal(err)
+	}
+	start(1)
+	leads(3, 1)
+	if err := client.Put(ctx, "size", "small"); err != nil {
+		t.Fatal(err)
+	}
+	holds(1, "color", "blue")
+	holds(1, "size", "small")
+
+	// The leader fails: 2 takes over, and 2 nodes still make a quorum
+	cancels[3]()
+	leads(2, 1, 2)
+	if err := client.Put(ctx, "color", "green"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete(ctx, "shape"); err != nil {
+		t.Fatal(err)
+	}
+	holds(1, "color", "green")
+	holds(1, "shape", "")
+
+	// Alone, 2 can't make one
+	cancels[1]()
+	if err := client.Put(ctx, "color", "red"); err == nil {
+		t.Error("expected no quorum with 2 nodes of 3 down")
+	}
+}
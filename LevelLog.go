@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Log levels
+//
+// The servers log through a *log.Logger (the ErrorLog fields), which
+// has no idea of levels. LevelLog adds them on top of one: every message
+// goes to the same logger, tagged with its level, unless it is below the
+// current level. The level is a slog.LevelVar, so it can change while
+// running (the admin API changes it) without handing out new loggers:
+//
+//	logs := NewLevelLog(log.New(os.Stderr, "serve: ", log.LstdFlags))
+//	srv.ErrorLog = logs.Logger(slog.LevelError)
+//	logs.Debugf("reloaded %s", name)  // dropped
+//	logs.Level.Set(slog.LevelDebug)
+//	logs.Debugf("reloaded %s", name)  // serve: 2026/... DEBUG reloaded echo
+//
+// NewLevelLogHandler sends the messages to a slog.Handler instead, as
+// records at their level, which is how they reach syslog or journald
+// (LogSyslog.go, LogJournalLinux.go).
+
+// LevelLog filters the messages of a log.Logger by level
+type LevelLog struct {
+	// Level is the lowest level logged, Info by default
+	Level slog.LevelVar
+
+	base    *log.Logger
+	handler slog.Handler
+}
+
+// NewLevelLog returns a LevelLog writing to base
+func NewLevelLog(base *log.Logger) *LevelLog {
+	return &LevelLog{base: base}
+}
+
+// NewLevelLogHandler returns a LevelLog sending records to h instead,
+// like a SyslogHandler, with the level as the record's
+func NewLevelLogHandler(h slog.Handler) *LevelLog {
+	return &LevelLog{handler: h}
+}
+
+// Enabled reports whether messages at level are logged
+func (l *LevelLog) Enabled(level slog.Level) bool {
+	return level >= l.Level.Level()
+}
+
+// Logf logs a message at level
+func (l *LevelLog) Logf(level slog.Level, format string, v ...any) {
+	switch {
+	case !l.Enabled(level):
+	case l.handler != nil:
+		r := slog.NewRecord(time.Now(), level, fmt.Sprintf(format, v...), 0)
+		_ = l.handler.Handle(context.Background(), r)
+	default:
+		l.base.Print(level.String() + " " + fmt.Sprintf(format, v...))
+	}
+}
+
+func (l *LevelLog) Debugf(format string, v ...any) { l.Logf(slog.LevelDebug, format, v...) }
+func (l *LevelLog) Infof(format string, v ...any)  { l.Logf(slog.LevelInfo, format, v...) }
+func (l *LevelLog) Warnf(format string, v ...any)  { l.Logf(slog.LevelWarn, format, v...) }
+func (l *LevelLog) Errorf(format string, v ...any) { l.Logf(slog.LevelError, format, v...) }
+
+// Logger returns a *log.Logger whose messages are at level, for the
+// components that take one
+func (l *LevelLog) Logger(level slog.Level) *log.Logger {
+	return log.New(levelWriter{l, level}, "", 0)
+}
+
+// levelWriter logs every write as a message at level
+type levelWriter struct {
+	log   *LevelLog
+	level slog.Level
+}
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	w.log.Logf(w.level, "%s", bytes.TrimSuffix(p, []byte("\n")))
+	return len(p), nil
+}
+
+func TestLevelLog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logs := NewLevelLog(log.New(buf, "test: ", 0))
+	errorLog := logs.Logger(slog.LevelError)
+
+	logs.Debugf("hidden %d", 1)
+	logs.Infof("shown %d", 2)
+	errorLog.Printf("component %d", 3)
+
+	logs.Level.Set(slog.LevelDebug)
+	logs.Debugf("shown %d", 4)
+
+	logs.Level.Set(slog.LevelError)
+	logs.Warnf("hidden %d", 5)
+	errorLog.Print("component 6")
+
+	expected := []string{
+		"test: INFO shown 2",
+		"test: ERROR component 3",
+		"test: DEBUG shown 4",
+		"test: ERROR component 6",
+	}
+	if actual := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"); strings.Join(actual, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected %q; actual: %q", expected, actual)
+	}
+}
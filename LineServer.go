@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Line-oriented text protocol server
+//
+// Many classic protocols (SMTP, POP3, FTP control, Redis inline...)
+// share the same shape: the client sends a line made of a command and
+// some arguments, the server answers with a line. LineServer takes care
+// of the plumbing so a protocol is just a set of handlers:
+//
+//	s := NewLineServer()
+//	s.Handle("PING", func(*LineSession, string) (string, error) {
+//		return "pong", nil
+//	})
+//	err := s.Serve(listener)
+//
+// Lines are CRLF terminated and read through a DelimitedReader, so the
+// maximum line length and the idle timeout are enforced for every line.
+// Commands are matched case-insensitively.
+
+// ErrQuit tells the server to send the reply and close the connection
+var ErrQuit = errors.New("quit")
+
+// LineSession is the per-connection state handed to every handler
+type LineSession struct {
+	Conn net.Conn
+
+	// Values is free for handlers to keep state between commands
+	Values map[string]any
+}
+
+// LineHandler handles one command. args is the rest of the line after
+// the command. A non-empty reply is written back as a line; returning
+// ErrQuit closes the connection after the reply, any other error closes
+// it right away.
+type LineHandler func(s *LineSession, args string) (reply string, err error)
+
+// LineServer dispatches lines to registered command handlers
+type LineServer struct {
+	// MaxLineLength bounds a single line (defaults to 1024 bytes)
+	MaxLineLength int
+
+	// IdleTimeout bounds the wait for each line; zero waits forever
+	IdleTimeout time.Duration
+
+	// Quota bounds the lines of a connection, and their bytes
+	Quota MessageQuota
+
+	// Greeting, when set, is sent to every client as it connects, the
+	// way SMTP and POP3 servers introduce themselves
+	Greeting string
+
+	// NotFound handles lines whose command isn't registered. The whole
+	// line is passed as args. When nil, "unknown command" is replied.
+	NotFound LineHandler
+
+	// Middleware, when set, wraps every handler, NotFound included;
+	// see LatencyRecorder.LineHandler
+	Middleware func(LineHandler) LineHandler
+
+	mu       sync.RWMutex
+	handlers map[string]LineHandler
+}
+
+// NewLineServer returns a server with no commands registered
+func NewLineServer() *LineServer {
+	return &LineServer{handlers: make(map[string]LineHandler)}
+}
+
+// Handle registers h for command
+func (s *LineServer) Handle(command string, h LineHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[strings.ToUpper(command)] = h
+}
+
+// handler looks up the handler for the command of line
+func (s *LineServer) handler(line string) (LineHandler, string) {
+	command, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+
+	s.mu.RLock()
+	h, ok := s.handlers[strings.ToUpper(command)]
+	s.mu.RUnlock()
+
+	if ok {
+		return h, strings.TrimSpace(args)
+	}
+	if s.NotFound != nil {
+		return s.NotFound, line
+	}
+
+	return func(*LineSession, string) (string, error) {
+		return "unknown command", nil
+	}, line
+}
+
+// Serve accepts connections on l and serves each of them in its own
+// goroutine. It returns when Accept fails, e.g. after l.Close().
+func (s *LineServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn reads and answers lines on conn until the client leaves,
+// a handler asks to quit or an error occurs. It closes conn on return.
+func (s *LineServer) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	maxLine := s.MaxLineLength
+	if maxLine <= 0 {
+		maxLine = 1024
+	}
+
+	r := NewDelimitedReader(conn, ScanCRLFLines(maxLine), maxLine+2, s.IdleTimeout)
+	r.SetQuota(s.Quota)
+	session := &LineSession{Conn: conn, Values: make(map[string]any)}
+
+	if s.Greeting != "" {
+		if _, err := io.WriteString(conn, s.Greeting+"\r\n"); err != nil {
+			return
+		}
+	}
+
+	for {
+		line, err := r.Next()
+		if err != nil {
+			// EOF, idle peer, a line that is too long or one too many
+			return
+		}
+
+		h, args := s.handler(string(line))
+		if s.Middleware != nil {
+			h = s.Middleware(h)
+		}
+		reply, err := h(session, args)
+		if err != nil && err != ErrQuit {
+			return
+		}
+
+		if reply != "" {
+			if _, werr := io.WriteString(conn, reply+"\r\n"); werr != nil {
+				return
+			}
+		}
+
+		if err == ErrQuit {
+			return
+		}
+	}
+}
+
+func TestLineServer(t *testing.T) {
+	// The ping/pong/echo server from TestProxy, declaratively
+	s := NewLineServer()
+	s.Handle("ping", func(*LineSession, string) (string, error) {
+		return "pong", nil
+	})
+	s.Handle("quit", func(*LineSession, string) (string, error) {
+		return "bye", ErrQuit
+	})
+	// Per-connection state: count the messages echoed so far
+	s.NotFound = func(session *LineSession, line string) (string, error) {
+		n, _ := session.Values["echoed"].(int)
+		session.Values["echoed"] = n + 1
+		return line, nil
+	}
+	s.Handle("count", func(session *LineSession, _ string) (string, error) {
+		n, _ := session.Values["echoed"].(int)
+		return strings.Repeat("*", n), nil
+	})
+
+	listener := testListener(t)
+	go func() { _ = s.Serve(listener) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := NewDelimitedReader(conn, ScanCRLFLines(1024), 1026, time.Second)
+
+	msgs := []struct{ Message, Reply string }{
+		{"ping", "pong"},
+		{"PING", "pong"},
+		{"echo", "echo"},
+		{"hello there", "hello there"},
+		{"count", "**"},
+		{"quit", "bye"},
+	}
+
+	for i, m := range msgs {
+		if _, err := io.WriteString(conn, m.Message+"\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) != m.Reply {
+			t.Errorf("%d: expected reply: %q; actual: %q", i, m.Reply, reply)
+		}
+	}
+
+	// After quit the server hangs up
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected EOF after quit; actual: %v", err)
+	}
+}
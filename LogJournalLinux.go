@@ -0,0 +1,227 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// journald output
+//
+// On a systemd machine whatever a service writes to stderr already ends
+// up in the journal, but as lines of text. Talking to journald directly
+// keeps the structure: every record is a set of fields the journal
+// indexes, so "journalctl CONN_ID=3" finds the records of a connection.
+//
+// The native protocol is one datagram per record on a unix socket, each
+// field on its own line:
+//
+//	MESSAGE=traffic
+//	PRIORITY=6
+//	SYSLOG_IDENTIFIER=golearn
+//	CONN_ID=3
+//
+// A value with a newline in it is written as the field name, a newline,
+// its length as a little endian uint64, and the raw value instead. Field
+// names are upper case letters, digits and underscores, so slog keys
+// are converted ("conn_id" to CONN_ID, "req.path" to REQ_PATH). Records
+// too large for a datagram (journald hands big ones over as a memfd) are
+// not supported and fail.
+
+// defaultJournalSocket is where journald listens
+const defaultJournalSocket = "/run/systemd/journal/socket"
+
+// JournalHandler sends records to journald
+type JournalHandler struct {
+	conn       *net.UnixConn
+	identifier string
+	fields     []journalField // From WithAttrs
+	group      string         // From WithGroup, "a.b." prefix
+}
+
+// journalField is a field of a journal entry
+type journalField struct {
+	name, value string
+}
+
+// DialJournal returns a handler sending to the journald socket at path
+// (the system's when empty), tagging records with identifier
+func DialJournal(path, identifier string) (*JournalHandler, error) {
+	if path == "" {
+		path = defaultJournalSocket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &JournalHandler{conn: conn, identifier: identifier}, nil
+}
+
+// Close closes the socket
+func (h *JournalHandler) Close() error {
+	return h.conn.Close()
+}
+
+// Enabled lets everything through: LevelLog or the slog.Logger filters
+func (h *JournalHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+// Handle sends the record as one journal entry
+func (h *JournalHandler) Handle(_ context.Context, r slog.Record) error {
+	buf := new(bytes.Buffer)
+	writeJournalField(buf, "MESSAGE", r.Message)
+	writeJournalField(buf, "PRIORITY", strconv.Itoa(syslogSeverity(r.Level)))
+	if h.identifier != "" {
+		writeJournalField(buf, "SYSLOG_IDENTIFIER", h.identifier)
+	}
+	for _, f := range h.fields {
+		writeJournalField(buf, f.name, f.value)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		forEachLogAttr(h.group, a, func(key, value string) {
+			writeJournalField(buf, journalFieldName(key), value)
+		})
+		return true
+	})
+
+	// Datagrams are written whole, so concurrent records don't mix
+	_, err := h.conn.Write(buf.Bytes())
+
+	return err
+}
+
+// WithAttrs returns a handler adding attrs to every record
+func (h *JournalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.fields = append([]journalField(nil), h.fields...)
+	for _, a := range attrs {
+		forEachLogAttr(h.group, a, func(key, value string) {
+			h2.fields = append(h2.fields, journalField{journalFieldName(key), value})
+		})
+	}
+
+	return &h2
+}
+
+// WithGroup returns a handler nesting the attributes to come under name
+func (h *JournalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+
+	return &h2
+}
+
+// writeJournalField writes a field in the native protocol
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+
+	buf.WriteString(name + "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// journalFieldName converts a slog key to a field name journald
+// accepts: upper case, digits and underscores, starting with a letter,
+// at most 64 characters
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	if name == "" || name[0] < 'A' || name[0] > 'Z' {
+		// Leading underscores are for the fields journald adds itself
+		name = "X" + name
+	}
+
+	return name[:min(len(name), 64)]
+}
+
+func TestJournalHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	server, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	h, err := DialJournal(path, "golearn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	slog.New(h).With("conn_id", 3).WithGroup("req").Error("failed", "path", "/a", "_secret", 1, "body", "two\nlines")
+
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parse the entry back
+	fields := make(map[string]string)
+	r := bufio.NewReader(bytes.NewReader(buf[:n]))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if name, value, ok := strings.Cut(line, "="); ok {
+			fields[name] = value
+			continue
+		}
+		var size uint64
+		_ = binary.Read(r, binary.LittleEndian, &size)
+		value := make([]byte, size+1) // With its newline
+		_, _ = io.ReadFull(r, value)
+		fields[line] = string(value[:size])
+	}
+
+	expected := map[string]string{
+		"MESSAGE":           "failed",
+		"PRIORITY":          "3",
+		"SYSLOG_IDENTIFIER": "golearn",
+		"CONN_ID":           "3",
+		"REQ_PATH":          "/a",
+		"REQ__SECRET":       "1",
+		"REQ_BODY":          "two\nlines",
+	}
+	for name, value := range expected {
+		if fields[name] != value {
+			t.Errorf("%s: expected %q; actual: %q", name, value, fields[name])
+		}
+	}
+	if len(fields) != len(expected) {
+		t.Errorf("unexpected fields %q", fields)
+	}
+
+	// journalFieldName keeps journald's own fields out of reach
+	if name := journalFieldName("_pid"); name != "X_PID" {
+		t.Errorf("unexpected field name %q", name)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// JournalHandler sends records to journald, only on linux (see
+// LogJournalLinux.go)
+type JournalHandler struct {
+	slog.Handler
+}
+
+// DialJournal fails: journald only runs on linux
+func DialJournal(path, identifier string) (*JournalHandler, error) {
+	return nil, errors.New("journald: only supported on linux")
+}
+
+// Close does nothing
+func (h *JournalHandler) Close() error {
+	return nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Syslog output
+//
+// Logs that stay on the machine are lost with it. Syslog is the oldest
+// way to ship them elsewhere and every log collector still speaks it.
+// RFC 5424 is its modern format, one message per line:
+//
+//	<30>1 2026-10-17T10:00:00.000000Z host golearn 1234 - [attrs@32473 conn_id="3" size="5"] traffic
+//
+// - <30> is the priority: facility * 8 + severity, here daemon (3) and
+//   informational (6)
+// - then the version, a timestamp, who sent it (host, app, process id)
+//   and a message id ("-" for none)
+// - structured data: the slog attributes as SD-PARAMs, with ", \ and ]
+//   escaped; "attrs@32473" uses the example enterprise number of RFC
+//   5612, since the SD-ID has to name someone's
+// - the message itself
+//
+// SyslogHandler is a slog.Handler, so it can be Monitor.Structured as is
+// and the server logs reach it through LevelLog. Over UDP every message
+// is a datagram (RFC 5426), lost if nobody listens; over TCP messages
+// are framed by their length (RFC 6587 octet counting), and a broken
+// connection is dialed again on the next message.
+
+// syslogAttrsID is the SD-ID of the attributes
+const syslogAttrsID = "attrs@32473"
+
+// Syslog facilities, the few that make sense here
+const (
+	SyslogUser   = 1
+	SyslogDaemon = 3
+	SyslogLocal0 = 16
+)
+
+// SyslogOptions are the header fields of the messages
+type SyslogOptions struct {
+	Facility int    // SyslogDaemon by default
+	AppName  string // "golearn" by default
+	Hostname string // os.Hostname by default
+}
+
+// syslogConn is the connection the handlers derived from one another
+// share
+type syslogConn struct {
+	network, addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// SyslogHandler sends records to a syslog server
+type SyslogHandler struct {
+	conn   *syslogConn
+	opts   SyslogOptions
+	procID string
+	attrs  []syslogParam // From WithAttrs
+	group  string        // From WithGroup, "a.b." prefix
+}
+
+// syslogOutput parses a log output naming a syslog server:
+// "syslog://host:port" over UDP, "syslog+tcp://host:port" over TCP, the
+// port 514 by default
+func syslogOutput(output string) (network, addr string, ok bool) {
+	u, err := url.Parse(output)
+	if err != nil {
+		return "", "", false
+	}
+	switch u.Scheme {
+	case "syslog", "syslog+udp":
+		network = "udp"
+	case "syslog+tcp":
+		network = "tcp"
+	default:
+		return "", "", false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "514"
+	}
+
+	return network, net.JoinHostPort(u.Hostname(), port), u.Hostname() != ""
+}
+
+// syslogParam is an SD-PARAM
+type syslogParam struct {
+	name, value string
+}
+
+// DialSyslog returns a handler sending to the syslog server at addr
+// over network ("udp" or "tcp")
+func DialSyslog(network, addr string, opts *SyslogOptions) (*SyslogHandler, error) {
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("syslog: unsupported network %q", network)
+	}
+
+	h := &SyslogHandler{conn: &syslogConn{network: network, addr: addr}, procID: strconv.Itoa(os.Getpid())}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.Facility == 0 {
+		h.opts.Facility = SyslogDaemon
+	}
+	if h.opts.AppName == "" {
+		h.opts.AppName = "golearn"
+	}
+	if h.opts.Hostname == "" {
+		h.opts.Hostname, _ = os.Hostname()
+	}
+
+	// Fail early on a bad address rather than at the first message
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+	if err := h.conn.dial(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// dial connects, called with mu held
+func (c *syslogConn) dial() error {
+	conn, err := net.DialTimeout(c.network, c.addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+	c.conn = conn
+
+	return nil
+}
+
+// send writes a message, dialing again once if the connection broke
+func (c *syslogConn) send(msg []byte) error {
+	if c.network == "tcp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if c.conn == nil {
+			if err := c.dial(); err != nil {
+				return err
+			}
+		}
+		_, err := c.conn.Write(msg)
+		if err == nil || attempt == 1 || c.network != "tcp" {
+			return err
+		}
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// Close closes the connection to the server
+func (h *SyslogHandler) Close() error {
+	h.conn.mu.Lock()
+	defer h.conn.mu.Unlock()
+
+	if h.conn.conn == nil {
+		return nil
+	}
+	err := h.conn.conn.Close()
+	h.conn.conn = nil
+
+	return err
+}
+
+// Enabled lets everything through: LevelLog or the slog.Logger filters
+func (h *SyslogHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+// syslogSeverity maps a slog level to a syslog severity
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	}
+
+	return 7 // debug
+}
+
+// Handle formats the record as RFC 5424 and sends it
+func (h *SyslogHandler) Handle(_ context.Context, r slog.Record) error {
+	params := append([]syslogParam(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		params = appendSyslogParams(params, h.group, a)
+		return true
+	})
+
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s -",
+		h.opts.Facility*8+syslogSeverity(r.Level),
+		t.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(h.opts.Hostname, 255),
+		syslogHeaderField(h.opts.AppName, 48),
+		syslogHeaderField(h.procID, 128))
+	if len(params) == 0 {
+		b.WriteString(" -")
+	} else {
+		b.WriteString(" [" + syslogAttrsID)
+		for _, p := range params {
+			b.WriteString(" " + p.name + `="` + syslogEscape(p.value) + `"`)
+		}
+		b.WriteString("]")
+	}
+	if r.Message != "" {
+		b.WriteString(" " + r.Message)
+	}
+
+	return h.conn.send([]byte(b.String()))
+}
+
+// WithAttrs returns a handler adding attrs to every record
+func (h *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]syslogParam(nil), h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = appendSyslogParams(h2.attrs, h.group, a)
+	}
+
+	return &h2
+}
+
+// WithGroup returns a handler nesting the attributes to come under name
+func (h *SyslogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+
+	return &h2
+}
+
+// appendSyslogParams flattens a, with groups as "group.key"
+func appendSyslogParams(params []syslogParam, prefix string, a slog.Attr) []syslogParam {
+	forEachLogAttr(prefix, a, func(key, value string) {
+		params = append(params, syslogParam{syslogParamName(key), value})
+	})
+
+	return params
+}
+
+// forEachLogAttr calls fn with the key and value of a, or of every
+// attribute in it when it's a group, keys prefixed by the group names
+func forEachLogAttr(prefix string, a slog.Attr, fn func(key, value string)) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() != slog.KindGroup {
+		fn(prefix+a.Key, a.Value.String())
+		return
+	}
+	if a.Key != "" {
+		prefix += a.Key + "."
+	}
+	for _, sub := range a.Value.Group() {
+		forEachLogAttr(prefix, sub, fn)
+	}
+}
+
+// syslogParamName keeps the printable ASCII an SD-PARAM name allows,
+// up to 32 of them
+func syslogParamName(s string) string {
+	name := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, s)
+	if name == "" {
+		return "_"
+	}
+
+	return name[:min(len(name), 32)]
+}
+
+// syslogHeaderField keeps the printable ASCII a header field allows, "-"
+// when nothing is left
+func syslogHeaderField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+
+	return s[:min(len(s), max)]
+}
+
+// syslogEscape escapes an SD-PARAM value
+var syslogEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace
+
+func TestSyslogHandler(t *testing.T) {
+	// UDP, one datagram per message
+	pc := testPacketConn(t)
+
+	h, err := DialSyslog("udp", pc.LocalAddr().String(), &SyslogOptions{Hostname: "my host", Facility: SyslogLocal0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h).With("conn_id", 3).WithGroup("req")
+	logger.Warn("slow", "path", `/a "b"]`, slog.Group("peer", "addr", "10.0.0.1"))
+
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	prefix := "<132>1 " // local0 * 8 + warning
+	suffix := fmt.Sprintf(` myhost golearn %d - [attrs@32473 conn_id="3" req.path="/a \"b\"\]" req.peer.addr="10.0.0.1"] slow`, os.Getpid())
+	if !strings.HasPrefix(msg, prefix) || !strings.HasSuffix(msg, suffix) {
+		t.Errorf("unexpected message %q", msg)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, strings.Fields(msg)[1]); err != nil {
+		t.Errorf("unexpected timestamp in %q: %v", msg, err)
+	}
+
+	// TCP, octet counted, through LevelLog
+	l := testListener(t)
+	received := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					length, err := r.ReadString(' ')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(length))
+					b, err := ReadExactly(r, n)
+					if err != nil {
+						return
+					}
+					received <- string(b)
+				}
+			}()
+		}
+	}()
+
+	tcp, err := DialSyslog("tcp", l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	logs := NewLevelLogHandler(tcp)
+	logs.Debugf("dropped")
+	logs.Errorf("first")
+
+	// A broken connection is dialed again
+	tcp.conn.mu.Lock()
+	_ = tcp.conn.conn.Close()
+	tcp.conn.mu.Unlock()
+	logs.Infof("second")
+
+	// Over two connections, so in any order
+	messages := make([]string, 2)
+	for i := range messages {
+		select {
+		case messages[i] = <-received:
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+	slices.Sort(messages)
+	if !strings.HasPrefix(messages[0], "<27>1 ") || !strings.HasSuffix(messages[0], " - - first") || // daemon, err
+		!strings.HasPrefix(messages[1], "<30>1 ") || !strings.HasSuffix(messages[1], " - - second") { // daemon, info
+		t.Errorf("unexpected messages %q", messages)
+	}
+}
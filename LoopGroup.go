@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Loop group
+//
+// A long-running loop needs three things to stop cleanly: a context it
+// watches, something that interrupts the call it blocks in (closing the
+// socket, like echoServerUDP does, or moving a deadline), and a way for
+// whoever started it to wait until it actually returned. The first two
+// vary from loop to loop; the third is always the same WaitGroup, and
+// LoopGroup is it:
+//
+//	var loops LoopGroup
+//	loops.Go(func(ctx context.Context) {
+//		stop := context.AfterFunc(ctx, func() { _ = pc.Close() })
+//		defer stop()
+//		for { ... }
+//	})
+//	...
+//	err := loops.Shutdown(ctx)
+//
+// Shutdown cancels the context every loop got and waits for all of them
+// to return, or for its own ctx to end first. Go after Shutdown doesn't
+// start anything. The zero value is ready to use, with a context that
+// only Shutdown cancels; NewLoopGroup ties it to a parent as well.
+
+// LoopGroup runs goroutines sharing a context and waits for them
+type LoopGroup struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopping bool
+
+	wg sync.WaitGroup
+}
+
+// NewLoopGroup returns a group whose loops also stop when parent is done
+func NewLoopGroup(parent context.Context) *LoopGroup {
+	g := new(LoopGroup)
+	g.ctx, g.cancel = context.WithCancel(parent)
+
+	return g
+}
+
+// init creates the context of a zero LoopGroup; g.mu is held
+func (g *LoopGroup) init() {
+	if g.ctx == nil {
+		g.ctx, g.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// Context returns the context the loops get, done once Shutdown is
+// called or the parent is done
+func (g *LoopGroup) Context() context.Context {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+
+	return g.ctx
+}
+
+// Go runs fn in its own goroutine. It reports false, without running
+// fn, once Shutdown has been called.
+func (g *LoopGroup) Go(fn func(ctx context.Context)) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+
+	if g.stopping {
+		return false
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		fn(g.ctx)
+	}()
+
+	return true
+}
+
+// Wait waits for the loops to return on their own
+func (g *LoopGroup) Wait() {
+	g.wg.Wait()
+}
+
+// Shutdown cancels the loops' context and waits for them to return.
+// When ctx is done first, it returns ctx.Err(); the loops are still
+// canceled and go on winding down in the background.
+func (g *LoopGroup) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	g.init()
+	g.stopping = true
+	g.cancel()
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestLoopGroup(t *testing.T) {
+	var loops LoopGroup
+
+	// A loop blocked in a read, interrupted by closing its socket
+	pc := testPacketConn(t)
+	returned := make(chan struct{})
+	loops.Go(func(ctx context.Context) {
+		defer close(returned)
+		stop := context.AfterFunc(ctx, func() { _ = pc.Close() })
+		defer stop()
+
+		buf := make([]byte, 1)
+		for {
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	})
+
+	// And one that won't stop in time
+	release := make(chan struct{})
+	loops.Go(func(context.Context) { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := loops.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the stuck loop to time out the shutdown; actual: %v", err)
+	}
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("closing the socket didn't end the read loop")
+	}
+
+	if loops.Go(func(context.Context) { t.Error("started after shutdown") }) {
+		t.Error("expected Go to refuse after shutdown")
+	}
+
+	close(release)
+	if err := loops.Shutdown(context.Background()); err != nil {
+		t.Errorf("second shutdown: %v", err)
+	}
+	if _, _, err := pc.ReadFrom(make([]byte, 1)); !IsClosed(err) {
+		t.Errorf("expected the socket closed; actual: %v", err)
+	}
+}
@@ -1,4 +1,65 @@
 package main
 
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+)
+
+// commands maps the first command line argument to the tool it runs,
+// e.g. "golearn ping 127.0.0.1"
+var commands = map[string]func(args []string) error{
+	"arp":      arpMain,
+	"bench":    benchMain,
+	"capture":  captureMain,
+	"dhclient": dhclientMain,
+	"gocat":    gocatMain,
+	"http":     httpMain,
+	"iperf":    iperfMain,
+	"ping":     pingMain,
+	"registry": registryMain,
+	"serve":    serveMain,
+	"syslogd":  syslogdMain,
+	"tlvd":     tlvdMain,
+	"watch":    watchMain,
+	"whois":    whoisMain,
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [arguments]\n\ncommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", name)
+	}
+}
+
+// signalContext returns a context canceled on Ctrl+C, so commands can
+// stop and print their summary
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
 }
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// In-memory connections
+//
+// Tests that bind loopback ports are slow to set up, can collide with
+// each other and with whatever else runs on the machine, and need
+// cleanup. Most of them only want two ends of a net.Conn.
+//
+// net.Pipe gives exactly that, but it has no buffer: every Write waits
+// for a Read, so a test writing a request before reading the response
+// on the same goroutine deadlocks, where a socket would have buffered
+// it. MemPipe behaves like a socket pair instead:
+//
+// - each direction buffers up to memPipeBuffer bytes, then Write blocks
+// - read and write deadlines, reported as timeouts like the real thing
+// - Close is a FIN: the peer reads what's left, then io.EOF; its writes
+//   fail with EPIPE
+// - CloseWrite half-closes, as with *net.TCPConn
+// - addresses, so logs and RemoteAddr() work
+//
+// A MemNetwork adds names: Listen on an address, DialContext to it. Its
+// DialContext has the signature http.Transport and ReconnectingConn
+// expect, so whole clients and servers can be tested without a port.
+
+// memPipeBuffer is how much a direction holds before Write blocks
+const memPipeBuffer = 64 << 10
+
+// MemAddr is the address of an in-memory endpoint
+type MemAddr string
+
+func (a MemAddr) Network() string { return "mem" }
+func (a MemAddr) String() string  { return string(a) }
+
+// memDeadline is a deadline whose expiry closes a channel, so waits can
+// select on it
+type memDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newMemDeadline() *memDeadline {
+	return &memDeadline{expired: make(chan struct{})}
+}
+
+func (d *memDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// A timer already fired has closed expired, or is about to
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.expired:
+		closed = true
+	default:
+	}
+
+	switch dur := time.Until(t); {
+	case t.IsZero() || dur > 0:
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		if !t.IsZero() {
+			expired := d.expired
+			d.timer = time.AfterFunc(dur, func() { close(expired) })
+		}
+	case !closed:
+		close(d.expired)
+	}
+}
+
+// passed reports whether the deadline expired
+func (d *memDeadline) passed() bool {
+	select {
+	case <-d.wait():
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *memDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+// memPipe is one direction of a MemPipe
+type memPipe struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	changed chan struct{} // Closed and replaced on every change
+	rclosed bool          // The reading end is gone
+	wclosed bool          // No more data will come
+}
+
+func newMemPipe() *memPipe {
+	return &memPipe{changed: make(chan struct{})}
+}
+
+// signal wakes up the waiters; p.mu is held
+func (p *memPipe) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// MemConn is one end of a MemPipe
+type MemConn struct {
+	local, remote MemAddr
+	rx, tx        *memPipe
+
+	readDeadline, writeDeadline *memDeadline
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+// MemPipe returns two connected in-memory connections
+func MemPipe() (net.Conn, net.Conn) {
+	return memPipeAddrs("mem:a", "mem:b")
+}
+
+func memPipeAddrs(a, b MemAddr) (*MemConn, *MemConn) {
+	ab, ba := newMemPipe(), newMemPipe()
+	newConn := func(local, remote MemAddr, rx, tx *memPipe) *MemConn {
+		return &MemConn{
+			local: local, remote: remote, rx: rx, tx: tx,
+			readDeadline:  newMemDeadline(),
+			writeDeadline: newMemDeadline(),
+			closed:        make(chan struct{}),
+		}
+	}
+
+	return newConn(a, b, ba, ab), newConn(b, a, ab, ba)
+}
+
+func (c *MemConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "mem", Source: c.local, Addr: c.remote, Err: err}
+}
+
+// Read reads buffered data, waiting while there is none
+func (c *MemConn) Read(b []byte) (int, error) {
+	for {
+		c.rx.mu.Lock()
+		switch {
+		case c.rx.rclosed:
+			c.rx.mu.Unlock()
+			return 0, c.opError("read", net.ErrClosed)
+		case c.readDeadline.passed():
+			// An expired deadline wins over buffered data, as on a
+			// socket
+			c.rx.mu.Unlock()
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		case c.rx.buf.Len() > 0:
+			n, _ := c.rx.buf.Read(b)
+			c.rx.signal()
+			c.rx.mu.Unlock()
+			return n, nil
+		case c.rx.wclosed:
+			c.rx.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := c.rx.changed
+		c.rx.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-c.readDeadline.wait():
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// Write buffers b, waiting while the buffer is full
+func (c *MemConn) Write(b []byte) (int, error) {
+	var written int
+	for {
+		c.tx.mu.Lock()
+		switch {
+		case c.tx.wclosed:
+			c.tx.mu.Unlock()
+			select {
+			case <-c.closed:
+				return written, c.opError("write", net.ErrClosed)
+			default:
+				return written, c.opError("write", syscall.EPIPE)
+			}
+		case c.tx.rclosed:
+			c.tx.mu.Unlock()
+			return written, c.opError("write", syscall.EPIPE)
+		case c.writeDeadline.passed():
+			c.tx.mu.Unlock()
+			return written, c.opError("write", os.ErrDeadlineExceeded)
+		}
+		if space := memPipeBuffer - c.tx.buf.Len(); space > 0 {
+			n := min(space, len(b)-written)
+			c.tx.buf.Write(b[written : written+n])
+			written += n
+			c.tx.signal()
+		}
+		changed := c.tx.changed
+		c.tx.mu.Unlock()
+
+		if written == len(b) {
+			return written, nil
+		}
+		select {
+		case <-changed:
+		case <-c.writeDeadline.wait():
+			return written, c.opError("write", os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// CloseWrite signals EOF to the peer while reads go on
+func (c *MemConn) CloseWrite() error {
+	c.tx.mu.Lock()
+	defer c.tx.mu.Unlock()
+	c.tx.wclosed = true
+	c.tx.signal()
+
+	return nil
+}
+
+// Close closes both directions; the peer still reads what's buffered
+func (c *MemConn) Close() error {
+	err := c.opError("close", net.ErrClosed)
+	c.once.Do(func() {
+		close(c.closed)
+		_ = c.CloseWrite()
+		c.rx.mu.Lock()
+		c.rx.rclosed = true
+		c.rx.buf.Reset()
+		c.rx.signal()
+		c.rx.mu.Unlock()
+		err = nil
+	})
+
+	return err
+}
+
+func (c *MemConn) LocalAddr() net.Addr  { return c.local }
+func (c *MemConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *MemConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *MemConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *MemConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// MemNetwork is a namespace of in-memory listeners. The zero value is
+// ready to use.
+type MemNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*MemListener
+	next      int
+}
+
+// Listen starts listening on addr; an empty addr picks a free one.
+// Addresses look like host:port, as HTTP clients insist on a port.
+func (n *MemNetwork) Listen(addr string) (*MemListener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.listeners == nil {
+		n.listeners = make(map[string]*MemListener)
+	}
+	if addr == "" {
+		n.next++
+		addr = "mem:" + strconv.Itoa(n.next)
+	}
+	if _, ok := n.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "mem", Addr: MemAddr(addr), Err: syscall.EADDRINUSE}
+	}
+
+	l := &MemListener{network: n, addr: MemAddr(addr), conns: make(chan *MemConn), done: make(chan struct{})}
+	n.listeners[addr] = l
+
+	return l, nil
+}
+
+// DialContext connects to the listener at addr; network is ignored
+func (n *MemNetwork) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	n.next++
+	local := MemAddr("mem:" + strconv.Itoa(n.next))
+	n.mu.Unlock()
+
+	refused := &net.OpError{Op: "dial", Net: "mem", Source: local, Addr: MemAddr(addr), Err: syscall.ECONNREFUSED}
+	if !ok {
+		return nil, refused
+	}
+
+	client, server := memPipeAddrs(local, l.addr)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, refused
+	case <-ctx.Done():
+		return nil, &net.OpError{Op: "dial", Net: "mem", Source: local, Addr: l.addr, Err: ctx.Err()}
+	}
+}
+
+// MemListener accepts connections dialed through its MemNetwork
+type MemListener struct {
+	network *MemNetwork
+	addr    MemAddr
+	conns   chan *MemConn
+	once    sync.Once
+	done    chan struct{}
+}
+
+// Accept waits for the next dialer
+func (l *MemListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "mem", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close stops listening and frees the address
+func (l *MemListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+	})
+
+	return nil
+}
+
+func (l *MemListener) Addr() net.Addr { return l.addr }
+
+func TestMemConn(t *testing.T) {
+	a, b := MemPipe()
+	defer a.Close()
+	defer b.Close()
+
+	// Writes are buffered, no reader needed
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := ReadExactly(b, 5); err != nil || string(msg) != "hello" {
+		t.Fatalf("unexpected read %q, %v", msg, err)
+	}
+
+	// Until the buffer is full: then the write deadline applies
+	_ = a.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	n, err := a.Write(make([]byte, memPipeBuffer+1))
+	if n != memPipeBuffer || !IsTimeout(err) {
+		t.Errorf("expected a timeout after %d bytes; actual: %d, %v", memPipeBuffer, n, err)
+	}
+	_ = a.SetWriteDeadline(time.Time{})
+	if _, err := io.CopyN(io.Discard, b, memPipeBuffer); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read deadlines, and clearing them
+	_ = b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := b.Read(make([]byte, 1)); !IsTimeout(err) {
+		t.Errorf("expected a read timeout; actual: %v", err)
+	}
+	_ = b.SetReadDeadline(time.Time{})
+	go func() { _, _ = a.Write([]byte("x")) }()
+	if _, err := ReadExactly(b, 1); err != nil {
+		t.Errorf("read after clearing the deadline: %v", err)
+	}
+
+	// Half-close: b sees EOF and can still answer
+	_ = a.(*MemConn).CloseWrite()
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF; actual: %v", err)
+	}
+	_, _ = b.Write([]byte("bye"))
+	_ = b.Close()
+	if msg, err := io.ReadAll(a); err != nil || string(msg) != "bye" {
+		t.Errorf("expected bye then EOF; actual: %q, %v", msg, err)
+	}
+
+	// Writing to a closed peer fails like a socket
+	c, d := MemPipe()
+	_ = d.Close()
+	if _, err := c.Write([]byte("x")); !errors.Is(err, syscall.EPIPE) || !IsTransient(err) {
+		t.Errorf("expected EPIPE; actual: %v", err)
+	}
+	_ = c.Close()
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected net.ErrClosed; actual: %v", err)
+	}
+}
+
+func TestMemNetwork(t *testing.T) {
+	t.Parallel()
+
+	var network MemNetwork
+	l, err := network.Listen("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := network.Listen(l.Addr().String()); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("expected EADDRINUSE; actual: %v", err)
+	}
+
+	// A whole HTTP client and server without a port
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "hello %s", r.RemoteAddr)
+	})}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: network.DialContext}}
+	resp, err := client.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "hello mem:2" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	// Nobody listening: refused, and retryable like the real thing
+	_ = l.Close()
+	if _, err := network.DialContext(context.Background(), "mem", l.Addr().String()); !errors.Is(err, syscall.ECONNREFUSED) || !IsTransient(err) {
+		t.Errorf("expected ECONNREFUSED; actual: %v", err)
+	}
+}
@@ -0,0 +1,941 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Gossip membership (SWIM)
+//
+// A heartbeat (Heartbeat.go) tells one peer the other is still there.
+// A cluster of n nodes each heartbeating every other one sends n² beats
+// a round, and still disagrees about who is up when a link rather than
+// a node fails. SWIM (Das, Gupta, Motivala, 2002) spreads the work:
+//
+// - Failure detection: every ProbeInterval a node pings one member, the
+//   next of a shuffled round so each is probed once a round. Without an
+//   ack within ProbeTimeout it asks IndirectChecks other members to ping
+//   it for it (ping-req), which tells a dead member from a bad path
+//   between two live ones. Nothing either way, and the member becomes
+//   suspect.
+// - Suspicion: a suspect member that doesn't refute within
+//   SuspectTimeout is declared dead. It refutes by gossiping that it's
+//   alive with a higher incarnation number, a counter only a member
+//   itself increments, so newer news about a member always wins over
+//   older: alive(i) < suspect(i) < dead(i) < alive(i+1).
+// - Dissemination: there are no messages of their own for changes;
+//   every ping, ping-req and ack carries the most recent ones along
+//   (piggybacking), each sent about 4·log(n) times, which reaches the
+//   whole cluster with high probability.
+//
+// Joining needs the full state at once, more than a datagram holds, so
+// it's a push/pull over a reliable UDP connection (RUDP.go) to a seed:
+// both send what they know, both merge. The gossip and the connections
+// share the one socket; gossip messages start with a byte of 0x80 or
+// more, which RUDP packets never do, and the rest goes to an
+// RUDPListener.
+//
+// A node leaving tells the others by gossiping itself as left, so they
+// don't take it for dead. Members returns who is alive or suspect, and
+// OnChange reports every change of a member's state.
+//
+//	m := NewMembership("node-2", pc)
+//	go m.Serve(ctx)
+//	_, err := m.Join(ctx, "10.0.0.1:7946")
+//
+// Lite: no encryption or authentication of the gossip (run it on a
+// trusted network), no Lifeguard refinements, and dead members are
+// remembered, not reaped.
+
+// MemberState is what a node knows about a member
+type MemberState uint8
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+	MemberLeft
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	case MemberLeft:
+		return "left"
+	}
+	return fmt.Sprintf("MemberState(%d)", s)
+}
+
+// Member is a node of the cluster
+type Member struct {
+	Name        string      `json:"name"`
+	Addr        string      `json:"addr"` // Gossip address
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"incarnation"`
+}
+
+// Gossip message types
+const (
+	memberPing byte = iota + 0x80
+	memberAck
+	memberPingReq
+)
+
+const (
+	memberMaxPacket       = 1200 // Like RUDP, under the usual MTU
+	memberRetransmitMult  = 4    // Sends of a change: memberRetransmitMult·log10(n+1)
+	memberPushPullTimeout = 10 * time.Second
+)
+
+// memberEntry is a member with its resolved address
+type memberEntry struct {
+	Member
+	addr      *net.UDPAddr
+	suspected time.Time // When it became suspect
+}
+
+// memberBroadcast is a change being piggybacked
+type memberBroadcast struct {
+	member Member
+	sent   int
+}
+
+// Membership runs a node of a gossip cluster
+type Membership struct {
+	ProbeInterval  time.Duration // 1s by default
+	ProbeTimeout   time.Duration // 500ms by default
+	SuspectTimeout time.Duration // 5s by default
+	IndirectChecks int           // 3 by default
+
+	// OnChange, if set, is called with the member whenever a member
+	// joins or its state changes, one call at a time
+	OnChange func(Member)
+
+	ErrorLog *log.Logger
+
+	name    string
+	pc      net.PacketConn
+	rudp    *forwardedPacketConn
+	seq     atomic.Uint32
+	left    chan struct{} // Closed once Leave is done
+	deliver sync.Mutex    // Keeps the OnChange calls in order
+
+	mu      sync.Mutex
+	members map[string]*memberEntry
+	queue   []*memberBroadcast
+	acks    map[uint32]chan struct{}
+	order   []string // Left to probe this round
+	pending []Member // Changes for OnChange
+}
+
+// NewMembership returns the node name gossiping on pc, which the node
+// then owns. Its address is the local address of pc, so pc must be
+// bound to an address the other nodes reach.
+func NewMembership(name string, pc net.PacketConn) *Membership {
+	self := &memberEntry{Member: Member{Name: name, Addr: pc.LocalAddr().String()}}
+	self.addr, _ = pc.LocalAddr().(*net.UDPAddr)
+
+	return &Membership{
+		name:    name,
+		pc:      pc,
+		rudp:    newForwardedPacketConn(pc),
+		left:    make(chan struct{}),
+		members: map[string]*memberEntry{name: self},
+		acks:    make(map[uint32]chan struct{}),
+	}
+}
+
+func (m *Membership) probeInterval() time.Duration {
+	if m.ProbeInterval > 0 {
+		return m.ProbeInterval
+	}
+	return time.Second
+}
+
+func (m *Membership) probeTimeout() time.Duration {
+	if m.ProbeTimeout > 0 {
+		return m.ProbeTimeout
+	}
+	return 500 * time.Millisecond
+}
+
+func (m *Membership) suspectTimeout() time.Duration {
+	if m.SuspectTimeout > 0 {
+		return m.SuspectTimeout
+	}
+	return 5 * time.Second
+}
+
+func (m *Membership) indirectChecks() int {
+	if m.IndirectChecks > 0 {
+		return m.IndirectChecks
+	}
+	return 3
+}
+
+func (m *Membership) logf(format string, v ...any) {
+	if m.ErrorLog != nil {
+		m.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Serve answers the gossip, probes the members and accepts joins until
+// ctx is canceled or Leave is done; then it closes the socket
+func (m *Membership) Serve(ctx context.Context) error {
+	if m.name == "" || len(m.name) > math.MaxUint8 {
+		return fmt.Errorf("membership: invalid name %q", m.name)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.left:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Joins arrive over RUDP, handled like any TCP connection
+	srv := NewTCPServer(NewRUDPListener(m.rudp))
+	srv.ErrorLog = m.ErrorLog
+	go func() { _ = srv.Serve(ctx, m.pushPullConn) }()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	// The heartbeat drives the probes: one per "ping"
+	reset := make(chan time.Duration, 1)
+	reset <- m.probeInterval()
+	go Pinger(ctx, &memberProber{ctx: ctx, m: m}, reset)
+
+	err := ServePacket(ctx, m.pc, m.handle)
+	select {
+	case <-m.left:
+		return nil
+	default:
+	}
+
+	return err
+}
+
+// memberProber probes a member on every write of the Pinger
+type memberProber struct {
+	ctx context.Context
+	m   *Membership
+}
+
+func (p *memberProber) Write(b []byte) (int, error) {
+	p.m.probe(p.ctx)
+	return len(b), nil
+}
+
+// handle is the PacketHandler of the socket
+func (m *Membership) handle(ctx context.Context, pc net.PacketConn, addr net.Addr, packet []byte) {
+	if len(packet) == 0 || packet[0] < memberPing {
+		m.rudp.forward(packet, addr)
+		return
+	}
+	msg, ok := parseMemberMessage(packet)
+	if !ok {
+		return
+	}
+
+	m.mu.Lock()
+	for _, u := range msg.updates {
+		m.apply(u, time.Now())
+	}
+	m.mu.Unlock()
+	m.notify()
+
+	switch msg.typ {
+	case memberPing:
+		// For an earlier node on this address, maybe
+		if msg.name == m.name {
+			m.send(addr, memberAck, msg.seq, "", "")
+		}
+	case memberAck:
+		m.mu.Lock()
+		if acked, ok := m.acks[msg.seq]; ok {
+			select {
+			case acked <- struct{}{}:
+			default:
+			}
+		}
+		m.mu.Unlock()
+	case memberPingReq:
+		target, err := net.ResolveUDPAddr("udp", msg.addr)
+		if err != nil {
+			return
+		}
+		if m.ping(ctx, msg.name, target, m.probeTimeout()) {
+			m.send(addr, memberAck, msg.seq, "", "")
+		}
+	}
+}
+
+// probe checks on the next member of the round
+func (m *Membership) probe(ctx context.Context) {
+	m.mu.Lock()
+	m.expireSuspects(time.Now())
+	target, ok := m.nextTarget()
+	m.mu.Unlock()
+	m.notify()
+	if !ok {
+		return
+	}
+
+	if m.ping(ctx, target.Name, target.addr, m.probeTimeout()) {
+		return
+	}
+
+	// Maybe it's only the path between us: others try
+	m.mu.Lock()
+	helpers := m.randomMembers(m.indirectChecks(), target.Name)
+	m.mu.Unlock()
+	seq, acked := m.expectAck()
+	defer m.forgetAck(seq)
+	for _, h := range helpers {
+		m.send(h.addr, memberPingReq, seq, target.Name, target.Addr)
+	}
+	if waitAck(ctx, acked, m.probeTimeout()) || ctx.Err() != nil {
+		return
+	}
+
+	m.mu.Lock()
+	if e := m.members[target.Name]; e != nil && e.State == MemberAlive {
+		m.apply(Member{Name: e.Name, Addr: e.Addr, State: MemberSuspect, Incarnation: e.Incarnation}, time.Now())
+	}
+	m.mu.Unlock()
+	m.notify()
+}
+
+// ping pings the member name at addr, reporting whether it answered
+// within timeout. extra goes along whatever else is piggybacked.
+func (m *Membership) ping(ctx context.Context, name string, addr net.Addr, timeout time.Duration, extra ...Member) bool {
+	seq, acked := m.expectAck()
+	defer m.forgetAck(seq)
+	m.send(addr, memberPing, seq, name, "", extra...)
+
+	return waitAck(ctx, acked, timeout)
+}
+
+func waitAck(ctx context.Context, acked <-chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-acked:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// expectAck returns a new sequence number and the channel its ack is
+// signaled on
+func (m *Membership) expectAck() (uint32, <-chan struct{}) {
+	seq := m.seq.Add(1)
+	acked := make(chan struct{}, 1)
+	m.mu.Lock()
+	m.acks[seq] = acked
+	m.mu.Unlock()
+
+	return seq, acked
+}
+
+func (m *Membership) forgetAck(seq uint32) {
+	m.mu.Lock()
+	delete(m.acks, seq)
+	m.mu.Unlock()
+}
+
+// send sends a gossip message with the changes piggybacked, extra first
+func (m *Membership) send(addr net.Addr, typ byte, seq uint32, name, target string, extra ...Member) {
+	msg := memberMessage{typ: typ, seq: seq, name: name, addr: target, updates: extra}
+	size := len(msg.appendTo(nil))
+
+	m.mu.Lock()
+	n := len(m.members)
+	slices.SortStableFunc(m.queue, func(a, b *memberBroadcast) int { return a.sent - b.sent })
+	for _, b := range m.queue {
+		size += memberUpdateSize(b.member)
+		if size > memberMaxPacket || len(msg.updates) == math.MaxUint8 {
+			break
+		}
+		msg.updates = append(msg.updates, b.member)
+		b.sent++
+	}
+	limit := memberRetransmitMult * int(math.Ceil(math.Log10(float64(n+1))))
+	m.queue = slices.DeleteFunc(m.queue, func(b *memberBroadcast) bool { return b.sent >= limit })
+	m.mu.Unlock()
+
+	if _, err := m.pc.WriteTo(msg.appendTo(nil), addr); err != nil && !errors.Is(err, net.ErrClosed) {
+		m.logf("membership: %s: %v", addr, err)
+	}
+}
+
+// apply merges what's said about a member; m.mu is held
+func (m *Membership) apply(u Member, now time.Time) {
+	if u.Name == m.name {
+		self := m.members[m.name]
+		switch {
+		case self.State == MemberLeft:
+		case u.State != MemberAlive && u.Incarnation >= self.Incarnation:
+			// Refute: we're alive, and newer than the rumor
+			self.Incarnation = u.Incarnation + 1
+			m.broadcast(self.Member)
+		case u.Incarnation > self.Incarnation:
+			self.Incarnation = u.Incarnation
+		}
+		return
+	}
+
+	e := m.members[u.Name]
+	if e != nil && !supersedes(e.Member, u) {
+		return
+	}
+	// A new member is news when it's live, one we never saw alive
+	// that's dead or gone isn't
+	changed := live(u.State)
+	if e != nil {
+		changed = e.State != u.State
+	}
+	if e == nil || e.Addr != u.Addr {
+		addr, err := net.ResolveUDPAddr("udp", u.Addr)
+		if err != nil {
+			return
+		}
+		if e == nil {
+			e = &memberEntry{}
+			m.members[u.Name] = e
+		}
+		e.addr = addr
+	}
+
+	e.Member = u
+	if changed && u.State == MemberSuspect {
+		e.suspected = now
+	}
+	m.broadcast(u)
+	if changed {
+		m.pending = append(m.pending, u)
+	}
+}
+
+// supersedes reports whether u is newer news than old
+func supersedes(old, u Member) bool {
+	if u.Incarnation != old.Incarnation {
+		return u.Incarnation > old.Incarnation
+	}
+	switch u.State {
+	case MemberSuspect:
+		return old.State == MemberAlive
+	case MemberDead, MemberLeft:
+		return old.State == MemberAlive || old.State == MemberSuspect
+	}
+	return false
+}
+
+// broadcast queues a change for piggybacking, replacing an older one
+// about the same member; m.mu is held
+func (m *Membership) broadcast(u Member) {
+	m.queue = slices.DeleteFunc(m.queue, func(b *memberBroadcast) bool { return b.member.Name == u.Name })
+	m.queue = append(m.queue, &memberBroadcast{member: u})
+}
+
+// expireSuspects declares dead the suspects that didn't refute in time;
+// m.mu is held
+func (m *Membership) expireSuspects(now time.Time) {
+	for _, e := range m.members {
+		if e.State == MemberSuspect && now.Sub(e.suspected) >= m.suspectTimeout() {
+			m.apply(Member{Name: e.Name, Addr: e.Addr, State: MemberDead, Incarnation: e.Incarnation}, now)
+		}
+	}
+}
+
+// nextTarget returns the next member to probe, starting a new shuffled
+// round when this one is over; m.mu is held
+func (m *Membership) nextTarget() (memberEntry, bool) {
+	for range 2 {
+		if len(m.order) == 0 {
+			for _, e := range m.members {
+				if e.Name != m.name && live(e.State) {
+					m.order = append(m.order, e.Name)
+				}
+			}
+			rand.Shuffle(len(m.order), func(i, j int) { m.order[i], m.order[j] = m.order[j], m.order[i] })
+		}
+		for len(m.order) > 0 {
+			e := m.members[m.order[0]]
+			m.order = m.order[1:]
+			if live(e.State) {
+				return *e, true
+			}
+		}
+	}
+
+	return memberEntry{}, false
+}
+
+// randomMembers returns up to n live members other than this node and
+// except; m.mu is held
+func (m *Membership) randomMembers(n int, except string) []memberEntry {
+	var all []memberEntry
+	for _, e := range m.members {
+		if e.Name != m.name && e.Name != except && live(e.State) {
+			all = append(all, *e)
+		}
+	}
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+
+	return all[:min(n, len(all))]
+}
+
+func live(s MemberState) bool {
+	return s == MemberAlive || s == MemberSuspect
+}
+
+// notify hands the pending changes to OnChange
+func (m *Membership) notify() {
+	m.deliver.Lock()
+	defer m.deliver.Unlock()
+
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = nil
+	m.mu.Unlock()
+
+	if m.OnChange != nil {
+		for _, u := range pending {
+			m.OnChange(u)
+		}
+	}
+}
+
+// Members returns the members alive or suspect, this node included,
+// by name
+func (m *Membership) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var members []Member
+	for _, e := range m.members {
+		if live(e.State) {
+			members = append(members, e.Member)
+		}
+	}
+	slices.SortFunc(members, func(a, b Member) int { return strings.Compare(a.Name, b.Name) })
+
+	return members
+}
+
+// snapshot returns everything known, for a push/pull
+func (m *Membership) snapshot() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for _, e := range m.members {
+		members = append(members, e.Member)
+	}
+
+	return members
+}
+
+// merge applies the state of another node
+func (m *Membership) merge(members []Member) {
+	m.mu.Lock()
+	now := time.Now()
+	for _, u := range members {
+		if u.Name != "" && len(u.Name) <= math.MaxUint8 && len(u.Addr) <= math.MaxUint8 && u.State <= MemberLeft {
+			m.apply(u, now)
+		}
+	}
+	m.mu.Unlock()
+	m.notify()
+}
+
+// Join exchanges the full state with each of the seeds, the gossip
+// addresses of members, and returns how many were reached. It fails
+// only when none was.
+func (m *Membership) Join(ctx context.Context, seeds ...string) (int, error) {
+	var errs []error
+	joined := 0
+	for _, seed := range seeds {
+		if err := m.pushPull(ctx, seed); err != nil {
+			errs = append(errs, fmt.Errorf("membership: join %s: %w", seed, err))
+			continue
+		}
+		joined++
+	}
+	if joined == 0 {
+		return 0, errors.Join(errs...)
+	}
+
+	return joined, nil
+}
+
+// pushPull sends our state to seed and merges its state
+func (m *Membership) pushPull(ctx context.Context, seed string) error {
+	conn, err := DialRUDP(ctx, seed)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(memberPushPullTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if err := json.NewEncoder(conn).Encode(m.snapshot()); err != nil {
+		return err
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return err
+	}
+	var members []Member
+	if err := json.NewDecoder(conn).Decode(&members); err != nil {
+		return err
+	}
+	m.merge(members)
+
+	return nil
+}
+
+// pushPullConn is the seed's side of a push/pull
+func (m *Membership) pushPullConn(_ context.Context, conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(memberPushPullTimeout))
+
+	var members []Member
+	if err := json.NewDecoder(conn).Decode(&members); err != nil {
+		m.logf("membership: join from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	// Answer with what we knew before, the joiner knows its part
+	snapshot := m.snapshot()
+	m.merge(members)
+	if err := json.NewEncoder(conn).Encode(snapshot); err != nil {
+		m.logf("membership: join from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// Leave tells the live members this node leaves, waiting for their acks
+// until the probe timeout or ctx is done, and stops Serve
+func (m *Membership) Leave(ctx context.Context) error {
+	m.mu.Lock()
+	self := m.members[m.name]
+	if self.State == MemberLeft {
+		m.mu.Unlock()
+		return nil
+	}
+	self.Incarnation++
+	self.State = MemberLeft
+	left := self.Member
+	m.broadcast(left)
+	targets := m.randomMembers(len(m.members), "")
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.ping(ctx, t.Name, t.addr, m.probeTimeout(), left)
+		}()
+	}
+	wg.Wait()
+	close(m.left)
+
+	return ctx.Err()
+}
+
+// memberMessage is a decoded gossip message. name and addr are the
+// target of a ping or ping-req.
+type memberMessage struct {
+	typ        byte
+	seq        uint32
+	name, addr string
+	updates    []Member
+}
+
+// appendTo appends the encoded message to b:
+// type, seq, name, addr, count, then per update state, incarnation,
+// name and addr, strings prefixed with their length
+func (msg *memberMessage) appendTo(b []byte) []byte {
+	b = append(b, msg.typ)
+	b = binary.BigEndian.AppendUint32(b, msg.seq)
+	b = appendMemberString(b, msg.name)
+	b = appendMemberString(b, msg.addr)
+	b = append(b, byte(len(msg.updates)))
+	for _, u := range msg.updates {
+		b = append(b, byte(u.State))
+		b = binary.BigEndian.AppendUint64(b, u.Incarnation)
+		b = appendMemberString(b, u.Name)
+		b = appendMemberString(b, u.Addr)
+	}
+
+	return b
+}
+
+func memberUpdateSize(u Member) int {
+	return 1 + 8 + 1 + len(u.Name) + 1 + len(u.Addr)
+}
+
+func appendMemberString(b []byte, s string) []byte {
+	return append(append(b, byte(len(s))), s...)
+}
+
+// parseMemberMessage decodes b
+func parseMemberMessage(b []byte) (memberMessage, bool) {
+	if len(b) < 5 || b[0] < memberPing || b[0] > memberPingReq {
+		return memberMessage{}, false
+	}
+	msg := memberMessage{typ: b[0], seq: binary.BigEndian.Uint32(b[1:])}
+	b = b[5:]
+
+	var ok bool
+	if msg.name, b, ok = readMemberString(b); !ok {
+		return memberMessage{}, false
+	}
+	if msg.addr, b, ok = readMemberString(b); !ok || len(b) < 1 {
+		return memberMessage{}, false
+	}
+	count := int(b[0])
+	b = b[1:]
+	for range count {
+		if len(b) < 9 || MemberState(b[0]) > MemberLeft {
+			return memberMessage{}, false
+		}
+		u := Member{State: MemberState(b[0]), Incarnation: binary.BigEndian.Uint64(b[1:])}
+		b = b[9:]
+		if u.Name, b, ok = readMemberString(b); !ok || u.Name == "" {
+			return memberMessage{}, false
+		}
+		if u.Addr, b, ok = readMemberString(b); !ok {
+			return memberMessage{}, false
+		}
+		msg.updates = append(msg.updates, u)
+	}
+
+	return msg, len(b) == 0
+}
+
+func readMemberString(b []byte) (string, []byte, bool) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, false
+	}
+	n := int(b[0])
+
+	return string(b[1 : 1+n]), b[1+n:], true
+}
+
+// forwardedPacketConn is a PacketConn reading the packets another
+// reader of the socket passes on, and writing to the socket
+type forwardedPacketConn struct {
+	net.PacketConn
+	packets chan forwardedPacket
+	done    chan struct{}
+	once    sync.Once
+}
+
+type forwardedPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+func newForwardedPacketConn(pc net.PacketConn) *forwardedPacketConn {
+	return &forwardedPacketConn{
+		PacketConn: pc,
+		packets:    make(chan forwardedPacket, 64),
+		done:       make(chan struct{}),
+	}
+}
+
+// forward passes b on, dropping it when the reader falls behind like a
+// full socket buffer would
+func (c *forwardedPacketConn) forward(b []byte, addr net.Addr) {
+	select {
+	case c.packets <- forwardedPacket{b: b, addr: addr}:
+	default:
+	}
+}
+
+func (c *forwardedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.packets:
+		return copy(p, pkt.b), pkt.addr, nil
+	case <-c.done:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: c.LocalAddr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops the reads; the socket belongs to the other reader
+func (c *forwardedPacketConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func TestMemberMessage(t *testing.T) {
+	msg := memberMessage{
+		typ:  memberPingReq,
+		seq:  42,
+		name: "b",
+		addr: "127.0.0.1:7946",
+		updates: []Member{
+			{Name: "c", Addr: "127.0.0.1:7947", State: MemberSuspect, Incarnation: 3},
+			{Name: "d", Addr: "127.0.0.1:7948", State: MemberLeft, Incarnation: 1},
+		},
+	}
+	b := msg.appendTo(nil)
+
+	parsed, ok := parseMemberMessage(b)
+	if !ok || parsed.typ != msg.typ || parsed.seq != msg.seq || parsed.name != msg.name ||
+		parsed.addr != msg.addr || !slices.Equal(parsed.updates, msg.updates) {
+		t.Errorf("expected %+v; actual: %+v, %t", msg, parsed, ok)
+	}
+
+	// Truncated or padded messages, and RUDP packets, are rejected
+	for _, bad := range [][]byte{b[:len(b)-1], append(b, 0), {rudpSYN, 0, 0, 0, 0, 0, 0}} {
+		if _, ok := parseMemberMessage(bad); ok {
+			t.Errorf("expected %x to be rejected", bad)
+		}
+	}
+}
+
+func TestMembershipSupersedes(t *testing.T) {
+	for _, c := range []struct {
+		old, u   Member
+		expected bool
+	}{
+		{Member{State: MemberAlive, Incarnation: 1}, Member{State: MemberSuspect, Incarnation: 1}, true},
+		{Member{State: MemberSuspect, Incarnation: 1}, Member{State: MemberAlive, Incarnation: 1}, false},
+		{Member{State: MemberSuspect, Incarnation: 1}, Member{State: MemberAlive, Incarnation: 2}, true},
+		{Member{State: MemberSuspect, Incarnation: 1}, Member{State: MemberDead, Incarnation: 1}, true},
+		{Member{State: MemberDead, Incarnation: 1}, Member{State: MemberSuspect, Incarnation: 1}, false},
+		{Member{State: MemberDead, Incarnation: 1}, Member{State: MemberAlive, Incarnation: 2}, true},
+		{Member{State: MemberAlive, Incarnation: 2}, Member{State: MemberDead, Incarnation: 1}, false},
+	} {
+		if actual := supersedes(c.old, c.u); actual != c.expected {
+			t.Errorf("%v(%d) over %v(%d): expected %t; actual: %t",
+				c.u.State, c.u.Incarnation, c.old.State, c.old.Incarnation, c.expected, actual)
+		}
+	}
+}
+
+func TestMembership(t *testing.T) {
+	type node struct {
+		m      *Membership
+		cancel context.CancelFunc
+		done   chan error
+
+		mu     sync.Mutex
+		events []string
+	}
+	start := func(name string) *node {
+		n := &node{done: make(chan error, 1)}
+		n.m = NewMembership(name, testPacketConn(t))
+		n.m.ProbeInterval = 20 * time.Millisecond
+		n.m.ProbeTimeout = 30 * time.Millisecond
+		n.m.SuspectTimeout = 200 * time.Millisecond
+		n.m.OnChange = func(u Member) {
+			n.mu.Lock()
+			n.events = append(n.events, u.Name+" "+u.State.String())
+			n.mu.Unlock()
+		}
+		var ctx context.Context
+		ctx, n.cancel = context.WithCancel(context.Background())
+		go func() { n.done <- n.m.Serve(ctx) }()
+		t.Cleanup(n.cancel)
+		return n
+	}
+	names := func(n *node) string {
+		var s []string
+		for _, u := range n.m.Members() {
+			s = append(s, u.Name+" "+u.State.String())
+		}
+		return fmt.Sprint(s)
+	}
+	eventually := func(n *node, expected string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); names(n) != expected; {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected members %s; actual: %s", n.m.name, expected, names(n))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	a, b, c := start("a"), start("b"), start("c")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A seed nobody answers on fails the join
+	unreachable, cancelUnreachable := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelUnreachable()
+	if joined, err := b.m.Join(unreachable, testUnusedAddr(t)); joined != 0 || err == nil {
+		t.Errorf("expected the join to fail; actual: %d, %v", joined, err)
+	}
+
+	// b and c only know a; b learns about c by gossip
+	for _, n := range []*node{b, c} {
+		if joined, err := n.m.Join(ctx, a.m.pc.LocalAddr().String()); joined != 1 || err != nil {
+			t.Fatalf("expected to join 1 seed; actual: %d, %v", joined, err)
+		}
+	}
+	all := "[a alive b alive c alive]"
+	for _, n := range []*node{a, b, c} {
+		eventually(n, all)
+	}
+
+	// c crashes: suspect, then dead
+	c.cancel()
+	<-c.done
+	eventually(a, "[a alive b alive]")
+	eventually(b, "[a alive b alive]")
+
+	// b leaves politely
+	if err := b.m.Leave(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-b.done; err != nil {
+		t.Errorf("expected Serve to return nil after Leave; actual: %v", err)
+	}
+	eventually(a, "[a alive]")
+
+	a.mu.Lock()
+	events := slices.Clone(a.events)
+	a.mu.Unlock()
+	for _, expected := range []string{"b alive", "c alive", "c suspect", "c dead", "b left"} {
+		if !slices.Contains(events, expected) {
+			t.Errorf("expected the event %q; actual: %v", expected, events)
+		}
+	}
+	if slices.Contains(events, "b dead") {
+		t.Errorf("expected b to have left, not died; actual: %v", events)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Per-connection message quotas
+//
+// The size limits (MaxLineLength, MaxPayloadSize, maxTokenSize) bound a
+// single message, not how many a connection sends: a client that never
+// hangs up can stream messages of the allowed size for as long as it
+// likes, holding a connection and a goroutine, filling logs and
+// whatever the handlers store. A MessageQuota bounds the whole
+// connection:
+//
+// - MaxMessages, the messages read from it
+// - MaxBytes, their bytes, framing included (delimiters, TLV headers)
+//
+// The message going over fails the read with a *QuotaError, which
+// matches ErrQuotaExceeded and ErrTooLarge, and counts in
+// quota_exceeded_total by server and limit; the server then closes the
+// connection like after any other read error. The DelimitedReader
+// servers (LineServer, SyslogServer) take one in their Quota field, and
+// so does TLVConn.
+
+// ErrQuotaExceeded is matched by errors of connections over a quota
+var ErrQuotaExceeded = errors.New("connection quota exceeded")
+
+// QuotaError is a connection going over its MessageQuota
+type QuotaError struct {
+	Limit string // "messages" or "bytes"
+	Max   int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v: more than %d %s", ErrQuotaExceeded, e.Max, e.Limit)
+}
+
+// Is makes errors.Is true for ErrQuotaExceeded and ErrTooLarge
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded || target == ErrTooLarge
+}
+
+// MessageQuota bounds what a connection may send in total. The zero
+// value has no limits.
+type MessageQuota struct {
+	MaxMessages int64 `json:"max_messages"` // 0 for no limit
+	MaxBytes    int64 `json:"max_bytes"`    // 0 for no limit
+
+	// Metrics, when set, counts the connections closed over the quota
+	// in quota_exceeded_total, labeled with Name
+	Metrics *Metrics `json:"-"`
+	Name    string   `json:"-"`
+}
+
+// quotaUsage is what a connection used of its quota, for its only
+// reader
+type quotaUsage struct {
+	quota    MessageQuota
+	messages int64
+	bytes    int64
+	err      error // Sticky, once over
+}
+
+// start returns the usage of a new connection, nil without limits
+func (q MessageQuota) start() *quotaUsage {
+	if q.MaxMessages <= 0 && q.MaxBytes <= 0 {
+		return nil
+	}
+
+	return &quotaUsage{quota: q}
+}
+
+// exceeded returns the error of a connection that went over its quota,
+// nil until then
+func (u *quotaUsage) exceeded() error {
+	if u == nil {
+		return nil
+	}
+
+	return u.err
+}
+
+// add accounts a message of n bytes, and fails once over the quota
+func (u *quotaUsage) add(n int) error {
+	if u == nil || u.err != nil {
+		return u.exceeded()
+	}
+
+	u.messages++
+	u.bytes += int64(n)
+	switch q := u.quota; {
+	case q.MaxMessages > 0 && u.messages > q.MaxMessages:
+		u.err = &QuotaError{Limit: "messages", Max: q.MaxMessages}
+	case q.MaxBytes > 0 && u.bytes > q.MaxBytes:
+		u.err = &QuotaError{Limit: "bytes", Max: q.MaxBytes}
+	default:
+		return nil
+	}
+	if q := u.quota; q.Metrics != nil {
+		limit := u.err.(*QuotaError).Limit
+		q.Metrics.Counter("quota_exceeded_total", "Connections closed over their message quota.", "server", "limit").With(q.Name, limit).Inc()
+	}
+
+	return u.err
+}
+
+func TestMessageQuota(t *testing.T) {
+	metrics := new(Metrics)
+
+	// A line server allowing 3 messages
+	s := NewLineServer()
+	s.Quota = MessageQuota{MaxMessages: 3, Metrics: metrics, Name: "line"}
+	s.Handle("ping", func(*LineSession, string) (string, error) { return "pong", nil })
+	client, server := MemPipe()
+	go s.ServeConn(server)
+
+	_, _ = io.WriteString(client, strings.Repeat("PING\r\n", 4))
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != strings.Repeat("pong\r\n", 3) {
+		t.Errorf("expected 3 replies, then the connection closed; actual: %q", got)
+	}
+
+	// A TLV connection allowing 15 bytes, headers included
+	client, server = MemPipe()
+	tc := TLVServer(server, nil)
+	tc.Quota = MessageQuota{MaxBytes: 15, Metrics: metrics, Name: "tlv"}
+	go func() {
+		for _, s := range []string{"hello", "world"} {
+			_, _ = String(s).WriteTo(client)
+		}
+	}()
+	if _, err := tc.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = tc.Receive()
+	var qErr *QuotaError
+	if !errors.As(err, &qErr) || qErr.Limit != "bytes" || !IsTooLarge(err) {
+		t.Errorf("expected over the byte quota; actual: %v", err)
+	}
+	if _, err := tc.Receive(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected the quota error to stick; actual: %v", err)
+	}
+
+	// A syslog sender allowing 1 message
+	client, server = MemPipe()
+	var messages int
+	ss := &SyslogServer{
+		Handler:  func(context.Context, *SyslogMessage) { messages++ },
+		Quota:    MessageQuota{MaxMessages: 1},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ss.ServeConn(context.Background(), server)
+	}()
+	_, _ = io.WriteString(client, "<13>1 - - - - - - first\n<13>1 - - - - - - second\n")
+	<-done
+	if messages != 1 {
+		t.Errorf("expected 1 message handled; actual: %d", messages)
+	}
+
+	var out strings.Builder
+	_, _ = metrics.WriteTo(&out)
+	for _, want := range []string{`quota_exceeded_total{server="line",limit="messages"} 1`, `quota_exceeded_total{server="tlv",limit="bytes"} 1`} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %s in\n%s", want, out.String())
+		}
+	}
+	_ = client.Close()
+}
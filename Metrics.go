@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Metrics, Prometheus style
+//
+// expvar (see Counter.go) answers "what are the numbers right now" for a
+// human with curl. A monitoring system wants more: every server in the
+// process under one endpoint, in a format it can scrape every few
+// seconds and turn into graphs and alerts. Prometheus' text format is
+// the one nearly everything reads:
+//
+//	# HELP tcp_server_accepted_total Connections accepted.
+//	# TYPE tcp_server_accepted_total counter
+//	tcp_server_accepted_total{addr="127.0.0.1:7000"} 42
+//
+// Three kinds of metrics cover almost everything:
+//
+// - counters only go up (connections accepted, bytes sent); the
+//   monitoring system derives rates from them
+// - gauges go up and down (open connections)
+// - histograms count observations into buckets (how long connections
+//   last); the buckets are cumulative, each counting everything up to
+//   its bound ("le"), so quantiles can be computed across processes
+//
+// A metric is a family of series, one per combination of label values.
+// Registering the same name twice returns the same family, which is how
+// several servers share one registry: each labels its own series.
+//
+// Components take a *Metrics field, nil meaning no instrumentation, like
+// they take a Counter. The *Metric methods do nothing on a nil receiver,
+// so instrumented code needs no nil checks. DefaultMetrics is served at
+// /metrics by the http command, and at /debug/vars through expvar (see
+// MetricsExpvar.go).
+
+// DefaultMetrics is the registry the commands expose
+var DefaultMetrics = new(Metrics)
+
+// DefaultDurationBuckets are histogram bounds in seconds, from a
+// millisecond to a few minutes
+var DefaultDurationBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 60, 300}
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// Metrics is a registry of metric families. The zero value is ready to
+// use.
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*MetricVec
+}
+
+// MetricVec is a metric family: one series per set of label values
+type MetricVec struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+
+	mu     sync.Mutex
+	series map[string]*Metric
+}
+
+// Metric is a single series
+type Metric struct {
+	vec    *MetricVec
+	values []string
+
+	mu     sync.Mutex
+	value  float64        // Counters and gauges; the sum for histograms
+	counts []uint64       // Per bucket, not cumulative
+	count  uint64         // Histogram observations
+	fn     func() float64 // Read at scrape time instead of value
+}
+
+// register returns the family called name, creating it if needed
+func (m *Metrics) register(name, help, kind string, buckets []float64, labels []string) *MetricVec {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v, ok := m.families[name]; ok {
+		if v.kind != kind || strings.Join(v.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s registered as a %s with labels %v", name, v.kind, v.labels))
+		}
+		return v
+	}
+
+	if m.families == nil {
+		m.families = make(map[string]*MetricVec)
+	}
+	v := &MetricVec{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*Metric)}
+	m.families[name] = v
+
+	return v
+}
+
+// Counter registers a counter family
+func (m *Metrics) Counter(name, help string, labels ...string) *MetricVec {
+	return m.register(name, help, metricCounter, nil, labels)
+}
+
+// Gauge registers a gauge family
+func (m *Metrics) Gauge(name, help string, labels ...string) *MetricVec {
+	return m.register(name, help, metricGauge, nil, labels)
+}
+
+// Histogram registers a histogram family with the given upper bounds,
+// DefaultDurationBuckets when nil
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *MetricVec {
+	if buckets == nil {
+		buckets = DefaultDurationBuckets
+	}
+	return m.register(name, help, metricHistogram, buckets, labels)
+}
+
+// With returns the series for the label values, in the order the labels
+// were registered
+func (v *MetricVec) With(values ...string) *Metric {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = &Metric{vec: v, values: values}
+		if v.kind == metricHistogram {
+			s.counts = make([]uint64, len(v.buckets)+1)
+		}
+		v.series[key] = s
+	}
+
+	return s
+}
+
+// Func makes the series for the label values report f() at scrape
+// time, for numbers a component already keeps
+func (v *MetricVec) Func(f func() float64, values ...string) {
+	s := v.With(values...)
+	s.mu.Lock()
+	s.fn = f
+	s.mu.Unlock()
+}
+
+// Add adds delta, which must not be negative for a counter
+func (s *Metric) Add(delta float64) {
+	if s == nil {
+		return
+	}
+	if delta < 0 && s.vec.kind == metricCounter {
+		panic("metrics: counter " + s.vec.name + " decreased")
+	}
+	s.mu.Lock()
+	s.value += delta
+	s.mu.Unlock()
+}
+
+// Inc adds one
+func (s *Metric) Inc() { s.Add(1) }
+
+// Dec subtracts one from a gauge
+func (s *Metric) Dec() { s.Add(-1) }
+
+// Set sets a gauge
+func (s *Metric) Set(v float64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.value = v
+	s.mu.Unlock()
+}
+
+// Observe records v in a histogram
+func (s *Metric) Observe(v float64) {
+	if s == nil {
+		return
+	}
+	i := sort.SearchFloat64s(s.vec.buckets, v)
+
+	s.mu.Lock()
+	s.counts[i]++
+	s.count++
+	s.value += v
+	s.mu.Unlock()
+}
+
+// ObserveDuration records d in seconds
+func (s *Metric) ObserveDuration(d time.Duration) {
+	s.Observe(d.Seconds())
+}
+
+// ServeHTTP writes every metric in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+// WriteTo writes every metric in the Prometheus text format, families
+// and series sorted so consecutive scrapes line up
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	families := make([]*MetricVec, 0, len(m.families))
+	for _, v := range m.families {
+		families = append(families, v)
+	}
+	m.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, v := range families {
+		v.writeTo(&b)
+	}
+	n, err := io.WriteString(w, b.String())
+
+	return int64(n), err
+}
+
+func (v *MetricVec) writeTo(b *strings.Builder) {
+	v.mu.Lock()
+	series := make([]*Metric, 0, len(v.series))
+	for _, s := range v.series {
+		series = append(series, s)
+	}
+	v.mu.Unlock()
+	if len(series) == 0 {
+		return
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return strings.Join(series[i].values, "\xff") < strings.Join(series[j].values, "\xff")
+	})
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeMetricHelp(v.help), v.name, v.kind)
+	for _, s := range series {
+		s.mu.Lock()
+		value := s.value
+		if s.fn != nil {
+			value = s.fn()
+		}
+
+		if v.kind != metricHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", v.name, v.labelString(s.values, ""), formatMetricValue(value))
+			s.mu.Unlock()
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, v.labelString(s.values, formatMetricValue(bound)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, v.labelString(s.values, "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", v.name, v.labelString(s.values, ""), formatMetricValue(value))
+		fmt.Fprintf(b, "%s_count%s %d\n", v.name, v.labelString(s.values, ""), s.count)
+		s.mu.Unlock()
+	}
+}
+
+// labelString formats the labels, plus le for a histogram bucket
+func (v *MetricVec) labelString(values []string, le string) string {
+	var pairs []string
+	for i, name := range v.labels {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func escapeMetricHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// metricsCounter feeds Counter reports into traffic metrics
+type metricsCounter struct {
+	bytes, messages [2]*Metric // By Direction
+}
+
+// TrafficCounter returns a Counter recording bytes and messages of
+// component, for everything that already reports to a Counter (the
+// proxy, the UDP echo server, the Monitor)
+func (m *Metrics) TrafficCounter(component string) Counter {
+	bytes := m.Counter("traffic_bytes_total", "Bytes moved, by component and direction.", "component", "direction")
+	messages := m.Counter("traffic_messages_total", "Reads, writes or datagrams, by component and direction.", "component", "direction")
+
+	var c metricsCounter
+	for _, d := range []Direction{Inbound, Outbound} {
+		c.bytes[d] = bytes.With(component, d.String())
+		c.messages[d] = messages.With(component, d.String())
+	}
+
+	return c
+}
+
+// Count implements Counter
+func (c metricsCounter) Count(d Direction, n int) {
+	if d > Outbound {
+		return
+	}
+	c.bytes[d].Add(float64(n))
+	c.messages[d].Inc()
+}
+
+// InstrumentPacketHandler counts the datagrams handled as server and
+// times the handler
+func InstrumentPacketHandler(m *Metrics, server string, handler PacketHandler) PacketHandler {
+	packets := m.Counter("udp_server_packets_total", "Datagrams received.", "server").With(server)
+	bytes := m.Counter("udp_server_bytes_total", "Bytes received in datagrams.", "server").With(server)
+	duration := m.Histogram("udp_server_handler_duration_seconds", "Time spent handling a datagram.", nil, "server").With(server)
+
+	return func(ctx context.Context, pc net.PacketConn, addr net.Addr, packet []byte) {
+		packets.Inc()
+		bytes.Add(float64(len(packet)))
+		start := time.Now()
+		handler(ctx, pc, addr, packet)
+		duration.ObserveDuration(time.Since(start))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := new(Metrics)
+	requests := m.Counter("requests_total", "Requests served.", "method", "code")
+	requests.With("GET", "200").Add(3)
+	requests.With("POST", "500").Inc()
+	open := m.Gauge("open_conns", "Open connections.")
+	open.With().Inc()
+	open.With().Inc()
+	open.With().Dec()
+	m.Gauge("goroutines", "Goroutines.").Func(func() float64 { return 7 })
+	latency := m.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}).With()
+	for _, v := range []float64{0.05, 0.5, 0.5, 2} {
+		latency.Observe(v)
+	}
+
+	// Registering again returns the same family
+	m.Counter("requests_total", "Requests served.", "method", "code").With("GET", "200").Inc()
+	// An escaped label value
+	requests.With(`say "hi"`, "200").Inc()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	expected := `# HELP goroutines Goroutines.
+# TYPE goroutines gauge
+goroutines 7
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.05
+latency_seconds_count 4
+# HELP open_conns Open connections.
+# TYPE open_conns gauge
+open_conns 1
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 4
+requests_total{method="POST",code="500"} 1
+requests_total{method="say \"hi\"",code="200"} 1
+`
+	if actual := rec.Body.String(); actual != expected {
+		t.Errorf("expected:\n%s\nactual:\n%s", expected, actual)
+	}
+
+	// A nil series is a no-op, so uninstrumented code needs no checks
+	var none *Metric
+	none.Inc()
+	none.ObserveDuration(time.Second)
+}
+
+func TestMetricsInstrumented(t *testing.T) {
+	m := new(Metrics)
+
+	// A TCP server, a CONNECT proxy in front of it and a UDP server,
+	// all reporting to m, the first two by peer as well
+	srv := NewTCPServer(testListener(t))
+	srv.Metrics = m
+	srv.Enricher = testEnricher
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = srv.Serve(ctx, func(_ context.Context, conn net.Conn) {
+			_, _ = io.Copy(conn, conn)
+		})
+	}()
+
+	proxy := startConnectProxy(t, &ConnectProxy{Allow: func(string) bool { return true }, Metrics: m, Enricher: testEnricher})
+	conn, err := DialConnect(ctx, "http://"+proxy, srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("hello"))
+	if _, err := ReadExactly(conn, 5); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	pc := testPacketConn(t)
+	echo := func(_ context.Context, pc net.PacketConn, addr net.Addr, p []byte) {
+		_, _ = pc.WriteTo(p, addr)
+	}
+	go func() { _ = ServePacket(ctx, pc, InstrumentPacketHandler(m, "echo", echo)) }()
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, _ = client.Write([]byte("ping"))
+	if _, err := client.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	// One scrape shows all of them once the connections are done
+	addr := srv.Addr().String()
+	expected := []string{
+		`tcp_server_accepted_total{addr="` + addr + `"} 1`,
+		`tcp_server_active_connections{addr="` + addr + `"} 0`,
+		`tcp_server_connection_duration_seconds_count{addr="` + addr + `"} 1`,
+		`tcp_server_peers_total{addr="` + addr + `",country="ZZ",asn="AS64500"} 1`,
+		`connect_proxy_tunnels_total{result="ok"} 1`,
+		`connect_proxy_peers_total{country="ZZ",asn="AS64500"} 1`,
+		`connect_proxy_active_tunnels 0`,
+		`traffic_bytes_total{component="connect_proxy",direction="out"} 5`,
+		`traffic_bytes_total{component="connect_proxy",direction="in"} 5`,
+		`udp_server_packets_total{server="echo"} 1`,
+		`udp_server_handler_duration_seconds_count{server="echo"} 1`,
+	}
+	var scrape string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		b := new(strings.Builder)
+		_, _ = m.WriteTo(b)
+		scrape = b.String()
+
+		missing := false
+		for _, line := range expected {
+			if !strings.Contains(scrape, line+"\n") {
+				missing = true
+			}
+		}
+		if !missing {
+			return
+		}
+	}
+	for _, line := range expected {
+		if !strings.Contains(scrape, line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+	t.Logf("scrape:\n%s", scrape)
+}
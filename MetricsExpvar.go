@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Metrics through expvar
+//
+// Not everybody runs Prometheus. The same numbers (open connections,
+// bytes, errors, retries) are just as useful at /debug/vars, where curl
+// and jq are all it takes to read them. Publish exposes a registry under
+// a single namespace key, each family becoming a map from its label
+// values to the current value:
+//
+//	"golearn": {
+//	  "tcp_server_accepted_total": {"addr=127.0.0.1:7000": 42},
+//	  "tcp_server_connection_duration_seconds": {
+//	    "addr=127.0.0.1:7000": {"count": 40, "sum": 12.5}
+//	  },
+//	  "uptime_seconds": 3600
+//	}
+//
+// Series without labels are plain numbers. Histograms only carry their
+// count and sum: the buckets are for the monitoring system to compute
+// quantiles, a person wants the average.
+//
+// Nobody watching /debug/vars? Monitor.LogVars writes the published
+// variables through the Monitor's logger every interval, which is often
+// all a small deployment needs to see what a server has been doing.
+
+// metricHistogramVar is how a histogram series looks in expvar
+type metricHistogramVar struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+}
+
+// Vars returns the current value of every series, keyed by family name
+// and then by label values ("name=value,name=value")
+func (m *Metrics) Vars() map[string]any {
+	m.mu.Lock()
+	families := make([]*MetricVec, 0, len(m.families))
+	for _, v := range m.families {
+		families = append(families, v)
+	}
+	m.mu.Unlock()
+
+	vars := make(map[string]any, len(families))
+	for _, v := range families {
+		v.mu.Lock()
+		series := make([]*Metric, 0, len(v.series))
+		for _, s := range v.series {
+			series = append(series, s)
+		}
+		v.mu.Unlock()
+		if len(series) == 0 {
+			continue
+		}
+
+		values := make(map[string]any, len(series))
+		for _, s := range series {
+			s.mu.Lock()
+			var value any = s.value
+			if s.fn != nil {
+				value = s.fn()
+			}
+			if v.kind == metricHistogram {
+				value = metricHistogramVar{Count: s.count, Sum: s.value}
+			}
+			s.mu.Unlock()
+
+			if len(v.labels) == 0 {
+				vars[v.name] = value
+				continue
+			}
+			pairs := make([]string, len(v.labels))
+			for i, name := range v.labels {
+				pairs[i] = name + "=" + s.values[i]
+			}
+			values[strings.Join(pairs, ",")] = value
+		}
+		if len(v.labels) > 0 {
+			vars[v.name] = values
+		}
+	}
+
+	return vars
+}
+
+// Publish exposes the registry through expvar under namespace. Like
+// expvar.Publish, it panics if namespace is already in use.
+func (m *Metrics) Publish(namespace string) {
+	expvar.Publish(namespace, expvar.Func(func() any {
+		return m.Vars()
+	}))
+}
+
+// LogVars logs the expvar variables called names, or all of them when
+// names is empty, every interval until ctx is done
+func (m *Monitor) LogVars(ctx context.Context, interval time.Duration, names ...string) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		if len(names) == 0 {
+			expvar.Do(func(kv expvar.KeyValue) {
+				m.Printf("%s: %s", kv.Key, kv.Value)
+			})
+			continue
+		}
+		for _, name := range names {
+			if v := expvar.Get(name); v != nil {
+				m.Printf("%s: %s", name, v)
+			}
+		}
+	}
+}
+
+func TestMetricsVars(t *testing.T) {
+	m := new(Metrics)
+	m.Counter("accepted_total", "Accepted.", "addr").With("127.0.0.1:1").Add(3)
+	m.Gauge("up", "Up.").Func(func() float64 { return 1 })
+	h := m.Histogram("duration_seconds", "Duration.", []float64{1}, "addr").With("127.0.0.1:1")
+	h.Observe(0.5)
+	h.Observe(2)
+	m.Counter("unused_total", "Never touched.", "addr")
+
+	b, err := json.Marshal(m.Vars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"accepted_total":{"addr=127.0.0.1:1":3},` +
+		`"duration_seconds":{"addr=127.0.0.1:1":{"count":2,"sum":2.5}},` +
+		`"up":1}`
+	if string(b) != expected {
+		t.Errorf("expected %s; actual: %s", expected, b)
+	}
+}
+
+func TestMonitorLogVars(t *testing.T) {
+	// expvar names are process wide, so the test picks its own
+	name := "test_monitor_log_vars_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	m := new(Metrics)
+	m.Counter("retries_total", "Retries.", "op").With("dial").Inc()
+	m.Publish(name)
+
+	buf := new(bytes.Buffer)
+	monitor := &Monitor{Logger: log.New(buf, "", 0)}
+	ctx, cancel := context.WithTimeout(context.Background(), 35*time.Millisecond)
+	defer cancel()
+	_ = monitor.LogVars(ctx, 10*time.Millisecond, name)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := name + `: {"retries_total":{"op=dial":1}}`
+	if len(lines) < 2 || lines[0] != expected {
+		t.Errorf("expected repeated %q; actual: %q", expected, lines)
+	}
+}
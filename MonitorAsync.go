@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"testing"
+)
+
+// Async Monitor writes
+//
+// By default Monitor logs inline: every Read/Write on a MonitoredConn
+// waits for the log line to be written before it returns. A slow log
+// destination (a file on a busy disk, a pipe nobody reads) then slows
+// down the connection itself.
+//
+// After StartAsync, records are copied into a buffered channel and a
+// background goroutine drains them into the logger. When the channel is
+// full the *oldest* queued record is dropped to make room, so monitoring
+// never blocks the data path. Dropped records are counted in Stats().
+
+// monitorQueue is the buffered channel plus the drainer's exit signal
+type monitorQueue struct {
+	records chan monitorRecord
+	done    chan struct{}
+}
+
+// StartAsync switches the Monitor to non-blocking mode with a queue
+// holding up to size records. Calling it again while already async
+// does nothing.
+func (m *Monitor) StartAsync(size int) {
+	m.asyncMu.Lock()
+	defer m.asyncMu.Unlock()
+
+	if m.async != nil {
+		return
+	}
+
+	// A queue needs room for at least one record
+	if size < 1 {
+		size = 1
+	}
+
+	q := &monitorQueue{
+		records: make(chan monitorRecord, size),
+		done:    make(chan struct{}),
+	}
+	m.async = q
+
+	// Drainer: log records until the queue is closed
+	go func() {
+		defer close(q.done)
+
+		for r := range q.records {
+			_ = m.emit(r)
+		}
+	}()
+}
+
+// StopAsync flushes the queued records, waits for the drainer to exit
+// and switches the Monitor back to logging inline.
+func (m *Monitor) StopAsync() {
+	m.asyncMu.Lock()
+	q := m.async
+	m.async = nil
+	m.asyncMu.Unlock()
+
+	if q == nil {
+		return
+	}
+
+	// No more senders can reach the channel, close it so the
+	// drainer exits after logging what's left
+	close(q.records)
+	<-q.done
+}
+
+// enqueue hands the record to the drainer. It returns false when the
+// Monitor isn't in async mode and the caller should log inline.
+func (m *Monitor) enqueue(r monitorRecord) bool {
+	m.asyncMu.RLock()
+	defer m.asyncMu.RUnlock()
+
+	if m.async == nil {
+		return false
+	}
+
+	// The caller owns the payload and may reuse it as soon as we
+	// return, so the queue keeps its own copy
+	r.payload = bytes.Clone(r.payload)
+
+	for {
+		select {
+		case m.async.records <- r:
+			return true
+		default:
+		}
+
+		// Queue is full: drop the oldest record and try again
+		select {
+		case <-m.async.records:
+			m.stats.dropped.Add(1)
+		default:
+			// The drainer emptied a slot in the meantime
+		}
+	}
+}
+
+func TestMonitorAsync(t *testing.T) {
+	buf := new(bytes.Buffer)
+	monitor := &Monitor{Logger: log.New(buf, "", 0)}
+
+	// Hold the drainer back by holding the logger's output lock, so
+	// the queue fills up and the oldest records get dropped
+	var mu sync.Mutex
+	mu.Lock()
+	monitor.Logger.SetOutput(lockedWriter{mu: &mu, w: buf})
+
+	monitor.StartAsync(2)
+
+	for _, msg := range []string{"one", "two", "three", "four", "five"} {
+		_, _ = monitor.Record(Outbound, []byte(msg))
+	}
+
+	// Let the drainer go and flush everything
+	mu.Unlock()
+	monitor.StopAsync()
+
+	stats := monitor.Stats()
+	if stats.MessagesOut != 5 {
+		t.Errorf("expected 5 messages counted; actual: %d", stats.MessagesOut)
+	}
+
+	// The drainer may have picked up "one" before blocking on the
+	// logger, so either 2 or 3 records were dropped; the last two
+	// must always make it out
+	if stats.Dropped < 2 || stats.Dropped > 3 {
+		t.Errorf("expected 2 or 3 dropped records; actual: %d", stats.Dropped)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("four\nfive\n")) {
+		t.Errorf("expected newest records to be logged; actual: %q", buf.String())
+	}
+}
+
+// lockedWriter writes to w only while holding mu
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  *bytes.Buffer
+}
+
+func (l lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(p)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Request/response latency in MonitoredConn
+//
+// For request/response protocols (ping/pong, the TFTP DATA/ACK dance,
+// the proxy test server) the time between our last Write and the first
+// Read that follows it is a crude but useful application-level latency:
+// it includes the network round trip plus the time the peer spent
+// working on the request.
+//
+// MonitoredConn remembers when it last wrote. The first successful Read
+// after that write is annotated with the elapsed time, which shows up in
+// the Monitor output and in the latency fields of Stats().
+//
+// Reads that aren't preceded by a write (server pushes, the rest of a
+// response split over several reads) carry no latency.
+
+// latencyTracker remembers the last write of a single connection
+type latencyTracker struct {
+	mu        sync.Mutex
+	lastWrite time.Time
+	awaiting  bool // A write happened and no read has followed yet
+}
+
+// wrote marks the time of a successful write
+func (l *latencyTracker) wrote(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastWrite = now
+	l.awaiting = true
+}
+
+// read returns the time since the last write if this is the first
+// read after it, and 0 otherwise
+func (l *latencyTracker) read(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.awaiting {
+		return 0
+	}
+	l.awaiting = false
+
+	// Make sure a measured latency is never mistaken for "none"
+	return max(now.Sub(l.lastWrite), time.Nanosecond)
+}
+
+// latencyStats aggregates latency observations across connections
+type latencyStats struct {
+	count atomic.Uint64
+	total atomic.Int64 // Sum of all observations in nanoseconds
+	last  atomic.Int64
+	max   atomic.Int64
+}
+
+// observe adds a single latency observation
+func (s *latencyStats) observe(d time.Duration) {
+	s.count.Add(1)
+	s.total.Add(int64(d))
+	s.last.Store(int64(d))
+
+	// Raise the maximum unless another goroutine beat us to it
+	for {
+		current := s.max.Load()
+		if int64(d) <= current || s.max.CompareAndSwap(current, int64(d)) {
+			return
+		}
+	}
+}
+
+// fill copies the latency figures into a stats snapshot
+func (s *latencyStats) fill(stats *MonitorStats) {
+	stats.Responses = s.count.Load()
+	stats.LatencyLast = time.Duration(s.last.Load())
+	stats.LatencyMax = time.Duration(s.max.Load())
+	if stats.Responses > 0 {
+		stats.LatencyAvg = time.Duration(s.total.Load() / int64(stats.Responses))
+	}
+}
+
+func TestMonitoredConnLatency(t *testing.T) {
+	buf := new(bytes.Buffer)
+	monitor := &Monitor{Logger: log.New(buf, "", 0)}
+
+	client, server := net.Pipe()
+	conn := NewMonitoredConn(client, monitor)
+	defer conn.Close()
+
+	// Server answers every request after a short delay
+	go func() {
+		defer server.Close()
+		b := make([]byte, 1024)
+		for {
+			n, err := server.Read(b)
+			if err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			if _, err := server.Write(b[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	b := make([]byte, 1024)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := monitor.Stats()
+	if stats.Responses != 2 {
+		t.Fatalf("expected 2 responses; actual: %d", stats.Responses)
+	}
+	if stats.LatencyAvg < 50*time.Millisecond || stats.LatencyMax < stats.LatencyAvg {
+		t.Errorf("unexpected latency figures: %+v", stats)
+	}
+
+	// Every response is annotated in the log output
+	if n := strings.Count(buf.String(), "response after"); n != 2 {
+		t.Errorf("expected 2 latency annotations; actual: %d\n%s", n, buf)
+	}
+}
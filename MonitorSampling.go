@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Sampling and rate limited logging for the Monitor
+//
+// On a busy connection logging every payload floods the output and
+// slows everything down. The Monitor can instead:
+//
+// - Sample: log only 1 out of every SampleEvery messages
+// - Cap: log at most MaxLogsPerSecond messages in any second
+//
+// Messages that are skipped are not lost silently, the next line that
+// does get logged is preceded by a "suppressed X messages" summary.
+// The traffic counters (Stats) still see every message.
+//
+// The fields can't change while connections log through the Monitor;
+// SetSampling can, e.g. from the console (see Console.go) to quiet a
+// Monitor that turned out too chatty.
+
+// logSampler holds the state needed to decide whether a message is logged
+type logSampler struct {
+	mu         sync.Mutex
+	seen       uint64 // Messages offered to the sampler so far
+	second     int64  // Unix second the per-second counter belongs to
+	logged     int    // Messages logged during that second
+	suppressed uint64 // Messages skipped since the last logged line
+
+	// Set by SetSampling, overriding the fields of the Monitor
+	set       bool
+	every     uint64
+	perSecond int
+}
+
+// allow reports whether the next message should be logged. When it
+// returns true it also returns how many messages were suppressed since
+// the previous logged message, so the caller can report them.
+func (s *logSampler) allow(every uint64, perSecond int, now time.Time) (bool, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.set {
+		every, perSecond = s.every, s.perSecond
+	}
+	s.seen++
+
+	// Sampling: only every N-th message is a candidate for logging
+	if every > 1 && (s.seen-1)%every != 0 {
+		s.suppressed++
+		return false, 0
+	}
+
+	// Rate cap: reset the counter when a new second starts
+	if perSecond > 0 {
+		if sec := now.Unix(); sec != s.second {
+			s.second = sec
+			s.logged = 0
+		}
+		if s.logged >= perSecond {
+			s.suppressed++
+			return false, 0
+		}
+		s.logged++
+	}
+
+	// Report and reset the suppressed counter
+	suppressed := s.suppressed
+	s.suppressed = 0
+
+	return true, suppressed
+}
+
+// SetSampling changes SampleEvery and MaxLogsPerSecond, from then on,
+// safely while the Monitor is in use
+func (m *Monitor) SetSampling(every uint64, perSecond int) {
+	m.sampler.mu.Lock()
+	defer m.sampler.mu.Unlock()
+
+	m.sampler.set, m.sampler.every, m.sampler.perSecond = true, every, perSecond
+}
+
+// Sampling returns the sampling in effect
+func (m *Monitor) Sampling() (every uint64, perSecond int) {
+	m.sampler.mu.Lock()
+	defer m.sampler.mu.Unlock()
+
+	if m.sampler.set {
+		return m.sampler.every, m.sampler.perSecond
+	}
+	return m.SampleEvery, m.MaxLogsPerSecond
+}
+
+// emit logs p unless sampling or the rate cap says otherwise
+func (m *Monitor) emit(r monitorRecord) error {
+	ok, suppressed := m.sampler.allow(m.SampleEvery, m.MaxLogsPerSecond, time.Now())
+	if !ok {
+		return nil
+	}
+
+	// Structured output takes over from the plain text logger
+	if m.Structured != nil {
+		m.emitStructured(r, suppressed)
+		return nil
+	}
+
+	// Let the reader know some messages were skipped in between
+	if suppressed > 0 {
+		err := m.Output(4, fmt.Sprintf("suppressed %d messages", suppressed))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Annotate responses with how long the peer took to answer
+	if r.latency > 0 {
+		err := m.Output(4, fmt.Sprintf("response after %s", r.latency))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Using Output(4, ...) skips the frames of emit, record and
+	// its caller to show the actual caller
+	if m.Hex {
+		return m.Output(4, fmt.Sprintf("%s %d bytes\n%s", r.direction, len(r.payload), hex.Dump(r.payload)))
+	}
+	return m.Output(4, string(r.payload))
+}
+
+func TestMonitorSampling(t *testing.T) {
+	buf := new(bytes.Buffer)
+	monitor := &Monitor{
+		Logger:      log.New(buf, "", 0),
+		SampleEvery: 3,
+	}
+
+	// Out of 7 messages, the 1st, 4th and 7th are logged
+	for i := 1; i <= 7; i++ {
+		_, _ = monitor.Record(Inbound, []byte(fmt.Sprintf("msg %d", i)))
+	}
+
+	expected := strings.Join([]string{
+		"msg 1",
+		"suppressed 2 messages",
+		"msg 4",
+		"suppressed 2 messages",
+		"msg 7",
+	}, "\n") + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected log:\n%s\nactual log:\n%s", expected, actual)
+	}
+
+	// Sampling only affects logging, the counters see everything
+	if stats := monitor.Stats(); stats.MessagesIn != 7 {
+		t.Errorf("expected 7 messages counted; actual: %d", stats.MessagesIn)
+	}
+}
+
+func TestMonitorRateLimit(t *testing.T) {
+	var s logSampler
+	now := time.Unix(1_000, 0)
+
+	// Only two messages per second are allowed through
+	for i := 0; i < 5; i++ {
+		ok, _ := s.allow(0, 2, now)
+		if expected := i < 2; ok != expected {
+			t.Fatalf("message %d: expected allowed=%t; actual: %t", i, expected, ok)
+		}
+	}
+
+	// The next second starts over and reports the 3 suppressed messages
+	ok, suppressed := s.allow(0, 2, now.Add(time.Second))
+	if !ok || suppressed != 3 {
+		t.Errorf("expected allowed with 3 suppressed; actual: %t, %d", ok, suppressed)
+	}
+}
+
+func TestMonitorHex(t *testing.T) {
+	buf := new(bytes.Buffer)
+	monitor := &Monitor{Logger: log.New(buf, "", 0), Hex: true}
+
+	_, _ = monitor.Record(Outbound, []byte{0x01, 0x00, 'h', 'i'})
+
+	expected := "out 4 bytes\n00000000  01 00 68 69                                       |..hi|\n"
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected log:\n%q\nactual log:\n%q", expected, actual)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Traffic counters for the Monitor
+//
+// Logging every payload tells you *what* went over the wire, but not
+// *how much*. The Monitor also keeps atomic counters of bytes and
+// messages per direction, plus a rolling window of per-second buckets
+// used to compute throughput over the last few seconds.
+//
+// The counters are cheap (a handful of atomic adds per message), so
+// they stay on even when the log output is discarded.
+
+// throughputWindow is how many one-second buckets are kept for the
+// rolling throughput calculation
+const throughputWindow = 10
+
+// MonitorStats is a point-in-time snapshot of the Monitor counters
+type MonitorStats struct {
+	BytesIn     uint64 `json:"bytes_in"`
+	BytesOut    uint64 `json:"bytes_out"`
+	MessagesIn  uint64 `json:"messages_in"`
+	MessagesOut uint64 `json:"messages_out"`
+
+	// Throughput in bytes per second averaged over the rolling window
+	ThroughputIn  float64 `json:"throughput_in"`
+	ThroughputOut float64 `json:"throughput_out"`
+
+	// Records dropped by the async queue because it was full
+	Dropped uint64 `json:"dropped"`
+
+	// Request/response latency measured by MonitoredConn
+	Responses   uint64        `json:"responses"`
+	LatencyLast time.Duration `json:"latency_last"`
+	LatencyAvg  time.Duration `json:"latency_avg"`
+	LatencyMax  time.Duration `json:"latency_max"`
+}
+
+// monitorStats holds the live counters. The zero value is ready to use.
+type monitorStats struct {
+	bytes    [2]atomic.Uint64 // Indexed by Direction
+	messages [2]atomic.Uint64 // Indexed by Direction
+	rate     [2]rateWindow    // Indexed by Direction
+	dropped  atomic.Uint64    // Records dropped by the async queue
+	latency  latencyStats     // Response latency observations
+}
+
+// add accounts n bytes (one message) in direction d at time now
+func (s *monitorStats) add(d Direction, n int, now time.Time) {
+	// Ignore directions we don't know about instead of panicking
+	// on an out of range index
+	if d > Outbound {
+		return
+	}
+
+	s.bytes[d].Add(uint64(n))
+	s.messages[d].Add(1)
+	s.rate[d].add(uint64(n), now)
+}
+
+// snapshot copies the counters into a MonitorStats value
+func (s *monitorStats) snapshot(now time.Time) MonitorStats {
+	stats := MonitorStats{
+		BytesIn:       s.bytes[Inbound].Load(),
+		BytesOut:      s.bytes[Outbound].Load(),
+		MessagesIn:    s.messages[Inbound].Load(),
+		MessagesOut:   s.messages[Outbound].Load(),
+		ThroughputIn:  s.rate[Inbound].perSecond(now),
+		ThroughputOut: s.rate[Outbound].perSecond(now),
+		Dropped:       s.dropped.Load(),
+	}
+	s.latency.fill(&stats)
+
+	return stats
+}
+
+// rateWindow is a ring of one-second buckets. Each bucket remembers
+// which second it belongs to, so stale buckets are ignored instead of
+// having to be cleared by a background goroutine.
+type rateWindow struct {
+	mu      sync.Mutex
+	buckets [throughputWindow]struct {
+		second int64  // Unix second this bucket is counting
+		bytes  uint64 // Bytes seen during that second
+	}
+}
+
+// add counts n bytes in the bucket for now
+func (w *rateWindow) add(n uint64, now time.Time) {
+	sec := now.Unix()
+	b := &w.buckets[sec%throughputWindow]
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The bucket still holds an older second, start it over
+	if b.second != sec {
+		b.second = sec
+		b.bytes = 0
+	}
+	b.bytes += n
+}
+
+// perSecond returns the average bytes per second over the window
+// ending at now
+func (w *rateWindow) perSecond(now time.Time) float64 {
+	sec := now.Unix()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var total uint64
+	for _, b := range w.buckets {
+		// Only buckets inside the window count
+		if sec-b.second < throughputWindow && b.second <= sec {
+			total += b.bytes
+		}
+	}
+
+	return float64(total) / throughputWindow
+}
+
+// Stats returns a snapshot of the traffic counters
+func (m *Monitor) Stats() MonitorStats {
+	return m.stats.snapshot(time.Now())
+}
+
+// Publish exposes the Monitor counters through expvar under name,
+// so they show up at /debug/vars when the expvar handler is served.
+// Like expvar.Publish, it panics if name is already in use.
+func (m *Monitor) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return m.Stats()
+	}))
+}
+
+func TestMonitorStats(t *testing.T) {
+	var s monitorStats
+	now := time.Unix(1_000, 0)
+
+	// Two inbound messages and one outbound message in the same second
+	s.add(Inbound, 100, now)
+	s.add(Inbound, 50, now)
+	s.add(Outbound, 20, now)
+
+	stats := s.snapshot(now)
+	if stats.BytesIn != 150 || stats.MessagesIn != 2 {
+		t.Errorf("unexpected inbound counters: %+v", stats)
+	}
+	if stats.BytesOut != 20 || stats.MessagesOut != 1 {
+		t.Errorf("unexpected outbound counters: %+v", stats)
+	}
+
+	// 150 bytes spread over a 10 second window is 15 bytes/sec
+	if stats.ThroughputIn != 15 {
+		t.Errorf("expected 15 B/s inbound; actual: %v", stats.ThroughputIn)
+	}
+
+	// Once the window has passed, the throughput drops back to zero
+	// while the totals keep their values
+	later := now.Add(throughputWindow * time.Second)
+	stats = s.snapshot(later)
+	if stats.ThroughputIn != 0 || stats.BytesIn != 150 {
+		t.Errorf("expected expired window; actual: %+v", stats)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Streaming Monitor records over a WebSocket
+//
+// The Monitor logs traffic where the process runs, which is rarely
+// where the developer looking for a bug sits. StreamHandler serves the
+// records live over a WebSocket (see WebSocket.go) instead, one JSON
+// text message per record:
+//
+//	{"time":"...","conn_id":3,"direction":"in","size":5,"preview":"Hello"}
+//
+// so a browser can watch with a few lines of JavaScript, and "golearn
+// watch" from a terminal:
+//
+//	golearn watch -conn 3 -dir in ws://127.0.0.1:9090/
+//
+// The query string filters what a subscriber gets: conn=3&conn=5 only
+// those connections, dir=in or dir=out only one direction.
+//
+// A subscriber that can't keep up must not slow down the connections
+// it watches, so like StartAsync the Monitor never waits: records that
+// don't fit in the subscriber's buffer are dropped, and the next record
+// that does fit says how many went missing before it ("dropped").
+
+const (
+	monitorStreamBuffer       = 256 // Records queued per subscriber
+	monitorStreamWriteTimeout = 10 * time.Second
+)
+
+// MonitorEvent is a record as sent to subscribers
+type MonitorEvent struct {
+	Time      time.Time `json:"time"`
+	ConnID    uint64    `json:"conn_id"`
+	Direction string    `json:"direction"`
+	Size      int       `json:"size"`
+	Latency   string    `json:"latency,omitempty"`
+	Preview   string    `json:"preview"`
+
+	// Dropped counts the records this subscriber missed right before
+	// this one
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// MonitorFilter selects the records of a subscription
+type MonitorFilter struct {
+	ConnIDs    []uint64    // Empty matches every connection
+	Directions []Direction // Empty matches both
+}
+
+// match reports whether r passes the filter
+func (f MonitorFilter) match(r monitorRecord) bool {
+	if len(f.Directions) > 0 && !slices.Contains(f.Directions, r.direction) {
+		return false
+	}
+
+	return len(f.ConnIDs) == 0 || slices.Contains(f.ConnIDs, r.id)
+}
+
+// MonitorSubscription receives the records of a Monitor on C until it
+// is closed
+type MonitorSubscription struct {
+	C <-chan MonitorEvent
+
+	monitor *Monitor
+	filter  MonitorFilter
+	events  chan MonitorEvent
+
+	mu      sync.Mutex
+	pending uint64 // Dropped since the last delivered event
+	dropped uint64 // Dropped in total
+}
+
+// Subscribe returns a subscription to the records matching f, holding
+// up to buffer of them for the reader
+func (m *Monitor) Subscribe(f MonitorFilter, buffer int) *MonitorSubscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	events := make(chan MonitorEvent, buffer)
+	s := &MonitorSubscription{C: events, monitor: m, filter: f, events: events}
+
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	if m.subs == nil {
+		m.subs = make(map[*MonitorSubscription]struct{})
+	}
+	m.subs[s] = struct{}{}
+
+	return s
+}
+
+// Close ends the subscription and closes C
+func (s *MonitorSubscription) Close() {
+	m := s.monitor
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+
+	if _, ok := m.subs[s]; !ok {
+		return
+	}
+	delete(m.subs, s)
+	close(s.events)
+}
+
+// Dropped returns the number of records that didn't fit in the buffer
+func (s *MonitorSubscription) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// deliver hands ev to the subscriber without waiting
+func (s *MonitorSubscription) deliver(ev MonitorEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ev.Dropped = s.pending
+	select {
+	case s.events <- ev:
+		s.pending = 0
+	default:
+		s.pending++
+		s.dropped++
+	}
+}
+
+// publish sends r to the subscribers it matches
+func (m *Monitor) publish(r monitorRecord, now time.Time) {
+	m.subsMu.RLock()
+	defer m.subsMu.RUnlock()
+
+	if len(m.subs) == 0 {
+		return
+	}
+
+	var ev *MonitorEvent
+	for s := range m.subs {
+		if !s.filter.match(r) {
+			continue
+		}
+		if ev == nil {
+			// Built once, and only when somebody wants it; the
+			// preview copies the payload the caller may reuse
+			ev = &MonitorEvent{
+				Time:      now,
+				ConnID:    r.id,
+				Direction: r.direction.String(),
+				Size:      len(r.payload),
+				Preview:   string(r.payload[:min(len(r.payload), monitorPreviewSize)]),
+			}
+			if r.latency > 0 {
+				ev.Latency = r.latency.String()
+			}
+		}
+		s.deliver(*ev)
+	}
+}
+
+// parseMonitorFilter reads a filter from the query of a stream request
+func parseMonitorFilter(q url.Values) (MonitorFilter, error) {
+	var f MonitorFilter
+	for _, v := range q["conn"] {
+		for _, field := range strings.Split(v, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 64)
+			if err != nil {
+				return f, fmt.Errorf("invalid conn %q", field)
+			}
+			f.ConnIDs = append(f.ConnIDs, id)
+		}
+	}
+	switch dir := q.Get("dir"); dir {
+	case "":
+	case "in":
+		f.Directions = []Direction{Inbound}
+	case "out":
+		f.Directions = []Direction{Outbound}
+	default:
+		return f, fmt.Errorf("invalid dir %q, want in or out", dir)
+	}
+
+	return f, nil
+}
+
+// StreamHandler serves the records of m over WebSockets, filtered by
+// the query of each request
+func (m *Monitor) StreamHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseMonitorFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Subscribed before the handshake completes, so nothing is
+		// missed once the client is connected
+		sub := m.Subscribe(f, monitorStreamBuffer)
+		defer sub.Close()
+
+		conn, err := WSUpgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Subscribers don't talk, but reading answers their pings and
+		// notices when they leave
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			_, _ = io.Copy(io.Discard, conn)
+		}()
+
+		for {
+			select {
+			case <-gone:
+				return
+			case ev := <-sub.C:
+				b, err := json.Marshal(ev)
+				if err != nil {
+					return
+				}
+				_ = conn.SetWriteDeadline(time.Now().Add(monitorStreamWriteTimeout))
+				if err := conn.WriteText(b); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+// WatchMonitor reads the events of a stream at rawURL (see
+// StreamHandler), calling fn for each until ctx is done or the stream
+// ends
+func WatchMonitor(ctx context.Context, rawURL string, fn func(MonitorEvent)) error {
+	conn, err := DialWebSocket(ctx, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	// Messages arrive as one stream, JSON finds the boundaries
+	dec := json.NewDecoder(conn)
+	for {
+		var ev MonitorEvent
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		fn(ev)
+	}
+}
+
+// String formats the event as a line of "golearn watch"
+func (ev MonitorEvent) String() string {
+	line := fmt.Sprintf("%s #%d %s %dB %q", ev.Time.Format("15:04:05.000"), ev.ConnID, ev.Direction, ev.Size, ev.Preview)
+	if ev.Latency != "" {
+		line += " after " + ev.Latency
+	}
+	if ev.Dropped > 0 {
+		line += fmt.Sprintf(" (%d dropped before)", ev.Dropped)
+	}
+
+	return line
+}
+
+func watchMain(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	conns := fs.String("conn", "", "comma separated connection `ids` to watch (default all)")
+	dir := fs.String("dir", "", "only one `direction`, in or out")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: watch [-conn ids] [-dir in|out] ws://host:port/path")
+	}
+
+	u, err := url.Parse(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	if *conns != "" {
+		q.Set("conn", *conns)
+	}
+	if *dir != "" {
+		q.Set("dir", *dir)
+	}
+	if _, err := parseMonitorFilter(q); err != nil {
+		return err
+	}
+	u.RawQuery = q.Encode()
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	err = WatchMonitor(ctx, u.String(), func(ev MonitorEvent) { fmt.Fprintln(os.Stdout, ev) })
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+
+	return err
+}
+
+func TestMonitorStream(t *testing.T) {
+	monitor := new(Monitor) // Streams only, no log
+
+	l := testListener(t)
+	srv := NewHTTPServer("", monitor.StreamHandler())
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	pipe := func() (*MonitoredConn, net.Conn) {
+		client, server := net.Pipe()
+		t.Cleanup(func() { _ = client.Close(); _ = server.Close() })
+		return NewMonitoredConn(server, monitor), client
+	}
+	a, aPeer := pipe()
+	b, bPeer := pipe()
+	go func() { _, _ = io.Copy(io.Discard, aPeer) }()
+	go func() {
+		_, _ = bPeer.Write([]byte("ping"))
+		_, _ = io.Copy(io.Discard, bPeer)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	events := make(chan MonitorEvent, 10)
+	streamURL := fmt.Sprintf("ws://%s/?conn=%d&dir=out", l.Addr(), b.ID())
+	go func() { _ = WatchMonitor(ctx, streamURL, func(ev MonitorEvent) { events <- ev }) }()
+
+	// Wait for the subscription to be in place
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		monitor.subsMu.RLock()
+		n := len(monitor.subs)
+		monitor.subsMu.RUnlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber never showed up")
+		}
+	}
+
+	_, _ = a.Write([]byte("not this connection"))
+	_, _ = b.Read(make([]byte, 4)) // Not this direction
+	_, _ = b.Write([]byte("Hello"))
+
+	select {
+	case ev := <-events:
+		if ev.ConnID != b.ID() || ev.Direction != "out" || ev.Size != 5 || ev.Preview != "Hello" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-ctx.Done():
+		t.Fatal("no event arrived")
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected extra event %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Bad filters are refused before the upgrade
+	resp, err := http.Get("http://" + l.Addr().String() + "/?dir=sideways")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400; actual: %d", resp.StatusCode)
+	}
+}
+
+func TestMonitorStreamBackpressure(t *testing.T) {
+	monitor := new(Monitor)
+	sub := monitor.Subscribe(MonitorFilter{}, 2)
+	defer sub.Close()
+
+	// Nobody reads: the records past the buffer are dropped, and the
+	// writer never waits
+	for _, msg := range []string{"one", "two", "three", "four", "five"} {
+		_, _ = monitor.Record(Outbound, []byte(msg))
+	}
+	if sub.Dropped() != 3 {
+		t.Errorf("expected 3 dropped; actual: %d", sub.Dropped())
+	}
+	if ev := <-sub.C; ev.Preview != "one" || ev.Dropped != 0 {
+		t.Errorf("unexpected first event %+v", ev)
+	}
+	<-sub.C
+
+	// The next record delivered tells about the gap
+	_, _ = monitor.Record(Outbound, []byte("six"))
+	if ev := <-sub.C; ev.Preview != "six" || ev.Dropped != 3 {
+		t.Errorf("expected six after 3 dropped; actual: %+v", ev)
+	}
+
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("expected C to be closed")
+	}
+}
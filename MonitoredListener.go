@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+// Monitored listener
+//
+// Wrapping every accepted connection by hand is easy to forget. With
+// WrapListener the proxy, echo or TLV servers get traffic logging by
+// swapping a single line:
+//
+//	listener, err := net.Listen("tcp", "127.0.0.1:")
+//	listener = WrapListener(listener, monitor)
+//
+// Everything else keeps calling Accept as before.
+
+// monitoredListener is a net.Listener handing out MonitoredConns
+type monitoredListener struct {
+	net.Listener
+	monitor *Monitor
+}
+
+// WrapListener returns a listener whose Accept returns connections
+// that are monitored by m
+func WrapListener(l net.Listener, m *Monitor) net.Listener {
+	return &monitoredListener{Listener: l, monitor: m}
+}
+
+// Accept waits for the next connection and wraps it in a MonitoredConn
+func (l *monitoredListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMonitoredConn(conn, l.monitor), nil
+}
+
+func TestWrapListener(t *testing.T) {
+	buf := new(bytes.Buffer)
+	monitor := &Monitor{Logger: log.New(buf, "monitor: ", 0)}
+
+	listener := testListener(t)
+	// The only change needed to monitor the server
+	listener = WrapListener(listener, monitor)
+	defer listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		// Echo whatever the client sends until it hangs up
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write([]byte("Test")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	<-done
+
+	// The server side saw the message come in and go back out
+	stats := monitor.Stats()
+	if stats.BytesIn != 4 || stats.BytesOut != 4 {
+		t.Errorf("expected 4 bytes each way; actual: %+v", stats)
+	}
+	if expected := "monitor: Test\nmonitor: Test\n"; buf.String() != expected {
+		t.Errorf("expected log %q; actual: %q", expected, buf.String())
+	}
+}
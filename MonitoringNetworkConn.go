@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Network Traffic Monitor and Echo Server
@@ -32,14 +37,234 @@ import (
 // This allows it to be used as a destination for monitoring network traffic
 type Monitor struct {
 	*log.Logger
+
+	// stats keeps per-direction byte/message counters and the
+	// rolling throughput windows. The zero value is ready to use,
+	// so Monitor can still be built with a plain struct literal.
+	stats monitorStats
+
+	// SampleEvery logs only one out of every N messages.
+	// Zero or one logs every message.
+	SampleEvery uint64
+
+	// MaxLogsPerSecond caps how many messages are logged per second.
+	// Zero means no cap.
+	MaxLogsPerSecond int
+
+	// sampler tracks the sampling and rate limiting state
+	sampler logSampler
+
+	// Counter, when set, is told about every recorded message with
+	// a known direction, so the Monitor reports the same numbers as
+	// the proxy and the UDP server
+	Counter Counter
+
+	// Structured, when set, receives one slog record per message
+	// (conn id, direction, size, preview) instead of the plain
+	// prefixed text written to Logger.
+	Structured *slog.Logger
+
+	// Hex logs payloads as a hex dump with offsets, like hexdump -C,
+	// instead of as text; binary protocols are unreadable otherwise
+	Hex bool
+
+	// Enricher, when set, labels the structured records of a
+	// MonitoredConn with what it knows about the peer (see Enrich.go)
+	Enricher Enricher
+
+	// Recorder, when set, keeps the last bytes of every MonitoredConn
+	// and dumps them when it fails (see FlightRecorder.go)
+	Recorder *FlightRecorder
+
+	// asyncMu guards async, which is non-nil while the Monitor
+	// hands records to a background drainer (see StartAsync)
+	asyncMu sync.RWMutex
+	async   *monitorQueue
+
+	// subsMu guards subs, the subscribers to the records (see
+	// MonitorStream.go)
+	subsMu sync.RWMutex
+	subs   map[*MonitorSubscription]struct{}
+}
+
+// Direction tells the Monitor which way traffic was flowing
+// when it was recorded
+type Direction uint8
+
+const (
+	Inbound     Direction = iota // Data read from the remote peer
+	Outbound                     // Data written to the remote peer
+	Unspecified                  // Plain io.Writer use, direction isn't known
+)
+
+// String returns a short label for the direction, used in log output
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	default:
+		return "unknown"
+	}
 }
 
 // Write implements the io.Writer interface for Monitor
 // It logs the data being written and returns the length to satisfy the interface
 func (m *Monitor) Write(p []byte) (int, error) {
 	// Return the full length of the data and log it
-	// Using Output(2, ...) skips 2 stack frames to show the actual caller
-	return len(p), m.Output(2, string(p))
+	// (subject to sampling and the per-second cap)
+	return len(p), m.record(monitorRecord{direction: Unspecified, payload: p})
+}
+
+// Record logs p and accounts it against direction d.
+// Every call counts as one message for the message counters.
+func (m *Monitor) Record(d Direction, p []byte) (int, error) {
+	return len(p), m.record(monitorRecord{direction: d, payload: p})
+}
+
+// monitorRecord is a single chunk of traffic on its way to the log
+type monitorRecord struct {
+	id        uint64        // MonitoredConn ID, 0 if not tied to a connection
+	direction Direction     // Which way the payload was flowing
+	payload   []byte        // The data itself
+	latency   time.Duration // Response latency, 0 if not measured
+	peer      PeerInfo      // Who's on the other end, if known
+}
+
+// record accounts and logs a single traffic record
+func (m *Monitor) record(r monitorRecord) error {
+	// Update the counters before logging so Stats() is accurate
+	// even if the logger output fails
+	m.stats.add(r.direction, len(r.payload), time.Now())
+	if r.direction != Unspecified {
+		count(m.Counter, r.direction, len(r.payload))
+	}
+	if r.latency > 0 {
+		m.stats.latency.observe(r.latency)
+	}
+	m.publish(r, time.Now())
+
+	// A Monitor may only be there for its subscribers
+	if m.Logger == nil && m.Structured == nil {
+		return nil
+	}
+
+	// In async mode the record is queued and logged later
+	if m.enqueue(r) {
+		return nil
+	}
+
+	return m.emit(r)
+}
+
+// Writer returns an io.Writer that records everything written to it
+// as traffic flowing in direction d. It can be plugged into
+// io.TeeReader or io.MultiWriter just like the Monitor itself.
+func (m *Monitor) Writer(d Direction) io.Writer {
+	return directionWriter{monitor: m, direction: d}
+}
+
+// directionWriter binds a Monitor to a fixed Direction
+type directionWriter struct {
+	monitor   *Monitor
+	direction Direction
+}
+
+// Write implements io.Writer by recording p in the bound direction
+func (w directionWriter) Write(p []byte) (int, error) {
+	return w.monitor.Record(w.direction, p)
+}
+
+// monitoredConnIDs hands out unique, increasing connection IDs.
+// IDs start at 1 so 0 can mean "no connection".
+var monitoredConnIDs atomic.Uint64
+
+// MonitoredConn wraps a net.Conn and records every successful Read
+// as Inbound traffic and every successful Write as Outbound traffic
+type MonitoredConn struct {
+	net.Conn
+	monitor *Monitor
+	id      uint64
+	peer    PeerInfo // From Monitor.Enricher, looked up once
+
+	// Request/response latency tracking, see MonitorLatency.go
+	latency latencyTracker
+
+	// The connection's flight recording, nil without a Recorder
+	ring *flightRing
+}
+
+// NewMonitoredConn returns conn wrapped so all traffic passing
+// through it is recorded by m under a new connection ID
+func NewMonitoredConn(conn net.Conn, m *Monitor) *MonitoredConn {
+	c := &MonitoredConn{
+		Conn:    conn,
+		monitor: m,
+		id:      monitoredConnIDs.Add(1),
+		peer:    enrichAddr(m.Enricher, conn.RemoteAddr()),
+	}
+	c.ring = m.Recorder.open(c.id, conn)
+
+	return c
+}
+
+// ID returns the unique ID the Monitor uses for this connection
+func (c *MonitoredConn) ID() uint64 {
+	return c.id
+}
+
+// Read reads from the underlying connection and records what was received
+func (c *MonitoredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		// Only the bytes actually read are recorded, together with
+		// the time since our last write if this is its response
+		_ = c.monitor.record(monitorRecord{
+			id:        c.id,
+			direction: Inbound,
+			payload:   p[:n],
+			latency:   c.latency.read(time.Now()),
+			peer:      c.peer,
+		})
+		c.record(Inbound, p[:n])
+	}
+	if err != nil && c.ring != nil {
+		c.monitor.Recorder.failed(c.id, err)
+	}
+
+	return n, err
+}
+
+// Write writes to the underlying connection and records what was sent
+func (c *MonitoredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.latency.wrote(time.Now())
+
+		// A short write only records the bytes that made it out
+		_ = c.monitor.record(monitorRecord{id: c.id, direction: Outbound, payload: p[:n], peer: c.peer})
+		c.record(Outbound, p[:n])
+	}
+	if err != nil && c.ring != nil {
+		c.monitor.Recorder.failed(c.id, err)
+	}
+
+	return n, err
+}
+
+// record adds p to the flight recording, if there is one
+func (c *MonitoredConn) record(d Direction, p []byte) {
+	if c.ring != nil {
+		c.ring.add(c.monitor.Recorder.Size, d, p)
+	}
+}
+
+// Close closes the connection, and drops its flight recording
+func (c *MonitoredConn) Close() error {
+	c.monitor.Recorder.close(c.id)
+
+	return c.Conn.Close()
 }
 
 func ExampleMonitor() {
@@ -51,6 +276,14 @@ func ExampleMonitor() {
 	if err != nil {
 		monitor.Fatal(err)
 	}
+	defer listener.Close()
+
+	// Give up after 5 seconds even if the client never shows up or
+	// stops talking: closing the sockets unblocks Accept and Read
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
 
 	// Channel to signal when the goroutine is done
 	done := make(chan struct{})
@@ -67,13 +300,15 @@ func ExampleMonitor() {
 		}
 		// Ensure the connection is closed when done
 		defer conn.Close()
+		stopConn := context.AfterFunc(ctx, func() { _ = conn.Close() })
+		defer stopConn()
 
 		// Buffer to read incoming data
 		b := make([]byte, 1024)
 
 		// Create a TeeReader that reads from the connection and simultaneously
 		// writes the data to the monitor (for logging incoming data)
-		r := io.TeeReader(conn, monitor)
+		r := io.TeeReader(conn, monitor.Writer(Inbound))
 
 		// Read data from the connection (this will also log it via TeeReader)
 		n, err := r.Read(b)
@@ -84,7 +319,7 @@ func ExampleMonitor() {
 
 		// Create a MultiWriter that writes to both the connection and monitor
 		// This allows us to echo the message back while also logging it
-		w := io.MultiWriter(conn, monitor)
+		w := io.MultiWriter(conn, monitor.Writer(Outbound))
 
 		// Echo the received message back to the client and log it
 		_, err = w.Write(b[:n])
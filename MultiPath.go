@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Multi-path dialing
+//
+// An edge node with two uplinks, say Ethernet and an LTE modem, has two
+// ways out, but the kernel only uses one: the default route, whether or
+// not anything answers behind it. MultiPathDialer picks the way out
+// itself, binding each connection to the source address of an uplink:
+//
+// - the paths are in order of preference, the first healthy one gets
+//   the new connections
+// - Run sends a heartbeat through every path each Interval, a TCP
+//   connect to Probe from the path's address. Fall heartbeats failing in
+//   a row, or answering slower than MaxRTT, mark a path down; Rise
+//   succeeding mark it up again, and the connections move back to it.
+// - a dial failing through a path tries the next healthy one, so a path
+//   dying between heartbeats costs one timeout, not a connection
+//
+// Connections already open stay where they are; it's the new ones that
+// move. The source address decides the path when the routing does
+// (policy routing, "ip rule add from 192.0.2.10 table lte", or one
+// default route per uplink with different metrics on most edge
+// distributions); InterfacePath looks up the address of an interface.
+
+const (
+	defaultPathInterval = 5 * time.Second
+	defaultPathTimeout  = 2 * time.Second
+	defaultPathFall     = 3
+	defaultPathRise     = 2
+)
+
+// ErrNoPath means every path of a MultiPathDialer failed the dial
+var ErrNoPath = errors.New("no path to dial through")
+
+// DialPath is a way out, through a local address
+type DialPath struct {
+	Name string
+	Addr netip.Addr // Source address of the connections
+}
+
+// InterfacePath returns the path through the first address of the
+// interface called name, IPv4 if it has one
+func InterfacePath(name string) (DialPath, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return DialPath{}, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return DialPath{}, err
+	}
+
+	var found netip.Addr
+	for _, a := range addrs {
+		prefix, err := netip.ParsePrefix(a.String())
+		if err != nil {
+			continue
+		}
+		addr := prefix.Addr()
+		if addr.Is4() {
+			return DialPath{Name: name, Addr: addr}, nil
+		}
+		if !found.IsValid() && !addr.IsLinkLocalUnicast() {
+			found = addr
+		}
+	}
+	if !found.IsValid() {
+		return DialPath{}, fmt.Errorf("interface %s: no usable address", name)
+	}
+
+	return DialPath{Name: name, Addr: found}, nil
+}
+
+// PathStatus is what the heartbeats say about a path
+type PathStatus struct {
+	Name      string        `json:"name"`
+	Addr      string        `json:"addr"`
+	Healthy   bool          `json:"healthy"`
+	RTT       time.Duration `json:"rtt_ns"` // Of the last heartbeat that succeeded
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// pathState is a path and its heartbeat record
+type pathState struct {
+	path DialPath
+	down atomic.Bool
+
+	mu        sync.Mutex
+	fails     int // In a row
+	successes int // In a row
+	rtt       time.Duration
+	lastErr   error
+}
+
+// MultiPathDialer dials through the best of several local addresses
+type MultiPathDialer struct {
+	Paths []DialPath // In order of preference
+
+	// Probe is the address the heartbeats connect to, something
+	// reachable through every path
+	Probe string
+
+	Interval time.Duration // Between heartbeats, 5s by default
+	Timeout  time.Duration // Of a heartbeat, 2s by default
+	MaxRTT   time.Duration // Slower heartbeats count as failed, 0 for no limit
+	Fall     int           // Failed heartbeats in a row marking a path down, 3 by default
+	Rise     int           // Heartbeats in a row marking it up again, 2 by default
+
+	// Heartbeat, when set, replaces the connect to Probe
+	Heartbeat func(ctx context.Context, p DialPath) error
+
+	// ErrorLog receives the paths going down and up
+	ErrorLog *log.Logger
+
+	// OnChange, when set, is called when a path is marked down or back
+	// up; see Alerter in SMTP.go
+	OnChange func(p DialPath, healthy bool)
+
+	once   sync.Once
+	states []*pathState
+}
+
+func (d *MultiPathDialer) logf(format string, v ...any) {
+	if d.ErrorLog != nil {
+		d.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+func (d *MultiPathDialer) init() {
+	d.once.Do(func() {
+		for _, p := range d.Paths {
+			d.states = append(d.states, &pathState{path: p})
+		}
+	})
+}
+
+// dialer returns a net.Dialer bound to the address of p
+func (d *MultiPathDialer) dialer(p DialPath) *net.Dialer {
+	return &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: p.Addr.AsSlice(), Zone: p.Addr.Zone()},
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// DialContext connects to addr through the first healthy path, then the
+// next ones if that fails. With none healthy, it tries them all anyway:
+// the heartbeats may be the ones failing.
+func (d *MultiPathDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.init()
+
+	var healthy, down []*pathState
+	for _, s := range d.states {
+		if s.down.Load() {
+			down = append(down, s)
+		} else {
+			healthy = append(healthy, s)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = down
+	}
+
+	var errs []error
+	for _, s := range healthy {
+		dialer := d.dialer(s.path)
+		if network == "udp" || network == "udp4" || network == "udp6" {
+			dialer.LocalAddr = &net.UDPAddr{IP: s.path.Addr.AsSlice(), Zone: s.path.Addr.Zone()}
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", s.path.Name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("dial %s: %w: %w", addr, ErrNoPath, errors.Join(errs...))
+}
+
+// Run sends heartbeats through every path each Interval until ctx is
+// done
+func (d *MultiPathDialer) Run(ctx context.Context) error {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = defaultPathInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		d.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// check sends a heartbeat through every path at once and records them
+func (d *MultiPathDialer) check(ctx context.Context) {
+	d.init()
+
+	var wg sync.WaitGroup
+	for _, s := range d.states {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := d.heartbeat(ctx, s.path)
+			if ctx.Err() == nil {
+				d.record(s, time.Since(start), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// heartbeat checks that p reaches Probe, in time
+func (d *MultiPathDialer) heartbeat(ctx context.Context, p DialPath) error {
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = defaultPathTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if d.Heartbeat != nil {
+		return d.Heartbeat(ctx, p)
+	}
+	conn, err := d.dialer(p).DialContext(ctx, "tcp", d.Probe)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// record counts a heartbeat, marking the path down or up when the
+// threshold is reached
+func (d *MultiPathDialer) record(s *pathState, rtt time.Duration, err error) {
+	if err == nil && d.MaxRTT > 0 && rtt > d.MaxRTT {
+		err = fmt.Errorf("heartbeat took %v, over %v", rtt.Round(time.Millisecond), d.MaxRTT)
+	}
+	fall, rise := d.Fall, d.Rise
+	if fall <= 0 {
+		fall = defaultPathFall
+	}
+	if rise <= 0 {
+		rise = defaultPathRise
+	}
+
+	s.mu.Lock()
+	s.lastErr = err
+	if err != nil {
+		s.fails++
+		s.successes = 0
+	} else {
+		s.rtt = rtt
+		s.successes++
+		s.fails = 0
+	}
+	down := s.down.Load()
+	change := !down && s.fails >= fall || down && s.successes >= rise
+	s.mu.Unlock()
+
+	if !change {
+		return
+	}
+	s.down.Store(!down)
+	if down {
+		d.logf("path %s (%s) back up", s.path.Name, s.path.Addr)
+	} else {
+		d.logf("path %s (%s) down: %v", s.path.Name, s.path.Addr, err)
+	}
+	if d.OnChange != nil {
+		d.OnChange(s.path, down)
+	}
+}
+
+// Status returns the paths as the heartbeats last saw them, in order of
+// preference
+func (d *MultiPathDialer) Status() []PathStatus {
+	d.init()
+
+	status := make([]PathStatus, 0, len(d.states))
+	for _, s := range d.states {
+		s.mu.Lock()
+		ps := PathStatus{
+			Name:    s.path.Name,
+			Addr:    s.path.Addr.String(),
+			Healthy: !s.down.Load(),
+			RTT:     s.rtt,
+		}
+		if s.lastErr != nil {
+			ps.LastError = s.lastErr.Error()
+		}
+		s.mu.Unlock()
+		status = append(status, ps)
+	}
+
+	return status
+}
+
+func TestMultiPathDialer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs 127.0.0.2, which only linux has without configuration")
+	}
+
+	l := testListener(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+
+	var failing atomic.Value // Name of the path whose heartbeats fail
+	failing.Store("")
+	var changes []string
+	d := &MultiPathDialer{
+		Paths: []DialPath{
+			{Name: "ethernet", Addr: netip.MustParseAddr("127.0.0.1")},
+			{Name: "lte", Addr: netip.MustParseAddr("127.0.0.2")},
+		},
+		Fall: 2,
+		Rise: 1,
+		Heartbeat: func(_ context.Context, p DialPath) error {
+			if p.Name == failing.Load() {
+				return errors.New("no carrier")
+			}
+			return nil
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+		OnChange: func(p DialPath, healthy bool) {
+			changes = append(changes, fmt.Sprintf("%s %t", p.Name, healthy))
+		},
+	}
+	ctx := context.Background()
+	source := func() string {
+		t.Helper()
+		c, err := d.DialContext(ctx, "tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.LocalAddr().(*net.TCPAddr).IP.String()
+	}
+
+	if ip := source(); ip != "127.0.0.1" {
+		t.Errorf("expected the preferred path; actual: %s", ip)
+	}
+
+	// One failed heartbeat isn't enough, two are
+	failing.Store("ethernet")
+	d.check(ctx)
+	if ip := source(); ip != "127.0.0.1" {
+		t.Errorf("expected to stay on the preferred path; actual: %s", ip)
+	}
+	d.check(ctx)
+	if ip := source(); ip != "127.0.0.2" {
+		t.Errorf("expected to fail over; actual: %s", ip)
+	}
+	if st := d.Status(); st[0].Healthy || st[0].LastError != "no carrier" || !st[1].Healthy {
+		t.Errorf("unexpected status: %+v", st)
+	}
+
+	failing.Store("")
+	d.check(ctx)
+	if ip := source(); ip != "127.0.0.1" {
+		t.Errorf("expected to move back; actual: %s", ip)
+	}
+	if fmt.Sprint(changes) != "[ethernet false ethernet true]" {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+
+	// A path failing the dial itself passes it on to the next
+	d = &MultiPathDialer{Paths: []DialPath{
+		{Name: "gone", Addr: netip.MustParseAddr("192.0.2.1")},
+		{Name: "lte", Addr: netip.MustParseAddr("127.0.0.2")},
+	}}
+	if ip := source(); ip != "127.0.0.2" {
+		t.Errorf("expected the next path; actual: %s", ip)
+	}
+}
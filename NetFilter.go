@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Peer IP filtering
+//
+// TCPServer.Deny is a hook; something has to decide. Lists of networks
+// are the usual answer, "10.0.0.0/8 but not 10.66.0.0/16", and checking
+// every connection against every entry gets slow as the lists grow.
+//
+// CIDRTrie stores prefixes in a binary trie, one level per address bit,
+// so a lookup walks at most 128 nodes whatever the number of entries and
+// finds the longest (most specific) matching prefix on the way. IPv4
+// addresses live in the same trie as their IPv4-mapped IPv6 form
+// (::ffff:10.0.0.0/104 for 10.0.0.0/8), so both families match the same
+// rules whichever way the socket reports them.
+//
+// A RuleSet is allow and deny lists in such a trie:
+//
+// - the most specific matching rule decides, so a deny inside an allow
+//   (or the reverse) carves out an exception
+// - a prefix in both lists is denied
+// - an address matching nothing is allowed, unless there is an allow
+//   list, which then names everyone allowed
+//
+// NetFilter applies a RuleSet to peers, and a new one can be swapped in
+// at any time (a configuration reload does): connections from denied
+// peers are closed right after Accept (Listener), their datagrams
+// dropped (PacketConn), or TCPServer.Deny says no (Deny). Unix socket
+// peers have no IP address and are always allowed.
+
+// CIDRTrie maps IP prefixes to values, finding the longest match
+type CIDRTrie[V any] struct {
+	root cidrNode[V]
+	size int
+}
+
+// cidrNode is a trie node, its children by the next address bit
+type cidrNode[V any] struct {
+	children [2]*cidrNode[V]
+	value    V
+	set      bool // A prefix ends here
+}
+
+// cidrKey returns the 128 bit form of a and its bit offset: 96 for IPv4
+func cidrKey(a netip.Addr) ([16]byte, int) {
+	offset := 0
+	if a.Is4() {
+		offset = 96
+	}
+
+	return a.As16(), offset
+}
+
+// cidrBit returns bit i of key, 0 the most significant
+func cidrBit(key [16]byte, i int) int {
+	return int(key[i/8]>>(7-i%8)) & 1
+}
+
+// Insert sets the value of p, replacing the previous one
+func (t *CIDRTrie[V]) Insert(p netip.Prefix, v V) {
+	key, offset := cidrKey(p.Addr())
+	n := &t.root
+	for i := 0; i < offset+p.Bits(); i++ {
+		b := cidrBit(key, i)
+		if n.children[b] == nil {
+			n.children[b] = new(cidrNode[V])
+		}
+		n = n.children[b]
+	}
+	if !n.set {
+		t.size++
+	}
+	n.value, n.set = v, true
+}
+
+// Lookup returns the value of the longest prefix containing a, and the
+// length of that prefix (in bits of a's own family)
+func (t *CIDRTrie[V]) Lookup(a netip.Addr) (v V, bits int, ok bool) {
+	key, offset := cidrKey(a.Unmap())
+	n := &t.root
+	for i := 0; n != nil; i++ {
+		if n.set && i >= offset {
+			v, bits, ok = n.value, i-offset, true
+		}
+		if i == 128 {
+			break
+		}
+		n = n.children[cidrBit(key, i)]
+	}
+
+	return v, bits, ok
+}
+
+// Len returns the number of prefixes
+func (t *CIDRTrie[V]) Len() int {
+	return t.size
+}
+
+// ParsePrefix parses "10.0.0.0/8", or a single address as its /32 or
+// /128. Host bits are cleared.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		a = a.Unmap()
+		return netip.PrefixFrom(a, a.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return p.Masked(), nil
+}
+
+// RuleSet decides which peers are allowed, see above
+type RuleSet struct {
+	trie         CIDRTrie[bool] // true for allow
+	defaultAllow bool
+}
+
+// NewRuleSet builds a RuleSet from prefixes as ParsePrefix reads them
+func NewRuleSet(allow, deny []string) (*RuleSet, error) {
+	r := &RuleSet{defaultAllow: len(allow) == 0}
+
+	var errs []error
+	for _, list := range []struct {
+		prefixes []string
+		allow    bool
+	}{{allow, true}, {deny, false}} {
+		for _, s := range list.prefixes {
+			p, err := ParsePrefix(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid network %q", s))
+				continue
+			}
+			r.trie.Insert(p, list.allow)
+		}
+	}
+
+	return r, errors.Join(errs...)
+}
+
+// Allowed reports whether a may connect. A nil RuleSet allows anyone.
+func (r *RuleSet) Allowed(a netip.Addr) bool {
+	if r == nil {
+		return true
+	}
+	if allow, _, ok := r.trie.Lookup(a); ok {
+		return allow
+	}
+
+	return r.defaultAllow
+}
+
+// NetFilter applies a replaceable RuleSet to peers
+type NetFilter struct {
+	rules   atomic.Pointer[RuleSet]
+	dropped atomic.Uint64
+}
+
+// NewNetFilter returns a filter applying rules, nil allowing anyone
+func NewNetFilter(rules *RuleSet) *NetFilter {
+	f := new(NetFilter)
+	f.SetRules(rules)
+
+	return f
+}
+
+// SetRules replaces the rules for the peers to come
+func (f *NetFilter) SetRules(rules *RuleSet) {
+	f.rules.Store(rules)
+}
+
+// Dropped returns how many connections and datagrams were refused
+func (f *NetFilter) Dropped() uint64 {
+	return f.dropped.Load()
+}
+
+// peerIP returns the IP address of a TCP or UDP peer
+func peerIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr(), true
+	case *net.UDPAddr:
+		return a.AddrPort().Addr(), true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+
+	return ap.Addr(), err == nil
+}
+
+// Allowed reports whether the peer at addr is allowed, counting it as
+// dropped when it's not
+func (f *NetFilter) Allowed(addr net.Addr) bool {
+	ip, ok := peerIP(addr)
+	if !ok || f.rules.Load().Allowed(ip) {
+		return true
+	}
+	f.dropped.Add(1)
+
+	return false
+}
+
+// Deny is a TCPServer.Deny hook
+func (f *NetFilter) Deny(ip net.IP) bool {
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok || f.rules.Load().Allowed(a) {
+		return false
+	}
+	f.dropped.Add(1)
+
+	return true
+}
+
+// filteredListener closes the connections of denied peers
+type filteredListener struct {
+	net.Listener
+	filter *NetFilter
+}
+
+// Listener returns a listener closing the connections of denied peers
+// before handing them out
+func (f *NetFilter) Listener(l net.Listener) net.Listener {
+	return &filteredListener{Listener: l, filter: f}
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.filter.Allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		_ = conn.Close()
+	}
+}
+
+// filteredPacketConn drops the datagrams of denied peers
+type filteredPacketConn struct {
+	net.PacketConn
+	filter *NetFilter
+}
+
+// PacketConn returns a PacketConn whose ReadFrom skips the datagrams of
+// denied peers
+func (f *NetFilter) PacketConn(pc net.PacketConn) net.PacketConn {
+	return &filteredPacketConn{PacketConn: pc, filter: f}
+}
+
+func (c *filteredPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.filter.Allowed(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+func TestCIDRTrie(t *testing.T) {
+	var trie CIDRTrie[string]
+	for p, v := range map[string]string{
+		"0.0.0.0/0":       "any v4",
+		"10.0.0.0/8":      "ten",
+		"10.66.0.0/16":    "lab",
+		"10.66.1.7":       "host",
+		"2001:db8::/32":   "doc",
+		"2001:db8:1::/48": "doc1",
+	} {
+		prefix, err := ParsePrefix(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trie.Insert(prefix, v)
+	}
+	if trie.Len() != 6 {
+		t.Errorf("expected 6 prefixes; actual: %d", trie.Len())
+	}
+
+	for _, c := range []struct {
+		addr     string
+		expected string
+		bits     int
+	}{
+		{"10.1.2.3", "ten", 8},
+		{"10.66.200.1", "lab", 16},
+		{"10.66.1.7", "host", 32},
+		{"::ffff:10.66.1.7", "host", 32},
+		{"192.0.2.1", "any v4", 0},
+		{"2001:db8:1::5", "doc1", 48},
+		{"2001:db8:2::5", "doc", 32},
+		{"::1", "", 0},
+	} {
+		v, bits, ok := trie.Lookup(netip.MustParseAddr(c.addr))
+		if v != c.expected || bits != c.bits || ok != (c.expected != "") {
+			t.Errorf("%s: expected %q/%d; actual: %q/%d %t", c.addr, c.expected, c.bits, v, bits, ok)
+		}
+	}
+}
+
+func TestNetFilter(t *testing.T) {
+	if _, err := NewRuleSet([]string{"10.0.0.0/33"}, []string{"nope"}); err == nil ||
+		!strings.Contains(err.Error(), `"10.0.0.0/33"`) || !strings.Contains(err.Error(), `"nope"`) {
+		t.Errorf("expected both networks to be invalid; actual: %v", err)
+	}
+
+	// An allow list with an exception in it
+	rules, err := NewRuleSet([]string{"10.0.0.0/8", "127.0.0.1"}, []string{"10.66.0.0/16", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, expected := range map[string]bool{
+		"10.1.1.1":  true,
+		"10.66.1.1": false,
+		"127.0.0.1": false, // In both lists
+		"192.0.2.1": false, // Not allowed
+	} {
+		if rules.Allowed(netip.MustParseAddr(addr)) != expected {
+			t.Errorf("%s: expected allowed %t", addr, expected)
+		}
+	}
+	if !(*RuleSet)(nil).Allowed(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("expected no rules to allow anyone")
+	}
+
+	// Loopback is denied, then allowed after a reload
+	denyLoopback, _ := NewRuleSet(nil, []string{"127.0.0.0/8", "::1"})
+	f := NewNetFilter(denyLoopback)
+	l := f.Listener(testListener(t))
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	_ = conn.Close()
+
+	f.SetRules(nil)
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case c := <-accepted:
+		_ = c.Close()
+	case <-time.After(time.Second):
+		t.Error("expected the connection to be accepted after the reload")
+	}
+
+	// Datagrams: dropped, then let through
+	f.SetRules(denyLoopback)
+	pc := testPacketConn(t)
+	filtered := f.PacketConn(pc)
+	udp, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	_, _ = udp.Write([]byte("dropped"))
+	_ = filtered.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := filtered.ReadFrom(make([]byte, 16)); err == nil {
+		t.Error("expected the datagram to be dropped")
+	}
+	f.SetRules(nil)
+	_, _ = udp.Write([]byte("kept"))
+	_ = filtered.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 16)
+	if n, _, err := filtered.ReadFrom(b); err != nil || string(b[:n]) != "kept" {
+		t.Errorf("unexpected datagram %q, %v", b[:n], err)
+	}
+
+	// And the TCPServer hook
+	if f.Deny(net.ParseIP("127.0.0.1")) {
+		t.Error("expected no rules to deny no one")
+	}
+	f.SetRules(denyLoopback)
+	if !f.Deny(net.ParseIP("127.0.0.1")) || f.Deny(net.ParseIP("192.0.2.1")) {
+		t.Error("expected Deny to deny loopback only")
+	}
+
+	if f.Dropped() != 3 {
+		t.Errorf("expected 3 dropped; actual: %d", f.Dropped())
+	}
+}
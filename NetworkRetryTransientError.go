@@ -1,10 +1,9 @@
 package main
 
 import (
-	"errors"
+	"fmt"
 	"log"
 	"net"
-	"syscall"
 	"time"
 )
 
@@ -19,7 +18,7 @@ func SendWithRetry(conn net.Conn, data []byte) error {
 		n, err = conn.Write(data)
 		if err != nil {
 			// Retry only on known transient errors
-			if isTransientError(err) {
+			if IsTransient(err) {
 				log.Printf("transient error on write (attempt %d/%d): %v", i+1, maxRetries, err)
 				time.Sleep(10 * time.Second)
 				continue
@@ -33,13 +32,6 @@ func SendWithRetry(conn net.Conn, data []byte) error {
 		return nil
 	}
 
-	// All retries failed
-	return errors.New("temporary write failure threshold exceeded")
-}
-
-// Checks if the error is a retryable transient network error
-func isTransientError(err error) bool {
-	return errors.Is(err, syscall.ECONNRESET) ||
-		errors.Is(err, syscall.ECONNABORTED) ||
-		errors.Is(err, syscall.EPIPE)
+	// All retries failed; the last error still says why
+	return fmt.Errorf("write failed %d times: %w", maxRetries, err)
 }
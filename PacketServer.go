@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Generic UDP handler framework
+//
+// echoServerUDP reads a datagram, answers it and only then reads the
+// next one. That's fine for an echo, but a handler that takes a while
+// (a DNS lookup, a disk read for TFTP) would hold up every other client.
+//
+// ServePacket is the packet-oriented sibling of TCPServer.Serve: it
+// reads datagrams in a loop and hands each one to a PacketHandler in its
+// own goroutine, together with the socket to answer on. There are no
+// connections to track, so shutting down is just canceling the context
+// and waiting for the running handlers.
+
+// maxDatagramSize is the largest possible UDP payload
+const maxDatagramSize = 65535
+
+// PacketHandler handles a single datagram received from addr. Replies
+// (zero or more) are sent with pc.WriteTo. The packet is only valid
+// until the handler returns.
+type PacketHandler func(ctx context.Context, pc net.PacketConn, addr net.Addr, packet []byte)
+
+// ServePacket reads datagrams from pc and runs handler for each of them
+// until ctx is done or reading fails. pc is closed when ctx is done.
+// ServePacket waits for the running handlers before returning ctx.Err()
+// or the read error.
+func ServePacket(ctx context.Context, pc net.PacketConn, handler PacketHandler) error {
+	// Closing the socket is the only way to unblock ReadFrom
+	stop := context.AfterFunc(ctx, func() { _ = pc.Close() })
+	defer stop()
+
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			// A previous WriteTo triggered an ICMP "port unreachable",
+			// which some platforms (Windows) report on the next read
+			if isUnreachableEcho(err) {
+				continue
+			}
+
+			return err
+		}
+
+		// The buffer is reused for the next datagram
+		packet := append([]byte(nil), buf[:n]...)
+
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			handler(ctx, pc, addr, packet)
+		}()
+	}
+}
+
+func TestServePacket(t *testing.T) {
+	pc := testPacketConn(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// A slow handler for "slow" must not hold up the others
+	served := make(chan error)
+	go func() {
+		served <- ServePacket(ctx, pc, func(_ context.Context, pc net.PacketConn, addr net.Addr, packet []byte) {
+			if string(packet) == "slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			_, _ = pc.WriteTo(append([]byte("re: "), packet...), addr)
+		})
+	}()
+
+	slow, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	fast, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+
+	if _, err := slow.Write([]byte("slow")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fast.Write([]byte("fast")); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = fast.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 16)
+	n, err := fast.Read(buf)
+	if err != nil {
+		t.Fatalf("fast client was held up: %v", err)
+	}
+	if string(buf[:n]) != "re: fast" {
+		t.Errorf("unexpected reply: %q", buf[:n])
+	}
+
+	// Canceling waits for the slow handler to finish
+	cancel()
+	if err := <-served; err != context.Canceled {
+		t.Errorf("expected context canceled; actual: %v", err)
+	}
+}
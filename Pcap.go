@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Pcap files
+//
+// The pcap format is what tcpdump writes and Wireshark reads: a 24 byte
+// file header (magic number, version, snapshot length, link type),
+// then a record per frame:
+//
+//	seconds (4) | microseconds (4) | captured length (4) | length (4) | frame
+//
+// The magic number gives the byte order the file was written in, and
+// the resolution of its timestamps: 0xa1b2c3d4 for microseconds,
+// 0xa1b23c4d for nanoseconds. PcapWriter writes little endian with
+// microseconds, like tcpdump on most machines; PcapReader reads both
+// orders and both resolutions. The newer pcapng format isn't supported.
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapMagicNanos = 0xa1b23c4d
+
+	// LinkTypeEthernet is the link type of Ethernet frames
+	LinkTypeEthernet = 1
+
+	defaultSnapLen = 262144 // tcpdump's default
+)
+
+// PcapWriter writes frames to a pcap file. It's safe for concurrent
+// use.
+type PcapWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	snapLen int
+	buf     []byte
+}
+
+// NewPcapWriter writes the file header to w. Frames longer than
+// snapLen are cut there, or at defaultSnapLen when it's 0.
+func NewPcapWriter(w io.Writer, snapLen int, linkType uint32) (*PcapWriter, error) {
+	if snapLen <= 0 {
+		snapLen = defaultSnapLen
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2) // Version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	// Time zone and timestamp accuracy, always 0
+	binary.LittleEndian.PutUint32(header[16:], uint32(snapLen))
+	binary.LittleEndian.PutUint32(header[20:], linkType)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &PcapWriter{w: w, snapLen: snapLen}, nil
+}
+
+// WriteFrame writes a record for f, in a single Write
+func (w *PcapWriter) WriteFrame(f Frame) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data := f.Data
+	if len(data) > w.snapLen {
+		data = data[:w.snapLen]
+	}
+	length := max(f.Length, len(f.Data))
+
+	w.buf = binary.LittleEndian.AppendUint32(w.buf[:0], uint32(f.Time.Unix()))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(f.Time.Nanosecond()/1000))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(len(data)))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(length))
+	w.buf = append(w.buf, data...)
+	_, err := w.w.Write(w.buf)
+
+	return err
+}
+
+// PcapReader reads the frames of a pcap file
+type PcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	header   [16]byte
+	SnapLen  int
+	LinkType uint32
+}
+
+// NewPcapReader reads the file header from r
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	pr := &PcapReader{r: r}
+	switch {
+	case binary.LittleEndian.Uint32(header[:]) == pcapMagic:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header[:]) == pcapMagic:
+		pr.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header[:]) == pcapMagicNanos:
+		pr.order, pr.nanos = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(header[:]) == pcapMagicNanos:
+		pr.order, pr.nanos = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("pcap: unknown magic number %#x", header[:4])
+	}
+	pr.SnapLen = int(pr.order.Uint32(header[16:]))
+	pr.LinkType = pr.order.Uint32(header[20:])
+
+	return pr, nil
+}
+
+// ReadFrame reads the next frame: io.EOF after the last one, and
+// io.ErrUnexpectedEOF in the middle of one
+func (r *PcapReader) ReadFrame() (Frame, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return Frame{}, err
+	}
+
+	sec, frac := r.order.Uint32(r.header[0:]), r.order.Uint32(r.header[4:])
+	size := r.order.Uint32(r.header[8:])
+	if size > uint32(max(r.SnapLen, defaultSnapLen)) {
+		return Frame{}, fmt.Errorf("pcap: record of %d bytes", size)
+	}
+	if !r.nanos {
+		frac *= 1000
+	}
+
+	f := Frame{
+		Time:   time.Unix(int64(sec), int64(frac)),
+		Data:   make([]byte, size),
+		Length: int(r.order.Uint32(r.header[12:])),
+	}
+	if _, err := io.ReadFull(r.r, f.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	return f, nil
+}
+
+func TestPcap(t *testing.T) {
+	frames := []Frame{
+		{Time: time.Unix(1700000000, 123456000), Data: testFrame(EtherTypeARP, make([]byte, 28)), Length: 42},
+		{Time: time.Unix(1700000001, 0), Data: bytes.Repeat([]byte{1}, 100), Length: 1500},
+	}
+
+	var buf bytes.Buffer
+	w, err := NewPcapWriter(&buf, 64, LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range frames {
+		if err := w.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// What tcpdump expects to find first
+	if !bytes.HasPrefix(buf.Bytes(), []byte{0xd4, 0xc3, 0xb2, 0xa1, 2, 0, 4, 0}) {
+		t.Errorf("unexpected file header % x", buf.Bytes()[:8])
+	}
+
+	r, err := NewPcapReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.SnapLen != 64 || r.LinkType != LinkTypeEthernet {
+		t.Errorf("unexpected file header: %d bytes, link type %d", r.SnapLen, r.LinkType)
+	}
+	for i, expected := range frames {
+		f, err := r.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The second frame is cut at the snapshot length
+		data := expected.Data[:min(len(expected.Data), 64)]
+		if !f.Time.Equal(expected.Time) || !bytes.Equal(f.Data, data) || f.Length != expected.Length {
+			t.Errorf("frame %d: expected %v, %d bytes of %d; actual: %v, %d bytes of %d", i,
+				expected.Time, len(data), expected.Length, f.Time, len(f.Data), f.Length)
+		}
+	}
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Errorf("expected io.EOF; actual: %v", err)
+	}
+
+	// Cut in the middle of a frame
+	r, _ = NewPcapReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	_, _ = r.ReadFrame()
+	if _, err := r.ReadFrame(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF; actual: %v", err)
+	}
+
+	if _, err := NewPcapReader(bytes.NewReader(make([]byte, 24))); err == nil {
+		t.Error("expected an unknown magic number to fail")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Read-ahead connections
+//
+// Deciding who handles a connection often means reading its first bytes:
+// the SNI router and the fingerprinting listener read the ClientHello, a
+// CONNECT client may find the target's first bytes behind the proxy's
+// answer, a protocol sniffer would look for "GET " or a PROXY header.
+// Those bytes belong to whoever handles the connection next, so each of
+// them used to keep what it read on the side and replay it, its own way.
+//
+// PeekConn does it once: a net.Conn reading through a buffer, where
+// Peek(n) returns the next n bytes without consuming them and Discard(n)
+// consumes them, like bufio.Reader. Read hands out the buffered bytes
+// first, then reads on, so a PeekConn is passed on as the connection
+// itself. Lookahead is an io.Reader over the bytes not peeked yet, for
+// parsers written against one (ReadClientHello); Reader is the buffer,
+// for those taking a *bufio.Reader (http.ReadRequest, ReadStrictResponse).
+//
+// Peeking reads with the read deadline of the connection. PeekTimeout
+// sets one for the peek and clears it after; a peer sending part of what
+// was asked for and then stopping gets a *StallError, as with a
+// DelimitedReader, and one sending nothing the plain timeout.
+
+// defaultPeekSize is the buffer of a PeekConn, unless told otherwise
+const defaultPeekSize = 4096
+
+// PeekConn is a connection whose next bytes can be looked at first
+type PeekConn struct {
+	net.Conn
+	r   *bufio.Reader
+	max int // Size the buffer may grow to
+}
+
+// NewPeekConn returns conn reading through a buffer of up to size bytes
+// (4096 if 0), the most Peek can look ahead. The buffer starts at 4096
+// at most and grows when a peek needs it to. A PeekConn allowing that
+// much already is returned as it is.
+func NewPeekConn(conn net.Conn, size int) *PeekConn {
+	if size <= 0 {
+		size = defaultPeekSize
+	}
+	if pc, ok := conn.(*PeekConn); ok && pc.max >= size {
+		return pc
+	}
+
+	return &PeekConn{Conn: conn, r: bufio.NewReaderSize(conn, min(size, defaultPeekSize)), max: size}
+}
+
+// Peek returns the next n bytes without consuming them. The slice is
+// only valid until the next read. Fewer than n bytes come with the
+// error that stopped the read, bufio.ErrBufferFull when n is more than
+// the buffer may hold.
+func (c *PeekConn) Peek(n int) ([]byte, error) {
+	c.grow(n)
+
+	return c.r.Peek(n)
+}
+
+// grow makes room for n bytes, up to max, carrying over the buffered
+// ones
+func (c *PeekConn) grow(n int) {
+	size := c.r.Size()
+	if n <= size || size >= c.max {
+		return
+	}
+	for size < n {
+		size *= 2
+	}
+
+	buffered, _ := c.r.Peek(c.r.Buffered())
+	r := io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), c.Conn)
+	c.r = bufio.NewReaderSize(r, min(size, c.max))
+}
+
+// PeekTimeout is Peek with a read deadline of timeout from now, cleared
+// afterwards
+func (c *PeekConn) PeekTimeout(n int, timeout time.Duration) ([]byte, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	b, err := c.Peek(n)
+	_ = c.Conn.SetReadDeadline(time.Time{})
+
+	var nErr net.Error
+	if errors.As(err, &nErr) && nErr.Timeout() && len(b) > 0 {
+		return b, &StallError{Buffered: len(b), Timeout: timeout}
+	}
+
+	return b, err
+}
+
+// Discard consumes the next n bytes, buffered or not
+func (c *PeekConn) Discard(n int) (int, error) {
+	return c.r.Discard(n)
+}
+
+// Buffered returns how many bytes were read ahead and not consumed
+func (c *PeekConn) Buffered() int {
+	return c.r.Buffered()
+}
+
+// Reader returns the buffer; what is read from it is consumed
+func (c *PeekConn) Reader() *bufio.Reader {
+	return c.r
+}
+
+// Lookahead returns a reader of the bytes past those peeked so far, for
+// parsing them without consuming them. It reads the connection into the
+// buffer, so it fails with bufio.ErrBufferFull past its end.
+func (c *PeekConn) Lookahead() io.Reader {
+	return &lookahead{c: c}
+}
+
+// lookahead reads the buffer of a PeekConn from off
+type lookahead struct {
+	c   *PeekConn
+	off int
+}
+
+func (l *lookahead) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b, err := l.c.Peek(l.off + 1)
+	if len(b) <= l.off {
+		return 0, err
+	}
+	// Whatever else is buffered comes along
+	b, _ = l.c.r.Peek(l.c.r.Buffered())
+	n := copy(p, b[l.off:])
+	l.off += n
+
+	return n, nil
+}
+
+// Read returns the buffered bytes first, then reads on
+func (c *PeekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes like *net.TCPConn; without one underneath it
+// closes the connection
+func (c *PeekConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+// SyscallConn exposes the socket underneath, for the socket options
+func (c *PeekConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+
+	return nil, errors.ErrUnsupported
+}
+
+// NetConn returns the connection underneath, like tls.Conn does
+func (c *PeekConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func TestPeekConn(t *testing.T) {
+	client, server := MemPipe()
+	defer client.Close()
+	pc := NewPeekConn(server, 16)
+	go func() { _, _ = io.WriteString(client, "GET / HTTP/1.1\r\n") }()
+
+	// Looking doesn't consume
+	b, err := pc.PeekTimeout(4, time.Second)
+	if err != nil || string(b) != "GET " {
+		t.Fatalf("unexpected peek %q: %v", b, err)
+	}
+	line, err := bufio.NewReader(pc.Lookahead()).ReadString('\n')
+	if err != nil || line != "GET / HTTP/1.1\r\n" {
+		t.Fatalf("unexpected lookahead %q: %v", line, err)
+	}
+	if _, err := pc.Peek(17); !errors.Is(err, bufio.ErrBufferFull) {
+		t.Errorf("expected the buffer full; actual: %v", err)
+	}
+
+	// Reading gets it all, from the start
+	if n, err := pc.Discard(4); n != 4 || err != nil {
+		t.Fatalf("unexpected discard %d: %v", n, err)
+	}
+	got := make([]byte, 12)
+	if _, err := io.ReadFull(pc, got); err != nil || string(got) != "/ HTTP/1.1\r\n" {
+		t.Errorf("unexpected read %q: %v", got, err)
+	}
+
+	// Half of what was asked for, then nothing
+	go func() { _, _ = io.WriteString(client, "\x16\x03") }()
+	if _, err := pc.PeekTimeout(5, 50*time.Millisecond); !errors.Is(err, ErrStalled) {
+		t.Errorf("expected a stall; actual: %v", err)
+	}
+	if b, _ := pc.Peek(2); !bytes.Equal(b, []byte("\x16\x03")) {
+		t.Errorf("expected the bytes kept; actual: %q", b)
+	}
+	if NewPeekConn(pc, 16) != pc {
+		t.Error("expected a PeekConn to be reused")
+	}
+
+	// The buffer grows as needed, keeping what it had
+	pc = NewPeekConn(pc, 10000)
+	long := strings.Repeat("x", 6000)
+	go func() { _, _ = io.WriteString(client, long) }()
+	if b, err := pc.Peek(6002); err != nil || string(b) != "\x16\x03"+long {
+		t.Errorf("unexpected long peek of %d bytes: %v", len(b), err)
+	}
+
+	// The ClientHello of a real client, peeked and then read by the TLS
+	// server
+	client, server = tcpPair(t)
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "peek.test", InsecureSkipVerify: true}).Handshake()
+	}()
+	pc = NewPeekConn(server, maxClientHelloSize)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	hello, _, err := ReadClientHello(pc.Lookahead())
+	if err != nil || hello.ServerName != "peek.test" {
+		t.Fatalf("unexpected hello %+v: %v", hello, err)
+	}
+	again, _, err := ReadClientHello(pc)
+	if err != nil || again.JA3() != hello.JA3() {
+		t.Errorf("expected the same hello read again; actual: %v", err)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ICMP ping
+//
+// ping doesn't use TCP or UDP at all: it sends ICMP "echo request"
+// messages straight on top of IP and waits for the matching "echo
+// reply". Every message carries an identifier (which pinger sent it) and
+// a sequence number (which request it answers), so replies can be
+// matched even when they arrive out of order or not at all.
+//
+//	 0       8       16              31
+//	+-------+-------+----------------+
+//	| Type  | Code  |    Checksum    |
+//	+-------+-------+----------------+
+//	|   Identifier  | Sequence Number|
+//	+---------------+----------------+
+//	|            Data ...            |
+//	+--------------------------------+
+//
+// Sending raw IP needs privileges (root or CAP_NET_RAW). Linux and macOS
+// also offer "ICMP datagram sockets" that ordinary users may open
+// (on Linux, if their group is in net.ipv4.ping_group_range). With those
+// the kernel takes care of the identifier and the checksum. ICMPPinger
+// tries a raw socket first and falls back to a datagram socket.
+
+// ICMP message types used by ping
+const (
+	icmpEchoReply     = 0
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+
+	icmpHeaderSize = 8
+)
+
+// ICMPEcho is an ICMP or ICMPv6 echo request/reply message
+type ICMPEcho struct {
+	Type uint8
+	Code uint8
+	ID   uint16
+	Seq  uint16
+	Data []byte
+}
+
+// MarshalBinary encodes the message, computing the checksum. The
+// checksum of ICMPv6 messages covers a pseudo header the kernel fills in
+// for us, so for those it's left to the kernel and stays zero here.
+func (e ICMPEcho) MarshalBinary() ([]byte, error) {
+	b := make([]byte, icmpHeaderSize+len(e.Data))
+	b[0] = e.Type
+	b[1] = e.Code
+	binary.BigEndian.PutUint16(b[4:], e.ID)
+	binary.BigEndian.PutUint16(b[6:], e.Seq)
+	copy(b[icmpHeaderSize:], e.Data)
+
+	if e.Type == icmpEchoRequest || e.Type == icmpEchoReply {
+		binary.BigEndian.PutUint16(b[2:], internetChecksum(b))
+	}
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes an echo message
+func (e *ICMPEcho) UnmarshalBinary(p []byte) error {
+	if len(p) < icmpHeaderSize {
+		return errors.New("icmp: message too short")
+	}
+
+	e.Type = p[0]
+	e.Code = p[1]
+	e.ID = binary.BigEndian.Uint16(p[4:])
+	e.Seq = binary.BigEndian.Uint16(p[6:])
+	e.Data = append([]byte(nil), p[icmpHeaderSize:]...)
+
+	return nil
+}
+
+// internetChecksum is the internet checksum (RFC 1071): the one's complement
+// of the one's complement sum of the message as 16-bit words
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+// PingReply describes a single echo reply
+type PingReply struct {
+	From net.Addr
+	Seq  int
+	Size int // Bytes of ICMP data
+	RTT  time.Duration
+}
+
+// PingStats summarizes a ping run
+type PingStats struct {
+	Sent     int
+	Received int
+	Loss     float64 // Fraction of requests without a reply, 0 to 1
+	MinRTT   time.Duration
+	AvgRTT   time.Duration
+	MaxRTT   time.Duration
+	StdDev   time.Duration
+}
+
+// ICMPPinger sends ICMP echo requests to a single host
+type ICMPPinger struct {
+	Count    int           // Requests to send, 0 to ping until ctx is done
+	Interval time.Duration // Between requests (defaults to 1s)
+	Timeout  time.Duration // Wait for the last reply (defaults to 1s)
+	Size     int           // Bytes of data per request (defaults to 56)
+
+	// Unprivileged skips the raw socket attempt and goes straight to
+	// an ICMP datagram socket
+	Unprivileged bool
+
+	// OnReply is called for every reply as it arrives
+	OnReply func(PingReply)
+}
+
+// pingConn is an open ICMP socket
+type pingConn struct {
+	net.PacketConn
+	v6       bool
+	datagram bool // Kernel managed IDs, replies come from *net.UDPAddr
+}
+
+// dest returns the address to send to, matching the socket type
+func (c *pingConn) dest(ip net.IP) net.Addr {
+	if c.datagram {
+		return &net.UDPAddr{IP: ip}
+	}
+
+	return &net.IPAddr{IP: ip}
+}
+
+// listenICMP opens a raw socket, or a datagram socket when that isn't
+// allowed
+func listenICMP(v6, unprivileged bool) (*pingConn, error) {
+	if !unprivileged {
+		network := "ip4:icmp"
+		if v6 {
+			network = "ip6:ipv6-icmp"
+		}
+		pc, err := net.ListenPacket(network, "")
+		if err == nil {
+			return &pingConn{PacketConn: pc, v6: v6}, nil
+		}
+		if !errors.Is(err, os.ErrPermission) {
+			return nil, err
+		}
+	}
+
+	pc, err := listenICMPDatagram(v6)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pingConn{PacketConn: pc, v6: v6, datagram: true}, nil
+}
+
+// Ping pings host until Count requests have been sent (and answered or
+// timed out) or ctx is done, whichever comes first
+func (p *ICMPPinger) Ping(ctx context.Context, host string) (PingStats, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return PingStats{}, err
+	}
+	ip := addrs[0].IP
+	v6 := ip.To4() == nil
+
+	conn, err := listenICMP(v6, p.Unprivileged)
+	if err != nil {
+		return PingStats{}, err
+	}
+	defer conn.Close()
+
+	interval := p.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	size := p.Size
+	if size <= 0 {
+		size = 56
+	}
+
+	r := &pingRun{
+		id:      uint16(os.Getpid()),
+		pending: make(map[uint16]time.Time),
+		replied: make(chan struct{}, 1),
+		onReply: p.OnReply,
+	}
+
+	// Closing the socket is the only way to stop the reader
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		r.readReplies(conn)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	reqType := uint8(icmpEchoRequest)
+	if v6 {
+		reqType = icmpv6EchoRequest
+	}
+
+send:
+	for seq := 0; p.Count == 0 || seq < p.Count; seq++ {
+		b, _ := ICMPEcho{Type: reqType, ID: r.id, Seq: uint16(seq), Data: make([]byte, size)}.MarshalBinary()
+
+		r.sent(uint16(seq))
+		if _, err := conn.WriteTo(b, conn.dest(ip)); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return r.stats(), err
+		}
+
+		if p.Count != 0 && seq == p.Count-1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break send
+		case <-ticker.C:
+		}
+	}
+
+	// Give the last replies a chance to arrive
+	wait := time.NewTimer(timeout)
+	defer wait.Stop()
+drain:
+	for r.outstanding() > 0 {
+		select {
+		case <-r.replied:
+		case <-wait.C:
+			break drain
+		case <-ctx.Done():
+			break drain
+		}
+	}
+	_ = conn.Close()
+	<-readDone
+
+	return r.stats(), nil
+}
+
+// pingRun holds the state of a single Ping call
+type pingRun struct {
+	id      uint16
+	onReply func(PingReply)
+	replied chan struct{} // Nudged after every matched reply
+
+	mu      sync.Mutex
+	pending map[uint16]time.Time // Send time of unanswered requests
+	nSent   int
+	rtts    []time.Duration
+}
+
+func (r *pingRun) sent(seq uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending[seq] = time.Now()
+	r.nSent++
+}
+
+func (r *pingRun) outstanding() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.pending)
+}
+
+// readReplies reads until the socket is closed or its deadline hits
+func (r *pingRun) readReplies(conn *pingConn) {
+	replyType := uint8(icmpEchoReply)
+	if conn.v6 {
+		replyType = icmpv6EchoReply
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+
+		var msg ICMPEcho
+		if err := msg.UnmarshalBinary(buf[:n]); err != nil || msg.Type != replyType {
+			continue
+		}
+		// A raw socket sees every ICMP message for the host, including
+		// the replies for other ping processes. Datagram sockets only
+		// get their own, with an ID the kernel picked.
+		if !conn.datagram && msg.ID != r.id {
+			continue
+		}
+
+		r.mu.Lock()
+		sentAt, ok := r.pending[msg.Seq]
+		if ok {
+			delete(r.pending, msg.Seq)
+			r.rtts = append(r.rtts, now.Sub(sentAt))
+		}
+		r.mu.Unlock()
+
+		// Duplicates and replies to requests we gave up on
+		if !ok {
+			continue
+		}
+
+		if r.onReply != nil {
+			r.onReply(PingReply{From: from, Seq: int(msg.Seq), Size: len(msg.Data), RTT: now.Sub(sentAt)})
+		}
+
+		select {
+		case r.replied <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stats computes the summary of the run so far
+func (r *pingRun) stats() PingStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := PingStats{Sent: r.nSent, Received: len(r.rtts)}
+	if s.Sent > 0 {
+		s.Loss = float64(s.Sent-s.Received) / float64(s.Sent)
+	}
+	if s.Received == 0 {
+		return s
+	}
+
+	var sum float64
+	s.MinRTT = r.rtts[0]
+	for _, rtt := range r.rtts {
+		s.MinRTT = min(s.MinRTT, rtt)
+		s.MaxRTT = max(s.MaxRTT, rtt)
+		sum += float64(rtt)
+	}
+	mean := sum / float64(s.Received)
+	s.AvgRTT = time.Duration(mean)
+
+	var variance float64
+	for _, rtt := range r.rtts {
+		variance += (float64(rtt) - mean) * (float64(rtt) - mean)
+	}
+	s.StdDev = time.Duration(math.Sqrt(variance / float64(s.Received)))
+
+	return s
+}
+
+// pingMain implements the "ping" command:
+//
+//	golearn ping [-c count] [-i interval] [-W timeout] [-s size] [-u] host
+func pingMain(args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ContinueOnError)
+	count := fs.Int("c", 0, "stop after `count` requests (0 pings until interrupted)")
+	interval := fs.Duration("i", time.Second, "`interval` between requests")
+	timeout := fs.Duration("W", time.Second, "`timeout` for the last reply")
+	size := fs.Int("s", 56, "bytes of data per request")
+	unprivileged := fs.Bool("u", false, "use an unprivileged ICMP datagram socket")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: ping [flags] host")
+	}
+	host := fs.Arg(0)
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	pinger := &ICMPPinger{
+		Count:        *count,
+		Interval:     *interval,
+		Timeout:      *timeout,
+		Size:         *size,
+		Unprivileged: *unprivileged,
+		OnReply: func(r PingReply) {
+			fmt.Printf("%d bytes from %s: icmp_seq=%d time=%s\n", r.Size, r.From, r.Seq, r.RTT)
+		},
+	}
+
+	fmt.Printf("PING %s: %d data bytes\n", host, *size)
+	s, err := pinger.Ping(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\n--- %s ping statistics ---\n", host)
+	fmt.Printf("%d packets transmitted, %d received, %.1f%% packet loss\n", s.Sent, s.Received, s.Loss*100)
+	if s.Received > 0 {
+		fmt.Printf("rtt min/avg/max/stddev = %s/%s/%s/%s\n", s.MinRTT, s.AvgRTT, s.MaxRTT, s.StdDev)
+	}
+
+	return nil
+}
+
+func TestICMPEcho(t *testing.T) {
+	in := ICMPEcho{Type: icmpEchoRequest, ID: 0x1234, Seq: 7, Data: []byte("abc")}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A correct checksum makes the checksum of the whole message zero
+	if sum := internetChecksum(b); sum != 0 {
+		t.Errorf("expected valid checksum; actual: %#04x", sum)
+	}
+
+	var out ICMPEcho
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if out.Type != in.Type || out.ID != in.ID || out.Seq != in.Seq || string(out.Data) != "abc" {
+		t.Errorf("round trip mismatch: %+v", out)
+	}
+
+	if err := out.UnmarshalBinary(b[:4]); err == nil {
+		t.Error("expected error for a short message")
+	}
+}
+
+func TestICMPPinger(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		t.Run(host, func(t *testing.T) {
+			var replies []PingReply
+			p := &ICMPPinger{
+				Count:    3,
+				Interval: 10 * time.Millisecond,
+				Timeout:  500 * time.Millisecond,
+				OnReply:  func(r PingReply) { replies = append(replies, r) },
+			}
+
+			s, err := p.Ping(context.Background(), host)
+			if err != nil {
+				t.Skipf("can't ping %s here: %v", host, err)
+			}
+
+			if s.Sent != 3 || s.Received != 3 || s.Loss != 0 {
+				t.Errorf("expected 3/3 replies; actual: %+v", s)
+			}
+			if s.MinRTT <= 0 || s.MinRTT > s.AvgRTT || s.AvgRTT > s.MaxRTT {
+				t.Errorf("inconsistent RTT stats: %+v", s)
+			}
+			if len(replies) != 3 {
+				t.Errorf("expected 3 OnReply calls; actual: %d", len(replies))
+			}
+		})
+	}
+}
+
+func TestICMPPingerCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Pings forever until ctx is done
+	p := &ICMPPinger{Interval: 10 * time.Millisecond}
+	s, err := p.Ping(ctx, "127.0.0.1")
+	if err != nil {
+		t.Skipf("can't ping here: %v", err)
+	}
+	if s.Sent == 0 || s.Sent > 10 {
+		t.Errorf("unexpected number of requests: %d", s.Sent)
+	}
+}
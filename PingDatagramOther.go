@@ -0,0 +1,13 @@
+//go:build !(linux || darwin)
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// listenICMPDatagram is only available on linux and macOS
+func listenICMPDatagram(bool) (net.PacketConn, error) {
+	return nil, errors.New("unprivileged ICMP sockets not supported on this platform")
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// Port exhaustion
+//
+// Every outbound TCP connection holds a local port until it's closed,
+// and for a minute or so after that in TIME_WAIT. A client opening short
+// connections to one backend in a loop can use up the kernel's
+// ephemeral range (net.ipv4.ip_local_port_range, about 28000 ports) to
+// that address; connect then fails with EADDRNOTAVAIL, "cannot assign
+// requested address", which reads like a configuration mistake rather
+// than a load problem. Running out of file descriptors (EMFILE, ENFILE)
+// is the same problem one level up, and as cryptic.
+//
+// explainExhaustion recognizes both in a dial error and wraps it in an
+// *ExhaustionError, whose message says what ran out and what to do
+// about it. It matches ErrExhausted, and IsTransient holds for it: ports
+// come back out of TIME_WAIT and descriptors get closed, so backing off
+// helps. ConnBudget dials and RetryPolicy.Do pass their errors through
+// it, which covers the dialers of the repo.
+//
+// SourceDialer is the mitigation when more connections are really
+// needed:
+//
+// - bound to a source IP with port 0, it sets IP_BIND_ADDRESS_NO_PORT
+//   (linux): the kernel then picks the port at connect, knowing the
+//   destination, and a port can serve one connection per destination
+//   instead of one overall
+// - with a port range, when the kernel's own pick fails for lack of
+//   ports it binds a port of the range itself, with SO_REUSEADDR so
+//   connections to other destinations can share it, and moves on to
+//   the next port for as long as they're taken
+//
+// Elsewhere than linux, both options degrade: a bind to port 0 takes a
+// port of its own, and a port of the range holds a single connection.
+
+// ErrExhausted is matched by errors about ports or file descriptors
+// running out
+var ErrExhausted = errors.New("local resources exhausted")
+
+// Resources an ExhaustionError may be about
+const (
+	ResourcePorts = "ephemeral ports"
+	ResourceFiles = "file descriptors"
+)
+
+// Remediation hints of the ExhaustionError messages
+var exhaustionHints = map[string]string{
+	ResourcePorts: "reuse connections (UpstreamTransport), cap them with a ConnBudget, widen net.ipv4.ip_local_port_range or dial through a SourceDialer port range",
+	ResourceFiles: "raise the limit (ulimit -n, LimitNOFILE), or cap connections with a ConnBudget",
+}
+
+// ExhaustionError is a dial that failed because local ports or file
+// descriptors ran out
+type ExhaustionError struct {
+	Resource string // ResourcePorts or ResourceFiles
+	Addr     string // Destination, when known
+	Err      error
+}
+
+func (e *ExhaustionError) Error() string {
+	msg := fmt.Sprintf("out of %s (%v); %s", e.Resource, e.Err, exhaustionHints[e.Resource])
+	if e.Addr != "" {
+		msg = "dial " + e.Addr + ": " + msg
+	}
+
+	return msg
+}
+
+// Is makes errors.Is(err, ErrExhausted) true for an ExhaustionError
+func (e *ExhaustionError) Is(target error) bool { return target == ErrExhausted }
+
+func (e *ExhaustionError) Unwrap() error { return e.Err }
+
+// IsExhausted reports whether err is about ports or file descriptors
+// running out
+func IsExhausted(err error) bool {
+	return errors.Is(err, ErrExhausted)
+}
+
+// exhaustedResource returns what err says ran out, if anything. A
+// connect failing with EADDRNOTAVAIL or EADDRINUSE is out of ports; a
+// bind doing so asked for an address that isn't there or is taken, and
+// isn't.
+func exhaustedResource(err error) string {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return ResourceFiles
+	}
+	var sysErr *os.SyscallError
+	if errors.As(err, &sysErr) && sysErr.Syscall == "connect" &&
+		(errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EADDRINUSE)) {
+		return ResourcePorts
+	}
+
+	return ""
+}
+
+// explainExhaustion wraps err in an *ExhaustionError when it's about
+// resources running out, and returns it unchanged otherwise
+func explainExhaustion(err error, addr string) error {
+	if err == nil || IsExhausted(err) {
+		return err
+	}
+	resource := exhaustedResource(err)
+	if resource == "" {
+		return err
+	}
+
+	return &ExhaustionError{Resource: resource, Addr: addr, Err: err}
+}
+
+// SourceDialer dials from a chosen source address, see above
+type SourceDialer struct {
+	// Dialer dials, with its LocalAddr IP as the source address, if any
+	Dialer net.Dialer
+
+	// PortLow and PortHigh, when set, are the source ports to bind once
+	// the kernel runs out, inclusive
+	PortLow, PortHigh int
+}
+
+// DialContext connects to addr
+func (d *SourceDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialFrom(ctx, network, addr, 0)
+	if err == nil {
+		return conn, nil
+	}
+	err = explainExhaustion(err, addr)
+	if exhaustedResource(err) != ResourcePorts || d.PortLow <= 0 || d.PortHigh < d.PortLow {
+		return nil, err
+	}
+
+	return d.dialRange(ctx, network, addr)
+}
+
+// dialRange binds the ports of the range in turn, from a random one, so
+// dialers sharing a range don't all contend for its first ports
+func (d *SourceDialer) dialRange(ctx context.Context, network, addr string) (net.Conn, error) {
+	n := d.PortHigh - d.PortLow + 1
+	start := rand.IntN(n)
+
+	var err error
+	for i := 0; i < n; i++ {
+		var conn net.Conn
+		conn, err = d.dialFrom(ctx, network, addr, d.PortLow+(start+i)%n)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil || !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, err
+		}
+	}
+
+	return nil, &ExhaustionError{
+		Resource: ResourcePorts,
+		Addr:     addr,
+		Err:      fmt.Errorf("source ports %d-%d all taken: %w", d.PortLow, d.PortHigh, err),
+	}
+}
+
+// dialFrom dials from port, 0 meaning the kernel's choice
+func (d *SourceDialer) dialFrom(ctx context.Context, network, addr string, port int) (net.Conn, error) {
+	dialer := d.Dialer
+	var ip net.IP
+	if local, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		ip = local.IP
+	}
+	if ip == nil && port == 0 {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	dialer.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+
+	control := dialer.ControlContext
+	dialer.ControlContext = func(ctx context.Context, network, address string, rc syscall.RawConn) error {
+		if err := setBindNoPort(rc, port); err != nil {
+			return err
+		}
+		if control != nil {
+			return control(ctx, network, address, rc)
+		}
+		return nil
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func TestPortExhaustion(t *testing.T) {
+	portsErr := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EADDRNOTAVAIL)}
+	bindErr := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("bind", syscall.EADDRNOTAVAIL)}
+	filesErr := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("socket", syscall.EMFILE)}
+
+	err := explainExhaustion(portsErr, "backend:80")
+	var exErr *ExhaustionError
+	if !errors.As(err, &exErr) || exErr.Resource != ResourcePorts || !IsTransient(err) {
+		t.Errorf("expected out of ports, transient; actual: %v", err)
+	}
+	if !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Error("expected the errno to stay matchable")
+	}
+	if explainExhaustion(err, "backend:80") != err {
+		t.Error("expected an ExhaustionError to be left as is")
+	}
+	if err := explainExhaustion(filesErr, ""); exhaustedResource(err) != ResourceFiles {
+		t.Errorf("expected out of files; actual: %v", err)
+	}
+	if err := explainExhaustion(bindErr, ""); err != bindErr {
+		t.Errorf("expected a bad bind address to be left alone; actual: %v", err)
+	}
+
+	// The retry layer explains too
+	policy := RetryPolicy{Attempts: 2, Initial: 1}
+	err = policy.Do(context.Background(), func(context.Context) error { return portsErr })
+	if !IsExhausted(err) {
+		t.Errorf("expected the retries to end explained; actual: %v", err)
+	}
+
+	// A single port takes one connection to the listener, not two
+	l := testListener(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	pl := testListener(t)
+	port := pl.Addr().(*net.TCPAddr).Port
+	_ = pl.Close()
+
+	d := &SourceDialer{PortLow: port, PortHigh: port}
+	ctx := context.Background()
+	c, err := d.dialRange(ctx, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if local := c.LocalAddr().(*net.TCPAddr).Port; local != port {
+		t.Errorf("expected source port %d; actual: %d", port, local)
+	}
+	if _, err := d.dialRange(ctx, "tcp", l.Addr().String()); !IsExhausted(err) {
+		t.Errorf("expected the range exhausted; actual: %v", err)
+	}
+
+	// Linux shares it with a connection to another destination
+	if runtime.GOOS == "linux" {
+		other := testListener(t)
+		c, err := d.dialRange(ctx, "tcp", other.Addr().String())
+		if err != nil {
+			t.Fatalf("expected the port shared; actual: %v", err)
+		}
+		_ = c.Close()
+	}
+
+	// A source IP alone dials as usual
+	d = &SourceDialer{Dialer: net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}}
+	c, err = d.DialContext(ctx, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+}
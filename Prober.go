@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Latency and jitter probes
+//
+// Monitoring from the inside (the Monitor's counters, server logs) says
+// nothing about what clients see. A prober is a synthetic client: every
+// Interval it connects to each target and times the steps separately,
+// because each one points at a different culprit:
+//
+// - TCP connect: one network round trip plus the kernel's accept queue;
+//   slow means the network or an overloaded listener
+// - TLS handshake: another round trip plus the server's crypto; slow
+//   with a fast connect means a busy server
+// - application RTT: a WebSocket ping answered with a pong by the
+//   application itself; slow with a fast handshake means the
+//   application is stuck (a full event loop, a lock)
+//
+// Each step feeds a RollingHistogram for percentiles, plus a jitter
+// figure, the smoothed difference between consecutive measurements (as
+// in RFC 3550): a path with a steady 80ms is better for a voice call
+// than one alternating between 10 and 100ms.
+//
+// Publish exposes everything through expvar, so the metrics show up at
+// /debug/vars next to the Monitor's.
+
+const (
+	defaultProbeInterval = 10 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+	defaultProbeWindow   = 5 * time.Minute
+)
+
+// ProbeTarget is something to probe
+type ProbeTarget struct {
+	Name string
+	Addr string // host:port
+
+	// TLS, when set, adds a timed handshake after connecting
+	TLS *tls.Config
+
+	// WSPath, when set, upgrades to a WebSocket at this path and times
+	// a ping/pong round trip
+	WSPath string
+}
+
+// ProbeStats are a target's figures over the window
+type ProbeStats struct {
+	Connect   HistogramSnapshot `json:"connect"`
+	Handshake HistogramSnapshot `json:"tls_handshake"`
+	RTT       HistogramSnapshot `json:"rtt"`
+
+	ConnectJitter   time.Duration `json:"connect_jitter_ns"`
+	HandshakeJitter time.Duration `json:"tls_handshake_jitter_ns"`
+	RTTJitter       time.Duration `json:"rtt_jitter_ns"`
+
+	Probes    uint64 `json:"probes"`
+	Failures  uint64 `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// latencySeries is one measured step of a target
+type latencySeries struct {
+	hist   *RollingHistogram
+	last   time.Duration
+	jitter float64
+}
+
+func (s *latencySeries) observe(d time.Duration, now time.Time) {
+	s.hist.Observe(d, now)
+	if s.last > 0 {
+		diff := float64(d - s.last)
+		if diff < 0 {
+			diff = -diff
+		}
+		s.jitter += (diff - s.jitter) / 16
+	}
+	s.last = d
+}
+
+// probeState is what the prober knows about a target
+type probeState struct {
+	mu                      sync.Mutex
+	connect, handshake, rtt latencySeries
+	probes, failures        uint64
+	lastErr                 error
+	failing                 bool // The last probe failed
+}
+
+// Prober probes targets periodically
+type Prober struct {
+	Targets  []ProbeTarget
+	Interval time.Duration // Between probes of a target, defaults to 10s
+	Timeout  time.Duration // Per probe, defaults to 5s
+	Window   time.Duration // Covered by the histograms, defaults to 5m
+
+	// ErrorLog receives failed probes
+	ErrorLog *log.Logger
+
+	// OnChange, when set, is called when a target starts failing, with
+	// the error, and when it recovers, with nil; see Alerter in SMTP.go
+	OnChange func(target string, err error)
+
+	once  sync.Once
+	state map[string]*probeState
+}
+
+func (p *Prober) logf(format string, v ...any) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+func (p *Prober) init() {
+	p.once.Do(func() {
+		window := p.Window
+		if window <= 0 {
+			window = defaultProbeWindow
+		}
+
+		p.state = make(map[string]*probeState, len(p.Targets))
+		for _, t := range p.Targets {
+			p.state[t.Name] = &probeState{
+				connect:   latencySeries{hist: NewRollingHistogram(window)},
+				handshake: latencySeries{hist: NewRollingHistogram(window)},
+				rtt:       latencySeries{hist: NewRollingHistogram(window)},
+			}
+		}
+	})
+}
+
+// Run probes every target each Interval until ctx is done
+func (p *Prober) Run(ctx context.Context) error {
+	p.init()
+
+	interval := p.Interval
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, t := range p.Targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := p.Probe(ctx, t); err != nil && ctx.Err() == nil {
+					p.logf("probe %s: %v", t.Name, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Probe measures t once and records the results
+func (p *Prober) Probe(ctx context.Context, t ProbeTarget) error {
+	p.init()
+	state, ok := p.state[t.Name]
+	if !ok {
+		return fmt.Errorf("probe: unknown target %q", t.Name)
+	}
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	connect, handshake, rtt, err := probe(probeCtx, t)
+	if err != nil {
+		// Interrupted by the caller, not the target's fault. The
+		// connection's deadline may fire a moment before ctx notices.
+		if deadline, ok := ctx.Deadline(); ctx.Err() != nil || ok && !time.Now().Before(deadline) {
+			return err
+		}
+	}
+
+	now := time.Now()
+	state.mu.Lock()
+	state.probes++
+	if connect > 0 {
+		state.connect.observe(connect, now)
+	}
+	if handshake > 0 {
+		state.handshake.observe(handshake, now)
+	}
+	if rtt > 0 {
+		state.rtt.observe(rtt, now)
+	}
+	if err != nil {
+		state.failures++
+		state.lastErr = err
+	}
+	changed := state.failing != (err != nil)
+	state.failing = err != nil
+	state.mu.Unlock()
+
+	if changed && p.OnChange != nil {
+		p.OnChange(t.Name, err)
+	}
+
+	return err
+}
+
+// probe times the steps of t that it gets through
+func probe(ctx context.Context, t ProbeTarget) (connect, handshake, rtt time.Duration, err error) {
+	start := time.Now()
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	connect = time.Since(start)
+	defer func() { _ = conn.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	scheme := "ws"
+	if t.TLS != nil {
+		cfg := t.TLS
+		if cfg.ServerName == "" {
+			// Verify the host we dialed, like tls.Dial does
+			cfg = cfg.Clone()
+			cfg.ServerName, _, _ = net.SplitHostPort(t.Addr)
+		}
+		tlsConn := tls.Client(conn, cfg)
+		start = time.Now()
+		if _, err := TLSHandshake(ctx, tlsConn, 0); err != nil {
+			return connect, 0, 0, err
+		}
+		handshake = time.Since(start)
+		conn, scheme = tlsConn, "wss"
+	}
+
+	if t.WSPath == "" {
+		return connect, handshake, 0, nil
+	}
+
+	ws, err := wsClientHandshake(ctx, conn, &url.URL{Scheme: scheme, Host: t.Addr, Path: t.WSPath})
+	if err != nil {
+		return connect, handshake, 0, err
+	}
+	defer ws.Close()
+
+	// The pong arrives through Read, which must be running
+	pong := make(chan []byte, 1)
+	ws.OnPong = func(data []byte) {
+		select {
+		case pong <- data:
+		default:
+		}
+	}
+	go func() { _, _ = io.Copy(io.Discard, ws) }()
+
+	start = time.Now()
+	token := binary.BigEndian.AppendUint64(nil, uint64(start.UnixNano()))
+	if err := ws.Ping(token); err != nil {
+		return connect, handshake, 0, err
+	}
+	select {
+	case data := <-pong:
+		if string(data) != string(token) {
+			return connect, handshake, 0, errors.New("probe: pong doesn't match ping")
+		}
+		rtt = time.Since(start)
+	case <-ctx.Done():
+		return connect, handshake, 0, ctx.Err()
+	}
+
+	return connect, handshake, rtt, nil
+}
+
+// Stats returns the figures of every target
+func (p *Prober) Stats() map[string]ProbeStats {
+	p.init()
+	now := time.Now()
+
+	stats := make(map[string]ProbeStats, len(p.state))
+	for name, s := range p.state {
+		s.mu.Lock()
+		st := ProbeStats{
+			Connect:         s.connect.hist.Snapshot(now),
+			Handshake:       s.handshake.hist.Snapshot(now),
+			RTT:             s.rtt.hist.Snapshot(now),
+			ConnectJitter:   time.Duration(s.connect.jitter),
+			HandshakeJitter: time.Duration(s.handshake.jitter),
+			RTTJitter:       time.Duration(s.rtt.jitter),
+			Probes:          s.probes,
+			Failures:        s.failures,
+		}
+		if s.lastErr != nil {
+			st.LastError = s.lastErr.Error()
+		}
+		s.mu.Unlock()
+		stats[name] = st
+	}
+
+	return stats
+}
+
+// Publish exposes the stats through expvar under name. Like
+// expvar.Publish, it panics if name is already in use.
+func (p *Prober) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return p.Stats()
+	}))
+}
+
+func TestProber(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := ca.Issue(TLSLeaf{Name: "server", Hosts: []string{"127.0.0.1"}})
+
+	// A WebSocket server over TLS; the handler only needs to read for
+	// pings to be answered
+	mux := http.NewServeMux()
+	mux.Handle("/ws", WSHandler(func(_ context.Context, conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	}))
+	l, err := tls.Listen("tcp", "127.0.0.1:", ServerConfig(cert, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: mux, ErrorLog: log.New(io.Discard, "", 0)}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	// A port nobody listens on
+	deadAddr := testUnusedAddr(t)
+
+	var mu sync.Mutex
+	changes := make(map[string]int)
+	p := &Prober{
+		Targets: []ProbeTarget{
+			{Name: "ws", Addr: l.Addr().String(), TLS: ClientConfig(ca.Pool()), WSPath: "/ws"},
+			{Name: "dead", Addr: deadAddr},
+		},
+		Interval: 20 * time.Millisecond,
+		Timeout:  time.Second,
+		ErrorLog: log.New(io.Discard, "", 0),
+		OnChange: func(target string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes[target]++
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	_ = p.Run(ctx)
+
+	stats := p.Stats()
+	ws := stats["ws"]
+	if ws.Probes < 3 || ws.Failures != 0 {
+		t.Fatalf("unexpected probe counts %+v", ws)
+	}
+	for name, h := range map[string]HistogramSnapshot{"connect": ws.Connect, "handshake": ws.Handshake, "rtt": ws.RTT} {
+		if h.Count != ws.Probes || h.Quantile(0.5) <= 0 {
+			t.Errorf("%s: unexpected histogram %+v", name, h)
+		}
+	}
+
+	if d := stats["dead"]; d.Failures == 0 || d.Failures != d.Probes || d.LastError == "" || d.Connect.Count != 0 {
+		t.Errorf("unexpected stats for the dead target %+v", d)
+	}
+	// The dead target started failing once, and stayed down
+	if changes["dead"] != 1 || changes["ws"] != 0 {
+		t.Errorf("unexpected changes %v", changes)
+	}
+
+	// What Publish shows at /debug/vars: the percentiles per step
+	b, err := json.Marshal(stats)
+	if err != nil || !strings.Contains(string(b), `"rtt":{"count":`) || !strings.Contains(string(b), `"p99_ms"`) {
+		t.Errorf("unexpected JSON %s, %v", b, err)
+	}
+}
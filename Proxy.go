@@ -1,53 +1,84 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"sync"
 	"testing"
+	"time"
 )
 
 // proxyConn connects to two TCP endpoints (source and destination) and proxies data between them.
 // It sets up bi-directional data transfer: any data received from the source is forwarded to the destination,
-// and any data from the destination is sent back to the source.
-func proxyConn(source, destination string) error {
+// and any data from the destination is sent back to the source. It returns once both directions are done,
+// or as soon as ctx is, which closes both connections.
+func proxyConn(ctx context.Context, source, destination string) error {
+	var d net.Dialer
+
 	// Dial the source TCP address
-	connSource, err := net.Dial("tcp", source)
+	connSource, err := d.DialContext(ctx, "tcp", source)
 	if err != nil {
 		return err
 	}
 	defer connSource.Close() // Ensure source connection is closed when function exits
 
 	// Dial the destination TCP address
-	connDestination, err := net.Dial("tcp", destination)
+	connDestination, err := d.DialContext(ctx, "tcp", destination)
 	if err != nil {
 		return err
 	}
 	defer connDestination.Close() // Ensure destination connection is closed
 
-	// Start a goroutine to copy data from destination to source
-	// (e.g., for responses coming back)
-	go func() {
-		_, _ = io.Copy(connSource, connDestination)
-	}()
+	// Copy both ways until both are done, see SNIRouter.go
+	pipeConns(ctx, connSource, connDestination, nil)
 
-	// Start a goroutine to copy data from source to destination
-	// (e.g., for requests going out)
-	go func() {
-		_, _ = io.Copy(connDestination, connSource)
-	}()
+	return ctx.Err()
+}
+
+// ConnProxy proxies pairs of connections in the background, like
+// proxyConn without the dialing, and keeps track of them so Shutdown
+// can close them all and wait for the copies to return
+type ConnProxy struct {
+	// Counter, when set, receives the bytes copied: what the client
+	// sends is Outbound
+	Counter Counter
 
-	// NOTE: This function returns immediately without waiting for the copies to finish.
-	// In real-world use, you might want to use synchronization (like `sync.WaitGroup`)
-	// or a blocking operation to wait for these copies to finish.
+	loops LoopGroup
+}
+
+// Proxy copies between client and upstream until both directions are
+// done. It returns at once; after Shutdown it only closes the two.
+func (p *ConnProxy) Proxy(client, upstream net.Conn) {
+	started := p.loops.Go(func(ctx context.Context) {
+		defer client.Close()
+		defer upstream.Close()
+		pipeConns(ctx, client, upstream, p.Counter)
+	})
+	if !started {
+		_ = client.Close()
+		_ = upstream.Close()
+	}
+}
 
-	return nil
+// Shutdown closes the proxied connections and waits for their copies
+// to return, giving up when ctx is done
+func (p *ConnProxy) Shutdown(ctx context.Context) error {
+	return p.loops.Shutdown(ctx)
 }
 
 // proxy copies data from an io.Reader (`from`) to an io.Writer (`to`) with optional bi-directional support.
 // If `from` also implements `io.Writer` and `to` implements `io.Reader`, it sets up reverse communication
 // as well using a goroutine.
 func proxy(from io.Reader, to io.Writer) error {
+	return proxyWithCounter(from, to, nil)
+}
+
+// proxyWithCounter works like proxy and also reports the bytes it copies
+// to counter: data from `from` to `to` counts as Outbound, data coming
+// back from `to` counts as Inbound. A nil counter disables accounting.
+func proxyWithCounter(from io.Reader, to io.Writer, counter Counter) error {
 	// Check if `from` can also be written to (used for reverse copy)
 	fromWriter, fromIsWriter := from.(io.Writer)
 	// Check if `to` can also be read from (used for reverse copy)
@@ -56,12 +87,12 @@ func proxy(from io.Reader, to io.Writer) error {
 	if toIsReader && fromIsWriter {
 		// If both directions are supported, copy data from `to` back to `from`
 		go func() {
-			_, _ = io.Copy(fromWriter, toReader)
+			_, _ = io.Copy(fromWriter, countingReader{toReader, counter, Inbound})
 		}()
 	}
 
 	// Main data transfer: copy from `from` to `to`
-	_, err := io.Copy(to, from)
+	_, err := io.Copy(to, countingReader{from, counter, Outbound})
 	return err
 }
 
@@ -71,10 +102,7 @@ func TestProxy(t *testing.T) {
 	// server listens for a "ping" message and responds with a
 	// "pong" message. All other messages are echoed back to
 	// the client
-	server, err := net.Listen("tcp", "127.0.0.1:")
-	if err != nil {
-		t.Fatal(err)
-	}
+	server := testListener(t)
 
 	wg.Add(1)
 
@@ -94,7 +122,7 @@ func TestProxy(t *testing.T) {
 					buf := make([]byte, 1024)
 					n, err := c.Read(buf)
 					if err != nil {
-						if err != io.EOF {
+						if !errors.Is(err, io.EOF) {
 							t.Error(err)
 						}
 
@@ -109,7 +137,7 @@ func TestProxy(t *testing.T) {
 					}
 
 					if err != nil {
-						if err != io.EOF {
+						if !errors.Is(err, io.EOF) {
 							t.Error(err)
 						}
 
@@ -123,10 +151,7 @@ func TestProxy(t *testing.T) {
 	// proxyServer proxies messages from client connections to the
 	// destinationServer. Replies from the destinationServer are proxied
 	// back to the clients.
-	proxyServer, err := net.Listen("tcp", "127.0.0.1:")
-	if err != nil {
-		t.Fatal(err)
-	}
+	proxyServer := testListener(t)
 
 	wg.Add(1)
 
@@ -151,7 +176,7 @@ func TestProxy(t *testing.T) {
 				defer to.Close()
 
 				err = proxy(from, to)
-				if err != nil && err != io.EOF {
+				if err != nil && !errors.Is(err, io.EOF) {
 					t.Error(err)
 				}
 			}(conn)
@@ -194,3 +219,91 @@ func TestProxy(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestConnProxyShutdown(t *testing.T) {
+	var p ConnProxy
+
+	// Two pairs: the proxy sits between client and upstream
+	client, proxyClient := MemPipe()
+	proxyUpstream, upstream := MemPipe()
+	p.Proxy(proxyClient, proxyUpstream)
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := ReadExactly(upstream, 4); err != nil || string(msg) != "ping" {
+		t.Fatalf("unexpected read %q, %v", msg, err)
+	}
+
+	// Nobody hung up, Shutdown has to cut both sides off
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("copies didn't return: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); !IsClosed(err) {
+		t.Errorf("expected the client cut off; actual: %v", err)
+	}
+	if _, err := upstream.Read(make([]byte, 1)); !IsClosed(err) {
+		t.Errorf("expected the upstream cut off; actual: %v", err)
+	}
+
+	// Too late to start another pair
+	late, lateServer := MemPipe()
+	p.Proxy(lateServer, late)
+	if _, err := late.Write([]byte("x")); err == nil {
+		t.Error("expected a pair proxied after Shutdown to be closed")
+	}
+}
+
+// BenchmarkProxy pushes 1 MB per iteration from a client through proxy
+// to a server, all over loopback, and waits for the server to have it
+// all
+func BenchmarkProxy(b *testing.B) {
+	server := testListener(b)
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+
+	proxyListener := testListener(b)
+	go func() {
+		conn, err := proxyListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		upstream, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		_ = proxy(conn, upstream)
+	}()
+
+	client, err := net.Dial("tcp", proxyListener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	chunk := make([]byte, 1<<20)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	_ = client.(*net.TCPConn).CloseWrite()
+	if n := <-received; n != int64(b.N)*int64(len(chunk)) {
+		b.Fatalf("expected %d bytes through the proxy; actual: %d", b.N*len(chunk), n)
+	}
+}
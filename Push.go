@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Server push over HTTP: Server-Sent Events and long polling
+//
+// HTTP is request/response, the client always asks first. To push
+// events, the server can simply never finish the response. With
+// Server-Sent Events (the EventSource API in browsers) it streams text
+// like this:
+//
+//	retry: 1000
+//
+//	id: 1
+//	event: price
+//	data: {"symbol":"GOOG","price":101.5}
+//
+//	: ping
+//
+// An event is a group of "field: value" lines ending with a blank line;
+// lines starting with ":" are comments. The server sends a comment every
+// now and then, driven by the same Pinger as the TCP heartbeats: proxies
+// and NATs drop connections that stay quiet too long, and a failing
+// write tells the server the client is gone.
+//
+// Connections drop, so every event carries an id. A reconnecting client
+// sends the last one it saw in the Last-Event-ID header and the broker
+// replays what it missed from its history. "retry" tells clients how
+// long to wait before reconnecting. A subscriber too slow to keep up is
+// disconnected rather than holding everyone back; it catches up from the
+// history when it reconnects.
+//
+// Long polling is the fallback for clients that can't stream: GET
+// /poll?after=<id> returns the newer events right away, or waits until
+// one arrives (204 No Content after PollTimeout).
+//
+// Streams never go idle, so http.Server.Shutdown would wait for them
+// until its deadline. Register the broker's Close to end them:
+//
+//	srv.RegisterOnShutdown(broker.Close)
+
+const (
+	defaultSSEHistory     = 256
+	defaultSSEHeartbeat   = 15 * time.Second
+	defaultSSERetry       = time.Second
+	defaultPollTimeout    = 30 * time.Second
+	sseSubscriberBuffer   = 64
+	sseMaxLineLength      = 64 << 10
+	sseHeartbeatComment   = ": ping\n\n"
+	sseDefaultEventType   = "message"
+	sseLastEventIDHeader  = "Last-Event-ID"
+	sseContentType        = "text/event-stream"
+	ssePollAfterParameter = "after"
+)
+
+// ErrBrokerClosed is returned when publishing to a closed broker
+var ErrBrokerClosed = errors.New("push: broker closed")
+
+// SSEEvent is a pushed event
+type SSEEvent struct {
+	ID    string `json:"id"`
+	Event string `json:"event,omitempty"` // Defaults to "message"
+	Data  string `json:"data"`
+
+	seq uint64
+}
+
+// WriteTo writes the event in the text/event-stream format
+func (e SSEEvent) WriteTo(w io.Writer) (int64, error) {
+	b := new(strings.Builder)
+	if e.ID != "" {
+		fmt.Fprintf(b, "id: %s\n", e.ID)
+	}
+	if e.Event != "" {
+		fmt.Fprintf(b, "event: %s\n", e.Event)
+	}
+	// Multi-line data goes out as one data field per line
+	for _, line := range strings.Split(e.Data, "\n") {
+		fmt.Fprintf(b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+
+	n, err := io.WriteString(w, b.String())
+
+	return int64(n), err
+}
+
+// SSEBroker fans events out to SSE streams and long polls
+type SSEBroker struct {
+	History     int           // Events kept for replay (defaults to 256)
+	Heartbeat   time.Duration // Between heartbeat comments (defaults to 15s)
+	Retry       time.Duration // Reconnect delay advertised to clients (1s)
+	PollTimeout time.Duration // How long a long poll waits (30s)
+
+	mu      sync.Mutex
+	seq     uint64
+	history []SSEEvent
+	subs    map[chan SSEEvent]struct{}
+	changed chan struct{} // Closed and replaced on every Publish
+	closed  bool
+	done    chan struct{}
+}
+
+func (b *SSEBroker) init() {
+	if b.subs == nil {
+		b.subs = make(map[chan SSEEvent]struct{})
+		b.changed = make(chan struct{})
+		b.done = make(chan struct{})
+	}
+}
+
+// Publish sends an event to all subscribers and returns its id
+func (b *SSEBroker) Publish(event, data string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.init()
+	if b.closed {
+		return "", ErrBrokerClosed
+	}
+
+	b.seq++
+	e := SSEEvent{ID: strconv.FormatUint(b.seq, 10), Event: event, Data: data, seq: b.seq}
+
+	limit := b.History
+	if limit <= 0 {
+		limit = defaultSSEHistory
+	}
+	b.history = append(b.history, e)
+	if len(b.history) > limit {
+		b.history = b.history[len(b.history)-limit:]
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// Too slow; it reconnects and catches up from the history
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+
+	return e.ID, nil
+}
+
+// Close ends all streams and long polls
+func (b *SSEBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.init()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	close(b.done)
+}
+
+// since returns the events after id, mu must be held
+func (b *SSEBroker) since(id uint64) []SSEEvent {
+	for i, e := range b.history {
+		if e.seq > id {
+			return append([]SSEEvent(nil), b.history[i:]...)
+		}
+	}
+
+	return nil
+}
+
+// subscribe returns the events after lastID and a channel for the next
+// ones, atomically so nothing falls in between
+func (b *SSEBroker) subscribe(lastID uint64) ([]SSEEvent, chan SSEEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.init()
+	if b.closed {
+		return nil, nil, false
+	}
+
+	ch := make(chan SSEEvent, sseSubscriberBuffer)
+	b.subs[ch] = struct{}{}
+
+	return b.since(lastID), ch, true
+}
+
+func (b *SSEBroker) unsubscribe(ch chan SSEEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// parseEventID parses an id we handed out; anything else means "from
+// the start of the history"
+func parseEventID(s string) uint64 {
+	id, _ := strconv.ParseUint(s, 10, 64)
+	return id
+}
+
+// ServeHTTP streams events as text/event-stream
+func (b *SSEBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	missed, ch, ok := b.subscribe(parseEventID(r.Header.Get(sseLastEventIDHeader)))
+	if !ok {
+		// Shutting down; clients retry, hopefully against our successor
+		http.Error(w, ErrBrokerClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer b.unsubscribe(ch)
+
+	rc := http.NewResponseController(w)
+	// The stream outlives any WriteTimeout of the server
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", sseContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Tell nginx not to buffer
+	w.WriteHeader(http.StatusOK)
+
+	// Heartbeats and events share the response
+	stream := &sseStream{w: w, rc: rc}
+
+	retry := b.Retry
+	if retry <= 0 {
+		retry = defaultSSERetry
+	}
+	if err := stream.write(fmt.Sprintf("retry: %d\n\n", retry.Milliseconds())); err != nil {
+		return
+	}
+	for _, e := range missed {
+		if err := stream.event(e); err != nil {
+			return
+		}
+	}
+
+	heartbeat := b.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = defaultSSEHeartbeat
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	reset := make(chan time.Duration, 1)
+	reset <- heartbeat
+	pingerDone := make(chan struct{})
+	go func() {
+		defer close(pingerDone)
+		Pinger(ctx, stream, reset)
+	}()
+	// The Pinger must be gone before the handler returns, writing to
+	// the ResponseWriter after that is not allowed
+	defer func() {
+		cancel()
+		<-pingerDone
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.done:
+			return
+		case e, ok := <-ch:
+			if !ok {
+				// Dropped for being slow
+				return
+			}
+			if err := stream.event(e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sseStream serializes writes to an event stream. Its Write is the
+// heartbeat: Pinger writes "ping", the client gets a comment.
+type sseStream struct {
+	mu sync.Mutex
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (s *sseStream) write(text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := io.WriteString(s.w, text); err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+func (s *sseStream) event(e SSEEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := e.WriteTo(s.w); err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+func (s *sseStream) Write(p []byte) (int, error) {
+	if err := s.write(sseHeartbeatComment); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Poll is the long polling handler: GET ?after=<id> returns a JSON array
+// of the events after id, waiting for one if there are none yet. Without
+// "after", it waits for the next event.
+func (b *SSEBroker) Poll(w http.ResponseWriter, r *http.Request) {
+	timeout := b.PollTimeout
+	if timeout <= 0 {
+		timeout = defaultPollTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	b.mu.Lock()
+	b.init()
+	after := b.seq
+	b.mu.Unlock()
+	if s := r.URL.Query().Get(ssePollAfterParameter); s != "" {
+		after = parseEventID(s)
+	}
+
+	for {
+		b.mu.Lock()
+		events, changed, closed := b.since(after), b.changed, b.closed
+		b.mu.Unlock()
+
+		if len(events) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(events)
+			return
+		}
+		if closed {
+			http.Error(w, ErrBrokerClosed.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-b.done:
+		case <-timer.C:
+			// Nothing happened, the client polls again
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// SSEClient subscribes to an event stream, reconnecting as needed
+type SSEClient struct {
+	Client *http.Client // Defaults to http.DefaultClient
+
+	// LastEventID is the id of the last event received; set it to
+	// resume a previous subscription
+	LastEventID string
+
+	// Retry is the reconnect delay until the server sends its own
+	Retry time.Duration
+}
+
+// Subscribe calls handle for every event from url until ctx is done or
+// the server answers 204 No Content. Dropped connections and 5xx
+// responses are retried after the server's retry delay.
+func (c *SSEClient) Subscribe(ctx context.Context, url string, handle func(SSEEvent)) error {
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if c.Retry <= 0 {
+		c.Retry = defaultSSERetry
+	}
+
+	for {
+		done, err := c.stream(ctx, client, url, handle)
+		if done || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.Retry):
+		}
+	}
+}
+
+// stream reads one connection's worth of events. done reports that
+// reconnecting makes no sense.
+func (c *SSEClient) stream(ctx context.Context, client *http.Client, url string, handle func(SSEEvent)) (done bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Accept", sseContentType)
+	if c.LastEventID != "" {
+		req.Header.Set(sseLastEventIDHeader, c.LastEventID)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return ctx.Err() != nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return true, nil
+	case resp.StatusCode >= 500:
+		return false, fmt.Errorf("push: %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return true, fmt.Errorf("push: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 4096), sseMaxLineLength)
+
+	var event SSEEvent
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			// Dispatch
+			if data != nil {
+				event.ID = c.LastEventID
+				event.Data = strings.Join(data, "\n")
+				if event.Event == "" {
+					event.Event = sseDefaultEventType
+				}
+				handle(event)
+			}
+			event, data = SSEEvent{}, nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// Comment, e.g. a heartbeat
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				c.LastEventID = value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				c.Retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// startSSEServer serves the broker at /events and /poll
+func startSSEServer(t *testing.T, b *SSEBroker, wrap func(http.Handler) http.Handler) (string, context.CancelFunc, <-chan error) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /events", wrap(b))
+	mux.HandleFunc("GET /poll", b.Poll)
+
+	srv := NewHTTPServer("", mux)
+	srv.RegisterOnShutdown(b.Close)
+
+	l := testListener(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- ServeHTTP(ctx, srv, l) }()
+	t.Cleanup(cancel)
+
+	return "http://" + l.Addr().String(), cancel, served
+}
+
+func TestSSE(t *testing.T) {
+	b := &SSEBroker{Heartbeat: 20 * time.Millisecond}
+	url, shutdown, served := startSSEServer(t, b, func(h http.Handler) http.Handler { return h })
+
+	// Raw stream: retry field, events and heartbeats
+	resp, err := http.Get(url + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != sseContentType {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	_, _ = b.Publish("greeting", "hello\nworld")
+	r := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 10 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+		if line == ": ping\n" {
+			break
+		}
+	}
+	stream := strings.Join(lines, "|")
+	if !strings.HasPrefix(stream, "retry: 1000||id: 1|event: greeting|data: hello|data: world||") ||
+		!strings.HasSuffix(stream, ": ping") {
+		t.Errorf("unexpected stream %q", stream)
+	}
+
+	// Shutting down ends the stream instead of waiting for it
+	begin := time.Now()
+	shutdown()
+	if err := <-served; err != nil {
+		t.Errorf("expected clean shutdown; actual: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+	if _, err := b.Publish("late", "x"); !errors.Is(err, ErrBrokerClosed) {
+		t.Errorf("expected closed broker; actual: %v", err)
+	}
+}
+
+func TestSSEReconnect(t *testing.T) {
+	b := &SSEBroker{Retry: 10 * time.Millisecond}
+
+	// The first connection can be cut from the test; every request's
+	// Last-Event-ID is recorded
+	var (
+		mu        sync.Mutex
+		cutFirst  context.CancelFunc
+		requested []string
+		first     atomic.Bool
+	)
+	wrap := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requested = append(requested, r.Header.Get(sseLastEventIDHeader))
+			ctx := r.Context()
+			if !first.Swap(true) {
+				ctx, cutFirst = context.WithCancel(ctx)
+			}
+			mu.Unlock()
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+	url, _, _ := startSSEServer(t, b, wrap)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	events := make(chan SSEEvent, 10)
+	client := &SSEClient{}
+	go func() { _ = client.Subscribe(ctx, url+"/events", func(e SSEEvent) { events <- e }) }()
+
+	// Wait for the subscription, then publish the first event
+	for {
+		b.mu.Lock()
+		n := len(b.subs)
+		b.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	_, _ = b.Publish("", "one")
+	if e := <-events; e.ID != "1" || e.Data != "one" || e.Event != "message" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// Drop the connection and publish while the client is away
+	mu.Lock()
+	cutFirst()
+	mu.Unlock()
+	_, _ = b.Publish("", "two")
+	_, _ = b.Publish("", "three")
+
+	// The client comes back and gets what it missed, in order
+	for _, want := range []string{"two", "three"} {
+		select {
+		case e := <-events:
+			if e.Data != want {
+				t.Errorf("expected %q; actual: %+v", want, e)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for replay")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requested) < 2 || requested[0] != "" || requested[1] != "1" {
+		t.Errorf("unexpected Last-Event-ID headers %q", requested)
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	b := &SSEBroker{PollTimeout: 50 * time.Millisecond}
+	url, _, _ := startSSEServer(t, b, func(h http.Handler) http.Handler { return h })
+
+	poll := func(query string) (int, []SSEEvent) {
+		t.Helper()
+		resp, err := http.Get(url + "/poll" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var events []SSEEvent
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, events
+	}
+
+	// Nothing new: 204 after the timeout
+	if status, _ := poll(""); status != http.StatusNoContent {
+		t.Errorf("expected 204; actual: %d", status)
+	}
+
+	// Old events come right away
+	_, _ = b.Publish("", "one")
+	_, _ = b.Publish("", "two")
+	if status, events := poll("?after=1"); status != http.StatusOK || len(events) != 1 || events[0].Data != "two" {
+		t.Errorf("unexpected poll result %d %+v", status, events)
+	}
+
+	// A poll waits for the next event
+	b.PollTimeout = time.Second
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_, _ = b.Publish("", "three")
+	}()
+	if status, events := poll("?after=2"); status != http.StatusOK || len(events) != 1 || events[0].ID != "3" {
+		t.Errorf("unexpected poll result %d %+v", status, events)
+	}
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RPC over the TLV mux
+//
+// With streams multiplexed on one connection, each call gets a stream of
+// its own, gRPC style. The client opens a stream and sends a Control
+// frame naming the method and its deadline:
+//
+//	call Arith.Add 1718000000123456789
+//
+// followed by the request messages (JSON in Binary frames) and a FIN.
+// The server answers with the response messages and a final status:
+//
+//	status 0
+//	status 4 context deadline exceeded
+//
+// The deadline travels as an absolute time (0 for none), so the server
+// stops working on a call the client already gave up on. Clock skew
+// between the machines shifts it; gRPC sends a relative timeout instead
+// for that reason. A client that cancels resets the stream, which
+// cancels the server's context too.
+//
+// Services are plain Go values. Register finds their methods by
+// reflection, no code generation needed:
+//
+//	func (s *Arith) Add(ctx context.Context, req *AddRequest) (*AddReply, error)
+//	func (s *Arith) Sum(ctx context.Context, stream *RPCStream) error
+//
+// The first form is a unary call; the second reads and writes any
+// number of messages on the stream, covering client, server and
+// bidirectional streaming alike.
+
+// RPC status codes, numbered like gRPC's
+const (
+	RPCOK               = 0
+	RPCCanceled         = 1
+	RPCUnknown          = 2
+	RPCInvalidArgument  = 3
+	RPCDeadlineExceeded = 4
+	RPCUnimplemented    = 12
+	RPCInternal         = 13
+	RPCUnavailable      = 14
+)
+
+const (
+	rpcCall   = "call"
+	rpcStatus = "status"
+)
+
+var (
+	rpcContextType = reflect.TypeFor[context.Context]()
+	rpcErrorType   = reflect.TypeFor[error]()
+	rpcStreamType  = reflect.TypeFor[*RPCStream]()
+)
+
+// RPCError is a call's failure status
+type RPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// rpcErrorf builds an RPCError, for handlers to return
+func rpcErrorf(code int, format string, v ...any) error {
+	return &RPCError{Code: code, Message: fmt.Sprintf(format, v...)}
+}
+
+// rpcStatusOf maps an error to a status
+func rpcStatusOf(err error) *RPCError {
+	var rpcErr *RPCError
+	switch {
+	case err == nil:
+		return &RPCError{Code: RPCOK}
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.Is(err, context.DeadlineExceeded):
+		return &RPCError{Code: RPCDeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &RPCError{Code: RPCCanceled, Message: err.Error()}
+	default:
+		return &RPCError{Code: RPCUnknown, Message: err.Error()}
+	}
+}
+
+// RPCStream carries the messages of one call
+type RPCStream struct {
+	s   *MuxStream
+	ctx context.Context
+
+	// Set on the client side once the status arrived
+	status *RPCError
+}
+
+// Context returns the call's context
+func (st *RPCStream) Context() context.Context {
+	return st.ctx
+}
+
+// Send sends a message
+func (st *RPCStream) Send(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return st.write(Binary(b))
+}
+
+// write sends a frame in a single stream write
+func (st *RPCStream) write(p io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		return err
+	}
+	_, err := st.s.Write(buf.Bytes())
+
+	return err
+}
+
+// CloseSend tells the peer no more messages follow
+func (st *RPCStream) CloseSend() error {
+	return st.s.CloseWrite()
+}
+
+// Recv reads the next message into v. It returns io.EOF when the peer
+// is done sending: on the server, after the client's CloseSend; on the
+// client, after a successful status. A failed call returns *RPCError.
+func (st *RPCStream) Recv(v any) error {
+	if st.status != nil {
+		return st.result()
+	}
+
+	p, err := decode(st.s)
+	if err != nil {
+		if err == io.EOF && st.ctx.Err() == nil {
+			return io.EOF
+		}
+		return st.fail(err)
+	}
+
+	switch p := p.(type) {
+	case *Binary:
+		if err := json.Unmarshal(p.Bytes(), v); err != nil {
+			return &RPCError{Code: RPCInvalidArgument, Message: err.Error()}
+		}
+		return nil
+	case *Control:
+		status, err := parseRPCStatus(p.String())
+		if err != nil {
+			return st.fail(err)
+		}
+		// The status is the last frame of a call
+		st.status = status
+		_ = st.s.Close()
+		return st.result()
+	default:
+		return st.fail(fmt.Errorf("rpc: unexpected %T frame", p))
+	}
+}
+
+func (st *RPCStream) result() error {
+	if st.status.Code == RPCOK {
+		return io.EOF
+	}
+
+	return st.status
+}
+
+// fail reports a broken stream, preferring the context's reason
+func (st *RPCStream) fail(err error) error {
+	if ctxErr := st.ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+
+	return rpcStatusOf(err)
+}
+
+func parseRPCStatus(s string) (*RPCError, error) {
+	fields := strings.SplitN(s, " ", 3)
+	if len(fields) < 2 || fields[0] != rpcStatus {
+		return nil, ErrUnexpectedControl
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, ErrUnexpectedControl
+	}
+	status := &RPCError{Code: code}
+	if len(fields) == 3 {
+		status.Message = fields[2]
+	}
+
+	return status, nil
+}
+
+// rpcMethod is a registered method
+type rpcMethod struct {
+	fn     reflect.Value // Bound to the receiver
+	req    reflect.Type  // Request type, nil for streaming methods
+	stream bool
+}
+
+// RPCServer dispatches calls to registered services
+type RPCServer struct {
+	// ErrorLog receives connection errors
+	ErrorLog *log.Logger
+
+	mu      sync.RWMutex
+	methods map[string]rpcMethod
+}
+
+// NewRPCServer returns a server with no services
+func NewRPCServer() *RPCServer {
+	return &RPCServer{methods: make(map[string]rpcMethod)}
+}
+
+func (s *RPCServer) logf(format string, v ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Register exposes rcvr's methods of either RPC form as name.Method.
+// Other methods are ignored; it's an error if none qualify.
+func (s *RPCServer) Register(name string, rcvr any) error {
+	v := reflect.ValueOf(rcvr)
+	t := v.Type()
+
+	methods := make(map[string]rpcMethod)
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		ft := m.Type // Receiver is the first argument
+		if ft.NumIn() != 3 || ft.In(1) != rpcContextType {
+			continue
+		}
+
+		switch {
+		case ft.In(2) == rpcStreamType && ft.NumOut() == 1 && ft.Out(0) == rpcErrorType:
+			methods[name+"."+m.Name] = rpcMethod{fn: v.Method(i), stream: true}
+		case ft.In(2).Kind() == reflect.Pointer && ft.NumOut() == 2 && ft.Out(1) == rpcErrorType:
+			methods[name+"."+m.Name] = rpcMethod{fn: v.Method(i), req: ft.In(2).Elem()}
+		}
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("rpc: %s (%s) has no suitable methods", name, t)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, m := range methods {
+		if _, ok := s.methods[k]; ok {
+			return fmt.Errorf("rpc: %s already registered", k)
+		}
+		s.methods[k] = m
+	}
+
+	return nil
+}
+
+// ServeConn serves calls on conn until it closes; it's a ConnHandler
+func (s *RPCServer) ServeConn(ctx context.Context, conn net.Conn) {
+	m := NewMux(conn, false)
+	defer m.Close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = m.Close()
+		case <-m.Done():
+		}
+	}()
+
+	for {
+		stream, err := m.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveStream(ctx, stream)
+	}
+}
+
+func (s *RPCServer) serveStream(ctx context.Context, stream *MuxStream) {
+	defer stream.Close()
+
+	p, err := decode(stream)
+	if err != nil {
+		return
+	}
+	call, ok := p.(*Control)
+	if !ok {
+		return
+	}
+
+	st := &RPCStream{s: stream}
+	name, deadline, err := parseRPCCall(call.String())
+	if err != nil {
+		s.writeStatus(st, rpcStatusOf(err))
+		return
+	}
+
+	var cancel context.CancelFunc
+	if deadline.IsZero() {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+	defer cancel()
+	st.ctx = ctx
+
+	// A reset from the client cancels the call
+	go func() {
+		select {
+		case <-stream.resetCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	s.mu.RLock()
+	method, ok := s.methods[name]
+	s.mu.RUnlock()
+	if !ok {
+		s.writeStatus(st, &RPCError{Code: RPCUnimplemented, Message: "unknown method " + name})
+		return
+	}
+
+	s.writeStatus(st, rpcStatusOf(s.invoke(st, method)))
+}
+
+func (s *RPCServer) invoke(st *RPCStream, method rpcMethod) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("rpc: panic: %v", r)
+			err = &RPCError{Code: RPCInternal, Message: "internal error"}
+		}
+	}()
+
+	if method.stream {
+		out := method.fn.Call([]reflect.Value{reflect.ValueOf(st.ctx), reflect.ValueOf(st)})
+		err, _ = out[0].Interface().(error)
+		return err
+	}
+
+	req := reflect.New(method.req)
+	if err := st.Recv(req.Interface()); err != nil {
+		if err == io.EOF {
+			return rpcErrorf(RPCInvalidArgument, "missing request")
+		}
+		return err
+	}
+
+	out := method.fn.Call([]reflect.Value{reflect.ValueOf(st.ctx), req})
+	if err, _ := out[1].Interface().(error); err != nil {
+		return err
+	}
+
+	return st.Send(out[0].Interface())
+}
+
+func (s *RPCServer) writeStatus(st *RPCStream, status *RPCError) {
+	msg := fmt.Sprintf("%s %d", rpcStatus, status.Code)
+	if status.Message != "" {
+		msg += " " + status.Message
+	}
+	if len(msg) > maxControlSize {
+		msg = msg[:maxControlSize]
+	}
+	_ = st.write(Control(msg))
+}
+
+func parseRPCCall(s string) (string, time.Time, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 || fields[0] != rpcCall {
+		return "", time.Time{}, rpcErrorf(RPCInvalidArgument, "malformed call")
+	}
+	nanos, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", time.Time{}, rpcErrorf(RPCInvalidArgument, "malformed deadline")
+	}
+	if nanos == 0 {
+		return fields[1], time.Time{}, nil
+	}
+
+	return fields[1], time.Unix(0, nanos), nil
+}
+
+// RPCClient makes calls over one multiplexed connection
+type RPCClient struct {
+	mux *Mux
+}
+
+// NewRPCClient starts a client on conn
+func NewRPCClient(conn net.Conn) *RPCClient {
+	return &RPCClient{mux: NewMux(conn, true)}
+}
+
+// Close closes the connection, failing calls in flight
+func (c *RPCClient) Close() error {
+	return c.mux.Close()
+}
+
+// Stream starts a call of method ("Service.Method"). Cancelling ctx
+// aborts it on both ends.
+func (c *RPCClient) Stream(ctx context.Context, method string) (*RPCStream, error) {
+	if strings.ContainsAny(method, " \t\n") {
+		return nil, fmt.Errorf("rpc: invalid method name %q", method)
+	}
+
+	s, err := c.mux.Open()
+	if err != nil {
+		return nil, err
+	}
+	st := &RPCStream{s: s, ctx: ctx}
+
+	var nanos int64
+	if deadline, ok := ctx.Deadline(); ok {
+		nanos = deadline.UnixNano()
+	}
+	if err := st.write(Control(fmt.Sprintf("%s %s %d", rpcCall, method, nanos))); err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Reset()
+		case <-s.closeCh:
+		case <-s.resetCh:
+		}
+	}()
+
+	return st, nil
+}
+
+// Call makes a unary call, decoding the reply into resp
+func (c *RPCClient) Call(ctx context.Context, method string, req, resp any) error {
+	st, err := c.Stream(ctx, method)
+	if err != nil {
+		return err
+	}
+	defer st.s.Close()
+
+	if err := st.Send(req); err != nil {
+		return st.fail(err)
+	}
+	_ = st.CloseSend()
+
+	if err := st.Recv(resp); err != nil {
+		if err == io.EOF {
+			return rpcErrorf(RPCInternal, "no reply")
+		}
+		return err
+	}
+	if err := st.Recv(nil); err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// Arith is the example service of the tests
+type Arith struct{}
+
+type ArithArgs struct {
+	A, B int
+}
+
+type ArithReply struct {
+	Result int
+}
+
+func (Arith) Add(_ context.Context, args *ArithArgs) (*ArithReply, error) {
+	return &ArithReply{Result: args.A + args.B}, nil
+}
+
+func (Arith) Div(_ context.Context, args *ArithArgs) (*ArithReply, error) {
+	if args.B == 0 {
+		return nil, rpcErrorf(RPCInvalidArgument, "division by zero")
+	}
+	return &ArithReply{Result: args.A / args.B}, nil
+}
+
+// Sleep waits A milliseconds, or until the call is abandoned
+func (Arith) Sleep(ctx context.Context, args *ArithArgs) (*ArithReply, error) {
+	select {
+	case <-time.After(time.Duration(args.A) * time.Millisecond):
+		return &ArithReply{}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Sum streams back the running total of the numbers it receives
+func (Arith) Sum(_ context.Context, stream *RPCStream) error {
+	var total int
+	for {
+		var n int
+		err := stream.Recv(&n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		total += n
+		if err := stream.Send(ArithReply{Result: total}); err != nil {
+			return err
+		}
+	}
+}
+
+// rpcPair returns a client connected to a server offering Arith
+func rpcPair(t *testing.T) (*RPCClient, *RPCServer) {
+	t.Helper()
+
+	server := NewRPCServer()
+	server.ErrorLog = log.New(io.Discard, "", 0)
+	if err := server.Register("Arith", Arith{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, s := tlvPair(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.ServeConn(ctx, s)
+
+	client := NewRPCClient(c)
+	t.Cleanup(func() {
+		cancel()
+		_ = client.Close()
+	})
+
+	return client, server
+}
+
+func TestRPCUnary(t *testing.T) {
+	client, server := rpcPair(t)
+	ctx := context.Background()
+
+	// Concurrent calls share the connection
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply ArithReply
+			if err := client.Call(ctx, "Arith.Add", ArithArgs{A: i, B: 2}, &reply); err != nil {
+				t.Error(err)
+				return
+			}
+			if reply.Result != i+2 {
+				t.Errorf("%d+2: expected %d; actual: %d", i, i+2, reply.Result)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Errors arrive as statuses
+	var reply ArithReply
+	err := client.Call(ctx, "Arith.Div", ArithArgs{A: 1}, &reply)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != RPCInvalidArgument || rpcErr.Message != "division by zero" {
+		t.Errorf("expected invalid argument; actual: %v", err)
+	}
+	err = client.Call(ctx, "Arith.Mul", ArithArgs{}, &reply)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != RPCUnimplemented {
+		t.Errorf("expected unimplemented; actual: %v", err)
+	}
+
+	// Values without suitable methods can't be registered
+	if err := server.Register("Nothing", struct{}{}); err == nil {
+		t.Error("expected registration to fail")
+	}
+	if err := server.Register("Arith", Arith{}); err == nil {
+		t.Error("expected duplicate registration to fail")
+	}
+}
+
+func TestRPCStream(t *testing.T) {
+	client, _ := rpcPair(t)
+
+	stream, err := client.Stream(context.Background(), "Arith.Sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bidirectional: each number sent gets the running total back
+	for i, want := range []int{1, 3, 6, 10} {
+		if err := stream.Send(i + 1); err != nil {
+			t.Fatal(err)
+		}
+		var reply ArithReply
+		if err := stream.Recv(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Result != want {
+			t.Errorf("expected %d; actual: %d", want, reply.Result)
+		}
+	}
+
+	_ = stream.CloseSend()
+	if err := stream.Recv(nil); err != io.EOF {
+		t.Errorf("expected EOF after the status; actual: %v", err)
+	}
+}
+
+func TestRPCDeadline(t *testing.T) {
+	client, _ := rpcPair(t)
+
+	// The deadline reaches the server, which gives up on its own
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	var reply ArithReply
+	err := client.Call(ctx, "Arith.Sleep", ArithArgs{A: 5000}, &reply)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != RPCDeadlineExceeded {
+		t.Errorf("expected deadline exceeded; actual: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call took %s", elapsed)
+	}
+
+	// Cancelling resets the stream; the connection stays usable
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err = client.Call(ctx, "Arith.Sleep", ArithArgs{A: 5000}, &reply)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != RPCCanceled {
+		t.Errorf("expected canceled; actual: %v", err)
+	}
+
+	if err := client.Call(context.Background(), "Arith.Add", ArithArgs{A: 1, B: 1}, &reply); err != nil || reply.Result != 2 {
+		t.Errorf("unexpected reply %v, %v", reply, err)
+	}
+}
@@ -0,0 +1,1094 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Reliable UDP
+//
+// TCP delivers everything, but on its own terms: over a lossy path
+// (wifi, mobile, a long haul on cheap links) it waits long before
+// retransmitting and halves its rate on every loss, taking losses for
+// congestion. KCP and its kind make another trade, an ARQ (automatic
+// repeat request) layer over UDP that retransmits early and doesn't
+// back off, spending bandwidth to keep latency down.
+//
+// RUDPConn is such a layer behind net.Conn, and RUDPListener behind
+// net.Listener, so what was written for TCP (TLV payloads, proxy,
+// Pinger, TCPServer) runs over it unchanged:
+//
+// - Handshake: the client picks a random connection ID and sends SYN
+//   until a SYNACK, or anything else from the server, comes back. The
+//   ID and the client's address key the connection on the listener's
+//   one socket; a new ID per connection keeps stray packets of an
+//   earlier one from the same port out.
+// - Every packet has the same header: type, ID, sequence number, the
+//   cumulative ACK (the next sequence number expected), a SACK bitmap
+//   of the 32 packets after it, and the receive window in packets.
+// - Writes are cut into packets of at most rudpMaxPayload bytes, under
+//   the usual MTU so nothing gets fragmented. The receiver ACKs every
+//   packet. One not acknowledged within the RTO, computed from the
+//   measured round trips (RFC 6298) and doubled on every retry, is sent
+//   again, and so is one that three ACKs report missing while later
+//   ones arrived. After rudpMaxRetries tries the connection fails.
+// - Flow control: no more than the window the receiver advertised,
+//   rudpWindow at most, is in flight. Write blocks meanwhile.
+// - Keepalive: an idle connection pings, and fails with ErrRUDPTimeout
+//   once nothing came back for a while (SetKeepAlive).
+// - FIN takes a sequence number like data, so it arrives after all of
+//   it: CloseWrite is a half close, and Read returns io.EOF once the
+//   peer's data is read. Close goes on in the background until what
+//   was written is acknowledged.
+// - A packet for a connection the listener doesn't know gets a RST,
+//   which fails the connection with ECONNRESET.
+//
+// What it doesn't do: congestion control beyond the window (it's for
+// paths we own, not for sharing the Internet fairly), encryption (run
+// TLS over it) or path MTU discovery.
+
+// ErrRUDPTimeout fails a connection whose peer stopped answering
+var ErrRUDPTimeout = errors.New("rudp: peer not responding")
+
+// Packet types
+const (
+	rudpSYN byte = iota + 1
+	rudpSYNACK
+	rudpData
+	rudpACK
+	rudpFIN
+	rudpPing
+	rudpRST
+)
+
+const (
+	rudpHeaderSize = 19                     // type, id, seq, ack, sack, window
+	rudpMaxPayload = 1200 - rudpHeaderSize  // Data per packet
+	rudpWindow     = 256                    // Packets in flight, or buffered by the receiver
+	rudpBacklog    = 128                    // Connections waiting for Accept
+	rudpInitialRTO = 250 * time.Millisecond // Before the first RTT sample
+	rudpMinRTO     = 30 * time.Millisecond
+	rudpMaxRTO     = 5 * time.Second
+	rudpMaxRetries = 12                     // Sends of a packet before giving up
+	rudpKeepAlive  = 5 * time.Second        // Ping after this long without sending
+	rudpTimeout    = 30 * time.Second       // Fail after this long without hearing back
+	rudpLinger     = 200 * time.Millisecond // Keep answering a peer's FIN after ours is acknowledged
+	rudpIdleWakeup = 1 * time.Minute        // Nothing to do in a failed connection
+)
+
+// rudpPacket is a decoded packet
+type rudpPacket struct {
+	typ            byte
+	id             uint32
+	seq, ack, sack uint32
+	window         uint16
+	data           []byte
+}
+
+// appendTo appends the encoded packet to b
+func (p *rudpPacket) appendTo(b []byte) []byte {
+	b = append(b, p.typ)
+	b = binary.BigEndian.AppendUint32(b, p.id)
+	b = binary.BigEndian.AppendUint32(b, p.seq)
+	b = binary.BigEndian.AppendUint32(b, p.ack)
+	b = binary.BigEndian.AppendUint32(b, p.sack)
+	b = binary.BigEndian.AppendUint16(b, p.window)
+
+	return append(b, p.data...)
+}
+
+// parseRUDPPacket decodes b, whose data the packet shares
+func parseRUDPPacket(b []byte) (rudpPacket, bool) {
+	if len(b) < rudpHeaderSize || b[0] < rudpSYN || b[0] > rudpRST {
+		return rudpPacket{}, false
+	}
+
+	return rudpPacket{
+		typ:    b[0],
+		id:     binary.BigEndian.Uint32(b[1:]),
+		seq:    binary.BigEndian.Uint32(b[5:]),
+		ack:    binary.BigEndian.Uint32(b[9:]),
+		sack:   binary.BigEndian.Uint32(b[13:]),
+		window: binary.BigEndian.Uint16(b[17:]),
+		data:   b[rudpHeaderSize:],
+	}, true
+}
+
+// seqBefore reports whether sequence number a comes before b, across
+// the wrap around
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// rudpSegment is a packet sent and not acknowledged yet
+type rudpSegment struct {
+	typ      byte // rudpSYN, rudpData or rudpFIN
+	seq      uint32
+	data     []byte
+	sent     time.Time // Last sent
+	deadline time.Time // When to send it again
+	retries  int
+}
+
+// RUDPStats counts what a connection did
+type RUDPStats struct {
+	Sent          uint64        // Data packets sent, retransmissions included
+	Retransmitted uint64        // Data packets sent again
+	Received      uint64        // Data packets received, duplicates included
+	RTT           time.Duration // Smoothed round trip time
+}
+
+// RUDPConn is a reliable connection over UDP
+type RUDPConn struct {
+	pc     net.PacketConn
+	remote net.Addr
+	id     uint32
+	done   func() // Releases the connection's share of pc
+
+	readDeadline, writeDeadline *memDeadline
+	kick                        chan struct{} // Wakes up run
+	stop                        chan struct{} // Ends run
+
+	mu          sync.Mutex
+	changed     chan struct{} // Closed and replaced on every change
+	established bool
+	err         error // Why the connection failed
+	closed      bool  // Close was called
+	finished    bool  // Nothing left to do
+	stats       RUDPStats
+	buf         []byte // For encoding packets
+
+	// Sending
+	sndNext           uint32
+	inflight          []*rudpSegment // By sequence number
+	peerAck           uint32         // Highest cumulative ACK received
+	peerLimit         uint32         // Sequence numbers before it fit the peer's window
+	dupAcks           int
+	srtt, rttvar, rto time.Duration
+	wclosed           bool // FIN queued
+	finAcked          time.Time
+	lastSent          time.Time
+
+	// Receiving
+	rcvNext    uint32
+	outOfOrder map[uint32]rudpPacket
+	queue      [][]byte // In order, not read yet
+	rclosed    bool     // FIN received
+	advertised int      // Last window sent
+	lastRecv   time.Time
+
+	keepAlive, timeout time.Duration
+}
+
+func newRUDPConn(pc net.PacketConn, remote net.Addr, id uint32) *RUDPConn {
+	now := time.Now()
+	c := &RUDPConn{
+		pc:            pc,
+		remote:        remote,
+		id:            id,
+		readDeadline:  newMemDeadline(),
+		writeDeadline: newMemDeadline(),
+		kick:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		changed:       make(chan struct{}),
+		peerLimit:     rudpWindow,
+		rto:           rudpInitialRTO,
+		outOfOrder:    make(map[uint32]rudpPacket),
+		advertised:    rudpWindow,
+		lastSent:      now,
+		lastRecv:      now,
+		keepAlive:     rudpKeepAlive,
+		timeout:       rudpTimeout,
+	}
+	go c.run()
+
+	return c
+}
+
+// DialRUDP connects to a RUDPListener at addr, from a socket of its own
+func DialRUDP(ctx context.Context, addr string) (*RUDPConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+
+	return DialRUDPPacketConn(ctx, pc, raddr)
+}
+
+// DialRUDPPacketConn connects to a RUDPListener at raddr over pc, which
+// the connection then owns
+func DialRUDPPacketConn(ctx context.Context, pc net.PacketConn, raddr net.Addr) (*RUDPConn, error) {
+	c := newRUDPConn(pc, raddr, rand.Uint32())
+	c.done = func() { _ = pc.Close() }
+	go c.readLoop()
+
+	c.mu.Lock()
+	c.queueSegment(rudpSYN, nil)
+	for !c.established && c.err == nil {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			c.abort(ctx.Err())
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		c.abort(err)
+		return nil, c.opError("dial", err)
+	}
+
+	return c, nil
+}
+
+// readLoop feeds a dialed connection the packets of its socket
+func (c *RUDPConn) readLoop() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := c.pc.ReadFrom(buf)
+		if err != nil {
+			c.mu.Lock()
+			c.fail(err)
+			c.mu.Unlock()
+			return
+		}
+		p, ok := parseRUDPPacket(buf[:n])
+		if !ok || p.id != c.id || addr.String() != c.remote.String() {
+			continue
+		}
+		c.handle(p)
+	}
+}
+
+func (c *RUDPConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "rudp", Source: c.pc.LocalAddr(), Addr: c.remote, Err: err}
+}
+
+// signal wakes up the waiters; c.mu is held
+func (c *RUDPConn) signal() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wake has run look at the timers again
+func (c *RUDPConn) wake() {
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+// window is how many more packets the receiving side takes; c.mu is
+// held
+func (c *RUDPConn) window() int {
+	return max(rudpWindow-len(c.queue), 0)
+}
+
+// send sends a packet with the current ACK; c.mu is held
+func (c *RUDPConn) send(p rudpPacket) {
+	p.id = c.id
+	p.ack = c.rcvNext
+	for i := uint32(0); i < 32; i++ {
+		if _, ok := c.outOfOrder[c.rcvNext+1+i]; ok {
+			p.sack |= 1 << i
+		}
+	}
+	c.advertised = c.window()
+	p.window = uint16(c.advertised)
+
+	c.buf = p.appendTo(c.buf[:0])
+	// A failed send is a lost packet, retransmission takes care of it
+	_, _ = c.pc.WriteTo(c.buf, c.remote)
+	c.lastSent = time.Now()
+}
+
+// queueSegment sends a packet taking a sequence number, and keeps it
+// until it's acknowledged; c.mu is held
+func (c *RUDPConn) queueSegment(typ byte, data []byte) {
+	seg := &rudpSegment{typ: typ, seq: c.sndNext, data: data}
+	c.sndNext++
+	c.inflight = append(c.inflight, seg)
+	c.sendSegment(seg)
+	c.wake()
+}
+
+// sendSegment sends seg, again if it was sent before; c.mu is held
+func (c *RUDPConn) sendSegment(seg *rudpSegment) {
+	if !seg.sent.IsZero() {
+		seg.retries++
+		c.stats.Retransmitted++
+	}
+	seg.sent = time.Now()
+	seg.deadline = seg.sent.Add(min(c.rto<<seg.retries, rudpMaxRTO))
+	c.stats.Sent++
+	c.send(rudpPacket{typ: seg.typ, seq: seg.seq, data: seg.data})
+}
+
+// handle processes a packet from the peer
+func (c *RUDPConn) handle(p rudpPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished {
+		return
+	}
+	c.lastRecv = time.Now()
+
+	if p.typ == rudpRST {
+		// Whatever was received in order is still read first
+		c.fail(syscall.ECONNRESET)
+		return
+	}
+	if !c.established && (p.typ == rudpSYNACK || !seqBefore(p.ack, 1)) {
+		c.established = true
+	}
+	if p.typ != rudpSYN {
+		c.acknowledged(p.ack, p.sack, p.window)
+	}
+
+	switch p.typ {
+	case rudpSYN:
+		// The first SYN, or a retransmission whose SYNACK was lost
+		c.send(rudpPacket{typ: rudpSYNACK})
+	case rudpData, rudpFIN:
+		c.stats.Received++
+		c.receive(p)
+		c.send(rudpPacket{typ: rudpACK})
+	case rudpPing:
+		c.send(rudpPacket{typ: rudpACK})
+	}
+	c.signal()
+	c.wake()
+	c.maybeFinish()
+}
+
+// acknowledged drops the segments the peer has; c.mu is held
+func (c *RUDPConn) acknowledged(ack, sack uint32, window uint16) {
+	if seqBefore(ack, c.peerAck) {
+		return // Reordered, older than what we know
+	}
+	progress := ack != c.peerAck
+	c.peerAck = ack
+	c.peerLimit = ack + uint32(window)
+
+	now := time.Now()
+	kept := c.inflight[:0]
+	for _, seg := range c.inflight {
+		offset := seg.seq - ack - 1
+		switch {
+		case seqBefore(seg.seq, ack):
+		case seg.seq != ack && offset < 32 && sack&(1<<offset) != 0:
+		default:
+			kept = append(kept, seg)
+			continue
+		}
+		// Karn: a retransmitted segment's ACK may be for any copy
+		if seg.retries == 0 {
+			c.sampleRTT(now.Sub(seg.sent))
+		}
+		if seg.typ == rudpFIN {
+			c.finAcked = now
+		}
+	}
+	clear(c.inflight[len(kept):])
+	c.inflight = kept
+
+	// Three ACKs showing later packets but not the first missing one:
+	// it's lost, don't wait for its RTO
+	if progress || sack == 0 {
+		c.dupAcks = 0
+		return
+	}
+	c.dupAcks++
+	if c.dupAcks == 3 && len(c.inflight) > 0 && c.inflight[0].seq == ack {
+		c.sendSegment(c.inflight[0])
+	}
+}
+
+// sampleRTT updates the RTO with a round trip, RFC 6298; c.mu is held
+func (c *RUDPConn) sampleRTT(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = rtt, rtt/2
+	} else {
+		c.rttvar = (3*c.rttvar + (c.srtt - rtt).Abs()) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = min(max(c.srtt+max(4*c.rttvar, 10*time.Millisecond), rudpMinRTO), rudpMaxRTO)
+	c.stats.RTT = c.srtt
+}
+
+// receive queues a data or FIN packet, in order; c.mu is held
+func (c *RUDPConn) receive(p rudpPacket) {
+	if seqBefore(p.seq, c.rcvNext) || p.seq-c.rcvNext >= uint32(c.window()) {
+		return // A duplicate, or beyond the window
+	}
+	if _, ok := c.outOfOrder[p.seq]; ok {
+		return
+	}
+	// p.data belongs to the read buffer
+	p.data = bytes.Clone(p.data)
+	c.outOfOrder[p.seq] = p
+
+	for {
+		next, ok := c.outOfOrder[c.rcvNext]
+		if !ok {
+			return
+		}
+		delete(c.outOfOrder, c.rcvNext)
+		c.rcvNext++
+		if next.typ == rudpFIN {
+			c.rclosed = true
+		} else if !c.closed && len(next.data) > 0 {
+			c.queue = append(c.queue, next.data)
+		}
+	}
+}
+
+// fail ends the connection with err; c.mu is held
+func (c *RUDPConn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.inflight = nil
+	c.signal()
+	c.maybeFinish()
+}
+
+// maybeFinish releases the connection once closed and done: everything
+// we sent acknowledged and the peer's FIN had a chance to be ACKed, or
+// failed; c.mu is held
+func (c *RUDPConn) maybeFinish() {
+	if !c.closed || c.finished {
+		return
+	}
+	if c.err != nil || (len(c.inflight) == 0 && !c.finAcked.IsZero() &&
+		(c.rclosed || time.Since(c.finAcked) >= rudpLinger)) {
+		c.finish()
+	}
+}
+
+// finish stops everything; c.mu is held
+func (c *RUDPConn) finish() {
+	c.finished = true
+	close(c.stop)
+	if c.done != nil {
+		c.done()
+	}
+	c.signal()
+}
+
+// abort closes the connection without waiting for anything
+func (c *RUDPConn) abort(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if !c.finished {
+		c.fail(err)
+	}
+}
+
+// run retransmits, pings and times out
+func (c *RUDPConn) run() {
+	timer := time.NewTimer(c.rto)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.kick:
+		case <-timer.C:
+		}
+
+		c.mu.Lock()
+		next := c.tick(time.Now())
+		c.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// tick does what's due and returns how long until the next thing;
+// c.mu is held
+func (c *RUDPConn) tick(now time.Time) time.Duration {
+	if c.err != nil || c.finished {
+		return rudpIdleWakeup
+	}
+	if now.Sub(c.lastRecv) >= c.timeout {
+		c.fail(ErrRUDPTimeout)
+		return rudpIdleWakeup
+	}
+
+	next := c.lastRecv.Add(c.timeout)
+	for _, seg := range c.inflight {
+		if !now.Before(seg.deadline) {
+			if seg.retries+1 >= rudpMaxRetries {
+				c.fail(ErrRUDPTimeout)
+				return rudpIdleWakeup
+			}
+			c.sendSegment(seg)
+		}
+		if seg.deadline.Before(next) {
+			next = seg.deadline
+		}
+	}
+	if c.established && now.Sub(c.lastSent) >= c.keepAlive {
+		c.send(rudpPacket{typ: rudpPing})
+	}
+	if keepAlive := c.lastSent.Add(c.keepAlive); keepAlive.Before(next) {
+		next = keepAlive
+	}
+	if c.closed && !c.finAcked.IsZero() {
+		c.maybeFinish()
+		if linger := c.finAcked.Add(rudpLinger); linger.Before(next) {
+			next = linger
+		}
+	}
+
+	return max(next.Sub(now), time.Millisecond)
+}
+
+// Read reads the data received in order, waiting while there is none
+func (c *RUDPConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, c.opError("read", net.ErrClosed)
+		case c.readDeadline.passed():
+			// An expired deadline wins over queued data, as on a socket
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		case len(c.queue) > 0:
+			n := copy(b, c.queue[0])
+			if c.queue[0] = c.queue[0][n:]; len(c.queue[0]) == 0 {
+				c.queue[0] = nil
+				c.queue = c.queue[1:]
+			}
+			// A sender stopped by a small window learns it opened up
+			if c.advertised < rudpWindow/4 && c.window() >= rudpWindow/2 {
+				c.send(rudpPacket{typ: rudpACK})
+			}
+			return n, nil
+		case c.rclosed:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.opError("read", c.err)
+		}
+
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+			c.mu.Lock()
+		case <-c.readDeadline.wait():
+			c.mu.Lock()
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// Write sends b, waiting while the peer's window is full
+func (c *RUDPConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var written int
+	for {
+		switch {
+		case c.closed:
+			return written, c.opError("write", net.ErrClosed)
+		case c.err != nil:
+			return written, c.opError("write", c.err)
+		case c.wclosed:
+			return written, c.opError("write", syscall.EPIPE)
+		case c.writeDeadline.passed():
+			// Even with room in the window
+			return written, c.opError("write", os.ErrDeadlineExceeded)
+		}
+		for written < len(b) && seqBefore(c.sndNext, c.peerLimit) && c.sndNext-c.peerAck < rudpWindow {
+			n := min(len(b)-written, rudpMaxPayload)
+			c.queueSegment(rudpData, bytes.Clone(b[written:written+n]))
+			written += n
+		}
+		if written == len(b) {
+			return written, nil
+		}
+
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+			c.mu.Lock()
+		case <-c.writeDeadline.wait():
+			c.mu.Lock()
+			return written, c.opError("write", os.ErrDeadlineExceeded)
+		}
+	}
+}
+
+// CloseWrite sends a FIN after the data written: the peer reads io.EOF
+// while we can still read
+func (c *RUDPConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil || c.closed {
+		return c.opError("close", net.ErrClosed)
+	}
+	c.closeWrite()
+
+	return nil
+}
+
+// closeWrite queues a FIN once; c.mu is held
+func (c *RUDPConn) closeWrite() {
+	if !c.wclosed {
+		c.wclosed = true
+		c.queueSegment(rudpFIN, nil)
+	}
+}
+
+// Close closes both directions. What was written is still delivered,
+// in the background.
+func (c *RUDPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return c.opError("close", net.ErrClosed)
+	}
+	c.closed = true
+	if c.err == nil {
+		c.closeWrite()
+	}
+	c.queue = nil
+	c.signal()
+	c.maybeFinish()
+
+	return nil
+}
+
+// SetKeepAlive pings an idle connection every interval, and fails it
+// after timeout without hearing from the peer
+func (c *RUDPConn) SetKeepAlive(interval, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keepAlive, c.timeout = interval, timeout
+	c.wake()
+}
+
+// Stats returns the connection's counters
+func (c *RUDPConn) Stats() RUDPStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+func (c *RUDPConn) LocalAddr() net.Addr  { return c.pc.LocalAddr() }
+func (c *RUDPConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *RUDPConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *RUDPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *RUDPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// rudpKey identifies a connection on a listener
+type rudpKey struct {
+	addr string
+	id   uint32
+}
+
+// RUDPListener accepts reliable connections on a UDP socket, which
+// they all share
+type RUDPListener struct {
+	pc       net.PacketConn
+	accepted chan *RUDPConn
+	done     chan struct{} // Closed by Close
+
+	mu     sync.Mutex
+	conns  map[rudpKey]*RUDPConn
+	closed bool
+}
+
+// ListenRUDP listens on the UDP address addr
+func ListenRUDP(addr string) (*RUDPListener, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRUDPListener(pc), nil
+}
+
+// NewRUDPListener accepts connections on pc, which the listener then
+// owns
+func NewRUDPListener(pc net.PacketConn) *RUDPListener {
+	l := &RUDPListener{
+		pc:       pc,
+		accepted: make(chan *RUDPConn, rudpBacklog),
+		done:     make(chan struct{}),
+		conns:    make(map[rudpKey]*RUDPConn),
+	}
+	go l.readLoop()
+
+	return l
+}
+
+// readLoop hands the packets to their connections, creating them on
+// SYN
+func (l *RUDPListener) readLoop() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.mu.Lock()
+			conns := make([]*RUDPConn, 0, len(l.conns))
+			for _, c := range l.conns {
+				conns = append(conns, c)
+			}
+			l.mu.Unlock()
+			for _, c := range conns {
+				c.mu.Lock()
+				c.fail(err)
+				c.mu.Unlock()
+			}
+			return
+		}
+		p, ok := parseRUDPPacket(buf[:n])
+		if !ok {
+			continue
+		}
+
+		key := rudpKey{addr: addr.String(), id: p.id}
+		l.mu.Lock()
+		c := l.conns[key]
+		if c == nil && p.typ == rudpSYN && !l.closed && len(l.accepted) < cap(l.accepted) {
+			c = newRUDPConn(l.pc, addr, p.id)
+			c.established = true
+			c.rcvNext = 1 // After the SYN
+			c.done = func() { l.remove(key) }
+			l.conns[key] = c
+			l.accepted <- c
+		}
+		l.mu.Unlock()
+
+		switch {
+		case c != nil:
+			c.handle(p)
+		case p.typ != rudpRST:
+			rst := rudpPacket{typ: rudpRST, id: p.id}
+			_, _ = l.pc.WriteTo(rst.appendTo(nil), addr)
+		}
+	}
+}
+
+// remove forgets a finished connection
+func (l *RUDPListener) remove(key rudpKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.conns, key)
+	if l.closed && len(l.conns) == 0 {
+		_ = l.pc.Close()
+	}
+}
+
+// Accept waits for a connection
+func (l *RUDPListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "rudp", Addr: l.pc.LocalAddr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops accepting connections. Those accepted go on, the socket
+// is closed after the last one.
+func (l *RUDPListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return &net.OpError{Op: "close", Net: "rudp", Addr: l.pc.LocalAddr(), Err: net.ErrClosed}
+	}
+	l.closed = true
+	close(l.done)
+	l.mu.Unlock()
+
+	// Connections nobody accepted go away
+	for {
+		select {
+		case c := <-l.accepted:
+			c.abort(net.ErrClosed)
+			continue
+		default:
+		}
+		break
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.conns) == 0 {
+		return l.pc.Close()
+	}
+
+	return nil
+}
+
+// Addr returns the UDP address
+func (l *RUDPListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+// lossyPacketConn drops a share of the packets written, or all of them
+type lossyPacketConn struct {
+	net.PacketConn
+	loss float64
+	rand *chaosRand
+	drop atomic.Bool
+}
+
+func newLossyPacketConn(t testing.TB, loss float64, seed uint64) *lossyPacketConn {
+	pc := testPacketConn(t)
+
+	return &lossyPacketConn{PacketConn: pc, loss: loss, rand: &chaosRand{r: rand.New(rand.NewPCG(seed, 0))}}
+}
+
+func (c *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.drop.Load() || c.rand.float() < c.loss {
+		return len(p), nil
+	}
+
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// startRUDPEcho runs a TCPServer echoing over a RUDPListener on pc
+func startRUDPEcho(t *testing.T, pc net.PacketConn) *RUDPListener {
+	l := NewRUDPListener(pc)
+	srv := NewTCPServer(l)
+	go func() { _ = srv.Serve(context.Background(), echoConn) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	})
+
+	return l
+}
+
+func TestRUDP(t *testing.T) {
+	// A fifth of the packets each way are lost
+	l := startRUDPEcho(t, newLossyPacketConn(t, 0.2, 1))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := DialRUDPPacketConn(ctx, newLossyPacketConn(t, 0.2, 2), l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(20 * time.Second))
+
+	data := make([]byte, 256<<10)
+	for i := range data {
+		data[i] = byte(rand.Uint32())
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		if err == nil {
+			err = conn.CloseWrite()
+		}
+		errs <- err
+	}()
+	received, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if sha256.Sum256(received) != sha256.Sum256(data) {
+		t.Fatalf("expected %d bytes echoed; actual: %d, different", len(data), len(received))
+	}
+	if stats := conn.Stats(); stats.Retransmitted == 0 || stats.RTT == 0 {
+		t.Errorf("expected retransmissions and an RTT; actual: %+v", stats)
+	}
+}
+
+func TestRUDPPayloads(t *testing.T) {
+	l, err := ListenRUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The TLV encoding, unchanged, over reliable UDP
+	payloads := []Payload{new(Binary), new(String)}
+	*payloads[0].(*Binary) = Binary(bytes.Repeat([]byte{7}, 5000))
+	*payloads[1].(*String) = String("Errors are values.")
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, p := range payloads {
+			if _, err := p.WriteTo(conn); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	conn, err := DialRUDP(context.Background(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, expected := range payloads {
+		actual, err := decode(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual.Bytes(), expected.Bytes()) {
+			t.Errorf("expected %T of %d bytes; actual: %T of %d", expected, len(expected.Bytes()), actual, len(actual.Bytes()))
+		}
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected io.EOF after the server closed; actual: %v", err)
+	}
+}
+
+func TestRUDPTimeout(t *testing.T) {
+	pc := newLossyPacketConn(t, 0, 3)
+	l := startRUDPEcho(t, pc)
+	conn, err := DialRUDP(context.Background(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetKeepAlive(20*time.Millisecond, 200*time.Millisecond)
+
+	// The server goes silent
+	pc.drop.Store(true)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrRUDPTimeout) {
+		t.Errorf("expected ErrRUDPTimeout; actual: %v", err)
+	}
+}
+
+func TestRUDPDeadline(t *testing.T) {
+	l := startRUDPEcho(t, newLossyPacketConn(t, 0, 4))
+	conn, err := DialRUDP(context.Background(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// An expired deadline fails a Write the window has room for...
+	_ = conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if n, err := conn.Write([]byte("late")); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected nothing written past the deadline; actual: %d, %v", n, err)
+	}
+	_ = conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.Write([]byte("echo")); err != nil {
+		t.Fatal(err)
+	}
+
+	// ...and a Read of data already queued
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		conn.mu.Lock()
+		queued := len(conn.queue) > 0
+		conn.mu.Unlock()
+		if queued {
+			break
+		}
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := conn.Read(make([]byte, 4)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected a timeout; actual: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := ReadExactly(conn, 4); err != nil || string(b) != "echo" {
+		t.Errorf("unexpected echo %q: %v", b, err)
+	}
+}
+
+func TestRUDPReset(t *testing.T) {
+	l, err := ListenRUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := DialRUDP(context.Background(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF; actual: %v", err)
+	}
+
+	// The server forgot the connection once its FIN was acknowledged:
+	// what we send now gets a RST
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err = conn.Write([]byte("anyone?")); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("expected ECONNRESET; actual: %v", err)
+	}
+}
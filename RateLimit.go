@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Rate limiting primitives
+//
+// Two classic shapes:
+//
+// - TokenBucket: tokens drip in at Rate per second up to Burst; every
+//   operation (or byte) takes one. Idle time is saved up, so short
+//   bursts pass at full speed while the long-run average stays at Rate.
+//   Right for most things: accept rates, API calls, bandwidth caps.
+// - LeakyBucket: operations leave at exactly Rate per second, evenly
+//   spaced, and at most Capacity may wait in line; the rest are
+//   refused. No bursts ever, which downstream systems with tiny buffers
+//   (a serial link, a strict upstream API) sometimes need.
+//
+// TokenBucket.WaitN reserves its tokens first and then sleeps, letting
+// the balance go negative, so waiters are served in order instead of
+// racing for each new token. Cancelling a wait gives the tokens back.
+//
+// RateLimitedReader and RateLimitedWriter throttle byte throughput with
+// a TokenBucket counting bytes. Wrapping several connections with the
+// same bucket caps their combined bandwidth.
+
+// ErrRateLimited is returned when a LeakyBucket's queue is full
+var ErrRateLimited = errors.New("rate limited")
+
+// TokenBucket limits operations to Rate per second with bursts of up to
+// Burst
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(max(burst, 1)), tokens: float64(max(burst, 1))}
+}
+
+// Burst returns the bucket's capacity
+func (b *TokenBucket) Burst() int {
+	return int(b.burst)
+}
+
+// refill adds the tokens accumulated since the last call; b.mu is held
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+}
+
+// AllowN takes n tokens if they're available at now
+func (b *TokenBucket) AllowN(now time.Time, n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+
+	return true
+}
+
+// Allow takes a token if one is available
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(time.Now(), 1)
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how
+// long until the debt is paid off
+func (b *TokenBucket) reserve(now time.Time, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// unreserve returns n tokens of an abandoned reservation
+func (b *TokenBucket) unreserve(n int) {
+	b.mu.Lock()
+	b.tokens = min(b.burst, b.tokens+float64(n))
+	b.mu.Unlock()
+}
+
+// WaitN blocks until n tokens are available or ctx is done
+func (b *TokenBucket) WaitN(ctx context.Context, n int) error {
+	if float64(n) > b.burst {
+		return fmt.Errorf("rate limit: %d tokens exceed the burst of %d", n, int(b.burst))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	wait := b.reserve(time.Now(), n)
+	if wait == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		// Don't sleep for nothing
+		b.unreserve(n)
+		return context.DeadlineExceeded
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.unreserve(n)
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until a token is available or ctx is done
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	return b.WaitN(ctx, 1)
+}
+
+// LeakyBucket spaces operations evenly at Rate per second, queueing up
+// to Capacity of them
+type LeakyBucket struct {
+	mu       sync.Mutex
+	interval time.Duration // Between two operations
+	capacity int
+	next     time.Time // When the next operation may go
+}
+
+// NewLeakyBucket returns an empty bucket
+func NewLeakyBucket(rate float64, capacity int) *LeakyBucket {
+	return &LeakyBucket{interval: time.Duration(float64(time.Second) / rate), capacity: max(capacity, 0)}
+}
+
+// schedule returns when an operation arriving at now may go, or false
+// if the queue is full
+func (b *LeakyBucket) schedule(now time.Time) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	at := b.next
+	if at.Before(now) {
+		at = now
+	}
+	if at.Sub(now) > time.Duration(b.capacity)*b.interval {
+		return time.Time{}, false
+	}
+	b.next = at.Add(b.interval)
+
+	return at, true
+}
+
+// AllowAt reports whether an operation may go right away at now
+func (b *LeakyBucket) AllowAt(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.next.After(now) {
+		return false
+	}
+	b.next = now.Add(b.interval)
+
+	return true
+}
+
+// Allow reports whether an operation may go right away
+func (b *LeakyBucket) Allow() bool {
+	return b.AllowAt(time.Now())
+}
+
+// Wait blocks until the operation's turn, or fails with ErrRateLimited
+// when Capacity operations are queued already. A cancelled wait keeps
+// its slot; the ones behind it don't move up.
+func (b *LeakyBucket) Wait(ctx context.Context) error {
+	now := time.Now()
+	at, ok := b.schedule(now)
+	if !ok {
+		return ErrRateLimited
+	}
+	if !at.After(now) {
+		return nil
+	}
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RateLimitedReader throttles reads to a TokenBucket counting bytes
+type RateLimitedReader struct {
+	ctx    context.Context
+	r      io.Reader
+	bucket *TokenBucket
+}
+
+// NewRateLimitedReader throttles r; ctx aborts waits
+func NewRateLimitedReader(ctx context.Context, r io.Reader, bucket *TokenBucket) *RateLimitedReader {
+	return &RateLimitedReader{ctx: ctx, r: r, bucket: bucket}
+}
+
+// Read reads at most a burst, then waits for what it read. Paying
+// afterwards is the only option, as a read's size isn't known before.
+func (r *RateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.bucket.Burst() {
+		p = p[:r.bucket.Burst()]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.bucket.WaitN(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	return n, err
+}
+
+// RateLimitedWriter throttles writes to a TokenBucket counting bytes
+type RateLimitedWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	bucket *TokenBucket
+}
+
+// NewRateLimitedWriter throttles w; ctx aborts waits
+func NewRateLimitedWriter(ctx context.Context, w io.Writer, bucket *TokenBucket) *RateLimitedWriter {
+	return &RateLimitedWriter{ctx: ctx, w: w, bucket: bucket}
+}
+
+// Write writes p in chunks of at most a burst, each once it's paid for
+func (w *RateLimitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), w.bucket.Burst())]
+		if err := w.bucket.WaitN(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(10, 5)
+	now := time.Unix(1_000, 0)
+
+	// The full burst, then nothing
+	for i := 0; i < 5; i++ {
+		if !b.AllowN(now, 1) {
+			t.Fatalf("request %d of the burst refused", i)
+		}
+	}
+	if b.AllowN(now, 1) {
+		t.Error("expected the empty bucket to refuse")
+	}
+
+	// 10 per second is one per 100ms
+	if !b.AllowN(now.Add(100*time.Millisecond), 1) || b.AllowN(now.Add(100*time.Millisecond), 1) {
+		t.Error("expected exactly one token after 100ms")
+	}
+
+	// Idle time fills up to the burst and no further
+	if !b.AllowN(now.Add(time.Hour), 5) || b.AllowN(now.Add(time.Hour), 1) {
+		t.Error("expected a full bucket of 5 after idling")
+	}
+
+	// Waits are served in order and a cancelled one returns its tokens
+	b = NewTokenBucket(100, 1)
+	b.Allow()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled; actual: %v", err)
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := b.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > 200*time.Millisecond {
+		t.Errorf("expected 5 waits at 100/s to take about 50ms; actual: %s", elapsed)
+	}
+
+	if err := b.WaitN(context.Background(), 2); err == nil {
+		t.Error("expected an error for more than the burst")
+	}
+}
+
+func TestLeakyBucket(t *testing.T) {
+	b := NewLeakyBucket(10, 2)
+	now := time.Unix(1_000, 0)
+
+	// No bursts: one right away, the next only 100ms later
+	if !b.AllowAt(now) || b.AllowAt(now) || b.AllowAt(now.Add(50*time.Millisecond)) {
+		t.Error("expected operations to be spaced 100ms apart")
+	}
+	if !b.AllowAt(now.Add(100 * time.Millisecond)) {
+		t.Error("expected the next operation after 100ms")
+	}
+
+	// Waiters queue up evenly spaced until the queue is full
+	b = NewLeakyBucket(50, 2)
+	start := time.Now()
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() { errs <- b.Wait(context.Background()) }()
+	}
+	var ok, limited int
+	for i := 0; i < 4; i++ {
+		switch err := <-errs; {
+		case err == nil:
+			ok++
+		case errors.Is(err, ErrRateLimited):
+			limited++
+		default:
+			t.Fatal(err)
+		}
+	}
+	// One goes right away, two wait 20ms and 40ms, one is refused
+	if ok != 3 || limited != 1 {
+		t.Errorf("expected 3 passed and 1 refused; actual: %d and %d", ok, limited)
+	}
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("expected the queue to take about 40ms; actual: %s", elapsed)
+	}
+}
+
+func TestRateLimitedWriter(t *testing.T) {
+	// 10 KB/s with 1 KB bursts: 3 KB take 200ms, the first KB being free
+	var out countingWriter
+	w := NewRateLimitedWriter(context.Background(), &out, NewTokenBucket(10_000, 1_000))
+
+	start := time.Now()
+	n, err := w.Write(make([]byte, 3_000))
+	if err != nil || n != 3_000 || out.n != 3_000 {
+		t.Fatalf("unexpected write %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("expected about 200ms; actual: %s", elapsed)
+	}
+
+	// Reading is throttled the same way, and a reader sharing the
+	// writer's bucket shares its budget
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := NewRateLimitedReader(ctx, zeroReader{}, w.bucket)
+	got, err := io.Copy(io.Discard, r)
+	if !errors.Is(err, context.DeadlineExceeded) || got > 2_000 {
+		t.Errorf("expected a few hundred bytes before the deadline; actual: %d, %v", got, err)
+	}
+}
+
+// countingWriter counts and discards what's written
+type countingWriter struct{ n int }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+// zeroReader is an endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"testing"
@@ -18,11 +21,7 @@ func TestReadIntoBuffer(t *testing.T) {
 	}
 
 	// Start a TCP listener on a local address with an automatically assigned port
-	listener, err := net.Listen("tcp", "127.0.0.1:")
-	if err != nil {
-		// Fail the test if listener creation fails
-		t.Fatal(err)
-	}
+	listener := testListener(t)
 
 	// Server side
 	// Start a goroutine to accept a single connection
@@ -76,3 +75,150 @@ func TestReadIntoBuffer(t *testing.T) {
 	// Close the connection when done
 	conn.Close()
 }
+
+// ReadExactly reads exactly n bytes from r. Unlike a single Read, which
+// may return fewer bytes than the buffer holds (TCP delivers a stream,
+// not messages), it keeps reading until all n bytes have arrived. A
+// stream ending early returns io.ErrUnexpectedEOF with what was read.
+func ReadExactly(r io.Reader, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, errors.New("negative read size")
+	}
+
+	buf := make([]byte, n)
+	// io.ReadFull loops over Read until buf is full
+	read, err := io.ReadFull(r, buf)
+
+	return buf[:read], err
+}
+
+// CopyWithProgress copies src to dst using a buffer of chunk bytes and
+// calls progress (if not nil) with the running total after every write.
+// It returns the number of bytes copied and the first error, other than
+// io.EOF, that occurred.
+func CopyWithProgress(dst io.Writer, src io.Reader, chunk int, progress func(total int64)) (int64, error) {
+	if chunk <= 0 {
+		return 0, errors.New("chunk size must be positive")
+	}
+
+	buf := make([]byte, chunk)
+	var total int64
+
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			written, werr := dst.Write(buf[:n])
+			total += int64(written)
+
+			if progress != nil {
+				progress(total)
+			}
+
+			if werr != nil {
+				return total, werr
+			}
+			// A writer must report an error for short writes,
+			// but don't trust it blindly
+			if written != n {
+				return total, io.ErrShortWrite
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+}
+
+func TestReadExactly(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// Send 10 bytes in small pieces, then hang up
+	go func() {
+		defer server.Close()
+		for _, part := range []string{"012", "3456", "789"} {
+			_, _ = server.Write([]byte(part))
+		}
+	}()
+
+	b, err := ReadExactly(client, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "01234567" {
+		t.Errorf("expected %q; actual: %q", "01234567", b)
+	}
+
+	// Only 2 bytes are left before EOF
+	b, err = ReadExactly(client, 8)
+	if err != io.ErrUnexpectedEOF || string(b) != "89" {
+		t.Errorf("expected %q and unexpected EOF; actual: %q, %v", "89", b, err)
+	}
+}
+
+func TestCopyWithProgress(t *testing.T) {
+	src := bytes.NewReader(make([]byte, 10_000))
+	dst := new(bytes.Buffer)
+
+	var reports []int64
+	n, err := CopyWithProgress(dst, src, 4096, func(total int64) {
+		reports = append(reports, total)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 10_000 || dst.Len() != 10_000 {
+		t.Errorf("expected 10000 bytes copied; actual: %d (%d in dst)", n, dst.Len())
+	}
+
+	// 4096 + 4096 + 1808
+	expected := []int64{4096, 8192, 10_000}
+	if fmt.Sprint(reports) != fmt.Sprint(expected) {
+		t.Errorf("expected progress %v; actual: %v", expected, reports)
+	}
+}
+
+// BenchmarkCopyWithProgress compares buffer sizes when copying 16 MB
+// over a loopback TCP connection, like TestReadIntoBuffer does
+func BenchmarkCopyWithProgress(b *testing.B) {
+	payload := make([]byte, 1<<24)
+
+	for _, chunk := range []int{1 << 12, 1 << 16, 1 << 19} {
+		b.Run(fmt.Sprintf("%dKB", chunk>>10), func(b *testing.B) {
+			listener := testListener(b)
+
+			// Server sends the payload once per accepted connection
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					_, _ = conn.Write(payload)
+					_ = conn.Close()
+				}
+			}()
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				conn, err := net.Dial("tcp", listener.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				_, err = CopyWithProgress(io.Discard, conn, chunk, nil)
+				_ = conn.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
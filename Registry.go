@@ -0,0 +1,692 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Service registry and client-side discovery
+//
+// Hard-coded addresses break as soon as a service moves, scales out or
+// restarts on another port. A registry (Consul, etcd, Eureka) keeps the
+// current ones instead:
+//
+// - Every instance registers its service name and address with a TTL,
+//   and re-registers well before it runs out (Announce): the heartbeat.
+//   An instance that stops heartbeating, crashed or cut off, expires;
+//   one that shuts down cleanly deregisters at once.
+// - Clients look the name up (Lookup), or watch it: a Watch stream
+//   sends the instances right away and again after every change.
+//
+// The registry is an RPC service (RPC.go). On the client side
+// ServiceResolver makes it a dialer: DialContext takes "service://echo"
+// where an address goes, spreading the connections over the instances
+// round robin and trying the next one when an instance doesn't answer.
+// Its signature is net.Dialer's, so it drops into UpstreamPool.Dial or
+// an http.Transport. The resolved addresses are cached for CacheTTL; or
+// with Watch set, kept current by a watch stream per service.
+//
+//	golearn registry -listen :8500
+//
+// Discovery happens in the client, no load balancer in between: that's
+// one hop less, but every client needs the resolver.
+
+// ServiceScheme prefixes the service names ServiceResolver dials
+const ServiceScheme = "service://"
+
+const (
+	registryDefaultTTL = 30 * time.Second
+	registryIdle       = time.Minute // Sweep at least this often
+)
+
+// RegistryArgs is an instance of a service
+type RegistryArgs struct {
+	Service string
+	Addr    string
+	TTL     time.Duration // When it expires without a new registration
+}
+
+// RegistryLookup names the service to look up or watch
+type RegistryLookup struct {
+	Service string
+}
+
+// RegistryInstances are the addresses of a service's instances
+type RegistryInstances struct {
+	Service string
+	Addrs   []string
+}
+
+// Registry keeps the instances of services
+type Registry struct {
+	DefaultTTL time.Duration // For registrations without one, 30s by default
+	MaxTTL     time.Duration // Longer TTLs are cut down to it, if set
+
+	ErrorLog *log.Logger
+
+	mu       sync.Mutex
+	services map[string]map[string]time.Time // Service, address: expiry
+	changed  chan struct{}                   // Closed on every change
+}
+
+func (r *Registry) ttl(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = r.DefaultTTL
+	}
+	if ttl <= 0 {
+		ttl = registryDefaultTTL
+	}
+	if r.MaxTTL > 0 {
+		ttl = min(ttl, r.MaxTTL)
+	}
+	return ttl
+}
+
+// Serve answers on l until ctx is canceled, and returns ctx.Err()
+func (r *Registry) Serve(ctx context.Context, l net.Listener) error {
+	rpc := NewRPCServer()
+	rpc.ErrorLog = r.ErrorLog
+	if err := r.Register(rpc); err != nil {
+		return err
+	}
+	srv := NewTCPServer(l)
+	srv.ErrorLog = r.ErrorLog
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, rpc.ServeConn) }()
+
+	r.sweep(ctx)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = srv.Shutdown(shutdownCtx)
+	<-served
+
+	return ctx.Err()
+}
+
+// Register adds the registry's service to s. Without Serve, nothing
+// sweeps the expired instances, but they're never returned either.
+func (r *Registry) Register(s *RPCServer) error {
+	return s.Register("Registry", &registryService{r: r})
+}
+
+// sweep drops the instances as they expire, so the watchers hear about
+// it, until ctx is canceled
+func (r *Registry) sweep(ctx context.Context) {
+	for {
+		r.mu.Lock()
+		next := r.expire(time.Now())
+		changed := r.watch()
+		r.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-changed: // Maybe one expiring sooner
+			timer.Stop()
+		}
+	}
+}
+
+// expire drops the expired instances, returning when the next one
+// expires; r.mu is held
+func (r *Registry) expire(now time.Time) time.Time {
+	next := now.Add(registryIdle)
+	dropped := false
+	for service, instances := range r.services {
+		for addr, expiry := range instances {
+			switch {
+			case !expiry.After(now):
+				delete(instances, addr)
+				dropped = true
+			case expiry.Before(next):
+				next = expiry
+			}
+		}
+		if len(instances) == 0 {
+			delete(r.services, service)
+		}
+	}
+	if dropped {
+		r.signal()
+	}
+
+	return next
+}
+
+// watch returns the channel closed on the next change; r.mu is held
+func (r *Registry) watch() <-chan struct{} {
+	if r.changed == nil {
+		r.changed = make(chan struct{})
+	}
+	return r.changed
+}
+
+// signal wakes up the watchers; r.mu is held
+func (r *Registry) signal() {
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+}
+
+// lookup returns the live addresses of service, sorted; r.mu is held
+func (r *Registry) lookup(service string, now time.Time) []string {
+	addrs := []string{}
+	for addr, expiry := range r.services[service] {
+		if expiry.After(now) {
+			addrs = append(addrs, addr)
+		}
+	}
+	slices.Sort(addrs)
+
+	return addrs
+}
+
+// registryService is the RPC service of a Registry
+type registryService struct {
+	r *Registry
+}
+
+func (s *registryService) Register(_ context.Context, args *RegistryArgs) (*RegistryInstances, error) {
+	if args.Service == "" || args.Addr == "" {
+		return nil, rpcErrorf(RPCInvalidArgument, "a registration needs a service and an address")
+	}
+
+	r := s.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.services == nil {
+		r.services = make(map[string]map[string]time.Time)
+	}
+	instances := r.services[args.Service]
+	if instances == nil {
+		instances = make(map[string]time.Time)
+		r.services[args.Service] = instances
+	}
+	now := time.Now()
+	if expiry, ok := instances[args.Addr]; !ok || !expiry.After(now) {
+		r.signal() // New, not a heartbeat
+	}
+	instances[args.Addr] = now.Add(r.ttl(args.TTL))
+
+	return &RegistryInstances{Service: args.Service, Addrs: r.lookup(args.Service, now)}, nil
+}
+
+func (s *registryService) Deregister(_ context.Context, args *RegistryArgs) (*RegistryInstances, error) {
+	r := s.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.services[args.Service][args.Addr]; ok {
+		delete(r.services[args.Service], args.Addr)
+		r.signal()
+	}
+
+	return &RegistryInstances{Service: args.Service, Addrs: r.lookup(args.Service, time.Now())}, nil
+}
+
+func (s *registryService) Lookup(_ context.Context, args *RegistryLookup) (*RegistryInstances, error) {
+	r := s.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return &RegistryInstances{Service: args.Service, Addrs: r.lookup(args.Service, time.Now())}, nil
+}
+
+// Watch reads a RegistryLookup and sends the instances of its service,
+// then again whenever they change, until the client goes away
+func (s *registryService) Watch(ctx context.Context, st *RPCStream) error {
+	var args RegistryLookup
+	if err := st.Recv(&args); err != nil {
+		return err
+	}
+
+	r := s.r
+	var sent []string
+	for {
+		r.mu.Lock()
+		addrs := r.lookup(args.Service, time.Now())
+		changed := r.watch()
+		r.mu.Unlock()
+
+		if sent == nil || !slices.Equal(addrs, sent) {
+			if err := st.Send(RegistryInstances{Service: args.Service, Addrs: addrs}); err != nil {
+				return err
+			}
+			sent = addrs
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// RegistryClient talks to a Registry
+type RegistryClient struct {
+	// ErrorLog receives the failed heartbeats of Announce
+	ErrorLog *log.Logger
+
+	peer *rpcPeer
+}
+
+// NewRegistryClient returns a client of the registry at addr
+func NewRegistryClient(addr string) *RegistryClient {
+	return &RegistryClient{peer: &rpcPeer{addr: addr}}
+}
+
+func (c *RegistryClient) logf(format string, v ...any) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Close closes the connection to the registry
+func (c *RegistryClient) Close() error {
+	c.peer.close()
+	return nil
+}
+
+// Register registers the instance at addr of service, until ttl runs out
+func (c *RegistryClient) Register(ctx context.Context, service, addr string, ttl time.Duration) error {
+	var reply RegistryInstances
+	return c.peer.call(ctx, "Registry.Register", &RegistryArgs{Service: service, Addr: addr, TTL: ttl}, &reply)
+}
+
+// Deregister removes the instance at addr of service
+func (c *RegistryClient) Deregister(ctx context.Context, service, addr string) error {
+	var reply RegistryInstances
+	return c.peer.call(ctx, "Registry.Deregister", &RegistryArgs{Service: service, Addr: addr}, &reply)
+}
+
+// Lookup returns the addresses of the instances of service
+func (c *RegistryClient) Lookup(ctx context.Context, service string) ([]string, error) {
+	var reply RegistryInstances
+	if err := c.peer.call(ctx, "Registry.Lookup", &RegistryLookup{Service: service}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Addrs, nil
+}
+
+// Watch returns the addresses of the instances of service, and then
+// again after every change, until ctx is canceled or the stream fails;
+// then the channel is closed
+func (c *RegistryClient) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	st, err := c.peer.stream(ctx, "Registry.Watch")
+	if err != nil {
+		return nil, err
+	}
+	if err := st.Send(RegistryLookup{Service: service}); err != nil {
+		return nil, err
+	}
+
+	updates := make(chan []string)
+	go func() {
+		defer close(updates)
+		for {
+			var instances RegistryInstances
+			if err := st.Recv(&instances); err != nil {
+				return
+			}
+			select {
+			case updates <- instances.Addrs:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return updates, nil
+}
+
+// Announce registers the instance at addr of service, and keeps it
+// registered with a heartbeat every third of ttl until ctx is canceled;
+// then it deregisters the instance and returns ctx.Err(). Only the
+// first registration failing is an error, the heartbeats retry.
+func (c *RegistryClient) Announce(ctx context.Context, service, addr string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = registryDefaultTTL
+	}
+	if err := c.Register(ctx, service, addr, ttl); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			deregisterCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+			defer cancel()
+			if err := c.Deregister(deregisterCtx, service, addr); err != nil {
+				c.logf("registry: deregister %s %s: %v", service, addr, err)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+			if err := c.Register(ctx, service, addr, ttl); err != nil && ctx.Err() == nil {
+				c.logf("registry: heartbeat %s %s: %v", service, addr, err)
+			}
+		}
+	}
+}
+
+// ServiceResolver dials services by name, resolving them with a
+// registry
+type ServiceResolver struct {
+	Registry *RegistryClient
+
+	// CacheTTL is how long looked up addresses are used, 5s by default
+	CacheTTL time.Duration
+
+	// Watch keeps the addresses of every service resolved current with
+	// a watch stream, until Close, instead of looking them up again
+	Watch bool
+
+	// Dial connects to the instances, a net.Dialer by default
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu      sync.Mutex
+	cache   map[string]*resolvedService
+	watches context.Context
+	stop    context.CancelFunc
+}
+
+// resolvedService is the cache entry of a service
+type resolvedService struct {
+	addrs   []string
+	expires time.Time // Zero while watched
+	next    int       // Round robin
+}
+
+func (r *ServiceResolver) cacheTTL() time.Duration {
+	if r.CacheTTL > 0 {
+		return r.CacheTTL
+	}
+	return 5 * time.Second
+}
+
+// Resolve returns the addresses of the instances of service
+func (r *ServiceResolver) Resolve(ctx context.Context, service string) ([]string, error) {
+	r.mu.Lock()
+	if e := r.cache[service]; e != nil && (e.expires.IsZero() || time.Now().Before(e.expires)) {
+		addrs := e.addrs
+		r.mu.Unlock()
+		return addrs, nil
+	}
+	r.mu.Unlock()
+
+	if r.Watch {
+		if addrs, err := r.watch(ctx, service); err == nil {
+			return addrs, nil
+		}
+		// No stream: look it up like without Watch
+	}
+	addrs, err := r.Registry.Lookup(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	r.update(service, addrs, time.Now().Add(r.cacheTTL()))
+
+	return addrs, nil
+}
+
+// watch starts a watch stream for service, returning the first update
+func (r *ServiceResolver) watch(ctx context.Context, service string) ([]string, error) {
+	r.mu.Lock()
+	if r.watches == nil {
+		r.watches, r.stop = context.WithCancel(context.Background())
+	}
+	watches := r.watches
+	r.mu.Unlock()
+
+	updates, err := r.Registry.Watch(watches, service)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	select {
+	case a, ok := <-updates:
+		if !ok {
+			return nil, errors.New("registry: watch ended")
+		}
+		addrs = a
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	r.update(service, addrs, time.Time{})
+
+	go func() {
+		for addrs := range updates {
+			r.update(service, addrs, time.Time{})
+		}
+		// The stream is gone: the next Resolve looks up again
+		r.update(service, nil, time.Now())
+	}()
+
+	return addrs, nil
+}
+
+// update caches the addresses of service
+func (r *ServiceResolver) update(service string, addrs []string, expires time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cache == nil {
+		r.cache = make(map[string]*resolvedService)
+	}
+	e := r.cache[service]
+	if e == nil {
+		e = &resolvedService{}
+		r.cache[service] = e
+	}
+	e.addrs, e.expires = addrs, expires
+}
+
+// DialContext connects to address, or to an instance of the service
+// when address is "service://name"
+func (r *ServiceResolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dial := r.Dial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	service, ok := strings.CutPrefix(address, ServiceScheme)
+	if !ok {
+		return dial(ctx, network, address)
+	}
+
+	addrs, err := r.Resolve(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("registry: no instances of %s", service)
+	}
+
+	r.mu.Lock()
+	start := 0
+	if e := r.cache[service]; e != nil {
+		start = e.next
+		e.next++
+	}
+	r.mu.Unlock()
+
+	var errs []error
+	for i := range addrs {
+		conn, err := dial(ctx, network, addrs[(start+i)%len(addrs)])
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("registry: %s: %w", service, errors.Join(errs...))
+}
+
+// Close ends the watch streams
+func (r *ServiceResolver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stop != nil {
+		r.stop()
+		r.watches, r.stop = nil, nil
+	}
+	return nil
+}
+
+func registryMain(args []string) error {
+	fs := flag.NewFlagSet("registry", flag.ContinueOnError)
+	addr := fs.String("listen", ":8500", "TCP `address` to listen on")
+	ttl := fs.Duration("ttl", registryDefaultTTL, "TTL of registrations without one")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	r := &Registry{DefaultTTL: *ttl}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	return Run(ctx, NewService("registry", func(ctx context.Context) error { return r.Serve(ctx, l) }, nil))
+}
+
+func TestRegistry(t *testing.T) {
+	l := testListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registry := &Registry{ErrorLog: log.New(io.Discard, "", 0)}
+	go func() { _ = registry.Serve(ctx, l) }()
+
+	client := NewRegistryClient(l.Addr().String())
+	client.ErrorLog = registry.ErrorLog
+	defer client.Close()
+
+	// Two echo servers announce themselves
+	var echoes []string
+	announced := make(map[string]context.CancelFunc)
+	for range 2 {
+		srv := NewTCPServer(testListener(t))
+		go func() { _ = srv.Serve(ctx, echoConn) }()
+		addr := srv.Addr().String()
+		echoes = append(echoes, addr)
+
+		announceCtx, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			_ = client.Announce(announceCtx, "echo", addr, 150*time.Millisecond)
+			close(done)
+		}()
+		announced[addr] = func() {
+			stop()
+			<-done
+		}
+	}
+	slices.Sort(echoes)
+
+	eventually := func(what string, get func() []string, expected []string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !slices.Equal(get(), expected); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected %v; actual: %v", what, expected, get())
+			}
+		}
+	}
+	lookup := func() []string {
+		addrs, _ := client.Lookup(ctx, "echo")
+		return addrs
+	}
+	eventually("lookup", lookup, echoes)
+
+	// Heartbeats keep them registered well past their TTL
+	time.Sleep(400 * time.Millisecond)
+	if addrs := lookup(); !slices.Equal(addrs, echoes) {
+		t.Errorf("expected %v after the TTL; actual: %v", echoes, addrs)
+	}
+
+	// Dialing the service name spreads over the instances
+	resolver := &ServiceResolver{Registry: NewRegistryClient(l.Addr().String()), Watch: true}
+	defer resolver.Registry.Close()
+	defer resolver.Close()
+	dialed := make(map[string]bool)
+	for range 2 {
+		conn, err := resolver.DialContext(ctx, "tcp", "service://echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialed[conn.RemoteAddr().String()] = true
+		_, _ = conn.Write([]byte("hi\n"))
+		b := make([]byte, 3)
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hi\n" {
+			t.Errorf("expected the echo; actual: %q, %v", b, err)
+		}
+		_ = conn.Close()
+	}
+	if len(dialed) != 2 {
+		t.Errorf("expected both instances dialed; actual: %v", dialed)
+	}
+
+	// An instance shutting down deregisters, and the watch tells the
+	// resolver
+	watch, err := client.Watch(ctx, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := <-watch; !slices.Equal(addrs, echoes) {
+		t.Errorf("expected the watch to start with %v; actual: %v", echoes, addrs)
+	}
+	announced[echoes[0]]()
+	if addrs := <-watch; !slices.Equal(addrs, echoes[1:]) {
+		t.Errorf("expected the watch to report %v; actual: %v", echoes[1:], addrs)
+	}
+	eventually("resolve", func() []string {
+		addrs, _ := resolver.Resolve(ctx, "echo")
+		return addrs
+	}, echoes[1:])
+
+	// One that stops heartbeating expires
+	if err := client.Register(ctx, "db", "127.0.0.1:5432", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	eventually("db", func() []string {
+		addrs, _ := client.Lookup(ctx, "db")
+		return addrs
+	}, []string{})
+
+	// Plain addresses are dialed as they are, unknown services fail
+	if conn, err := resolver.DialContext(ctx, "tcp", echoes[1]); err != nil {
+		t.Error(err)
+	} else {
+		_ = conn.Close()
+	}
+	if _, err := resolver.DialContext(ctx, "tcp", "service://nope"); err == nil {
+		t.Error("expected no instances of nope")
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replay fuzzing
+//
+// A recorded session (see SessionReplay.go) is a valid conversation.
+// Servers rarely break on valid conversations; they break on the
+// almost valid ones: a length one byte off, a command cut in half, a
+// type nobody expected. ReplayFuzzer replays a session over and over,
+// each time with a few random byte-level mutations (flipped bits,
+// replaced, inserted, deleted or duplicated bytes) and watches the
+// server for:
+//
+//   - panics, recovered with their stack
+//   - hangs: the server must be done Deadline after the client closed
+//     its side, which is how a missing read deadline or a loop that
+//     ignores EOF shows up
+//   - memory: a run allocating more than MaxRunAlloc (a length prefix
+//     trusted blindly), or the heap growing by more than MaxHeapGrowth
+//     over all runs (something kept per connection and never freed)
+//
+// Run 0 replays the session as recorded. The randomness comes from
+// Seed, so a finding reproduces by running again with the same seed,
+// and each finding carries its input, which WriteTo saves as a capture
+// for Replayer.
+//
+// FuzzConn replays into a ConnHandler over a MemPipe, one event per
+// Write; FuzzPackets hands each event to a packet decoder as a
+// datagram, for protocols like TFTP that have no stream to serve. The
+// tests below fuzz the TLV server, the LineServer and the TFTP packets.
+
+const (
+	defaultFuzzMutations     = 4
+	defaultFuzzDeadline      = 2 * time.Second
+	defaultFuzzMaxRunAlloc   = 64 << 20
+	defaultFuzzMaxHeapGrowth = 32 << 20
+)
+
+var (
+	// ErrFuzzPanic is a server panicking on an input
+	ErrFuzzPanic = errors.New("fuzz: panic")
+
+	// ErrFuzzHang is a server still busy Deadline after its input ended
+	ErrFuzzHang = errors.New("fuzz: hang")
+
+	// ErrFuzzMemory is a run, or all runs, using too much memory
+	ErrFuzzMemory = errors.New("fuzz: memory")
+)
+
+// ReplayFuzzer replays mutated sessions against a server
+type ReplayFuzzer struct {
+	// Direction selects the side of the capture to send, as for
+	// Replayer
+	Direction Direction
+
+	// Runs is the number of replays, including the unmutated one
+	Runs int
+
+	// Mutations is the most mutations per run (defaults to 4); each
+	// run applies between one and that many
+	Mutations int
+
+	// Deadline bounds a run once its input was sent (defaults to 2s)
+	Deadline time.Duration
+
+	// MaxRunAlloc bounds the bytes allocated by a run (64 MiB),
+	// MaxHeapGrowth the growth of the live heap over all runs (32 MiB)
+	MaxRunAlloc   uint64
+	MaxHeapGrowth uint64
+
+	Seed uint64
+}
+
+// FuzzFinding is a problem found by a run
+type FuzzFinding struct {
+	Run    int
+	Err    error // Wraps ErrFuzzPanic, ErrFuzzHang or ErrFuzzMemory
+	Input  []SessionEvent
+	Detail string // The panic's stack, if any
+}
+
+func (f FuzzFinding) String() string {
+	return fmt.Sprintf("run %d: %v", f.Run, f.Err)
+}
+
+// WriteTo saves the input of the finding as a capture
+func (f FuzzFinding) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, e := range f.Input {
+		n, err := e.WriteTo(w)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// FuzzReport sums up a fuzzing session
+type FuzzReport struct {
+	Runs       int
+	Findings   []FuzzFinding
+	HeapGrowth int64 // Live heap after the runs minus before them
+}
+
+// Err joins the errors of the findings
+func (r FuzzReport) Err() error {
+	var err error
+	for _, f := range r.Findings {
+		err = errors.Join(err, fmt.Errorf("run %d: %w", f.Run, f.Err))
+	}
+
+	return err
+}
+
+// FuzzConn replays mutations of events into handler, one connection
+// per run
+func (f *ReplayFuzzer) FuzzConn(ctx context.Context, events []SessionEvent, handler ConnHandler) FuzzReport {
+	return f.fuzz(ctx, events, func(ctx context.Context, input []SessionEvent) error {
+		client, server := MemPipe()
+		defer client.Close()
+		defer server.Close()
+
+		done := make(chan error, 1)
+		go func() { done <- guardFuzz(func() { handler(ctx, server) }) }()
+		// Whatever the server answers is read and dropped, so it
+		// never blocks on a full buffer
+		go func() { _, _ = io.Copy(io.Discard, client) }()
+
+		_ = client.SetWriteDeadline(time.Now().Add(f.deadline()))
+		for _, e := range input {
+			if _, err := client.Write(e.Payload); err != nil {
+				// The server hung up, or stopped reading
+				break
+			}
+		}
+		_ = client.(*MemConn).CloseWrite()
+
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(f.deadline()):
+			return ErrFuzzHang
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// FuzzPackets hands every event of mutations of events to decode
+func (f *ReplayFuzzer) FuzzPackets(ctx context.Context, events []SessionEvent, decode func(p []byte)) FuzzReport {
+	return f.fuzz(ctx, events, func(ctx context.Context, input []SessionEvent) error {
+		done := make(chan error, 1)
+		go func() {
+			done <- guardFuzz(func() {
+				for _, e := range input {
+					decode(e.Payload)
+				}
+			})
+		}()
+
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(f.deadline()):
+			return ErrFuzzHang
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// guardFuzz runs fn, turning a panic into an ErrFuzzPanic
+func guardFuzz(fn func()) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &fuzzPanic{value: v, stack: debug.Stack()}
+		}
+	}()
+	fn()
+
+	return nil
+}
+
+// fuzzPanic is a recovered panic
+type fuzzPanic struct {
+	value any
+	stack []byte
+}
+
+func (p *fuzzPanic) Error() string { return fmt.Sprintf("%v: %v", ErrFuzzPanic, p.value) }
+func (p *fuzzPanic) Unwrap() error { return ErrFuzzPanic }
+
+func (f *ReplayFuzzer) deadline() time.Duration {
+	if f.Deadline > 0 {
+		return f.Deadline
+	}
+
+	return defaultFuzzDeadline
+}
+
+// fuzz does the runs of FuzzConn and FuzzPackets
+func (f *ReplayFuzzer) fuzz(ctx context.Context, events []SessionEvent, run func(context.Context, []SessionEvent) error) FuzzReport {
+	maxRunAlloc := f.MaxRunAlloc
+	if maxRunAlloc == 0 {
+		maxRunAlloc = defaultFuzzMaxRunAlloc
+	}
+	maxGrowth := f.MaxHeapGrowth
+	if maxGrowth == 0 {
+		maxGrowth = defaultFuzzMaxHeapGrowth
+	}
+
+	var sent []SessionEvent
+	for _, e := range events {
+		if e.Direction == f.Direction {
+			sent = append(sent, e)
+		}
+	}
+
+	rng := rand.New(rand.NewPCG(f.Seed, 3))
+	var report FuzzReport
+	var mem runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	heapBefore := mem.HeapAlloc
+
+	for i := 0; i < max(f.Runs, 1) && ctx.Err() == nil; i++ {
+		input := sent
+		if i > 0 {
+			input = f.mutate(rng, sent)
+		}
+
+		runtime.ReadMemStats(&mem)
+		allocBefore := mem.TotalAlloc
+		err := run(ctx, input)
+		runtime.ReadMemStats(&mem)
+		if err == nil && mem.TotalAlloc-allocBefore > maxRunAlloc {
+			err = fmt.Errorf("%w: run allocated %d bytes", ErrFuzzMemory, mem.TotalAlloc-allocBefore)
+		}
+		report.Runs++
+
+		if err == nil || errors.Is(err, ctx.Err()) {
+			continue
+		}
+		finding := FuzzFinding{Run: i, Err: err, Input: input}
+		var p *fuzzPanic
+		if errors.As(err, &p) {
+			finding.Detail = string(p.stack)
+		}
+		report.Findings = append(report.Findings, finding)
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	report.HeapGrowth = int64(mem.HeapAlloc) - int64(heapBefore)
+	if report.HeapGrowth > int64(maxGrowth) {
+		report.Findings = append(report.Findings, FuzzFinding{
+			Run: report.Runs - 1,
+			Err: fmt.Errorf("%w: heap grew by %d bytes over %d runs", ErrFuzzMemory, report.HeapGrowth, report.Runs),
+		})
+	}
+
+	return report
+}
+
+// mutate returns a copy of events with random byte-level mutations
+func (f *ReplayFuzzer) mutate(rng *rand.Rand, events []SessionEvent) []SessionEvent {
+	out := make([]SessionEvent, len(events))
+	for i, e := range events {
+		e.Payload = bytes.Clone(e.Payload)
+		out[i] = e
+	}
+	if len(out) == 0 {
+		return out
+	}
+
+	limit := f.Mutations
+	if limit <= 0 {
+		limit = defaultFuzzMutations
+	}
+	for n := 1 + rng.IntN(limit); n > 0; n-- {
+		e := &out[rng.IntN(len(out))]
+		p := e.Payload
+		if len(p) == 0 {
+			e.Payload = append(p, byte(rng.IntN(256)))
+			continue
+		}
+		at := rng.IntN(len(p))
+
+		switch rng.IntN(6) {
+		case 0: // Flip a bit
+			p[at] ^= 1 << rng.IntN(8)
+		case 1: // Replace a byte, often by one that means something
+			interesting := []byte{0x00, 0x01, 0x7f, 0x80, 0xff, '\r', '\n'}
+			if rng.IntN(2) == 0 {
+				p[at] = interesting[rng.IntN(len(interesting))]
+			} else {
+				p[at] = byte(rng.IntN(256))
+			}
+		case 2: // Insert random bytes
+			extra := make([]byte, 1+rng.IntN(8))
+			for i := range extra {
+				extra[i] = byte(rng.IntN(256))
+			}
+			e.Payload = append(p[:at], append(extra, p[at:]...)...)
+		case 3: // Delete a range
+			end := min(at+1+rng.IntN(8), len(p))
+			e.Payload = append(p[:at], p[end:]...)
+		case 4: // Duplicate a range
+			end := min(at+1+rng.IntN(16), len(p))
+			e.Payload = append(p[:end], append(bytes.Clone(p[at:end]), p[end:]...)...)
+		case 5: // Cut the event short
+			e.Payload = p[:at]
+		}
+	}
+
+	return out
+}
+
+// fuzzRuns is the number of runs of the fuzz tests
+func fuzzRuns() int {
+	if testing.Short() {
+		return 20
+	}
+
+	return 300
+}
+
+// requireNoFindings fails t with the findings of report
+func requireNoFindings(t *testing.T, report FuzzReport) {
+	t.Helper()
+
+	for _, f := range report.Findings {
+		t.Errorf("%s\n%s", f, f.Detail)
+	}
+}
+
+// recordTLVSession records a TLV client talking to tlvAckServer
+func recordTLVSession(t *testing.T) []SessionEvent {
+	t.Helper()
+
+	capture := new(bytes.Buffer)
+	client, server := MemPipe()
+	go func() {
+		defer server.Close()
+		_ = tlvAckServer(TLVServer(server, nil))
+	}()
+
+	c := TLVClient(NewRecordingConn(client, capture), nil)
+	for _, msg := range []io.WriterTo{String("hello"), Binary{0xde, 0xad, 0xbe, 0xef}, String(strings.Repeat("x", 300))} {
+		if err := c.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = client.Close()
+
+	events, err := ReadSession(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return events
+}
+
+func TestReplayFuzzTLV(t *testing.T) {
+	f := &ReplayFuzzer{Direction: Outbound, Runs: fuzzRuns(), Seed: 1}
+	report := f.FuzzConn(context.Background(), recordTLVSession(t), func(_ context.Context, conn net.Conn) {
+		_ = tlvAckServer(TLVServer(conn, nil))
+	})
+
+	requireNoFindings(t, report)
+	if report.Runs != fuzzRuns() {
+		t.Errorf("expected %d runs; actual: %d", fuzzRuns(), report.Runs)
+	}
+}
+
+func TestReplayFuzzLineServer(t *testing.T) {
+	s := NewLineServer()
+	s.MaxLineLength = 64
+	s.Greeting = "hello"
+	s.Handle("echo", func(_ *LineSession, args string) (string, error) { return args, nil })
+	s.Handle("set", func(session *LineSession, args string) (string, error) {
+		key, value, _ := strings.Cut(args, " ")
+		session.Values[key] = value
+		return "ok", nil
+	})
+	s.Handle("quit", func(*LineSession, string) (string, error) { return "bye", ErrQuit })
+
+	events := []SessionEvent{
+		{Direction: Outbound, Payload: []byte("ECHO hello\r\n")},
+		{Direction: Outbound, Payload: []byte("set color blue\r\nset size 42\r\n")},
+		{Direction: Outbound, Payload: []byte("echo " + strings.Repeat("y", 40) + "\r\n")},
+		{Direction: Outbound, Payload: []byte("QUIT\r\n")},
+	}
+	f := &ReplayFuzzer{Direction: Outbound, Runs: fuzzRuns(), Seed: 2}
+	report := f.FuzzConn(context.Background(), events, func(_ context.Context, conn net.Conn) {
+		s.ServeConn(conn)
+	})
+
+	requireNoFindings(t, report)
+}
+
+func TestReplayFuzzTFTP(t *testing.T) {
+	rrq, _ := ReadReq{Filename: "boot/kernel.img"}.MarshalBinary()
+	data, _ := (&Data{Block: 1, Payload: strings.NewReader(strings.Repeat("z", BlockSize))}).MarshalBinary()
+	last, _ := (&Data{Block: 2, Payload: strings.NewReader("tail")}).MarshalBinary()
+	events := []SessionEvent{
+		{Direction: Inbound, Payload: rrq},
+		{Direction: Inbound, Payload: data},
+		{Direction: Inbound, Payload: last},
+	}
+
+	// What a server does with a datagram: find out what it is
+	f := &ReplayFuzzer{Direction: Inbound, Runs: fuzzRuns(), Seed: 3}
+	report := f.FuzzPackets(context.Background(), events, func(p []byte) {
+		var q ReadReq
+		if q.UnmarshalBinary(p) == nil {
+			return
+		}
+		var d Data
+		_ = d.UnmarshalBinary(p)
+	})
+
+	requireNoFindings(t, report)
+}
+
+func TestReplayFuzzFindings(t *testing.T) {
+	events := []SessionEvent{{Direction: Outbound, Payload: []byte("boom")}}
+
+	// The unmutated run is enough to catch a panic...
+	f := &ReplayFuzzer{Direction: Outbound, Runs: 1}
+	report := f.FuzzConn(context.Background(), events, func(_ context.Context, conn net.Conn) {
+		b, _ := io.ReadAll(conn)
+		if string(b) == "boom" {
+			panic("boom")
+		}
+	})
+	if len(report.Findings) != 1 || !errors.Is(report.Findings[0].Err, ErrFuzzPanic) || !strings.Contains(report.Findings[0].Detail, "ReplayFuzz.go") {
+		t.Fatalf("expected a panic with its stack; actual: %v", report.Findings)
+	}
+
+	// ...its input saved as a capture
+	capture := new(bytes.Buffer)
+	if _, err := report.Findings[0].WriteTo(capture); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := ReadSession(capture); err != nil || len(saved) != 1 || string(saved[0].Payload) != "boom" {
+		t.Errorf("unexpected saved input %v, %v", saved, err)
+	}
+
+	// ...a server ignoring EOF...
+	f = &ReplayFuzzer{Direction: Outbound, Runs: 1, Deadline: 20 * time.Millisecond}
+	report = f.FuzzConn(context.Background(), events, func(ctx context.Context, conn net.Conn) {
+		_, _ = io.ReadAll(conn)
+		<-ctx.Done()
+	})
+	if !errors.Is(report.Err(), ErrFuzzHang) {
+		t.Errorf("expected a hang; actual: %v", report.Err())
+	}
+
+	// ...and one trusting a length it shouldn't
+	f = &ReplayFuzzer{Direction: Outbound, Runs: 1, MaxRunAlloc: 1 << 20}
+	report = f.FuzzConn(context.Background(), events, func(_ context.Context, conn net.Conn) {
+		_, _ = io.ReadAll(conn)
+		_ = bytes.Repeat([]byte{0}, 8<<20)
+	})
+	if !errors.Is(report.Err(), ErrFuzzMemory) {
+		t.Errorf("expected excessive allocation; actual: %v", report.Err())
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Zero-downtime restarts
+//
+// Upgrading a server binary the naive way (stop the old process, start
+// the new one) leaves a gap in which the port is closed and clients get
+// "connection refused". Two classic ways around that:
+//
+// 1. Listener inheritance: the old process starts the new binary and
+//    hands it its listening sockets as extra file descriptors (this is
+//    what nginx, HAProxy and systemd socket activation do). The socket
+//    never closes, connections arriving during the switch simply wait in
+//    the kernel's backlog until someone accepts them.
+// 2. SO_REUSEPORT: the new process binds the very same address next to
+//    the old one and the kernel spreads new connections between them.
+//    Once the new process is up, the old one stops accepting.
+//
+// Restarter supports both. Create listeners through it instead of
+// calling net.Listen directly:
+//
+//	r, err := NewRestarter()
+//	l, err := r.Listen("tcp", ":8080")          // Inherited after a restart
+//	pc, err := r.ListenPacket("udp", ":69")     // Works for TFTP too
+//	r.Ready()                                   // Tell the parent we're up
+//
+// and on whatever triggers the upgrade call Restart, then drain the old
+// process with TCPServer.Shutdown and exit. The serve command does it on
+// SIGUSR2 (SIGHUP reloads its configuration), for every listener of the
+// configuration and of the admin API; see Serve.go.
+//
+// Listeners closed since they were created, like those a reload
+// replaced, aren't handed down.
+//
+// Inherited descriptors start at 3 (after stdin, stdout and stderr); the
+// environment tells the child which one is which.
+
+const (
+	// restartListenersEnv lists the inherited sockets, in fd order, as
+	// "network:address" entries separated by ";"
+	restartListenersEnv = "GOLEARN_LISTENERS"
+
+	// restartReadyEnv holds the fd of the pipe the child signals on
+	restartReadyEnv = "GOLEARN_READY_FD"
+
+	// firstInheritedFD is the fd of the first of exec.Cmd.ExtraFiles
+	firstInheritedFD = 3
+
+	// restartTimeout is how long serve waits for the new process to be
+	// ready
+	restartTimeout = 30 * time.Second
+)
+
+// Restarter creates listeners that survive a restart of the process
+type Restarter struct {
+	// ReusePort binds new listeners with SO_REUSEPORT, so a new process
+	// can bind next to this one without inheriting anything
+	ReusePort bool
+
+	mu        sync.Mutex
+	inherited map[string]*os.File // Handed down by the parent, keyed by network:address
+	sockets   []restartSocket     // Everything created through Listen/ListenPacket
+	ready     *os.File            // Write end of the parent's ready pipe
+}
+
+// restartSocket is a socket to hand down on Restart
+type restartSocket struct {
+	key  string
+	file interface{ File() (*os.File, error) }
+}
+
+// NewRestarter picks up the sockets inherited from the parent process,
+// if any
+func NewRestarter() (*Restarter, error) {
+	var ready *os.File
+	if fd := os.Getenv(restartReadyEnv); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", restartReadyEnv, err)
+		}
+		ready = os.NewFile(uintptr(n), "ready")
+	}
+
+	spec := os.Getenv(restartListenersEnv)
+	var files []*os.File
+	if spec != "" {
+		for i := range strings.Split(spec, ";") {
+			files = append(files, os.NewFile(uintptr(firstInheritedFD+i), "inherited"))
+		}
+	}
+
+	// Our own children must not mistake these for theirs
+	_ = os.Unsetenv(restartListenersEnv)
+	_ = os.Unsetenv(restartReadyEnv)
+
+	return newRestarter(spec, files, ready)
+}
+
+// newRestarter builds a Restarter from a listener spec and its files
+func newRestarter(spec string, files []*os.File, ready *os.File) (*Restarter, error) {
+	r := &Restarter{inherited: make(map[string]*os.File), ready: ready}
+	if spec == "" {
+		return r, nil
+	}
+
+	keys := strings.Split(spec, ";")
+	if len(keys) != len(files) {
+		return nil, fmt.Errorf("%s lists %d sockets; inherited %d", restartListenersEnv, len(keys), len(files))
+	}
+	for i, key := range keys {
+		r.inherited[key] = files[i]
+	}
+
+	return r, nil
+}
+
+// Listen returns the inherited listener for network and address, or
+// creates a new one
+func (r *Restarter) Listen(network, address string) (net.Listener, error) {
+	return r.ListenFunc(network, address, func() (net.Listener, error) {
+		if r.ReusePort {
+			return reusePortConfig().Listen(context.Background(), network, address)
+		}
+		return net.Listen(network, address)
+	})
+}
+
+// ListenFunc is Listen creating the listener with listen when none was
+// inherited, for those net.Listen doesn't make (ListenUnix)
+func (r *Restarter) ListenFunc(network, address string, listen func() (net.Listener, error)) (net.Listener, error) {
+	key := network + ":" + address
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var l net.Listener
+	var err error
+	if f, ok := r.inherited[key]; ok {
+		delete(r.inherited, key)
+		// FileListener dups the fd, the original can go
+		l, err = net.FileListener(f)
+		_ = f.Close()
+	} else {
+		l, err = listen()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fl, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		_ = l.Close()
+		return nil, fmt.Errorf("listener %T can't be handed down", l)
+	}
+	r.sockets = append(r.sockets, restartSocket{key, fl})
+
+	return l, nil
+}
+
+// ListenPacket is Listen for packet oriented networks such as "udp"
+func (r *Restarter) ListenPacket(network, address string) (net.PacketConn, error) {
+	key := network + ":" + address
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var pc net.PacketConn
+	var err error
+	if f, ok := r.inherited[key]; ok {
+		delete(r.inherited, key)
+		pc, err = net.FilePacketConn(f)
+		_ = f.Close()
+	} else if r.ReusePort {
+		pc, err = reusePortConfig().ListenPacket(context.Background(), network, address)
+	} else {
+		pc, err = net.ListenPacket(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fpc, ok := pc.(interface{ File() (*os.File, error) })
+	if !ok {
+		_ = pc.Close()
+		return nil, fmt.Errorf("packet conn %T can't be handed down", pc)
+	}
+	r.sockets = append(r.sockets, restartSocket{key, fpc})
+
+	return pc, nil
+}
+
+// Files returns duplicates of every socket created through the
+// Restarter and still open, together with the matching value for
+// restartListenersEnv. The caller owns the files.
+func (r *Restarter) Files() ([]*os.File, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := make([]*os.File, 0, len(r.sockets))
+	keys := make([]string, 0, len(r.sockets))
+	open := make([]restartSocket, 0, len(r.sockets))
+	for _, s := range r.sockets {
+		// Closing a unix listener removes its socket file, which the
+		// child still needs
+		if ul, ok := s.file.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+
+		f, err := s.file.File()
+		if errors.Is(err, net.ErrClosed) {
+			// Forgotten for good
+			continue
+		}
+		open = append(open, s)
+		if err != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+			return nil, "", fmt.Errorf("%s: %w", s.key, err)
+		}
+		files = append(files, f)
+		keys = append(keys, s.key)
+	}
+	r.sockets = open
+
+	return files, strings.Join(keys, ";"), nil
+}
+
+// Restart starts a new copy of the running binary with the same
+// arguments, hands it the sockets and waits until it calls Ready. The
+// caller should then stop accepting, drain its connections and exit.
+func (r *Restarter) Restart(ctx context.Context) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files, spec, err := r.Files()
+	if err != nil {
+		return nil, err
+	}
+	// The child gets its own copies when it starts
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		restartListenersEnv+"="+spec,
+		restartReadyEnv+"="+strconv.Itoa(firstInheritedFD+len(files)),
+	)
+
+	err = cmd.Start()
+	// Only the child may hold the write end, or we'd never see EOF
+	_ = readyW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := waitReady(ctx, readyR); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, err
+	}
+
+	return cmd.Process, nil
+}
+
+// waitReady waits for the child's ready byte. EOF means the child exited
+// (or closed the pipe) without becoming ready.
+func waitReady(ctx context.Context, ready *os.File) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == io.EOF {
+			return errors.New("restart: child exited before becoming ready")
+		}
+		return err
+	case <-ctx.Done():
+		// Unblocks the Read above
+		_ = ready.SetReadDeadline(time.Now())
+		return ctx.Err()
+	}
+}
+
+// Ready tells the parent that started us through Restart that we are
+// serving, so it can start draining. It does nothing for a process that
+// wasn't restarted.
+func (r *Restarter) Ready() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Inherited sockets nobody asked for belong to listeners the new
+	// version no longer has
+	for key, f := range r.inherited {
+		_ = f.Close()
+		delete(r.inherited, key)
+	}
+
+	if r.ready == nil {
+		return nil
+	}
+	_, err := r.ready.Write([]byte{1})
+	_ = r.ready.Close()
+	r.ready = nil
+
+	return err
+}
+
+func TestRestarterHandoff(t *testing.T) {
+	parent, err := newRestarter("", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldListener, err := parent.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPacket, err := parent.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What Restart hands to the new process
+	files, spec, err := parent.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readyR.Close()
+
+	// The "new process" asks for the same addresses and gets the very
+	// same sockets back
+	child, err := newRestarter(spec, files, readyW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newListener, err := child.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newListener.Close()
+	newPacket, err := child.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newPacket.Close()
+
+	if newListener.Addr().String() != oldListener.Addr().String() {
+		t.Errorf("expected inherited listener on %s; actual: %s", oldListener.Addr(), newListener.Addr())
+	}
+	if newPacket.LocalAddr().String() != oldPacket.LocalAddr().String() {
+		t.Errorf("expected inherited packet conn on %s; actual: %s", oldPacket.LocalAddr(), newPacket.LocalAddr())
+	}
+
+	if err := child.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := waitReady(ctx, readyR); err != nil {
+		t.Fatalf("expected ready signal; actual: %v", err)
+	}
+
+	// A client connecting while the old process goes away is picked up
+	// by the new one
+	conn, err := net.Dial("tcp", oldListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = oldListener.Close()
+
+	accepted, err := newListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = accepted.Close()
+
+	// Same for datagrams
+	client, err := net.Dial("udp", oldPacket.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = oldPacket.Close()
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = newPacket.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, _, err := newPacket.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("expected datagram on inherited conn; actual: %q, %v", buf[:n], err)
+	}
+}
+
+func TestRestarterReusePort(t *testing.T) {
+	first := &Restarter{ReusePort: true}
+	l1, err := first.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("SO_REUSEPORT unavailable: %v", err)
+	}
+	defer l1.Close()
+
+	// A second process binding the same port is what SO_REUSEPORT allows
+	second := &Restarter{ReusePort: true}
+	l2, err := second.Listen("tcp", l1.Addr().String())
+	if err != nil {
+		t.Fatalf("expected second bind to succeed; actual: %v", err)
+	}
+	_ = l2.Close()
+}
+
+func TestWaitReadyChildExited(t *testing.T) {
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readyR.Close()
+
+	// The child dying closes its end without writing
+	_ = readyW.Close()
+
+	if err := waitReady(context.Background(), readyR); err == nil {
+		t.Error("expected an error when the child exits early")
+	}
+}
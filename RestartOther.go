@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// restartSignal is nil: there's no SIGUSR2, and a child process can't
+// inherit sockets through exec.Cmd.ExtraFiles here, see Restart.go
+var restartSignal os.Signal
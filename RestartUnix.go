@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignal makes serve restart, see Serve.go
+var restartSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Retry engine
+//
+// SendWithRetry hard-codes its policy: 7 attempts, 10 seconds apart, on
+// a fixed set of errors. Clients that talk to flaky networks (DNS over
+// UDP, dialing a backend that is restarting) need the same idea with
+// knobs:
+//
+// - how many attempts in total
+// - exponential backoff between them, capped at a maximum
+// - jitter, so a thousand clients that failed together don't all retry
+//   in the same millisecond
+// - which errors are worth retrying at all (a refused DNS query or a
+//   TLS certificate error will fail the same way every time)
+//
+// RetryPolicy.Do runs an operation under such a policy and stops early
+// when its context is done. An operation that knows better than the
+// policy can wrap its error with Permanent to stop right away, or with
+// RetryAfter when the server said how long to back off.
+
+// Default RetryPolicy values
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryInitial    = 100 * time.Millisecond
+	defaultRetryMax        = 5 * time.Second
+	defaultRetryMultiplier = 2
+)
+
+// RetryPolicy describes how an operation is retried. The zero value
+// uses the defaults above without jitter.
+type RetryPolicy struct {
+	Attempts   int           // Total tries, including the first one
+	Initial    time.Duration // Backoff after the first failure
+	Max        time.Duration // Upper bound for the backoff
+	Multiplier float64       // Backoff growth per attempt
+	Jitter     float64       // Randomize the backoff by up to this fraction (0 to 1)
+
+	// Retryable reports whether err is worth another attempt. It
+	// defaults to IsTransient: timeouts, resets, refused connections and
+	// local ports running out.
+	Retryable func(err error) bool
+
+	// Metrics, when set, counts retries and exhausted policies in
+	// retries_total and retry_exhausted_total, labelled with Name
+	Metrics *Metrics
+	Name    string
+
+	// Tracer, or else the context's tracer, gets a span per attempt
+	Tracer Tracer
+}
+
+// permanentError marks an error that must not be retried
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that RetryPolicy.Do returns it (unwrapped)
+// without retrying, whatever Retryable says
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return permanentError{err}
+}
+
+// retryAfterError carries a server-requested minimum wait
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e retryAfterError) Error() string { return e.err.Error() }
+func (e retryAfterError) Unwrap() error { return e.err }
+
+// RetryAfter wraps err so that RetryPolicy.Do waits at least d before
+// the next attempt, e.g. for an HTTP Retry-After header
+func RetryAfter(err error, d time.Duration) error {
+	if err == nil {
+		return nil
+	}
+
+	return retryAfterError{err: err, after: d}
+}
+
+// Do calls op until it succeeds, returns an error that isn't retryable,
+// the attempts are used up or ctx is done
+func (p RetryPolicy) Do(ctx context.Context, op func(ctx context.Context) error) error {
+	attempts := p.Attempts
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsTransient
+	}
+
+	var retries, exhausted *Metric
+	if p.Metrics != nil {
+		retries = p.Metrics.Counter("retries_total", "Operations attempted again after a failure.", "op").With(p.Name)
+		exhausted = p.Metrics.Counter("retry_exhausted_total", "Operations that failed every attempt.", "op").With(p.Name)
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			retries.Inc()
+			wait := p.Backoff(attempt - 1)
+			var ra retryAfterError
+			if errors.As(err, &ra) {
+				wait = max(wait, ra.after)
+			}
+
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+			case <-time.After(wait):
+			}
+		}
+
+		attemptCtx, span := startSpan(ctx, p.Tracer, "retry.attempt", Attr("op", p.Name), Attr("attempt", attempt+1))
+		err = explainExhaustion(op(attemptCtx), "")
+		span.End(err)
+		if err == nil {
+			return nil
+		}
+		var perm permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if !retryable(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+
+	exhausted.Inc()
+
+	return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
+
+// Backoff returns the wait after the given failed attempt (0 based)
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	initial := p.Initial
+	if initial <= 0 {
+		initial = defaultRetryInitial
+	}
+	maxBackoff := p.Max
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMax
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = defaultRetryMultiplier
+	}
+
+	d := float64(initial)
+	for i := 0; i < attempt && d < float64(maxBackoff); i++ {
+		d *= multiplier
+	}
+	d = min(d, float64(maxBackoff))
+
+	if p.Jitter > 0 {
+		// Spread evenly over d ± Jitter*d
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(d)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{Attempts: 4, Initial: time.Millisecond}
+
+	// Succeeds on the third attempt
+	calls := 0
+	err := p.Do(context.Background(), func(context.Context) error {
+		if calls++; calls < 3 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success after 3 calls; actual: %d calls, %v", calls, err)
+	}
+
+	// Never succeeds: all attempts are used and the last error kept
+	calls = 0
+	err = p.Do(context.Background(), func(context.Context) error {
+		calls++
+		return syscall.ECONNRESET
+	})
+	if !errors.Is(err, syscall.ECONNRESET) || calls != 4 {
+		t.Errorf("expected 4 calls ending in ECONNRESET; actual: %d calls, %v", calls, err)
+	}
+
+	// Permanent errors aren't retried
+	calls = 0
+	permanent := errors.New("bad request")
+	err = p.Do(context.Background(), func(context.Context) error {
+		calls++
+		return permanent
+	})
+	if err != permanent || calls != 1 {
+		t.Errorf("expected a single call; actual: %d calls, %v", calls, err)
+	}
+
+	// Neither are errors the operation marks as permanent
+	calls = 0
+	err = p.Do(context.Background(), func(context.Context) error {
+		calls++
+		return Permanent(syscall.ECONNRESET)
+	})
+	if err != syscall.ECONNRESET || calls != 1 {
+		t.Errorf("expected a single call returning ECONNRESET; actual: %d calls, %v", calls, err)
+	}
+}
+
+func TestRetryPolicyContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	p := RetryPolicy{Attempts: 100, Initial: 20 * time.Millisecond}
+	calls := 0
+	err := p.Do(ctx, func(context.Context) error {
+		calls++
+		return syscall.ECONNRESET
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded; actual: %v", err)
+	}
+	if calls > 3 {
+		t.Errorf("expected retries to stop with the context; actual: %d calls", calls)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for i, e := range expected {
+		if d := p.Backoff(i); d != e*time.Millisecond {
+			t.Errorf("attempt %d: expected %s; actual: %s", i, e*time.Millisecond, d)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.Backoff(0); d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatalf("jittered backoff out of range: %s", d)
+		}
+	}
+}
+
+func TestRetryPolicyRetryAfter(t *testing.T) {
+	p := RetryPolicy{Attempts: 2, Initial: time.Millisecond}
+
+	// The operation's wait wins over the much shorter backoff
+	begin := time.Now()
+	calls := 0
+	err := p.Do(context.Background(), func(context.Context) error {
+		if calls++; calls == 1 {
+			return RetryAfter(syscall.ECONNRESET, 50*time.Millisecond)
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("expected success on the second call; actual: %d calls, %v", calls, err)
+	}
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond {
+		t.Errorf("expected to wait at least 50ms; actual: %s", elapsed)
+	}
+}
+
+func TestRetryPolicyMetrics(t *testing.T) {
+	m := new(Metrics)
+	p := RetryPolicy{Attempts: 3, Initial: time.Millisecond, Metrics: m, Name: "dial"}
+
+	// Two retries and a failure, then one retry and a success
+	_ = p.Do(context.Background(), func(context.Context) error { return syscall.ECONNRESET })
+	calls := 0
+	_ = p.Do(context.Background(), func(context.Context) error {
+		if calls++; calls < 2 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	})
+
+	vars := m.Vars()
+	if n := vars["retries_total"].(map[string]any)["op=dial"]; n != 3.0 {
+		t.Errorf("expected 3 retries; actual: %v", n)
+	}
+	if n := vars["retry_exhausted_total"].(map[string]any)["op=dial"]; n != 1.0 {
+		t.Errorf("expected 1 exhausted policy; actual: %v", n)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which package syscall is missing on most
+// linux architectures (mips uses a different value, hence the build tag)
+const soReusePort = 0xf
+
+// reusePortConfig sets SO_REUSEPORT (and SO_REUSEADDR) on the socket
+// before bind, so several processes can listen on the same address and
+// the kernel balances new connections between them. Only linux does the
+// balancing; on BSD and macOS the last process to bind gets everything,
+// which is no good for a restart.
+func reusePortConfig() *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+				if sockErr == nil {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// reusePortConfig fails every listen, see ReusePortLinux.go
+func reusePortConfig() *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(_, _ string, _ syscall.RawConn) error {
+			return errors.New("SO_REUSEPORT restarts are only supported on linux")
+		},
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Reverse HTTP proxy
+//
+// proxyConn in Proxy.go works at layer 4: it copies bytes between two
+// TCP connections without knowing what they mean. That's fast and works
+// for any protocol, but every connection goes to the same place and the
+// proxy can't tell one request from the next.
+//
+// A layer 7 proxy parses HTTP, so it can decide per request:
+//
+//   - routing by Host header and path prefix, e.g. api.example.com to
+//     the API servers and /static/ to the file servers
+//   - rewriting headers on the way: X-Forwarded-For/-Host/-Proto tell
+//     the backend who the client really is, since the TCP connection it
+//     sees comes from the proxy
+//   - spreading requests over several upstreams and skipping the ones
+//     that are down
+//
+// Upstreams are marked down two ways: actively, by a periodic GET of
+// HealthPath (Run), and passively, when a request to them fails. A down
+// upstream comes back with the next successful health check.
+//
+// Warm pre-dials connections to every upstream through the pool of
+// UpstreamPool.go, so the first requests find them open already.
+//
+// The price is parsing every request, and the proxy only speaks HTTP.
+
+const (
+	defaultHealthPath     = "/healthz"
+	defaultHealthInterval = 5 * time.Second
+	healthCheckTimeout    = 2 * time.Second
+)
+
+// ErrNoUpstream means no healthy upstream serves the request
+var ErrNoUpstream = errors.New("no healthy upstream")
+
+// Upstream is a backend server
+type Upstream struct {
+	URL *url.URL
+
+	down atomic.Bool
+}
+
+// NewUpstream parses the base URL of a backend, e.g.
+// "http://10.0.0.1:8080". It starts out healthy.
+func NewUpstream(rawURL string) (*Upstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("upstream %q: scheme must be http or https", rawURL)
+	}
+
+	return &Upstream{URL: u}, nil
+}
+
+// Healthy reports whether the upstream takes requests
+func (u *Upstream) Healthy() bool {
+	return !u.down.Load()
+}
+
+// ProxyRoute sends matching requests to its upstreams
+type ProxyRoute struct {
+	Host        string // Matches the request's Host, without port; empty matches any
+	PathPrefix  string // Matches the start of the path; empty matches any
+	StripPrefix bool   // Remove PathPrefix before forwarding
+
+	Upstreams []*Upstream
+
+	SetHeaders    map[string]string // Request headers to add or replace
+	RemoveHeaders []string          // Request headers to drop
+
+	next atomic.Uint64 // Round robin position
+}
+
+// pick returns the next healthy upstream
+func (r *ProxyRoute) pick() *Upstream {
+	n := uint64(len(r.Upstreams))
+	for i := uint64(0); i < n; i++ {
+		u := r.Upstreams[(r.next.Add(1)-1)%n]
+		if u.Healthy() {
+			return u
+		}
+	}
+
+	return nil
+}
+
+// ReverseProxy routes requests to upstreams
+type ReverseProxy struct {
+	Routes []*ProxyRoute
+
+	// HealthPath is requested by the health checks (defaults to
+	// "/healthz"), HealthInterval is the time between them (5s)
+	HealthPath     string
+	HealthInterval time.Duration
+
+	// Transport talks to the upstreams (defaults to
+	// DefaultUpstreamTransport, see UpstreamPool.go)
+	Transport http.RoundTripper
+
+	// ErrorLog receives upstream errors
+	ErrorLog *log.Logger
+
+	// Enricher, when set, labels clients in the logs (see Enrich.go)
+	Enricher Enricher
+
+	// OnHealthChange, when set, is called when an upstream is marked
+	// down or back up; see Alerter in SMTP.go
+	OnHealthChange func(u *Upstream, healthy bool)
+
+	proxy atomic.Pointer[httputil.ReverseProxy]
+}
+
+// proxyTarget travels in the request context from ServeHTTP to Rewrite
+type proxyTarget struct {
+	route    *ProxyRoute
+	upstream *Upstream
+}
+
+type proxyTargetKey struct{}
+
+func (p *ReverseProxy) logf(format string, v ...any) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// setHealth marks u up or down, logging and reporting a change
+func (p *ReverseProxy) setHealth(u *Upstream, healthy bool) {
+	if wasDown := u.down.Swap(!healthy); wasDown != !healthy {
+		p.logf("upstream %s healthy: %t", u.URL, healthy)
+		if p.OnHealthChange != nil {
+			p.OnHealthChange(u, healthy)
+		}
+	}
+}
+
+func (p *ReverseProxy) transport() http.RoundTripper {
+	if p.Transport != nil {
+		return p.Transport
+	}
+
+	return DefaultUpstreamTransport
+}
+
+// httpProxy builds the httputil.ReverseProxy on first use
+func (p *ReverseProxy) httpProxy() *httputil.ReverseProxy {
+	if rp := p.proxy.Load(); rp != nil {
+		return rp
+	}
+
+	rp := &httputil.ReverseProxy{
+		Rewrite:   p.rewrite,
+		Transport: p.transport(),
+		ErrorLog:  p.ErrorLog,
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Add("Via", fmt.Sprintf("%d.%d golearn", resp.ProtoMajor, resp.ProtoMinor))
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			target := r.Context().Value(proxyTargetKey{}).(proxyTarget)
+			// Passive health check: a failed request marks the upstream
+			// down until the next successful active check. A client
+			// that went away says nothing about the upstream.
+			if r.Context().Err() == nil {
+				p.setHealth(target.upstream, false)
+			}
+			p.logf("proxy %s %s for %s to %s: %v", r.Method, r.URL.Path, requestPeer(p.Enricher, r), target.upstream.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	if !p.proxy.CompareAndSwap(nil, rp) {
+		return p.proxy.Load()
+	}
+
+	return rp
+}
+
+// rewrite turns the incoming request into the upstream request
+func (p *ReverseProxy) rewrite(pr *httputil.ProxyRequest) {
+	target := pr.In.Context().Value(proxyTargetKey{}).(proxyTarget)
+	route := target.route
+
+	if route.StripPrefix && route.PathPrefix != "" {
+		path := strings.TrimPrefix(pr.Out.URL.Path, strings.TrimSuffix(route.PathPrefix, "/"))
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		pr.Out.URL.Path = path
+		pr.Out.URL.RawPath = ""
+	}
+
+	// Host, scheme and base path of the upstream
+	pr.SetURL(target.upstream.URL)
+	// X-Forwarded-For, -Host and -Proto from the incoming request
+	pr.SetXForwarded()
+
+	for _, h := range route.RemoveHeaders {
+		pr.Out.Header.Del(h)
+	}
+	for h, v := range route.SetHeaders {
+		pr.Out.Header.Set(h, v)
+	}
+}
+
+// route finds the most specific route for r: routes for its host win
+// over catch-all ones, then the longest matching path prefix
+func (p *ReverseProxy) route(r *http.Request) *ProxyRoute {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var best *ProxyRoute
+	for _, route := range p.Routes {
+		if route.Host != "" && !strings.EqualFold(route.Host, host) {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+			continue
+		}
+		if best == nil ||
+			(route.Host != "" && best.Host == "") ||
+			((route.Host != "") == (best.Host != "") && len(route.PathPrefix) > len(best.PathPrefix)) {
+			best = route
+		}
+	}
+
+	return best
+}
+
+// ServeHTTP proxies r to an upstream of the matching route
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := p.route(r)
+	if route == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	upstream := route.pick()
+	if upstream == nil {
+		http.Error(w, ErrNoUpstream.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), proxyTargetKey{}, proxyTarget{route: route, upstream: upstream})
+	p.httpProxy().ServeHTTP(w, r.WithContext(ctx))
+}
+
+// Run health checks the upstreams until ctx is done
+func (p *ReverseProxy) Run(ctx context.Context) {
+	interval := p.HealthInterval
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		p.CheckHealth(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckHealth checks every upstream once, concurrently
+func (p *ReverseProxy) CheckHealth(ctx context.Context) {
+	seen := make(map[*Upstream]bool)
+	done := make(chan struct{})
+	n := 0
+
+	for _, route := range p.Routes {
+		for _, u := range route.Upstreams {
+			if seen[u] {
+				continue
+			}
+			seen[u] = true
+			n++
+
+			go func() {
+				defer func() { done <- struct{}{} }()
+
+				p.setHealth(u, p.check(ctx, u))
+			}()
+		}
+	}
+
+	for ; n > 0; n-- {
+		<-done
+	}
+}
+
+// Warm parks n connections to every upstream in the Transport's pool,
+// concurrently. It needs an *UpstreamTransport, the default; with
+// another Transport it does nothing.
+func (p *ReverseProxy) Warm(ctx context.Context, n int) error {
+	tr, ok := p.transport().(*UpstreamTransport)
+	if !ok {
+		return nil
+	}
+
+	seen := make(map[*Upstream]bool)
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+	for _, route := range p.Routes {
+		for _, u := range route.Upstreams {
+			if seen[u] {
+				continue
+			}
+			seen[u] = true
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := tr.Warm(ctx, u.URL, n); err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %w", u.URL, err))
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// check asks u for its health, any 2xx answer means healthy
+func (p *ReverseProxy) check(ctx context.Context, u *Upstream) bool {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	path := p.HealthPath
+	if path == "" {
+		path = defaultHealthPath
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.URL.JoinPath(path).String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.transport().RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	discard(resp)
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// startBackend runs an HTTP server answering with its name and the
+// request details the proxy is supposed to set
+func startBackend(t *testing.T, name string) (*Upstream, *http.Server) {
+	t.Helper()
+
+	l := testListener(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(http.ResponseWriter, *http.Request) {})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s xff=%s xfh=%s tenant=%s cookie=%s",
+			name, r.URL.Path, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Host"),
+			r.Header.Get("X-Tenant"), r.Header.Get("Cookie"))
+	})
+	srv := &http.Server{Handler: mux}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	u, err := NewUpstream("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u, srv
+}
+
+func TestReverseProxy(t *testing.T) {
+	api, _ := startBackend(t, "api")
+	static, _ := startBackend(t, "static")
+	web1, _ := startBackend(t, "web1")
+	web2, web2Server := startBackend(t, "web2")
+
+	var mu sync.Mutex
+	var changes []string
+	p := &ReverseProxy{
+		ErrorLog: log.New(io.Discard, "", 0),
+		OnHealthChange: func(u *Upstream, healthy bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, fmt.Sprintf("%s %t", u.URL.Host, healthy))
+		},
+		Routes: []*ProxyRoute{
+			{Host: "api.example.com", Upstreams: []*Upstream{api},
+				SetHeaders: map[string]string{"X-Tenant": "acme"}, RemoveHeaders: []string{"Cookie"}},
+			{PathPrefix: "/static/", StripPrefix: true, Upstreams: []*Upstream{static}},
+			{PathPrefix: "/", Upstreams: []*Upstream{web1, web2}},
+		},
+	}
+
+	l := testListener(t)
+	srv := &http.Server{Handler: p}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	get := func(host, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+l.Addr().String()+path, nil)
+		req.Host = host
+		req.Header.Set("Cookie", "session=secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusOK && !strings.HasPrefix(resp.Header.Get("Via"), "1.1 golearn") {
+			t.Errorf("expected Via header; actual: %q", resp.Header.Get("Via"))
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	// Host routing with header rewriting
+	if _, body := get("api.example.com:80", "/users"); body != "api /users xff=127.0.0.1 xfh=api.example.com:80 tenant=acme cookie=" {
+		t.Errorf("unexpected api response %q", body)
+	}
+
+	// Path routing with the prefix stripped
+	if _, body := get("www.example.com", "/static/logo.png"); !strings.HasPrefix(body, "static /logo.png ") {
+		t.Errorf("unexpected static response %q", body)
+	}
+
+	// Round robin over the web servers
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		_, body := get("www.example.com", "/")
+		seen[strings.Fields(body)[0]]++
+	}
+	if seen["web1"] != 2 || seen["web2"] != 2 {
+		t.Errorf("expected even spread; actual: %v", seen)
+	}
+
+	// web2 dies: the first request to it fails and marks it down...
+	_ = web2Server.Close()
+	failures := 0
+	for i := 0; i < 4; i++ {
+		if status, _ := get("www.example.com", "/"); status == http.StatusBadGateway {
+			failures++
+		}
+	}
+	if failures > 1 || web2.Healthy() {
+		t.Errorf("expected web2 to be taken out after one failure; actual: %d failures", failures)
+	}
+
+	// ...and the health check agrees, while web1 stays in
+	p.CheckHealth(context.Background())
+	if web2.Healthy() || !web1.Healthy() {
+		t.Errorf("unexpected health: web1 %t, web2 %t", web1.Healthy(), web2.Healthy())
+	}
+
+	// No healthy upstream at all
+	api.down.Store(true)
+	if status, _ := get("api.example.com", "/"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected 503; actual: %d", status)
+	}
+	// Until the health check brings it back
+	p.CheckHealth(context.Background())
+	if status, _ := get("api.example.com", "/"); status != http.StatusOK {
+		t.Errorf("expected api back; actual: %d", status)
+	}
+
+	// Each change reported once: web2 going down, api coming back
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{web2.URL.Host + " false", api.URL.Host + " true"}
+	if !slices.Equal(changes, expected) {
+		t.Errorf("expected changes %q; actual: %q", expected, changes)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Service lifecycle
+//
+// Every server command used to wire up its own stopping logic: a
+// signal context, a goroutine per server, a channel per error, a
+// Shutdown call with a fresh deadline, and a guess at which errors just
+// mean "stopped". Run does it once for any number of services:
+//
+//	err := Run(ctx,
+//		TCPService("echo", NewTCPServer(echoListener), echoHandler),
+//		HTTPService("proxy", &http.Server{Handler: proxy}, proxyListener),
+//	)
+//
+// 1. every service's Serve runs in its own goroutine with a shared
+//    context
+// 2. on SIGINT or SIGTERM, on ctx being done or on any service
+//    returning early, the shared context is canceled
+// 3. every service's Shutdown is called at the same time, together
+//    sharing a grace period (10 seconds by default)
+// 4. Run waits for the services to return, up to the end of the grace
+//    period, and returns their errors joined
+//
+// Errors that only say a service was stopped (context.Canceled,
+// ErrServerClosed, http.ErrServerClosed, net.ErrClosed) aren't errors
+// here. A service failing on its own, e.g. its listener dying, is
+// reported and stops the others: a half-running process is harder to
+// notice than one that exits.
+
+// defaultRunGrace is how long services get to shut down
+const defaultRunGrace = 10 * time.Second
+
+// Service is something Run starts and stops
+type Service interface {
+	// Serve runs until ctx is done or Shutdown is called
+	Serve(ctx context.Context) error
+
+	// Shutdown stops the service gracefully, giving up when ctx is done
+	Shutdown(ctx context.Context) error
+}
+
+// funcService is a Service made of two functions
+type funcService struct {
+	name     string
+	serve    func(ctx context.Context) error
+	shutdown func(ctx context.Context) error
+}
+
+// NewService returns a named Service. shutdown may be nil for services
+// that stop when their context is canceled.
+func NewService(name string, serve, shutdown func(ctx context.Context) error) Service {
+	return &funcService{name: name, serve: serve, shutdown: shutdown}
+}
+
+func (s *funcService) Serve(ctx context.Context) error { return s.serve(ctx) }
+
+func (s *funcService) Shutdown(ctx context.Context) error {
+	if s.shutdown == nil {
+		return nil
+	}
+
+	return s.shutdown(ctx)
+}
+
+func (s *funcService) String() string { return s.name }
+
+// TCPService runs handler for the connections of srv
+func TCPService(name string, srv *TCPServer, handler ConnHandler) Service {
+	return NewService(name, func(ctx context.Context) error {
+		return srv.Serve(ctx, handler)
+	}, srv.Shutdown)
+}
+
+// PacketService runs handler for the datagrams arriving on pc, which
+// is closed when the shared context is canceled
+func PacketService(name string, pc net.PacketConn, handler PacketHandler) Service {
+	return NewService(name, func(ctx context.Context) error {
+		return ServePacket(ctx, pc, handler)
+	}, nil)
+}
+
+// HTTPService serves srv on l. Requests in flight get the grace period
+// to complete; whoever is still there after it is cut off.
+func HTTPService(name string, srv *http.Server, l net.Listener) Service {
+	return NewService(name, func(context.Context) error {
+		return srv.Serve(l)
+	}, func(ctx context.Context) error {
+		err := srv.Shutdown(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			_ = srv.Close()
+		}
+		return err
+	})
+}
+
+// Runner runs services until they are told to stop
+type Runner struct {
+	// Grace bounds the shutdown of all services, 10 seconds by default
+	Grace time.Duration
+
+	// Signals stop the services, SIGINT and SIGTERM by default
+	Signals []os.Signal
+
+	// ErrorLog receives the reason for stopping
+	ErrorLog *log.Logger
+}
+
+func (r *Runner) logf(format string, v ...any) {
+	if r.ErrorLog != nil {
+		r.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Run runs services with the default Runner
+func Run(ctx context.Context, services ...Service) error {
+	return new(Runner).Run(ctx, services...)
+}
+
+// serviceResult is what a Service's Serve returned
+type serviceResult struct {
+	service Service
+	err     error
+}
+
+// Run starts services and stops them on a signal, when ctx is done or
+// when one of them returns. It returns the services' errors joined.
+func (r *Runner) Run(ctx context.Context, services ...Service) error {
+	signals := r.Signals
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	grace := r.Grace
+	if grace <= 0 {
+		grace = defaultRunGrace
+	}
+
+	sigCtx, stopSignals := signal.NotifyContext(ctx, signals...)
+	defer stopSignals()
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan serviceResult, len(services))
+	for _, s := range services {
+		go func() { results <- serviceResult{s, s.Serve(serveCtx)} }()
+	}
+
+	var errs []error
+	running := len(services)
+	select {
+	case <-sigCtx.Done():
+		r.logf("stopping: %v", context.Cause(sigCtx))
+	case res := <-results:
+		running--
+		if err := serviceError(res); err != nil {
+			errs = append(errs, err)
+		}
+		r.logf("stopping: %s returned", serviceName(res.service))
+	}
+	cancel()
+
+	// Shutdown gets a fresh deadline: ctx may be done already
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.WithoutCancel(ctx), grace)
+	defer cancelShutdown()
+
+	shutdownErrs := make(chan error, len(services))
+	for _, s := range services {
+		go func() {
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				err = fmt.Errorf("%s: shutdown: %w", serviceName(s), err)
+				shutdownErrs <- err
+				return
+			}
+			shutdownErrs <- nil
+		}()
+	}
+
+	for ; running > 0; running-- {
+		select {
+		case res := <-results:
+			if err := serviceError(res); err != nil {
+				errs = append(errs, err)
+			}
+		case <-shutdownCtx.Done():
+			errs = append(errs, fmt.Errorf("%d service(s) still running after %s", running, grace))
+			return errors.Join(errs...)
+		}
+	}
+	for range services {
+		select {
+		case err := <-shutdownErrs:
+			if err != nil {
+				errs = append(errs, err)
+			}
+		case <-shutdownCtx.Done():
+			return errors.Join(append(errs, shutdownCtx.Err())...)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// serviceError returns the error of a Serve call, nil when it only
+// says the service was stopped
+func serviceError(res serviceResult) error {
+	err := res.err
+	if err == nil ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, ErrServerClosed) ||
+		errors.Is(err, http.ErrServerClosed) ||
+		errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return fmt.Errorf("%s: %w", serviceName(res.service), err)
+}
+
+// serviceName names s in errors and logs
+func serviceName(s Service) string {
+	if n, ok := s.(fmt.Stringer); ok {
+		return n.String()
+	}
+
+	return fmt.Sprintf("%T", s)
+}
+
+func TestRun(t *testing.T) {
+	l, pc := testListenerPair(t)
+	httpListener := testListener(t)
+
+	echo := func(ctx context.Context, conn net.Conn) {
+		stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+		defer stop()
+		_, _ = io.Copy(conn, conn)
+	}
+	udpEcho := func(_ context.Context, pc net.PacketConn, addr net.Addr, p []byte) {
+		_, _ = pc.WriteTo(p, addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, _ *http.Request) { _, _ = io.WriteString(w, "ok") })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Runner{Grace: time.Second, ErrorLog: log.New(io.Discard, "", 0)}
+	tcp := NewTCPServer(l)
+	tcp.ErrorLog = r.ErrorLog
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx,
+			TCPService("echo", tcp, echo),
+			PacketService("udp echo", pc, udpEcho),
+			HTTPService("http", &http.Server{Handler: mux}, httpListener),
+		)
+	}()
+
+	// All three are up
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("tcp"))
+	if b, err := ReadExactly(conn, 3); err != nil || string(b) != "tcp" {
+		t.Errorf("unexpected TCP echo %q, %v", b, err)
+	}
+
+	udp, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	_ = udp.SetDeadline(time.Now().Add(time.Second))
+	_, _ = udp.Write([]byte("udp"))
+	b := make([]byte, 3)
+	if n, err := udp.Read(b); err != nil || string(b[:n]) != "udp" {
+		t.Errorf("unexpected UDP echo %q, %v", b[:n], err)
+	}
+
+	resp, err := http.Get("http://" + httpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	// Stopping with a connection open: the TCP handler is canceled and
+	// Run returns cleanly, well within the grace period
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected a clean stop; actual: %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Run didn't return")
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	boom := errors.New("boom")
+	stopped := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	r := &Runner{Grace: 100 * time.Millisecond, ErrorLog: log.New(io.Discard, "", 0)}
+	err := r.Run(context.Background(),
+		NewService("failing", func(context.Context) error { return boom }, nil),
+		NewService("healthy", func(ctx context.Context) error {
+			<-ctx.Done()
+			close(stopped)
+			return ctx.Err()
+		}, nil),
+		NewService("stuck", func(context.Context) error {
+			<-release
+			return nil
+		}, nil),
+	)
+
+	// The failure stopped the healthy service; the stuck one ran out
+	// of time
+	<-stopped
+	if !errors.Is(err, boom) {
+		t.Errorf("expected boom; actual: %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "failing: boom") || !strings.Contains(msg, "1 service(s) still running") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// SCTP
+//
+// SCTP (RFC 9260) is the other reliable transport the kernel knows,
+// next to TCP: connection oriented too, but it carries messages rather
+// than a byte stream, and an association (its connection) has several
+// streams, ordered each on its own. A packet lost on one stream holds
+// up that stream only, where TCP holds up everything behind it. That's
+// what Mux (TLVMux.go) can't do over TCP, and what QUIC later brought
+// to UDP. Firewalls and NATs that know TCP and UDP only are why SCTP
+// lives on in telecom networks and WebRTC data channels (over DTLS over
+// UDP) rather than on the Internet.
+//
+// Go has no SCTP, so SCTPConn and SCTPListener make the socket calls
+// themselves, in the one-to-one style (SOCK_STREAM) that looks like
+// TCP: socket, bind, listen, accept and connect, with the file
+// descriptor handed to the runtime's poller through os.NewFile, so
+// that reads block a goroutine rather than a thread and deadlines work.
+// SCTPConn is a net.Conn: Write sends a message on stream 0, Read
+// reads the messages back to back. WriteStream and ReadStream pick and
+// report the stream.
+//
+// The number of streams is agreed on in the handshake: each side asks
+// for some and gets the smaller of its own and the peer's. A Mux over
+// an SCTPConn sends the frames of each of its streams on one SCTP
+// stream, so a loss only stalls the mux streams sharing it.
+//
+// Experimental, and linux only (but 386): the kernel needs the sctp module
+// (modprobe sctp), which containers often lack; elsewhere ListenSCTP
+// and DialSCTP fail with ErrSCTPUnsupported. Single homed: SCTP can
+// bind an association to several addresses and fail over between
+// them, which isn't done here. Nor is a half close, which SCTP
+// doesn't have: once one side shuts down, neither sends anymore.
+
+const (
+	defaultSCTPStreams = 16
+	maxSCTPStreams     = 1<<16 - 1
+)
+
+// ErrSCTPUnsupported means SCTP sockets can't be opened here
+var ErrSCTPUnsupported = errors.New("sctp: not supported on this platform")
+
+// SCTPAddr is the address of an SCTP endpoint
+type SCTPAddr struct {
+	IP   net.IP
+	Port int
+}
+
+// Network returns "sctp"
+func (a *SCTPAddr) Network() string {
+	return "sctp"
+}
+
+func (a *SCTPAddr) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
+}
+
+// SCTPConn is an SCTP association, one-to-one style
+type SCTPConn struct {
+	f            *os.File
+	laddr, raddr *SCTPAddr
+	streams      int // Outbound streams agreed on
+}
+
+// Read reads the next messages, whatever their stream; a message
+// larger than b is read in pieces
+func (c *SCTPConn) Read(b []byte) (int, error) {
+	return c.f.Read(b)
+}
+
+// Write sends b as one message on stream 0
+func (c *SCTPConn) Write(b []byte) (int, error) {
+	return c.f.Write(b)
+}
+
+// WriteStream sends b as one message on stream, below Streams()
+func (c *SCTPConn) WriteStream(b []byte, stream int) (int, error) {
+	if stream < 0 || stream >= c.streams {
+		return 0, fmt.Errorf("sctp: stream %d out of %d", stream, c.streams)
+	}
+	rc, err := c.f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	return sctpSend(rc, b, uint16(stream))
+}
+
+// ReadStream reads the next message, or the next piece of one larger
+// than b, and returns the stream it came on
+func (c *SCTPConn) ReadStream(b []byte) (n, stream int, err error) {
+	rc, err := c.f.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return sctpReceive(rc, b)
+}
+
+// Streams returns how many outbound streams the association has
+func (c *SCTPConn) Streams() int {
+	return c.streams
+}
+
+// Close shuts the association down gracefully: what was written is
+// still delivered
+func (c *SCTPConn) Close() error {
+	return c.f.Close()
+}
+
+func (c *SCTPConn) LocalAddr() net.Addr                { return c.laddr }
+func (c *SCTPConn) RemoteAddr() net.Addr               { return c.raddr }
+func (c *SCTPConn) SetDeadline(t time.Time) error      { return c.f.SetDeadline(t) }
+func (c *SCTPConn) SetReadDeadline(t time.Time) error  { return c.f.SetReadDeadline(t) }
+func (c *SCTPConn) SetWriteDeadline(t time.Time) error { return c.f.SetWriteDeadline(t) }
+
+// SCTPListener accepts SCTP associations
+type SCTPListener struct {
+	f     *os.File
+	laddr *SCTPAddr
+}
+
+// ListenSCTP listens on the address addr ("host:port"), offering
+// streams streams to each association, or defaultSCTPStreams when 0
+func ListenSCTP(addr string, streams int) (*SCTPListener, error) {
+	a, err := resolveSCTPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if streams, err = sctpStreams(streams); err != nil {
+		return nil, err
+	}
+
+	return listenSCTP(a, streams)
+}
+
+// Accept waits for the next association
+func (l *SCTPListener) Accept() (net.Conn, error) {
+	return l.AcceptSCTP()
+}
+
+// AcceptSCTP waits for the next association
+func (l *SCTPListener) AcceptSCTP() (*SCTPConn, error) {
+	rc, err := l.f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	return acceptSCTP(rc, l.laddr)
+}
+
+// Close stops listening; a pending Accept returns an error
+func (l *SCTPListener) Close() error {
+	return l.f.Close()
+}
+
+// Addr returns the address listened on
+func (l *SCTPListener) Addr() net.Addr {
+	return l.laddr
+}
+
+// DialSCTP connects to the address addr, asking for streams streams, or
+// defaultSCTPStreams when 0
+func DialSCTP(ctx context.Context, addr string, streams int) (*SCTPConn, error) {
+	a, err := resolveSCTPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if streams, err = sctpStreams(streams); err != nil {
+		return nil, err
+	}
+
+	return dialSCTP(ctx, a, streams)
+}
+
+func resolveSCTPAddr(addr string) (*SCTPAddr, error) {
+	// Same host:port syntax as TCP, only the protocol differs
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SCTPAddr{IP: a.IP, Port: a.Port}, nil
+}
+
+func sctpStreams(streams int) (int, error) {
+	switch {
+	case streams == 0:
+		return defaultSCTPStreams, nil
+	case streams < 0 || streams > maxSCTPStreams:
+		return 0, fmt.Errorf("sctp: %d streams out of 1-%d", streams, maxSCTPStreams)
+	}
+
+	return streams, nil
+}
+
+// sctpPair returns both ends of an association over loopback, skipping
+// the test where SCTP isn't available
+func sctpPair(tb testing.TB, clientStreams, serverStreams int) (client, server *SCTPConn) {
+	tb.Helper()
+
+	l, err := ListenSCTP("127.0.0.1:0", serverStreams)
+	if errors.Is(err, ErrSCTPUnsupported) || errors.Is(err, syscall.EPROTONOSUPPORT) {
+		tb.Skip("no SCTP here:", err)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan *SCTPConn, 1)
+	go func() {
+		conn, _ := l.AcceptSCTP()
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err = DialSCTP(ctx, l.Addr().String(), clientStreams)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		_ = client.Close()
+		tb.Fatal("no association accepted")
+	}
+	tb.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+func TestSCTP(t *testing.T) {
+	client, server := sctpPair(t, 4, 10)
+
+	// Each side gets the smaller of the two
+	if client.Streams() != 4 || server.Streams() != 4 {
+		t.Errorf("expected 4 streams each way; actual: %d and %d", client.Streams(), server.Streams())
+	}
+	if _, err := client.WriteStream([]byte("x"), 4); err == nil {
+		t.Error("expected stream 4 to be out of range")
+	}
+
+	// Messages keep their boundaries and their stream
+	messages := []string{"zero", "Clear is better than clever.", "three"}
+	for i, stream := range []int{0, 1, 3} {
+		if _, err := client.WriteStream([]byte(messages[i]), stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 1024)
+	for i, expected := range []int{0, 1, 3} {
+		n, stream, err := server.ReadStream(buf)
+		if err != nil || stream != expected || string(buf[:n]) != messages[i] {
+			t.Errorf("expected %q on stream %d; actual: %q on %d, %v", messages[i], expected, buf[:n], stream, err)
+		}
+	}
+
+	// And the plain net.Conn methods on stream 0
+	if _, err := server.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := ReadExactly(client, 5); err != nil || string(reply) != "reply" {
+		t.Errorf("unexpected reply %q, %v", reply, err)
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := server.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected a timeout; actual: %v", err)
+	}
+
+	_ = client.Close()
+	_ = server.SetReadDeadline(time.Time{})
+	if _, err := server.Read(buf); err != io.EOF {
+		t.Errorf("expected io.EOF once the client closed; actual: %v", err)
+	}
+}
+
+func TestSCTPMux(t *testing.T) {
+	c, s := sctpPair(t, 0, 0)
+	client, server := NewMux(c, true), NewMux(s, false)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				_, _ = io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	// Each mux stream rides an SCTP stream of its own
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+
+			data := bytes.Repeat([]byte{byte(i)}, 100_000)
+			if _, err := stream.Write(data); err != nil {
+				t.Error(err)
+				return
+			}
+			_ = stream.CloseWrite()
+			if echo, err := io.ReadAll(stream); err != nil || !bytes.Equal(echo, data) {
+				t.Errorf("stream %d: unexpected echo of %d bytes, %v", stream.ID(), len(echo), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// benchMux echoes small messages over a Mux over conns, a stream per
+// goroutine
+func benchMux(b *testing.B, c, s net.Conn) {
+	client, server := NewMux(c, true), NewMux(s, false)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				_, _ = io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		stream, err := client.Open()
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer stream.Close()
+
+		msg := make([]byte, 64)
+		for pb.Next() {
+			if _, err := stream.Write(msg); err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err := io.ReadFull(stream, msg); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkMuxTCP echoes over a Mux over TCP
+func BenchmarkMuxTCP(b *testing.B) {
+	l := testListener(b)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		b.Fatal("no connection")
+	}
+
+	benchMux(b, c, s)
+}
+
+// BenchmarkMuxSCTP echoes over a Mux over SCTP
+func BenchmarkMuxSCTP(b *testing.B) {
+	c, s := sctpPair(b, 0, 0)
+	benchMux(b, c, s)
+}
@@ -0,0 +1,293 @@
+//go:build linux && !386
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// SCTP socket options and control messages from linux/sctp.h, which
+// package syscall is missing
+const (
+	sctpInitMsg     = 2  // SCTP_INITMSG: streams asked for
+	sctpStatus      = 14 // SCTP_STATUS: streams agreed on, among others
+	sctpRecvRcvInfo = 32 // SCTP_RECVRCVINFO: a sctpRcvInfo with every message
+
+	sctpSndInfo = 2 // SCTP_SNDINFO control message: struct sctp_sndinfo
+	sctpRcvInfo = 3 // SCTP_RCVINFO control message: struct sctp_rcvinfo
+
+	sctpSndInfoSize = 16
+	sctpRcvInfoSize = 28
+	sctpStatusSize  = 176
+)
+
+// sctpSocket opens a non-blocking SCTP socket for addresses like a,
+// asking for streams streams each way
+func sctpSocket(a *SCTPAddr, streams int) (int, error) {
+	family := syscall.AF_INET
+	if a.IP != nil && a.IP.To4() == nil {
+		family = syscall.AF_INET6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+
+	// struct sctp_initmsg: outbound streams, inbound streams at most,
+	// and the INIT retries and timeout, left to the defaults
+	var init [8]byte
+	binary.NativeEndian.PutUint16(init[0:], uint16(streams))
+	binary.NativeEndian.PutUint16(init[2:], uint16(streams))
+	if err := syscall.SetsockoptString(fd, syscall.IPPROTO_SCTP, sctpInitMsg, string(init[:])); err != nil {
+		_ = syscall.Close(fd)
+		return -1, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_SCTP, sctpRecvRcvInfo, 1); err != nil {
+		_ = syscall.Close(fd)
+		return -1, os.NewSyscallError("setsockopt", err)
+	}
+
+	return fd, nil
+}
+
+func listenSCTP(a *SCTPAddr, streams int) (*SCTPListener, error) {
+	fd, err := sctpSocket(a, streams)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, sctpSockaddr(a)); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+
+	return &SCTPListener{f: os.NewFile(uintptr(fd), "sctp"), laddr: sctpAddrOf(sa)}, nil
+}
+
+func acceptSCTP(rc syscall.RawConn, laddr *SCTPAddr) (*SCTPConn, error) {
+	var fd int
+	var sa syscall.Sockaddr
+	var acceptErr error
+	err := rc.Read(func(lfd uintptr) bool {
+		fd, sa, acceptErr = syscall.Accept4(int(lfd), syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		return acceptErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, os.NewSyscallError("accept", acceptErr)
+	}
+	// Not every option is inherited from the listening socket
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_SCTP, sctpRecvRcvInfo, 1); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	return newSCTPConn(fd, laddr, sctpAddrOf(sa))
+}
+
+func dialSCTP(ctx context.Context, a *SCTPAddr, streams int) (*SCTPConn, error) {
+	fd, err := sctpSocket(a, streams)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Connect(fd, sctpSockaddr(a)); err != nil && err != syscall.EINPROGRESS {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+
+	// The handshake goes on in the background; the socket turns
+	// writable once it's over, one way or the other
+	f := os.NewFile(uintptr(fd), "sctp")
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = f.SetWriteDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = f.SetWriteDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	var connectErr error
+	err = rc.Write(func(fd uintptr) bool {
+		var errno int
+		errno, connectErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if connectErr == nil && errno != 0 {
+			connectErr = syscall.Errno(errno)
+		}
+		if connectErr != nil {
+			return true
+		}
+		_, connectErr = syscall.Getpeername(int(fd))
+		return connectErr != syscall.ENOTCONN
+	})
+	if err == nil && connectErr != nil {
+		err = os.NewSyscallError("connect", connectErr)
+	}
+	if err != nil {
+		_ = f.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	_ = f.SetWriteDeadline(time.Time{})
+
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		_ = f.Close()
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	streams, err = sctpOutStreams(rc)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &SCTPConn{f: f, laddr: sctpAddrOf(sa), raddr: a, streams: streams}, nil
+}
+
+// newSCTPConn hands an accepted socket to the poller
+func newSCTPConn(fd int, laddr, raddr *SCTPAddr) (*SCTPConn, error) {
+	f := os.NewFile(uintptr(fd), "sctp")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	streams, err := sctpOutStreams(rc)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	return &SCTPConn{f: f, laddr: laddr, raddr: raddr, streams: streams}, nil
+}
+
+// sctpOutStreams reads the number of outbound streams agreed on from
+// struct sctp_status, which package syscall has no getsockopt for
+func sctpOutStreams(rc syscall.RawConn) (int, error) {
+	var status [sctpStatusSize]byte
+	size := uint32(len(status))
+	var errno syscall.Errno
+	err := rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_SCTP, sctpStatus,
+			uintptr(unsafe.Pointer(&status[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError("getsockopt", errno)
+	}
+
+	// assoc id (4) | state (4) | rwnd (4) | unacked (2) | pending (2) |
+	// in streams (2) | out streams (2) | ...
+	return int(binary.NativeEndian.Uint16(status[18:])), nil
+}
+
+// sctpSend sends b as one message on stream, with an SCTP_SNDINFO
+// control message
+func sctpSend(rc syscall.RawConn, b []byte, stream uint16) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(sctpSndInfoSize))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_SCTP
+	h.Type = sctpSndInfo
+	h.SetLen(syscall.CmsgLen(sctpSndInfoSize))
+	// struct sctp_sndinfo: stream, flags, ppid, context, assoc id
+	binary.NativeEndian.PutUint16(oob[syscall.CmsgLen(0):], stream)
+
+	var n int
+	var sendErr error
+	err := rc.Write(func(fd uintptr) bool {
+		n, sendErr = syscall.SendmsgN(int(fd), b, oob, nil, 0)
+		return sendErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sendErr != nil {
+		return 0, os.NewSyscallError("sendmsg", sendErr)
+	}
+
+	return n, nil
+}
+
+// sctpReceive reads a message, and its stream from the SCTP_RCVINFO
+// control message
+func sctpReceive(rc syscall.RawConn, b []byte) (n, stream int, err error) {
+	oob := make([]byte, syscall.CmsgSpace(sctpRcvInfoSize))
+	var oobn int
+	var recvErr error
+	err = rc.Read(func(fd uintptr) bool {
+		n, oobn, _, _, recvErr = syscall.Recvmsg(int(fd), b, oob, 0)
+		return recvErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if recvErr != nil {
+		return 0, 0, os.NewSyscallError("recvmsg", recvErr)
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, 0, io.EOF
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, 0, err
+	}
+	for _, m := range msgs {
+		// struct sctp_rcvinfo: stream first
+		if m.Header.Level == syscall.IPPROTO_SCTP && m.Header.Type == sctpRcvInfo && len(m.Data) >= 2 {
+			return n, int(binary.NativeEndian.Uint16(m.Data)), nil
+		}
+	}
+
+	return n, 0, errors.New("sctp: message without its stream")
+}
+
+func sctpSockaddr(a *SCTPAddr) syscall.Sockaddr {
+	if a.IP != nil && a.IP.To4() == nil {
+		sa := &syscall.SockaddrInet6{Port: a.Port}
+		copy(sa.Addr[:], a.IP.To16())
+		return sa
+	}
+
+	sa := &syscall.SockaddrInet4{Port: a.Port}
+	if ip := a.IP.To4(); ip != nil {
+		copy(sa.Addr[:], ip)
+	}
+
+	return sa
+}
+
+func sctpAddrOf(sa syscall.Sockaddr) *SCTPAddr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &SCTPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		return &SCTPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}
+	}
+
+	return &SCTPAddr{}
+}
@@ -0,0 +1,33 @@
+//go:build !linux || 386
+
+package main
+
+import (
+	"context"
+	"syscall"
+)
+
+// listenSCTP fails: SCTP sockets are only opened on linux, see SCTP.go
+func listenSCTP(*SCTPAddr, int) (*SCTPListener, error) {
+	return nil, ErrSCTPUnsupported
+}
+
+// acceptSCTP fails, like listenSCTP
+func acceptSCTP(syscall.RawConn, *SCTPAddr) (*SCTPConn, error) {
+	return nil, ErrSCTPUnsupported
+}
+
+// dialSCTP fails, like listenSCTP
+func dialSCTP(context.Context, *SCTPAddr, int) (*SCTPConn, error) {
+	return nil, ErrSCTPUnsupported
+}
+
+// sctpSend fails, like listenSCTP
+func sctpSend(syscall.RawConn, []byte, uint16) (int, error) {
+	return 0, ErrSCTPUnsupported
+}
+
+// sctpReceive fails, like listenSCTP
+func sctpReceive(syscall.RawConn, []byte) (int, int, error) {
+	return 0, 0, ErrSCTPUnsupported
+}
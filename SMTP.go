@@ -0,0 +1,845 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SMTP client and email alerts
+//
+// SMTP is the oldest text protocol still carrying traffic, and looks
+// it: a command per line, a reply per command, a three digit code
+// first. Sending a message goes like this (C is the client, S the
+// server):
+//
+//	S: 220 mail.example.com ESMTP
+//	C: EHLO monitor.example.com
+//	S: 250-mail.example.com
+//	S: 250-STARTTLS
+//	S: 250 AUTH PLAIN LOGIN
+//	C: STARTTLS
+//	S: 220 go ahead
+//	   (TLS handshake, then EHLO again over TLS)
+//	C: AUTH PLAIN AGFsZXJ0cwBzZWNyZXQ=
+//	S: 235 authenticated
+//	C: MAIL FROM:<alerts@example.com>
+//	S: 250 ok
+//	C: RCPT TO:<oncall@example.com>
+//	S: 250 ok
+//	C: DATA
+//	S: 354 end with .
+//	C: (the message, headers and body)
+//	C: .
+//	S: 250 queued
+//	C: QUIT
+//
+// A reply continues over several lines with a dash after the code. The
+// message ends with a line holding a single dot, so lines of the
+// message starting with a dot get another one, which the server takes
+// off: dot-stuffing.
+//
+// 2xx means done, 3xx go on, 4xx try again later (a full queue, a
+// greylisted sender) and 5xx don't bother. SMTPClient retries the 4xx
+// and the network errors with its RetryPolicy, and gives up on the 5xx
+// right away. Once the message is sent, a failure isn't retried: the
+// server may have queued it, and an alert twice is worse than late.
+//
+// The client upgrades to TLS with STARTTLS (or starts with it, on port
+// 465, with ImplicitTLS), and refuses to go on, credentials or not,
+// with a server that doesn't offer it, unless AllowPlaintext says so.
+// It authenticates with AUTH PLAIN, or AUTH LOGIN for the servers that
+// only know that one.
+//
+// Alerter sends alert emails with it: when an upstream of a reverse
+// proxy goes down or comes back (ReverseProxy.OnHealthChange), when a
+// probed target starts failing or recovers (Prober.OnChange), at most
+// one per subject every Interval, in the background so the proxy never
+// waits for a mail server.
+
+const (
+	defaultSMTPTimeout   = 30 * time.Second
+	defaultAlertInterval = 10 * time.Minute
+	defaultAlertTimeout  = 2 * time.Minute // For all the attempts of an alert
+	smtpMaxLine          = 4096
+)
+
+// ErrSMTPNoTLS is returned when the server doesn't offer STARTTLS and
+// the client may not go on without it
+var ErrSMTPNoTLS = errors.New("smtp: server doesn't offer STARTTLS")
+
+// SMTPError is a reply refusing a command
+type SMTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *SMTPError) Error() string {
+	return fmt.Sprintf("smtp: %d %s", e.Code, e.Message)
+}
+
+// Temporary reports whether trying again later may succeed
+func (e *SMTPError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// SMTPClient sends messages through a mail server
+type SMTPClient struct {
+	Addr  string // host:port, usually port 587 (submission)
+	Hello string // Name given in EHLO, the host name by default
+
+	// TLS configures the handshake; ServerName defaults to Addr's host
+	TLS *tls.Config
+
+	// ImplicitTLS starts with TLS (port 465) rather than STARTTLS
+	ImplicitTLS bool
+
+	// AllowPlaintext goes on without TLS when STARTTLS isn't offered,
+	// sending the credentials in the clear
+	AllowPlaintext bool
+
+	// Username and Password, when set, authenticate
+	Username, Password string
+
+	Timeout time.Duration // Per attempt, 30s by default
+	Retry   RetryPolicy
+	Dialer  *net.Dialer
+}
+
+// Send sends msg, headers and body, from the address from to those in
+// to. The lines of msg may end with LF or CRLF.
+func (c *SMTPClient) Send(ctx context.Context, from string, to []string, msg []byte) error {
+	if err := checkSMTPAddrs(from, to); err != nil {
+		return err
+	}
+
+	policy := c.Retry
+	policy.Retryable = func(err error) bool {
+		var smtpErr *SMTPError
+		if errors.As(err, &smtpErr) {
+			return smtpErr.Temporary()
+		}
+		return IsTransient(err)
+	}
+	if policy.Name == "" {
+		policy.Name = "smtp"
+	}
+
+	return policy.Do(ctx, func(ctx context.Context) error {
+		return c.send(ctx, from, to, msg)
+	})
+}
+
+// smtpConn reads replies and writes commands
+type smtpConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// reply reads a reply, every line of it
+func (c *smtpConn) reply() (int, []string, error) {
+	var lines []string
+	for {
+		line, err := c.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return 0, nil, fmt.Errorf("smtp: reply %w", ErrLineTooLong)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		text := strings.TrimRight(string(line), "\r\n")
+		if len(text) < 3 {
+			return 0, nil, fmt.Errorf("smtp: invalid reply %q", text)
+		}
+		code, err := strconv.Atoi(text[:3])
+		if err != nil || code < 200 || code > 599 {
+			return 0, nil, fmt.Errorf("smtp: invalid reply %q", text)
+		}
+		lines = append(lines, strings.TrimSpace(text[3:]))
+
+		// "250-more to come", "250 the end" or just "250"
+		if len(text) == 3 || text[3] == ' ' {
+			return code, lines, nil
+		}
+		if text[3] != '-' {
+			return 0, nil, fmt.Errorf("smtp: invalid reply %q", text)
+		}
+		lines[len(lines)-1] = text[4:]
+	}
+}
+
+// cmd sends a command and reads its reply, an SMTPError unless its code
+// is one of expected
+func (c *smtpConn) cmd(expected []int, format string, v ...any) ([]string, error) {
+	if format != "" {
+		if _, err := fmt.Fprintf(c.conn, format+"\r\n", v...); err != nil {
+			return nil, err
+		}
+	}
+	code, lines, err := c.reply()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(expected, code) {
+		return nil, &SMTPError{Code: code, Message: strings.Join(lines, " ")}
+	}
+
+	return lines, nil
+}
+
+// hello sends EHLO and returns the extensions of the server, keywords
+// upper case, or sends HELO to a server not speaking ESMTP
+func (c *smtpConn) hello(name string) (map[string]string, error) {
+	lines, err := c.cmd([]int{250}, "EHLO %s", name)
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) && !smtpErr.Temporary() {
+		_, err = c.cmd([]int{250}, "HELO %s", name)
+		return map[string]string{}, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The first line is the server's greeting
+	ext := make(map[string]string)
+	for _, line := range lines[1:] {
+		keyword, params, _ := strings.Cut(line, " ")
+		ext[strings.ToUpper(keyword)] = params
+	}
+
+	return ext, nil
+}
+
+func (c *SMTPClient) hello() string {
+	if c.Hello != "" {
+		return c.Hello
+	}
+	if host, err := os.Hostname(); err == nil && host != "" && !strings.ContainsAny(host, " \r\n") {
+		return host
+	}
+	return "localhost"
+}
+
+func (c *SMTPClient) tlsConfig() (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(tls.Config)
+	if c.TLS != nil {
+		cfg = c.TLS.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+
+	return cfg, nil
+}
+
+// send runs a single attempt
+func (c *SMTPClient) send(ctx context.Context, from string, to []string, msg []byte) error {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultSMTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return Permanent(err)
+	}
+
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = new(net.Dialer)
+	}
+	var conn net.Conn
+	if c.ImplicitTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", c.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	// The deadline covers the whole exchange, and cancellation
+	// interrupts it; after STARTTLS, conn is the TLS connection
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	sc := &smtpConn{conn: conn, r: bufio.NewReaderSize(conn, smtpMaxLine)}
+	if _, err := sc.cmd([]int{220}, ""); err != nil {
+		return err
+	}
+	ext, err := sc.hello(c.hello())
+	if err != nil {
+		return err
+	}
+
+	if !c.ImplicitTLS {
+		if _, ok := ext["STARTTLS"]; ok {
+			if _, err := sc.cmd([]int{220}, "STARTTLS"); err != nil {
+				return err
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				return Permanent(fmt.Errorf("smtp: %w", err))
+			}
+			conn = tlsConn
+			// What was said before TLS can't be trusted: ask again
+			sc = &smtpConn{conn: conn, r: bufio.NewReaderSize(conn, smtpMaxLine)}
+			if ext, err = sc.hello(c.hello()); err != nil {
+				return err
+			}
+		} else if !c.AllowPlaintext {
+			return Permanent(ErrSMTPNoTLS)
+		}
+	}
+
+	if c.Username != "" {
+		if err := c.auth(sc, ext["AUTH"]); err != nil {
+			return err
+		}
+	}
+
+	if _, err := sc.cmd([]int{250}, "MAIL FROM:<%s>", from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if _, err := sc.cmd([]int{250, 251}, "RCPT TO:<%s>", rcpt); err != nil {
+			return err
+		}
+	}
+	if _, err := sc.cmd([]int{354}, "DATA"); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(conn)
+	if err := dotStuff(w, msg); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	// The message is out: whatever happens now, sending it again may
+	// deliver it twice
+	if _, err := sc.cmd([]int{250}, ""); err != nil {
+		var smtpErr *SMTPError
+		if errors.As(err, &smtpErr) {
+			return err
+		}
+		return Permanent(err)
+	}
+	_, _ = sc.cmd([]int{221}, "QUIT")
+
+	return nil
+}
+
+// auth authenticates with the first mechanism of the server's that the
+// client knows
+func (c *SMTPClient) auth(sc *smtpConn, mechanisms string) error {
+	offered := strings.Fields(strings.ToUpper(mechanisms))
+	switch {
+	case slices.Contains(offered, "PLAIN"):
+		// The authorization identity (empty: the same), the user and
+		// the password, NUL separated
+		creds := base64.StdEncoding.EncodeToString([]byte("\x00" + c.Username + "\x00" + c.Password))
+		_, err := sc.cmd([]int{235}, "AUTH PLAIN %s", creds)
+		return authError(err)
+	case slices.Contains(offered, "LOGIN"):
+		// The server asks for the user name, then the password,
+		// base64 encoded both ways
+		if _, err := sc.cmd([]int{334}, "AUTH LOGIN"); err != nil {
+			return authError(err)
+		}
+		if _, err := sc.cmd([]int{334}, "%s", base64.StdEncoding.EncodeToString([]byte(c.Username))); err != nil {
+			return authError(err)
+		}
+		_, err := sc.cmd([]int{235}, "%s", base64.StdEncoding.EncodeToString([]byte(c.Password)))
+		return authError(err)
+	}
+
+	return Permanent(fmt.Errorf("smtp: no supported authentication mechanism in %q", mechanisms))
+}
+
+// authError makes a refused authentication permanent: the credentials
+// won't be any better next time
+func authError(err error) error {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) && !smtpErr.Temporary() {
+		return Permanent(err)
+	}
+	return err
+}
+
+// dotStuff writes msg as the data of a DATA command: lines ending with
+// CRLF, a dot doubled at the start of a line, and the final dot
+func dotStuff(w io.Writer, msg []byte) error {
+	bw := bufio.NewWriter(w)
+	for len(msg) > 0 {
+		line, rest, _ := bytes.Cut(msg, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if bytes.HasPrefix(line, []byte(".")) {
+			_ = bw.WriteByte('.')
+		}
+		_, _ = bw.Write(line)
+		_, _ = bw.WriteString("\r\n")
+		msg = rest
+	}
+	_, _ = bw.WriteString(".\r\n")
+
+	return bw.Flush()
+}
+
+// checkSMTPAddrs rejects what would break out of a command or header:
+// a CR or LF, or the brackets around an address
+func checkSMTPAddrs(from string, to []string) error {
+	if len(to) == 0 {
+		return errors.New("smtp: no recipients")
+	}
+	for _, addr := range append([]string{from}, to...) {
+		if strings.ContainsAny(addr, "<>\r\n") {
+			return fmt.Errorf("smtp: invalid address %q", addr)
+		}
+	}
+
+	return nil
+}
+
+// NewSMTPMessage returns a plain text message with the headers mail
+// servers expect, the subject encoded when it isn't ASCII and the body
+// quoted-printable, safe through any server. It checks the addresses
+// like Send, so none can add headers.
+func NewSMTPMessage(from string, to []string, subject, body string) ([]byte, error) {
+	if err := checkSMTPAddrs(from, to); err != nil {
+		return nil, err
+	}
+
+	var id [12]byte
+	_, _ = rand.Read(id[:])
+	domain := "localhost"
+	if _, d, ok := strings.Cut(from, "@"); ok {
+		domain = d
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id[:]), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&b)
+	_, _ = qp.Write([]byte(body))
+	_ = qp.Close()
+	b.WriteString("\r\n")
+
+	return b.Bytes(), nil
+}
+
+// Alerter sends alert emails through an SMTPClient
+type Alerter struct {
+	SMTP *SMTPClient
+	From string
+	To   []string
+
+	// Interval is the minimum time between two alerts of the same
+	// subject, 10 minutes by default: a flapping upstream doesn't fill
+	// the inbox
+	Interval time.Duration
+
+	// ErrorLog receives the alerts that couldn't be sent
+	ErrorLog *log.Logger
+
+	mu      sync.Mutex
+	sent    map[string]time.Time // Subjects, when last sent
+	sending sync.WaitGroup
+}
+
+func (a *Alerter) logf(format string, v ...any) {
+	if a.ErrorLog != nil {
+		a.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Alert sends an email in the background, unless one of the same
+// subject was sent less than Interval ago. It reports whether it did.
+func (a *Alerter) Alert(subject, body string) bool {
+	interval := a.Interval
+	if interval <= 0 {
+		interval = defaultAlertInterval
+	}
+
+	a.mu.Lock()
+	if a.sent == nil {
+		a.sent = make(map[string]time.Time)
+	}
+	if last, ok := a.sent[subject]; ok && time.Since(last) < interval {
+		a.mu.Unlock()
+		return false
+	}
+	a.sent[subject] = time.Now()
+	a.mu.Unlock()
+
+	a.sending.Add(1)
+	go func() {
+		defer a.sending.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), defaultAlertTimeout)
+		defer cancel()
+		msg, err := NewSMTPMessage(a.From, a.To, subject, body)
+		if err == nil {
+			err = a.SMTP.Send(ctx, a.From, a.To, msg)
+		}
+		if err != nil {
+			a.logf("alert %q: %v", subject, err)
+		}
+	}()
+
+	return true
+}
+
+// Wait waits for the alerts being sent
+func (a *Alerter) Wait() {
+	a.sending.Wait()
+}
+
+// UpstreamHealth alerts about an upstream going down or coming back,
+// for ReverseProxy.OnHealthChange
+func (a *Alerter) UpstreamHealth(u *Upstream, healthy bool) {
+	state := "down"
+	if healthy {
+		state = "up"
+	}
+	a.Alert(fmt.Sprintf("upstream %s is %s", u.URL, state),
+		fmt.Sprintf("The upstream %s was marked %s at %s.\n", u.URL, state, time.Now().Format(time.RFC3339)))
+}
+
+// ProbeChange alerts about a probed target failing or recovering, for
+// Prober.OnChange
+func (a *Alerter) ProbeChange(target string, err error) {
+	if err != nil {
+		a.Alert(fmt.Sprintf("%s is failing", target),
+			fmt.Sprintf("Probing %s failed at %s: %v\n", target, time.Now().Format(time.RFC3339), err))
+		return
+	}
+	a.Alert(fmt.Sprintf("%s recovered", target),
+		fmt.Sprintf("Probing %s succeeded again at %s.\n", target, time.Now().Format(time.RFC3339)))
+}
+
+// smtpTestServer is a mail server for the tests, with STARTTLS and
+// authentication
+type smtpTestServer struct {
+	addr     string
+	tls      *tls.Config // STARTTLS offered when set
+	auth     string      // Mechanisms offered, "" for none
+	user     string      // "user:password" to accept
+	tempFail int         // RCPTs refused with a 451
+	reject   bool        // Every RCPT refused with a 550
+
+	mu       sync.Mutex
+	sessions int
+	messages []smtpTestMessage
+}
+
+type smtpTestMessage struct {
+	From string
+	To   []string
+	Data string // As received, unstuffed
+	TLS  bool
+}
+
+func newSMTPTestServer(t *testing.T, s *smtpTestServer) *smtpTestServer {
+	t.Helper()
+
+	l := testListener(t)
+	s.addr = l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+// set changes the settings of the sessions to come
+func (s *smtpTestServer) set(f func(s *smtpTestServer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func (s *smtpTestServer) sessionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions
+}
+
+func (s *smtpTestServer) received() []smtpTestMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.messages)
+}
+
+func (s *smtpTestServer) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	// The settings as they are when the session starts
+	s.mu.Lock()
+	s.sessions++
+	auth, user, reject := s.auth, s.user, s.reject
+	s.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	reply := func(format string, v ...any) { fmt.Fprintf(conn, format+"\r\n", v...) }
+	line := func() string {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return "QUIT"
+		}
+		return strings.TrimRight(l, "\r\n")
+	}
+
+	var m smtpTestMessage
+	authenticated := user == ""
+	reply("220 test ESMTP")
+	for {
+		cmd := line()
+		verb, arg, _ := strings.Cut(cmd, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-test greets %s", arg)
+			if s.tls != nil && !m.TLS {
+				reply("250-STARTTLS")
+			}
+			if auth != "" {
+				reply("250-AUTH %s", auth)
+			}
+			reply("250 8BITMIME")
+		case "STARTTLS":
+			reply("220 go ahead")
+			tlsConn := tls.Server(conn, s.tls)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, r, m.TLS = tlsConn, bufio.NewReader(tlsConn), true
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			var creds string
+			switch mechanism {
+			case "PLAIN":
+				b, _ := base64.StdEncoding.DecodeString(initial)
+				creds = strings.Replace(strings.TrimPrefix(string(b), "\x00"), "\x00", ":", 1)
+			case "LOGIN":
+				reply("334 VXNlcm5hbWU6")
+				user, _ := base64.StdEncoding.DecodeString(line())
+				reply("334 UGFzc3dvcmQ6")
+				password, _ := base64.StdEncoding.DecodeString(line())
+				creds = string(user) + ":" + string(password)
+			}
+			if creds != user || !m.TLS {
+				reply("535 authentication failed")
+				continue
+			}
+			authenticated = true
+			reply("235 authenticated")
+		case "MAIL":
+			if !authenticated {
+				reply("530 authentication required")
+				continue
+			}
+			m.From = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			reply("250 ok")
+		case "RCPT":
+			s.mu.Lock()
+			fail := s.tempFail > 0
+			if fail {
+				s.tempFail--
+			}
+			s.mu.Unlock()
+			switch {
+			case fail:
+				reply("451 try again later")
+			case reject:
+				reply("550 no such user")
+			default:
+				m.To = append(m.To, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+				reply("250 ok")
+			}
+		case "DATA":
+			reply("354 end with .")
+			var data strings.Builder
+			for l := line(); l != "."; l = line() {
+				data.WriteString(strings.TrimPrefix(l, ".") + "\n")
+			}
+			m.Data = data.String()
+			s.mu.Lock()
+			s.messages = append(s.messages, m)
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("500 unknown command")
+		}
+	}
+}
+
+func TestDotStuff(t *testing.T) {
+	for in, expected := range map[string]string{
+		"":                     ".\r\n",
+		"hello":                "hello\r\n.\r\n",
+		"a\nb\r\n":             "a\r\nb\r\n.\r\n",
+		".\n..x\nend.":         "..\r\n...x\r\nend.\r\n.\r\n",
+		"line\r\n.\r\nsneaky":  "line\r\n..\r\nsneaky\r\n.\r\n",
+		"trailing blank\n\n\n": "trailing blank\r\n\r\n\r\n.\r\n",
+	} {
+		var b bytes.Buffer
+		if err := dotStuff(&b, []byte(in)); err != nil || b.String() != expected {
+			t.Errorf("%q: expected %q; actual: %q, %v", in, expected, b.String(), err)
+		}
+	}
+}
+
+func TestSMTPClient(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := ca.Issue(TLSLeaf{Name: "mail", Hosts: []string{"127.0.0.1"}})
+
+	s := newSMTPTestServer(t, &smtpTestServer{
+		tls: ServerConfig(cert, nil), auth: "PLAIN LOGIN", user: "alerts:secret", tempFail: 1,
+	})
+	c := &SMTPClient{
+		Addr: s.addr, Hello: "monitor.test", TLS: ClientConfig(ca.Pool()),
+		Username: "alerts", Password: "secret",
+		Timeout: 5 * time.Second, Retry: RetryPolicy{Attempts: 2, Initial: time.Millisecond},
+	}
+
+	ctx := context.Background()
+	msg, err := NewSMTPMessage("alerts@example.com", []string{"oncall@example.com"}, "Ünïcode subject", "First line\n.hidden\nLast line\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(ctx, "alerts@example.com", []string{"oncall@example.com"}, msg); err != nil {
+		t.Fatal(err)
+	}
+	messages := s.received()
+	if len(messages) != 1 || s.sessionCount() != 2 {
+		t.Fatalf("expected a message in the second session (after a 451); actual: %d in %d", len(messages), s.sessionCount())
+	}
+	m := messages[0]
+	if m.From != "alerts@example.com" || !slices.Equal(m.To, []string{"oncall@example.com"}) || !m.TLS ||
+		!strings.Contains(m.Data, "\n\nFirst line\n.hidden\nLast line\n") ||
+		!strings.Contains(m.Data, "Subject: =?utf-8?q?=C3=9Cn=C3=AFcode_subject?=\n") {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	// AUTH LOGIN only
+	s.set(func(s *smtpTestServer) { s.auth = "LOGIN" })
+	if err := c.Send(ctx, "alerts@example.com", []string{"oncall@example.com"}, []byte("Subject: login\n\nhi\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refused for good: no retry
+	s.set(func(s *smtpTestServer) { s.reject = true })
+	sessions := s.sessionCount()
+	var smtpErr *SMTPError
+	if err := c.Send(ctx, "alerts@example.com", []string{"nobody@example.com"}, msg); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("expected a 550; actual: %v", err)
+	}
+	if n := s.sessionCount() - sessions; n != 1 {
+		t.Errorf("expected a single attempt; actual: %d", n)
+	}
+	s.set(func(s *smtpTestServer) { s.reject = false })
+
+	// Wrong password
+	c.Password = "guess"
+	if err := c.Send(ctx, "alerts@example.com", []string{"oncall@example.com"}, msg); !errors.As(err, &smtpErr) || smtpErr.Code != 535 {
+		t.Errorf("expected a 535; actual: %v", err)
+	}
+
+	// No STARTTLS: the credentials stay home
+	plain := newSMTPTestServer(t, &smtpTestServer{})
+	c = &SMTPClient{Addr: plain.addr, Username: "alerts", Password: "secret", Timeout: 5 * time.Second}
+	if err := c.Send(ctx, "alerts@example.com", []string{"oncall@example.com"}, msg); !errors.Is(err, ErrSMTPNoTLS) {
+		t.Errorf("expected ErrSMTPNoTLS; actual: %v", err)
+	}
+	c.Username, c.AllowPlaintext = "", true
+	if err := c.Send(ctx, "alerts@example.com", []string{"oncall@example.com"}, msg); err != nil || len(plain.received()) != 1 {
+		t.Errorf("expected a plaintext message; actual: %v", err)
+	}
+
+	if err := c.Send(ctx, "alerts@example.com>\r\nRCPT TO:<x", []string{"oncall@example.com"}, msg); err == nil {
+		t.Error("expected an invalid address to fail")
+	}
+	for _, to := range [][]string{{"oncall@example.com\r\nBcc: eve@example.com"}, {"a@example.com", "b@example.com\n"}} {
+		if _, err := NewSMTPMessage("alerts@example.com", to, "subject", "body"); err == nil {
+			t.Errorf("%q: expected a header injection to fail", to)
+		}
+	}
+	if _, err := NewSMTPMessage("alerts@example.com\r\nBcc: eve@example.com", []string{"oncall@example.com"}, "subject", "body"); err == nil {
+		t.Error("expected a header injection to fail")
+	}
+}
+
+func TestAlerter(t *testing.T) {
+	s := newSMTPTestServer(t, &smtpTestServer{})
+	a := &Alerter{
+		SMTP: &SMTPClient{Addr: s.addr, AllowPlaintext: true, Timeout: 5 * time.Second},
+		From: "alerts@example.com",
+		To:   []string{"oncall@example.com", "boss@example.com"},
+	}
+
+	u, _ := NewUpstream("http://10.0.0.1:8080")
+	a.UpstreamHealth(u, false)
+	a.UpstreamHealth(u, false) // Within Interval
+	a.UpstreamHealth(u, true)
+	a.ProbeChange("dns", errors.New("timeout"))
+	a.Wait()
+
+	var subjects []string
+	for _, m := range s.received() {
+		_, subject, _ := strings.Cut(m.Data, "Subject: ")
+		subject, _, _ = strings.Cut(subject, "\n")
+		subjects = append(subjects, subject)
+		if len(m.To) != 2 {
+			t.Errorf("expected 2 recipients; actual: %v", m.To)
+		}
+	}
+	slices.Sort(subjects)
+	expected := []string{"dns is failing", "upstream http://10.0.0.1:8080 is down", "upstream http://10.0.0.1:8080 is up"}
+	if !slices.Equal(subjects, expected) {
+		t.Errorf("expected alerts %q; actual: %q", expected, subjects)
+	}
+}
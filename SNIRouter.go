@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SNI routing
+//
+// The ALPNRouter terminates TLS, so it needs the certificates of every
+// service behind it. A hosting setup wants the opposite: one address
+// for many tenants, each keeping its own certificates and private keys
+// on its own servers. The one thing a TLS client says in the clear
+// about where it is going is SNI, the server name in its ClientHello,
+// and that is enough to pick a backend:
+//
+//	router := NewSNIRouter()
+//	router.Route("shop.example.com", "10.0.0.1:443")
+//	router.Route("*.blog.example.com", "10.0.0.2:443")
+//	router.Route("*", "10.0.0.3:443")
+//	router.Serve(ctx, listener)
+//
+// The router peeks at the ClientHello (ReadClientHello, see
+// Fingerprint.go, over a PeekConn) and then copies bytes both ways,
+// the ClientHello first: the handshake happens between the client and the backend, which
+// is all the router ever sees of it. That's TLS passthrough; the router
+// can't read or change anything inside, not even add X-Forwarded-For.
+//
+// A wildcard covers a single label, like in certificates: "*.example.com"
+// matches "a.example.com" but neither "example.com" nor "a.b.example.com".
+// "*" alone is the catch-all: clients without SNI, or with an unknown
+// one, go there, or are closed when there is none. So are clients that
+// don't speak TLS.
+
+// ErrNoSNIRoute is logged for connections without a backend
+var ErrNoSNIRoute = errors.New("no route for server name")
+
+// defaultSNIDialTimeout bounds connecting to a backend
+const defaultSNIDialTimeout = 5 * time.Second
+
+// SNIRouter forwards TLS connections to backends by server name
+type SNIRouter struct {
+	// HelloTimeout bounds reading the ClientHello, 10 seconds by
+	// default
+	HelloTimeout time.Duration
+
+	// Dial connects to backends, a net.Dialer with a 5 second timeout
+	// within DefaultConnBudget by default
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// ErrorLog receives routing and backend errors
+	ErrorLog *log.Logger
+
+	// Metrics, when set, counts connections by result and the bytes
+	// they carry
+	Metrics *Metrics
+
+	mu     sync.Mutex
+	routes map[string]string // Lower case server name to backend
+	server *TCPServer
+}
+
+// NewSNIRouter returns a router without routes
+func NewSNIRouter() *SNIRouter {
+	return &SNIRouter{routes: make(map[string]string)}
+}
+
+// Route sends the clients asking for name ("host", "*.domain" or "*")
+// to backend ("host:port")
+func (r *SNIRouter) Route(name, backend string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.routes[strings.ToLower(name)] = backend
+}
+
+// SetRoutes replaces every route, for the connections to come
+func (r *SNIRouter) SetRoutes(routes map[string]string) {
+	m := make(map[string]string, len(routes))
+	for name, backend := range routes {
+		m[strings.ToLower(name)] = backend
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.routes = m
+}
+
+// Backend returns the backend for a server name, and whether there is
+// one
+func (r *SNIRouter) Backend(serverName string) (string, bool) {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if name != "" {
+		if backend, ok := r.routes[name]; ok {
+			return backend, true
+		}
+		if _, parent, ok := strings.Cut(name, "."); ok {
+			if backend, ok := r.routes["*."+parent]; ok {
+				return backend, true
+			}
+		}
+	}
+	backend, ok := r.routes["*"]
+
+	return backend, ok
+}
+
+// Serve accepts connections on l until ctx is done or Shutdown is called
+func (r *SNIRouter) Serve(ctx context.Context, l net.Listener) error {
+	r.mu.Lock()
+	r.server = NewTCPServer(l)
+	r.server.ErrorLog = r.ErrorLog
+	r.server.Metrics = r.Metrics
+	server := r.server
+	r.mu.Unlock()
+
+	return server.Serve(ctx, r.ServeConn)
+}
+
+// Shutdown stops the server started by Serve, see TCPServer.Shutdown
+func (r *SNIRouter) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	server := r.server
+	r.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+
+	return server.Shutdown(ctx)
+}
+
+func (r *SNIRouter) logf(format string, v ...any) {
+	if r.ErrorLog != nil {
+		r.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// routed records the outcome of a connection
+func (r *SNIRouter) routed(result string) {
+	if r.Metrics != nil {
+		r.Metrics.Counter("sni_router_connections_total", "Connections, by result.", "result").With(result).Inc()
+	}
+}
+
+// ServeConn is the ConnHandler doing the routing; use it directly to
+// plug the router into another server
+func (r *SNIRouter) ServeConn(ctx context.Context, conn net.Conn) {
+	timeout := r.HelloTimeout
+	if timeout <= 0 {
+		timeout = defaultFingerprintTimeout
+	}
+	// Peeked, so the backend gets the ClientHello as if it had read it
+	// first
+	pc := NewPeekConn(conn, maxClientHelloSize)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	hello, _, err := ReadClientHello(pc.Lookahead())
+	if err != nil {
+		r.logf("%s: %v", conn.RemoteAddr(), err)
+		r.routed("not_tls")
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	backend, ok := r.Backend(hello.ServerName)
+	if !ok {
+		r.logf("%s: %q: %v", conn.RemoteAddr(), hello.ServerName, ErrNoSNIRoute)
+		r.routed("unknown")
+		return
+	}
+
+	dial := r.Dial
+	if dial == nil {
+		dial = DefaultConnBudget.Dialer((&net.Dialer{Timeout: defaultSNIDialTimeout}).DialContext)
+	}
+	upstream, err := dial(ctx, "tcp", backend)
+	if err != nil {
+		r.logf("%s: %q: %v", conn.RemoteAddr(), hello.ServerName, err)
+		r.routed("unreachable")
+		return
+	}
+	defer upstream.Close()
+	r.routed("ok")
+
+	var counter Counter
+	if r.Metrics != nil {
+		counter = r.Metrics.TrafficCounter("sni_router")
+	}
+	pipeConns(ctx, pc, upstream, counter)
+}
+
+// pipeConns copies between client and upstream until both directions
+// are done or ctx is. What the client sends counts as Outbound.
+func pipeConns(ctx context.Context, client, upstream net.Conn, counter Counter) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = client.Close()
+		_ = upstream.Close()
+	})
+	defer stop()
+
+	// When one side is done sending, tell the other, and keep the
+	// other direction going until it is done as well
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(to, from net.Conn, d Direction) {
+		defer wg.Done()
+		_, _ = io.Copy(to, countingReader{from, counter, d})
+		if cw, ok := to.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = to.Close()
+		}
+	}
+	go copyHalf(upstream, client, Outbound)
+	go copyHalf(client, upstream, Inbound)
+	wg.Wait()
+}
+
+func TestSNIRouter(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A backend per tenant, each with its own certificate
+	backend := func(host string) string {
+		cert, err := ca.Issue(TLSLeaf{Name: host, Hosts: []string{host}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return startTLSEcho(t, ServerConfig(cert, nil), nil).Addr().String()
+	}
+	router := NewSNIRouter()
+	router.ErrorLog = log.New(io.Discard, "", 0)
+	router.Metrics = new(Metrics)
+	router.Route("Shop.Test", backend("shop.test"))
+	router.Route("*.blog.test", backend("alice.blog.test"))
+
+	l := testListener(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = router.Serve(ctx, l) }()
+
+	// The handshakes only succeed with the backend holding the name
+	clientConfig := ClientConfig(ca.Pool())
+	for _, name := range []string{"shop.test", "alice.blog.test"} {
+		clientConfig.ServerName = name
+		if echo, err := tlsEcho(l.Addr().String(), clientConfig); err != nil || echo != "ping" {
+			t.Errorf("%s: unexpected echo %q, %v", name, echo, err)
+		}
+	}
+
+	// No route, and nothing in the clear either
+	for _, name := range []string{"other.test", "a.b.blog.test"} {
+		clientConfig.ServerName = name
+		if _, err := tlsEcho(l.Addr().String(), clientConfig); err == nil {
+			t.Errorf("%s: expected no route", name)
+		}
+	}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\n\r\n")
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected a plain text client to be closed")
+	}
+	_ = conn.Close()
+
+	// Unknown names go to the catch-all when there is one
+	router.SetRoutes(map[string]string{"*": backend("other.test")})
+	clientConfig.ServerName = "other.test"
+	if echo, err := tlsEcho(l.Addr().String(), clientConfig); err != nil || echo != "ping" {
+		t.Errorf("unexpected echo through the default %q, %v", echo, err)
+	}
+
+	b := new(strings.Builder)
+	_, _ = router.Metrics.WriteTo(b)
+	for _, line := range []string{
+		`sni_router_connections_total{result="ok"} 3`,
+		`sni_router_connections_total{result="unknown"} 2`,
+		`sni_router_connections_total{result="not_tls"} 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %s in the metrics", line)
+		}
+	}
+}
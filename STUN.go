@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// STUN binding (RFC 5389)
+//
+// A host behind a NAT only knows its private address. To tell a peer
+// where to send packets it needs the public address and port the NAT
+// maps it to, and the only way to learn those is to ask someone on the
+// outside. That's what a STUN "binding request" does: the server answers
+// with the source address it saw the request come from.
+//
+//	 0                   1                   2                   3
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|0 0|     Message Type          |         Message Length        |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                  Magic Cookie (0x2112A442)                    |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                 Transaction ID (96 bits)                      |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                 Attributes (type, length, value)...           |
+//
+// The address comes back in a XOR-MAPPED-ADDRESS attribute, XORed with
+// the magic cookie so that NATs rewriting IP addresses they find in
+// payloads (yes, some do) leave it alone.
+//
+// Only the binding method is implemented, which is all hole punching
+// needs; no authentication, no FINGERPRINT.
+
+const (
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112a442
+
+	stunBindingRequest = 0x0001
+	stunBindingSuccess = 0x0101
+
+	stunAttrXORMappedAddress = 0x0020
+
+	stunFamilyIPv4 = 0x01
+	stunFamilyIPv6 = 0x02
+)
+
+// ErrNotSTUN is returned for packets that aren't STUN messages
+var ErrNotSTUN = errors.New("stun: not a STUN message")
+
+// stunMessage is a STUN message with the attributes we care about
+type stunMessage struct {
+	Type          uint16
+	TransactionID [12]byte
+	MappedAddress *net.UDPAddr // XOR-MAPPED-ADDRESS
+}
+
+// MarshalBinary encodes the message
+func (m stunMessage) MarshalBinary() ([]byte, error) {
+	attrs := new(bytes.Buffer)
+	if a := m.MappedAddress; a != nil {
+		value, err := m.xorAddress(a)
+		if err != nil {
+			return nil, err
+		}
+		_ = binary.Write(attrs, binary.BigEndian, uint16(stunAttrXORMappedAddress))
+		_ = binary.Write(attrs, binary.BigEndian, uint16(len(value)))
+		attrs.Write(value) // Already a multiple of 4 bytes, no padding
+	}
+
+	b := make([]byte, stunHeaderSize, stunHeaderSize+attrs.Len())
+	binary.BigEndian.PutUint16(b, m.Type)
+	binary.BigEndian.PutUint16(b[2:], uint16(attrs.Len()))
+	binary.BigEndian.PutUint32(b[4:], stunMagicCookie)
+	copy(b[8:], m.TransactionID[:])
+
+	return append(b, attrs.Bytes()...), nil
+}
+
+// xorAddress encodes addr as a XOR-MAPPED-ADDRESS value. Port and IPv4
+// address are XORed with the cookie, IPv6 addresses with cookie and
+// transaction ID.
+func (m stunMessage) xorAddress(addr *net.UDPAddr) ([]byte, error) {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key, stunMagicCookie)
+	copy(key[4:], m.TransactionID[:])
+
+	value := []byte{0, stunFamilyIPv4, 0, 0}
+	ip := addr.IP.To4()
+	if ip == nil {
+		value[1] = stunFamilyIPv6
+		if ip = addr.IP.To16(); ip == nil {
+			return nil, fmt.Errorf("stun: invalid address %s", addr)
+		}
+	}
+
+	binary.BigEndian.PutUint16(value[2:], uint16(addr.Port)^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		value = append(value, ip[i]^key[i])
+	}
+
+	return value, nil
+}
+
+// UnmarshalBinary decodes a message, skipping unknown attributes
+func (m *stunMessage) UnmarshalBinary(p []byte) error {
+	// The top two bits of every STUN message are zero, which tells it
+	// apart from other protocols sharing the port
+	if len(p) < stunHeaderSize || p[0]&0xc0 != 0 ||
+		binary.BigEndian.Uint32(p[4:]) != stunMagicCookie {
+		return ErrNotSTUN
+	}
+	length := int(binary.BigEndian.Uint16(p[2:]))
+	if stunHeaderSize+length > len(p) {
+		return ErrNotSTUN
+	}
+
+	*m = stunMessage{Type: binary.BigEndian.Uint16(p)}
+	copy(m.TransactionID[:], p[8:20])
+
+	attrs := p[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs)
+		size := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+size > len(attrs) {
+			return fmt.Errorf("stun: truncated attribute %#04x", typ)
+		}
+		value := attrs[4 : 4+size]
+
+		if typ == stunAttrXORMappedAddress {
+			addr, err := m.parseXORAddress(value)
+			if err != nil {
+				return err
+			}
+			m.MappedAddress = addr
+		}
+
+		// Attributes are padded to a multiple of 4 bytes
+		next := 4 + (size+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+
+	return nil
+}
+
+func (m *stunMessage) parseXORAddress(v []byte) (*net.UDPAddr, error) {
+	if len(v) < 4 {
+		return nil, errors.New("stun: short XOR-MAPPED-ADDRESS")
+	}
+
+	size := net.IPv4len
+	if v[1] == stunFamilyIPv6 {
+		size = net.IPv6len
+	}
+	if len(v) < 4+size {
+		return nil, errors.New("stun: short XOR-MAPPED-ADDRESS")
+	}
+
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key, stunMagicCookie)
+	copy(key[4:], m.TransactionID[:])
+
+	ip := make(net.IP, size)
+	for i := range ip {
+		ip[i] = v[4+i] ^ key[i]
+	}
+	port := binary.BigEndian.Uint16(v[2:]) ^ uint16(stunMagicCookie>>16)
+
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// STUNHandler is a PacketHandler answering binding requests with the
+// address they came from
+func STUNHandler(_ context.Context, pc net.PacketConn, addr net.Addr, packet []byte) {
+	var req stunMessage
+	if req.UnmarshalBinary(packet) != nil || req.Type != stunBindingRequest {
+		return
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	resp := stunMessage{Type: stunBindingSuccess, TransactionID: req.TransactionID, MappedAddress: udpAddr}
+	b, err := resp.MarshalBinary()
+	if err != nil {
+		return
+	}
+	_, _ = pc.WriteTo(b, addr)
+}
+
+// STUNBinding asks the STUN server at server which public address pc
+// is mapped to. It must be sent from the very socket that will be used
+// for the traffic afterwards: a different socket gets a different
+// mapping. Requests are resent every 250ms until ctx is done.
+func STUNBinding(ctx context.Context, pc net.PacketConn, server string) (*net.UDPAddr, error) {
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+
+	req := stunMessage{Type: stunBindingRequest}
+	if _, err := rand.Read(req.TransactionID[:]); err != nil {
+		return nil, err
+	}
+	b, _ := req.MarshalBinary()
+
+	// Don't leave our deadline behind for whoever reads pc next
+	defer func() { _ = pc.SetReadDeadline(time.Time{}) }()
+
+	buf := make([]byte, 1500)
+	for {
+		if _, err := pc.WriteTo(b, raddr); err != nil {
+			return nil, err
+		}
+
+		_ = pc.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if IsTimeout(err) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			var resp stunMessage
+			if resp.UnmarshalBinary(buf[:n]) != nil || resp.TransactionID != req.TransactionID {
+				// Someone else's packet, or a late answer
+				continue
+			}
+			if resp.Type != stunBindingSuccess || resp.MappedAddress == nil {
+				return nil, fmt.Errorf("stun: unexpected response type %#04x", resp.Type)
+			}
+
+			return resp.MappedAddress, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func TestSTUNMessage(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.IPv4(203, 0, 113, 7).To4(), Port: 40000},
+		{IP: net.ParseIP("2001:db8::42"), Port: 3478},
+	} {
+		m := stunMessage{Type: stunBindingSuccess, MappedAddress: addr}
+		copy(m.TransactionID[:], "0123456789ab")
+
+		b, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The address must not appear in the clear
+		if bytes.Contains(b, addr.IP) {
+			t.Errorf("%s: address not XORed", addr)
+		}
+
+		var out stunMessage
+		if err := out.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if out.TransactionID != m.TransactionID || out.MappedAddress.String() != addr.String() {
+			t.Errorf("round trip mismatch: %+v", out)
+		}
+	}
+
+	if err := new(stunMessage).UnmarshalBinary([]byte("GET / HTTP/1.1\r\n\r\n..")); err != ErrNotSTUN {
+		t.Errorf("expected ErrNotSTUN; actual: %v", err)
+	}
+}
+
+func TestSTUNBinding(t *testing.T) {
+	server := testPacketConn(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() { _ = ServePacket(ctx, server, STUNHandler) }()
+
+	client := testPacketConn(t)
+
+	// Without a NAT in between, the mapped address is our own
+	mapped, err := STUNBinding(ctx, client, server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped.String() != client.LocalAddr().String() {
+		t.Errorf("expected %s; actual: %s", client.LocalAddr(), mapped)
+	}
+}
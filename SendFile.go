@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Sending files with sendfile
+//
+// Copying a file to a socket the obvious way reads it into a buffer and
+// writes the buffer out: every byte crosses from the kernel into our
+// memory and back, for nothing. sendfile(2) has the kernel move the
+// bytes from the page cache to the socket itself.
+//
+// Go uses it on its own when io.Copy meets a *net.TCPConn, whose
+// ReadFrom knows the trick, and a *os.File, or an io.LimitedReader of
+// one. The catch is keeping those types visible: a connection wrapper
+// without ReadFrom, or a reader wrapping the file (a SectionReader,
+// a counting reader), and io.Copy quietly falls back to the buffer.
+//
+// SendFile sends a slice of a file that way, by seeking the file and
+// limiting it with an io.LimitedReader, and the connections a TCPServer
+// tracks (see ConnTracker.go) pass ReadFrom through. Where the platform
+// has no sendfile, or the connection isn't a TCP one, the copy happens
+// in user space, with the same result.
+//
+// BenchmarkSendFile and BenchmarkSendFileUserspace compare the two on
+// 16 MB over loopback. The gain is CPU more than time: loopback is
+// memory bandwidth either way, but the copy through user space
+// spends it twice.
+
+// SendFile writes n bytes of f from offset to conn, or everything from
+// offset when n is negative. A file shorter than that is an
+// io.ErrUnexpectedEOF. f's offset moves.
+func SendFile(conn net.Conn, f *os.File, offset, n int64) (int64, error) {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var r io.Reader = f
+	if n >= 0 {
+		r = &io.LimitedReader{R: f, N: n}
+	}
+	written, err := io.Copy(conn, r)
+	if err == nil && n >= 0 && written < n {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return written, err
+}
+
+func TestSendFile(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10_000)
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The server end goes through a tracker, like a TCPServer's
+	tracker := new(ConnTracker)
+	l := tracker.Listener(testListener(t))
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("no connection")
+	}
+	defer conn.Close()
+
+	for _, c := range []struct {
+		offset, n int64
+		expected  []byte
+		err       error
+	}{
+		{10, 100, data[10:110], nil},
+		{99_990, -1, data[99_990:], nil},
+		{0, 0, nil, nil},
+		{99_000, 2_000, data[99_000:], io.ErrUnexpectedEOF},
+	} {
+		n, err := SendFile(conn, f, c.offset, c.n)
+		if !errors.Is(err, c.err) || n != int64(len(c.expected)) {
+			t.Errorf("%d+%d: expected %d bytes, %v; actual: %d, %v", c.offset, c.n, len(c.expected), c.err, n, err)
+			continue
+		}
+		if received, err := ReadExactly(client, len(c.expected)); err != nil || !bytes.Equal(received, c.expected) {
+			t.Errorf("%d+%d: unexpected data received, %v", c.offset, c.n, err)
+		}
+	}
+}
+
+// benchSendFile sends a 16 MB file per iteration over loopback with
+// send, to a server discarding it
+func benchSendFile(b *testing.B, send func(conn net.Conn, f *os.File) error) {
+	path := filepath.Join(b.TempDir(), "data")
+	if err := os.WriteFile(path, make([]byte, 16<<20), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	l := testListener(b)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	b.SetBytes(16 << 20)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := send(conn, f); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSendFile sends with SendFile
+func BenchmarkSendFile(b *testing.B) {
+	benchSendFile(b, func(conn net.Conn, f *os.File) error {
+		_, err := SendFile(conn, f, 0, -1)
+		return err
+	})
+}
+
+// BenchmarkSendFileUserspace sends through a buffer, with the types
+// hidden from io.Copy
+func BenchmarkSendFileUserspace(b *testing.B) {
+	buf := make([]byte, 32<<10)
+	benchSendFile(b, func(conn net.Conn, f *os.File) error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.CopyBuffer(struct{ io.Writer }{conn}, struct{ io.Reader }{f}, buf)
+		return err
+	})
+}
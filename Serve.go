@@ -0,0 +1,1733 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The serve command
+//
+// "golearn serve -config golearn.yaml" runs the listeners of a
+// configuration file (see Config.go) until it is interrupted:
+//
+// - echo: sends back what it receives, over TCP, UDP or a unix socket
+// - connect_proxy: a ConnectProxy limited to its allow list
+// - forward_proxy: a ForwardProxy fetching absolute-URI requests for
+//   the origins of its allow list, caching what they allow
+// - reverse_proxy: a ReverseProxy spreading requests over a backend,
+//   with its health checks
+// - sni_router: an SNIRouter passing TLS connections through to the
+//   backend of their server name, by its routes
+// - discard, daytime, chargen and exec: the inetd services, trivial
+//   ones and a command per connection (see Inetd.go)
+//
+// Every listener is opened before anything is served, so a port in use
+// or a missing certificate stops the command right away instead of
+// leaving it half started. The TCPServer limits apply to the echo,
+// inetd and SNI router listeners; the HTTP ones get the request timeout,
+// and all TCP listeners their socket options. The proxies' upstream
+// connections share DefaultConnBudget (see ConnBudget.go), capped by
+// limits.max_outbound_per_host and limits.max_outbound. Everything reports
+// to DefaultMetrics, published through expvar as "golearn" and logged
+// every log.stats when that is set. When log.peers names a CSV of
+// networks (see Enrich.go), clients are counted by country and ASN and
+// labeled in the proxy logs.
+//
+// Reloading
+//
+// SIGHUP reads the file again and applies it without a restart, and so
+// does POST /reload on the admin API (see Admin.go) when admin.socket
+// or admin.addr is set, and reload on the console (see Console.go) when
+// admin.console is. What a listener does can change under it:
+// backends, allow lists, credentials, peer filters, denied JA3 hashes,
+// limits, timeouts, socket options and certificates are swapped in atomically, each request or connection using either
+// the old settings or the new ones, never a mix. Tunnels and connections that are open
+// keep going with the settings they started with.
+//
+// What a listener is (its kind, network, address, whether it uses TLS)
+// can't change under it. A listener whose identity changed is replaced,
+// one that is gone is drained like at shutdown, and a new one is
+// started, all without touching the others. New listeners are opened
+// before anything is applied, so a reload that fails (a bad file, a
+// port in use) changes nothing. The exception is a listener moving onto
+// the address of one being removed, which can only be bound once the old
+// one has let go of it.
+//
+// A listener with upnp set gets its port forwarded on the LAN's router
+// for as long as it runs, by a PortForward (see UPnP.go); toggling it
+// replaces the listener.
+//
+// The log level applies right away; where the logs go, the peer
+// database (log.peers) and the admin API only change on a restart.
+//
+// Restarting
+//
+// SIGUSR2 upgrades the binary without closing a port: the listeners,
+// the admin API's included, are bound through a Restarter (see
+// Restart.go), which starts the binary again with the same arguments
+// and hands it the sockets. Once the new process has opened its
+// listeners and says it's ready, this one drains like on SIGTERM and
+// exits; connections arriving in between wait in the backlog. A new
+// process that fails to start leaves this one serving.
+
+// configListener is a listener of the configuration and its services
+type configListener struct {
+	config   ListenerConfig
+	addr     net.Addr  // Bound address
+	closer   io.Closer // The socket
+	services []Service
+
+	// stopAccepting frees the address, leaving connections open
+	stopAccepting func()
+
+	// apply sets what can change at runtime from a configuration
+	apply func(lc ListenerConfig, cfg *Config)
+
+	// tlsConfig is used by new TLS connections, deniedJA3 refuses
+	// some of them (see Fingerprint.go)
+	tlsConfig atomic.Pointer[tls.Config]
+	deniedJA3 atomic.Pointer[map[string]bool]
+
+	tracker *ConnTracker    // Connections of stream listeners
+	filter  *NetFilter      // Peers allowed by the filter of the config
+	socket  *SocketListener // Options of new TCP connections
+
+	// backends reports the health of a reverse proxy's upstreams
+	backends func() map[string]bool
+
+	failed  atomic.Bool // A service returned an error
+	warming atomic.Bool // Connections to the upstreams are being opened
+
+	cancel context.CancelFunc // Stops the services, set once started
+}
+
+// configServer runs the listeners of a configuration. It's a Service:
+// Serve starts the listeners, Shutdown drains them.
+type configServer struct {
+	logs      *LevelLog
+	errorLog  *log.Logger // For the components
+	enricher  Enricher    // From log.peers, nil without
+	restarter *Restarter  // Binds the sockets, hands them down on restart
+
+	mu        sync.Mutex
+	cfg       *Config
+	listeners map[string]*configListener
+	ctx       context.Context // Set by Serve
+	closed    bool            // Shutdown was called
+	running   sync.WaitGroup  // Services of all listeners, past and present
+	errs      []error         // Services that failed on their own
+	draining  map[string]bool // Listeners being drained by Drain
+
+	// adminFilter is the filter of the admin API on admin.addr
+	adminFilter *NetFilter
+
+	healthInterval time.Duration // Between the reverse proxy health checks
+}
+
+// newConfigServer opens the listeners of cfg and builds their services
+func newConfigServer(cfg *Config, logs *LevelLog) (*configServer, error) {
+	r, err := newRestarter("", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return openConfigServer(cfg, logs, r)
+}
+
+// openConfigServer is newConfigServer binding the sockets through r,
+// inheriting those r was handed
+func openConfigServer(cfg *Config, logs *LevelLog, r *Restarter) (*configServer, error) {
+	tlsConfigs, err := loadTLSConfigs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &configServer{
+		logs:           logs,
+		restarter:      r,
+		cfg:            cfg,
+		listeners:      make(map[string]*configListener),
+		draining:       make(map[string]bool),
+		adminFilter:    NewNetFilter(cfg.ruleSet(cfg.Admin.Filter)),
+		healthInterval: defaultHealthInterval,
+	}
+	s.errorLog = s.logs.Logger(slog.LevelError)
+	if cfg.Log.Peers != "" {
+		peers, err := LoadPrefixEnricher(cfg.Log.Peers)
+		if err != nil {
+			return nil, fmt.Errorf("log: %w", err)
+		}
+		s.enricher = peers
+	}
+	if level, err := cfg.Log.level(); err == nil {
+		s.logs.Level.Set(level)
+	}
+	DefaultConnBudget.SetLimits(cfg.Limits.MaxOutboundPerHost, cfg.Limits.MaxOutbound)
+	for _, lc := range cfg.Listeners {
+		l, err := s.open(lc)
+		if err != nil {
+			for _, l := range s.listeners {
+				_ = l.closer.Close()
+			}
+			return nil, fmt.Errorf("listener %q: %w", lc.Name, err)
+		}
+		l.set(lc, cfg, tlsConfigs)
+		s.listeners[lc.Name] = l
+	}
+
+	return s, nil
+}
+
+// open binds the socket of lc and builds its services
+func (s *configServer) open(lc ListenerConfig) (*configListener, error) {
+	l := &configListener{config: lc, apply: func(ListenerConfig, *Config) {}, filter: new(NetFilter)}
+
+	if lc.Network == "udp" {
+		pc, err := s.restarter.ListenPacket("udp", lc.Addr)
+		if err != nil {
+			return nil, err
+		}
+		l.addr, l.closer = pc.LocalAddr(), pc
+		l.stopAccepting = func() { _ = pc.Close() }
+		l.services = []Service{PacketService(lc.Name, l.filter.PacketConn(pc), packetHandlers[lc.Kind])}
+		return l, s.forward(l)
+	}
+
+	var ln net.Listener
+	var err error
+	if lc.Network == "unix" {
+		ln, err = s.restarter.ListenFunc("unix", lc.Addr, func() (net.Listener, error) {
+			return ListenUnix(lc.Addr, 0o660)
+		})
+	} else {
+		ln, err = s.restarter.Listen("tcp", lc.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.addr, l.closer = ln.Addr(), ln
+	l.stopAccepting = func() { _ = ln.Close() }
+	if lc.Network == "tcp" {
+		l.socket = NewSocketListener(ln, lc.Socket)
+		l.socket.Failed = func(conn net.Conn, err error) {
+			s.logs.Warnf("%s: %s: socket options: %v", lc.Name, conn.RemoteAddr(), err)
+		}
+		ln = l.socket
+	}
+	if !tcpServerKind(lc.Kind) {
+		// TCPServer tracks and filters its own
+		ln = l.filter.Listener(ln)
+		l.tracker = new(ConnTracker)
+		ln = l.tracker.Listener(ln)
+	}
+	if lc.TLS != "" {
+		// Clients are fingerprinted before the handshake, and logged
+		// with it at debug level
+		ln = &FingerprintListener{Listener: ln, Check: func(conn net.Conn, fp *Fingerprint) error {
+			s.logs.Debugf("%s: %s %s", lc.Name, conn.RemoteAddr(), fp)
+			if ja3 := fp.JA3Hash(); (*l.deniedJA3.Load())[ja3] {
+				return fmt.Errorf("%s: %s: denied JA3 %s", lc.Name, conn.RemoteAddr(), ja3)
+			}
+			return nil
+		}}
+		ln = tls.NewListener(ln, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return l.tlsConfig.Load(), nil
+			},
+		})
+	}
+
+	switch lc.Kind {
+	case kindEcho, kindDiscard, kindDaytime, kindChargen, kindExec, kindSNIRouter:
+		srv := NewTCPServer(ln)
+		srv.ErrorLog = s.errorLog
+		srv.Metrics = DefaultMetrics
+		srv.Enricher = s.enricher
+		srv.Deny = l.filter.Deny
+		l.tracker = &srv.Tracker
+		l.stopAccepting = srv.StopAccepting
+		handler, set := connHandlers[lc.Kind], func(ListenerConfig) {}
+		switch lc.Kind {
+		case kindSNIRouter:
+			router := NewSNIRouter()
+			router.ErrorLog = s.errorLog
+			router.Metrics = DefaultMetrics
+			handler, set = router.ServeConn, func(lc ListenerConfig) { router.SetRoutes(lc.Routes) }
+		case kindExec:
+			// Connections run the command of the configuration they
+			// arrived under
+			var command atomic.Pointer[[]string]
+			handler = execConn(func() []string { return *command.Load() }, s.errorLog)
+			set = func(lc ListenerConfig) { command.Store(&lc.Command) }
+		}
+		l.apply = func(lc ListenerConfig, cfg *Config) {
+			srv.SetLimits(cfg.Limits.AcceptRate, cfg.Limits.AcceptBurst, cfg.Limits.MaxConnsPerIP)
+			set(lc)
+		}
+		l.services = []Service{TCPService(lc.Name, srv, handler)}
+
+	case kindConnectProxy:
+		handler := new(swapHandler)
+		l.apply = func(lc ListenerConfig, _ *Config) {
+			allowed := make(map[string]bool, len(lc.Allow))
+			for _, target := range lc.Allow {
+				allowed[target] = true
+			}
+			handler.Store(&ConnectProxy{
+				Allow:       func(target string) bool { return allowed["*"] || allowed[target] },
+				Credentials: lc.Credentials,
+				ErrorLog:    s.errorLog,
+				Metrics:     DefaultMetrics,
+				Enricher:    s.enricher,
+			})
+		}
+		// Tunnels outlive any request timeout
+		srv := NewHTTPServer(lc.Addr, handler)
+		srv.ConnContext = ConnInfoConnContext
+		srv.ReadTimeout, srv.WriteTimeout = 0, 0
+		srv.ErrorLog = s.errorLog
+		l.services = []Service{HTTPService(lc.Name, srv, ln)}
+
+	case kindForwardProxy:
+		handler := new(swapHandler)
+		// Reloads keep the cache and the pooled upstream connections
+		cache, client := new(HTTPCache), NewForwardClient()
+		l.apply = func(lc ListenerConfig, cfg *Config) {
+			allowed := make(map[string]bool, len(lc.Allow))
+			for _, target := range lc.Allow {
+				allowed[target] = true
+			}
+			p := &ForwardProxy{
+				Allow:       func(target string) bool { return allowed["*"] || allowed[target] },
+				Credentials: lc.Credentials,
+				Client:      client,
+				Cache:       cache,
+				ErrorLog:    s.errorLog,
+				Metrics:     DefaultMetrics,
+				Enricher:    s.enricher,
+			}
+			handler.Store(Chain(p, Timeout(time.Duration(cfg.Limits.RequestTimeout))))
+		}
+		if lc.TLS == "" {
+			ln = &StrictHTTPListener{Listener: ln, Rejected: func(conn net.Conn, err error) {
+				s.logs.Warnf("%s: %s: %v", lc.Name, conn.RemoteAddr(), err)
+			}}
+		}
+		srv := NewHTTPServer(lc.Addr, handler)
+		srv.ConnContext = ConnInfoConnContext
+		srv.ErrorLog = s.errorLog
+		l.services = []Service{HTTPService(lc.Name, srv, ln)}
+
+	case kindReverseProxy:
+		handler := new(swapHandler)
+		var current atomic.Pointer[ReverseProxy]
+		l.apply = func(lc ListenerConfig, cfg *Config) {
+			// Upstreams that stay keep their health state
+			known := make(map[string]*Upstream)
+			if p := current.Load(); p != nil {
+				for _, u := range p.Routes[0].Upstreams {
+					known[u.URL.String()] = u
+				}
+			}
+			route := new(ProxyRoute)
+			for _, raw := range cfg.Backends[lc.Backend] {
+				u, ok := known[raw]
+				if !ok {
+					var err error
+					if u, err = NewUpstream(raw); err != nil {
+						continue // Can't happen, Validate checked them
+					}
+				}
+				route.Upstreams = append(route.Upstreams, u)
+			}
+			p := &ReverseProxy{Routes: []*ProxyRoute{route}, ErrorLog: s.errorLog, Enricher: s.enricher}
+			current.Store(p)
+			handler.Store(Chain(p, Timeout(time.Duration(cfg.Limits.RequestTimeout))))
+		}
+		l.backends = func() map[string]bool {
+			health := make(map[string]bool)
+			for _, u := range current.Load().Routes[0].Upstreams {
+				health[u.URL.String()] = u.Healthy()
+			}
+			return health
+		}
+		if lc.TLS == "" {
+			// Requests are checked before net/http parses them, see
+			// HTTPStrict.go. Not over TLS: net/http only sees TLS, and
+			// offers HTTP/2, on a *tls.Conn.
+			ln = &StrictHTTPListener{Listener: ln, Rejected: func(conn net.Conn, err error) {
+				s.logs.Warnf("%s: %s: %v", lc.Name, conn.RemoteAddr(), err)
+			}}
+		}
+		srv := NewHTTPServer(lc.Addr, handler)
+		srv.ConnContext = ConnInfoConnContext
+		srv.ErrorLog = s.errorLog
+		l.warming.Store(lc.Warm > 0)
+		l.services = []Service{
+			HTTPService(lc.Name, srv, ln),
+			NewService(lc.Name+" health checks", func(ctx context.Context) error {
+				// Ready once the warm connections are open, or failed to
+				if lc.Warm > 0 {
+					if err := current.Load().Warm(ctx, lc.Warm); err != nil {
+						s.logs.Warnf("%s: warm-up: %v", lc.Name, err)
+					}
+					l.warming.Store(false)
+				}
+
+				ticker := time.NewTicker(s.healthInterval)
+				defer ticker.Stop()
+				for {
+					current.Load().CheckHealth(ctx)
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case <-ticker.C:
+					}
+				}
+			}, nil),
+		}
+	}
+
+	return l, s.forward(l)
+}
+
+// forward adds a PortForward of the port of l to its services, when
+// its configuration asks for one
+func (s *configServer) forward(l *configListener) error {
+	if !l.config.UPnP {
+		return nil
+	}
+	f, err := NewPortForward(l.config.Name+" upnp", l.addr, "golearn "+l.config.Name)
+	if err != nil {
+		_ = l.closer.Close()
+		return err
+	}
+	f.ErrorLog = s.logs.Logger(slog.LevelInfo)
+	l.services = append(l.services, f)
+
+	return nil
+}
+
+// set applies the runtime settings of a configuration to l
+func (l *configListener) set(lc ListenerConfig, cfg *Config, tlsConfigs map[string]*tls.Config) {
+	l.config = lc
+	if lc.TLS != "" {
+		l.tlsConfig.Store(tlsConfigs[lc.TLS])
+	}
+	denied := make(map[string]bool, len(lc.DenyJA3))
+	for _, hash := range lc.DenyJA3 {
+		denied[strings.ToLower(hash)] = true
+	}
+	l.deniedJA3.Store(&denied)
+	l.filter.SetRules(cfg.ruleSet(lc.Filter))
+	if l.socket != nil {
+		l.socket.SetOptions(lc.Socket)
+	}
+	l.apply(lc, cfg)
+}
+
+// sameListener reports whether b can be applied to a running a
+func sameListener(a, b ListenerConfig) bool {
+	return a.Kind == b.Kind && a.Network == b.Network && a.Addr == b.Addr && (a.TLS == "") == (b.TLS == "") &&
+		a.UPnP == b.UPnP
+}
+
+// start runs the services of l. Called with s.mu held.
+func (s *configServer) start(l *configListener) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	l.cancel = cancel
+
+	for _, svc := range l.services {
+		s.running.Add(1)
+		go func() {
+			defer s.running.Done()
+			if err := serviceError(serviceResult{svc, svc.Serve(ctx)}); err != nil {
+				l.failed.Store(true)
+				s.logs.Errorf("%v", err)
+				s.mu.Lock()
+				s.errs = append(s.errs, err)
+				s.mu.Unlock()
+			}
+		}()
+	}
+}
+
+// stop drains l: no more connections, then Shutdown within ctx
+func (s *configServer) stop(ctx context.Context, l *configListener) error {
+	l.stopAccepting()
+	if l.cancel == nil {
+		// Never started
+		return l.closer.Close()
+	}
+
+	errs := make(chan error, len(l.services))
+	for _, svc := range l.services {
+		go func() { errs <- svc.Shutdown(ctx) }()
+	}
+	var err error
+	for range l.services {
+		err = errors.Join(err, <-errs)
+	}
+	l.cancel()
+
+	return err
+}
+
+// Serve runs the listeners until ctx is done and they have been shut
+// down. It returns the errors of services that failed on their own.
+func (s *configServer) Serve(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.ctx = ctx
+	for _, l := range s.listeners {
+		s.start(l)
+	}
+	if s.cfg.Log.Stats > 0 {
+		monitor := &Monitor{Logger: s.logs.Logger(slog.LevelInfo)}
+		interval := time.Duration(s.cfg.Log.Stats)
+		s.running.Add(1)
+		go func() {
+			defer s.running.Done()
+			_ = monitor.LogVars(ctx, interval, "golearn")
+		}()
+	}
+	s.mu.Unlock()
+
+	<-ctx.Done()
+	s.running.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return errors.Join(s.errs...)
+}
+
+// Shutdown drains every listener
+func (s *configServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	listeners := make([]*configListener, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		listeners = append(listeners, l)
+	}
+	s.mu.Unlock()
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() { errs <- s.stop(ctx, l) }()
+	}
+	var err error
+	for range listeners {
+		err = errors.Join(err, <-errs)
+	}
+
+	return err
+}
+
+// Reload applies cfg to the running listeners, see above
+func (s *configServer) Reload(cfg *Config) error {
+	tlsConfigs, err := loadTLSConfigs(cfg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.ctx != nil && s.ctx.Err() != nil {
+		return ErrServerClosed
+	}
+
+	// Sort the listeners into kept, removed and added
+	wanted := make(map[string]ListenerConfig, len(cfg.Listeners))
+	for _, lc := range cfg.Listeners {
+		wanted[lc.Name] = lc
+	}
+	var removed []*configListener
+	freed := make(map[string]bool) // network/address of removed listeners
+	for name, l := range s.listeners {
+		if lc, ok := wanted[name]; !ok || !sameListener(l.config, lc) {
+			removed = append(removed, l)
+			freed[l.config.Network+"/"+l.config.Addr] = true
+		}
+	}
+	var added, deferred []ListenerConfig
+	for _, lc := range cfg.Listeners {
+		if l, ok := s.listeners[lc.Name]; ok && sameListener(l.config, lc) {
+			continue
+		}
+		if freed[lc.Network+"/"+lc.Addr] {
+			deferred = append(deferred, lc)
+		} else {
+			added = append(added, lc)
+		}
+	}
+
+	// Open what's new; failing here leaves everything as it was
+	opened := make([]*configListener, 0, len(added))
+	for _, lc := range added {
+		l, err := s.open(lc)
+		if err != nil {
+			for _, l := range opened {
+				_ = l.closer.Close()
+			}
+			return fmt.Errorf("listener %q: %w", lc.Name, err)
+		}
+		opened = append(opened, l)
+	}
+
+	// Apply
+	grace := time.Duration(cfg.Limits.ShutdownGrace)
+	for _, l := range s.listeners {
+		if lc, ok := wanted[l.config.Name]; ok && sameListener(l.config, lc) {
+			l.set(lc, cfg, tlsConfigs)
+		}
+	}
+	for _, l := range removed {
+		delete(s.listeners, l.config.Name)
+		l.stopAccepting()
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), grace)
+			defer cancel()
+			if err := s.stop(ctx, l); err != nil {
+				s.logs.Errorf("%s: %v", l.config.Name, err)
+			}
+		}()
+	}
+	var errs []error
+	for _, lc := range deferred {
+		l, err := s.open(lc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listener %q: %w", lc.Name, err))
+			continue
+		}
+		opened = append(opened, l)
+	}
+	for _, l := range opened {
+		l.set(wanted[l.config.Name], cfg, tlsConfigs)
+		s.listeners[l.config.Name] = l
+		if s.ctx != nil {
+			s.start(l)
+		}
+	}
+	if level, err := cfg.Log.level(); err == nil {
+		s.logs.Level.Set(level)
+	}
+	if old := s.cfg.Log; cfg.Log.Output != old.Output || cfg.Log.Stats != old.Stats || cfg.Log.Peers != old.Peers {
+		s.logs.Warnf("reload: log settings take effect on restart")
+		cfg.Log.Output, cfg.Log.Stats, cfg.Log.Peers = old.Output, old.Stats, old.Peers
+	}
+	if cfg.Admin != s.cfg.Admin {
+		s.logs.Warnf("reload: admin settings take effect on restart")
+		cfg.Admin = s.cfg.Admin
+	}
+	if _, ok := cfg.Filters[cfg.Admin.Filter]; ok || cfg.Admin.Filter == "" {
+		s.adminFilter.SetRules(cfg.ruleSet(cfg.Admin.Filter))
+	} else {
+		s.logs.Warnf("reload: admin filter %q is gone, keeping its rules", cfg.Admin.Filter)
+	}
+	DefaultConnBudget.SetLimits(cfg.Limits.MaxOutboundPerHost, cfg.Limits.MaxOutbound)
+	s.cfg = cfg
+	for _, l := range removed {
+		s.logs.Debugf("reload: %s removed", l.config.Name)
+	}
+	for _, l := range opened {
+		s.logs.Debugf("reload: %s added on %s", l.config.Name, l.addr)
+	}
+	s.logs.Infof("reload: %d listeners added, %d removed", len(opened), len(removed))
+
+	return errors.Join(errs...)
+}
+
+// Conns lists the open connections of the stream listeners
+func (s *configServer) Conns() map[string][]TrackedConnInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make(map[string][]TrackedConnInfo, len(s.listeners))
+	for name, l := range s.listeners {
+		if l.tracker != nil {
+			conns[name] = l.tracker.Conns()
+		}
+	}
+
+	return conns
+}
+
+// Drain stops the listener called name like a reload removing it
+// would, waiting for its connections within ctx and the shutdown grace
+// period. The next reload starts it again.
+func (s *configServer) Drain(ctx context.Context, name string) error {
+	s.mu.Lock()
+	l, ok := s.listeners[name]
+	if ok {
+		delete(s.listeners, name)
+		s.draining[name] = true
+	}
+	grace := time.Duration(s.cfg.Limits.ShutdownGrace)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownListener, name)
+	}
+
+	s.logs.Infof("%s: draining", name)
+	ctx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+	err := s.stop(ctx, l)
+
+	s.mu.Lock()
+	delete(s.draining, name)
+	s.mu.Unlock()
+
+	return err
+}
+
+// Health reports the state of the listeners, see Health.go
+func (s *configServer) Health() HealthReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := HealthReport{Live: true, Ready: true, Listeners: make(map[string]ListenerHealth)}
+	for _, lc := range s.cfg.Listeners {
+		var h ListenerHealth
+		l, ok := s.listeners[lc.Name]
+		switch {
+		case ok && l.failed.Load():
+			h.State = listenerFailed
+			r.Live = false
+		case ok && s.closed:
+			h.State = listenerDraining
+		case ok && l.cancel == nil:
+			h.State = listenerStarting
+		case ok && l.warming.Load():
+			h.State = listenerWarming
+		case ok:
+			h.State = listenerServing
+		case s.draining[lc.Name]:
+			h.State = listenerDraining
+		default:
+			h.State = listenerDrained
+		}
+		if h.State != listenerServing {
+			r.Ready = false
+		}
+
+		// A reverse proxy without a healthy upstream only answers 502
+		if ok && l.backends != nil {
+			h.Backends = l.backends()
+			healthy := false
+			for _, up := range h.Backends {
+				healthy = healthy || up
+			}
+			if !healthy {
+				r.Ready = false
+			}
+		}
+		r.Listeners[lc.Name] = h
+	}
+
+	return r
+}
+
+// Addr returns the bound address of the listener called name, or nil
+func (s *configServer) Addr(name string) net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.listeners[name]; ok {
+		return l.addr
+	}
+
+	return nil
+}
+
+// Run serves until ctx is done or the process is interrupted, along
+// with services that go with it, like the admin API
+func (s *configServer) Run(ctx context.Context, services ...Service) error {
+	s.mu.Lock()
+	grace := time.Duration(s.cfg.Limits.ShutdownGrace)
+	s.mu.Unlock()
+
+	r := &Runner{Grace: grace, ErrorLog: s.logs.Logger(slog.LevelInfo)}
+	return r.Run(ctx, append([]Service{s}, services...)...)
+}
+
+// swapHandler serves with the handler last stored in it
+type swapHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+// Store replaces the handler for the requests to come
+func (s *swapHandler) Store(h http.Handler) {
+	s.h.Store(&h)
+}
+
+func (s *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.h.Load()).ServeHTTP(w, r)
+}
+
+// adminServices serves a on the socket and address of cfg, the address
+// behind filter, binding them through r
+func adminServices(cfg AdminConfig, a *Admin, filter *NetFilter, r *Restarter) ([]Service, error) {
+	var services []Service
+	var local net.Listener
+	if cfg.Socket != "" {
+		var err error
+		local, err = r.ListenFunc("unix", cfg.Socket, func() (net.Listener, error) {
+			return ListenUnix(cfg.Socket, 0o600)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("admin: %w", err)
+		}
+		services = append(services, AdminService(a, local))
+	}
+	if cfg.Addr != "" {
+		l, err := r.Listen("tcp", cfg.Addr)
+		if err != nil {
+			if local != nil {
+				_ = local.Close()
+			}
+			return nil, fmt.Errorf("admin: %w", err)
+		}
+		remote := *a
+		remote.Token = cfg.Token
+		services = append(services, AdminService(&remote, filter.Listener(l)))
+	}
+
+	return services, nil
+}
+
+// consoleServices serves the console on admin.console, if set, behind
+// filter, with the functions of a, binding it through r
+func consoleServices(cfg *Config, a *Admin, filter *NetFilter, r *Restarter) ([]Service, error) {
+	if cfg.Admin.Console == "" {
+		return nil, nil
+	}
+	c := &Console{
+		Conns:    a.Conns,
+		Drain:    a.Drain,
+		Reload:   a.Reload,
+		Health:   a.Health,
+		Level:    a.Level,
+		Password: cfg.Admin.ConsolePassword,
+		ErrorLog: a.ErrorLog,
+	}
+	if cfg.Admin.ConsoleTLS != "" {
+		var err error
+		if c.TLS, err = loadTLSConfig(cfg.TLS[cfg.Admin.ConsoleTLS]); err != nil {
+			return nil, fmt.Errorf("console: %w", err)
+		}
+	}
+	l, err := r.Listen("tcp", cfg.Admin.Console)
+	if err != nil {
+		return nil, fmt.Errorf("console: %w", err)
+	}
+
+	return []Service{ConsoleService(c, filter.Listener(l))}, nil
+}
+
+// loadTLSConfigs loads the certificates of cfg by name
+func loadTLSConfigs(cfg *Config) (map[string]*tls.Config, error) {
+	configs := make(map[string]*tls.Config, len(cfg.TLS))
+	for name, t := range cfg.TLS {
+		c, err := loadTLSConfig(t)
+		if err != nil {
+			return nil, fmt.Errorf("tls %q: %w", name, err)
+		}
+		configs[name] = c
+	}
+
+	return configs, nil
+}
+
+// loadTLSConfig loads the certificate of t, requiring client
+// certificates when it names a client CA
+func loadTLSConfig(t TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+	if t.ClientCA == "" {
+		return ServerConfig(cert, nil), nil
+	}
+
+	b, err := os.ReadFile(t.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no certificates", t.ClientCA)
+	}
+
+	return ServerConfig(cert, pool), nil
+}
+
+// echoConn sends back what it receives until the client hangs up or
+// the server stops
+func echoConn(ctx context.Context, conn net.Conn) {
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	_, _ = io.Copy(conn, conn)
+}
+
+// echoPacket sends a datagram back where it came from
+func echoPacket(_ context.Context, pc net.PacketConn, addr net.Addr, packet []byte) {
+	_, _ = pc.WriteTo(packet, addr)
+}
+
+// connHandlers are the services of the listeners with nothing to set
+// up, by kind, and packetHandlers those that can use udp
+var (
+	connHandlers = map[string]ConnHandler{
+		kindEcho:    echoConn,
+		kindDiscard: discardConn,
+		kindDaytime: daytimeConn,
+		kindChargen: chargenConn,
+	}
+	packetHandlers = map[string]PacketHandler{
+		kindEcho:    echoPacket,
+		kindDiscard: discardPacket,
+		kindDaytime: daytimePacket,
+	}
+)
+
+// tcpServerKind reports whether the listeners of kind are served by a
+// TCPServer, which tracks and filters its own connections
+func tcpServerKind(kind string) bool {
+	return connHandlers[kind] != nil || kind == kindExec || kind == kindSNIRouter
+}
+
+// openLogs returns the server logs for LogConfig.Output, and what to
+// close once done with them
+func openLogs(output string) (*LevelLog, io.Closer, error) {
+	if output == "journald" {
+		h, err := DialJournal("", "golearn")
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewLevelLogHandler(h), h, nil
+	}
+	if network, addr, ok := syslogOutput(output); ok {
+		h, err := DialSyslog(network, addr, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewLevelLogHandler(h), h, nil
+	}
+
+	out, err := openLogOutput(output)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return NewLevelLog(log.New(out, "serve: ", log.LstdFlags)), out, nil
+}
+
+// openLogOutput returns the writer for a file or standard stream
+func openLogOutput(output string) (io.WriteCloser, error) {
+	switch output {
+	case "stderr":
+		return nopWriteCloser{os.Stderr}, nil
+	case "stdout":
+		return nopWriteCloser{os.Stdout}, nil
+	}
+
+	return os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+}
+
+// nopWriteCloser keeps the standard streams open
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// serveMain runs "golearn serve -config file"
+func serveMain(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	path := fs.String("config", "golearn.yaml", "configuration `file` (.yaml, .yml or .json)")
+	check := fs.Bool("check", false, "validate the configuration and exit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Before the configuration, which would take the restart's
+	// GOLEARN_ variables for its own
+	r, err := NewRestarter()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfig(*path)
+	if err != nil {
+		return err
+	}
+	if *check {
+		return nil
+	}
+
+	logs, closer, err := openLogs(cfg.Log.Output)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	s, err := openConfigServer(cfg, logs, r)
+	if err != nil {
+		return err
+	}
+	for _, lc := range cfg.Listeners {
+		s.logs.Infof("%s (%s) on %s/%s", lc.Name, lc.Kind, lc.Network, s.Addr(lc.Name))
+	}
+	DefaultMetrics.Publish("golearn")
+
+	reload := func() error {
+		cfg, err := LoadConfig(*path)
+		if err != nil {
+			return err
+		}
+		return s.Reload(cfg)
+	}
+
+	// SIGHUP reloads the file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer func() {
+		signal.Stop(hup)
+		close(hup)
+	}()
+	go func() {
+		for range hup {
+			if err := reload(); err != nil {
+				s.logs.Errorf("reload: %v", err)
+			}
+		}
+	}()
+
+	// SIGUSR2 hands the sockets to a new process, then drains this one
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if restartSignal != nil {
+		usr := make(chan os.Signal, 1)
+		signal.Notify(usr, restartSignal)
+		defer func() {
+			signal.Stop(usr)
+			close(usr)
+		}()
+		go func() {
+			for range usr {
+				rctx, rcancel := context.WithTimeout(ctx, restartTimeout)
+				child, err := r.Restart(rctx)
+				rcancel()
+				if err != nil {
+					s.logs.Errorf("restart: %v", err)
+					continue
+				}
+				s.logs.Infof("restarted as process %d, draining", child.Pid)
+				cancel()
+			}
+		}()
+	}
+
+	a := &Admin{
+		Conns:    s.Conns,
+		Drain:    s.Drain,
+		Health:   s.Health,
+		Reload:   reload,
+		Level:    &s.logs.Level,
+		ErrorLog: s.logs.Logger(slog.LevelInfo),
+	}
+	admin, err := adminServices(cfg.Admin, a, s.adminFilter, r)
+	if err == nil {
+		var console []Service
+		console, err = consoleServices(cfg, a, s.adminFilter, r)
+		admin = append(admin, console...)
+	}
+	if err != nil {
+		_ = s.Shutdown(context.Background())
+		return err
+	}
+
+	// The parent, if restarted, may drain now
+	if err := r.Ready(); err != nil {
+		s.logs.Warnf("restart: %v", err)
+	}
+
+	return s.Run(ctx, admin...)
+}
+
+// testCertFiles writes a certificate for 127.0.0.1 and its key as PEM
+// files, returning the CA that signed it and the paths
+func testCertFiles(t *testing.T) (ca *TLSCA, certFile, keyFile string) {
+	t.Helper()
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Issue(TLSLeaf{Name: "server", Hosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600)
+
+	return ca, certFile, keyFile
+}
+
+func TestServeConfig(t *testing.T) {
+	backend, _ := startBackend(t, "app")
+
+	ca, certFile, keyFile := testCertFiles(t)
+
+	yaml := fmt.Sprintf(`
+listeners:
+  - name: echo
+    kind: echo
+    addr: 127.0.0.1:0
+  - name: echo-udp
+    kind: echo
+    network: udp
+    addr: 127.0.0.1:0
+  - name: tunnel
+    kind: connect_proxy
+    addr: 127.0.0.1:0
+    allow: ["*"]
+  - name: web
+    kind: reverse_proxy
+    addr: 127.0.0.1:0
+    tls: site
+    backend: app
+backends:
+  app: [%s]
+tls:
+  site:
+    cert: %s
+    key: %s
+`, backend.URL, certFile, keyFile)
+	cfg, err := parseConfig([]byte(yaml), ".yaml", func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newConfigServer(cfg, NewLevelLog(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	// TCP echo, reached through the CONNECT proxy
+	dialCtx, cancelDial := context.WithTimeout(ctx, 2*time.Second)
+	defer cancelDial()
+	conn, err := DialConnect(dialCtx, "http://"+s.Addr("tunnel").String(), s.Addr("echo").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("tcp"))
+	if b, err := ReadExactly(conn, 3); err != nil || string(b) != "tcp" {
+		t.Errorf("unexpected TCP echo %q, %v", b, err)
+	}
+	_ = conn.Close()
+
+	// UDP echo
+	udp, err := net.Dial("udp", s.Addr("echo-udp").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	_ = udp.SetDeadline(time.Now().Add(time.Second))
+	_, _ = udp.Write([]byte("udp"))
+	b := make([]byte, 3)
+	if n, err := udp.Read(b); err != nil || string(b[:n]) != "udp" {
+		t.Errorf("unexpected UDP echo %q, %v", b[:n], err)
+	}
+
+	// The reverse proxy over TLS
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: ClientConfig(ca.Pool())}}
+	resp, err := client.Get("https://" + s.Addr("web").String() + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !strings.HasPrefix(string(body), "app /hello") {
+		t.Errorf("unexpected response %q", body)
+	}
+	client.CloseIdleConnections()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean stop; actual: %v", err)
+	}
+}
+
+func TestServeConfigPortInUse(t *testing.T) {
+	taken := testListener(t)
+	cfg := &Config{Listeners: []ListenerConfig{
+		{Name: "first", Kind: kindEcho, Network: "tcp", Addr: "127.0.0.1:0"},
+		{Name: "second", Kind: kindEcho, Network: "tcp", Addr: taken.Addr().String()},
+	}}
+
+	// The first listener is closed again when the second one fails
+	_, err := newConfigServer(cfg, NewLevelLog(log.New(io.Discard, "", 0)))
+	if err == nil || !strings.Contains(err.Error(), `listener "second"`) || !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("expected address in use for the second listener; actual: %v", err)
+	}
+}
+
+func TestServeReload(t *testing.T) {
+	first, _ := startBackend(t, "first")
+	second, _ := startBackend(t, "second")
+	noEnv := func(string) (string, bool) { return "", false }
+
+	config := func(extra string, v ...any) *Config {
+		t.Helper()
+		cfg, err := parseConfig([]byte(fmt.Sprintf(`
+listeners:
+  - name: echo
+    kind: echo
+    addr: 127.0.0.1:0
+  - name: tunnel
+    kind: connect_proxy
+    addr: 127.0.0.1:0
+    allow: [%s]
+  - name: web
+    kind: reverse_proxy
+    addr: 127.0.0.1:0
+    backend: app
+`+extra, v...)), ".yaml", noEnv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	cfg := config("backends:\n  app: [%s]\n", "\"*\"", first.URL)
+	s, err := newConfigServer(cfg, NewLevelLog(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	echoAddr, tunnelAddr, webAddr := s.Addr("echo").String(), s.Addr("tunnel").String(), s.Addr("web").String()
+	get := func() string {
+		t.Helper()
+		resp, err := http.Get("http://" + webAddr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	dialCtx, cancelDial := context.WithTimeout(ctx, 2*time.Second)
+	defer cancelDial()
+
+	tunnel, err := DialConnect(dialCtx, "http://"+tunnelAddr, echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	if !strings.HasPrefix(get(), "first") {
+		t.Fatal("expected the first backend")
+	}
+
+	// Another allow list, another backend, one connection per client, and
+	// a new listener
+	cfg = config(`  - name: extra
+    kind: echo
+    addr: 127.0.0.1:0
+backends:
+  app: [%s]
+limits:
+  max_conns_per_ip: 1
+`, "elsewhere:80", second.URL)
+	if err := s.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(); !strings.HasPrefix(body, "second") {
+		t.Errorf("expected the second backend; actual: %q", body)
+	}
+	if _, err := DialConnect(dialCtx, "http://"+tunnelAddr, echoAddr); err == nil {
+		t.Error("expected the new allow list to refuse the tunnel")
+	}
+
+	// The tunnel opened before still works, and holds the only
+	// connection to the echo listener
+	_, _ = tunnel.Write([]byte("still"))
+	if b, err := ReadExactly(tunnel, 5); err != nil || string(b) != "still" {
+		t.Errorf("unexpected echo through the old tunnel %q, %v", b, err)
+	}
+	conn, err := net.Dial("tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected a second connection to be closed")
+	}
+	_ = conn.Close()
+
+	extra, err := net.Dial("tcp", s.Addr("extra").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = extra.Write([]byte("new"))
+	if b, err := ReadExactly(extra, 3); err != nil || string(b) != "new" {
+		t.Errorf("unexpected echo from the new listener %q, %v", b, err)
+	}
+	_ = extra.Close()
+
+	// The extra listener goes away, the others stay where they are
+	extraAddr := s.Addr("extra").String()
+	if err := s.Reload(config("backends:\n  app: [%s]\n", "\"*\"", second.URL)); err != nil {
+		t.Fatal(err)
+	}
+	if s.Addr("extra") != nil || s.Addr("echo").String() != echoAddr {
+		t.Error("unexpected listeners after removing one")
+	}
+	if conn, err := net.DialTimeout("tcp", extraAddr, time.Second); err == nil {
+		_ = conn.Close()
+		t.Error("expected the removed listener to be closed")
+	}
+
+	// A reload that can't bind changes nothing
+	taken := testListener(t)
+	bad := config("  - name: taken\n    kind: echo\n    addr: %s\nbackends:\n  app: [%s]\n", "\"*\"", taken.Addr(), first.URL)
+	if err := s.Reload(bad); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("expected address in use; actual: %v", err)
+	}
+	if body := get(); !strings.HasPrefix(body, "second") {
+		t.Errorf("expected the failed reload to keep the second backend; actual: %q", body)
+	}
+
+	_ = tunnel.Close()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean stop; actual: %v", err)
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+listeners:
+  - name: echo
+    kind: echo
+    addr: 127.0.0.1:0
+  - name: tunnel
+    kind: connect_proxy
+    addr: 127.0.0.1:0
+    allow: ["*"]
+`), ".yaml", func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newConfigServer(cfg, NewLevelLog(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.Run(ctx) }()
+
+	echoAddr := s.Addr("echo").String()
+	dialCtx, cancelDial := context.WithTimeout(ctx, 2*time.Second)
+	defer cancelDial()
+	tunnel, err := DialConnect(dialCtx, "http://"+s.Addr("tunnel").String(), echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	// The tunnel shows up on both sides of the proxy, once the echo
+	// server got around to accepting it
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		conns := s.Conns()
+		if len(conns["echo"]) == 1 && len(conns["tunnel"]) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected connections %+v", conns)
+		}
+	}
+
+	// Draining the echo listener closes it, the tunnel going with it
+	// once it's past the drain deadline
+	if err := s.Drain(ctx, "echo"); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.DialTimeout("tcp", echoAddr, time.Second); err == nil {
+		_ = conn.Close()
+		t.Error("expected the drained listener to be closed")
+	}
+	if _, ok := s.Conns()["echo"]; ok {
+		t.Error("expected the drained listener to be gone")
+	}
+	if err := s.Drain(ctx, "echo"); !errors.Is(err, ErrUnknownListener) {
+		t.Errorf("expected an unknown listener; actual: %v", err)
+	}
+}
+
+func TestServeRestart(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+listeners:
+  - name: echo
+    kind: echo
+    addr: 127.0.0.1:0
+  - name: echo-udp
+    kind: echo
+    network: udp
+    addr: 127.0.0.1:0
+`), ".yaml", func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := NewLevelLog(log.New(io.Discard, "", 0))
+
+	parent, err := newRestarter("", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := openConfigServer(cfg, logs, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCtx, stopOld := context.WithCancel(context.Background())
+	oldDone := make(chan struct{})
+	go func() {
+		defer close(oldDone)
+		_ = old.Run(oldCtx)
+	}()
+
+	// What Restart hands to the new process, which serves on the same
+	// sockets
+	files, spec, err := parent.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := newRestarter(spec, files, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := openConfigServer(cfg, logs, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"echo", "echo-udp"} {
+		if s.Addr(name).String() != old.Addr(name).String() {
+			t.Errorf("%s: expected %s inherited; actual: %s", name, old.Addr(name), s.Addr(name))
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.Run(ctx) }()
+
+	// The old process drains, the new one keeps answering
+	stopOld()
+	<-oldDone
+	for _, network := range []string{"tcp", "udp"} {
+		name := map[string]string{"tcp": "echo", "udp": "echo-udp"}[network]
+		conn, err := net.Dial(network, s.Addr(name).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		_, _ = conn.Write([]byte("still here"))
+		if b, err := ReadExactly(conn, 10); err != nil || string(b) != "still here" {
+			t.Errorf("%s: unexpected echo %q: %v", name, b, err)
+		}
+		_ = conn.Close()
+	}
+
+	// The old sockets are closed now, a later restart hands down none
+	if files, spec, err := parent.Files(); err != nil || len(files) != 0 {
+		t.Errorf("expected no sockets left; actual: %q, %v", spec, err)
+	}
+}
+
+func TestServeFilter(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+	config := func(deny string) *Config {
+		t.Helper()
+		cfg, err := parseConfig([]byte(`
+listeners:
+  - name: echo
+    kind: echo
+    addr: 127.0.0.1:0
+    filter: peers
+  - name: udp
+    kind: echo
+    network: udp
+    addr: 127.0.0.1:0
+    filter: peers
+  - name: tunnel
+    kind: connect_proxy
+    addr: 127.0.0.1:0
+    allow: ["*"]
+    filter: peers
+filters:
+  peers:
+    deny: [`+deny+`]
+admin:
+  filter: peers
+`), ".yaml", noEnv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	s, err := newConfigServer(config("127.0.0.0/8"), NewLevelLog(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.Run(ctx) }()
+
+	// echoes reports whether every listener answers
+	echoes := func() map[string]bool {
+		answered := make(map[string]bool)
+		for _, name := range []string{"echo", "udp"} {
+			conn, err := net.Dial(s.Addr(name).Network(), s.Addr(name).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+			_, _ = conn.Write([]byte("hi"))
+			b, err := ReadExactly(conn, 2)
+			answered[name] = err == nil && string(b) == "hi"
+			_ = conn.Close()
+		}
+		dialCtx, cancelDial := context.WithTimeout(ctx, time.Second)
+		defer cancelDial()
+		tunnel, err := DialConnect(dialCtx, "http://"+s.Addr("tunnel").String(), s.Addr("echo").String())
+		answered["tunnel"] = err == nil
+		if err == nil {
+			_ = tunnel.Close()
+		}
+		return answered
+	}
+
+	for name, ok := range echoes() {
+		if ok {
+			t.Errorf("%s: expected loopback to be denied", name)
+		}
+	}
+	if s.adminFilter.rules.Load().Allowed(netip.MustParseAddr("127.0.0.1")) {
+		t.Error("expected the admin filter to deny loopback")
+	}
+
+	// The filter changes under the running listeners
+	if err := s.Reload(config("192.0.2.0/24")); err != nil {
+		t.Fatal(err)
+	}
+	for name, ok := range echoes() {
+		if !ok {
+			t.Errorf("%s: expected loopback to be allowed after the reload", name)
+		}
+	}
+	if !s.adminFilter.rules.Load().Allowed(netip.MustParseAddr("127.0.0.1")) {
+		t.Error("expected the reload to apply to the admin filter")
+	}
+}
+
+func TestServePeers(t *testing.T) {
+	peers := filepath.Join(t.TempDir(), "peers.csv")
+	if err := os.WriteFile(peers, []byte("127.0.0.0/8,ZZ,AS64500,Loopback\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Listeners: []ListenerConfig{{Name: "echo", Kind: kindEcho, Network: "tcp", Addr: "127.0.0.1:0"}},
+		Log:       LogConfig{Peers: peers},
+	}
+	s, err := newConfigServer(cfg, NewLevelLog(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.Run(ctx) }()
+
+	addr := s.Addr("echo").String()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("hi"))
+	if _, err := ReadExactly(conn, 2); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	expected := `tcp_server_peers_total{addr="` + addr + `",country="ZZ",asn="AS64500"} 1`
+	b := new(strings.Builder)
+	_, _ = DefaultMetrics.WriteTo(b)
+	if !strings.Contains(b.String(), expected+"\n") {
+		t.Errorf("expected %s in the metrics", expected)
+	}
+
+	// A database that can't be read stops the command
+	cfg.Log.Peers = filepath.Join(t.TempDir(), "missing.csv")
+	if _, err := newConfigServer(cfg, NewLevelLog(log.New(io.Discard, "", 0))); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing database; actual: %v", err)
+	}
+}
+
+func TestServeDenyJA3(t *testing.T) {
+	ca, certFile, keyFile := testCertFiles(t)
+	clientConfig := ClientConfig(ca.Pool())
+
+	// The JA3 of our own client, as a FingerprintListener sees it
+	fl := &FingerprintListener{Listener: testListener(t)}
+	ja3 := make(chan string, 1)
+	go func() {
+		conn, err := fl.Accept()
+		if err != nil {
+			return
+		}
+		fp, _ := conn.(*FingerprintConn).Fingerprint()
+		ja3 <- fp.JA3Hash()
+		_ = conn.Close()
+	}()
+	if conn, err := tls.Dial("tcp", fl.Addr().String(), clientConfig); err == nil {
+		_ = conn.Close()
+	}
+	ours := <-ja3
+
+	config := func(deny string) *Config {
+		t.Helper()
+		cfg, err := parseConfig([]byte(fmt.Sprintf(`
+listeners:
+  - name: echo
+    kind: echo
+    addr: 127.0.0.1:0
+    tls: site
+    deny_ja3: ["%s"]
+tls:
+  site:
+    cert: %s
+    key: %s
+`, deny, certFile, keyFile)), ".yaml", func(string) (string, bool) { return "", false })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	s, err := newConfigServer(config(ours), NewLevelLog(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.Run(ctx) }()
+
+	echoes := func() bool {
+		conn, err := tls.Dial("tcp", s.Addr("echo").String(), clientConfig)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("hi"))
+		b, err := ReadExactly(conn, 2)
+		return err == nil && string(b) == "hi"
+	}
+	if echoes() {
+		t.Error("expected our JA3 to be refused")
+	}
+
+	// Another hash lets us in
+	if err := s.Reload(config(strings.Repeat("0", 32))); err != nil {
+		t.Fatal(err)
+	}
+	if !echoes() {
+		t.Error("expected the reload to let our JA3 in")
+	}
+}
+
+func TestServeSNIRouter(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := func(host string) string {
+		cert, err := ca.Issue(TLSLeaf{Name: host, Hosts: []string{host}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return startTLSEcho(t, ServerConfig(cert, nil), nil).Addr().String()
+	}
+	shop, blog := backend("shop.test"), backend("blog.test")
+
+	config := func(routes string) *Config {
+		t.Helper()
+		cfg, err := parseConfig([]byte(`
+listeners:
+  - name: router
+    kind: sni_router
+    addr: 127.0.0.1:0
+    routes:
+      `+routes+`
+`), ".yaml", func(string) (string, bool) { return "", false })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	s, err := newConfigServer(config(`shop.test: "`+shop+`"`), NewLevelLog(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = s.Run(ctx) }()
+
+	echoes := func(name string) bool {
+		clientConfig := ClientConfig(ca.Pool())
+		clientConfig.ServerName = name
+		echo, err := tlsEcho(s.Addr("router").String(), clientConfig)
+		return err == nil && echo == "ping"
+	}
+	if !echoes("shop.test") || echoes("blog.test") {
+		t.Error("expected only shop.test to be routed")
+	}
+
+	// The routes change under the running listener
+	if err := s.Reload(config(`blog.test: "` + blog + `"`)); err != nil {
+		t.Fatal(err)
+	}
+	if echoes("shop.test") || !echoes("blog.test") {
+		t.Error("expected only blog.test to be routed after the reload")
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server
+//
+// The other side of Client: a TLV server with what a server exposed to
+// a network needs, wired from the pieces of this repo. NewServer takes
+// the address, a TLVRegistry of handlers and a handful of options:
+//
+//	handlers := NewTLVRegistry()
+//	handlers.Handle("echo", func(_ *TLVConn, p Payload) (io.WriterTo, error) {
+//		_, text, _ := strings.Cut(p.String(), " ")
+//		return String(text), nil
+//	})
+//	srv, err := NewServer(":7000", handlers, &ServerOptions{TLS: cfg, Metrics: DefaultMetrics})
+//	err = Run(ctx, srv)
+//
+// - TCPServer accepts, with its panic guard, accept backoff and limits
+//   (MaxConnsPerIP, AcceptRate), and Allow and Deny networks through a
+//   NetFilter
+// - TLS, when set, is the first thing on every connection, as Client
+//   expects it
+// - every connection is a TLVConn served by ServeTLV: one payload, its
+//   handler, its reply, within the Quota
+// - a connection silent for IdleTimeout is closed; Client's heartbeats,
+//   the pings TLVConn skips, are what keeps an idle client connected
+// - Metrics gets the TCPServer series and the handler latencies
+//   (LatencyRecorder) labeled with the address; Monitor, when set,
+//   logs the traffic of every connection
+// - a Server is a Service: Run stops it on SIGINT or SIGTERM, Shutdown
+//   letting the payloads in progress finish
+//
+// The registry dispatches String payloads on their first word, case
+// insensitively, like LineServer does lines; the handler gets the whole
+// payload. Binary payloads and unknown commands go to NotFound.
+//
+// The tlvd command is a complete example.
+
+const (
+	// defaultServerIdleTimeout gives a client four of Client's default
+	// heartbeats to show up
+	defaultServerIdleTimeout = 4 * defaultPingInterval
+
+	defaultServerHandshakeTimeout = 10 * time.Second
+)
+
+// TLVRegistry dispatches payloads to handlers, see above
+type TLVRegistry struct {
+	// NotFound handles the payloads no handler is registered for. When
+	// nil, "unknown command" is replied.
+	NotFound TLVHandler
+
+	mu       sync.RWMutex
+	handlers map[string]TLVHandler
+}
+
+// NewTLVRegistry returns a registry with no handlers
+func NewTLVRegistry() *TLVRegistry {
+	return &TLVRegistry{handlers: make(map[string]TLVHandler)}
+}
+
+// Handle registers h for the String payloads starting with command
+func (r *TLVRegistry) Handle(command string, h TLVHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handlers[strings.ToUpper(command)] = h
+}
+
+// Serve is the TLVHandler dispatching p
+func (r *TLVRegistry) Serve(c *TLVConn, p Payload) (io.WriterTo, error) {
+	if s, ok := p.(*String); ok {
+		command, _, _ := strings.Cut(strings.TrimSpace(s.String()), " ")
+
+		r.mu.RLock()
+		h, ok := r.handlers[strings.ToUpper(command)]
+		r.mu.RUnlock()
+
+		if ok {
+			return h(c, p)
+		}
+	}
+	if r.NotFound != nil {
+		return r.NotFound(c, p)
+	}
+
+	return String("unknown command"), nil
+}
+
+// ServerOptions configure a Server; the zero value is usable
+type ServerOptions struct {
+	// TLS, when set, secures every connection
+	TLS *tls.Config
+
+	// IdleTimeout closes the connections that stay silent, 2 minutes by
+	// default
+	IdleTimeout time.Duration
+
+	// Allow and Deny are the networks that may connect, or not, as
+	// NewRuleSet reads them
+	Allow, Deny []string
+
+	// Limits of TCPServer, 0 for none
+	MaxConnsPerIP int
+	AcceptRate    float64
+	AcceptBurst   int
+
+	// Quota bounds what a connection may send
+	Quota MessageQuota
+
+	// Metrics, when set, receives the server's metrics
+	Metrics *Metrics
+
+	// Monitor, when set, logs the traffic of every connection
+	Monitor *Monitor
+
+	// ErrorLog receives the connection errors
+	ErrorLog *log.Logger
+}
+
+// Server serves a TLVRegistry, see above
+type Server struct {
+	opts     ServerOptions
+	handlers *TLVRegistry
+	tcp      *TCPServer
+	latency  *LatencyRecorder
+	filter   *NetFilter
+}
+
+// NewServer listens on addr, for handlers
+func NewServer(addr string, handlers *TLVRegistry, opts *ServerOptions) (*Server, error) {
+	s := &Server{handlers: handlers}
+	if opts != nil {
+		s.opts = *opts
+	}
+
+	var rules *RuleSet
+	if len(s.opts.Allow) > 0 || len(s.opts.Deny) > 0 {
+		var err error
+		if rules, err = NewRuleSet(s.opts.Allow, s.opts.Deny); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.tcp = NewTCPServer(l)
+	s.tcp.ErrorLog = s.opts.ErrorLog
+	s.tcp.MaxConnsPerIP = s.opts.MaxConnsPerIP
+	s.tcp.AcceptRate = s.opts.AcceptRate
+	s.tcp.AcceptBurst = s.opts.AcceptBurst
+	s.tcp.Metrics = s.opts.Metrics
+	if rules != nil {
+		s.filter = NewNetFilter(rules)
+		s.tcp.Deny = s.filter.Deny
+	}
+
+	if m := s.opts.Metrics; m != nil {
+		s.latency = NewLatencyRecorder(m, s.Addr().String())
+		if s.opts.Quota.Metrics == nil {
+			s.opts.Quota.Metrics = m
+		}
+	}
+	if s.opts.Quota.Name == "" {
+		s.opts.Quota.Name = s.Addr().String()
+	}
+
+	return s, nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.tcp.Addr()
+}
+
+func (s *Server) logf(format string, v ...any) {
+	if s.opts.ErrorLog != nil {
+		s.opts.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Serve serves the connections until ctx is done or Shutdown is called
+func (s *Server) Serve(ctx context.Context) error {
+	return s.tcp.Serve(ctx, s.serveConn)
+}
+
+// Shutdown stops accepting and waits for the connections, see
+// TCPServer.Shutdown
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.tcp.Shutdown(ctx)
+}
+
+// String names the server for Run
+func (s *Server) String() string {
+	return "tlv " + s.Addr().String()
+}
+
+// serveConn is the ConnHandler of the TCPServer
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	if s.opts.Monitor != nil {
+		conn = NewMonitoredConnContext(ctx, conn, s.opts.Monitor)
+	}
+	if s.opts.TLS != nil {
+		tc := tls.Server(conn, s.opts.TLS)
+		hctx, cancel := context.WithTimeout(ctx, defaultServerHandshakeTimeout)
+		err := tc.HandshakeContext(hctx)
+		cancel()
+		if err != nil {
+			s.logf("tlv %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		conn = tc
+	}
+
+	idle := s.opts.IdleTimeout
+	if idle <= 0 {
+		idle = defaultServerIdleTimeout
+	}
+	tc := TLVServer(NewIdleConn(conn, idle), nil)
+	tc.Quota = s.opts.Quota
+
+	handler := s.handlers.Serve
+	if s.latency != nil {
+		handler = s.latency.TLVHandler(handler)
+	}
+	err := ServeTLV(tc, handler)
+	if err != nil && !IsClosed(err) && !errors.Is(err, ErrIdle) && ctx.Err() == nil {
+		s.logf("tlv %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func tlvdMain(args []string) error {
+	fs := flag.NewFlagSet("tlvd", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:7000", "`address` to listen on")
+	cert := fs.String("cert", "", "certificate `file` for TLS, with -key")
+	key := fs.String("key", "", "private key `file` for TLS")
+	allow := fs.String("allow", "", "comma separated `networks` allowed to connect, anyone if empty")
+	deny := fs.String("deny", "", "comma separated `networks` refused")
+	metrics := fs.String("metrics", "", "`address` to serve /metrics on, empty for none")
+	verbose := fs.Bool("v", false, "log the traffic of every connection")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	handlers := NewTLVRegistry()
+	handlers.Handle("echo", func(_ *TLVConn, p Payload) (io.WriterTo, error) {
+		_, text, _ := strings.Cut(p.String(), " ")
+		return String(text), nil
+	})
+	handlers.Handle("time", func(*TLVConn, Payload) (io.WriterTo, error) {
+		return String(time.Now().UTC().Format(time.RFC3339Nano)), nil
+	})
+	handlers.Handle("quit", func(c *TLVConn, _ Payload) (io.WriterTo, error) {
+		_ = c.Send(String("bye"))
+		return nil, io.EOF
+	})
+	// Binary payloads come back as they are
+	handlers.NotFound = func(_ *TLVConn, p Payload) (io.WriterTo, error) {
+		if b, ok := p.(*Binary); ok {
+			return *b, nil
+		}
+		return String("unknown command"), nil
+	}
+
+	logger := log.New(log.Writer(), "tlvd: ", log.LstdFlags)
+	opts := &ServerOptions{
+		Allow:         splitList(*allow),
+		Deny:          splitList(*deny),
+		MaxConnsPerIP: 64,
+		Quota:         MessageQuota{MaxBytes: 100 << 20},
+		Metrics:       DefaultMetrics,
+		ErrorLog:      logger,
+	}
+	if *cert != "" {
+		pair, err := tls.LoadX509KeyPair(*cert, *key)
+		if err != nil {
+			return err
+		}
+		opts.TLS = ServerConfig(pair, nil)
+	}
+	if *verbose {
+		opts.Monitor = &Monitor{Logger: logger}
+	}
+
+	srv, err := NewServer(*addr, handlers, opts)
+	if err != nil {
+		return err
+	}
+	services := []Service{srv}
+	logger.Printf("listening on %s", srv.Addr())
+
+	if *metrics != "" {
+		l, err := net.Listen("tcp", *metrics)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", DefaultMetrics)
+		services = append(services, HTTPService("metrics", &http.Server{Handler: mux, ErrorLog: logger}, l))
+	}
+
+	return (&Runner{ErrorLog: logger}).Run(context.Background(), services...)
+}
+
+// splitList splits a comma separated flag, "" being no items
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+func TestServer(t *testing.T) {
+	serverTLS, clientTLS := tlvTLSConfigs(t)
+	handlers := NewTLVRegistry()
+	handlers.Handle("echo", func(_ *TLVConn, p Payload) (io.WriterTo, error) {
+		_, text, _ := strings.Cut(p.String(), " ")
+		return String(text), nil
+	})
+	m := new(Metrics)
+	srv, err := NewServer("127.0.0.1:0", handlers, &ServerOptions{
+		TLS:         serverTLS,
+		IdleTimeout: 50 * time.Millisecond,
+		Deny:        []string{"192.0.2.0/24"},
+		Quota:       MessageQuota{MaxMessages: 4},
+		Metrics:     m,
+		ErrorLog:    log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	r := &Runner{ErrorLog: log.New(io.Discard, "", 0)}
+	go func() { served <- r.Run(ctx, srv) }()
+
+	// The client's heartbeats keep it connected past the idle timeout
+	c := NewClient(srv.Addr().String(), &ClientOptions{
+		TLS:       clientTLS,
+		Retry:     RetryPolicy{Attempts: 1},
+		Heartbeat: 10 * time.Millisecond,
+	})
+	defer c.Close()
+	for _, msg := range []string{"ECHO hello", "nope"} {
+		if _, err := c.Request(ctx, String(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(120 * time.Millisecond)
+	reply, err := c.Request(ctx, String("echo again"))
+	if err != nil || reply.String() != "again" {
+		t.Fatalf("unexpected reply %v: %v", reply, err)
+	}
+
+	// A silent one is dropped
+	conn, err := tls.Dial("tcp", srv.Addr().String(), clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !IsClosed(err) {
+		t.Errorf("expected the idle connection closed; actual: %v", err)
+	}
+
+	// The fifth payload of a connection is over its quota
+	_, _ = c.Request(ctx, String("echo four"))
+	if _, err := c.Request(ctx, String("echo five")); !IsClosed(err) {
+		t.Errorf("expected the connection closed over its quota; actual: %v", err)
+	}
+
+	var scrape strings.Builder
+	_, _ = m.WriteTo(&scrape)
+	addr := srv.Addr().String()
+	for _, want := range []string{
+		`handler_duration_seconds_count{listener="` + addr + `"} 4`,
+		`quota_exceeded_total{server="` + addr + `",limit="messages"} 1`,
+		`tcp_server_accepted_total{addr="` + addr + `"} 2`,
+	} {
+		if !strings.Contains(scrape.String(), want) {
+			t.Errorf("expected %s in\n%s", want, scrape.String())
+		}
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean stop; actual: %v", err)
+	}
+}
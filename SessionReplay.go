@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Session recording and replay
+//
+// A RecordingConn wraps a net.Conn and writes every chunk of data that
+// passes through it, in either direction, to a capture file together
+// with the time it happened (relative to the start of the session).
+//
+// A Replayer reads such a capture back and re-sends one side of the
+// conversation to a target address, sleeping between chunks to keep the
+// original timing (or a scaled down version of it). That makes it easy
+// to reproduce a bug report or a load pattern against a local server.
+//
+// Each record in the capture is laid out as:
+// [8 bytes offset in ns][1 byte direction][4 bytes length][payload]
+
+// SessionEvent is a single recorded chunk of traffic
+type SessionEvent struct {
+	Offset    time.Duration // Time since the start of the session
+	Direction Direction     // Inbound (read) or Outbound (written)
+	Payload   []byte
+}
+
+// RecordingConn records all traffic of the wrapped connection
+type RecordingConn struct {
+	net.Conn
+
+	mu    sync.Mutex // Serializes concurrent Read/Write records
+	w     io.Writer  // Capture destination
+	start time.Time  // Start of the session, offsets are relative to it
+	err   error      // First error writing the capture, recording stops there
+}
+
+// NewRecordingConn returns conn wrapped so its traffic is recorded to w
+func NewRecordingConn(conn net.Conn, w io.Writer) *RecordingConn {
+	return &RecordingConn{Conn: conn, w: w, start: time.Now()}
+}
+
+// Read reads from the connection and records what was received
+func (c *RecordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.record(Inbound, p[:n])
+	}
+
+	return n, err
+}
+
+// Write writes to the connection and records what was sent
+func (c *RecordingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.record(Outbound, p[:n])
+	}
+
+	return n, err
+}
+
+// Err returns the first error that occurred while writing the capture
+func (c *RecordingConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// record appends a single event to the capture
+func (c *RecordingConn) record(d Direction, p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A broken capture shouldn't break the connection, we just
+	// stop recording and remember why
+	if c.err != nil {
+		return
+	}
+
+	_, c.err = SessionEvent{
+		Offset:    time.Since(c.start),
+		Direction: d,
+		Payload:   p,
+	}.WriteTo(c.w)
+}
+
+// WriteTo serializes the event in the capture format
+func (e SessionEvent) WriteTo(w io.Writer) (int64, error) {
+	// Build the header in one go so a record is written with a
+	// single call to the underlying writer
+	var header [13]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(e.Offset))
+	header[8] = byte(e.Direction)
+	binary.BigEndian.PutUint32(header[9:], uint32(len(e.Payload)))
+
+	n, err := w.Write(append(header[:], e.Payload...))
+	return int64(n), err
+}
+
+// ReadFrom deserializes a single event from the capture format
+func (e *SessionEvent) ReadFrom(r io.Reader) (int64, error) {
+	var header [13]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return int64(n), err
+	}
+
+	size := binary.BigEndian.Uint32(header[9:])
+	// Reuse the TLV payload limit to keep a corrupt capture
+	// from allocating huge buffers
+	if size > MaxPayloadSize {
+		return int64(n), ErrMaxPayloadSize
+	}
+
+	e.Offset = time.Duration(binary.BigEndian.Uint64(header[:8]))
+	e.Direction = Direction(header[8])
+	e.Payload = make([]byte, size)
+
+	m, err := io.ReadFull(r, e.Payload)
+	if err == io.EOF {
+		// Header without payload, the capture was cut short
+		err = io.ErrUnexpectedEOF
+	}
+
+	return int64(n + m), err
+}
+
+// ReadSession reads all events from a capture
+func ReadSession(r io.Reader) ([]SessionEvent, error) {
+	var events []SessionEvent
+	for {
+		var e SessionEvent
+		_, err := e.ReadFrom(r)
+		if err != nil {
+			// A clean EOF between records is the end of the capture
+			if err == io.EOF {
+				return events, nil
+			}
+			return events, err
+		}
+		events = append(events, e)
+	}
+}
+
+// Replayer re-sends one side of a recorded session to a target
+type Replayer struct {
+	// Direction selects which side of the capture is sent. Use
+	// Outbound for a capture taken on the client and Inbound for a
+	// capture taken on the server.
+	Direction Direction
+
+	// Speed scales the original timing: 1 keeps it, 2 replays twice
+	// as fast, and 0 sends everything without any delay.
+	Speed float64
+
+	// Dialer is used to connect to the target. The zero value is fine.
+	Dialer net.Dialer
+}
+
+// Replay dials address and sends the selected events with their
+// original (scaled) inter-message timing. Whatever the target sends
+// back is read and discarded so it never blocks on a full window.
+func (r *Replayer) Replay(ctx context.Context, address string, events []SessionEvent) error {
+	conn, err := r.Dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Close the connection on cancellation to unblock Write
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	// Drain responses in the background
+	go func() { _, _ = io.Copy(io.Discard, conn) }()
+
+	start := time.Now()
+	for _, e := range events {
+		if e.Direction != r.Direction {
+			continue
+		}
+
+		// Wait until the (scaled) offset of this event is reached
+		if r.Speed > 0 {
+			due := time.Duration(float64(e.Offset) / r.Speed)
+			if wait := due - time.Since(start); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		if _, err := conn.Write(e.Payload); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestSessionReplay(t *testing.T) {
+	// Record a small session on the client side of a pipe
+	capture := new(bytes.Buffer)
+	client, server := net.Pipe()
+	rec := NewRecordingConn(client, capture)
+
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 1024)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			// Echo every message back
+			if _, err := server.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 1024)
+	for _, msg := range []string{"ping", "echo", "bye"} {
+		if _, err := rec.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rec.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = rec.Close()
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := ReadSession(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 6 {
+		t.Fatalf("expected 6 events; actual: %d", len(events))
+	}
+
+	// Replay the client side to a listener and collect what arrives
+	listener := testListener(t)
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		b, _ := io.ReadAll(conn)
+		received <- b
+	}()
+
+	r := &Replayer{Direction: Outbound, Speed: 0}
+	if err := r.Replay(context.Background(), listener.Addr().String(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := <-received; string(actual) != "pingechobye" {
+		t.Errorf("expected %q; actual: %q", "pingechobye", actual)
+	}
+}
+
+func TestSessionEventTruncated(t *testing.T) {
+	// A header announcing 10 bytes followed by only 3 of them
+	buf := new(bytes.Buffer)
+	_, _ = SessionEvent{Payload: []byte("0123456789")}.WriteTo(buf)
+	buf.Truncate(13 + 3)
+
+	_, err := ReadSession(buf)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected unexpected EOF; actual: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Socket options of accepted connections
+//
+// The defaults suit most protocols, but not all of them:
+//
+// - Go turns Nagle's algorithm off (TCP_NODELAY) on every TCP
+//   connection, so small writes go out right away. That is what a
+//   heartbeat or a TLV RPC wants; a server trickling small writes of a
+//   bulk stream would rather have them coalesced into full packets.
+// - The kernel sizes the socket buffers (SO_SNDBUF, SO_RCVBUF) itself,
+//   growing them with the traffic. A fixed size caps the memory of a
+//   server with many slow clients, or lets a single stream over a long
+//   fat pipe fill it without waiting for the autotuning. A size set by
+//   hand turns the autotuning off for that socket, and linux doubles it
+//   for its bookkeeping.
+// - Linux delays ACKs to piggyback them on the reply. For
+//   request-response protocols where the reply comes late, or never,
+//   TCP_QUICKACK acknowledges right away. The kernel may go back to
+//   delaying ACKs later on, the option isn't sticky; setting it at
+//   accept covers the first exchanges. Other systems have no such
+//   option per socket and ignore it.
+//
+// SocketOptions holds them, applied right after Accept: by TCPServer
+// through its Socket field, and by SocketListener for servers that do
+// their own accepting (net/http). Connections that aren't TCP, through
+// a unix socket or in memory, are left alone.
+
+// SocketOptions are the options set on accepted TCP connections. The
+// zero value keeps the defaults.
+type SocketOptions struct {
+	Nagle         bool `json:"nagle"`          // Leave Nagle's algorithm on (TCP_NODELAY off)
+	SendBuffer    int  `json:"send_buffer"`    // SO_SNDBUF in bytes, 0 for the kernel's
+	ReceiveBuffer int  `json:"receive_buffer"` // SO_RCVBUF in bytes, 0 for the kernel's
+	QuickAck      bool `json:"quick_ack"`      // TCP_QUICKACK, linux only
+}
+
+// Apply sets the options on conn, looking through wrappers that have a
+// NetConn method for a *net.TCPConn. Other connections are left alone.
+func (o SocketOptions) Apply(conn net.Conn) error {
+	for conn != nil {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			return o.apply(tc)
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = u.NetConn()
+	}
+
+	return nil
+}
+
+func (o SocketOptions) apply(conn *net.TCPConn) error {
+	if o.Nagle {
+		if err := conn.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := conn.SetWriteBuffer(o.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if o.ReceiveBuffer > 0 {
+		if err := conn.SetReadBuffer(o.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	if o.QuickAck {
+		rc, err := conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if err := setQuickAck(rc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SocketListener applies socket options to the connections it accepts
+type SocketListener struct {
+	net.Listener
+
+	// Failed, when set, is called with the connections whose options
+	// couldn't be set. They are served with the defaults.
+	Failed func(conn net.Conn, err error)
+
+	options atomic.Pointer[SocketOptions]
+}
+
+// NewSocketListener returns a listener applying o to the connections
+// accepted on l
+func NewSocketListener(l net.Listener, o SocketOptions) *SocketListener {
+	sl := &SocketListener{Listener: l}
+	sl.SetOptions(o)
+
+	return sl
+}
+
+// SetOptions changes the options of the connections accepted from now on
+func (l *SocketListener) SetOptions(o SocketOptions) {
+	l.options.Store(&o)
+}
+
+// Accept waits for a connection and sets its options
+func (l *SocketListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	var o SocketOptions
+	if p := l.options.Load(); p != nil {
+		o = *p
+	}
+	if err := o.Apply(conn); err != nil && l.Failed != nil {
+		l.Failed(conn, err)
+	}
+
+	return conn, nil
+}
+
+// SetSocketOptions changes the Socket options of a running server, for
+// the connections accepted from now on
+func (s *TCPServer) SetSocketOptions(o SocketOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Socket = o
+}
+
+// applySocketOptions sets the Socket options on a freshly accepted
+// connection
+func (s *TCPServer) applySocketOptions(conn net.Conn) {
+	s.mu.Lock()
+	o := s.Socket
+	s.mu.Unlock()
+
+	if err := o.Apply(conn); err != nil {
+		s.logf("%s: socket options: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// socketState reads back the options of the server end of a
+// connection to srv, once it's serving on l
+func socketState(t *testing.T, srv *TCPServer, l net.Listener) socketInfo {
+	t.Helper()
+
+	infos := make(chan socketInfo, 1)
+	go func() {
+		_ = srv.Serve(context.Background(), func(_ context.Context, conn net.Conn) {
+			// Down to the *net.TCPConn under the tracker and the
+			// SocketListener
+			for {
+				u, ok := conn.(interface{ NetConn() net.Conn })
+				if !ok {
+					break
+				}
+				conn = u.NetConn()
+			}
+			info, err := getSocketInfo(conn.(*net.TCPConn))
+			if err != nil {
+				t.Error(err)
+			}
+			infos <- info
+		})
+	}()
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case info := <-infos:
+		return info
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	return socketInfo{}
+}
+
+// socketInfo are the options getSocketInfo reads back
+type socketInfo struct {
+	noDelay       bool
+	sendBuffer    int
+	receiveBuffer int
+}
+
+func TestSocketOptions(t *testing.T) {
+	if !socketInfoSupported {
+		t.Skip("socket options can't be read back here")
+	}
+
+	l := testListener(t)
+	if info := socketState(t, NewTCPServer(l), l); !info.noDelay {
+		t.Error("expected TCP_NODELAY by default")
+	}
+
+	o := SocketOptions{Nagle: true, SendBuffer: 64 << 10, ReceiveBuffer: 32 << 10, QuickAck: true}
+	l = testListener(t)
+	srv := NewTCPServer(l)
+	srv.Socket = o
+	server := socketState(t, srv, l)
+
+	l = testListener(t)
+	sl := NewSocketListener(l, SocketOptions{})
+	sl.SetOptions(o)
+	sl.Failed = func(_ net.Conn, err error) { t.Error(err) }
+	listener := socketState(t, NewTCPServer(sl), l)
+
+	for name, info := range map[string]socketInfo{"TCPServer": server, "SocketListener": listener} {
+		if info.noDelay {
+			t.Errorf("%s: expected TCP_NODELAY off", name)
+		}
+		// Linux doubles the sizes
+		if info.sendBuffer < o.SendBuffer || info.receiveBuffer < o.ReceiveBuffer || info.sendBuffer > 4*o.SendBuffer {
+			t.Errorf("%s: expected buffers of %d and %d bytes; actual: %d and %d", name,
+				o.SendBuffer, o.ReceiveBuffer, info.sendBuffer, info.receiveBuffer)
+		}
+	}
+}
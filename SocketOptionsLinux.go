@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketInfoSupported says getSocketInfo works here
+const socketInfoSupported = true
+
+// setQuickAck sets TCP_QUICKACK, see SocketOptions.go
+func setQuickAck(rc syscall.RawConn) error {
+	var sockErr error
+	err := rc.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_QUICKACK, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// getSocketInfo reads back the options SocketOptions sets, but for
+// TCP_QUICKACK, which the kernel clears on its own
+func getSocketInfo(conn *net.TCPConn) (socketInfo, error) {
+	var info socketInfo
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return info, err
+	}
+
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		var noDelay int
+		noDelay, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		if sockErr != nil {
+			return
+		}
+		info.noDelay = noDelay != 0
+		info.sendBuffer, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		if sockErr != nil {
+			return
+		}
+		info.receiveBuffer, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if err != nil {
+		return info, err
+	}
+
+	return info, sockErr
+}
+
+// ipBindAddressNoPort is IP_BIND_ADDRESS_NO_PORT, missing from package
+// syscall
+const ipBindAddressNoPort = 0x18
+
+// setBindNoPort sets IP_BIND_ADDRESS_NO_PORT and SO_REUSEADDR, see
+// PortExhaustion.go: the first has a bind to port 0 leave the port to
+// connect, the second lets a bind to a given port share it with
+// connections to other destinations
+func setBindNoPort(rc syscall.RawConn, port int) error {
+	var sockErr error
+	err := rc.Control(func(fd uintptr) {
+		if port == 0 {
+			// Only an optimization: kernels before 4.2 don't have it
+			_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipBindAddressNoPort, 1)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
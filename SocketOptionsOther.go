@@ -0,0 +1,30 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// socketInfoSupported says getSocketInfo works here
+const socketInfoSupported = false
+
+// setQuickAck does nothing: TCP_QUICKACK is linux only, see
+// SocketOptions.go
+func setQuickAck(syscall.RawConn) error {
+	return nil
+}
+
+// getSocketInfo fails, the options are read back on linux only
+func getSocketInfo(*net.TCPConn) (socketInfo, error) {
+	return socketInfo{}, errors.New("socket options can't be read back here")
+}
+
+// setBindNoPort does nothing: IP_BIND_ADDRESS_NO_PORT is linux only,
+// and a port of the range then holds a single connection, see
+// PortExhaustion.go
+func setBindNoPort(syscall.RawConn, int) error {
+	return nil
+}
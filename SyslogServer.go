@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Syslog receiver
+//
+// SyslogHandler (LogSyslog.go) sends logs to a syslog server;
+// SyslogServer is one. It receives messages over UDP, a message per
+// datagram (RFC 5426), and over TCP, framed by octet counting or by
+// line feeds (RFC 6587, see ScanSyslogFrames), parses them and hands
+// them to a handler: print them, store them, forward them.
+//
+// Two formats are around. RFC 5424, what SyslogHandler sends:
+//
+//	<165>1 2003-10-11T22:14:15.003Z host.example.com evntslog - ID47 [exampleSDID@32473 iut="3"] An application event
+//
+// and the older one RFC 3164 describes rather than specifies, still
+// what most devices and the C library's syslog(3) send, with no year,
+// no time zone, and a tag rather than fields:
+//
+//	<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed for lonvick
+//
+// The version after the priority tells them apart. A message in the
+// old format that doesn't quite follow it (no timestamp, no host) is
+// taken as it comes, the rest of it being the message: RFC 3164 asks
+// receivers to make do with whatever arrives.
+//
+// UDP messages are handled by ServePacket (PacketServer.go), a
+// goroutine each, and TCP connections by a TCPServer, one message after
+// the other per connection, in order. A sender that stays quiet longer
+// than IdleTimeout is hung up on; senders dial again when they have
+// something to say.
+//
+//	golearn syslogd -udp :514 -tcp :514
+
+const (
+	defaultSyslogMaxMessage  = 8192 // What RFC 5425 says receivers should take
+	defaultSyslogIdleTimeout = 5 * time.Minute
+)
+
+// SyslogMessage is a received message
+type SyslogMessage struct {
+	Facility int `json:"facility"`
+	Severity int `json:"severity"`
+	Version  int `json:"version"` // 1 for RFC 5424, 0 for RFC 3164
+
+	// Timestamp is zero when the message has none. RFC 3164 timestamps
+	// are in the local time zone, of the current year.
+	Timestamp time.Time `json:"timestamp"`
+
+	// The header fields, "" when the message doesn't have them.
+	// AppName is the tag of an RFC 3164 message.
+	Hostname string `json:"hostname,omitempty"`
+	AppName  string `json:"app_name,omitempty"`
+	ProcID   string `json:"proc_id,omitempty"`
+	MsgID    string `json:"msg_id,omitempty"`
+
+	// StructuredData maps SD-IDs to their parameters (RFC 5424 only)
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+
+	Message string `json:"message"`
+
+	// Addr is the sender, set by SyslogServer
+	Addr net.Addr `json:"-"`
+}
+
+// ParseSyslog parses an RFC 5424 or RFC 3164 message
+func ParseSyslog(b []byte) (*SyslogMessage, error) {
+	s := strings.TrimRight(string(b), "\r\n\x00")
+
+	end := strings.IndexByte(s, '>')
+	if !strings.HasPrefix(s, "<") || end < 2 || end > 4 {
+		return nil, errors.New("syslog: missing priority")
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri < 0 || pri > 191 || s[1] == '0' && end > 2 {
+		return nil, fmt.Errorf("syslog: invalid priority %q", s[1:end])
+	}
+	m := &SyslogMessage{Facility: pri / 8, Severity: pri % 8}
+
+	rest := s[end+1:]
+	if after, ok := strings.CutPrefix(rest, "1 "); ok {
+		m.Version = 1
+		if err := m.parse5424(after); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	m.parse3164(rest, time.Now())
+
+	return m, nil
+}
+
+// parse5424 parses what follows the version
+func (m *SyslogMessage) parse5424(s string) error {
+	// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID, "-" for none
+	var fields [5]string
+	for i := range fields {
+		field, rest, ok := strings.Cut(s, " ")
+		if !ok {
+			return errors.New("syslog: truncated header")
+		}
+		if field != "-" {
+			fields[i] = field
+		}
+		s = rest
+	}
+	if fields[0] != "" {
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("syslog: invalid timestamp %q", fields[0])
+		}
+		m.Timestamp = t
+	}
+	m.Hostname, m.AppName, m.ProcID, m.MsgID = fields[1], fields[2], fields[3], fields[4]
+
+	// STRUCTURED-DATA: "-" or [ID name="value" ...], one after the other
+	switch {
+	case strings.HasPrefix(s, "-"):
+		s = s[1:]
+	case strings.HasPrefix(s, "["):
+		var err error
+		if s, err = m.parseStructuredData(s); err != nil {
+			return err
+		}
+	default:
+		return errors.New("syslog: missing structured data")
+	}
+
+	if s != "" {
+		if s[0] != ' ' {
+			return errors.New("syslog: invalid structured data")
+		}
+		// A UTF-8 message may start with a byte order mark
+		m.Message = strings.TrimPrefix(s[1:], "\ufeff")
+	}
+
+	return nil
+}
+
+// parseStructuredData parses the SD-ELEMENTs at the start of s and
+// returns what follows them
+func (m *SyslogMessage) parseStructuredData(s string) (string, error) {
+	m.StructuredData = make(map[string]map[string]string)
+	for strings.HasPrefix(s, "[") {
+		end := strings.IndexAny(s, " ]")
+		if end < 2 {
+			return "", errors.New("syslog: invalid structured data")
+		}
+		params := make(map[string]string)
+		m.StructuredData[s[1:end]] = params
+		s = s[end:]
+
+		for strings.HasPrefix(s, " ") {
+			name, rest, ok := strings.Cut(s[1:], `="`)
+			if !ok || name == "" {
+				return "", errors.New("syslog: invalid structured data")
+			}
+			// The value runs to the first quote not escaped; \", \\
+			// and \] are escapes, any other backslash is itself
+			var value strings.Builder
+			for i := 0; ; i++ {
+				if i == len(rest) {
+					return "", errors.New("syslog: unterminated structured data")
+				}
+				c := rest[i]
+				if c == '\\' && i+1 < len(rest) && strings.IndexByte(`"\]`, rest[i+1]) >= 0 {
+					value.WriteByte(rest[i+1])
+					i++
+					continue
+				}
+				if c == '"' {
+					s = rest[i+1:]
+					break
+				}
+				value.WriteByte(c)
+			}
+			params[name] = value.String()
+		}
+		if !strings.HasPrefix(s, "]") {
+			return "", errors.New("syslog: invalid structured data")
+		}
+		s = s[1:]
+	}
+
+	return s, nil
+}
+
+// parse3164 parses what follows the priority of an RFC 3164 message,
+// received at now
+func (m *SyslogMessage) parse3164(s string, now time.Time) {
+	// "Oct 11 22:14:15 ", no year: the closest one to now
+	if len(s) > len(time.Stamp) && s[len(time.Stamp)] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], now.Location()); err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			m.Timestamp = t
+			s = s[len(time.Stamp)+1:]
+
+			// The host name, unless the sender left it out and this
+			// is already the tag
+			if word, rest, ok := strings.Cut(s, " "); ok && !strings.HasSuffix(word, ":") && !strings.Contains(word, "[") {
+				m.Hostname, s = word, rest
+			}
+		}
+	}
+
+	// "tag[pid]: " or "tag: "
+	if i := strings.IndexAny(s, ":[ "); i > 0 && i <= 48 && s[i] != ' ' {
+		tag, rest := s[:i], s[i:]
+		if rest[0] == '[' {
+			pid, after, ok := strings.Cut(rest[1:], "]")
+			if !ok || !strings.HasPrefix(after, ":") {
+				m.Message = s
+				return
+			}
+			m.ProcID, rest = pid, after
+		}
+		m.AppName = tag
+		s = strings.TrimPrefix(rest[1:], " ")
+	}
+	m.Message = s
+}
+
+// SyslogServer receives syslog messages
+type SyslogServer struct {
+	// Handler is called with every message received. UDP messages
+	// are handled concurrently, those of a TCP connection in order.
+	Handler func(ctx context.Context, m *SyslogMessage)
+
+	MaxMessageSize int           // 8192 bytes by default
+	IdleTimeout    time.Duration // For TCP senders, 5 minutes by default
+
+	// Quota bounds the messages of a TCP sender, and their bytes
+	Quota MessageQuota
+
+	// ErrorLog receives the messages that couldn't be parsed
+	ErrorLog *log.Logger
+}
+
+func (s *SyslogServer) logf(format string, v ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+func (s *SyslogServer) maxMessageSize() int {
+	if s.MaxMessageSize > 0 {
+		return s.MaxMessageSize
+	}
+	return defaultSyslogMaxMessage
+}
+
+func (s *SyslogServer) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return defaultSyslogIdleTimeout
+}
+
+// handle parses a message and hands it to the handler
+func (s *SyslogServer) handle(ctx context.Context, addr net.Addr, b []byte) {
+	if len(b) > s.maxMessageSize() {
+		s.logf("syslog from %s: %d bytes message dropped", addr, len(b))
+		return
+	}
+	m, err := ParseSyslog(b)
+	if err != nil {
+		s.logf("syslog from %s: %v", addr, err)
+		return
+	}
+	m.Addr = addr
+	s.Handler(ctx, m)
+}
+
+// ServePacket is a PacketHandler for ServePacket: every datagram is a
+// message
+func (s *SyslogServer) ServePacket(ctx context.Context, _ net.PacketConn, addr net.Addr, packet []byte) {
+	s.handle(ctx, addr, packet)
+}
+
+// ServeConn is a ConnHandler for TCPServer: the messages of conn one
+// after the other, until the sender hangs up or stays quiet for
+// IdleTimeout
+func (s *SyslogServer) ServeConn(ctx context.Context, conn net.Conn) {
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	// Room for the longest message and its length
+	max := s.maxMessageSize()
+	r := NewDelimitedReader(conn, ScanSyslogFrames(max), max+len(strconv.Itoa(max))+2, s.idleTimeout())
+	r.SetQuota(s.Quota)
+	for {
+		b, err := r.Next()
+		if err != nil {
+			var nErr net.Error
+			idle := errors.As(err, &nErr) && nErr.Timeout() && !errors.Is(err, ErrStalled)
+			if err != io.EOF && !idle && ctx.Err() == nil {
+				s.logf("syslog from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		s.handle(ctx, conn.RemoteAddr(), b)
+	}
+}
+
+func syslogdMain(args []string) error {
+	fs := flag.NewFlagSet("syslogd", flag.ContinueOnError)
+	udpAddr := fs.String("udp", ":514", "UDP `address` to listen on, empty for none")
+	tcpAddr := fs.String("tcp", "", "TCP `address` to listen on, empty for none")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *udpAddr == "" && *tcpAddr == "" {
+		return errors.New("usage: syslogd [-udp address] [-tcp address]")
+	}
+
+	// Every message as a line of JSON, with where it came from
+	enc := json.NewEncoder(os.Stdout)
+	srv := &SyslogServer{Handler: func(_ context.Context, m *SyslogMessage) {
+		_ = enc.Encode(struct {
+			From string `json:"from"`
+			*SyslogMessage
+		}{m.Addr.String(), m})
+	}}
+
+	var services []Service
+	if *udpAddr != "" {
+		pc, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			return err
+		}
+		services = append(services, PacketService("syslog udp", pc, srv.ServePacket))
+	}
+	if *tcpAddr != "" {
+		l, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			return err
+		}
+		services = append(services, TCPService("syslog tcp", NewTCPServer(l), srv.ServeConn))
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	return Run(ctx, services...)
+}
+
+func TestParseSyslog(t *testing.T) {
+	for _, c := range []struct {
+		in       string
+		expected SyslogMessage
+	}{
+		// The examples of RFC 5424
+		{"<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \ufeff'su root' failed for lonvick on /dev/pts/8",
+			SyslogMessage{Facility: 4, Severity: 2, Version: 1, Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3e6, time.UTC),
+				Hostname: "mymachine.example.com", AppName: "su", MsgID: "ID47",
+				Message: "'su root' failed for lonvick on /dev/pts/8"}},
+		{`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high"]`,
+			SyslogMessage{Facility: 20, Severity: 5, Version: 1, Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3e6, time.UTC),
+				Hostname: "mymachine.example.com", AppName: "evntslog", MsgID: "ID47",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473":     {"iut": "3", "eventSource": "Application", "eventID": "1011"},
+					"examplePriority@32473": {"class": "high"},
+				}}},
+		// Escapes, and nothing but the priority
+		{`<13>1 - - - - - [a@1 p="x \"y\" \] \\ \z"] msg` + "\n",
+			SyslogMessage{Facility: 1, Severity: 5, Version: 1,
+				StructuredData: map[string]map[string]string{"a@1": {"p": `x "y" ] \ \z`}}, Message: "msg"}},
+		{"<0>1 - - - - - -", SyslogMessage{Version: 1}},
+
+		// RFC 3164, with a host, without one, with nothing
+		{"<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+			SyslogMessage{Facility: 4, Severity: 2, Hostname: "mymachine", AppName: "su",
+				Message: "'su root' failed for lonvick on /dev/pts/8"}},
+		{"<13>Oct  1 01:02:03 cron[230]: job done",
+			SyslogMessage{Facility: 1, Severity: 5, AppName: "cron", ProcID: "230", Message: "job done"}},
+		{"<13>just some text: really", SyslogMessage{Facility: 1, Severity: 5, Message: "just some text: really"}},
+		{"<13>app[1 oops", SyslogMessage{Facility: 1, Severity: 5, Message: "app[1 oops"}},
+	} {
+		m, err := ParseSyslog([]byte(c.in))
+		if err != nil {
+			t.Errorf("%q: %v", c.in, err)
+			continue
+		}
+		ts := m.Timestamp
+		if c.expected.Version == 0 {
+			// No year in RFC 3164: the month, day and time only
+			if c.expected.Hostname != "" || c.expected.ProcID != "" {
+				if ts.IsZero() || ts.Year() < time.Now().Year()-1 {
+					t.Errorf("%q: unexpected timestamp %v", c.in, ts)
+				}
+			}
+			m.Timestamp = time.Time{}
+		}
+		if fmt.Sprintf("%+v", *m) != fmt.Sprintf("%+v", c.expected) {
+			t.Errorf("%q:\nexpected %+v\nactual   %+v", c.in, c.expected, *m)
+		}
+	}
+
+	for _, in := range []string{
+		"no priority", "<>1 - - - - - -", "<192>x", "<013>x", "<13>1 yesterday - - - - -",
+		"<13>1 - - -", "<13>1 - - - - - [a@1 p=\"open", "<13>1 - - - - - [a@1 p=x]", "<13>1 - - - - - oops",
+	} {
+		if _, err := ParseSyslog([]byte(in)); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestSyslogServer(t *testing.T) {
+	received := make(chan *SyslogMessage, 8)
+	var logs strings.Builder
+	srv := &SyslogServer{
+		Handler:        func(_ context.Context, m *SyslogMessage) { received <- m },
+		MaxMessageSize: 256,
+		ErrorLog:       log.New(&logs, "", 0),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pc := testPacketConn(t)
+	served := make(chan error)
+	go func() { served <- ServePacket(ctx, pc, srv.ServePacket) }()
+	tcp := NewTCPServer(testListener(t))
+	go func() { _ = tcp.Serve(ctx, srv.ServeConn) }()
+
+	next := func() *SyslogMessage {
+		t.Helper()
+		select {
+		case m := <-received:
+			return m
+		case <-time.After(time.Second):
+			t.Fatal("no message received")
+			return nil
+		}
+	}
+
+	// From SyslogHandler, over both networks
+	for _, network := range []string{"udp", "tcp"} {
+		addr := pc.LocalAddr().String()
+		if network == "tcp" {
+			addr = tcp.Addr().String()
+		}
+		h, err := DialSyslog(network, addr, &SyslogOptions{Hostname: "node1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		NewLevelLogHandler(h).Errorf("disk full")
+		_ = h.Close()
+
+		m := next()
+		if m.Hostname != "node1" || m.AppName != "golearn" || m.Facility != SyslogDaemon || m.Severity != 3 ||
+			m.Message != "disk full" || m.Addr == nil || time.Since(m.Timestamp) > time.Minute {
+			t.Errorf("%s: unexpected message %+v", network, m)
+		}
+	}
+
+	// A line per message, an old sender's
+	conn, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "<13>Oct 18 10:00:00 router kernel: link up\n<13>1 - - - - - - second\r\n")
+	if m := next(); m.Hostname != "router" || m.AppName != "kernel" || m.Message != "link up" {
+		t.Errorf("unexpected message %+v", m)
+	}
+	if m := next(); m.Version != 1 || m.Message != "second" {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	// Garbage and oversized messages are logged, not handled
+	udp, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	_, _ = udp.Write([]byte("garbage"))
+	_, _ = udp.Write([]byte("<13>" + strings.Repeat("x", 300)))
+	_, _ = udp.Write([]byte("<13>last"))
+	if m := next(); m.Message != "last" {
+		t.Errorf("unexpected message %+v", m)
+	}
+	// Once the handlers are done
+	cancel()
+	<-served
+	if !strings.Contains(logs.String(), "missing priority") || !strings.Contains(logs.String(), "304 bytes message dropped") {
+		t.Errorf("unexpected logs %q", logs.String())
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Graceful TCP server skeleton
+//
+// Most examples in this repo hand-roll the same accept loop:
+//
+//	for {
+//		conn, err := listener.Accept()
+//		if err != nil {
+//			return
+//		}
+//		go handle(conn)
+//	}
+//
+// That loop has a few subtle problems: any Accept error ends the server
+// (even "too many open files", which goes away on its own), nothing
+// keeps track of the handler goroutines so there's no way to wait for
+// them, and a panic in a single handler takes the whole process down.
+//
+// TCPServer wraps the loop once and fixes all of that:
+//
+// - temporary Accept errors are retried with exponential backoff
+// - every accepted connection is tracked until its handler returns
+// - a panicking handler is recovered, logged and its connection closed
+// - Shutdown stops accepting, drains the connections through a
+//   ConnTracker (idle ones closed, active ones given a deadline) and
+//   waits for the handlers, force closing whatever is left when its
+//   context expires
+
+// ErrServerClosed is returned by Serve after Shutdown has been called
+var ErrServerClosed = errors.New("tcp server closed")
+
+// ConnHandler serves a single connection. ctx is canceled when the
+// server is forced down, and carries the connection's ConnInfo (see
+// ConnContext.go); the server closes conn after the handler returns.
+type ConnHandler func(ctx context.Context, conn net.Conn)
+
+// TCPServer runs a ConnHandler for every connection accepted on a listener
+type TCPServer struct {
+	// ErrorLog receives accept errors and recovered panics.
+	// When nil, log.Default() is used.
+	ErrorLog *log.Logger
+
+	// Tracker keeps track of the accepted connections and drives the
+	// phased close during Shutdown. Its thresholds can be tuned
+	// before calling Serve.
+	Tracker ConnTracker
+
+	// Limits for servers exposed to untrusted networks, see
+	// TCPServerLimits.go. The zero values disable them. Once Serve
+	// runs, change them with SetLimits.
+	AcceptRate    float64              // Accepted connections per second
+	AcceptBurst   int                  // Accepts allowed in a burst above AcceptRate
+	MaxConnsPerIP int                  // Concurrent connections per remote IP
+	Deny          func(ip net.IP) bool // Reject connections from ip when true
+
+	// Socket are the options set on accepted TCP connections, see
+	// SocketOptions.go. Once Serve runs, change them with
+	// SetSocketOptions.
+	Socket SocketOptions
+
+	// Metrics, when set, receives the server's metrics labeled with
+	// its address, see Metrics.go
+	Metrics *Metrics
+
+	// Enricher, when set along with Metrics, counts the connections
+	// admitted by country and ASN (see Enrich.go)
+	Enricher Enricher
+
+	listener net.Listener
+	limits   serverLimits
+	panics   PanicGuard
+	metrics  tcpServerMetrics
+
+	mu       sync.Mutex
+	closing  bool               // Shutdown has been called
+	cancel   context.CancelFunc // Cancels the handler contexts
+	handlers sync.WaitGroup
+}
+
+// NewTCPServer returns a server that accepts connections on l
+func NewTCPServer(l net.Listener) *TCPServer {
+	return &TCPServer{listener: l}
+}
+
+// Addr returns the listener's address
+func (s *TCPServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *TCPServer) logf(format string, v ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// Serve accepts connections and runs handler for each of them in its own
+// goroutine. Canceling ctx stops accepting and cancels the handler
+// contexts. Serve returns ErrServerClosed after Shutdown, ctx.Err() after
+// cancellation, or the Accept error that stopped it.
+func (s *TCPServer) Serve(ctx context.Context, handler ConnHandler) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	// Handlers get their own cancel func: a graceful Shutdown lets them
+	// finish even though Serve has already returned
+	handlerCtx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.panics.Logger = s.ErrorLog
+	s.instrument()
+	s.mu.Unlock()
+
+	// Every handler runs behind the panic guard
+	handler = s.panics.Handler(handler)
+
+	// Closing the listener is the only way to unblock Accept
+	stop := context.AfterFunc(ctx, func() { _ = s.listener.Close() })
+	defer stop()
+
+	err := s.acceptLoop(ctx, handlerCtx, handler)
+	if err != ErrServerClosed {
+		// Not a Shutdown, nobody else will cancel the handlers
+		cancel()
+	}
+
+	return err
+}
+
+// acceptLoop accepts connections until the listener fails for good
+func (s *TCPServer) acceptLoop(ctx, handlerCtx context.Context, handler ConnHandler) error {
+	var backoff time.Duration
+	for {
+		// Throttle the loop itself: while we wait, new connections
+		// queue up in the kernel's backlog instead of our memory
+		if err := s.waitAcceptToken(ctx); err != nil {
+			return err
+		}
+
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			s.metrics.acceptErrors.Inc()
+
+			// Temporary errors (out of file descriptors, aborted
+			// handshakes) go away on their own: wait and retry
+			if isTemporaryAcceptError(err) {
+				backoff = nextAcceptBackoff(backoff)
+				s.logf("accept error: %v; retrying in %s", err, backoff)
+
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(backoff):
+				}
+				continue
+			}
+
+			return err
+		}
+		backoff = 0
+		s.metrics.accepted.Inc()
+
+		// Denied peers and peers over their connection cap are
+		// dropped before a handler goroutine is started
+		if !s.admit(conn) {
+			_ = conn.Close()
+			continue
+		}
+		if s.metrics.peers != nil {
+			country, asn := enrichAddr(s.Enricher, conn.RemoteAddr()).labels()
+			s.metrics.peers.With(s.Addr().String(), country, asn).Inc()
+		}
+
+		s.applySocketOptions(conn)
+
+		if !s.track() {
+			s.release(conn)
+			// Shutdown raced with Accept, don't start a handler
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+
+		// The handler works on the tracked wrapper so the tracker
+		// sees its activity and notices when it's closed
+		go s.serveConn(handlerCtx, s.Tracker.Track(conn), handler)
+	}
+}
+
+// serveConn runs the handler and cleans up after it
+func (s *TCPServer) serveConn(ctx context.Context, conn net.Conn, handler ConnHandler) {
+	defer s.handlers.Done()
+	defer s.release(conn)
+	start := time.Now()
+	defer func() { s.metrics.duration.ObserveDuration(time.Since(start)) }()
+	defer conn.Close()
+
+	handler(WithConnInfo(ctx, NewConnInfo(conn, s.Enricher)), conn)
+}
+
+// Panics returns how many handler panics have been recovered
+func (s *TCPServer) Panics() uint64 {
+	return s.panics.Panics()
+}
+
+// tcpServerMetrics are the series the server updates itself; the
+// others read its existing counters at scrape time
+type tcpServerMetrics struct {
+	accepted, acceptErrors, duration *Metric
+	peers                            *MetricVec // By country and ASN, with an Enricher
+}
+
+// instrument registers the server's series with s.Metrics, if set
+func (s *TCPServer) instrument() {
+	m := s.Metrics
+	if m == nil {
+		return
+	}
+	addr := s.Addr().String()
+
+	s.metrics.accepted = m.Counter("tcp_server_accepted_total", "Connections accepted.", "addr").With(addr)
+	s.metrics.acceptErrors = m.Counter("tcp_server_accept_errors_total", "Accept calls that failed.", "addr").With(addr)
+	s.metrics.duration = m.Histogram("tcp_server_connection_duration_seconds", "How long connections stayed open.", nil, "addr").With(addr)
+	m.Gauge("tcp_server_active_connections", "Open connections.", "addr").Func(func() float64 {
+		return float64(s.ActiveConns())
+	}, addr)
+	m.Counter("tcp_server_rejected_total", "Connections refused by Deny or MaxConnsPerIP.", "addr").Func(func() float64 {
+		return float64(s.Rejected())
+	}, addr)
+	m.Counter("tcp_server_panics_total", "Handler panics recovered.", "addr").Func(func() float64 {
+		return float64(s.Panics())
+	}, addr)
+	if s.Enricher != nil {
+		s.metrics.peers = m.Counter("tcp_server_peers_total", "Connections admitted, by peer country and ASN.", "addr", "country", "asn")
+	}
+}
+
+// track registers a handler about to start; it fails once Shutdown
+// has started
+func (s *TCPServer) track() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.handlers.Add(1)
+
+	return true
+}
+
+func (s *TCPServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closing
+}
+
+// ActiveConns returns the number of open connections
+func (s *TCPServer) ActiveConns() int {
+	return s.Tracker.Len()
+}
+
+// Shutdown stops accepting connections, closes the idle ones, gives the
+// active ones Tracker.DrainDeadline to finish and waits for the running
+// handlers to return. If ctx expires first, the handler contexts are
+// canceled, the remaining connections are closed and ctx.Err() is
+// returned.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.StopAccepting()
+	s.Tracker.Drain()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancelHandlers()
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Out of time: tell the handlers and pull the plug
+	s.cancelHandlers()
+	s.Tracker.CloseAll()
+
+	<-done
+	return ctx.Err()
+}
+
+// StopAccepting closes the listener and makes Serve return
+// ErrServerClosed, leaving the open connections alone. Shutdown starts
+// with it; calling it first frees the address right away.
+func (s *TCPServer) StopAccepting() {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	_ = s.listener.Close()
+}
+
+// cancelHandlers cancels the context handed to the handlers
+func (s *TCPServer) cancelHandlers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// isTemporaryAcceptError reports Accept errors worth retrying
+func isTemporaryAcceptError(err error) bool {
+	var nErr net.Error
+	if errors.As(err, &nErr) && nErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED)
+}
+
+// nextAcceptBackoff doubles the delay from 5ms up to 1s, like net/http
+func nextAcceptBackoff(d time.Duration) time.Duration {
+	if d == 0 {
+		return 5 * time.Millisecond
+	}
+
+	return min(2*d, time.Second)
+}
+
+func TestTCPServerShutdown(t *testing.T) {
+	listener := testListener(t)
+
+	s := NewTCPServer(listener)
+	s.ErrorLog = log.New(io.Discard, "", 0)
+
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(context.Background(), func(_ context.Context, conn net.Conn) {
+			// Echo until the client hangs up
+			_, _ = io.Copy(conn, conn)
+		})
+	}()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadExactly(conn, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shutdown waits for the active connection to be done
+	shutdown := make(chan error)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with an active connection: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_ = conn.Close()
+	if err := <-shutdown; err != nil {
+		t.Errorf("expected clean shutdown; actual: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed; actual: %v", err)
+	}
+}
+
+func TestTCPServerForcedShutdown(t *testing.T) {
+	listener := testListener(t)
+
+	s := NewTCPServer(listener)
+	s.ErrorLog = log.New(io.Discard, "", 0)
+
+	canceled := make(chan struct{})
+	go func() {
+		_ = s.Serve(context.Background(), func(ctx context.Context, conn net.Conn) {
+			// A handler that only stops when told to
+			<-ctx.Done()
+			close(canceled)
+		})
+	}()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the handler to be running before shutting down
+	for s.ActiveConns() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded; actual: %v", err)
+	}
+	<-canceled
+}
+
+func TestTCPServerPanic(t *testing.T) {
+	listener := testListener(t)
+
+	s := NewTCPServer(listener)
+	s.ErrorLog = log.New(io.Discard, "", 0)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+
+	go func() {
+		_ = s.Serve(context.Background(), func(_ context.Context, conn net.Conn) {
+			panic("handler bug")
+		})
+	}()
+
+	// Both connections are closed by the server after the panic,
+	// and the server survives the first one to accept the second
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected EOF; actual: %v", err)
+		}
+		_ = conn.Close()
+	}
+
+	// The handler goroutines may still be unwinding, wait for both
+	// panics to be counted
+	for deadline := time.Now().Add(time.Second); s.Panics() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 recovered panics; actual: %d", s.Panics())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Accept limits for exposed servers
+//
+// A server on a public address has to assume some clients are hostile.
+// Without limits, a single host opening connections in a loop (or a
+// SYN flood completing handshakes) makes us start a goroutine per
+// connection until we run out of memory or file descriptors.
+//
+// TCPServer has three knobs, all off by default:
+//
+// - AcceptRate/AcceptBurst: a TokenBucket in front of Accept. While it
+//   is empty we simply don't call Accept; the kernel keeps completing
+//   handshakes into the listen backlog and, once that is full, starts
+//   dropping SYNs (or answering with SYN cookies), which is exactly the
+//   pressure valve we want.
+// - MaxConnsPerIP: connections beyond the cap for a single remote IP
+//   are closed right after Accept.
+// - Deny: a hook consulted for every connection, e.g. backed by a deny
+//   list, closing the connection when it returns true.
+//
+// Rejected connections are counted in Rejected().
+
+// serverLimits holds the state behind the TCPServer limits
+type serverLimits struct {
+	mu       sync.Mutex
+	perIP    map[string]int // Open connections per remote IP
+	accepts  *TokenBucket   // For AcceptRate, created on first use
+	rejected atomic.Uint64
+}
+
+// Rejected returns how many connections were closed by Deny or
+// MaxConnsPerIP
+func (s *TCPServer) Rejected() uint64 {
+	return s.limits.rejected.Load()
+}
+
+// SetLimits changes AcceptRate, AcceptBurst and MaxConnsPerIP of a
+// running server. Connections over a lowered per-IP cap stay open and
+// count against it.
+func (s *TCPServer) SetLimits(acceptRate float64, acceptBurst, maxConnsPerIP int) {
+	l := &s.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s.AcceptRate, s.AcceptBurst, s.MaxConnsPerIP = acceptRate, acceptBurst, maxConnsPerIP
+	l.accepts = nil // Recreated at the new rate by the next Accept
+}
+
+// waitAcceptToken blocks until the accept rate allows another Accept
+func (s *TCPServer) waitAcceptToken(ctx context.Context) error {
+	l := &s.limits
+	l.mu.Lock()
+	if s.AcceptRate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	if l.accepts == nil {
+		l.accepts = NewTokenBucket(s.AcceptRate, s.AcceptBurst)
+	}
+	accepts := l.accepts
+	l.mu.Unlock()
+
+	return accepts.Wait(ctx)
+}
+
+// remoteIP extracts the IP of the connection's peer
+func remoteIP(conn net.Conn) net.IP {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// admit applies Deny and MaxConnsPerIP to a freshly accepted connection.
+// An admitted connection must be released when it's done.
+func (s *TCPServer) admit(conn net.Conn) bool {
+	ip := remoteIP(conn)
+
+	if s.Deny != nil && s.Deny(ip) {
+		s.limits.rejected.Add(1)
+		return false
+	}
+
+	l := &s.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Connections are counted even without a cap, so that one set
+	// later by SetLimits knows about them
+	if l.perIP == nil {
+		l.perIP = make(map[string]int)
+	}
+	if s.MaxConnsPerIP > 0 && l.perIP[ip.String()] >= s.MaxConnsPerIP {
+		l.rejected.Add(1)
+		return false
+	}
+	l.perIP[ip.String()]++
+
+	return true
+}
+
+// release gives back the per-IP slot taken by admit
+func (s *TCPServer) release(conn net.Conn) {
+	key := remoteIP(conn).String()
+
+	l := &s.limits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n, ok := l.perIP[key]; ok {
+		if n <= 1 {
+			delete(l.perIP, key)
+		} else {
+			l.perIP[key] = n - 1
+		}
+	}
+}
+
+// startLimitedServer runs a server that holds every connection open
+// until the client hangs up
+func startLimitedServer(t *testing.T, s *TCPServer) {
+	t.Helper()
+
+	s.ErrorLog = log.New(io.Discard, "", 0)
+	go func() {
+		_ = s.Serve(context.Background(), func(_ context.Context, conn net.Conn) {
+			_, _ = io.Copy(io.Discard, conn)
+		})
+	}()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+}
+
+// dialAndProbe connects and reports whether the server closed the
+// connection on us within a short time
+func dialAndProbe(t *testing.T, addr string) (net.Conn, bool) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+
+	return conn, err == io.EOF
+}
+
+func TestTCPServerMaxConnsPerIP(t *testing.T) {
+	listener := testListener(t)
+
+	s := NewTCPServer(listener)
+	s.MaxConnsPerIP = 2
+	startLimitedServer(t, s)
+
+	// The first two connections are kept open, the third is closed
+	for i, expectClosed := range []bool{false, false, true} {
+		conn, closed := dialAndProbe(t, s.Addr().String())
+		defer conn.Close()
+
+		if closed != expectClosed {
+			t.Errorf("connection %d: expected closed=%t; actual: %t", i, expectClosed, closed)
+		}
+	}
+
+	if n := s.Rejected(); n != 1 {
+		t.Errorf("expected 1 rejected connection; actual: %d", n)
+	}
+}
+
+func TestTCPServerDeny(t *testing.T) {
+	listener := testListener(t)
+
+	s := NewTCPServer(listener)
+	s.Deny = func(ip net.IP) bool { return ip.IsLoopback() }
+	startLimitedServer(t, s)
+
+	conn, closed := dialAndProbe(t, s.Addr().String())
+	defer conn.Close()
+
+	if !closed {
+		t.Error("expected denied connection to be closed")
+	}
+}
+
+func TestTCPServerAcceptRate(t *testing.T) {
+	listener := testListener(t)
+
+	s := NewTCPServer(listener)
+	s.AcceptRate = 10 // One accept every 100ms after the burst
+	s.AcceptBurst = 1
+	startLimitedServer(t, s)
+
+	// Dialing succeeds right away thanks to the backlog, but the
+	// server only gets to the connections at the configured rate
+	begin := time.Now()
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	for s.ActiveConns() < 4 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// 1 from the burst, then 3 more at 100ms intervals
+	if elapsed := time.Since(begin); elapsed < 250*time.Millisecond {
+		t.Errorf("accepted 4 connections too fast: %s", elapsed)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"testing"
 )
 
 // DatagramSize is the maximum size of a TFTP packet.
@@ -190,9 +191,33 @@ func (d *Data) UnmarshalBinary(p []byte) error {
 	return nil
 }
 
+// BenchmarkData encodes and decodes full 512 byte DATA blocks, the work
+// a transfer does per block besides the network
+func BenchmarkData(b *testing.B) {
+	block := make([]byte, BlockSize)
+	r := bytes.NewReader(block)
+	d := Data{Payload: r}
+	var decoded Data
+	b.SetBytes(BlockSize)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(block)
+		p, err := d.MarshalBinary()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := decoded.UnmarshalBinary(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 type Ack uint16
 
-func (a Ack) MarshaBinary() ([]byte, error) {
+// MarshalBinary converts the Ack into a TFTP ACK packet binary format.
+// The layout is: [2 bytes opcode][2 bytes block number]
+func (a Ack) MarshalBinary() ([]byte, error) {
 	cap := 2 + 2
 
 	b := new(bytes.Buffer)
@@ -202,4 +227,12 @@ func (a Ack) MarshaBinary() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	// Write the 2-byte block number being acknowledged
+	err = binary.Write(b, binary.BigEndian, a)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
 }
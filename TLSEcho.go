@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TLS and mutual TLS echo servers
+//
+// tls.Server wraps an accepted net.Conn; reads and writes on the wrapper
+// are encrypted, everything else about the server stays the same. The
+// handshake happens on the first Read or Write, which means a client
+// that connects and says nothing would tie up the handler forever, so
+// the echo server runs the handshake explicitly under a deadline.
+//
+// With mutual TLS the client proves its identity with a certificate
+// too. Verifying the certificate chain only proves the CA issued it;
+// which of the CA's clients may use *this* service is a separate
+// decision. The server extracts a TLSIdentity from the verified
+// certificate and asks an authorizer, during the handshake, so
+// unauthorized clients fail to connect at all.
+
+// tlsHandshakeTimeout bounds the handshake of every connection
+const tlsHandshakeTimeout = 5 * time.Second
+
+// ErrUnauthorized is returned by authorizers rejecting a client
+var ErrUnauthorized = errors.New("client not authorized")
+
+// TLSIdentity is what a client certificate says about its owner
+type TLSIdentity struct {
+	CommonName string
+	DNSNames   []string
+	URIs       []string // e.g. SPIFFE IDs
+	Emails     []string
+	Serial     string
+}
+
+func (id TLSIdentity) String() string {
+	if len(id.URIs) > 0 {
+		return id.URIs[0]
+	}
+
+	return id.CommonName
+}
+
+// TLSAuthorizer decides whether a verified client may connect
+type TLSAuthorizer func(id TLSIdentity) error
+
+// AllowCommonNames authorizes clients with one of the given common names
+func AllowCommonNames(names ...string) TLSAuthorizer {
+	return func(id TLSIdentity) error {
+		if slices.Contains(names, id.CommonName) {
+			return nil
+		}
+		return fmt.Errorf("%w: %q", ErrUnauthorized, id.CommonName)
+	}
+}
+
+// IdentityFromCert extracts the identity of a certificate
+func IdentityFromCert(cert *x509.Certificate) TLSIdentity {
+	id := TLSIdentity{
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+		Emails:     cert.EmailAddresses,
+		Serial:     cert.SerialNumber.Text(16),
+	}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+
+	return id
+}
+
+// ClientIdentity returns the identity of the verified client
+// certificate of a completed handshake
+func ClientIdentity(state tls.ConnectionState) (TLSIdentity, error) {
+	// VerifiedChains is only set when the chain checked out; the first
+	// certificate of a chain is the client's own
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return TLSIdentity{}, errors.New("no verified client certificate")
+	}
+
+	return IdentityFromCert(state.VerifiedChains[0][0]), nil
+}
+
+// MutualTLSConfig returns a server config requiring client certificates
+// signed by clientCAs and accepted by authorize
+func MutualTLSConfig(cert tls.Certificate, clientCAs *x509.CertPool, authorize TLSAuthorizer) *tls.Config {
+	cfg := ServerConfig(cert, clientCAs)
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		id, err := ClientIdentity(state)
+		if err != nil {
+			return err
+		}
+		if authorize != nil {
+			return authorize(id)
+		}
+		return nil
+	}
+
+	return cfg
+}
+
+// TLSEchoServer echoes everything sent over TLS connections
+type TLSEchoServer struct {
+	Config *tls.Config
+
+	// OnConnect is called with the client's identity after a mutual
+	// TLS handshake (optional)
+	OnConnect func(id TLSIdentity)
+
+	*TCPServer
+}
+
+// NewTLSEchoServer returns an echo server accepting on l with cfg
+func NewTLSEchoServer(l net.Listener, cfg *tls.Config) *TLSEchoServer {
+	return &TLSEchoServer{Config: cfg, TCPServer: NewTCPServer(l)}
+}
+
+// Serve runs the server until ctx is done or Shutdown is called
+func (s *TLSEchoServer) Serve(ctx context.Context) error {
+	return s.TCPServer.Serve(ctx, func(ctx context.Context, conn net.Conn) {
+		tlsConn := tls.Server(conn, s.Config)
+
+		if _, err := TLSHandshake(ctx, tlsConn, tlsHandshakeTimeout); err != nil {
+			s.logf("%v", err)
+			return
+		}
+
+		if s.OnConnect != nil {
+			if id, err := ClientIdentity(tlsConn.ConnectionState()); err == nil {
+				s.OnConnect(id)
+			}
+		}
+
+		_, _ = io.Copy(tlsConn, tlsConn)
+	})
+}
+
+// startTLSEcho runs a TLS echo server for a test
+func startTLSEcho(t *testing.T, cfg *tls.Config, onConnect func(TLSIdentity)) *TLSEchoServer {
+	t.Helper()
+
+	l := testListener(t)
+
+	s := NewTLSEchoServer(l, cfg)
+	s.ErrorLog = log.New(io.Discard, "", 0)
+	s.OnConnect = onConnect
+	go func() { _ = s.Serve(context.Background()) }()
+	t.Cleanup(func() { _ = s.Shutdown(context.Background()) })
+
+	return s
+}
+
+// tlsEcho dials the server, sends a message and reads it back
+func tlsEcho(addr string, cfg *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return "", err
+	}
+	b, err := ReadExactly(conn, 4)
+
+	return string(b), err
+}
+
+func TestTLSEchoServer(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Issue(TLSLeaf{Name: "echo", Hosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := startTLSEcho(t, ServerConfig(cert, nil), nil)
+
+	// A client trusting our CA gets its echo
+	if reply, err := tlsEcho(s.Addr().String(), ClientConfig(ca.Pool())); err != nil || reply != "ping" {
+		t.Errorf("expected echo; actual: %q, %v", reply, err)
+	}
+
+	// A client trusting the system roots rejects the certificate
+	if _, err := tlsEcho(s.Addr().String(), &tls.Config{}); err == nil {
+		t.Error("expected unknown authority error")
+	}
+}
+
+func TestTLSEchoServerMutual(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, _ := ca.Issue(TLSLeaf{Name: "echo", Hosts: []string{"127.0.0.1"}})
+	alice, _ := ca.Issue(TLSLeaf{Name: "alice", Client: true, Hosts: []string{"spiffe://golearn/alice"}})
+	mallory, _ := ca.Issue(TLSLeaf{Name: "mallory", Client: true})
+
+	// A client certificate from a different CA
+	otherCA, _ := NewTLSCA("other CA")
+	stranger, _ := otherCA.Issue(TLSLeaf{Name: "alice", Client: true})
+
+	connected := make(chan TLSIdentity, 1)
+	s := startTLSEcho(t, MutualTLSConfig(serverCert, ca.Pool(), AllowCommonNames("alice")),
+		func(id TLSIdentity) { connected <- id })
+
+	addr := s.Addr().String()
+	if reply, err := tlsEcho(addr, ClientConfig(ca.Pool(), alice)); err != nil || reply != "ping" {
+		t.Errorf("alice: expected echo; actual: %q, %v", reply, err)
+	}
+	if id := <-connected; id.CommonName != "alice" || id.String() != "spiffe://golearn/alice" {
+		t.Errorf("unexpected identity: %+v", id)
+	}
+
+	// In TLS 1.3 the client may finish its side of the handshake before
+	// the server rejects the certificate, so the error can show up on
+	// the first read instead of on Dial
+	for name, cfg := range map[string]*tls.Config{
+		"no certificate":     ClientConfig(ca.Pool()),
+		"unauthorized":       ClientConfig(ca.Pool(), mallory),
+		"untrusted issuer":   ClientConfig(ca.Pool(), stranger),
+		"server certificate": ClientConfig(ca.Pool(), serverCert),
+	} {
+		if reply, err := tlsEcho(addr, cfg); err == nil {
+			t.Errorf("%s: expected rejection; actual: %q", name, reply)
+		} else if strings.Contains(err.Error(), "timeout") {
+			t.Errorf("%s: expected a TLS alert, not a timeout: %v", name, err)
+		}
+	}
+}
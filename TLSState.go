@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TLS handshake and connection state
+//
+// A tls.Conn handshakes lazily on the first Read or Write, and without
+// a deadline a peer that stalls mid-handshake blocks that Read forever.
+// TLSHandshake runs the handshake up front, bounded by a timeout and a
+// context, and closes the connection when it fails, so callers can't
+// forget to.
+//
+// After the handshake, tls.ConnectionState knows everything that was
+// negotiated, but mostly as numbers and raw certificates. TLSInfo turns
+// it into something worth logging:
+//
+//	tls TLS 1.3 TLS_AES_128_GCM_SHA256 alpn=h2 sni=example.com
+//	    peer=CN=example.com (issuer CN=R3, expires 2025-01-01) in 3.2ms
+//
+// Monitor.LogTLS writes it next to the connection's traffic, as a plain
+// line or as a structured "tls" record.
+
+// defaultTLSHandshakeTimeout is used when TLSHandshake gets no timeout
+const defaultTLSHandshakeTimeout = 10 * time.Second
+
+// TLSCertInfo summarizes a certificate of the peer's chain
+type TLSCertInfo struct {
+	Subject     string
+	Issuer      string
+	DNSNames    []string
+	NotAfter    time.Time
+	Fingerprint string // SHA-256 of the DER encoding, hex
+}
+
+// TLSInfo describes a completed handshake
+type TLSInfo struct {
+	Version     string
+	CipherSuite string
+	ALPN        string // Negotiated application protocol, if any
+	ServerName  string // SNI sent by the client
+	Resumed     bool   // Session resumption, no full handshake
+	Duration    time.Duration
+	PeerChain   []TLSCertInfo // Leaf first
+}
+
+// TLSHandshake performs the handshake of conn, giving up after timeout
+// (defaults to 10s) or when ctx is done. conn is closed on failure.
+func TLSHandshake(ctx context.Context, conn *tls.Conn, timeout time.Duration) (TLSInfo, error) {
+	if timeout <= 0 {
+		timeout = defaultTLSHandshakeTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	begin := time.Now()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return TLSInfo{}, fmt.Errorf("tls handshake with %s: %w", conn.RemoteAddr(), err)
+	}
+
+	info := InspectTLS(conn.ConnectionState())
+	info.Duration = time.Since(begin)
+
+	return info, nil
+}
+
+// InspectTLS describes a connection state
+func InspectTLS(state tls.ConnectionState) TLSInfo {
+	info := TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+		ServerName:  state.ServerName,
+		Resumed:     state.DidResume,
+	}
+	for _, cert := range state.PeerCertificates {
+		info.PeerChain = append(info.PeerChain, certInfo(cert))
+	}
+
+	return info
+}
+
+func certInfo(cert *x509.Certificate) TLSCertInfo {
+	return TLSCertInfo{
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		DNSNames:    cert.DNSNames,
+		NotAfter:    cert.NotAfter,
+		Fingerprint: certFingerprint(cert),
+	}
+}
+
+// certFingerprint is the hex SHA-256 of the certificate
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (i TLSInfo) String() string {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "%s %s", i.Version, i.CipherSuite)
+	if i.ALPN != "" {
+		fmt.Fprintf(b, " alpn=%s", i.ALPN)
+	}
+	if i.ServerName != "" {
+		fmt.Fprintf(b, " sni=%s", i.ServerName)
+	}
+	if i.Resumed {
+		b.WriteString(" resumed")
+	}
+	if len(i.PeerChain) > 0 {
+		leaf := i.PeerChain[0]
+		fmt.Fprintf(b, " peer=%s (issuer %s, expires %s)",
+			leaf.Subject, leaf.Issuer, leaf.NotAfter.Format(time.DateOnly))
+	}
+	if i.Duration > 0 {
+		fmt.Fprintf(b, " in %s", i.Duration.Round(10*time.Microsecond))
+	}
+
+	return b.String()
+}
+
+// LogValue lets slog log a TLSInfo as a group of attributes
+func (i TLSInfo) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("version", i.Version),
+		slog.String("cipher_suite", i.CipherSuite),
+		slog.Bool("resumed", i.Resumed),
+	}
+	if i.ALPN != "" {
+		attrs = append(attrs, slog.String("alpn", i.ALPN))
+	}
+	if i.ServerName != "" {
+		attrs = append(attrs, slog.String("sni", i.ServerName))
+	}
+	if i.Duration > 0 {
+		attrs = append(attrs, slog.Duration("handshake", i.Duration))
+	}
+	if len(i.PeerChain) > 0 {
+		leaf := i.PeerChain[0]
+		attrs = append(attrs,
+			slog.String("peer_subject", leaf.Subject),
+			slog.String("peer_issuer", leaf.Issuer),
+			slog.Time("peer_expires", leaf.NotAfter),
+			slog.String("peer_sha256", leaf.Fingerprint),
+		)
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+// LogTLS logs the handshake details of connection connID (as returned
+// by MonitoredConn.ID, 0 when unknown)
+func (m *Monitor) LogTLS(connID uint64, info TLSInfo) {
+	if m.Structured != nil {
+		m.Structured.LogAttrs(context.Background(), slog.LevelInfo, "tls",
+			slog.Uint64("conn_id", connID), slog.Any("tls", info))
+		return
+	}
+
+	if m.Logger != nil {
+		m.Printf("conn %d: tls %s", connID, info)
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := ca.Issue(TLSLeaf{Name: "server", Hosts: []string{"localhost"}})
+
+	serverCfg := ServerConfig(cert, nil)
+	serverCfg.NextProtos = []string{"tlv/1", "echo"}
+	clientCfg := ClientConfig(ca.Pool())
+	clientCfg.ServerName = "localhost"
+	clientCfg.NextProtos = []string{"echo"}
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		_, _ = TLSHandshake(context.Background(), tls.Server(server, serverCfg), time.Second)
+	}()
+
+	info, err := TLSHandshake(context.Background(), tls.Client(client, clientCfg), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Version != "TLS 1.3" || info.ALPN != "echo" || info.ServerName != "localhost" {
+		t.Errorf("unexpected handshake info: %+v", info)
+	}
+	if len(info.PeerChain) != 1 || info.PeerChain[0].Subject != "CN=server" || len(info.PeerChain[0].Fingerprint) != 64 {
+		t.Errorf("unexpected peer chain: %+v", info.PeerChain)
+	}
+
+	// Plain and structured Monitor output
+	buf := new(bytes.Buffer)
+	(&Monitor{Logger: log.New(buf, "", 0)}).LogTLS(7, info)
+	if line := buf.String(); !strings.HasPrefix(line, "conn 7: tls TLS 1.3") || !strings.Contains(line, "alpn=echo") {
+		t.Errorf("unexpected log line: %q", line)
+	}
+
+	buf.Reset()
+	(&Monitor{Structured: slog.New(slog.NewJSONHandler(buf, nil))}).LogTLS(7, info)
+	var record struct {
+		TLS struct {
+			Version string `json:"version"`
+			ALPN    string `json:"alpn"`
+		} `json:"tls"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.TLS.Version != "TLS 1.3" || record.TLS.ALPN != "echo" {
+		t.Errorf("unexpected structured record: %s", buf)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// The "server" never answers the ClientHello
+	go func() { _, _ = server.Read(make([]byte, 4096)) }()
+
+	begin := time.Now()
+	_, err := TLSHandshake(context.Background(), tls.Client(client, &tls.Config{ServerName: "x"}), 50*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected handshake timeout")
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("handshake timeout took %s", elapsed)
+	}
+
+	// The connection was closed for us
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("expected closed connection")
+	}
+}
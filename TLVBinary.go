@@ -25,14 +25,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 )
 
 // Constants defining the TLV types and constraints
 const (
 	// BinaryType is assigned the value 1 (iota + 1)
 	// iota starts at 0, so BinaryType = 1, StringType = 2
-	BinaryType uint8 = iota + 1
-	StringType       // StringType is implicitly 2
+	BinaryType  uint8 = iota + 1
+	StringType        // StringType is implicitly 2
+	ControlType       // ControlType (3) frames STARTTLS signaling
+	MuxType           // MuxType (4) frames carry multiplexed streams
 	// MaxPayloadSize defines the maximum allowed payload
 	// size (10 MB)
 	// Keep this low to avoid memory exhaustion attack
@@ -40,7 +43,7 @@ const (
 )
 
 // Custom error for when the payload size exceeds MaxPayloadSize
-var ErrMaxPayloadSize = errors.New("maximum payload size exceeded ")
+var ErrMaxPayloadSize = errLimit("maximum payload size exceeded")
 
 // Payload interface defines the behavior for types
 // that can be encoded/decoded in TLV format
@@ -72,32 +75,39 @@ func (m Binary) String() string {
 // io.Writer in TLV format
 // Satisfies the io.WriterTo interface
 func (m Binary) WriteTo(w io.Writer) (int64, error) {
-	// Write the type identifier (BinaryType = 1)
-	// in big-endian format
-	err := binary.Write(w, binary.BigEndian, BinaryType)
-	if err != nil {
-		// Return 0 bytes written and the error
-		return 0, err
-	}
-	// Track the number of bytes written (1 byte for the type)
-	var n int64 = 1
+	// Type identifier (BinaryType = 1), length and
+	// payload, together
+	return writeTLV(w, BinaryType, m)
+}
 
-	// Write the length of the payload as a
-	// uint32 in big-endian format
-	err = binary.Write(w, binary.BigEndian, uint32(len(m)))
-	if err != nil {
-		// Return bytes written so far (1) and the error
-		return n, err
+// writeTLV writes a [1-byte type][4-byte length][payload] frame.
+//
+// Writing the parts one by one costs a system call each, and on a
+// connection with TCP_NODELAY (Go's default) a packet each: the peer
+// waits for three of them to get one message. Copying them into one
+// buffer first costs a copy of the payload. net.Buffers does neither:
+// on a TCP or Unix connection its WriteTo is a single writev(2) of the
+// header and the payload where they are. On any other io.Writer,
+// wrapped connections included, it's one Write per part.
+//
+// BenchmarkTLVRoundTrip and BenchmarkTLVRoundTripSeparate (TLVTest.go)
+// compare it to the three writes it replaced; strace -c -f on the test
+// binary counts the system calls.
+//
+// A payload over MaxPayloadSize, which the peer would refuse, isn't
+// written at all.
+func writeTLV(w io.Writer, typ uint8, payload []byte) (int64, error) {
+	if uint64(len(payload)) > uint64(MaxPayloadSize) {
+		return 0, ErrMaxPayloadSize
 	}
-	// Add the 4 bytes written for the length field
-	n += 4
 
-	// Write the actual payload data
-	output, err := w.Write(m)
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
 
-	// Return total bytes written (type + length + payload)
-	// and any error
-	return n + int64(output), err
+	buffers := net.Buffers{header[:], payload}
+
+	return buffers.WriteTo(w)
 }
 
 // ReadFrom deserializes a Binary payload from an
@@ -141,8 +151,9 @@ func (m *Binary) ReadFrom(r io.Reader) (int64, error) {
 	// Allocate a byte slice of the specified size to
 	// store the payload
 	*m = make([]byte, size)
-	// Read the payload data into the allocated slice
-	output, err := r.Read(*m)
+	// Read the payload data into the allocated slice;
+	// ReadFull, as a single Read may return less
+	output, err := io.ReadFull(r, *m)
 
 	// Return total bytes read (type + length + payload)
 	// and any error
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Multiplexing streams over one TLV connection
+//
+// One request at a time per connection wastes the connection: a slow
+// reply holds up every request behind it, and opening a connection per
+// request costs a handshake (or three, with TLS). A multiplexer carves
+// one connection into many independent streams, the way HTTP/2 and SSH
+// channels do.
+//
+// Every frame carries the id of the stream it belongs to:
+//
+//	type (MuxType) | length (4) | stream id (4) | flags (1) | data
+//
+// Flags open a stream (SYN), end one direction of it (FIN, like a TCP
+// half-close) or abort it (RST). The dialing side uses odd ids, the
+// accepting side even ones, so both can open streams without agreeing
+// on ids first.
+//
+// There is no per-stream flow control: a stream whose reader falls more
+// than muxStreamBacklog frames behind stalls the whole connection until
+// it catches up. Good enough for request/response traffic; HTTP/2 uses
+// window updates to do better, and QUIC does it on top of UDP (see the
+// quicx module).
+//
+// Over a connection with streams of its own, an SCTPConn (SCTP.go), the
+// frames of each mux stream go on one of them, so that a lost packet
+// only holds up the mux streams sharing it rather than all of them.
+
+const (
+	muxSYN = 1 << iota // Open a stream
+	muxFIN             // No more data from the sender
+	muxRST             // Abort the stream
+
+	muxHeaderSize    = 5         // Stream id and flags after the TLV header
+	muxMaxFrameData  = 16 << 10  // Data per frame
+	muxStreamBacklog = 64        // Frames buffered per stream
+	muxAcceptBacklog = 64        // Streams waiting for Accept
+	muxMaxStreamID   = 1<<31 - 1 // Ids aren't reused
+)
+
+var (
+	// ErrMuxClosed is returned by operations on a closed mux
+	ErrMuxClosed = errors.New("mux: closed")
+	// ErrStreamReset means the peer aborted the stream
+	ErrStreamReset = errors.New("mux: stream reset")
+)
+
+// streamConn is a connection with streams of its own, like SCTPConn
+type streamConn interface {
+	Streams() int
+	WriteStream(b []byte, stream int) (int, error)
+}
+
+// Mux multiplexes streams over a connection
+type Mux struct {
+	conn net.Conn
+
+	wmu sync.Mutex // Frames must not interleave
+
+	mu      sync.Mutex
+	streams map[uint32]*MuxStream
+	nextID  uint32
+	err     error // Why the mux closed
+
+	accept chan *MuxStream
+	done   chan struct{}
+}
+
+// NewMux starts multiplexing conn. client picks the id space: one side
+// of the connection must pass true, the other false.
+func NewMux(conn net.Conn, client bool) *Mux {
+	m := &Mux{
+		conn:    conn,
+		streams: make(map[uint32]*MuxStream),
+		nextID:  2,
+		accept:  make(chan *MuxStream, muxAcceptBacklog),
+		done:    make(chan struct{}),
+	}
+	if client {
+		m.nextID = 1
+	}
+
+	go m.readLoop()
+
+	return m
+}
+
+// Open starts a new stream
+func (m *Mux) Open() (*MuxStream, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	if m.nextID > muxMaxStreamID {
+		m.mu.Unlock()
+		return nil, errors.New("mux: stream ids exhausted")
+	}
+	s := newMuxStream(m, m.nextID)
+	m.nextID += 2
+	m.streams[s.id] = s
+	m.mu.Unlock()
+
+	if err := m.writeFrame(s.id, muxSYN, nil); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Accept waits for a stream opened by the peer
+func (m *Mux) Accept() (*MuxStream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-m.done:
+		return nil, m.Err()
+	}
+}
+
+// Err returns why the mux closed, nil while it's open
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.err
+}
+
+// Done is closed when the mux closes
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Close closes the connection and every stream
+func (m *Mux) Close() error {
+	m.shutdown(ErrMuxClosed)
+
+	return m.conn.Close()
+}
+
+func (m *Mux) shutdown(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	close(m.done)
+}
+
+func (m *Mux) writeFrame(id uint32, flags byte, data []byte) error {
+	frame := make([]byte, 5+muxHeaderSize, 5+muxHeaderSize+len(data))
+	frame[0] = MuxType
+	binary.BigEndian.PutUint32(frame[1:], uint32(muxHeaderSize+len(data)))
+	binary.BigEndian.PutUint32(frame[5:], id)
+	frame[9] = flags
+	frame = append(frame, data...)
+
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	if err := m.Err(); err != nil {
+		return err
+	}
+	var err error
+	if sc, ok := m.conn.(streamConn); ok {
+		_, err = sc.WriteStream(frame, int(id%uint32(sc.Streams())))
+	} else {
+		_, err = m.conn.Write(frame)
+	}
+	if err != nil {
+		m.shutdown(err)
+		return err
+	}
+
+	return nil
+}
+
+func (m *Mux) readLoop() {
+	err := m.read()
+	m.shutdown(err)
+	_ = m.conn.Close()
+}
+
+func (m *Mux) read() error {
+	header := make([]byte, 5+muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(m.conn, header); err != nil {
+			return err
+		}
+		if header[0] != MuxType {
+			return fmt.Errorf("mux: unexpected frame type %d", header[0])
+		}
+		size := binary.BigEndian.Uint32(header[1:])
+		if size < muxHeaderSize || size-muxHeaderSize > muxMaxFrameData {
+			return ErrMaxPayloadSize
+		}
+		id, flags := binary.BigEndian.Uint32(header[5:]), header[9]
+
+		data := make([]byte, size-muxHeaderSize)
+		if _, err := io.ReadFull(m.conn, data); err != nil {
+			return err
+		}
+
+		m.mu.Lock()
+		s := m.streams[id]
+		if s == nil && flags&muxSYN != 0 {
+			s = newMuxStream(m, id)
+			m.streams[id] = s
+			select {
+			case m.accept <- s:
+			default:
+				// Nobody is accepting; turn it away
+				delete(m.streams, id)
+				s = nil
+				go func() { _ = m.writeFrame(id, muxRST, nil) }()
+			}
+		}
+		m.mu.Unlock()
+
+		if s == nil {
+			// Frames of a stream we closed already
+			continue
+		}
+		if len(data) > 0 {
+			s.deliver(data)
+		}
+		if flags&muxFIN != 0 {
+			s.remoteFin()
+		}
+		if flags&muxRST != 0 {
+			s.reset(ErrStreamReset)
+		}
+	}
+}
+
+func (m *Mux) forget(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// MuxStream is one stream of a Mux
+type MuxStream struct {
+	mux *Mux
+	id  uint32
+
+	data    chan []byte   // Closed on FIN, only the read loop sends
+	unread  []byte        // Rest of the current frame
+	resetCh chan struct{} // Closed on RST, either side
+	closeCh chan struct{} // Closed on local Close
+
+	once      sync.Once // Guards close(data)
+	resetOnce sync.Once
+	closeOnce sync.Once
+	finOnce   sync.Once
+	resetErr  error
+}
+
+func newMuxStream(m *Mux, id uint32) *MuxStream {
+	return &MuxStream{
+		mux:     m,
+		id:      id,
+		data:    make(chan []byte, muxStreamBacklog),
+		resetCh: make(chan struct{}),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// ID returns the stream id
+func (s *MuxStream) ID() uint32 {
+	return s.id
+}
+
+// deliver queues data for Read, blocking the read loop while the backlog
+// is full
+func (s *MuxStream) deliver(p []byte) {
+	select {
+	case s.data <- p:
+	case <-s.resetCh:
+	case <-s.closeCh:
+	}
+}
+
+func (s *MuxStream) remoteFin() {
+	s.once.Do(func() { close(s.data) })
+}
+
+func (s *MuxStream) reset(err error) {
+	s.resetOnce.Do(func() {
+		s.resetErr = err
+		close(s.resetCh)
+	})
+	s.mux.forget(s.id)
+}
+
+// Read reads data sent on the stream; io.EOF after the peer's FIN
+func (s *MuxStream) Read(p []byte) (int, error) {
+	for len(s.unread) == 0 {
+		select {
+		case b, ok := <-s.data:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.unread = b
+		case <-s.resetCh:
+			return 0, s.resetErr
+		case <-s.mux.done:
+			return 0, s.mux.Err()
+		}
+	}
+
+	n := copy(p, s.unread)
+	s.unread = s.unread[n:]
+
+	return n, nil
+}
+
+// Write sends p in as many frames as needed
+func (s *MuxStream) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		select {
+		case <-s.resetCh:
+			return n, s.resetErr
+		case <-s.closeCh:
+			return n, net.ErrClosed
+		default:
+		}
+
+		chunk := p[:min(len(p), muxMaxFrameData)]
+		if err := s.mux.writeFrame(s.id, 0, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// CloseWrite tells the peer we're done sending; it can still reply
+func (s *MuxStream) CloseWrite() error {
+	var err error
+	s.finOnce.Do(func() { err = s.mux.writeFrame(s.id, muxFIN, nil) })
+
+	return err
+}
+
+// Reset aborts the stream in both directions
+func (s *MuxStream) Reset() error {
+	s.reset(net.ErrClosed)
+
+	return s.mux.writeFrame(s.id, muxRST, nil)
+}
+
+// Close ends our side of the stream and stops reading from it
+func (s *MuxStream) Close() error {
+	err := s.CloseWrite()
+	s.closeOnce.Do(func() { close(s.closeCh) })
+	s.mux.forget(s.id)
+
+	return err
+}
+
+// muxPair returns the two ends of a multiplexed TCP connection
+func muxPair(t *testing.T) (client, server *Mux) {
+	t.Helper()
+
+	c, s := tlvPair(t)
+	client, server = NewMux(c, true), NewMux(s, false)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+func TestMux(t *testing.T) {
+	client, server := muxPair(t)
+
+	// Echo every stream, each in its own goroutine
+	go func() {
+		for {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				_, _ = io.Copy(s, s)
+			}()
+		}
+	}()
+
+	// Several streams at once, each with TLV payloads and a half-close
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			s, err := client.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.Close()
+
+			text := fmt.Sprintf("stream %d: %0100000d", i, i)
+			if _, err := String(text).WriteTo(s); err != nil {
+				errs <- err
+				return
+			}
+			_ = s.CloseWrite()
+
+			p, err := decode(s)
+			if err != nil || p.String() != text {
+				errs <- fmt.Errorf("stream %d: unexpected echo, %v", i, err)
+				return
+			}
+			// The echo ends when the server closes its side
+			if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+				errs <- fmt.Errorf("stream %d: expected EOF; actual: %v", i, err)
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	client, server := muxPair(t)
+
+	accepted := make(chan *MuxStream, 1)
+	go func() {
+		s, _ := server.Accept()
+		accepted <- s
+	}()
+
+	s, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+
+	// Resetting unblocks a pending Read on the other side
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := remote.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	_ = s.Reset()
+
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, ErrStreamReset) {
+			t.Errorf("expected reset; actual: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not interrupted by reset")
+	}
+
+	// Closing the mux ends everything
+	_ = client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	select {
+	case <-server.Done():
+	case <-ctx.Done():
+		t.Fatal("server mux didn't notice the closed connection")
+	}
+	if _, err := server.Accept(); err == nil {
+		t.Error("expected Accept to fail")
+	}
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Opportunistic STARTTLS for the TLV protocol
+//
+// Instead of a separate TLS port, a TLV connection can start in
+// plaintext and upgrade in place, the way SMTP and IMAP do. Either side
+// sends a Control frame asking for TLS; the peer agrees or refuses:
+//
+//	A -> B: Control "STARTTLS"
+//	B -> A: Control "STARTTLS OK"   (or "STARTTLS NO")
+//	        TLS handshake on the same TCP connection
+//	A <-> B: Control "FINISHED <sent> <received>", now encrypted
+//
+// Regardless of who asked, the side holding the certificate (the one
+// created with TLVServer) plays the TLS server. If both sides ask at the
+// same time, the client answers the server's request and both upgrade
+// once.
+//
+// STARTTLS has a bad track record, because everything before the
+// upgrade is unauthenticated:
+//
+//   - An attacker can strip the request or forge a refusal, and the
+//     peers carry on in plaintext. RequireTLS turns that into an error:
+//     plaintext payloads are neither sent nor accepted, and a refusal
+//     fails the connection.
+//   - An attacker can tamper with the plaintext conversation. Once the
+//     channel is secure, both sides exchange SHA-256 hashes of every
+//     plaintext byte they sent and received, and hang up if they don't
+//     match.
+//   - Data the attacker pipelines after the "STARTTLS OK" must not end
+//     up on the secure side. decode reads frames straight from the
+//     connection without buffering, so any extra bytes go to the TLS
+//     handshake, which fails on them.
+//
+// A Control "ping" is a heartbeat keeping an idle connection open, and
+// is skipped, before and after the upgrade.
+//
+// A TLVConn is meant to be used by one reader; Send may be called from
+// another goroutine only after the upgrade has finished.
+
+const (
+	controlStartTLS = "STARTTLS"
+	controlAccept   = "STARTTLS OK"
+	controlRefuse   = "STARTTLS NO"
+	controlFinished = "FINISHED"
+
+	// controlPing is a heartbeat, ignored on receipt (see Chat.go and
+	// Client.go)
+	controlPing = "ping"
+
+	// maxControlSize bounds control frames, which are tiny
+	maxControlSize = 1 << 10
+)
+
+var (
+	// ErrTLSRequired means a plaintext payload was sent or received, or
+	// the upgrade was refused, on a connection requiring TLS
+	ErrTLSRequired = errors.New("tlv: TLS required")
+	// ErrTLSRefused means the peer answered STARTTLS with a refusal
+	ErrTLSRefused = errors.New("tlv: peer refused STARTTLS")
+	// ErrTLSDowngrade means the plaintext conversation was tampered with
+	ErrTLSDowngrade = errors.New("tlv: plaintext transcript mismatch")
+	// ErrUnexpectedControl is a control frame out of sequence
+	ErrUnexpectedControl = errors.New("tlv: unexpected control frame")
+)
+
+// Control is a protocol signaling frame, never seen by applications
+type Control string
+
+// Bytes returns the control message as a byte slice
+func (m Control) Bytes() []byte {
+	return []byte(m)
+}
+
+// String returns the control message
+func (m Control) String() string {
+	return string(m)
+}
+
+// WriteTo writes the Control frame, [1-byte type][4-byte length][text]
+func (m Control) WriteTo(w io.Writer) (int64, error) {
+	return writeTLV(w, ControlType, []byte(m))
+}
+
+// ReadFrom reads a Control frame
+func (m *Control) ReadFrom(r io.Reader) (int64, error) {
+	var header [5]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	if header[0] != ControlType {
+		return int64(n), errors.New("invalid Control")
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxControlSize {
+		return int64(n), ErrMaxPayloadSize
+	}
+
+	buf := make([]byte, size)
+	output, err := io.ReadFull(r, buf)
+	if err != nil {
+		return int64(n + output), err
+	}
+	*m = Control(buf)
+
+	return int64(n + output), nil
+}
+
+// TLVConn exchanges TLV payloads and can upgrade to TLS midway
+type TLVConn struct {
+	// RequireTLS refuses to exchange payloads in plaintext
+	RequireTLS bool
+
+	// HandshakeTimeout bounds the TLS handshake (defaults to 10s)
+	HandshakeTimeout time.Duration
+
+	// Quota bounds the payloads received, and their bytes with the
+	// headers. Going over closes the connection.
+	Quota MessageQuota
+
+	raw    net.Conn
+	conn   net.Conn // transcript before the upgrade, tls after
+	config *tls.Config
+	server bool
+
+	tls        *tls.Conn
+	sent, recv hash.Hash // Plaintext transcript
+	pending    bool      // We asked for TLS, waiting for the answer
+	queue      []Payload // Received while waiting
+	usage      *quotaUsage
+}
+
+// TLVServer returns a TLV connection acting as the TLS server after an
+// upgrade. With a nil cfg, it refuses STARTTLS.
+func TLVServer(conn net.Conn, cfg *tls.Config) *TLVConn {
+	return newTLVConn(conn, cfg, true)
+}
+
+// TLVClient returns a TLV connection acting as the TLS client after an
+// upgrade. cfg needs ServerName (or InsecureSkipVerify) as for
+// tls.Client; with a nil cfg, it refuses STARTTLS.
+func TLVClient(conn net.Conn, cfg *tls.Config) *TLVConn {
+	return newTLVConn(conn, cfg, false)
+}
+
+func newTLVConn(conn net.Conn, cfg *tls.Config, server bool) *TLVConn {
+	c := &TLVConn{
+		raw:    conn,
+		config: cfg,
+		server: server,
+		sent:   sha256.New(),
+		recv:   sha256.New(),
+	}
+	c.conn = &transcriptConn{Conn: conn, sent: c.sent, recv: c.recv}
+
+	return c
+}
+
+// TLS returns the TLS connection after an upgrade, nil before
+func (c *TLVConn) TLS() *tls.Conn {
+	return c.tls
+}
+
+// Close closes the underlying connection
+func (c *TLVConn) Close() error {
+	return c.conn.Close()
+}
+
+// Send writes a payload (a String, Binary, or anything else framing
+// itself)
+func (c *TLVConn) Send(p io.WriterTo) error {
+	if c.tls == nil && c.RequireTLS {
+		return ErrTLSRequired
+	}
+
+	_, err := p.WriteTo(c.conn)
+
+	return err
+}
+
+// Receive returns the next payload, handling control frames on the way.
+// It upgrades the connection when the peer asks for TLS.
+func (c *TLVConn) Receive() (Payload, error) {
+	if len(c.queue) > 0 {
+		p := c.queue[0]
+		c.queue = c.queue[1:]
+		return p, nil
+	}
+
+	for {
+		p, err := c.next()
+		if err != nil || p != nil {
+			return p, err
+		}
+	}
+}
+
+// TLVHandler answers a payload; a nil reply sends nothing, an error
+// ends the connection
+type TLVHandler func(c *TLVConn, p Payload) (reply io.WriterTo, err error)
+
+// ServeTLV answers the payloads of c with h until the peer hangs up,
+// which returns nil, or an error occurs. It closes c on return.
+func ServeTLV(c *TLVConn, h TLVHandler) error {
+	defer c.Close()
+
+	for {
+		p, err := c.Receive()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply, err := h(c, p)
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			if err := c.Send(reply); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// StartTLS asks the peer to upgrade and returns once the connection is
+// secure. Payloads arriving meanwhile are kept for Receive.
+func (c *TLVConn) StartTLS() error {
+	if c.tls != nil {
+		return nil
+	}
+	if c.config == nil {
+		return errors.New("tlv: STARTTLS without a TLS config")
+	}
+
+	c.pending = true
+	if _, err := Control(controlStartTLS).WriteTo(c.conn); err != nil {
+		return err
+	}
+
+	for c.pending {
+		p, err := c.next()
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			c.queue = append(c.queue, p)
+		}
+	}
+
+	return nil
+}
+
+// next reads a frame; it returns nil, nil after handling a control frame
+func (c *TLVConn) next() (Payload, error) {
+	if err := c.usage.exceeded(); err != nil {
+		return nil, err
+	}
+	p, err := decode(c.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	ctl, ok := p.(*Control)
+	if !ok {
+		if c.tls == nil && c.RequireTLS {
+			_ = c.Close()
+			return nil, ErrTLSRequired
+		}
+		if c.usage == nil {
+			c.usage = c.Quota.start()
+		}
+		// The type byte and the length of the header
+		if err := c.usage.add(len(p.Bytes()) + 5); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		return p, nil
+	}
+
+	switch {
+	case string(*ctl) == controlPing:
+		// Reading it was the point
+		return nil, nil
+	case c.tls != nil:
+		// Whatever it is, it has no business on a secure connection
+	case string(*ctl) == controlStartTLS && c.pending && c.server:
+		// Both asked; the client answers ours
+		return nil, nil
+	case string(*ctl) == controlStartTLS && c.config == nil:
+		_, err := Control(controlRefuse).WriteTo(c.conn)
+		return nil, err
+	case string(*ctl) == controlStartTLS:
+		if _, err := Control(controlAccept).WriteTo(c.conn); err != nil {
+			return nil, err
+		}
+		c.pending = false
+		return nil, c.upgrade()
+	case string(*ctl) == controlAccept && c.pending:
+		c.pending = false
+		return nil, c.upgrade()
+	case string(*ctl) == controlRefuse && c.pending:
+		c.pending = false
+		if c.RequireTLS {
+			_ = c.Close()
+			return nil, fmt.Errorf("%w: %w", ErrTLSRequired, ErrTLSRefused)
+		}
+		return nil, ErrTLSRefused
+	}
+
+	_ = c.Close()
+	return nil, fmt.Errorf("%w: %q", ErrUnexpectedControl, string(*ctl))
+}
+
+// upgrade runs the TLS handshake on the raw connection and checks that
+// both sides saw the same plaintext conversation
+func (c *TLVConn) upgrade() error {
+	if c.server {
+		c.tls = tls.Server(c.raw, c.config)
+	} else {
+		c.tls = tls.Client(c.raw, c.config)
+	}
+	if _, err := TLSHandshake(context.Background(), c.tls, c.HandshakeTimeout); err != nil {
+		return err
+	}
+	c.conn = c.tls
+
+	ours := Control(fmt.Sprintf("%s %x %x", controlFinished, c.sent.Sum(nil), c.recv.Sum(nil)))
+	theirs := fmt.Sprintf("%s %x %x", controlFinished, c.recv.Sum(nil), c.sent.Sum(nil))
+
+	// The client speaks first, the server answers even on a mismatch so
+	// both ends learn about it
+	var p Payload
+	var err error
+	if c.server {
+		p, err = decode(c.conn)
+		if err == nil {
+			_, err = ours.WriteTo(c.conn)
+		}
+	} else {
+		_, err = ours.WriteTo(c.conn)
+		if err == nil {
+			p, err = decode(c.conn)
+		}
+	}
+	if err != nil {
+		_ = c.Close()
+		return err
+	}
+
+	if ctl, ok := p.(*Control); !ok || string(*ctl) != theirs {
+		_ = c.Close()
+		return ErrTLSDowngrade
+	}
+
+	return nil
+}
+
+// transcriptConn hashes everything sent and received
+type transcriptConn struct {
+	net.Conn
+	sent, recv hash.Hash
+}
+
+func (c *transcriptConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.recv.Write(p[:n])
+
+	return n, err
+}
+
+func (c *transcriptConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Write(p[:n])
+
+	return n, err
+}
+
+// tlvPair returns both ends of an in-memory connection
+func tlvPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+
+	client, server = MemPipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+// tcpPair returns both ends of a TCP connection, for tests that need
+// the real thing (resets, socket options)
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+
+	l := testListener(t)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+// tlvTLSConfigs returns matching server and client configs
+func tlvTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+
+	ca, err := NewTLSCA("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Issue(TLSLeaf{Name: "tlv", Hosts: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client = ClientConfig(ca.Pool())
+	client.ServerName = "127.0.0.1"
+
+	return ServerConfig(cert, nil), client
+}
+
+// tlvAckServer answers every String with "ack:" and the text
+func tlvAckServer(c *TLVConn) error {
+	for {
+		p, err := c.Receive()
+		if err != nil {
+			return err
+		}
+		if err := c.Send(String("ack:" + p.String())); err != nil {
+			return err
+		}
+	}
+}
+
+// wireTap records everything written to a connection
+type wireTap struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *wireTap) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.buf.Write(p)
+	w.mu.Unlock()
+
+	return w.Conn.Write(p)
+}
+
+// tamperConn rewrites what it reads, like an attacker on the path
+type tamperConn struct {
+	net.Conn
+	old, new []byte
+}
+
+func (c *tamperConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	copy(p, bytes.ReplaceAll(p[:n], c.old, c.new))
+
+	return n, err
+}
+
+func TestTLVStartTLS(t *testing.T) {
+	serverCfg, clientCfg := tlvTLSConfigs(t)
+	clientConn, serverConn := tlvPair(t)
+	_ = clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	go func() { _ = tlvAckServer(TLVServer(serverConn, serverCfg)) }()
+
+	tap := &wireTap{Conn: clientConn}
+	client := TLVClient(tap, clientCfg)
+
+	roundTrip := func(text string) {
+		t.Helper()
+		if err := client.Send(String(text)); err != nil {
+			t.Fatal(err)
+		}
+		p, err := client.Receive()
+		if err != nil || p.String() != "ack:"+text {
+			t.Fatalf("unexpected reply %v, %v", p, err)
+		}
+	}
+
+	roundTrip("hello")
+	if err := client.StartTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if client.TLS() == nil {
+		t.Fatal("expected TLS connection")
+	}
+	roundTrip("secret")
+
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	if wire := tap.buf.String(); !strings.Contains(wire, "hello") || strings.Contains(wire, "secret") {
+		t.Errorf("expected only the first message in plaintext on the wire")
+	}
+}
+
+func TestTLVStartTLSBothAsk(t *testing.T) {
+	serverCfg, clientCfg := tlvTLSConfigs(t)
+	clientConn, serverConn := tlvPair(t)
+	_ = clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	_ = serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	server := TLVServer(serverConn, serverCfg)
+	client := TLVClient(clientConn, clientCfg)
+
+	errs := make(chan error, 2)
+	go func() { errs <- server.StartTLS() }()
+	go func() { errs <- client.StartTLS() }()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go func() { _ = client.Send(String("over TLS")) }()
+	if p, err := server.Receive(); err != nil || p.String() != "over TLS" {
+		t.Errorf("unexpected payload %v, %v", p, err)
+	}
+}
+
+func TestTLVStartTLSDowngrade(t *testing.T) {
+	serverCfg, clientCfg := tlvTLSConfigs(t)
+
+	t.Run("refused", func(t *testing.T) {
+		clientConn, serverConn := tlvPair(t)
+		_ = clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+		go func() { _ = tlvAckServer(TLVServer(serverConn, nil)) }()
+
+		// Opportunistic: carry on in plaintext
+		client := TLVClient(clientConn, clientCfg)
+		if err := client.StartTLS(); !errors.Is(err, ErrTLSRefused) {
+			t.Fatalf("expected refusal; actual: %v", err)
+		}
+		_ = client.Send(String("plain"))
+		if p, err := client.Receive(); err != nil || p.String() != "ack:plain" {
+			t.Errorf("unexpected reply %v, %v", p, err)
+		}
+	})
+
+	t.Run("refused but required", func(t *testing.T) {
+		clientConn, serverConn := tlvPair(t)
+		_ = clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+		go func() { _ = tlvAckServer(TLVServer(serverConn, nil)) }()
+
+		client := TLVClient(clientConn, clientCfg)
+		client.RequireTLS = true
+		if err := client.Send(String("plain")); !errors.Is(err, ErrTLSRequired) {
+			t.Errorf("expected plaintext send to fail; actual: %v", err)
+		}
+		if err := client.StartTLS(); !errors.Is(err, ErrTLSRequired) {
+			t.Errorf("expected TLS required error; actual: %v", err)
+		}
+	})
+
+	t.Run("plaintext to strict server", func(t *testing.T) {
+		clientConn, serverConn := tlvPair(t)
+		_ = serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		server := TLVServer(serverConn, serverCfg)
+		server.RequireTLS = true
+		_ = TLVClient(clientConn, clientCfg).Send(String("plain"))
+		if _, err := server.Receive(); !errors.Is(err, ErrTLSRequired) {
+			t.Errorf("expected TLS required error; actual: %v", err)
+		}
+	})
+
+	t.Run("tampered transcript", func(t *testing.T) {
+		clientConn, serverConn := tlvPair(t)
+		_ = clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+		_ = serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		// The attacker changes what the server reads before the upgrade
+		tampered := &tamperConn{Conn: serverConn, old: []byte("hello"), new: []byte("HELLO")}
+		serverErr := make(chan error, 1)
+		go func() { serverErr <- tlvAckServer(TLVServer(tampered, serverCfg)) }()
+
+		client := TLVClient(clientConn, clientCfg)
+		_ = client.Send(String("hello"))
+		if p, err := client.Receive(); err != nil || p.String() != "ack:HELLO" {
+			t.Fatalf("unexpected reply %v, %v", p, err)
+		}
+
+		if err := client.StartTLS(); !errors.Is(err, ErrTLSDowngrade) {
+			t.Errorf("client: expected downgrade error; actual: %v", err)
+		}
+		if err := <-serverErr; !errors.Is(err, ErrTLSDowngrade) {
+			t.Errorf("server: expected downgrade error; actual: %v", err)
+		}
+	})
+}
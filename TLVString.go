@@ -24,29 +24,10 @@ func (m String) String() string {
 // It encodes a type marker, the length of the string, and the string bytes themselves.
 // Returns the number of bytes written and an error if any.
 func (m String) WriteTo(w io.Writer) (int64, error) {
-	// Write the type marker byte identifying this payload as a String type
-	err := binary.Write(w, binary.BigEndian, StringType) // 1-byte
-	if err != nil {
-		return 0, err
-	}
-	// Count bytes written so far (1 byte for type)
-	var n int64 = 1
-
-	// Write the length of the string as a 4-byte unsigned
-	// integer (BigEndian)
-	err = binary.Write(w, binary.BigEndian, uint32(len(m))) // 4-bytes
-	if err != nil {
-		return n, err
-	}
-	// Add 4 bytes to the count for the length field
-	n += 4
-
-	// Write the actual string bytes
-	output, err := w.Write([]byte(m))
-	// output is the number of bytes written for the string contents
-
-	// Return total bytes written and error if any
-	return n + int64(output), err
+	// The type marker, the length as a 4-byte unsigned integer
+	// (BigEndian) and the string bytes, in one writev where the
+	// writer supports it (see writeTLV in TLVBinary.go)
+	return writeTLV(w, StringType, []byte(m))
 }
 
 // ReadFrom reads an encoded String from an io.Reader.
@@ -79,11 +60,17 @@ func (m *String) ReadFrom(r io.Reader) (int64, error) {
 	// Add 4 bytes read for length
 	n += 4
 
+	// Like Binary, refuse sizes over the limit before allocating
+	if size > MaxPayloadSize {
+		return n, ErrMaxPayloadSize
+	}
+
 	// Allocate a buffer to hold the string bytes
 	// based on the length
 	buf := make([]byte, size)
-	// Read the string bytes into the buffer
-	output, err := r.Read(buf)
+	// Read the string bytes into the buffer; ReadFull,
+	// as a single Read may return less
+	output, err := io.ReadFull(r, buf)
 	if err != nil {
 		return n, err
 	}
@@ -118,6 +105,9 @@ func decode(r io.Reader) (Payload, error) {
 	case StringType:
 		// Create a new String instance
 		payload = new(String)
+	case ControlType:
+		// Create a new Control instance
+		payload = new(Control)
 	default:
 		return nil, errors.New("unkown type")
 	}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 	"net"
 	"reflect"
 	"testing"
@@ -15,10 +16,7 @@ func TestPayloads(t *testing.T) {
 	s1 := String("Errors are values.")
 	payloads := []Payload{&b1, &s1, &b2}
 
-	listener, err := net.Listen("tcp", "127.0.0.1")
-	if err != nil {
-		t.Fatal(err)
-	}
+	listener := testListener(t)
 
 	go func() {
 		conn, err := listener.Accept()
@@ -76,3 +74,138 @@ func TestPayloadSize(t *testing.T) {
 		t.Fatalf("expected ErrMaxPayloadSize; actual: %v", err)
 	}
 }
+
+// BenchmarkTLVEncode writes a 4 KB Binary payload, type and length
+// included
+func BenchmarkTLVEncode(b *testing.B) {
+	payload := Binary(make([]byte, 4<<10))
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := payload.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTLVDecode reads the same payload back through decode
+func BenchmarkTLVDecode(b *testing.B) {
+	payload := Binary(make([]byte, 4<<10))
+	encoded := new(bytes.Buffer)
+	if _, err := payload.WriteTo(encoded); err != nil {
+		b.Fatal(err)
+	}
+	r := bytes.NewReader(encoded.Bytes())
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(encoded.Bytes())
+		if _, err := decode(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestPayloadEncoding checks the frames byte for byte, as written
+// through net.Buffers
+func TestPayloadEncoding(t *testing.T) {
+	for _, c := range []struct {
+		payload  io.WriterTo
+		expected []byte
+	}{
+		{Binary("hi"), []byte{BinaryType, 0, 0, 0, 2, 'h', 'i'}},
+		{String("go"), []byte{StringType, 0, 0, 0, 2, 'g', 'o'}},
+		{Binary(nil), []byte{BinaryType, 0, 0, 0, 0}},
+		{Control("ping"), []byte{ControlType, 0, 0, 0, 4, 'p', 'i', 'n', 'g'}},
+	} {
+		buf := new(bytes.Buffer)
+		n, err := c.payload.WriteTo(buf)
+		if err != nil || n != int64(len(c.expected)) || !bytes.Equal(buf.Bytes(), c.expected) {
+			t.Errorf("%#v: expected %v; actual: %v (%d, %v)", c.payload, c.expected, buf.Bytes(), n, err)
+		}
+	}
+
+	// Nothing of a payload the peer would refuse goes out
+	buf := new(bytes.Buffer)
+	if n, err := Binary(make([]byte, MaxPayloadSize+1)).WriteTo(buf); err != ErrMaxPayloadSize || n != 0 || buf.Len() != 0 {
+		t.Errorf("expected ErrMaxPayloadSize and nothing written; actual: %d, %v", n, err)
+	}
+}
+
+// writeTLVSeparate is the encoding as it was before writeTLV: type,
+// length and payload in three writes
+func writeTLVSeparate(w io.Writer, typ uint8, payload []byte) error {
+	if err := binary.Write(w, binary.BigEndian, typ); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(payload))); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+
+	return err
+}
+
+// benchTLVRoundTrip sends a 64-byte Binary frame with write over a
+// TCP_NODELAY loopback connection and waits for the server to echo it
+// back, the same way, per iteration
+func benchTLVRoundTrip(b *testing.B, write func(w io.Writer, payload []byte) error) {
+	listener := testListener(b)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			payload, err := decode(conn)
+			if err != nil {
+				return
+			}
+			if err := write(conn, payload.Bytes()); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	// Go's default, but the point of the benchmark: every write is a
+	// packet
+	if err := conn.(*net.TCPConn).SetNoDelay(true); err != nil {
+		b.Fatal(err)
+	}
+
+	payload := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := write(conn, payload); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := decode(conn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTLVRoundTrip writes the frames with writeTLV, one writev each
+func BenchmarkTLVRoundTrip(b *testing.B) {
+	benchTLVRoundTrip(b, func(w io.Writer, payload []byte) error {
+		_, err := Binary(payload).WriteTo(w)
+		return err
+	})
+}
+
+// BenchmarkTLVRoundTripSeparate writes them in three writes
+func BenchmarkTLVRoundTripSeparate(b *testing.B) {
+	benchTLVRoundTrip(b, func(w io.Writer, payload []byte) error {
+		return writeTLVSeparate(w, BinaryType, payload)
+	})
+}
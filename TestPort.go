@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Loopback ports for tests
+//
+// Binding "127.0.0.1:0" lets the kernel pick a free port, which is the
+// right start, but tests kept getting the rest wrong:
+//
+// - a listener left open when t.Fatal skips the deferred Close leaks
+//   into the next test, or keeps a port busy until the process exits
+// - a test wanting the same port for TCP and UDP (DNS, iperf) asks
+//   for a TCP port and assumes the UDP one is free too; usually it is
+// - a test wanting a port where nobody listens closes a listener and
+//   hopes nobody else binds the port before it dials
+// - a test restarting a server on the same address closes the listener
+//   and binds again right away, failing if the port is still busy
+//
+// These helpers bind and close through t.Cleanup, retry when a paired
+// port turns out to be taken, and keep track of the addresses they hand
+// out, so a port reserved as "unused" is never handed to another test
+// of the same run.
+
+// testPortAttempts bounds the retries for a busy paired port
+const testPortAttempts = 10
+
+// testRelistenTimeout bounds the wait for a port to free up again
+const testRelistenTimeout = 2 * time.Second
+
+// testPorts are the addresses handed out by the helpers, by test name
+var testPorts = struct {
+	sync.Mutex
+	owners map[string]string
+}{owners: make(map[string]string)}
+
+// claimTestPort records addr for t, refusing addresses already held;
+// the claim is released when t ends
+func claimTestPort(t testing.TB, addr net.Addr) bool {
+	key := addr.Network() + " " + addr.String()
+
+	testPorts.Lock()
+	defer testPorts.Unlock()
+	if _, ok := testPorts.owners[key]; ok {
+		return false
+	}
+	testPorts.owners[key] = t.Name()
+
+	t.Cleanup(func() {
+		testPorts.Lock()
+		delete(testPorts.owners, key)
+		testPorts.Unlock()
+	})
+
+	return true
+}
+
+// testListener returns a TCP listener on a free loopback port, closed
+// when the test ends
+func testListener(t testing.TB) net.Listener {
+	t.Helper()
+
+	for i := 0; i < testPortAttempts; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimTestPort(t, l.Addr()) {
+			t.Cleanup(func() { _ = l.Close() })
+			return l
+		}
+		// A port reserved elsewhere as unused; try another one
+		_ = l.Close()
+	}
+	t.Fatal("testport: no free TCP port")
+
+	return nil
+}
+
+// testPacketConn returns a UDP socket on a free loopback port, closed
+// when the test ends
+func testPacketConn(t testing.TB) net.PacketConn {
+	t.Helper()
+
+	for i := 0; i < testPortAttempts; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimTestPort(t, pc.LocalAddr()) {
+			t.Cleanup(func() { _ = pc.Close() })
+			return pc
+		}
+		_ = pc.Close()
+	}
+	t.Fatal("testport: no free UDP port")
+
+	return nil
+}
+
+// testListenerPair returns a TCP listener and a UDP socket on the same
+// free loopback port, both closed when the test ends
+func testListenerPair(t testing.TB) (net.Listener, net.PacketConn) {
+	t.Helper()
+
+	for i := 0; i < testPortAttempts; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", pc.LocalAddr().String())
+		if errors.Is(err, syscall.EADDRINUSE) {
+			// Taken for TCP; try another port
+			_ = pc.Close()
+			continue
+		}
+		if err != nil {
+			_ = pc.Close()
+			t.Fatal(err)
+		}
+		if !claimTestPort(t, l.Addr()) || !claimTestPort(t, pc.LocalAddr()) {
+			_ = l.Close()
+			_ = pc.Close()
+			continue
+		}
+
+		t.Cleanup(func() {
+			_ = l.Close()
+			_ = pc.Close()
+		})
+		return l, pc
+	}
+	t.Fatal("testport: no port free for both TCP and UDP")
+
+	return nil, nil
+}
+
+// testUnusedAddr returns a loopback TCP address nobody listens on, kept
+// from the other helpers until the test ends
+func testUnusedAddr(t testing.TB) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr()
+	_ = l.Close()
+	claimTestPort(t, addr)
+
+	return addr.String()
+}
+
+// testRelisten binds addr again, for a server restarting on the address
+// of a listener it closed, closed when the test ends. The address should
+// come from testListener, whose claim keeps the other helpers off it;
+// testRelisten retries while the old socket is still going away.
+func testRelisten(t testing.TB, addr string) net.Listener {
+	t.Helper()
+
+	for deadline := time.Now().Add(testRelistenTimeout); ; time.Sleep(10 * time.Millisecond) {
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			t.Cleanup(func() { _ = l.Close() })
+			return l
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTestPort(t *testing.T) {
+	var closed []net.Addr
+	t.Run("allocate", func(t *testing.T) {
+		l := testListener(t)
+		if pc := testPacketConn(t); !pc.LocalAddr().(*net.UDPAddr).IP.IsLoopback() {
+			t.Errorf("expected a loopback address; actual: %s", pc.LocalAddr())
+		}
+		pl, ppc := testListenerPair(t)
+		if pl.Addr().String() != ppc.LocalAddr().String() {
+			t.Errorf("expected the same port; actual: %s, %s", pl.Addr(), ppc.LocalAddr())
+		}
+
+		// An unused address is never handed out again in this test
+		unused := testUnusedAddr(t)
+		for i := 0; i < 20; i++ {
+			if addr := testListener(t).Addr().String(); addr == unused {
+				t.Fatalf("%s was reserved as unused", addr)
+			}
+		}
+		if _, err := net.Dial("tcp", unused); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("expected ECONNREFUSED; actual: %v", err)
+		}
+
+		// A closed listener's address can be bound again
+		relisten := testListener(t)
+		_ = relisten.Close()
+		if again := testRelisten(t, relisten.Addr().String()); again.Addr().String() != relisten.Addr().String() {
+			t.Errorf("expected %s; actual: %s", relisten.Addr(), again.Addr())
+		}
+
+		closed = []net.Addr{l.Addr(), pl.Addr(), relisten.Addr()}
+	})
+
+	// The subtest's cleanup closed its listeners and released the claims
+	for _, addr := range closed {
+		if _, err := net.Dial("tcp", addr.String()); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("%s: expected ECONNREFUSED after cleanup; actual: %v", addr, err)
+		}
+	}
+	testPorts.Lock()
+	defer testPorts.Unlock()
+	for key, owner := range testPorts.owners {
+		if owner == t.Name()+"/allocate" {
+			t.Errorf("%s still claimed", key)
+		}
+	}
+}
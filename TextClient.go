@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Simple text protocol client
+//
+// A whole family of old protocols (WHOIS, finger, daytime, QOTD) works
+// the same way: connect, send one line, and read the answer until the
+// server closes the connection. Closing is how the server says "done",
+// there is no length or terminator.
+//
+// That's fragile in practice. A server (or a middlebox in between) may
+// never send its FIN, and a plain io.ReadAll then waits forever. The
+// client applies the pattern from DeadlineConnection.go instead:
+//
+// - the first byte may take up to Timeout to arrive
+// - after that, every read pushes the deadline IdleTimeout forward; a
+//   server that has sent data and then goes quiet for IdleTimeout is
+//   assumed to be done
+// - the whole exchange never takes longer than Timeout
+//
+// Attempts that fail before any data arrived (connection refused, no
+// answer at all) are retried according to Retry.
+
+// Default TextClient values
+const (
+	defaultTextTimeout     = 10 * time.Second
+	defaultTextIdleTimeout = 2 * time.Second
+	defaultTextMaxResponse = 1 << 20
+)
+
+// ErrResponseTooLarge is returned when a response exceeds MaxResponse
+var ErrResponseTooLarge = errLimit("response too large")
+
+// TextClient sends a line and reads the response until EOF
+type TextClient struct {
+	Timeout     time.Duration // Whole exchange (defaults to 10s)
+	IdleTimeout time.Duration // Silence that ends the response (defaults to 2s)
+	MaxResponse int           // Bytes (defaults to 1MB)
+	Retry       RetryPolicy
+	Dialer      *net.Dialer
+}
+
+// Query sends line (CRLF terminated) to the TCP server at address and
+// returns everything it sends back. When the response ends because the
+// server went idle rather than closing the connection, the data is
+// returned without an error.
+func (c *TextClient) Query(ctx context.Context, address, line string) ([]byte, error) {
+	var resp []byte
+	err := c.Retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		resp, err = c.query(ctx, address, line)
+		if err != nil && len(resp) > 0 {
+			// Partial data: retrying would send the query again to a
+			// server that already answered
+			return Permanent(err)
+		}
+		return err
+	})
+
+	return resp, err
+}
+
+// query runs a single attempt
+func (c *TextClient) query(ctx context.Context, address, line string) ([]byte, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTextTimeout
+	}
+	idle := c.IdleTimeout
+	if idle <= 0 {
+		idle = defaultTextIdleTimeout
+	}
+	maxResponse := c.MaxResponse
+	if maxResponse <= 0 {
+		maxResponse = defaultTextMaxResponse
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = new(net.Dialer)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Cancellation interrupts a blocked Read
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	_ = conn.SetDeadline(deadline)
+	if _, err := io.WriteString(conn, line+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	resp := new(bytes.Buffer)
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		resp.Write(buf[:n])
+
+		if resp.Len() > maxResponse {
+			return resp.Bytes()[:maxResponse], ErrResponseTooLarge
+		}
+		if n > 0 {
+			// Data is flowing: allow IdleTimeout for the next chunk,
+			// but never beyond the overall deadline
+			next := time.Now().Add(idle)
+			if next.After(deadline) {
+				next = deadline
+			}
+			_ = conn.SetReadDeadline(next)
+		}
+
+		switch {
+		case err == nil:
+			continue
+		case err == io.EOF:
+			return resp.Bytes(), nil
+		case IsTimeout(err) && resp.Len() > 0 && ctx.Err() == nil:
+			// The server went quiet without closing: treat as done
+			return resp.Bytes(), nil
+		case ctx.Err() != nil && !IsTimeout(err):
+			return resp.Bytes(), ctx.Err()
+		default:
+			return resp.Bytes(), err
+		}
+	}
+}
+
+// WHOIS (RFC 3912)
+//
+// WHOIS is the canonical example: send the query to port 43, read the
+// text back. The registry that knows about a domain isn't the same for
+// every TLD, so whois.iana.org answers with a "refer:" line naming the
+// server to ask next. WhoisClient follows those referrals.
+
+// whoisPort is the WHOIS TCP port
+const whoisPort = "43"
+
+// WhoisClient looks up domains, IPs and AS numbers
+type WhoisClient struct {
+	TextClient
+
+	// Server is the first server to ask (defaults to whois.iana.org)
+	Server string
+
+	// MaxReferrals limits how many referrals are followed (0 follows none)
+	MaxReferrals int
+}
+
+// Lookup queries the WHOIS servers for query and returns the response
+// of the last one asked
+func (c *WhoisClient) Lookup(ctx context.Context, query string) (string, error) {
+	server := c.Server
+	if server == "" {
+		server = "whois.iana.org"
+	}
+
+	for hops := 0; ; hops++ {
+		resp, err := c.Query(ctx, whoisAddress(server), query)
+		if err != nil {
+			return string(resp), fmt.Errorf("whois %s: %w", server, err)
+		}
+
+		next := WhoisReferral(string(resp))
+		if next == "" || next == server || hops >= c.MaxReferrals {
+			return string(resp), nil
+		}
+		server = next
+	}
+}
+
+// whoisAddress adds the WHOIS port to server unless it has one
+func whoisAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+
+	return net.JoinHostPort(server, whoisPort)
+}
+
+// WhoisReferral returns the server a WHOIS response refers to, if any.
+// IANA uses "refer:", registries use "Registrar WHOIS Server:" or "whois:".
+func WhoisReferral(resp string) string {
+	s := bufio.NewScanner(strings.NewReader(resp))
+	for s.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(s.Text()), ":")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "refer", "whois", "registrar whois server":
+			if v := strings.TrimSpace(value); v != "" {
+				return strings.TrimPrefix(v, "whois://")
+			}
+		}
+	}
+
+	return ""
+}
+
+// whoisMain implements the "whois" command:
+//
+//	golearn whois [-h server] [-r referrals] query
+func whoisMain(args []string) error {
+	fs := flag.NewFlagSet("whois", flag.ContinueOnError)
+	server := fs.String("h", "whois.iana.org", "`server` to ask first")
+	referrals := fs.Int("r", 3, "referrals to follow")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: whois [flags] query")
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	c := &WhoisClient{Server: *server, MaxReferrals: *referrals}
+	resp, err := c.Lookup(ctx, fs.Arg(0))
+	fmt.Print(resp)
+
+	return err
+}
+
+// textServer answers every line with respond(line) and then, when hang
+// is true, keeps the connection open instead of closing it
+func textServer(t *testing.T, hang bool, respond func(line string) string) string {
+	t.Helper()
+
+	l := testListener(t)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				_, _ = io.WriteString(conn, respond(strings.TrimSpace(line)))
+				if hang {
+					// Never send FIN, wait for the client to give up
+					_, _ = io.Copy(io.Discard, conn)
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestTextClient(t *testing.T) {
+	respond := func(line string) string { return "you said: " + line + "\n" }
+
+	for _, hang := range []bool{false, true} {
+		addr := textServer(t, hang, respond)
+		c := &TextClient{Timeout: time.Second, IdleTimeout: 50 * time.Millisecond}
+
+		begin := time.Now()
+		resp, err := c.Query(context.Background(), addr, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp) != "you said: hello\n" {
+			t.Errorf("hang=%t: unexpected response %q", hang, resp)
+		}
+
+		// A server that never closes costs us IdleTimeout, not Timeout
+		if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+			t.Errorf("hang=%t: query took %s", hang, elapsed)
+		}
+	}
+}
+
+func TestTextClientSilentServer(t *testing.T) {
+	// Accepts, reads, never answers
+	addr := textServer(t, true, func(string) string { return "" })
+
+	c := &TextClient{Timeout: 100 * time.Millisecond, Retry: RetryPolicy{Attempts: 2, Initial: time.Millisecond}}
+	_, err := c.Query(context.Background(), addr, "anyone?")
+	if !IsTimeout(err) && !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected timeout; actual: %v", err)
+	}
+}
+
+func TestWhoisReferral(t *testing.T) {
+	registry := textServer(t, false, func(q string) string {
+		return "Domain Name: " + strings.ToUpper(q) + "\nRegistrar: Example Registrar\n"
+	})
+	iana := textServer(t, true, func(q string) string {
+		return "% IANA WHOIS server\n\nrefer:        " + registry + "\n\ndomain:       COM\n"
+	})
+
+	c := &WhoisClient{
+		TextClient:   TextClient{Timeout: time.Second, IdleTimeout: 50 * time.Millisecond},
+		Server:       iana,
+		MaxReferrals: 3,
+	}
+	resp, err := c.Lookup(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resp, "Domain Name: EXAMPLE.COM") {
+		t.Errorf("expected the registry's answer; actual: %q", resp)
+	}
+}
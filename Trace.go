@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Tracing hooks
+//
+// Metrics say how many dials failed; a trace says which one, how long
+// it took and what it was part of. A single request to a proxied
+// backend may involve a retried dial through a CONNECT proxy, each step
+// a span in the trace:
+//
+//	retry.attempt (op=backend, attempt=1)    error: connection reset
+//	retry.attempt (op=backend, attempt=2)
+//	  connect.dial (proxy=..., target=...)
+//	    connect_proxy.tunnel (target=..., result=ok)   (proxy side)
+//
+// OpenTelemetry is the usual way to collect them, but it's a large
+// dependency for a few hooks. The code here only knows a two-method
+// Tracer interface; an adapter to an otel trace.Tracer (or anything
+// else) is a few lines, and without one nothing is traced at all.
+//
+// Components that already take a Metrics field take a Tracer field too.
+// Free functions like DialConnect have no struct to hang it on, so the
+// tracer can also travel in the context (WithTracer), which is how the
+// spans of a dial end up as children of the retry attempt around it.
+//
+// There are no TFTP transfers to trace yet: TFTP.go only has the packet
+// types.
+
+// Tracer starts spans. The returned context carries the span, so spans
+// started from it become its children.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...TraceAttr) (context.Context, Span)
+}
+
+// Span is an operation in progress
+type Span interface {
+	// SetAttrs adds attributes learned along the way
+	SetAttrs(attrs ...TraceAttr)
+
+	// End finishes the span, marking it failed when err isn't nil
+	End(err error)
+}
+
+// TraceAttr is a span attribute
+type TraceAttr struct {
+	Key   string
+	Value any
+}
+
+// Attr returns a TraceAttr
+func Attr(key string, value any) TraceAttr {
+	return TraceAttr{Key: key, Value: value}
+}
+
+type tracerKey struct{}
+
+// WithTracer returns a context whose operations are traced by t
+func WithTracer(ctx context.Context, t Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// TracerFrom returns the context's tracer, or nil
+func TracerFrom(ctx context.Context) Tracer {
+	t, _ := ctx.Value(tracerKey{}).(Tracer)
+	return t
+}
+
+// noopSpan is the Span of untraced operations
+type noopSpan struct{}
+
+func (noopSpan) SetAttrs(...TraceAttr) {}
+func (noopSpan) End(error)             {}
+
+// startSpan starts a span with t, falling back to the context's tracer.
+// Without either it returns ctx and a span that does nothing.
+func startSpan(ctx context.Context, t Tracer, name string, attrs ...TraceAttr) (context.Context, Span) {
+	if t == nil {
+		t = TracerFrom(ctx)
+	}
+	if t == nil {
+		return ctx, noopSpan{}
+	}
+
+	return t.Start(ctx, name, attrs...)
+}
+
+// recordedSpan is a span kept by recordingTracer
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]any
+	err    error
+	ended  bool
+}
+
+// recordingTracer keeps every span, for tests
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpanKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...TraceAttr) (context.Context, Span) {
+	parent, _ := ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	s := &recordedSpan{name: name, parent: parent, attrs: make(map[string]any)}
+
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+
+	span := recordingSpan{t, s}
+	span.SetAttrs(attrs...)
+
+	return context.WithValue(ctx, recordedSpanKey{}, s), span
+}
+
+// find returns the first span called name
+func (t *recordingTracer) find(name string) *recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, s := range t.spans {
+		if s.name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+type recordingSpan struct {
+	t *recordingTracer
+	s *recordedSpan
+}
+
+func (s recordingSpan) SetAttrs(attrs ...TraceAttr) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	for _, a := range attrs {
+		s.s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s recordingSpan) End(err error) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	s.s.err, s.s.ended = err, true
+}
+
+func TestTrace(t *testing.T) {
+	// An echo server reached through a CONNECT proxy
+	l := testListener(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	proxyTracer := new(recordingTracer)
+	proxy := startConnectProxy(t, &ConnectProxy{
+		Allow:  func(string) bool { return true },
+		Tracer: proxyTracer,
+	})
+
+	tracer := new(recordingTracer)
+	ctx, cancel := context.WithTimeout(WithTracer(context.Background(), tracer), 2*time.Second)
+	defer cancel()
+
+	// The first attempt fails before dialing, the second dials
+	var conn net.Conn
+	attempts := 0
+	p := RetryPolicy{Attempts: 2, Initial: time.Millisecond, Name: "backend"}
+	err := p.Do(ctx, func(ctx context.Context) error {
+		if attempts++; attempts == 1 {
+			return syscall.ECONNRESET
+		}
+		var err error
+		conn, err = DialConnect(ctx, "http://"+proxy, l.Addr().String())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("ping"))
+	if b, err := ReadExactly(conn, 4); err != nil || string(b) != "ping" {
+		t.Fatalf("unexpected echo %q, %v", b, err)
+	}
+	_ = conn.Close()
+
+	tracer.mu.Lock()
+	spans := tracer.spans
+	tracer.mu.Unlock()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans; actual: %d", len(spans))
+	}
+	first, second, dial := spans[0], spans[1], spans[2]
+	if first.name != "retry.attempt" || first.attrs["attempt"] != 1 || !errors.Is(first.err, syscall.ECONNRESET) {
+		t.Errorf("unexpected first attempt %+v", first)
+	}
+	if second.name != "retry.attempt" || second.attrs["op"] != "backend" || second.err != nil || !second.ended {
+		t.Errorf("unexpected second attempt %+v", second)
+	}
+	if dial.name != "connect.dial" || dial.parent != second || dial.attrs["target"] != l.Addr().String() || !dial.ended {
+		t.Errorf("unexpected dial span %+v", dial)
+	}
+
+	// The proxy ends its span once both directions are done
+	deadline := time.Now().Add(time.Second)
+	for {
+		s := proxyTracer.find("connect_proxy.tunnel")
+		proxyTracer.mu.Lock()
+		ended := s != nil && s.ended
+		proxyTracer.mu.Unlock()
+		if ended {
+			if s.attrs["result"] != "ok" || s.attrs["target"] != l.Addr().String() {
+				t.Errorf("unexpected tunnel span %+v", s)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel span never ended")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
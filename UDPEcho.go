@@ -22,47 +22,86 @@ import (
 // - net.Addr: the actual address the server is bound to (useful if addr was ":0").
 // - error: if binding fails, returns a wrapped error; otherwise, returns nil.
 func echoServerUDP(ctx context.Context, addr string) (net.Addr, error) {
+	return echoServerUDPWithCounter(ctx, addr, nil)
+}
+
+// echoServerUDPWithCounter works like echoServerUDP and reports every
+// received datagram as Inbound and every echoed one as Outbound to
+// counter. A nil counter disables accounting.
+func echoServerUDPWithCounter(ctx context.Context, addr string, counter Counter) (net.Addr, error) {
+	s, err := ListenUDPEcho(ctx, addr, counter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Return the actual address we're bound to (useful when using ":0")
+	return s.Addr(), nil
+}
+
+// UDPEchoServer is the echo loop behind echoServerUDP, for callers that
+// need to know when it's over: Shutdown closes the socket and waits for
+// the loop to return.
+type UDPEchoServer struct {
+	pc      net.PacketConn
+	counter Counter
+	loops   *LoopGroup
+}
+
+// ListenUDPEcho binds addr and echoes datagrams until ctx is done or
+// Shutdown is called
+func ListenUDPEcho(ctx context.Context, addr string, counter Counter) (*UDPEchoServer, error) {
 	// Try to bind to the given UDP address (e.g., ":0" for any available port)
-	s, err := net.ListenPacket("udp", addr)
+	pc, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		// If binding fails, return a formatted error
 		return nil, fmt.Errorf("binding to udp %s: %w", addr, err)
 	}
 
-	// Start the server logic in a separate goroutine to avoid blocking the caller
-	go func() {
-		// Start another goroutine whose only job is to watch for context cancellation
-		// and close the UDP socket when it's done.
-		// This ensures the server exits cleanly when the parent context is canceled.
-		go func() {
-			// Wait for cancellation signal
-			<-ctx.Done()
-			// Close the socket to unblock ReadFrom/WriteTo
-			_ = s.Close()
-		}()
-
-		// Allocate a fixed-size buffer to read incoming UDP datagrams
-		buf := make([]byte, 1024)
-
-		for {
-			// Block and wait for the next incoming UDP packet
-			n, clientAddr, err := s.ReadFrom(buf)
-			if err != nil {
-				// Exit the loop on error (likely caused by socket closure)
-				return
-			}
-
-			// Echo the received data back to the client using the same connection
-			_, err = s.WriteTo(buf[:n], clientAddr)
-			if err != nil {
-				// If writing fails (e.g., network error), exit the loop
-				return
-			}
+	s := &UDPEchoServer{pc: pc, counter: counter, loops: NewLoopGroup(ctx)}
+	s.loops.Go(s.serve)
+
+	return s, nil
+}
+
+// Addr returns the address the server is bound to
+func (s *UDPEchoServer) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// serve echoes datagrams until ctx is done or the socket fails
+func (s *UDPEchoServer) serve(ctx context.Context) {
+	// Closing the socket is the only way to unblock ReadFrom/WriteTo,
+	// so do it as soon as ctx is done
+	stop := context.AfterFunc(ctx, func() { _ = s.pc.Close() })
+	defer stop()
+	defer s.pc.Close()
+
+	// Allocate a fixed-size buffer to read incoming UDP datagrams
+	buf := make([]byte, 1024)
+
+	for {
+		// Block and wait for the next incoming UDP packet
+		n, clientAddr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			// Exit the loop on error (likely caused by socket closure)
+			return
 		}
-	}()
+		count(s.counter, Inbound, n)
 
-	// Return the actual address we're bound to (useful when using ":0")
-	return s.LocalAddr(), err
+		// Echo the received data back to the client using the same connection
+		_, err = s.pc.WriteTo(buf[:n], clientAddr)
+		if err != nil {
+			// If writing fails (e.g., network error), exit the loop
+			return
+		}
+		count(s.counter, Outbound, n)
+	}
+}
+
+// Shutdown stops the server and waits for its loop to return, giving
+// up when ctx is done
+func (s *UDPEchoServer) Shutdown(ctx context.Context) error {
+	return s.loops.Shutdown(ctx)
 }
 
 // Properly verifies that the echo server properly receives and replies to a UDP packet
@@ -80,12 +119,7 @@ func TestEchoServerUDP(t *testing.T) {
 	defer cancel()
 
 	// Open a UDP client socket at an available port
-	client, err := net.ListenPacket("udp", "127.0.0.1:")
-	if err != nil {
-		t.Fatal(err)
-	}
-	// Close the client socket when the test completes
-	defer func() { _ = client.Close() }()
+	client := testPacketConn(t)
 
 	// Message to send to the server
 	msg := []byte("ping")
@@ -132,18 +166,11 @@ func TestListenPacketUDP(t *testing.T) {
 
 	// Create the client that will receive the message from
 	// the echo server
-	client, err := net.ListenPacket("udp", "127.0.0.1:")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer func() { _ = client.Close() }()
+	client := testPacketConn(t)
 
 	// Create an "interloper" UDP socket — a second, unrelated sender
 	// that will send a fake message directly to the client.
-	interloper, err := net.ListenPacket("udp", "127.0.0.1:")
-	if err != nil {
-		t.Fatal(err)
-	}
+	interloper := testPacketConn(t)
 
 	// The interloper prepares a message to send to the client
 	interrupt := []byte("pardon me")
@@ -215,7 +242,7 @@ func TestDialUDP(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Start the UDP echo server on 127.0.0.1 with an ephemeral port (":0")
-	serverAddr, err := echoServerUDP(ctx, "127.0.0.1")
+	serverAddr, err := echoServerUDP(ctx, "127.0.0.1:")
 	if err != nil {
 		t.Fatal(err) // Fail the test if the server fails to start
 	}
@@ -229,10 +256,7 @@ func TestDialUDP(t *testing.T) {
 	defer func() { _ = client.Close() }() // Ensure client connection is closed at the end
 
 	// Create a separate UDP listener (interloper) to send a spoofed packet to the client
-	interloper, err := net.ListenPacket("udp", "127.0.0.1")
-	if err != nil {
-		t.Fatal(err) // Fail if we can't create the interloper socket
-	}
+	interloper := testPacketConn(t)
 
 	// Send a fake, unsolicited UDP packet to the client (not part of the ping/echo exchange)
 	interrupt := []byte("pardon me")
@@ -278,3 +302,56 @@ func TestDialUDP(t *testing.T) {
 		t.Fatal("unexpected packet") // Fail if something is unexpectedly received
 	}
 }
+
+func TestUDPEchoServerShutdown(t *testing.T) {
+	s, err := ListenUDPEcho(context.Background(), "127.0.0.1:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("loop didn't return: %v", err)
+	}
+
+	// The port is free again once Shutdown returns
+	pc, err := net.ListenPacket("udp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("socket still bound after shutdown: %v", err)
+	}
+	_ = pc.Close()
+}
+
+// BenchmarkEchoServerUDP bounces 64 byte datagrams off the echo server
+// one at a time, and reports how many came back per second
+func BenchmarkEchoServerUDP(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr, err := echoServerUDP(ctx, "127.0.0.1:")
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, err := net.Dial("udp", addr.String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	msg, buf := make([]byte, 64), make([]byte, 64)
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		// Loopback doesn't drop, but a lost datagram mustn't hang
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := client.Read(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "packets/s")
+}
@@ -0,0 +1,815 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// UPnP port mapping
+//
+// Behind a home router, a server is reachable from the LAN only: the
+// router's NAT maps outgoing connections, but has no idea where to send
+// incoming ones. Most routers can be told, by the hosts behind them,
+// through UPnP's Internet Gateway Device (IGD) protocol. That takes two
+// steps.
+//
+// Discovery is SSDP: an HTTP request over UDP, multicast to
+// 239.255.255.250:1900, asking who is an InternetGatewayDevice,
+//
+//	M-SEARCH * HTTP/1.1
+//	HOST: 239.255.255.250:1900
+//	MAN: "ssdp:discover"
+//	MX: 2
+//	ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1
+//
+// and the router answers, unicast, with an HTTP response whose LOCATION
+// header is the URL of an XML description of the device: devices within
+// devices, each with its services, one of which is WANIPConnection (or
+// WANPPPConnection, on a DSL modem) and its control URL.
+//
+// Control is SOAP: an HTTP POST to that URL, the action in a SOAPAction
+// header and an XML envelope around its arguments. AddPortMapping asks
+// the router to forward a port of its external address to a port of a
+// host on the LAN, for a lease duration; DeletePortMapping undoes it;
+// GetExternalIPAddress tells what the world sees. A refusal comes back
+// as a SOAP fault carrying a UPnP error code, as a UPnPError.
+//
+// PortForward keeps a listener's port forwarded for as long as it
+// runs, renewing the lease, and is a Service to run next to it. A
+// listener of "golearn serve" gets one with "upnp: true" (Config.go):
+//
+//	listeners:
+//	  - name: proxy
+//	    kind: connect_proxy
+//	    addr: :8080
+//	    upnp: true
+//
+// UPnP has no authentication: any host on the LAN can open any port of
+// the router, which is why many people turn it off. Routers that do
+// NAT-PMP or PCP instead aren't supported.
+
+const (
+	ssdpAddr = "239.255.255.250:1900"
+	ssdpMX   = 2 // Seconds the devices may wait before answering
+
+	upnpDeviceIGD = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+
+	upnpDefaultLease = time.Hour
+	upnpRetry        = time.Minute // Between the attempts of a PortForward
+	upnpTimeout      = 10 * time.Second
+
+	// UPnP error codes a client can do something about
+	upnpErrNoSuchEntry          = 714
+	upnpErrConflict             = 718
+	upnpErrOnlyPermanentLeases  = 725
+	upnpErrActionNotImplemented = 401
+)
+
+// upnpServices are the services that map ports, by preference
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// ErrNoIGD is returned when no device answered the discovery with a
+// service mapping ports
+var ErrNoIGD = errors.New("upnp: no internet gateway device found")
+
+// UPnPError is a UPnP action refused by the device
+type UPnPError struct {
+	Action      string
+	Code        int
+	Description string
+}
+
+func (e *UPnPError) Error() string {
+	return fmt.Sprintf("upnp: %s: error %d %s", e.Action, e.Code, e.Description)
+}
+
+// IGD is an internet gateway device, a router, that maps ports
+type IGD struct {
+	Location    string // URL of its description
+	ServiceType string // One of upnpServices
+	ControlURL  string
+
+	// LocalIP is this host's address on the router's network, which
+	// ports are mapped to by default
+	LocalIP net.IP
+
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+// DiscoverIGD finds the router of the LAN, waiting up to ssdpMX seconds
+// and a bit for the answers, or until ctx is done
+func DiscoverIGD(ctx context.Context) (*IGD, error) {
+	return discoverIGD(ctx, ssdpAddr)
+}
+
+// discoverIGD sends the M-SEARCH to addr, which the tests point at a
+// server of their own
+func discoverIGD(ctx context.Context, addr string) (*IGD, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: " + strconv.Itoa(ssdpMX) + "\r\n" +
+		"ST: " + upnpDeviceIGD + "\r\n\r\n"
+	// Twice, UDP being UDP
+	for range 2 {
+		if _, err := pc.WriteTo([]byte(search), raddr); err != nil {
+			return nil, err
+		}
+	}
+
+	deadline := time.Now().Add(ssdpMX*time.Second + 500*time.Millisecond)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = pc.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { _ = pc.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	// The first device described with a service mapping ports wins
+	err = ErrNoIGD
+	seen := make(map[string]bool)
+	buf := make([]byte, 2048)
+	for {
+		n, _, readErr := pc.ReadFrom(buf)
+		if readErr != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		resp, parseErr := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if parseErr != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" || seen[location] {
+			continue
+		}
+		seen[location] = true
+
+		igd, describeErr := describeIGD(ctx, location)
+		if describeErr == nil {
+			return igd, nil
+		}
+		err = fmt.Errorf("%w: %s: %v", ErrNoIGD, location, describeErr)
+	}
+}
+
+// upnpDevice is a device of a description, and the devices within it
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// find returns the service of the type in the device or those within
+func (d *upnpDevice) find(serviceType string) (upnpService, bool) {
+	for _, s := range d.Services {
+		if s.ServiceType == serviceType {
+			return s, true
+		}
+	}
+	for i := range d.Devices {
+		if s, ok := d.Devices[i].find(serviceType); ok {
+			return s, true
+		}
+	}
+
+	return upnpService{}, false
+}
+
+// describeIGD fetches the description at location and picks the
+// service mapping ports
+func describeIGD(ctx context.Context, location string) (*IGD, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("description: %s", resp.Status)
+	}
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("description: %w", err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+	for _, serviceType := range upnpServices {
+		s, ok := root.Device.find(serviceType)
+		if !ok {
+			continue
+		}
+		control, err := base.Parse(s.ControlURL)
+		if err != nil {
+			return nil, err
+		}
+		igd := &IGD{Location: location, ServiceType: serviceType, ControlURL: control.String()}
+		if igd.LocalIP, err = localIPTo(control.Host); err != nil {
+			return nil, err
+		}
+		return igd, nil
+	}
+
+	return nil, errors.New("no service mapping ports")
+}
+
+// localIPTo returns the address this host reaches hostport from: a
+// connected UDP socket picks it, without sending anything
+func localIPTo(hostport string) (net.IP, error) {
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "80")
+	}
+	conn, err := net.Dial("udp4", hostport)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// call runs a SOAP action with its arguments, in order, and returns the
+// values of the response by name
+func (g *IGD) call(ctx context.Context, action string, args ...[2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, g.ServiceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		_ = xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.ControlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, g.ServiceType, action))
+
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	values, err := soapValues(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %s: %s: %w", action, resp.Status, err)
+	}
+	if code, ok := values["errorCode"]; ok {
+		n, _ := strconv.Atoi(code)
+		return nil, &UPnPError{Action: action, Code: n, Description: values["errorDescription"]}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp: %s: %s", action, resp.Status)
+	}
+
+	return values, nil
+}
+
+// soapValues returns the text of the elements of an envelope that have
+// no elements inside, by local name: the arguments of an action, the
+// values of its response or the fields of a fault
+func soapValues(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	var name string
+	var text []byte
+
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name, text = t.Name.Local, text[:0]
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			if t.Name.Local == name {
+				values[name] = strings.TrimSpace(string(text))
+			}
+			name = ""
+		}
+	}
+}
+
+// ExternalIP returns the router's address on the internet
+func (g *IGD) ExternalIP(ctx context.Context) (net.IP, error) {
+	values, err := g.call(ctx, "GetExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(values["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, fmt.Errorf("upnp: invalid external IP %q", values["NewExternalIPAddress"])
+	}
+
+	return ip, nil
+}
+
+// PortMapping is a port of the router forwarded to a host on the LAN
+type PortMapping struct {
+	Protocol     string // "TCP" or "UDP"
+	ExternalPort int
+	InternalPort int
+	Client       net.IP // LocalIP when nil
+	Description  string
+	Lease        time.Duration // 0 for as long as the router runs
+}
+
+// AddPortMapping forwards the port, or renews the lease when it is
+// already. A router that only knows permanent mappings, like many
+// IGD:1 ones, gets one.
+func (g *IGD) AddPortMapping(ctx context.Context, m PortMapping) error {
+	client := m.Client
+	if client == nil {
+		client = g.LocalIP
+	}
+	add := func(lease time.Duration) error {
+		_, err := g.call(ctx, "AddPortMapping",
+			[2]string{"NewRemoteHost", ""},
+			[2]string{"NewExternalPort", strconv.Itoa(m.ExternalPort)},
+			[2]string{"NewProtocol", strings.ToUpper(m.Protocol)},
+			[2]string{"NewInternalPort", strconv.Itoa(m.InternalPort)},
+			[2]string{"NewInternalClient", client.String()},
+			[2]string{"NewEnabled", "1"},
+			[2]string{"NewPortMappingDescription", m.Description},
+			[2]string{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		)
+		return err
+	}
+
+	err := add(m.Lease)
+	var upnpErr *UPnPError
+	if m.Lease > 0 && errors.As(err, &upnpErr) && upnpErr.Code == upnpErrOnlyPermanentLeases {
+		err = add(0)
+	}
+
+	return err
+}
+
+// DeletePortMapping stops forwarding the port
+func (g *IGD) DeletePortMapping(ctx context.Context, protocol string, externalPort int) error {
+	_, err := g.call(ctx, "DeletePortMapping",
+		[2]string{"NewRemoteHost", ""},
+		[2]string{"NewExternalPort", strconv.Itoa(externalPort)},
+		[2]string{"NewProtocol", strings.ToUpper(protocol)},
+	)
+
+	return err
+}
+
+// PortForward is a Service keeping the port of a listener forwarded on
+// the router, the same port outside, for as long as it runs. It finds
+// the router, maps the port for Lease, renews it halfway through, and
+// deletes it on the way out. Failures are logged and retried every
+// upnpRetry: a server is no less useful on the LAN without the router.
+type PortForward struct {
+	name        string
+	protocol    string
+	port        int
+	description string
+
+	// Lease is the duration of the mapping, upnpDefaultLease when 0.
+	// A lost server's mapping stays until then.
+	Lease time.Duration
+
+	// ErrorLog gets the mappings and the failures
+	ErrorLog *log.Logger
+
+	// discover finds the router, DiscoverIGD but in the tests
+	discover func(ctx context.Context) (*IGD, error)
+
+	mu       sync.Mutex
+	external string // "ip:port", once mapped
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewPortForward returns a PortForward named name for addr, a
+// *net.TCPAddr or a *net.UDPAddr
+func NewPortForward(name string, addr net.Addr, description string) (*PortForward, error) {
+	f := &PortForward{name: name, description: description, discover: DiscoverIGD,
+		stop: make(chan struct{}), done: make(chan struct{})}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		f.protocol, f.port = "TCP", a.Port
+	case *net.UDPAddr:
+		f.protocol, f.port = "UDP", a.Port
+	default:
+		return nil, fmt.Errorf("upnp: can't forward %s addresses", addr.Network())
+	}
+
+	return f, nil
+}
+
+func (f *PortForward) String() string { return f.name }
+
+// External returns the address forwarded, once it is
+func (f *PortForward) External() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.external
+}
+
+func (f *PortForward) logf(format string, v ...any) {
+	if f.ErrorLog != nil {
+		f.ErrorLog.Printf("%s: "+format, append([]any{f.name}, v...)...)
+	}
+}
+
+// Serve maps the port and keeps it mapped until ctx is done or Shutdown
+// is called
+func (f *PortForward) Serve(ctx context.Context) error {
+	defer close(f.done)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-f.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	lease := f.Lease
+	if lease <= 0 {
+		lease = upnpDefaultLease
+	}
+
+	var igd *IGD
+	for {
+		wait := upnpRetry
+		if err := f.forward(ctx, &igd, lease); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			f.logf("upnp: %v", err)
+			igd = nil // Maybe the router changed: find it again
+		} else {
+			wait = lease / 2
+		}
+		if sleepUntil(ctx, time.Now().Add(wait)) != nil {
+			break
+		}
+	}
+
+	if igd != nil && f.External() != "" {
+		// The server is going away, and its port with it
+		deleteCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), upnpTimeout)
+		defer cancel()
+		if err := igd.DeletePortMapping(deleteCtx, f.protocol, f.port); err != nil {
+			f.logf("upnp: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// forward maps the port, finding the router first when *igd is nil
+func (f *PortForward) forward(ctx context.Context, igd **IGD, lease time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, upnpTimeout)
+	defer cancel()
+
+	if *igd == nil {
+		found, err := f.discover(ctx)
+		if err != nil {
+			return err
+		}
+		*igd = found
+	}
+	err := (*igd).AddPortMapping(ctx, PortMapping{
+		Protocol:     f.protocol,
+		ExternalPort: f.port,
+		InternalPort: f.port,
+		Description:  f.description,
+		Lease:        lease,
+	})
+	if err != nil {
+		return err
+	}
+
+	external := "?"
+	if ip, err := (*igd).ExternalIP(ctx); err == nil {
+		external = ip.String()
+	}
+	external = net.JoinHostPort(external, strconv.Itoa(f.port))
+	f.mu.Lock()
+	mapped := f.external != external
+	f.external = external
+	f.mu.Unlock()
+	if mapped {
+		f.logf("upnp: %s %s forwarded to %s", f.protocol, external, net.JoinHostPort((*igd).LocalIP.String(), strconv.Itoa(f.port)))
+	}
+
+	return nil
+}
+
+// Shutdown stops Serve, which deletes the mapping, waiting for it
+// until ctx is done
+func (f *PortForward) Shutdown(ctx context.Context) error {
+	f.stopOnce.Do(func() { close(f.stop) })
+
+	select {
+	case <-f.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// upnpTestIGD is a router for the tests: an SSDP responder on loopback
+// pointing at an HTTP server with the description and the control URL
+type upnpTestIGD struct {
+	ssdp     net.PacketConn
+	http     *httptest.Server
+	mu       sync.Mutex
+	mappings map[string]string // "TCP 8080" to "client:port lease"
+
+	// permanentOnly refuses leases, like old routers
+	permanentOnly bool
+}
+
+func newUPnPTestIGD(t *testing.T) *upnpTestIGD {
+	t.Helper()
+
+	g := &upnpTestIGD{mappings: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rootDesc.xml", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = io.WriteString(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <serviceList>
+      <service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType><controlURL>/l3f</controlURL></service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/ctl/IPConn</controlURL></service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`)
+	})
+	mux.HandleFunc("POST /ctl/IPConn", g.control)
+	g.http = httptest.NewServer(mux)
+	t.Cleanup(g.http.Close)
+
+	g.ssdp = testPacketConn(t)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := g.ssdp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+			if err != nil || req.Method != "M-SEARCH" || req.Header.Get("St") != upnpDeviceIGD {
+				continue
+			}
+			_, _ = g.ssdp.WriteTo([]byte("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nST: "+upnpDeviceIGD+
+				"\r\nLOCATION: "+g.http.URL+"/rootDesc.xml\r\n\r\n"), addr)
+		}
+	}()
+
+	return g
+}
+
+func (g *upnpTestIGD) mapping(key string) (string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m, ok := g.mappings[key]
+	return m, ok
+}
+
+// control answers the SOAP actions
+func (g *upnpTestIGD) control(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	_, action, _ = strings.Cut(action, "#")
+	args, err := soapValues(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fault := func(code int, description string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+			`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+			`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode>`+
+			`<errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, description)
+	}
+	respond := func(values string) {
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:%sResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%s</u:%sResponse></s:Body></s:Envelope>`,
+			action, values, action)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := args["NewProtocol"] + " " + args["NewExternalPort"]
+	switch action {
+	case "GetExternalIPAddress":
+		respond("<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>")
+	case "AddPortMapping":
+		if g.permanentOnly && args["NewLeaseDuration"] != "0" {
+			fault(upnpErrOnlyPermanentLeases, "OnlyPermanentLeasesSupported")
+			return
+		}
+		client := net.JoinHostPort(args["NewInternalClient"], args["NewInternalPort"])
+		if m, ok := g.mappings[key]; ok && !strings.HasPrefix(m, client+" ") {
+			fault(upnpErrConflict, "ConflictInMappingEntry")
+			return
+		}
+		g.mappings[key] = client + " " + args["NewLeaseDuration"]
+		respond("")
+	case "DeletePortMapping":
+		if _, ok := g.mappings[key]; !ok {
+			fault(upnpErrNoSuchEntry, "NoSuchEntryInArray")
+			return
+		}
+		delete(g.mappings, key)
+		respond("")
+	default:
+		fault(upnpErrActionNotImplemented, "Invalid Action")
+	}
+}
+
+func TestUPnP(t *testing.T) {
+	g := newUPnPTestIGD(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	igd, err := discoverIGD(ctx, g.ssdp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if igd.ControlURL != g.http.URL+"/ctl/IPConn" || igd.ServiceType != upnpServices[1] || !igd.LocalIP.IsLoopback() {
+		t.Errorf("unexpected device %+v", igd)
+	}
+
+	if ip, err := igd.ExternalIP(ctx); err != nil || !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Errorf("expected 203.0.113.7; actual: %v, %v", ip, err)
+	}
+
+	m := PortMapping{Protocol: "tcp", ExternalPort: 8080, InternalPort: 80, Description: "golearn <test>", Lease: time.Hour}
+	if err := igd.AddPortMapping(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if mapping, _ := g.mapping("TCP 8080"); mapping != "127.0.0.1:80 3600" {
+		t.Errorf("unexpected mapping %q", mapping)
+	}
+	// Another host can't take the port
+	m.Client = net.IPv4(192, 0, 2, 9)
+	var upnpErr *UPnPError
+	if err := igd.AddPortMapping(ctx, m); !errors.As(err, &upnpErr) || upnpErr.Code != upnpErrConflict {
+		t.Errorf("expected error %d; actual: %v", upnpErrConflict, err)
+	}
+
+	if err := igd.DeletePortMapping(ctx, "tcp", 8080); err != nil {
+		t.Fatal(err)
+	}
+	if err := igd.DeletePortMapping(ctx, "tcp", 8080); !errors.As(err, &upnpErr) || upnpErr.Code != upnpErrNoSuchEntry {
+		t.Errorf("expected error %d; actual: %v", upnpErrNoSuchEntry, err)
+	}
+
+	// An old router gets a permanent mapping
+	g.mu.Lock()
+	g.permanentOnly = true
+	g.mu.Unlock()
+	m.Client = nil
+	if err := igd.AddPortMapping(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if mapping, _ := g.mapping("TCP 8080"); mapping != "127.0.0.1:80 0" {
+		t.Errorf("unexpected mapping %q", mapping)
+	}
+
+	// Nobody answers
+	pc := testPacketConn(t)
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := discoverIGD(ctx, pc.LocalAddr().String()); !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, ErrNoIGD) {
+		t.Errorf("expected no device; actual: %v", err)
+	}
+}
+
+func TestPortForward(t *testing.T) {
+	g := newUPnPTestIGD(t)
+
+	var logs bytes.Buffer
+	f, err := NewPortForward("proxy", &net.TCPAddr{IP: net.IPv4zero, Port: 8080}, "golearn proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ErrorLog = log.New(&logs, "", 0)
+	f.discover = func(ctx context.Context) (*IGD, error) {
+		return discoverIGD(ctx, g.ssdp.LocalAddr().String())
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- f.Serve(context.Background()) }()
+	for i := 0; f.External() == "" && i < 200; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f.External() != "203.0.113.7:8080" {
+		t.Fatalf("expected 203.0.113.7:8080 forwarded; actual: %q (%s)", f.External(), logs.String())
+	}
+	if mapping, ok := g.mapping("TCP 8080"); !ok || mapping != "127.0.0.1:8080 3600" {
+		t.Errorf("unexpected mapping %q", mapping)
+	}
+
+	if err := f.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.mapping("TCP 8080"); ok {
+		t.Error("expected the mapping deleted")
+	}
+	if !strings.Contains(logs.String(), "proxy: upnp: TCP 203.0.113.7:8080 forwarded to 127.0.0.1:8080") {
+		t.Errorf("unexpected logs %q", logs.String())
+	}
+
+	if _, err := NewPortForward("unix", &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, ""); err == nil {
+		t.Error("expected a unix address to fail")
+	}
+}
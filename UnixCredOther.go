@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCred is only implemented on Linux. BSDs and macOS have
+// LOCAL_PEERCRED/getpeereid with a different layout.
+func peerCred(*net.UnixConn) (PeerCredentials, error) {
+	return PeerCredentials{}, errors.New("peer credentials not supported on this platform")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Unix domain sockets
+//
+// Unix sockets are the "tcp on the same machine" of the networking
+// world: same net.Conn/net.Listener API, no ports, no network stack, and
+// access controlled with ordinary file permissions. They also let the
+// server ask the kernel *who* is connecting (SO_PEERCRED on Linux),
+// which is how daemons like Docker or systemd authorize local clients.
+//
+// ListenUnix adds the bits net.Listen("unix", ...) leaves to you:
+//
+// - A stale socket file from a previous run (the process crashed before
+//   it could clean up) is removed so the bind doesn't fail with
+//   "address already in use". Anything that isn't a socket is left
+//   alone and reported as an error.
+// - The socket file gets the requested permissions.
+// - The file is removed again when the listener is closed.
+// - A name starting with "@" is bound in the Linux abstract namespace:
+//   no file at all, it disappears with the last reference to it.
+
+// ListenUnix listens on the unix socket at path with the given file
+// permissions (ignored for abstract "@name" sockets)
+func ListenUnix(path string, perm fs.FileMode) (net.Listener, error) {
+	abstract := strings.HasPrefix(path, "@")
+	if abstract && runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("abstract unix socket %s: only supported on linux", path)
+	}
+
+	if !abstract {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !abstract {
+		// The file is created with the process umask, tighten or
+		// loosen it to what was asked for
+		if err := os.Chmod(path, perm); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+
+		// net.UnixListener unlinks the file on Close, make that
+		// explicit since the cleanup is part of our contract
+		l.(*net.UnixListener).SetUnlinkOnClose(true)
+	}
+
+	return l, nil
+}
+
+// removeStaleSocket removes a leftover socket file at path
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Never delete something that isn't a socket, path is probably wrong
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+
+	// A socket someone is still listening on isn't stale
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+
+	return os.Remove(path)
+}
+
+// DialUnix connects to the unix socket at path
+func DialUnix(ctx context.Context, path string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", path)
+}
+
+// PeerCredentials identifies the process on the other end of a unix socket
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// PeerCred returns the credentials of the peer of a unix socket
+// connection. It is implemented on Linux (SO_PEERCRED) and returns an
+// error elsewhere.
+func PeerCred(conn net.Conn) (PeerCredentials, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return PeerCredentials{}, fmt.Errorf("peer credentials: %T is not a unix socket", conn)
+	}
+
+	return peerCred(uc)
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.sock")
+
+	// A stale socket file left behind by a "crashed" server
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	listener, err := ListenUnix(path, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("expected permissions 0600; actual: %o", perm)
+	}
+
+	creds := make(chan PeerCredentials, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		if c, err := PeerCred(conn); err == nil {
+			creds <- c
+		} else {
+			t.Log(err)
+			close(creds)
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := DialUnix(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ReadExactly(conn, 4); err != nil || string(b) != "ping" {
+		t.Fatalf("expected echo; actual: %q, %v", b, err)
+	}
+
+	// The client is this very process
+	if c, ok := <-creds; ok {
+		if int(c.PID) != os.Getpid() || int(c.UID) != os.Getuid() {
+			t.Errorf("unexpected peer credentials: %+v", c)
+		}
+	} else if runtime.GOOS == "linux" {
+		t.Error("expected peer credentials on linux")
+	}
+
+	// Closing the listener removes the socket file
+	_ = listener.Close()
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected socket file to be removed; actual: %v", err)
+	}
+}
+
+func TestUnixSocketNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(path, []byte("important"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A regular file in the way must not be deleted
+	if _, err := ListenUnix(path, 0o600); err == nil {
+		t.Fatal("expected an error for a regular file")
+	}
+	if b, _ := os.ReadFile(path); string(b) != "important" {
+		t.Error("regular file was modified")
+	}
+}
+
+func TestUnixSocketAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract namespace is linux only")
+	}
+
+	name := fmt.Sprintf("@golearn-test-%d", os.Getpid())
+	listener, err := ListenUnix(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := DialUnix(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Upstream connection pool
+//
+// A reverse proxy that dials its upstream for every request pays a TCP
+// handshake (and a TLS one for https upstreams) before each of them,
+// which under load is most of the time spent in the proxy, and leaves
+// thousands of sockets in TIME_WAIT. Keeping connections alive between
+// requests avoids both: after a response is read to its end, its
+// connection is parked, and the next request to the same upstream
+// takes it instead of dialing.
+//
+// UpstreamTransport is the ReverseProxy's default Transport. It speaks
+// HTTP/1.1, reads responses with ReadStrictResponse (see HTTPStrict.go)
+// and keeps, per upstream:
+//
+// - at most MaxIdle parked connections (8 by default); a connection
+//   coming back to a full pool is closed
+// - connections younger than MaxAge (5 minutes), so that a scaled or
+//   rebalanced upstream sees new connections eventually
+//
+// A parked connection may have been closed by the upstream meanwhile,
+// most servers closing idle ones after a minute or so. Before reuse, a
+// probe checks it: a healthy connection has nothing to say, a closed
+// one has EOF waiting. On Linux, the probe peeks at the socket without
+// waiting (MSG_PEEK|MSG_DONTWAIT, see UpstreamPoolLinux.go); over TLS
+// and elsewhere, it reads with a deadline of a millisecond, which is
+// still much less than a handshake. Go fails reads with a deadline
+// already passed before even trying them, so the deadline can't be
+// zero. The check can't catch a close racing with the request, so a
+// request without a body that fails on a reused connection before any
+// response arrives is sent again on a new one.
+//
+// Concurrent dials to the same upstream are coalesced (see
+// DialCoalesce.go): while one is in flight, other requests wait for it
+// rather than pile more handshakes on the upstream. If it fails they all
+// fail; if it works, one of them gets the connection, and the others
+// look for a parked connection again before dialing their own.
+//
+// Warm fills the pool ahead of the first requests: it dials up to n
+// connections to an upstream at once, TLS handshake included for https,
+// and parks the ones that work, so the first requests after a start or
+// a deploy don't all pay for a handshake. ReverseProxy.Warm does it for
+// each of its upstreams, and the serve command keeps /readyz failing
+// until it's done.
+//
+// With Metrics, it counts connections dialed and reused
+// (upstream_pool_conns_total), closed by the pool and why
+// (upstream_pool_closed_total: stale, expired or full), and gauges the
+// parked ones (upstream_pool_idle), all by upstream.
+
+const (
+	defaultUpstreamMaxIdle     = 8
+	defaultUpstreamMaxAge      = 5 * time.Minute
+	defaultUpstreamDialTimeout = 5 * time.Second
+	upstreamProbeTimeout       = time.Millisecond
+)
+
+// DefaultUpstreamTransport is the pool of the ReverseProxies without a
+// Transport
+var DefaultUpstreamTransport = &UpstreamTransport{Metrics: DefaultMetrics}
+
+// UpstreamTransport is an http.RoundTripper keeping connections alive,
+// see above
+type UpstreamTransport struct {
+	// MaxIdle is the number of connections parked per upstream, 8 by
+	// default
+	MaxIdle int
+
+	// MaxAge is how long a connection is reused for, 5 minutes by
+	// default
+	MaxAge time.Duration
+
+	// Dial connects to upstreams, a net.Dialer with a 5 second timeout
+	// within DefaultConnBudget by default
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSConfig is used for https upstreams, with the server name of
+	// the request
+	TLSConfig *tls.Config
+
+	// Metrics, when set, receives the pool statistics
+	Metrics *Metrics
+
+	mu   sync.Mutex
+	idle map[string][]*upstreamConn // By upstream, the newest last
+
+	dials     DialGroup
+	dialsOnce sync.Once
+}
+
+// upstreamConn is a connection to an upstream, with its buffers
+type upstreamConn struct {
+	net.Conn
+	key     string // "scheme://host:port"
+	br      *bufio.Reader
+	bw      *bufio.Writer
+	created time.Time
+}
+
+func (t *UpstreamTransport) maxIdle() int {
+	if t.MaxIdle > 0 {
+		return t.MaxIdle
+	}
+	return defaultUpstreamMaxIdle
+}
+
+func (t *UpstreamTransport) maxAge() time.Duration {
+	if t.MaxAge > 0 {
+		return t.MaxAge
+	}
+	return defaultUpstreamMaxAge
+}
+
+func (t *UpstreamTransport) conns(key, result string) {
+	if t.Metrics != nil {
+		t.Metrics.Counter("upstream_pool_conns_total", "Upstream connections used, by whether they were dialed or reused.", "upstream", "result").With(key, result).Inc()
+	}
+}
+
+func (t *UpstreamTransport) closed(c *upstreamConn, reason string) {
+	_ = c.Close()
+	if t.Metrics != nil {
+		t.Metrics.Counter("upstream_pool_closed_total", "Upstream connections closed by the pool, by reason.", "upstream", "reason").With(c.key, reason).Inc()
+	}
+}
+
+func (t *UpstreamTransport) idleGauge(key string) *Metric {
+	if t.Metrics == nil {
+		return nil
+	}
+	return t.Metrics.Gauge("upstream_pool_idle", "Parked upstream connections.", "upstream").With(key)
+}
+
+// RoundTrip sends req over a parked connection to its upstream, or a
+// new one
+func (t *UpstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		closeRequestBody(req)
+		return nil, fmt.Errorf("upstream: unsupported scheme %q", req.URL.Scheme)
+	}
+	key, _ := upstreamKey(req.URL)
+
+	c, reused := t.get(key)
+	for {
+		if c == nil {
+			var err error
+			if c, reused, err = t.dial(req.Context(), key, req.URL.Hostname()); err != nil {
+				closeRequestBody(req)
+				return nil, err
+			}
+		}
+		resp, sent, err := t.send(c, req)
+		if err == nil {
+			return resp, nil
+		}
+		_ = c.Close()
+
+		// The upstream closed the connection as we took it: nothing was
+		// processed, and a request without a body can go again
+		if !reused || sent || (req.Body != nil && req.Body != http.NoBody) || req.Context().Err() != nil {
+			return nil, err
+		}
+		c, reused = nil, false
+	}
+}
+
+// send writes req on c and reads the response head. sent reports
+// whether any of the response arrived.
+func (t *UpstreamTransport) send(c *upstreamConn, req *http.Request) (resp *http.Response, sent bool, err error) {
+	// Cancelling the request interrupts whatever c is doing
+	stop := context.AfterFunc(req.Context(), func() {
+		_ = c.SetDeadline(time.Unix(1, 0))
+	})
+	defer func() {
+		if err != nil {
+			stop()
+			if ctxErr := req.Context().Err(); ctxErr != nil {
+				err = ctxErr
+			}
+		}
+	}()
+
+	if err := req.Write(c.bw); err != nil {
+		return nil, false, err
+	}
+	if err := c.bw.Flush(); err != nil {
+		return nil, false, err
+	}
+
+	for {
+		if _, err := c.br.Peek(1); err != nil {
+			return nil, false, err
+		}
+		resp, err = ReadStrictResponse(c.br, req, HTTPLimits{})
+		if err != nil {
+			return nil, true, err
+		}
+		// Interim responses precede the real one
+		if resp.StatusCode/100 != 1 || resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The connection is the upgraded protocol's from now on, which
+		// is what httputil.ReverseProxy expects of the body
+		stop()
+		resp.Body = &upgradedBody{c}
+		return resp, true, nil
+	}
+
+	body := &upstreamBody{ReadCloser: resp.Body, t: t, c: c, reuse: !resp.Close && !req.Close, stop: stop}
+	if resp.Body == http.NoBody {
+		body.release(true)
+		return resp, true, nil
+	}
+	resp.Body = body
+
+	return resp, true, nil
+}
+
+// get takes a parked connection to key that is still usable
+func (t *UpstreamTransport) get(key string) (*upstreamConn, bool) {
+	for {
+		t.mu.Lock()
+		conns := t.idle[key]
+		if len(conns) == 0 {
+			t.mu.Unlock()
+			return nil, false
+		}
+		c := conns[len(conns)-1]
+		t.idle[key] = conns[:len(conns)-1]
+		t.mu.Unlock()
+		t.idleGauge(key).Dec()
+
+		switch {
+		case time.Since(c.created) >= t.maxAge():
+			t.closed(c, "expired")
+		case !probeConn(c):
+			t.closed(c, "stale")
+		default:
+			t.conns(key, "reused")
+			return c, true
+		}
+	}
+}
+
+// probeConn reports whether c is still open with nothing unread, see
+// above
+func probeConn(c *upstreamConn) bool {
+	if c.br.Buffered() > 0 {
+		return false
+	}
+	if alive, ok := probeSocket(c.Conn); ok {
+		return alive
+	}
+	_ = c.SetReadDeadline(time.Now().Add(upstreamProbeTimeout))
+	_, err := c.br.Peek(1)
+	_ = c.SetReadDeadline(time.Time{})
+
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// put parks c, or closes it when the pool is full or it is too old
+func (t *UpstreamTransport) put(c *upstreamConn) {
+	if time.Since(c.created) >= t.maxAge() {
+		t.closed(c, "expired")
+		return
+	}
+
+	t.mu.Lock()
+	if len(t.idle[c.key]) >= t.maxIdle() {
+		t.mu.Unlock()
+		t.closed(c, "full")
+		return
+	}
+	if t.idle == nil {
+		t.idle = make(map[string][]*upstreamConn)
+	}
+	t.idle[c.key] = append(t.idle[c.key], c)
+	t.mu.Unlock()
+	t.idleGauge(c.key).Inc()
+}
+
+// dial returns a new connection to key, through the dial already in
+// flight when there is one. It reports whether the connection was
+// parked rather than dialed.
+func (t *UpstreamTransport) dial(ctx context.Context, key, serverName string) (*upstreamConn, bool, error) {
+	// A connection dialed for requests that are gone is parked
+	t.dialsOnce.Do(func() {
+		t.dials.Orphan = func(_ string, conn net.Conn) { t.put(conn.(*upstreamConn)) }
+	})
+
+	conn, err := t.dials.Dial(ctx, key, func(ctx context.Context) (net.Conn, error) {
+		return t.connect(ctx, key, serverName)
+	})
+	if !errors.Is(err, errDialTaken) {
+		if err != nil {
+			return nil, false, err
+		}
+		return conn.(*upstreamConn), false, nil
+	}
+
+	// The upstream is up; a connection may have been parked meanwhile
+	if c, ok := t.get(key); ok {
+		return c, true, nil
+	}
+	c, err := t.connect(ctx, key, serverName)
+
+	return c, false, err
+}
+
+// connect dials key and runs the TLS handshake for https
+func (t *UpstreamTransport) connect(ctx context.Context, key, serverName string) (*upstreamConn, error) {
+	dial := t.Dial
+	if dial == nil {
+		dial = DefaultConnBudget.Dialer((&net.Dialer{Timeout: defaultUpstreamDialTimeout, KeepAlive: 30 * time.Second}).DialContext)
+	}
+	scheme, addr, _ := strings.Cut(key, "://")
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme == "https" {
+		cfg := t.TLSConfig.Clone()
+		if cfg == nil {
+			cfg = new(tls.Config)
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = serverName
+		}
+		cfg.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	t.conns(key, "dialed")
+
+	return &upstreamConn{Conn: conn, key: key, br: bufio.NewReader(conn), bw: bufio.NewWriter(conn), created: time.Now()}, nil
+}
+
+// upstreamKey returns the pool key of an upstream URL, with the default
+// port filled in
+func upstreamKey(u *url.URL) (string, error) {
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if port == "" {
+		return "", fmt.Errorf("upstream: unsupported scheme %q", u.Scheme)
+	}
+
+	return u.Scheme + "://" + net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// Warm dials connections to upstream until n of them are parked, or at
+// most MaxIdle. Dials that fail are reported joined; the connections
+// that were made are parked all the same.
+func (t *UpstreamTransport) Warm(ctx context.Context, upstream *url.URL, n int) error {
+	key, err := upstreamKey(upstream)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	n = min(n, t.maxIdle()) - len(t.idle[key])
+	t.mu.Unlock()
+
+	errs := make([]error, max(n, 0))
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Not coalesced: these are meant to be in flight together
+			c, err := t.connect(ctx, key, upstream.Hostname())
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			t.put(c)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// CloseIdleConnections closes the parked connections; http.Client and
+// httputil call it through the http.RoundTripper
+func (t *UpstreamTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	idle := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+
+	for key, conns := range idle {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+		t.idleGauge(key).Add(-float64(len(conns)))
+	}
+}
+
+// closeRequestBody closes the body of a request that won't be sent,
+// as a RoundTripper must
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
+
+// upstreamBody parks its connection once read to the end, and closes
+// it when closed before
+type upstreamBody struct {
+	io.ReadCloser
+	t     *UpstreamTransport
+	c     *upstreamConn
+	reuse bool        // Whether the connection stays open after the response
+	stop  func() bool // Stops the cancellation of the request
+	once  sync.Once
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.release(b.reuse)
+	} else if err != nil {
+		b.release(false)
+	}
+
+	return n, err
+}
+
+func (b *upstreamBody) Close() error {
+	b.release(false)
+	return nil
+}
+
+// release parks the connection or closes it, the first time
+func (b *upstreamBody) release(reuse bool) {
+	b.once.Do(func() {
+		// A cancelled request left a deadline behind
+		if b.stop() && reuse {
+			b.t.put(b.c)
+			return
+		}
+		_ = b.c.Close()
+	})
+}
+
+// upgradedBody is the connection after a 101 Switching Protocols
+type upgradedBody struct {
+	c *upstreamConn
+}
+
+func (b *upgradedBody) Read(p []byte) (int, error)  { return b.c.br.Read(p) }
+func (b *upgradedBody) Write(p []byte) (int, error) { return b.c.Write(p) }
+func (b *upgradedBody) Close() error                { return b.c.Close() }
+
+func TestUpstreamTransport(t *testing.T) {
+	var dials atomic.Int32
+	hold := make(chan struct{})
+	l := testListener(t)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/hold" {
+				<-hold
+			}
+			if r.URL.Path == "/upgrade" {
+				w.Header().Set("Connection", "Upgrade")
+				w.Header().Set("Upgrade", "echo")
+				w.WriteHeader(http.StatusSwitchingProtocols)
+				conn, rw, _ := http.NewResponseController(w).Hijack()
+				defer conn.Close()
+				line, _ := rw.ReadString('\n')
+				_, _ = rw.WriteString(line)
+				_ = rw.Flush()
+				return
+			}
+			fmt.Fprint(w, strings.Repeat("x", 10000))
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				dials.Add(1)
+			}
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+	base := "http://" + l.Addr().String()
+
+	tr := &UpstreamTransport{Metrics: new(Metrics), MaxIdle: 2}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	get := func(path string, read bool) error {
+		t.Helper()
+		resp, err := client.Get(base + path)
+		if err != nil {
+			return err
+		}
+		if read {
+			_, err = io.Copy(io.Discard, resp.Body)
+		}
+		_ = resp.Body.Close()
+		return err
+	}
+
+	// One connection for requests in a row
+	for i := 0; i < 5; i++ {
+		if err := get("/", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("expected 1 connection; actual: %d", n)
+	}
+
+	// A body closed before its end takes its connection along
+	if err := get("/", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := get("/", true); err != nil {
+		t.Fatal(err)
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("expected a second connection; actual: %d", n)
+	}
+
+	// Three at once, of which two are parked
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := get("/hold", true); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for dials.Load() < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	close(hold)
+	wg.Wait()
+
+	// The upstream closes the parked ones: the probe notices
+	srv.SetKeepAlivesEnabled(false)
+	srv.SetKeepAlivesEnabled(true)
+	time.Sleep(50 * time.Millisecond)
+	if err := get("/", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Too old to reuse
+	tr.MaxAge = time.Nanosecond
+	if err := get("/", true); err != nil {
+		t.Fatal(err)
+	}
+	tr.MaxAge = 0
+
+	// An upgraded connection belongs to the caller
+	req, _ := http.NewRequest(http.MethodGet, base+"/upgrade", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected upgrade %s %T", resp.Status, resp.Body)
+	}
+	_, _ = io.WriteString(rw, "hello\n")
+	if line, _ := bufio.NewReader(rw).ReadString('\n'); line != "hello\n" {
+		t.Errorf("unexpected upgraded echo %q", line)
+	}
+	_ = rw.Close()
+
+	b := new(strings.Builder)
+	_, _ = tr.Metrics.WriteTo(b)
+	key := base
+	for _, line := range []string{
+		`upstream_pool_conns_total{upstream="` + key + `",result="dialed"} 7`,
+		`upstream_pool_conns_total{upstream="` + key + `",result="reused"} 6`,
+		`upstream_pool_closed_total{upstream="` + key + `",reason="full"} 1`,
+		`upstream_pool_closed_total{upstream="` + key + `",reason="stale"} 2`,
+		`upstream_pool_closed_total{upstream="` + key + `",reason="expired"} 2`,
+		`upstream_pool_idle{upstream="` + key + `"} 0`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %s in the metrics:\n%s", line, b)
+		}
+	}
+}
+
+func TestUpstreamTransportWarm(t *testing.T) {
+	var dials atomic.Int32
+	l := testListener(t)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "ok")
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				dials.Add(1)
+			}
+		},
+	}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+	upstream, _ := url.Parse("http://" + l.Addr().String())
+
+	tr := &UpstreamTransport{Metrics: new(Metrics), MaxIdle: 3}
+	defer tr.CloseIdleConnections()
+
+	// Capped at MaxIdle, and topping up counts what's parked already
+	if err := tr.Warm(context.Background(), upstream, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Warm(context.Background(), upstream, 3); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); dials.Load() < 3 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := dials.Load(); n != 3 {
+		t.Errorf("expected 3 connections; actual: %d", n)
+	}
+
+	// Three requests at once, not a single handshake among them
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := (&http.Client{Transport: tr}).Get(upstream.String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			discard(resp)
+		}()
+	}
+	wg.Wait()
+	if n := dials.Load(); n != 3 {
+		t.Errorf("expected the warm connections used; actual: %d dialed", n)
+	}
+
+	// A dead upstream is reported
+	dead, _ := url.Parse("http://" + testUnusedAddr(t))
+	if err := tr.Warm(context.Background(), dead, 2); !IsRefused(err) {
+		t.Errorf("expected connection refused; actual: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// probeSocket peeks at the socket under conn without waiting: nothing
+// to read (EAGAIN) is the healthy case, EOF or early bytes mean the
+// connection is done. ok is false when conn has no socket to peek at,
+// or one speaking TLS, whose records may come unasked.
+func probeSocket(conn net.Conn) (alive, ok bool) {
+	sc, isSocket := conn.(syscall.Conn)
+	if !isSocket {
+		return false, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+
+	var buf [1]byte
+	var peekErr error
+	err = raw.Read(func(fd uintptr) bool {
+		_, _, peekErr = syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return true
+	})
+	if err != nil {
+		return false, true
+	}
+
+	return errors.Is(peekErr, syscall.EAGAIN), true
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// probeSocket is only implemented on Linux; elsewhere the probe reads
+// with a short deadline instead
+func probeSocket(net.Conn) (alive, ok bool) {
+	return false, false
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TLV over WebSocket
+//
+// Corporate firewalls often only let HTTP(S) out. A WebSocket starts as
+// an ordinary HTTP request and, once the server agrees, turns the TCP
+// connection underneath into a two-way message channel:
+//
+//	GET /tlv HTTP/1.1
+//	Upgrade: websocket
+//	Connection: Upgrade
+//	Sec-WebSocket-Key: <random base64>
+//	Sec-WebSocket-Version: 13
+//
+//	HTTP/1.1 101 Switching Protocols
+//	Upgrade: websocket
+//	Connection: Upgrade
+//	Sec-WebSocket-Accept: <base64 SHA-1 of the key and a fixed GUID>
+//
+// From then on both sides exchange frames (RFC 6455):
+//
+//	FIN+opcode | MASK+length (7, 16 or 64 bit) | masking key | payload
+//
+// Frames from the client are XOR-masked with a random key, so proxies
+// that don't understand WebSockets can't be tricked into caching
+// attacker-chosen bytes. Ping, pong and close are control frames.
+//
+// WSConn hides all that behind net.Conn: every Write is a binary
+// message, Read returns message payloads as one byte stream. So the TLV
+// code (decode, TLVConn, ConnHandlers) runs over it unchanged, just like
+// over TCP or PSKConn. See ConnectTunnel.go for HTTP CONNECT, the other
+// way through a proxy.
+
+const (
+	wsGUID        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsSubprotocol = "golearn-tlv"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsCloseNormal   = 1000
+	wsCloseProtocol = 1002
+)
+
+// ErrWebSocketProtocol is a frame breaking the rules
+var ErrWebSocketProtocol = errors.New("websocket: protocol error")
+
+// WSConn is a WebSocket connection carrying a byte stream
+type WSConn struct {
+	net.Conn
+
+	// OnPong, when set, is called by Read with the payload of each pong
+	OnPong func(data []byte)
+
+	r      *bufio.Reader // May hold bytes read with the handshake
+	client bool          // Clients mask, servers don't
+
+	wmu       sync.Mutex // Data and control frames interleave
+	closeOnce sync.Once
+	unread    []byte // Rest of the current frame's payload
+	closed    bool   // Close frame received
+}
+
+// wsAccept computes Sec-WebSocket-Accept for a key
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether a comma separated header has token
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// WSUpgrade turns an HTTP request into a WebSocket connection. On
+// failure it has already answered the request.
+func WSUpgrade(w http.ResponseWriter, r *http.Request) (*WSConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%w: not an upgrade request", ErrWebSocketProtocol)
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	// The server's deadlines no longer apply to a hijacked connection
+	_ = conn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n"
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", wsSubprotocol) {
+		response += "Sec-WebSocket-Protocol: " + wsSubprotocol + "\r\n"
+	}
+	if _, err := io.WriteString(conn, response+"\r\n"); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &WSConn{Conn: conn, r: brw.Reader}, nil
+}
+
+// WSHandler serves TLV (or any stream protocol) over WebSockets with h
+func WSHandler(h ConnHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := WSUpgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// http.Server doesn't track hijacked connections: Shutdown
+		// neither waits for nor cancels them
+		h(r.Context(), conn)
+	})
+}
+
+// DialWebSocket connects to a ws:// or wss:// URL. tlsConfig is used
+// for wss and may be nil.
+func DialWebSocket(ctx context.Context, rawURL string, tlsConfig *tls.Config) (*WSConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		conn, err = new(net.Dialer).DialContext(ctx, "tcp", host)
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", host)
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := wsClientHandshake(ctx, conn, u)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// wsClientHandshake upgrades conn, e.g. one coming out of a CONNECT
+// tunnel, to a client WebSocket for u
+func wsClientHandshake(ctx context.Context, conn net.Conn, u *url.URL) (*WSConn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {key},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {wsSubprotocol},
+		},
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket: handshake: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, fmt.Errorf("%w: bad Sec-WebSocket-Accept", ErrWebSocketProtocol)
+	}
+
+	return &WSConn{Conn: conn, r: r, client: true}, nil
+}
+
+// writeFrame sends a single final frame
+func (c *WSConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode // FIN
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	frame := payload
+	if c.client {
+		header[1] |= 0x80
+		var mask [4]byte
+		_, _ = rand.Read(mask[:])
+		header = append(header, mask[:]...)
+
+		// Mask a copy, the caller's buffer stays as it was
+		frame = make([]byte, len(payload))
+		for i, b := range payload {
+			frame[i] = b ^ mask[i%4]
+		}
+	}
+
+	// One write, so frames from different goroutines can't interleave
+	_, err := c.Conn.Write(append(header, frame...))
+
+	return err
+}
+
+// readFrame reads a frame header and payload
+func (c *WSConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0f
+	masked := head[1]&0x80 != 0
+
+	if head[0]&0x70 != 0 || masked == c.client {
+		// Extensions weren't negotiated; clients must mask, servers not
+		return false, 0, nil, ErrWebSocketProtocol
+	}
+
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if size > uint64(MaxPayloadSize) || (opcode >= wsOpClose && (size > 125 || !fin)) {
+		return false, 0, nil, ErrWebSocketProtocol
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Read returns message payload bytes, answering control frames on the way
+func (c *WSConn) Read(p []byte) (int, error) {
+	for len(c.unread) == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+
+		_, opcode, payload, err := c.readFrame()
+		if errors.Is(err, ErrWebSocketProtocol) {
+			c.closeWith(wsCloseProtocol)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsOpBinary, wsOpText, wsOpContinuation:
+			// As a stream, message boundaries don't matter
+			c.unread = payload
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, err
+			}
+		case wsOpPong:
+			if c.OnPong != nil {
+				c.OnPong(payload)
+			}
+		case wsOpClose:
+			// Echo the close and we're done
+			c.closed = true
+			c.closeWith(wsCloseNormal)
+		default:
+			c.closeWith(wsCloseProtocol)
+			return 0, ErrWebSocketProtocol
+		}
+	}
+
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+
+	return n, nil
+}
+
+// Write sends p as one binary message
+func (c *WSConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// WriteText sends p as one text message, which browsers hand to
+// onmessage as a string rather than a Blob
+func (c *WSConn) WriteText(p []byte) error {
+	return c.writeFrame(wsOpText, p)
+}
+
+// Ping sends a ping; the peer's pong is consumed by Read
+func (c *WSConn) Ping(data []byte) error {
+	return c.writeFrame(wsOpPing, data)
+}
+
+// closeWith sends a close frame with code, once
+func (c *WSConn) closeWith(code uint16) {
+	c.closeOnce.Do(func() {
+		_ = c.writeFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, code))
+	})
+}
+
+// Close says goodbye and closes the connection
+func (c *WSConn) Close() error {
+	c.closeWith(wsCloseNormal)
+
+	return c.Conn.Close()
+}
+
+func TestWebSocketTLV(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/tlv", WSHandler(func(_ context.Context, conn net.Conn) {
+		// The very same server code as over plain TCP
+		_ = tlvAckServer(TLVServer(conn, nil))
+	}))
+
+	l := testListener(t)
+	srv := &http.Server{Handler: mux, ErrorLog: log.New(io.Discard, "", 0)}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := DialWebSocket(ctx, "ws://"+l.Addr().String()+"/tlv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	client := TLVClient(conn, nil)
+	for _, text := range []string{"hello", strings.Repeat("x", 100_000)} {
+		if err := client.Send(String(text)); err != nil {
+			t.Fatal(err)
+		}
+		p, err := client.Receive()
+		if err != nil || p.String() != "ack:"+text {
+			t.Fatalf("unexpected reply (%d bytes), %v", len(p.String()), err)
+		}
+	}
+
+	// Pongs are handled below the stream
+	if err := conn.Ping([]byte("are you there")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Send(String("after ping"))
+	if p, err := client.Receive(); err != nil || p.String() != "ack:after ping" {
+		t.Errorf("unexpected reply %v, %v", p, err)
+	}
+
+	// Plain HTTP requests are turned away
+	resp, err := http.Get("http://" + l.Addr().String() + "/tlv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("expected 426; actual: %d", resp.StatusCode)
+	}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	c := &WSConn{Conn: client, r: bufio.NewReader(client), client: true}
+	s := &WSConn{Conn: server, r: bufio.NewReader(server)}
+
+	// Every length encoding: 7 bit, 16 bit and 64 bit
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		msg := make([]byte, size)
+		_, _ = rand.Read(msg)
+		go func() { _, _ = c.Write(msg) }()
+
+		_, opcode, payload, err := s.readFrame()
+		if err != nil || opcode != wsOpBinary || string(payload) != string(msg) {
+			t.Fatalf("size %d: unexpected frame op=%d len=%d, %v", size, opcode, len(payload), err)
+		}
+	}
+
+	// Servers must not receive unmasked frames
+	rawClient, rawServer := net.Pipe()
+	defer rawClient.Close()
+	defer rawServer.Close()
+	unmasked := &WSConn{Conn: rawClient}
+	go func() { _, _ = unmasked.Write([]byte("unmasked")) }()
+	strict := &WSConn{Conn: rawServer, r: bufio.NewReader(rawServer)}
+	if _, _, _, err := strict.readFrame(); !errors.Is(err, ErrWebSocketProtocol) {
+		t.Errorf("expected protocol error; actual: %v", err)
+	}
+
+	// A close frame ends the stream on the other side
+	go func() { _ = c.writeFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal)) }()
+	go func() { _, _ = io.Copy(io.Discard, c) }() // Takes the close echo
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF; actual: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+)
+
+// TLV over QUIC
+//
+// The parent module carves TCP connections into streams with its own
+// multiplexer (TLVMux.go), and pays for TCP underneath: one lost packet
+// holds up every stream until it's retransmitted, since TCP delivers
+// one byte stream in order; a stream whose reader falls behind stalls
+// the whole connection, for lack of per-stream flow control; and every
+// new connection costs a TCP handshake, then a TLS one.
+//
+// QUIC (RFC 9000) moves the streams into the transport, over UDP:
+//
+// - streams are independent: a lost packet only delays the streams
+//   whose data it carried, and each stream has its own flow control
+//   window, so a slow reader only stops its own stream
+// - the TLS 1.3 handshake is the transport handshake, one round trip
+//   for both; and a client coming back with a session ticket sends its
+//   first request in that very first flight (0-RTT), no round trip at
+//   all. Like any 0-RTT data it can be replayed by an attacker, so it
+//   should only carry requests that are safe to repeat.
+// - connections are identified by IDs rather than addresses, so they
+//   survive a client changing networks
+//
+// The standard library has no QUIC, hence this module of its own
+// around quic-go, keeping the parent free of dependencies. It runs the
+// parent's TLV messages (TLV.go) and its echo server (Echo.go) over
+// QUIC streams:
+//
+//	cd quicx
+//	go run . serve -addr 127.0.0.1:4433
+//	go run . send -addr 127.0.0.1:4433 -insecure hello world
+//
+// send puts every message on a stream of its own, all at once, over
+// one connection, then does it again over a new connection, which
+// resumes the session with 0-RTT.
+
+// commands maps the first command line argument to the tool it runs
+var commands = map[string]func(args []string) error{
+	"send":  sendMain,
+	"serve": serveMain,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [arguments]\n\ncommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", name)
+	}
+}
+
+// signalContext returns a context canceled on Ctrl+C
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// TLV messages
+//
+// The frames of TLVBinary.go and TLVString.go in the parent module,
+// byte for byte: type (1) | length (4) | value. The parent is a package
+// main, which can't be imported, hence this copy; a client of one can
+// talk to a server of the other through a TLV-over-QUIC gateway without
+// translating anything.
+
+// Message types, as in the parent module
+const (
+	BinaryType uint8 = iota + 1
+	StringType
+
+	// MaxPayloadSize bounds what a peer can make us allocate
+	MaxPayloadSize uint32 = 10 << 20
+)
+
+// ErrMaxPayloadSize is returned for a message over MaxPayloadSize
+var ErrMaxPayloadSize = errors.New("maximum payload size exceeded")
+
+// MessageConn sends and receives TLV messages over a stream: a QUIC
+// stream here, any io.ReadWriter really
+type MessageConn struct {
+	rw io.ReadWriter
+}
+
+// NewMessageConn returns a MessageConn over rw
+func NewMessageConn(rw io.ReadWriter) *MessageConn {
+	return &MessageConn{rw: rw}
+}
+
+// Send writes a message, header and payload together
+func (c *MessageConn) Send(typ uint8, payload []byte) error {
+	if uint64(len(payload)) > uint64(MaxPayloadSize) {
+		return ErrMaxPayloadSize
+	}
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	buffers := net.Buffers{header[:], payload}
+	_, err := buffers.WriteTo(c.rw)
+
+	return err
+}
+
+// Receive reads a message. io.EOF means the peer is done sending,
+// between two messages.
+func (c *MessageConn) Receive() (uint8, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.rw, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxPayloadSize {
+		return 0, nil, ErrMaxPayloadSize
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}